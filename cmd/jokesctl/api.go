@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// request describes one call to the gateway.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// admin sends the request to the gateway's admin host
+	admin bool
+	// header holds extra request headers
+	header http.Header
+}
+
+// do sends req and decodes a JSON response into out, which may be nil.
+// Responses other than 2xx become errors carrying the service's message.
+func do(ctx context.Context, req request, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	u := strings.TrimRight(cfg.gateway, "/") + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		data, err := json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return err
+	}
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+	if req.body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if req.admin {
+		httpReq.Host = cfg.adminHost
+		if cfg.adminToken != "" {
+			httpReq.Header.Set("X-Admin-Token", cfg.adminToken)
+		}
+	}
+	if cfg.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+cfg.token)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp.StatusCode, data)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// responseError turns an error response into an error, using the
+// service's {"error": "..."} message when there is one.
+func responseError(status int, data []byte) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return fmt.Errorf("%s (%d)", body.Error, status)
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("not found (404); is %s the gateway and --admin-host its admin host?", cfg.gateway)
+	}
+	return fmt.Errorf("request failed with status %d", status)
+}
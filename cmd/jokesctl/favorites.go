@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Favorite is a joke a user saved.
+type Favorite struct {
+	ID        string    `json:"id"`
+	JokeID    string    `json:"joke_id,omitempty"`
+	Joke      string    `json:"joke"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func favoritesCommand() *cobra.Command {
+	var tenant string
+	cmd := &cobra.Command{
+		Use:   "favorites USER_ID",
+		Short: "Show a user's favorites",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := request{
+				method: http.MethodGet,
+				path:   "/admin/favorites",
+				query:  url.Values{"user_id": {args[0]}},
+				admin:  true,
+			}
+			if tenant != "" {
+				req.header = http.Header{"X-Tenant-Id": {tenant}}
+			}
+
+			var resp struct {
+				Favorites []Favorite `json:"favorites"`
+				Count     int        `json:"count"`
+			}
+			if err := do(cmd.Context(), req, &resp); err != nil {
+				return err
+			}
+
+			return render(resp, []string{"ID", "JOKE ID", "ADDED", "JOKE"}, func() [][]string {
+				rows := make([][]string, 0, len(resp.Favorites))
+				for _, f := range resp.Favorites {
+					rows = append(rows, []string{
+						f.ID, f.JokeID, f.CreatedAt.Format(time.RFC3339), truncate(f.Joke, 60),
+					})
+				}
+				return rows
+			})
+		},
+	}
+	cmd.Flags().StringVar(&tenant, "tenant", "", "tenant the user belongs to")
+	return cmd
+}
@@ -0,0 +1,10 @@
+module github.com/navyn13/microservice-joke/cmd/jokesctl
+
+go 1.23.0
+
+require github.com/spf13/cobra v1.9.1
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.6 // indirect
+)
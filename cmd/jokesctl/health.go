@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultServices are the services' addresses when run with
+// docker-compose; the gateway is checked at --gateway.
+var defaultServices = map[string]string{
+	"jokes":     "http://localhost:8081",
+	"analytics": "http://localhost:8082",
+	"user":      "http://localhost:8083",
+}
+
+// HealthResult is the outcome of one health check.
+type HealthResult struct {
+	Service   string `json:"service"`
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+func healthCommand() *cobra.Command {
+	var services map[string]string
+	cmd := &cobra.Command{
+		Use:   "health",
+		Short: "Check the health of the gateway and every service",
+		Long: "Check GET /healthz of the gateway and every service. Services are\n" +
+			"looked for at their docker-compose ports unless given with --service;\n" +
+			"--service name= skips one. Exits non-zero if any check fails.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := map[string]string{"gateway": cfg.gateway}
+			for name, url := range defaultServices {
+				targets[name] = url
+			}
+			for name, url := range services {
+				if url == "" {
+					delete(targets, name)
+					continue
+				}
+				targets[name] = url
+			}
+
+			results := checkHealth(cmd.Context(), targets)
+			err := render(results, []string{"SERVICE", "URL", "HEALTHY", "STATUS", "LATENCY", "ERROR"}, func() [][]string {
+				rows := make([][]string, 0, len(results))
+				for _, r := range results {
+					rows = append(rows, []string{
+						r.Service, r.URL, fmt.Sprint(r.Healthy), r.Status,
+						fmt.Sprintf("%dms", r.LatencyMS), r.Error,
+					})
+				}
+				return rows
+			})
+			if err != nil {
+				return err
+			}
+
+			unhealthy := 0
+			for _, r := range results {
+				if !r.Healthy {
+					unhealthy++
+				}
+			}
+			if unhealthy > 0 {
+				return fmt.Errorf("%d of %d services unhealthy", unhealthy, len(results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringToStringVar(&services, "service", nil, "service URL as name=url, repeatable")
+	return cmd
+}
+
+// checkHealth checks every target concurrently and returns the results
+// sorted by service name.
+func checkHealth(ctx context.Context, targets map[string]string) []HealthResult {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]HealthResult, 0, len(targets))
+	)
+	for name, url := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := checkService(ctx, name, url)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Service < results[j].Service })
+	return results
+}
+
+// checkService calls a service's /healthz. A service is healthy if it
+// answers 200 with status "healthy".
+func checkService(ctx context.Context, name, url string) HealthResult {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	result := HealthResult{Service: name, URL: url}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(url, "/")+"/healthz", nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Status = "unreachable"
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	result.Status = body.Status
+	if result.Status == "" {
+		result.Status = resp.Status
+	}
+	result.Healthy = resp.StatusCode == http.StatusOK && body.Status == "healthy"
+	if !result.Healthy && result.Error == "" {
+		result.Error = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return result
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Joke is a joke as listed by the jokes service's admin API.
+type Joke struct {
+	ID        string     `json:"id"`
+	Text      string     `json:"joke"`
+	Category  string     `json:"category,omitempty"`
+	Author    string     `json:"author,omitempty"`
+	Language  string     `json:"language"`
+	CreatedAt time.Time  `json:"created_at"`
+	Safe      bool       `json:"safe"`
+	Retired   bool       `json:"retired"`
+	State     string     `json:"state"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	Schedule  *Schedule  `json:"schedule,omitempty"`
+	InSeason  bool       `json:"in_season"`
+}
+
+var jokeHeaders = []string{"ID", "CATEGORY", "LANGUAGE", "SAFE", "STATE", "PUBLISH AT", "IN SEASON", "JOKE"}
+
+func jokeRow(j Joke) []string {
+	publishAt := ""
+	if j.PublishAt != nil {
+		publishAt = j.PublishAt.Format(time.RFC3339)
+	}
+	return []string{
+		j.ID, j.Category, j.Language,
+		strconv.FormatBool(j.Safe), j.State, publishAt, strconv.FormatBool(j.InSeason),
+		truncate(j.Text, 60),
+	}
+}
+
+func jokesCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "jokes",
+		Short: "List, add, publish, retire and schedule jokes",
+	}
+	cmd.AddCommand(
+		jokesListCommand(), jokesAddCommand(), jokesDeleteCommand(),
+		jokesPublishCommand(), jokesDraftCommand(),
+		jokesScheduleCommand(), jokesUnscheduleCommand(), jokesSchedulesCommand(),
+	)
+	return cmd
+}
+
+func jokesListCommand() *cobra.Command {
+	var all bool
+	var state string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List jokes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp struct {
+				Jokes []Joke `json:"jokes"`
+				Count int    `json:"count"`
+			}
+			err := do(cmd.Context(), request{
+				method: http.MethodGet,
+				path:   "/admin/jokes",
+				query:  url.Values{"include_retired": {strconv.FormatBool(all)}, "state": {state}},
+				admin:  true,
+			}, &resp)
+			if err != nil {
+				return err
+			}
+
+			return render(resp, jokeHeaders, func() [][]string {
+				rows := make([][]string, 0, len(resp.Jokes))
+				for _, j := range resp.Jokes {
+					rows = append(rows, jokeRow(j))
+				}
+				return rows
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&all, "all", false, "include retired jokes")
+	cmd.Flags().StringVar(&state, "state", "", "only jokes in this state: draft, published or archived")
+	return cmd
+}
+
+func jokesAddCommand() *cobra.Command {
+	var body struct {
+		Joke      string     `json:"joke"`
+		ID        string     `json:"id,omitempty"`
+		Category  string     `json:"category,omitempty"`
+		Author    string     `json:"author,omitempty"`
+		Language  string     `json:"language,omitempty"`
+		State     string     `json:"state,omitempty"`
+		PublishAt *time.Time `json:"publish_at,omitempty"`
+	}
+	var draft bool
+	var publishAt string
+	cmd := &cobra.Command{
+		Use:   "add TEXT",
+		Short: "Add a joke",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body.Joke = args[0]
+			if draft || publishAt != "" {
+				body.State = "draft"
+			}
+			if publishAt != "" {
+				t, err := time.Parse(time.RFC3339, publishAt)
+				if err != nil {
+					return fmt.Errorf("--publish-at must be an RFC 3339 time: %w", err)
+				}
+				body.PublishAt = &t
+			}
+
+			var added Joke
+			err := do(cmd.Context(), request{
+				method: http.MethodPost,
+				path:   "/admin/jokes",
+				body:   body,
+				admin:  true,
+			}, &added)
+			if err != nil {
+				return err
+			}
+
+			return render(added, jokeHeaders, func() [][]string {
+				return [][]string{jokeRow(added)}
+			})
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&body.ID, "id", "", "explicit joke ID; derived from the text if empty")
+	flags.StringVar(&body.Category, "category", "", "joke category")
+	flags.StringVar(&body.Author, "author", "", "joke author")
+	flags.StringVar(&body.Language, "language", "", "language tag (default en)")
+	flags.BoolVar(&draft, "draft", false, "add the joke as a draft, not served until published")
+	flags.StringVar(&publishAt, "publish-at", "", "add the joke as a draft published at this RFC 3339 time")
+	return cmd
+}
+
+func jokesDeleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "delete ID",
+		Aliases: []string{"retire", "archive"},
+		Short:   "Retire a joke so it is no longer served",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp struct {
+				ID        string `json:"id"`
+				Retired   bool   `json:"retired"`
+				RetiredAt string `json:"retired_at"`
+			}
+			err := do(cmd.Context(), request{
+				method: http.MethodDelete,
+				path:   "/admin/jokes/" + url.PathEscape(args[0]),
+				admin:  true,
+			}, &resp)
+			if err != nil {
+				return err
+			}
+
+			return render(resp, []string{"ID", "RETIRED AT"}, func() [][]string {
+				return [][]string{{resp.ID, resp.RetiredAt}}
+			})
+		},
+	}
+}
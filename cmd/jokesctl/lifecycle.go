@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// JokeState moves a joke to draft, published or archived; PublishAt
+// embargoes a draft until then.
+type JokeState struct {
+	State     string     `json:"state"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+}
+
+// setJokeState moves the joke with id to state and renders it.
+func setJokeState(cmd *cobra.Command, id string, state JokeState) error {
+	var updated Joke
+	err := do(cmd.Context(), request{
+		method: http.MethodPut,
+		path:   "/admin/jokes/" + url.PathEscape(id) + "/state",
+		body:   state,
+		admin:  true,
+	}, &updated)
+	if err != nil {
+		return err
+	}
+
+	return render(updated, jokeHeaders, func() [][]string {
+		return [][]string{jokeRow(updated)}
+	})
+}
+
+func jokesPublishCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "publish ID",
+		Short: "Publish a draft or archived joke so it is served",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setJokeState(cmd, args[0], JokeState{State: "published"})
+		},
+	}
+}
+
+func jokesDraftCommand() *cobra.Command {
+	var publishAt string
+	cmd := &cobra.Command{
+		Use:   "draft ID",
+		Short: "Take a joke back to draft, optionally embargoed until a time",
+		Example: `  jokesctl jokes draft xmas-1
+  jokesctl jokes draft xmas-1 --publish-at 2026-12-24T18:00:00Z`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := JokeState{State: "draft"}
+			if publishAt != "" {
+				t, err := time.Parse(time.RFC3339, publishAt)
+				if err != nil {
+					return fmt.Errorf("--publish-at must be an RFC 3339 time: %w", err)
+				}
+				state.PublishAt = &t
+			}
+			return setJokeState(cmd, args[0], state)
+		},
+	}
+	cmd.Flags().StringVar(&publishAt, "publish-at", "", "RFC 3339 time the draft is published at")
+	return cmd
+}
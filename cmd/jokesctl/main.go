@@ -0,0 +1,80 @@
+// jokesctl manages a running jokes stack through the gateway's admin API.
+//
+// Commands:
+//
+//	jokesctl jokes list [--all]        -> list jokes, retired ones too with --all (--state)
+//	jokesctl jokes add TEXT            -> add a joke (--id, --category, --author, --language,
+//	                                      --draft, --publish-at)
+//	jokesctl jokes delete ID           -> retire (archive) a joke
+//	jokesctl jokes publish ID          -> publish a draft or archived joke
+//	jokesctl jokes draft ID            -> take a joke back to draft (--publish-at)
+//	jokesctl jokes schedule ID         -> serve a joke only in season (--window, --cron, --timezone)
+//	jokesctl jokes unschedule ID       -> serve a joke all year again
+//	jokesctl jokes schedules           -> seasonal jokes and whether each is in season
+//	jokesctl stats                     -> analytics counters
+//	jokesctl stats reset [--tenant]    -> zero the analytics counters
+//	jokesctl favorites USER_ID         -> a user's favorites
+//	jokesctl health                    -> health of the gateway and every service
+//
+// Admin commands are sent to the gateway with the admin host in the Host
+// header, so jokesctl works against a port-forwarded gateway as well as the
+// admin hostname itself. Admin commands need the gateway's admin token
+// (--admin-token), or an ID token of one of its admin users (--token).
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// config holds the global flags.
+type config struct {
+	gateway    string
+	adminHost  string
+	adminToken string
+	token      string
+	output     string
+	timeout    time.Duration
+}
+
+var cfg config
+
+func main() {
+	root := &cobra.Command{
+		Use:           "jokesctl",
+		Short:         "Manage the jokes microservices",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if cfg.output != "table" && cfg.output != "json" {
+				return fmt.Errorf("output must be table or json, not %q", cfg.output)
+			}
+			return nil
+		},
+	}
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&cfg.gateway, "gateway", envOr("JOKESCTL_GATEWAY", "http://localhost:8000"), "gateway URL")
+	flags.StringVar(&cfg.adminHost, "admin-host", envOr("JOKESCTL_ADMIN_HOST", "admin.jokes.example"), "host the gateway serves admin routes on")
+	flags.StringVar(&cfg.adminToken, "admin-token", os.Getenv("JOKESCTL_ADMIN_TOKEN"), "gateway admin token sent with admin commands")
+	flags.StringVar(&cfg.token, "token", os.Getenv("JOKESCTL_TOKEN"), "OIDC ID token sent as a bearer token")
+	flags.StringVarP(&cfg.output, "output", "o", "table", "output format: table or json")
+	flags.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "timeout of each request")
+
+	root.AddCommand(jokesCommand(), statsCommand(), favoritesCommand(), healthCommand())
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ScheduleWindow is a period a seasonal joke is served in: "MM-DD" dates
+// recurring yearly, or RFC 3339 times.
+type ScheduleWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Schedule limits when a joke is served.
+type Schedule struct {
+	Windows  []ScheduleWindow `json:"windows,omitempty"`
+	Cron     string           `json:"cron,omitempty"`
+	Timezone string           `json:"timezone,omitempty"`
+}
+
+// ScheduledJoke is a schedule as listed by the jokes service.
+type ScheduledJoke struct {
+	JokeID string `json:"joke_id"`
+	Schedule
+	Active bool `json:"active"`
+}
+
+var scheduleHeaders = []string{"JOKE ID", "WINDOWS", "CRON", "TIMEZONE", "IN SEASON"}
+
+func scheduleRow(s ScheduledJoke) []string {
+	windows := make([]string, 0, len(s.Windows))
+	for _, w := range s.Windows {
+		windows = append(windows, w.From+".."+w.To)
+	}
+	return []string{s.JokeID, strings.Join(windows, ","), s.Cron, s.Timezone, strconv.FormatBool(s.Active)}
+}
+
+func jokesScheduleCommand() *cobra.Command {
+	var windows []string
+	var schedule Schedule
+	cmd := &cobra.Command{
+		Use:   "schedule ID",
+		Short: "Serve a joke only in the given windows and/or while a cron expression matches",
+		Example: `  jokesctl jokes schedule halloween-1 --window 10-01..10-31
+  jokesctl jokes schedule friday-1 --cron "* 17-23 * * 5" --timezone Europe/Berlin`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, w := range windows {
+				from, to, ok := strings.Cut(w, "..")
+				if !ok {
+					return fmt.Errorf("window %q must be FROM..TO", w)
+				}
+				schedule.Windows = append(schedule.Windows, ScheduleWindow{From: from, To: to})
+			}
+
+			var scheduled ScheduledJoke
+			err := do(cmd.Context(), request{
+				method: http.MethodPut,
+				path:   "/admin/jokes/" + url.PathEscape(args[0]) + "/schedule",
+				body:   schedule,
+				admin:  true,
+			}, &scheduled)
+			if err != nil {
+				return err
+			}
+
+			return render(scheduled, scheduleHeaders, func() [][]string {
+				return [][]string{scheduleRow(scheduled)}
+			})
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringArrayVar(&windows, "window", nil, "FROM..TO, as MM-DD (yearly) or RFC 3339 times; repeatable")
+	flags.StringVar(&schedule.Cron, "cron", "", "five-field cron expression the joke is served while matching")
+	flags.StringVar(&schedule.Timezone, "timezone", "", "IANA timezone the schedule is evaluated in")
+	return cmd
+}
+
+func jokesUnscheduleCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unschedule ID",
+		Short: "Remove a joke's schedule so it is served all year",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp struct {
+				JokeID string `json:"joke_id"`
+				Status string `json:"status"`
+			}
+			err := do(cmd.Context(), request{
+				method: http.MethodDelete,
+				path:   "/admin/jokes/" + url.PathEscape(args[0]) + "/schedule",
+				admin:  true,
+			}, &resp)
+			if err != nil {
+				return err
+			}
+
+			return render(resp, []string{"JOKE ID", "STATUS"}, func() [][]string {
+				return [][]string{{resp.JokeID, resp.Status}}
+			})
+		},
+	}
+}
+
+func jokesSchedulesCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schedules",
+		Short: "List seasonal jokes and whether each is in season",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp struct {
+				Schedules []ScheduledJoke `json:"schedules"`
+				Count     int             `json:"count"`
+			}
+			err := do(cmd.Context(), request{
+				method: http.MethodGet,
+				path:   "/admin/schedules",
+				admin:  true,
+			}, &resp)
+			if err != nil {
+				return err
+			}
+
+			return render(resp, scheduleHeaders, func() [][]string {
+				rows := make([][]string, 0, len(resp.Schedules))
+				for _, s := range resp.Schedules {
+					rows = append(rows, scheduleRow(s))
+				}
+				return rows
+			})
+		},
+	}
+}
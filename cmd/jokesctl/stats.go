@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func statsCommand() *cobra.Command {
+	var tenant string
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show analytics counters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := request{method: http.MethodGet, path: "/api/v1/stats"}
+			if tenant != "" {
+				req.header = http.Header{"X-Tenant-Id": {tenant}}
+			}
+
+			var stats map[string]interface{}
+			if err := do(cmd.Context(), req, &stats); err != nil {
+				return err
+			}
+
+			return render(stats, []string{"STAT", "VALUE"}, func() [][]string {
+				return keyValueRows(stats)
+			})
+		},
+	}
+	cmd.Flags().StringVar(&tenant, "tenant", "", "tenant whose counters to show")
+	cmd.AddCommand(statsResetCommand(), statsReplayCommand())
+	return cmd
+}
+
+func statsResetCommand() *cobra.Command {
+	var (
+		tenant string
+		yes    bool
+	)
+	cmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Zero the analytics counters of a tenant, or of all tenants",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scope := "all tenants"
+			if tenant != "" {
+				scope = "tenant " + tenant
+			}
+			if !yes && !confirm(fmt.Sprintf("Reset analytics counters of %s?", scope)) {
+				return fmt.Errorf("aborted")
+			}
+
+			req := request{method: http.MethodPost, path: "/admin/stats/reset", admin: true}
+			if tenant != "" {
+				req.query = url.Values{"tenant": {tenant}}
+			}
+
+			var resp struct {
+				Status   string                 `json:"status"`
+				Previous map[string]interface{} `json:"previous"`
+			}
+			if err := do(cmd.Context(), req, &resp); err != nil {
+				return err
+			}
+
+			return render(resp, []string{"PREVIOUS", "VALUE"}, func() [][]string {
+				return keyValueRows(resp.Previous)
+			})
+		},
+	}
+	cmd.Flags().StringVar(&tenant, "tenant", "", "tenant to reset; all tenants if empty")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "don't ask for confirmation")
+	return cmd
+}
+
+func statsReplayCommand() *cobra.Command {
+	var (
+		from string
+		yes  bool
+	)
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Rebuild the analytics aggregates from the raw event log",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scope := "the whole event log"
+			if from != "" {
+				scope = "the events logged since " + from
+			}
+			if !yes && !confirm(fmt.Sprintf("Zero the analytics aggregates and replay %s?", scope)) {
+				return fmt.Errorf("aborted")
+			}
+
+			req := request{method: http.MethodPost, path: "/admin/stats/replay", admin: true}
+			if from != "" {
+				req.query = url.Values{"from": {from}}
+			}
+
+			var resp struct {
+				Status string `json:"status"`
+				Result struct {
+					Replayed   int64            `json:"replayed"`
+					ByType     map[string]int64 `json:"by_type"`
+					Skipped    int64            `json:"skipped"`
+					Unreadable int64            `json:"unreadable"`
+				} `json:"result"`
+			}
+			if err := do(cmd.Context(), req, &resp); err != nil {
+				return err
+			}
+
+			return render(resp, []string{"EVENTS", "COUNT"}, func() [][]string {
+				rows := [][]string{
+					{"replayed", fmt.Sprint(resp.Result.Replayed)},
+					{"skipped", fmt.Sprint(resp.Result.Skipped)},
+					{"unreadable", fmt.Sprint(resp.Result.Unreadable)},
+				}
+				types := make([]string, 0, len(resp.Result.ByType))
+				for eventType := range resp.Result.ByType {
+					types = append(types, eventType)
+				}
+				sort.Strings(types)
+				for _, eventType := range types {
+					rows = append(rows, []string{"  " + eventType, fmt.Sprint(resp.Result.ByType[eventType])})
+				}
+				return rows
+			})
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "replay the events logged since this RFC 3339 time; all if empty")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "don't ask for confirmation")
+	return cmd
+}
+
+// keyValueRows lists a JSON object as rows sorted by key; values other than
+// strings are printed as JSON.
+func keyValueRows(m map[string]interface{}) [][]string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		value, ok := m[k].(string)
+		if !ok {
+			data, _ := json.Marshal(m[k])
+			value = string(data)
+		}
+		rows = append(rows, []string{k, value})
+	}
+	return rows
+}
+
+// confirm asks a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Stats are the headline counters of the analytics service.
+type Stats struct {
+	TotalRequests int64     `json:"total_requests"`
+	TotalJokes    int64     `json:"total_jokes"`
+	LastUpdate    time.Time `json:"last_update"`
+	// Favorites and merges as reported by the user service
+	FavoritesAdded   int64 `json:"favorites_added"`
+	FavoritesDeleted int64 `json:"favorites_deleted"`
+	UserMerges       int64 `json:"user_merges"`
+}
+
+// JokeReactions are the reactions to one joke.
+type JokeReactions struct {
+	JokeID     string  `json:"joke_id"`
+	Laugh      int64   `json:"laugh"`
+	Groan      int64   `json:"groan"`
+	Meh        int64   `json:"meh"`
+	Total      int64   `json:"total"`
+	GroanRatio float64 `json:"groan_ratio"`
+}
+
+// ReactionStats ranks jokes by groan ratio.
+type ReactionStats struct {
+	Jokes []JokeReactions `json:"jokes"`
+	Count int             `json:"count"`
+}
+
+// LatencySummary describes the latency of one backend endpoint.
+type LatencySummary struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	MaxMs  float64 `json:"max_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+// LatencyStats are latency summaries keyed by endpoint.
+type LatencyStats struct {
+	Endpoints        map[string]LatencySummary `json:"endpoints"`
+	RelativeAccuracy float64                   `json:"relative_accuracy"`
+}
+
+// LeaderboardEntry is a user's rank on the leaderboard.
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	UserID    string `json:"user_id"`
+	Favorites int64  `json:"favorites"`
+	Jokes     int64  `json:"jokes"`
+}
+
+// Leaderboard ranks users over a window.
+type Leaderboard struct {
+	Window  string             `json:"window"`
+	By      string             `json:"by"`
+	Leaders []LeaderboardEntry `json:"leaders"`
+	Count   int                `json:"count"`
+}
+
+// UniqueCount is the approximate number of distinct users and visitors in
+// a period; Date is set for per-day counts.
+type UniqueCount struct {
+	Date     string `json:"date,omitempty"`
+	Users    int64  `json:"unique_users"`
+	Visitors int64  `json:"unique_visitors"`
+}
+
+// Uniques counts distinct users and visitors over a window.
+type Uniques struct {
+	Window string `json:"window"`
+	UniqueCount
+	// Days breaks 7d and 30d windows down by UTC day
+	Days []UniqueCount `json:"days,omitempty"`
+}
+
+// SLOStatus is the evaluation of a service level objective over its
+// window.
+type SLOStatus struct {
+	Name      string  `json:"name"`
+	Endpoint  string  `json:"endpoint,omitempty"`
+	Objective float64 `json:"objective"`
+	// LatencyThresholdMs is 0 for availability SLOs
+	LatencyThresholdMs   float64            `json:"latency_threshold_ms,omitempty"`
+	Window               string             `json:"window"`
+	Good                 int64              `json:"good"`
+	Total                int64              `json:"total"`
+	Compliance           float64            `json:"compliance"`
+	ErrorBudgetRemaining float64            `json:"error_budget_remaining"`
+	BurnRates            map[string]float64 `json:"burn_rates"`
+	// Status is "ok", "fast_burn" or "exhausted"
+	Status string `json:"status"`
+}
+
+// SLOList is the evaluation of the configured SLOs.
+type SLOList struct {
+	SLOs  []SLOStatus `json:"slos"`
+	Count int         `json:"count"`
+}
+
+// RouteErrors are the requests and errors of a gateway route, or of a
+// backend when Route is empty, over a window.
+type RouteErrors struct {
+	Route        string  `json:"route,omitempty"`
+	Backend      string  `json:"backend"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ClientErrors int64   `json:"client_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	// Statuses counts the responses of a route by status code
+	Statuses map[string]int64 `json:"statuses,omitempty"`
+	// Status is "operational", "degraded" or "outage" for backends
+	Status string `json:"status,omitempty"`
+}
+
+// ErrorStats are the error counts and rates per route and per backend over
+// a window; Errors are 5xx responses, ClientErrors 4xx.
+type ErrorStats struct {
+	Window       string        `json:"window"`
+	Requests     int64         `json:"requests"`
+	Errors       int64         `json:"errors"`
+	ClientErrors int64         `json:"client_errors"`
+	ErrorRate    float64       `json:"error_rate"`
+	Routes       []RouteErrors `json:"routes"`
+	Backends     []RouteErrors `json:"backends"`
+}
+
+// AuthorStats is how the jokes of one author performed since analytics
+// started.
+type AuthorStats struct {
+	Author string `json:"author"`
+	// Jokes is the number of the author's jokes served
+	Jokes        int     `json:"jokes"`
+	Served       int64   `json:"served"`
+	Favorited    int64   `json:"favorited"`
+	FavoriteRate float64 `json:"favorite_rate_percent"`
+}
+
+// AuthorStatsList ranks authors by the servings of their jokes.
+type AuthorStatsList struct {
+	Authors      []AuthorStats `json:"authors"`
+	Count        int           `json:"count"`
+	TotalAuthors int           `json:"total_authors"`
+}
+
+// AnalyticsClient calls the analytics service.
+type AnalyticsClient struct {
+	base
+}
+
+// NewAnalyticsClient returns a client for the analytics service or gateway
+// at baseURL.
+func NewAnalyticsClient(baseURL string, opts ...Option) *AnalyticsClient {
+	return &AnalyticsClient{newBase("analytics", baseURL, opts)}
+}
+
+// Stats returns the headline counters.
+func (c *AnalyticsClient) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	err := c.do(ctx, request{
+		operation: "Stats", method: http.MethodGet, path: "/api/v1/stats", idempotent: true,
+	}, &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ReactionStats returns jokes ranked by groan ratio.
+func (c *AnalyticsClient) ReactionStats(ctx context.Context) (*ReactionStats, error) {
+	var stats ReactionStats
+	err := c.do(ctx, request{
+		operation: "ReactionStats", method: http.MethodGet, path: "/api/v1/stats/reactions", idempotent: true,
+	}, &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Leaderboard ranks users by favorites added or jokes requested ("by")
+// over window: "1h", "24h", "7d" or "30d". Empty values and a zero limit
+// use the service defaults.
+func (c *AnalyticsClient) Leaderboard(ctx context.Context, window, by string, limit int) (*Leaderboard, error) {
+	query := url.Values{}
+	if window != "" {
+		query.Set("window", window)
+	}
+	if by != "" {
+		query.Set("by", by)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var board Leaderboard
+	err := c.do(ctx, request{
+		operation: "Leaderboard", method: http.MethodGet, path: "/api/v1/stats/leaderboard",
+		query: query, idempotent: true,
+	}, &board)
+	if err != nil {
+		return nil, err
+	}
+	return &board, nil
+}
+
+// AuthorStats returns how the jokes of up to limit authors performed, most
+// served first, or only those of author when it is set. A zero limit uses
+// the service default.
+func (c *AnalyticsClient) AuthorStats(ctx context.Context, author string, limit int) (*AuthorStatsList, error) {
+	query := url.Values{}
+	if author != "" {
+		query.Set("author", author)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var list AuthorStatsList
+	err := c.do(ctx, request{
+		operation: "AuthorStats", method: http.MethodGet, path: "/api/v1/stats/authors",
+		query: query, idempotent: true,
+	}, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Uniques returns the approximate number of distinct users and visitors
+// over window: "1h", "24h", "7d" or "30d". An empty window uses the
+// service default.
+func (c *AnalyticsClient) Uniques(ctx context.Context, window string) (*Uniques, error) {
+	query := url.Values{}
+	if window != "" {
+		query.Set("window", window)
+	}
+
+	var uniques Uniques
+	err := c.do(ctx, request{
+		operation: "Uniques", method: http.MethodGet, path: "/api/v1/stats/unique",
+		query: query, idempotent: true,
+	}, &uniques)
+	if err != nil {
+		return nil, err
+	}
+	return &uniques, nil
+}
+
+// SLOs evaluates the configured SLOs, or only the one named name when it
+// is non-empty.
+func (c *AnalyticsClient) SLOs(ctx context.Context, name string) (*SLOList, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+
+	var list SLOList
+	err := c.do(ctx, request{
+		operation: "SLOs", method: http.MethodGet, path: "/api/v1/stats/slo",
+		query: query, idempotent: true,
+	}, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// LatencyStats returns latency percentiles per endpoint, or for one
+// endpoint when endpoint is non-empty.
+func (c *AnalyticsClient) LatencyStats(ctx context.Context, endpoint string) (*LatencyStats, error) {
+	query := url.Values{}
+	if endpoint != "" {
+		query.Set("endpoint", endpoint)
+	}
+
+	var stats LatencyStats
+	err := c.do(ctx, request{
+		operation: "LatencyStats", method: http.MethodGet, path: "/api/v1/stats/latency",
+		query: query, idempotent: true,
+	}, &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ErrorStats returns the error rates per route and backend over window
+// ("5m", "1h", "6h" or "24h"; the default 1h when empty).
+func (c *AnalyticsClient) ErrorStats(ctx context.Context, window string) (*ErrorStats, error) {
+	query := url.Values{}
+	if window != "" {
+		query.Set("window", window)
+	}
+
+	var stats ErrorStats
+	err := c.do(ctx, request{
+		operation: "ErrorStats", method: http.MethodGet, path: "/api/v1/stats/errors",
+		query: query, idempotent: true,
+	}, &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,272 @@
+// Package client provides typed Go clients for the jokes, user and
+// analytics services.
+//
+// Each client takes the base URL of either a service or the API gateway,
+// which serves the same paths:
+//
+//	jokes := client.NewJokesClient("http://localhost:8000")
+//	joke, err := jokes.RandomJoke(ctx, client.JokeOptions{UserID: "user123"})
+//
+// Every call is traced with the global OpenTelemetry tracer provider and
+// propagates the trace context and baggage from ctx. Idempotent calls are
+// retried with backoff on network errors and 429, 502, 503 and 504
+// responses.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/navyn13/microservice-joke/pkg/client"
+
+// UserIDHeader carries the authenticated user ID. The services trust it
+// over any user_id parameter, so only set it for users you authenticated.
+const UserIDHeader = "X-User-ID"
+
+// APIError is returned when a service answers with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	// Message is the service's "error" field, or the response body
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from a service.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Option configures a client.
+type Option func(*options)
+
+type options struct {
+	httpClient     *http.Client
+	retries        int
+	backoff        time.Duration
+	userAgent      string
+	tracerProvider trace.TracerProvider
+	headers        http.Header
+}
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) { o.httpClient = c }
+}
+
+// WithTimeout bounds each attempt; the default is 10s.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		c := *o.httpClient
+		c.Timeout = d
+		o.httpClient = &c
+	}
+}
+
+// WithRetries sets how many times an idempotent call is retried; the
+// default is 2.
+func WithRetries(n int) Option {
+	return func(o *options) { o.retries = n }
+}
+
+// WithBackoff sets the delay before the first retry, doubled on each
+// further one; the default is 100ms.
+func WithBackoff(d time.Duration) Option {
+	return func(o *options) { o.backoff = d }
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(ua string) Option {
+	return func(o *options) { o.userAgent = ua }
+}
+
+// WithHeader adds a header to every request, e.g. X-API-Key or
+// X-Client-App-ID when calling the gateway.
+func WithHeader(name, value string) Option {
+	return func(o *options) { o.headers.Add(name, value) }
+}
+
+// WithTracerProvider traces calls with tp instead of the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) { o.tracerProvider = tp }
+}
+
+// base holds what the typed clients share.
+type base struct {
+	service string
+	baseURL string
+	options
+}
+
+func newBase(service, baseURL string, opts []Option) base {
+	o := options{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+		userAgent:  "jokes-go-client/1.0",
+		headers:    http.Header{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return base{service: service, baseURL: strings.TrimRight(baseURL, "/"), options: o}
+}
+
+// request describes one API call.
+type request struct {
+	// operation names the span, e.g. "RandomJoke"
+	operation string
+	method    string
+	path      string
+	query     url.Values
+	userID    string
+	body      interface{}
+	// idempotent calls are retried
+	idempotent bool
+}
+
+// do performs req, retrying when allowed, and decodes the JSON response
+// into out when it is non-nil.
+func (b *base) do(ctx context.Context, req request, out interface{}) error {
+	tp := b.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	ctx, span := tp.Tracer(instrumentationName).Start(ctx, b.service+"."+req.operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("peer.service", b.service),
+			attribute.String("http.request.method", req.method),
+			attribute.String("url.path", req.path),
+		),
+	)
+	defer span.End()
+
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	target := b.baseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	attempts := 1
+	if req.idempotent {
+		attempts += b.retries
+	}
+	backoff := b.backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = b.attempt(ctx, req, target, body, out)
+		if err == nil || !retry || attempt >= attempts {
+			span.SetAttributes(attribute.Int("client.attempts", attempt))
+			break
+		}
+
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+			continue
+		}
+		break
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// attempt sends the request once and reports whether a failure is worth
+// retrying.
+func (b *base) attempt(ctx context.Context, req request, target string, body []byte, out interface{}) (bool, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target, reqBody)
+	if err != nil {
+		return false, err
+	}
+
+	for name, values := range b.headers {
+		httpReq.Header[name] = values
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("User-Agent", b.userAgent)
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.userID != "" {
+		httpReq.Header.Set(UserIDHeader, req.userID)
+	}
+
+	resp, err := b.httpClient.Do(httpReq)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+		var errBody struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &errBody) == nil && errBody.Error != "" {
+			apiErr.Message = errBody.Error
+		}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, apiErr
+		}
+		return false, apiErr
+	}
+
+	if out == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return false, fmt.Errorf("decoding %s response: %w", req.operation, err)
+	}
+	return false, nil
+}
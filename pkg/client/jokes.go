@@ -0,0 +1,268 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Joke is a joke served by the jokes service.
+type Joke struct {
+	// ID is stable: the same joke keeps it across replicas and restarts
+	ID   string `json:"id"`
+	Joke string `json:"joke"`
+	// Setup and Punchline are set for jokes told in two parts, whose Joke
+	// is the two on lines of their own
+	Setup     string `json:"setup,omitempty"`
+	Punchline string `json:"punchline,omitempty"`
+	// Format is "plain" or "markdown"
+	Format    string    `json:"format"`
+	Category  string    `json:"category"`
+	Author    string    `json:"author"`
+	Language  string    `json:"language"`
+	CreatedAt time.Time `json:"created_at"`
+	Reactions Reactions `json:"reactions"`
+	// Safe reports whether the joke passed the content filter
+	Safe      bool      `json:"safe"`
+	Timestamp time.Time `json:"timestamp"`
+	// Retired is set by Joke for jokes no longer served at random
+	Retired bool `json:"retired"`
+	// UnseenRemaining and NewRound are set by RandomJoke with Unseen: the
+	// jokes the user has left this round, and whether this pick started one
+	UnseenRemaining int  `json:"unseen_remaining,omitempty"`
+	NewRound        bool `json:"new_round,omitempty"`
+}
+
+// Reactions counts the reactions to a joke.
+type Reactions struct {
+	Laugh int64 `json:"laugh"`
+	Groan int64 `json:"groan"`
+	Meh   int64 `json:"meh"`
+}
+
+// Reaction values accepted by React
+const (
+	ReactionLaugh = "laugh"
+	ReactionGroan = "groan"
+	ReactionMeh   = "meh"
+)
+
+// ReactionResult is the joke's reaction counts after a reaction.
+type ReactionResult struct {
+	ID        string    `json:"id"`
+	Reaction  string    `json:"reaction"`
+	Reactions Reactions `json:"reactions"`
+}
+
+// HistoryEntry is a joke served to a user. Joke and Category are empty for
+// jokes since dropped from the catalogue.
+type HistoryEntry struct {
+	JokeID   string    `json:"joke_id"`
+	Joke     string    `json:"joke,omitempty"`
+	Category string    `json:"category,omitempty"`
+	ServedAt time.Time `json:"served_at"`
+}
+
+// JokeOptions tune RandomJoke.
+type JokeOptions struct {
+	// UserID avoids repeating jokes the user saw recently
+	UserID string
+	// Unsafe includes jokes withheld by the content filter
+	Unsafe bool
+	// Unseen picks only jokes UserID hasn't been served this round;
+	// RandomJoke only
+	Unseen bool
+	// Seed makes the pick reproducible: the same seed picks the same
+	// jokes, without avoiding UserID's recent ones
+	Seed *int64
+}
+
+// JokesClient calls the jokes service.
+type JokesClient struct {
+	base
+}
+
+// NewJokesClient returns a client for the jokes service or gateway at
+// baseURL.
+func NewJokesClient(baseURL string, opts ...Option) *JokesClient {
+	return &JokesClient{newBase("jokes", baseURL, opts)}
+}
+
+// RandomJoke returns a random joke.
+func (c *JokesClient) RandomJoke(ctx context.Context, opts JokeOptions) (*Joke, error) {
+	query := url.Values{}
+	if opts.UserID != "" {
+		query.Set("user_id", opts.UserID)
+	}
+	if opts.Unsafe {
+		query.Set("safe", strconv.FormatBool(false))
+	}
+	if opts.Unseen {
+		query.Set("unseen", strconv.FormatBool(true))
+	}
+	if opts.Seed != nil {
+		query.Set("seed", strconv.FormatInt(*opts.Seed, 10))
+	}
+
+	var joke Joke
+	err := c.do(ctx, request{
+		operation: "RandomJoke", method: http.MethodGet, path: "/api/v1/joke",
+		query: query, userID: opts.UserID, idempotent: true,
+	}, &joke)
+	if err != nil {
+		return nil, err
+	}
+	return &joke, nil
+}
+
+// RandomJokes returns up to count distinct random jokes in one call; fewer
+// when fewer jokes are available.
+func (c *JokesClient) RandomJokes(ctx context.Context, count int, opts JokeOptions) ([]Joke, error) {
+	query := url.Values{}
+	query.Set("count", strconv.Itoa(count))
+	if opts.UserID != "" {
+		query.Set("user_id", opts.UserID)
+	}
+	if opts.Unsafe {
+		query.Set("safe", strconv.FormatBool(false))
+	}
+	if opts.Seed != nil {
+		query.Set("seed", strconv.FormatInt(*opts.Seed, 10))
+	}
+
+	var batch struct {
+		Jokes []Joke `json:"jokes"`
+	}
+	err := c.do(ctx, request{
+		operation: "RandomJokes", method: http.MethodGet, path: "/api/v1/jokes/random",
+		query: query, userID: opts.UserID, idempotent: true,
+	}, &batch)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Jokes, nil
+}
+
+// History returns up to limit of the jokes served to userID, newest first;
+// limit 0 uses the service default.
+func (c *JokesClient) History(ctx context.Context, userID string, limit int) ([]HistoryEntry, error) {
+	query := url.Values{}
+	query.Set("user_id", userID)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var page struct {
+		History []HistoryEntry `json:"history"`
+	}
+	err := c.do(ctx, request{
+		operation: "History", method: http.MethodGet, path: "/api/v1/history",
+		query: query, userID: userID, idempotent: true,
+	}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return page.History, nil
+}
+
+// Joke returns a joke by ID, including retired jokes.
+func (c *JokesClient) Joke(ctx context.Context, id string) (*Joke, error) {
+	var joke Joke
+	err := c.do(ctx, request{
+		operation: "Joke", method: http.MethodGet, path: "/api/v1/jokes/" + url.PathEscape(id),
+		idempotent: true,
+	}, &joke)
+	if err != nil {
+		return nil, err
+	}
+	return &joke, nil
+}
+
+// JokeList is a page of the jokes of an author, or of the catalogue.
+type JokeList struct {
+	Author  string `json:"author"`
+	Jokes   []Joke `json:"jokes"`
+	Count   int    `json:"count"`
+	Total   int    `json:"total"`
+	Offset  int    `json:"offset"`
+	HasMore bool   `json:"has_more"`
+}
+
+// JokesByAuthor returns up to limit of the jokes of author, regardless of
+// case, from offset on; an empty author lists the whole catalogue and a
+// zero limit uses the service default. Retired jokes are left out.
+func (c *JokesClient) JokesByAuthor(ctx context.Context, author string, offset, limit int, opts JokeOptions) (*JokeList, error) {
+	query := url.Values{}
+	if author != "" {
+		query.Set("author", author)
+	}
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if opts.Unsafe {
+		query.Set("safe", strconv.FormatBool(false))
+	}
+
+	var list JokeList
+	err := c.do(ctx, request{
+		operation: "JokesByAuthor", method: http.MethodGet, path: "/api/v1/jokes",
+		query: query, idempotent: true,
+	}, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// TrendingJoke is a joke rising in popularity.
+type TrendingJoke struct {
+	Joke
+	Rank int `json:"rank"`
+	// Momentum is how much more the joke was served in the last hour than
+	// the hour before, smoothed so rarely served jokes don't dominate
+	Momentum           float64 `json:"momentum"`
+	ServedLastHour     int64   `json:"served_last_hour"`
+	ServedPreviousHour int64   `json:"served_previous_hour"`
+}
+
+// Trending returns up to limit of the fastest-rising jokes of the last
+// hour, highest momentum first.
+func (c *JokesClient) Trending(ctx context.Context, limit int, opts JokeOptions) ([]TrendingJoke, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if opts.Unsafe {
+		query.Set("safe", strconv.FormatBool(false))
+	}
+
+	var body struct {
+		Trending []TrendingJoke `json:"trending"`
+	}
+	err := c.do(ctx, request{
+		operation: "Trending", method: http.MethodGet, path: "/api/v1/jokes/trending",
+		query: query, idempotent: true,
+	}, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body.Trending, nil
+}
+
+// React records a reaction (ReactionLaugh, ReactionGroan or ReactionMeh)
+// to a joke. Reactions are counted once per call, so they are not retried.
+func (c *JokesClient) React(ctx context.Context, jokeID, reaction string) (*ReactionResult, error) {
+	var result ReactionResult
+	err := c.do(ctx, request{
+		operation: "React", method: http.MethodPost,
+		path: "/api/v1/joke/" + url.PathEscape(jokeID) + "/reaction",
+		body: map[string]string{"reaction": reaction},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
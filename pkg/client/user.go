@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Favorite is a joke saved by a user. JokeID is empty for favorites added
+// by text alone.
+type Favorite struct {
+	ID        string     `json:"id"`
+	JokeID    string     `json:"joke_id"`
+	Joke      string     `json:"joke"`
+	UserID    string     `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Note is the user's markdown note on the joke
+	Note          string     `json:"note,omitempty"`
+	NoteUpdatedAt *time.Time `json:"note_updated_at,omitempty"`
+	// AlreadyFavorited is set by AddFavorite when the user had already
+	// saved the same joke
+	AlreadyFavorited bool `json:"already_favorited,omitempty"`
+}
+
+// FavoriteList is a user's favorites.
+type FavoriteList struct {
+	Favorites []Favorite `json:"favorites"`
+	Count     int        `json:"count"`
+}
+
+// FavoriteStats summarizes a user's favorites.
+type FavoriteStats struct {
+	UserID          string     `json:"user_id"`
+	Count           int        `json:"count"`
+	FirstFavoriteAt *time.Time `json:"first_favorite_at"`
+	LastFavoriteAt  *time.Time `json:"last_favorite_at"`
+	PerDay          []DayCount `json:"per_day"`
+}
+
+// DayCount is the number of favorites added on one UTC day.
+type DayCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// UserClient calls the user service. The user ID passed to each method is
+// sent as the authenticated user.
+type UserClient struct {
+	base
+}
+
+// NewUserClient returns a client for the user service or gateway at
+// baseURL.
+func NewUserClient(baseURL string, opts ...Option) *UserClient {
+	return &UserClient{newBase("user", baseURL, opts)}
+}
+
+// AddFavorite saves a joke for the user. Saving the same joke twice returns
+// the existing favorite, so the call is safe to retry.
+func (c *UserClient) AddFavorite(ctx context.Context, userID, joke string) (*Favorite, error) {
+	var fav Favorite
+	err := c.do(ctx, request{
+		operation: "AddFavorite", method: http.MethodPost, path: "/api/v1/favorites",
+		userID: userID, body: map[string]string{"joke": joke, "user_id": userID},
+		idempotent: true,
+	}, &fav)
+	if err != nil {
+		return nil, err
+	}
+	return &fav, nil
+}
+
+// AddFavoriteByID saves a joke for the user by its ID; the user service
+// looks up the text. Like AddFavorite, it is safe to retry.
+func (c *UserClient) AddFavoriteByID(ctx context.Context, userID, jokeID string) (*Favorite, error) {
+	var fav Favorite
+	err := c.do(ctx, request{
+		operation: "AddFavoriteByID", method: http.MethodPost, path: "/api/v1/favorites",
+		userID: userID, body: map[string]string{"joke_id": jokeID, "user_id": userID},
+		idempotent: true,
+	}, &fav)
+	if err != nil {
+		return nil, err
+	}
+	return &fav, nil
+}
+
+// Favorites lists the user's favorites.
+func (c *UserClient) Favorites(ctx context.Context, userID string) (*FavoriteList, error) {
+	var list FavoriteList
+	err := c.do(ctx, request{
+		operation: "Favorites", method: http.MethodGet, path: "/api/v1/favorites",
+		query: url.Values{"user_id": {userID}}, userID: userID, idempotent: true,
+	}, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// FavoriteStats returns the user's favorite count, first and last favorite
+// times and a histogram over the last days (0 for the service default).
+func (c *UserClient) FavoriteStats(ctx context.Context, userID string, days int) (*FavoriteStats, error) {
+	query := url.Values{"user_id": {userID}}
+	if days > 0 {
+		query.Set("days", strconv.Itoa(days))
+	}
+
+	var stats FavoriteStats
+	err := c.do(ctx, request{
+		operation: "FavoriteStats", method: http.MethodGet, path: "/api/v1/favorites/stats",
+		query: query, userID: userID, idempotent: true,
+	}, &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// DeleteFavorite moves a favorite to the trash.
+func (c *UserClient) DeleteFavorite(ctx context.Context, userID, id string) (*Favorite, error) {
+	var fav Favorite
+	err := c.do(ctx, request{
+		operation: "DeleteFavorite", method: http.MethodDelete,
+		path:  "/api/v1/favorites/" + url.PathEscape(id),
+		query: url.Values{"user_id": {userID}}, userID: userID, idempotent: true,
+	}, &fav)
+	if err != nil {
+		return nil, err
+	}
+	return &fav, nil
+}
+
+// SetFavoriteNote sets the note of a favorite; an empty note removes it.
+func (c *UserClient) SetFavoriteNote(ctx context.Context, userID, id, note string) (*Favorite, error) {
+	var fav Favorite
+	err := c.do(ctx, request{
+		operation: "SetFavoriteNote", method: http.MethodPut,
+		path:  "/api/v1/favorites/" + url.PathEscape(id) + "/note",
+		query: url.Values{"user_id": {userID}}, userID: userID,
+		body: map[string]string{"note": note}, idempotent: true,
+	}, &fav)
+	if err != nil {
+		return nil, err
+	}
+	return &fav, nil
+}
+
+// RestoreFavorite brings a favorite back from the trash.
+func (c *UserClient) RestoreFavorite(ctx context.Context, userID, id string) (*Favorite, error) {
+	var fav Favorite
+	err := c.do(ctx, request{
+		operation: "RestoreFavorite", method: http.MethodPost,
+		path:  "/api/v1/favorites/" + url.PathEscape(id) + "/restore",
+		query: url.Values{"user_id": {userID}}, userID: userID,
+	}, &fav)
+	if err != nil {
+		return nil, err
+	}
+	return &fav, nil
+}
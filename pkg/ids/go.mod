@@ -0,0 +1,3 @@
+module github.com/navyn13/microservice-joke/pkg/ids
+
+go 1.23.0
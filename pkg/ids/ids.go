@@ -0,0 +1,147 @@
+// Package ids generates the IDs of the records the services create:
+// favorites, merges and erasures in the user service, experiments in the
+// jokes service and quarantined events in analytics.
+//
+// IDs are ULIDs: 26 characters of Crockford base32 holding a 48-bit Unix
+// millisecond timestamp followed by 80 random bits. They sort by creation
+// time as plain strings, and replicas create them without coordinating:
+// two IDs only collide if the same millisecond draws the same 80 bits.
+// Within a process, IDs created in the same millisecond increment the
+// random part instead of drawing it again, so they sort in creation order
+// too.
+package ids
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Length is the length of an ID.
+const Length = 26
+
+// crockford is the Crockford base32 alphabet, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ErrInvalid is returned for strings that aren't IDs.
+var ErrInvalid = errors.New("invalid ID")
+
+var (
+	mutex    sync.Mutex
+	lastMS   uint64
+	lastRand [10]byte
+)
+
+// New returns a new ID for the current time.
+func New() string {
+	return NewAt(time.Now())
+}
+
+// NewAt returns a new ID for t. IDs for a time before the latest one
+// created still increment the latest's random part, so a clock stepping
+// back doesn't break the order within the process.
+func NewAt(t time.Time) string {
+	ms := uint64(t.UnixMilli())
+
+	mutex.Lock()
+	if ms <= lastMS {
+		ms = lastMS
+		if !increment(&lastRand) {
+			// The random part overflowed; borrow the next millisecond
+			ms++
+			draw(&lastRand)
+		}
+	} else {
+		draw(&lastRand)
+	}
+	lastMS = ms
+	random := lastRand
+	mutex.Unlock()
+
+	return encode(ms, random)
+}
+
+// WithPrefix returns a new ID for the current time after prefix, for IDs
+// that name their kind, like "exp_".
+func WithPrefix(prefix string) string {
+	return prefix + New()
+}
+
+// Time returns the time an ID was created, to the millisecond.
+func Time(id string) (time.Time, error) {
+	if len(id) != Length {
+		return time.Time{}, ErrInvalid
+	}
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		v := decodeChar(id[i])
+		if v < 0 || (i == 0 && v > 7) {
+			return time.Time{}, ErrInvalid
+		}
+		ms = ms<<5 | uint64(v)
+	}
+	for i := 10; i < Length; i++ {
+		if decodeChar(id[i]) < 0 {
+			return time.Time{}, ErrInvalid
+		}
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
+
+func draw(random *[10]byte) {
+	if _, err := rand.Read(random[:]); err != nil {
+		panic(err)
+	}
+}
+
+// increment adds one to random, reporting false when it overflows.
+func increment(random *[10]byte) bool {
+	for i := len(random) - 1; i >= 0; i-- {
+		random[i]++
+		if random[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode writes the 128 bits of ms (48) and random (80) as 26 base32
+// characters, the first holding only 3 bits.
+func encode(ms uint64, random [10]byte) string {
+	var b [16]byte
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	copy(b[6:], random[:])
+
+	var out [Length]byte
+	// Walk the 130 bits (two leading zero bits) five at a time
+	for i := 0; i < Length; i++ {
+		bit := i*5 - 2
+		var v byte
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			if k := bit + j; k >= 0 && b[k/8]&(0x80>>(k%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out[:])
+}
+
+// decodeChar returns the value of a base32 character, or -1. Lowercase is
+// accepted, like Crockford's decoding allows.
+func decodeChar(c byte) int {
+	if 'a' <= c && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	for i := 0; i < len(crockford); i++ {
+		if crockford[i] == c {
+			return i
+		}
+	}
+	return -1
+}
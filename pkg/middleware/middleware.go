@@ -0,0 +1,130 @@
+// Package middleware provides the gin middleware every service installs for
+// cross-cutting HTTP concerns: request IDs, tracing, access logging,
+// request metrics, panic recovery, request body limits and the HMAC
+// authentication of internal requests, with replay guards kept in memory or
+// Redis. BindJSON binds and validates request bodies, reporting what was
+// wrong field by field.
+//
+// Services install the standard chain first thing, before their own
+// middleware:
+//
+//	r := gin.New()
+//	r.Use(middleware.Default("jokes-service",
+//		middleware.WithLogger(loggerFor),
+//		middleware.WithMetricAttributes(contextAttrs),
+//	)...)
+//
+// Request metrics and panics are recorded with the global OpenTelemetry
+// meter provider.
+package middleware
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+const instrumentationName = "github.com/navyn13/microservice-joke/pkg/middleware"
+
+// DefaultMaxBodyBytes is the request body limit of the standard chain.
+const DefaultMaxBodyBytes int64 = 8 << 20
+
+// Option configures the standard chain.
+type Option func(*options)
+
+type options struct {
+	logger       func(context.Context) *zap.Logger
+	metricAttrs  func(context.Context) metric.MeasurementOption
+	meter        metric.MeterProvider
+	maxBodyBytes int64
+	observers    []gin.HandlerFunc
+}
+
+// WithLogger logs with the logger it returns for a request context, which
+// should carry the request ID (see RequestIDFromContext); the default is
+// zap.L() with a request_id field.
+func WithLogger(f func(context.Context) *zap.Logger) Option {
+	return func(o *options) { o.logger = f }
+}
+
+// WithMetricAttributes adds the attributes it returns for a request
+// context, such as the tenant, to the request and panic metrics. It is
+// called once the request is handled, so it sees the context set by
+// middleware further down.
+func WithMetricAttributes(f func(context.Context) metric.MeasurementOption) Option {
+	return func(o *options) { o.metricAttrs = f }
+}
+
+// WithMeterProvider records metrics with mp instead of the global
+// provider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(o *options) { o.meter = mp }
+}
+
+// WithMaxBodyBytes sets the request body limit; the default is
+// DefaultMaxBodyBytes, and 0 disables it.
+func WithMaxBodyBytes(n int64) Option {
+	return func(o *options) { o.maxBodyBytes = n }
+}
+
+// WithObservers installs handlers outside the panic recovery, so the 500
+// a panic ends in is seen by them like any other response.
+func WithObservers(handlers ...gin.HandlerFunc) Option {
+	return func(o *options) { o.observers = append(o.observers, handlers...) }
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger: func(ctx context.Context) *zap.Logger {
+			return zap.L().With(zap.String("request_id", RequestIDFromContext(ctx)))
+		},
+		metricAttrs:  func(context.Context) metric.MeasurementOption { return metric.WithAttributes() },
+		meter:        otel.GetMeterProvider(),
+		maxBodyBytes: DefaultMaxBodyBytes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Default returns the standard chain for serviceName, in order: request
+// IDs, the otelgin server span, the access log, request metrics, the
+// observers, panic recovery and the body limit. Recovery comes after
+// everything that reports on the response, and inside the request span,
+// which is still open when a panic is recovered.
+func Default(serviceName string, opts ...Option) []gin.HandlerFunc {
+	o := newOptions(opts)
+	chain := []gin.HandlerFunc{
+		RequestID(),
+		otelgin.Middleware(serviceName),
+		accessLog(o),
+		metrics(o),
+	}
+	chain = append(chain, o.observers...)
+	chain = append(chain, recovery(o))
+	if o.maxBodyBytes > 0 {
+		chain = append(chain, BodyLimit(o.maxBodyBytes))
+	}
+	return chain
+}
+
+// AccessLog logs every request once it is handled.
+func AccessLog(opts ...Option) gin.HandlerFunc {
+	return accessLog(newOptions(opts))
+}
+
+// Metrics records the count and duration of every request.
+func Metrics(opts ...Option) gin.HandlerFunc {
+	return metrics(newOptions(opts))
+}
+
+// Recovery turns panics in handlers into 500 responses. Install it inside
+// the otelgin middleware.
+func Recovery(opts ...Option) gin.HandlerFunc {
+	return recovery(newOptions(opts))
+}
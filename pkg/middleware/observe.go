@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// routeOf is the route template that matched, so metrics stay bounded
+// whatever paths clients send.
+func routeOf(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+func accessLog(o options) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Middleware further down may have replaced the request
+		ctx := c.Request.Context()
+		status := c.Writer.Status()
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("route", routeOf(c)),
+			zap.Int("status", status),
+			zap.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			zap.Int("response_bytes", c.Writer.Size()),
+			zap.String("client_ip", c.ClientIP()),
+		}
+		if status >= http.StatusInternalServerError {
+			o.logger(ctx).Warn("Request handled", fields...)
+			return
+		}
+		o.logger(ctx).Info("Request handled", fields...)
+	}
+}
+
+func metrics(o options) gin.HandlerFunc {
+	meter := o.meter.Meter(instrumentationName)
+	requestCount, err := meter.Int64Counter(
+		"http.server.request_count",
+		metric.WithDescription("Total number of HTTP requests"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		o.logger(context.Background()).Fatal("Failed to create request counter", zap.Error(err))
+	}
+	requestDuration, err := meter.Float64Histogram(
+		"http.server.request_duration",
+		metric.WithDescription("HTTP request latency"),
+		metric.WithUnit("ms"),
+	)
+	if err != nil {
+		o.logger(context.Background()).Fatal("Failed to create request duration histogram", zap.Error(err))
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		ctx := c.Request.Context()
+		attrs := metric.WithAttributes(
+			attribute.String("method", c.Request.Method),
+			attribute.String("path", routeOf(c)),
+		)
+		requestCount.Add(ctx, 1, attrs,
+			metric.WithAttributes(attribute.Int("status_code", c.Writer.Status())),
+			o.metricAttrs(ctx),
+		)
+		requestDuration.Record(ctx, float64(time.Since(start).Microseconds())/1000, attrs, o.metricAttrs(ctx))
+	}
+}
+
+func recovery(o options) gin.HandlerFunc {
+	panics, err := o.meter.Meter(instrumentationName).Int64Counter(
+		"http.server.panics",
+		metric.WithDescription("Number of panics recovered while handling requests"),
+		metric.WithUnit("{panic}"),
+	)
+	if err != nil {
+		o.logger(context.Background()).Fatal("Failed to create panic counter", zap.Error(err))
+	}
+
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// A deliberate abort of the response, left for net/http to
+			// close the connection
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			// Middleware further down may have replaced the request
+			ctx := c.Request.Context()
+			message := fmt.Sprint(recovered)
+			stack := string(debug.Stack())
+
+			span := trace.SpanFromContext(ctx)
+			span.AddEvent("exception", trace.WithAttributes(
+				attribute.String("exception.type", fmt.Sprintf("%T", recovered)),
+				attribute.String("exception.message", message),
+				attribute.String("exception.stacktrace", stack),
+			))
+			span.SetStatus(codes.Error, "panic: "+message)
+
+			panics.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("method", c.Request.Method),
+				attribute.String("route", c.FullPath()),
+			), o.metricAttrs(ctx))
+
+			o.logger(ctx).Error("Panic recovered",
+				zap.String("panic", message),
+				zap.String("method", c.Request.Method),
+				zap.String("path", c.Request.URL.Path),
+				zap.String("stack", stack),
+			)
+
+			// Too late for an error body once the response has started
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}()
+		c.Next()
+	}
+}
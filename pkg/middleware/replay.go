@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisReplayGuard is a ReplayGuard shared by the replicas of a service
+// through Redis. Keys are stored under Prefix, with their TTL.
+type RedisReplayGuard struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func (g RedisReplayGuard) FirstUse(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return g.Client.SetNX(ctx, g.Prefix+key, 1, ttl).Result()
+}
+
+// NewMemoryReplayGuard returns a ReplayGuard keeping keys in memory,
+// which only covers one replica.
+func NewMemoryReplayGuard() ReplayGuard {
+	return &memoryReplayGuard{seen: map[string]time.Time{}}
+}
+
+// memoryReplayGuard is the single-replica ReplayGuard.
+type memoryReplayGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func (g *memoryReplayGuard) FirstUse(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for k, expires := range g.seen {
+		if now.After(expires) {
+			delete(g.seen, k)
+		}
+	}
+	if _, ok := g.seen[key]; ok {
+		return false, nil
+	}
+	g.seen[key] = now.Add(ttl)
+	return true, nil
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	entranslations "github.com/go-playground/validator/v10/translations/en"
+)
+
+// InvalidRequestMessage is the error of a request body failing to decode
+// or validate; what was wrong is in its details.
+const InvalidRequestMessage = "Invalid request body"
+
+// FieldError is one reason a request body was rejected. Field is the JSON
+// path of the field, such as "events[0].count", and empty when the body as
+// a whole is at fault; Rule is the validator tag that failed ("required",
+// "oneof", "min", ...), or "type" or "json" for decoding errors.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var (
+	validation     ut.Translator
+	validationOnce sync.Once
+)
+
+// setupValidation names fields by their JSON name in gin's validator and
+// registers its English messages.
+func setupValidation() {
+	validationOnce.Do(func() {
+		v, ok := binding.Validator.Engine().(*validator.Validate)
+		if !ok {
+			return
+		}
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			switch name {
+			case "-":
+				return ""
+			case "":
+				return field.Name
+			}
+			return name
+		})
+		english := en.New()
+		validation, _ = ut.New(english, english).GetTranslator("en")
+		if err := entranslations.RegisterDefaultTranslations(v, validation); err != nil {
+			validation = nil
+		}
+	})
+}
+
+// BindJSON decodes the JSON body of the request into obj and validates it
+// against its binding tags. On failure it responds with 400 and the
+// standard error, listing what was wrong in "details", or with 413 if the
+// body is over the limit (see BodyLimit), and returns false.
+func BindJSON(c *gin.Context, obj any) bool {
+	setupValidation()
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit),
+		})
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+		"error":   InvalidRequestMessage,
+		"details": FieldErrors(err),
+	})
+	return false
+}
+
+// FieldErrors describes an error of decoding or validating a request body
+// field by field, without the decoder's or validator's internals.
+func FieldErrors(err error) []FieldError {
+	setupValidation()
+
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		details := make([]FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			details = append(details, fieldError(fe))
+		}
+		return details
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var timeErr *time.ParseError
+	switch {
+	case errors.As(err, &typeErr):
+		path := decoderPath(typeErr.Field)
+		return []FieldError{{
+			Field:   path,
+			Rule:    "type",
+			Message: fieldName(path) + " must be " + jsonKind(typeErr.Type),
+		}}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return []FieldError{{Rule: "json", Message: "the body is not valid JSON"}}
+	case errors.Is(err, io.EOF):
+		return []FieldError{{Rule: "json", Message: "the body is empty"}}
+	case errors.As(err, &timeErr):
+		return []FieldError{{Rule: "type", Message: "times must be RFC 3339, e.g. 2026-10-16T09:30:00Z"}}
+	}
+	return []FieldError{{Rule: "json", Message: "the body could not be read"}}
+}
+
+// fieldError describes a failed validation rule, naming the field by its
+// full path.
+func fieldError(fe validator.FieldError) FieldError {
+	// The namespace starts with the name of the bound struct
+	_, path, _ := strings.Cut(fe.Namespace(), ".")
+	if path == "" {
+		path = fe.Field()
+	}
+
+	message := path + " failed the " + fe.Tag() + " rule"
+	if validation != nil {
+		message = fe.Translate(validation)
+		if path != fe.Field() {
+			message = strings.Replace(message, fe.Field(), path, 1)
+		}
+	}
+	return FieldError{Field: path, Rule: fe.Tag(), Message: message}
+}
+
+// decoderPath writes a field path of encoding/json, "events.0.count", the
+// way the validator does, "events[0].count".
+func decoderPath(field string) string {
+	var path strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			path.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			path.WriteByte('.')
+		}
+		path.WriteString(part)
+	}
+	return path.String()
+}
+
+// fieldName is how a decoding error names a field: by its path, or as
+// the body when the body itself has the wrong type.
+func fieldName(path string) string {
+	if path == "" {
+		return "the body"
+	}
+	return path
+}
+
+// jsonKind names the JSON type expected for t.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,113 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// With ANALYTICS_TRANSPORT=otlp, the services don't post analytics events
+// but record them as telemetry: each event is a span event named after
+// its type, its attributes the v2 payload with nested fields flattened
+// with dots, on a span of its own marked with AnalyticsEventAttribute.
+// The collector forwards those spans to the analytics service (see its
+// otlp.go).
+//
+// Samplers built with NewSampler(IsAnalyticsSpan) always sample the span,
+// whatever OTEL_TRACES_SAMPLER says, so no event is lost to sampling. It
+// starts a trace of its own, linked to the request's, so a sampled-out
+// request doesn't leave a dangling parent.
+
+// AnalyticsEventAttribute marks the spans carrying analytics events
+const AnalyticsEventAttribute = "analytics.event"
+
+// AnalyticsOverOTLP reports whether ANALYTICS_TRANSPORT asks for analytics
+// events to be exported as spans ("otlp") rather than posted ("events",
+// the default).
+func AnalyticsOverOTLP() bool {
+	switch v := os.Getenv("ANALYTICS_TRANSPORT"); v {
+	case "", "events":
+		return false
+	case "otlp":
+		logger().Info("Analytics events are exported as spans")
+		return true
+	default:
+		logger().Warn("Unknown ANALYTICS_TRANSPORT, posting analytics events", zap.String("transport", v))
+		return false
+	}
+}
+
+// RecordAnalyticsEvent records an analytics event as a span event on a
+// span started with tracer.
+func RecordAnalyticsEvent(ctx context.Context, tracer trace.Tracer, eventType string, payload interface{}) {
+	attrs, err := flattenPayload(payload)
+	if err != nil {
+		LoggerFor(ctx, logger()).Error("Failed to encode analytics event", zap.String("event_type", eventType), zap.Error(err))
+		return
+	}
+
+	_, span := tracer.Start(ctx, "analytics."+eventType,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attribute.String(AnalyticsEventAttribute, eventType)),
+	)
+	span.AddEvent(eventType, trace.WithAttributes(attrs...))
+	span.End()
+}
+
+// IsAnalyticsSpan reports whether a span about to start carries analytics
+// events, which are always sampled.
+func IsAnalyticsSpan(p sdktrace.SamplingParameters) bool {
+	for _, attr := range p.Attributes {
+		if attr.Key == AnalyticsEventAttribute {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenPayload turns a payload into span event attributes, nested
+// objects flattened with dots: {"latency": {"endpoint": ...}} becomes
+// "latency.endpoint".
+func flattenPayload(payload interface{}) ([]attribute.KeyValue, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	var attrs []attribute.KeyValue
+	var flatten func(prefix string, fields map[string]interface{})
+	flatten = func(prefix string, fields map[string]interface{}) {
+		for key, value := range fields {
+			key = prefix + key
+			switch value := value.(type) {
+			case map[string]interface{}:
+				flatten(key+".", value)
+			case string:
+				attrs = append(attrs, attribute.String(key, value))
+			case bool:
+				attrs = append(attrs, attribute.Bool(key, value))
+			case json.Number:
+				if n, err := value.Int64(); err == nil {
+					attrs = append(attrs, attribute.Int64(key, n))
+				} else if f, err := value.Float64(); err == nil {
+					attrs = append(attrs, attribute.Float64(key, f))
+				}
+			}
+		}
+	}
+	flatten("", fields)
+	return attrs, nil
+}
@@ -0,0 +1,276 @@
+package telemetry
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// telemetryExportTimeout bounds a single delivery to the collector
+	telemetryExportTimeout = 10 * time.Second
+	// telemetryMaxBackoff caps the delay between delivery attempts
+	telemetryMaxBackoff = time.Minute
+)
+
+// backgroundExporter decouples the service from the collector: items are
+// queued in memory and delivered from a background goroutine, which
+// connects lazily and retries with backoff while the collector is down.
+// The service starts and keeps running without a collector; once the queue
+// is full the oldest items are dropped.
+type backgroundExporter[T any] struct {
+	signal   string
+	connect  func(ctx context.Context) (export func(context.Context, []T) error, shutdown func(context.Context) error, err error)
+	maxQueue int
+
+	mu       sync.Mutex
+	queue    []T
+	dropped  int
+	export   func(context.Context, []T) error
+	shutdown func(context.Context) error
+	healthy  bool
+
+	wake chan struct{}
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func newBackgroundExporter[T any](signal string, connect func(context.Context) (func(context.Context, []T) error, func(context.Context) error, error)) *backgroundExporter[T] {
+	maxQueue := 10000
+	if v, err := strconv.Atoi(os.Getenv("OTEL_EXPORT_QUEUE_SIZE")); err == nil && v > 0 {
+		maxQueue = v
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	e := &backgroundExporter[T]{
+		signal:   signal,
+		connect:  connect,
+		maxQueue: maxQueue,
+		healthy:  true,
+		wake:     make(chan struct{}, 1),
+		stop:     stop,
+		done:     make(chan struct{}),
+	}
+	go e.run(ctx)
+	return e
+}
+
+// enqueue adds items for delivery without blocking.
+func (e *backgroundExporter[T]) enqueue(items []T) {
+	e.mu.Lock()
+	e.queue = append(e.queue, items...)
+	if over := len(e.queue) - e.maxQueue; over > 0 {
+		e.queue = append(e.queue[:0:0], e.queue[over:]...)
+		e.dropped += over
+	}
+	e.mu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *backgroundExporter[T]) run(ctx context.Context) {
+	defer close(e.done)
+
+	backoff := time.Second
+	for {
+		wait := backoff
+		if err := e.flush(ctx); err != nil {
+			backoff = min(2*backoff, telemetryMaxBackoff)
+		} else {
+			backoff = time.Second
+			wait = -1
+		}
+
+		var retry <-chan time.Time
+		if wait > 0 {
+			retry = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wake:
+		case <-retry:
+		}
+	}
+}
+
+// flush connects if needed and delivers everything queued. Items that
+// could not be delivered are put back at the front of the queue.
+func (e *backgroundExporter[T]) flush(ctx context.Context) error {
+	e.mu.Lock()
+	export := e.export
+	e.mu.Unlock()
+
+	if export == nil {
+		var shutdown func(context.Context) error
+		var err error
+		export, shutdown, err = e.connect(ctx)
+		if err != nil {
+			e.setHealthy(false, err)
+			return err
+		}
+		e.mu.Lock()
+		e.export, e.shutdown = export, shutdown
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	batch := e.queue
+	e.queue = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	exportCtx, cancel := context.WithTimeout(ctx, telemetryExportTimeout)
+	defer cancel()
+	if err := export(exportCtx, batch); err != nil {
+		e.mu.Lock()
+		e.queue = append(batch, e.queue...)
+		if over := len(e.queue) - e.maxQueue; over > 0 {
+			e.queue = e.queue[:e.maxQueue]
+			e.dropped += over
+		}
+		e.mu.Unlock()
+		e.setHealthy(false, err)
+		return err
+	}
+
+	e.setHealthy(true, nil)
+	return nil
+}
+
+// setHealthy logs transitions between delivering and failing, rather than
+// every failed attempt.
+func (e *backgroundExporter[T]) setHealthy(healthy bool, err error) {
+	e.mu.Lock()
+	changed := e.healthy != healthy
+	e.healthy = healthy
+	queued, dropped := len(e.queue), e.dropped
+	if healthy {
+		e.dropped = 0
+	}
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if healthy {
+		logger().Info("Telemetry collector reachable again",
+			zap.String("signal", e.signal),
+			zap.Int("dropped", dropped),
+		)
+		return
+	}
+	logger().Warn("Telemetry collector unreachable, buffering and retrying",
+		zap.String("signal", e.signal),
+		zap.Int("queued", queued),
+		zap.Error(err),
+	)
+}
+
+// close stops retrying, makes a last delivery attempt and shuts down the
+// underlying exporter.
+func (e *backgroundExporter[T]) close(ctx context.Context) error {
+	e.stop()
+	<-e.done
+
+	if err := e.flush(ctx); err != nil {
+		logger().Warn("Discarding undelivered telemetry on shutdown", zap.String("signal", e.signal), zap.Error(err))
+	}
+
+	e.mu.Lock()
+	shutdown := e.shutdown
+	e.mu.Unlock()
+	if shutdown == nil {
+		return nil
+	}
+	return shutdown(ctx)
+}
+
+// backgroundSpanExporter adapts backgroundExporter to sdktrace.SpanExporter.
+type backgroundSpanExporter struct {
+	*backgroundExporter[sdktrace.ReadOnlySpan]
+}
+
+// NewSpanExporter returns a span exporter for the collector at endpoint
+// that never blocks or fails the caller. Spans are buffered and delivered
+// in the background, so a service starts and keeps serving while the
+// collector is unreachable.
+func NewSpanExporter(endpoint string) sdktrace.SpanExporter {
+	return backgroundSpanExporter{newBackgroundExporter("traces",
+		func(ctx context.Context) (func(context.Context, []sdktrace.ReadOnlySpan) error, func(context.Context) error, error) {
+			exporter, err := otlptracegrpc.New(ctx,
+				otlptracegrpc.WithEndpoint(endpoint),
+				otlptracegrpc.WithInsecure(),
+				// Retries are handled by the background exporter
+				otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{Enabled: false}),
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			return exporter.ExportSpans, exporter.Shutdown, nil
+		},
+	)}
+}
+
+func (e backgroundSpanExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.enqueue(spans)
+	return nil
+}
+
+func (e backgroundSpanExporter) Shutdown(ctx context.Context) error {
+	return e.close(ctx)
+}
+
+// backgroundLogExporter adapts backgroundExporter to sdklog.Exporter.
+type backgroundLogExporter struct {
+	*backgroundExporter[sdklog.Record]
+}
+
+// newLogExporter returns a log exporter for the collector at endpoint that
+// never blocks or fails the caller.
+func newLogExporter(endpoint string) sdklog.Exporter {
+	return backgroundLogExporter{newBackgroundExporter("logs",
+		func(ctx context.Context) (func(context.Context, []sdklog.Record) error, func(context.Context) error, error) {
+			exporter, err := otlploggrpc.New(ctx,
+				otlploggrpc.WithEndpoint(endpoint),
+				otlploggrpc.WithInsecure(),
+				otlploggrpc.WithRetry(otlploggrpc.RetryConfig{Enabled: false}),
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			return exporter.Export, exporter.Shutdown, nil
+		},
+	)}
+}
+
+func (e backgroundLogExporter) Export(_ context.Context, records []sdklog.Record) error {
+	// Records are only valid during the call, so queue copies
+	copies := make([]sdklog.Record, len(records))
+	for i, r := range records {
+		copies[i] = r.Clone()
+	}
+	e.enqueue(copies)
+	return nil
+}
+
+func (e backgroundLogExporter) Shutdown(ctx context.Context) error {
+	return e.close(ctx)
+}
+
+func (e backgroundLogExporter) ForceFlush(context.Context) error {
+	return nil
+}
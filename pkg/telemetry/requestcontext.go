@@ -0,0 +1,102 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// The gateway describes every request in its baggage: the tenant (see
+// tenant.go), the user it acts for, a hash of the API key it came with and
+// the client app. The propagator forwards the baggage on every downstream
+// call, so each service tags its spans and logs with the same members, and
+// its metrics with the bounded ones, the tenant and the client app.
+
+// Baggage members set by the gateway, besides the tenant
+const (
+	UserBaggageKey      = "user.id"
+	APIKeyBaggageKey    = "api_key.id"
+	ClientAppBaggageKey = "client.app_id"
+)
+
+var (
+	// contextBaggageKeys are the members spans and log records are tagged
+	// with
+	contextBaggageKeys = []string{TenantBaggageKey, UserBaggageKey, APIKeyBaggageKey, ClientAppBaggageKey}
+	contextKeysMutex   sync.RWMutex
+)
+
+// AddContextBaggageKey tags spans and log records with one more baggage
+// member, for members a service sets itself. Call it before serving.
+func AddContextBaggageKey(key string) {
+	contextKeysMutex.Lock()
+	defer contextKeysMutex.Unlock()
+	contextBaggageKeys = append(contextBaggageKeys[:len(contextBaggageKeys):len(contextBaggageKeys)], key)
+}
+
+// ContextBaggageKeys returns the members spans and log records are tagged
+// with.
+func ContextBaggageKeys() []string {
+	contextKeysMutex.RLock()
+	defer contextKeysMutex.RUnlock()
+	return contextBaggageKeys
+}
+
+// ContextAttributes are the metric attributes of the request in ctx: its
+// tenant and, if known, its client app.
+func ContextAttributes(ctx context.Context) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{TenantAttr(ctx)}
+	if app := baggage.FromContext(ctx).Member(ClientAppBaggageKey).Value(); app != "" {
+		attrs = append(attrs, attribute.String("client_app_id", app))
+	}
+	return attrs
+}
+
+// ContextAttrs is ContextAttributes as a measurement option.
+func ContextAttrs(ctx context.Context) metric.MeasurementOption {
+	return metric.WithAttributes(ContextAttributes(ctx)...)
+}
+
+// ContextFields are the log fields of the request in ctx. The tenant keeps
+// its tenant_id field; the other members are logged under their keys.
+func ContextFields(ctx context.Context) []zap.Field {
+	b := baggage.FromContext(ctx)
+	var fields []zap.Field
+	for _, key := range ContextBaggageKeys() {
+		value := b.Member(key).Value()
+		if value == "" {
+			continue
+		}
+		if key == TenantBaggageKey {
+			key = "tenant_id"
+		}
+		fields = append(fields, zap.String(key, value))
+	}
+	if id := middleware.RequestIDFromContext(ctx); id != "" {
+		fields = append(fields, zap.String("request_id", id))
+	}
+	return fields
+}
+
+// ContextSpanProcessor tags every span started within a request's context
+// with its baggage members.
+type ContextSpanProcessor struct{}
+
+func (ContextSpanProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	b := baggage.FromContext(ctx)
+	for _, key := range ContextBaggageKeys() {
+		if value := b.Member(key).Value(); value != "" {
+			s.SetAttributes(attribute.String(key, value))
+		}
+	}
+}
+
+func (ContextSpanProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (ContextSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (ContextSpanProcessor) ForceFlush(context.Context) error { return nil }
@@ -0,0 +1,181 @@
+package telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Runtime configuration is read from CONFIG_FILE, typically a mounted
+// ConfigMap, as KEY=VALUE lines using the same names as the environment
+// variables. Values in the file override the environment and are re-read
+// every CONFIG_RELOAD_INTERVAL; keys removed from the file fall back to the
+// environment again. Only keys with a registered hook take effect without
+// a restart.
+var (
+	// LogLevel is shared by every logger core so it can change at runtime
+	LogLevel = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+
+	runtimeValues map[string]string
+	runtimeHooks  = map[string][]func(){}
+	runtimeMutex  sync.RWMutex
+)
+
+// RuntimeValue returns key from the runtime config file, falling back to
+// the environment.
+func RuntimeValue(key string) string {
+	if v, ok := RuntimeOverride(key); ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// RuntimeOverride returns key from the runtime config file only.
+func RuntimeOverride(key string) (string, bool) {
+	runtimeMutex.RLock()
+	defer runtimeMutex.RUnlock()
+	v, ok := runtimeValues[key]
+	return v, ok
+}
+
+// OnRuntimeChange registers fn to run whenever key changes.
+func OnRuntimeChange(key string, fn func()) {
+	runtimeMutex.Lock()
+	runtimeHooks[key] = append(runtimeHooks[key], fn)
+	runtimeMutex.Unlock()
+}
+
+// InitRuntimeConfig loads the runtime config file, applies the log level
+// and starts watching the file for changes.
+func InitRuntimeConfig() {
+	OnRuntimeChange("LOG_LEVEL", applyLogLevel)
+
+	path := os.Getenv("CONFIG_FILE")
+	var content []byte
+	if path != "" {
+		content, _ = os.ReadFile(path)
+		runtimeMutex.Lock()
+		runtimeValues = parseRuntimeConfig(content)
+		runtimeMutex.Unlock()
+	}
+	applyLogLevel()
+
+	if path == "" {
+		return
+	}
+
+	interval := 10 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("CONFIG_RELOAD_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+	logger().Info("Watching runtime config", zap.String("path", path), zap.Duration("interval", interval))
+
+	go func() {
+		for range time.Tick(interval) {
+			next, err := os.ReadFile(path)
+			if err != nil && !os.IsNotExist(err) {
+				logger().Warn("Failed to read runtime config", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			if bytes.Equal(next, content) {
+				continue
+			}
+			content = next
+			reloadRuntimeConfig(parseRuntimeConfig(content))
+		}
+	}()
+}
+
+// reloadRuntimeConfig swaps in new values and runs the hooks of every key
+// whose effective value changed.
+func reloadRuntimeConfig(values map[string]string) {
+	runtimeMutex.Lock()
+	previous := runtimeValues
+	runtimeValues = values
+
+	var changed []string
+	var hooks []func()
+	for key, fns := range runtimeHooks {
+		before, hadBefore := previous[key]
+		after, hasAfter := values[key]
+		if hadBefore != hasAfter || before != after {
+			changed = append(changed, key)
+			hooks = append(hooks, fns...)
+		}
+	}
+	runtimeMutex.Unlock()
+
+	sort.Strings(changed)
+	logger().Info("Runtime config reloaded", zap.Strings("changed", changed))
+
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+func parseRuntimeConfig(content []byte) map[string]string {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+func applyLogLevel() {
+	value := RuntimeValue("LOG_LEVEL")
+	if value == "" {
+		value = "info"
+	}
+	level, err := zapcore.ParseLevel(value)
+	if err != nil {
+		logger().Warn("Ignoring invalid LOG_LEVEL", zap.String("level", value))
+		return
+	}
+	if level != LogLevel.Level() {
+		LogLevel.SetLevel(level)
+		logger().Info("Log level changed", zap.Stringer("level", level))
+	}
+}
+
+// K8sResourceAttributes describes the pod the service runs in, from the
+// POD_NAME, POD_NAMESPACE and NODE_NAME variables the manifests fill in
+// through the downward API.
+func K8sResourceAttributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if v := os.Getenv("POD_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SPodName(v), semconv.ServiceInstanceID(v))
+	}
+	if v := os.Getenv("POD_NAMESPACE"); v != "" {
+		attrs = append(attrs, semconv.K8SNamespaceName(v))
+	}
+	if v := os.Getenv("NODE_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SNodeName(v))
+	}
+	return attrs
+}
+
+// ClusterServiceAddr returns the cluster DNS name of a service in the
+// namespace this service runs in, so the manifests work in any namespace.
+func ClusterServiceAddr(service string) string {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+	return service + "." + namespace + ".svc.cluster.local"
+}
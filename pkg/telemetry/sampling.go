@@ -0,0 +1,128 @@
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// NewSampler builds the trace sampler from the standard OTEL_TRACES_SAMPLER
+// and OTEL_TRACES_SAMPLER_ARG variables. In addition to the standard
+// samplers, "ratelimited" and "parentbased_ratelimited" sample at most ARG
+// new traces per second. The default is parentbased_always_on. The sampler
+// is rebuilt when either setting changes in the runtime config file. Spans
+// for which alwaysSample, if not nil, returns true are always sampled.
+func NewSampler(alwaysSample func(sdktrace.SamplingParameters) bool) sdktrace.Sampler {
+	s := &reloadableSampler{alwaysSample: alwaysSample}
+	s.current.Store(&samplerRef{buildSampler()})
+
+	rebuild := func() { s.current.Store(&samplerRef{buildSampler()}) }
+	OnRuntimeChange("OTEL_TRACES_SAMPLER", rebuild)
+	OnRuntimeChange("OTEL_TRACES_SAMPLER_ARG", rebuild)
+	return s
+}
+
+func buildSampler() sdktrace.Sampler {
+	name := RuntimeValue("OTEL_TRACES_SAMPLER")
+	arg := RuntimeValue("OTEL_TRACES_SAMPLER_ARG")
+
+	ratio := 1.0
+	if v, err := strconv.ParseFloat(arg, 64); err == nil {
+		ratio = v
+	}
+
+	var sampler sdktrace.Sampler
+	switch name {
+	case "always_on":
+		sampler = sdktrace.AlwaysSample()
+	case "always_off":
+		sampler = sdktrace.NeverSample()
+	case "traceidratio":
+		sampler = sdktrace.TraceIDRatioBased(ratio)
+	case "parentbased_always_off":
+		sampler = sdktrace.ParentBased(sdktrace.NeverSample())
+	case "parentbased_traceidratio":
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	case "ratelimited":
+		sampler = newRateLimitedSampler(ratio)
+	case "parentbased_ratelimited":
+		sampler = sdktrace.ParentBased(newRateLimitedSampler(ratio))
+	case "", "parentbased_always_on":
+		sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	default:
+		logger().Warn("Unknown OTEL_TRACES_SAMPLER, using parentbased_always_on", zap.String("sampler", name))
+		sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+
+	logger().Info("Trace sampler configured", zap.String("sampler", sampler.Description()))
+	return sampler
+}
+
+// reloadableSampler delegates to a sampler that can be swapped at runtime.
+type reloadableSampler struct {
+	current      atomic.Pointer[samplerRef]
+	alwaysSample func(sdktrace.SamplingParameters) bool
+}
+
+type samplerRef struct {
+	sdktrace.Sampler
+}
+
+func (s *reloadableSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if s.alwaysSample != nil && s.alwaysSample(p) {
+		return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample}
+	}
+	return s.current.Load().ShouldSample(p)
+}
+
+func (s *reloadableSampler) Description() string {
+	return s.current.Load().Description()
+}
+
+// rateLimitedSampler samples up to perSecond traces per second using a
+// token bucket, dropping the rest.
+type rateLimitedSampler struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimitedSampler(perSecond float64) *rateLimitedSampler {
+	burst := math.Max(perSecond, 1)
+	return &rateLimitedSampler{perSecond: perSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (s *rateLimitedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	s.mu.Lock()
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.perSecond
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+
+	decision := sdktrace.Drop
+	if s.tokens >= 1 {
+		s.tokens--
+		decision = sdktrace.RecordAndSample
+	}
+	s.mu.Unlock()
+
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (s *rateLimitedSampler) Description() string {
+	return fmt.Sprintf("RateLimited{%g/s}", s.perSecond)
+}
@@ -0,0 +1,133 @@
+// Package telemetry is the observability plumbing every service shares: the
+// zap logger with trace-correlated records, the export of traces and logs
+// to the collector, the trace sampler, analytics events recorded as spans,
+// the runtime config file that adjusts them without a restart, and the
+// request context the gateway describes in the baggage (tenant, user, API
+// key and client app), which tags spans, logs and metrics.
+//
+// A service builds its logger and loads its runtime config first thing,
+// then sets up tracing with the pieces here:
+//
+//	logger, err = telemetry.NewLogger()
+//	telemetry.InitRuntimeConfig()
+//	tp := sdktrace.NewTracerProvider(
+//		sdktrace.WithBatcher(telemetry.NewSpanExporter(endpoint)),
+//		sdktrace.WithSpanProcessor(telemetry.ContextSpanProcessor{}),
+//		sdktrace.WithSampler(telemetry.NewSampler(nil)),
+//	)
+//	logger, lp, err = telemetry.ExportLogs(logger, "jokes-service", endpoint, res)
+//
+// The package logs through the logger NewLogger or ExportLogs last
+// returned.
+package telemetry
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/contrib/bridges/otelzap"
+	"go.opentelemetry.io/otel/log/global"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// currentLogger is the logger the package logs through
+var currentLogger atomic.Pointer[zap.Logger]
+
+func logger() *zap.Logger {
+	if l := currentLogger.Load(); l != nil {
+		return l
+	}
+	return zap.NewNop()
+}
+
+// NewLogger builds the service logger: JSON on stdout at LogLevel, with
+// context.Context fields replaced by the trace_id and span_id of the span
+// they carry.
+func NewLogger() (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	config.EncoderConfig.TimeKey = "timestamp"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.Level = LogLevel
+	l, err := config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return traceCore{core}
+	}))
+	if err != nil {
+		return nil, err
+	}
+	currentLogger.Store(l)
+	return l, nil
+}
+
+// ExportLogs ships logs to the collector at endpoint alongside traces by
+// teeing l into the OTel logs bridge, and returns the teed logger. Like
+// spans, exported logs are buffered while the collector is unreachable.
+func ExportLogs(l *zap.Logger, serviceName, endpoint string, res *resource.Resource) (*zap.Logger, *sdklog.LoggerProvider, error) {
+	lp := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(newLogExporter(endpoint))),
+		sdklog.WithResource(res),
+	)
+	global.SetLoggerProvider(lp)
+
+	// The exported copy follows the runtime log level like stdout does
+	otelCore, err := zapcore.NewIncreaseLevelCore(otelzap.NewCore(serviceName, otelzap.WithLoggerProvider(lp)), LogLevel)
+	if err != nil {
+		return l, lp, err
+	}
+
+	l = l.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, otelCore)
+	}))
+	currentLogger.Store(l)
+	return l, lp, nil
+}
+
+// LoggerFor returns l bound to ctx. Records carry the trace and span IDs
+// of the span active in ctx, both on stdout and in the OTLP log export,
+// along with the tenant, user, API key and client app of the request (see
+// ContextFields).
+func LoggerFor(ctx context.Context, l *zap.Logger) *zap.Logger {
+	return l.With(append([]zap.Field{zap.Any("context", ctx)}, ContextFields(ctx)...)...)
+}
+
+// traceCore wraps the stdout core, replacing context.Context fields with
+// the trace_id and span_id of the span they carry.
+type traceCore struct {
+	zapcore.Core
+}
+
+func (c traceCore) With(fields []zapcore.Field) zapcore.Core {
+	return traceCore{c.Core.With(traceFields(fields))}
+}
+
+func (c traceCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c traceCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, traceFields(fields))
+}
+
+func traceFields(fields []zapcore.Field) []zapcore.Field {
+	out := fields[:0:0]
+	for _, f := range fields {
+		ctx, ok := f.Interface.(context.Context)
+		if !ok {
+			out = append(out, f)
+			continue
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			out = append(out,
+				zap.String("trace_id", sc.TraceID().String()),
+				zap.String("span_id", sc.SpanID().String()),
+			)
+		}
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package telemetry
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TenantBaggageKey is the baggage member carrying the tenant ID. The
+// gateway sets it and the propagator forwards it on every downstream call,
+// including calls between backends.
+const TenantBaggageKey = "tenant.id"
+
+// DefaultTenant owns requests that arrive without a tenant
+const DefaultTenant = "default"
+
+// TenantOf returns the tenant carried in ctx, if any.
+func TenantOf(ctx context.Context) (string, bool) {
+	tenant := baggage.FromContext(ctx).Member(TenantBaggageKey).Value()
+	return tenant, tenant != ""
+}
+
+// TenantFromContext returns the tenant carried in ctx, or DefaultTenant.
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := TenantOf(ctx); ok {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// WithTenant returns a copy of ctx whose baggage carries tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	member, err := baggage.NewMemberRaw(TenantBaggageKey, tenant)
+	if err != nil {
+		return ctx
+	}
+	b, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// TenantAttr is the metric attribute for the tenant carried in ctx.
+func TenantAttr(ctx context.Context) attribute.KeyValue {
+	return attribute.String("tenant_id", TenantFromContext(ctx))
+}
+
+// TenantMiddleware assigns requests without a tenant to DefaultTenant and
+// tags the server span, which starts before the tenant is known. Backends
+// install it; the gateway resolves the tenant itself.
+func TenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		tenant, ok := TenantOf(ctx)
+		if !ok {
+			tenant = DefaultTenant
+			ctx = WithTenant(ctx, tenant)
+			c.Request = c.Request.WithContext(ctx)
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String(TenantBaggageKey, tenant))
+		c.Next()
+	}
+}
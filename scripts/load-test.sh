@@ -21,7 +21,7 @@ for i in $(seq 1 $REQUESTS); do
   # 30% chance to add to favorites
   if [ $((RANDOM % 10)) -lt 3 ]; then
     USER_ID="user$((RANDOM % 10))"
-    curl -s -X POST "$BASE_URL/api/v1/favorite" \
+    curl -s -X POST "$BASE_URL/api/v1/favorites" \
       -H "Content-Type: application/json" \
       -d "{\"joke\":\"Test joke $i\",\"user_id\":\"$USER_ID\"}" > /dev/null
   fi
@@ -35,14 +35,14 @@ curl -s "$BASE_URL/api/v1/joke" | jq .
 echo ""
 echo "5. Add Favorite Joke"
 echo "-----------------------------------"
-curl -s -X POST "$BASE_URL/api/v1/favorite" \
+curl -s -X POST "$BASE_URL/api/v1/favorites" \
   -H "Content-Type: application/json" \
   -d "{\"joke\":\"$JOKE_TEXT\",\"user_id\":\"user123\"}" | jq .
 
 echo ""
 echo "6. Add Another Favorite"
 echo "-----------------------------------"
-curl -s -X POST "$BASE_URL/api/v1/favorite" \
+curl -s -X POST "$BASE_URL/api/v1/favorites" \
   -H "Content-Type: application/json" \
   -d '{"joke":"Test joke from script","user_id":"user456"}' | jq .
 
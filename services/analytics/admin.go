@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// AuditEntry records an administrative action against the stats.
+type AuditEntry struct {
+	Time     time.Time              `json:"time"`
+	Action   string                 `json:"action"`
+	Service  string                 `json:"service"`
+	ClientIP string                 `json:"client_ip"`
+	TraceID  string                 `json:"trace_id"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// BackfillEvent is a batch of historical joke events at one point in time.
+type BackfillEvent struct {
+	Timestamp time.Time `json:"timestamp" binding:"required"`
+	Count     int64     `json:"count" binding:"required,min=1"`
+}
+
+type BackfillRequest struct {
+	Events []BackfillEvent `json:"events" binding:"required,min=1,dive"`
+}
+
+// maxAuditEntries bounds the in-memory audit trail
+const maxAuditEntries = 500
+
+var (
+	auditLog      []AuditEntry
+	auditLogMutex sync.Mutex
+)
+
+// audit records an admin action in the audit trail, the logs and the span.
+func audit(c *gin.Context, action string, details map[string]interface{}) {
+	ctx := c.Request.Context()
+	span := trace.SpanFromContext(ctx)
+
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Action:   action,
+		Service:  c.GetHeader(middleware.InternalServiceHeader),
+		ClientIP: c.ClientIP(),
+		TraceID:  span.SpanContext().TraceID().String(),
+		Details:  details,
+	}
+
+	auditLogMutex.Lock()
+	auditLog = append(auditLog, entry)
+	if len(auditLog) > maxAuditEntries {
+		auditLog = auditLog[len(auditLog)-maxAuditEntries:]
+	}
+	auditLogMutex.Unlock()
+
+	span.AddEvent("admin.audit", trace.WithAttributes(
+		attribute.String("admin.action", action),
+		attribute.String("admin.service", entry.Service),
+	))
+
+	loggerFor(ctx).Warn("Admin action",
+		zap.Bool("audit", true),
+		zap.String("action", action),
+		zap.String("service", entry.Service),
+		zap.String("client_ip", entry.ClientIP),
+		zap.Any("details", details),
+	)
+}
+
+// registerAdminRoutes installs the admin endpoints on the internal group,
+// which is already guarded by internal auth. Reset and backfill take an
+// optional tenant query parameter; replay rebuilds the aggregates from the
+// event log (see eventlog.go).
+func registerAdminRoutes(internal *gin.RouterGroup) {
+	admin := internal.Group("/admin")
+
+	admin.POST("/reset", func(c *gin.Context) {
+		previous := resetStats(c.Request.Context(), c.Query("tenant"))
+		audit(c, "reset", previous)
+		c.JSON(http.StatusOK, gin.H{"status": "reset", "previous": previous})
+	})
+
+	admin.GET("/dump", func(c *gin.Context) {
+		dump := dumpStats(c.Request.Context())
+		audit(c, "dump", nil)
+		c.JSON(http.StatusOK, dump)
+	})
+
+	admin.POST("/backfill", func(c *gin.Context) {
+		var req BackfillRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+
+		tenant := c.Query("tenant")
+		if tenant == "" {
+			tenant = telemetry.TenantFromContext(c.Request.Context())
+		}
+
+		imported := backfillStats(c.Request.Context(), tenant, req.Events, true)
+		logBackfill(c.Request.Context(), tenant, req.Events)
+		audit(c, "backfill", map[string]interface{}{
+			"tenant":   tenant,
+			"events":   len(req.Events),
+			"imported": imported,
+		})
+		c.JSON(http.StatusOK, gin.H{"status": "backfilled", "imported": imported})
+	})
+
+	admin.POST("/replay", func(c *gin.Context) {
+		var from time.Time
+		if v := c.Query("from"); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+				return
+			}
+			from = parsed
+		}
+
+		result, err := replayEvents(c.Request.Context(), from)
+		switch {
+		case errors.Is(err, errEventLogDisabled), errors.Is(err, errReplayRunning):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			loggerFor(c.Request.Context()).Error("Replay failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "replay failed, the aggregates are incomplete"})
+			return
+		}
+
+		audit(c, "replay", map[string]interface{}{
+			"from":     c.Query("from"),
+			"replayed": result.Replayed,
+			"skipped":  result.Skipped,
+		})
+		c.JSON(http.StatusOK, gin.H{"status": "replayed", "result": result})
+	})
+
+	admin.GET("/quarantine", quarantineHandler)
+}
+
+// resetStats zeroes the tenant's counters, or every tenant's counters, the
+// latency sketches, the SLO counts and the route statuses when tenant is
+// empty, and returns the values they had.
+func resetStats(ctx context.Context, tenant string) map[string]interface{} {
+	ctx, span := tracer.Start(ctx, "resetStats")
+	defer span.End()
+
+	resetSharedStats(ctx, tenant)
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	var requests, totalJokes int64
+	for name, s := range stats {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		requests += s.requests
+		totalJokes += s.totalJokes
+		stats[name] = newStats()
+	}
+	if tenant == "" {
+		resetLatencies()
+		resetSLIs()
+		resetRouteStatuses()
+	}
+
+	previous := map[string]interface{}{
+		"total_requests": requests,
+		"total_jokes":    totalJokes,
+	}
+	if tenant != "" {
+		previous["tenant"] = tenant
+	}
+	return previous
+}
+
+// dumpStats returns the raw counters of every tenant, including the
+// per-minute and hourly buckets.
+func dumpStats(ctx context.Context) map[string]interface{} {
+	_, span := tracer.Start(ctx, "dumpStats")
+	defer span.End()
+
+	statsMutex.RLock()
+	tenants := make(map[string]interface{}, len(stats))
+	for tenant, s := range stats {
+		buckets := make(map[string]int64, len(s.minuteBuckets))
+		for minute, count := range s.minuteBuckets {
+			buckets[strconv.FormatInt(minute, 10)] = count
+		}
+		hours := make(map[string]int64, len(s.hourBuckets))
+		for hour, count := range s.hourBuckets {
+			hours[strconv.FormatInt(hour, 10)] = count
+		}
+		tenants[tenant] = map[string]interface{}{
+			"requests":       s.requests,
+			"total_jokes":    s.totalJokes,
+			"last_update":    s.lastUpdate.Format(time.RFC3339Nano),
+			"minute_buckets": buckets,
+			"hour_buckets":   hours,
+		}
+	}
+	statsMutex.RUnlock()
+
+	alertStateMutex.Lock()
+	alerts := make(map[string]bool, len(alertState))
+	for name, firing := range alertState {
+		alerts[name] = firing
+	}
+	alertStateMutex.Unlock()
+
+	auditLogMutex.Lock()
+	audits := append([]AuditEntry(nil), auditLog...)
+	auditLogMutex.Unlock()
+
+	return map[string]interface{}{
+		"tenants":        tenants,
+		"queue_depth":    len(eventQueue),
+		"queue_capacity": cap(eventQueue),
+		"alerts":         alerts,
+		"latency":        latencySummary(""),
+		"audit_log":      audits,
+	}
+}
+
+// backfillStats imports historical events into the tenant's aggregates,
+// and into the shared counters if share is set, and returns the number of
+// jokes imported.
+func backfillStats(ctx context.Context, tenant string, events []BackfillEvent, share bool) int64 {
+	_, span := tracer.Start(ctx, "backfillStats")
+	defer span.End()
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	s := statsFor(tenant)
+	now := time.Now()
+	var imported int64
+	var latest time.Time
+	for _, event := range events {
+		s.requests += event.Count
+		s.totalJokes += event.Count
+		imported += event.Count
+
+		s.addToBuckets(event.Timestamp, now, event.Count)
+		if event.Timestamp.After(s.lastUpdate) && event.Timestamp.Before(now) {
+			s.lastUpdate = event.Timestamp
+		}
+		if event.Timestamp.After(latest) && event.Timestamp.Before(now) {
+			latest = event.Timestamp
+		}
+	}
+	if share {
+		shareStats(tenant, imported, imported, latest)
+	}
+
+	span.SetAttributes(
+		attribute.String("backfill.tenant", tenant),
+		attribute.Int64("backfill.imported", imported),
+	)
+	return imported
+}
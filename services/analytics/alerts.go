@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// AlertRule is a single threshold evaluated against a stats snapshot.
+// Evaluate returns whether the rule is currently breached and a human
+// readable description of the observed value.
+type AlertRule struct {
+	Name     string
+	Evaluate func(s AlertSnapshot) (bool, string)
+}
+
+// AlertSnapshot is the view of the stats the rules are evaluated against.
+type AlertSnapshot struct {
+	JokesLastMinute int64
+	IdleFor         time.Duration
+	// Requests and server errors the gateway reported over the error rate
+	// window, across routes and backends (see routeerrors.go)
+	Requests int64
+	Errors   int64
+}
+
+// SlackMessage is the Slack-compatible incoming webhook payload.
+type SlackMessage struct {
+	Text string `json:"text"`
+}
+
+var (
+	alertRules    []AlertRule
+	alertWebhooks []string
+	// alertErrorWindow is the window the error rate is computed over
+	alertErrorWindow = 5 * time.Minute
+
+	// Rules currently firing, used to avoid sending the same alert on every tick
+	alertState      = map[string]bool{}
+	alertStateMutex sync.Mutex
+)
+
+func initAlerting() {
+	for _, url := range strings.Split(os.Getenv("ALERT_WEBHOOK_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			alertWebhooks = append(alertWebhooks, url)
+		}
+	}
+
+	spikeThreshold := int64(getEnvInt("ALERT_JOKES_PER_MINUTE_THRESHOLD", 600))
+	idleThreshold := getEnvDuration("ALERT_IDLE_THRESHOLD", 10*time.Minute)
+	errorRateThreshold := getEnvFloat("ALERT_ERROR_RATE_THRESHOLD", degradedErrorRate)
+	// Too few requests make the rate meaningless
+	errorRateMinRequests := int64(getEnvInt("ALERT_ERROR_RATE_MIN_REQUESTS", 20))
+	if v := getEnvDuration("ALERT_ERROR_RATE_WINDOW", alertErrorWindow); v >= time.Minute && v <= maxErrorWindow {
+		alertErrorWindow = v
+	}
+
+	alertRules = []AlertRule{
+		{
+			Name: "jokes_per_minute_spike",
+			Evaluate: func(s AlertSnapshot) (bool, string) {
+				return s.JokesLastMinute > spikeThreshold,
+					fmt.Sprintf("%d jokes served in the last minute (threshold %d)", s.JokesLastMinute, spikeThreshold)
+			},
+		},
+		{
+			Name: "zero_traffic",
+			Evaluate: func(s AlertSnapshot) (bool, string) {
+				return s.IdleFor >= idleThreshold,
+					fmt.Sprintf("no jokes tracked for %s (threshold %s)", s.IdleFor.Round(time.Second), idleThreshold)
+			},
+		},
+		{
+			Name: "error_rate",
+			Evaluate: func(s AlertSnapshot) (bool, string) {
+				var rate float64
+				if s.Requests > 0 {
+					rate = float64(s.Errors) / float64(s.Requests)
+				}
+				return s.Requests >= errorRateMinRequests && rate > errorRateThreshold,
+					fmt.Sprintf("%.1f%% of %d requests failed with a server error in the last %s (threshold %.1f%%)",
+						rate*100, s.Requests, alertErrorWindow, errorRateThreshold*100)
+			},
+		},
+	}
+}
+
+// runAlerting evaluates all rules on every tick until ctx is cancelled.
+func runAlerting(ctx context.Context) {
+	interval := getEnvDuration("ALERT_EVAL_INTERVAL", time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger.Info("Alerting started",
+		zap.Duration("interval", interval),
+		zap.Int("rules", len(alertRules)),
+		zap.Int("webhooks", len(alertWebhooks)),
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			evaluateAlerts(ctx)
+		}
+	}
+}
+
+// alertSnapshot sums the stats of all tenants, since the rules watch the
+// service's overall traffic.
+func alertSnapshot() AlertSnapshot {
+	now := time.Now()
+	snapshot := AlertSnapshot{IdleFor: time.Since(startedAt)}
+
+	_, backends := routeErrors(alertErrorWindow, "", "", now)
+	for _, b := range backends {
+		snapshot.Requests += b.Requests
+		snapshot.Errors += b.Errors
+	}
+
+	statsMutex.RLock()
+	defer statsMutex.RUnlock()
+
+	lastMinute := now.Truncate(time.Minute).Add(-time.Minute).Unix()
+	for _, s := range stats {
+		snapshot.JokesLastMinute += s.minuteBuckets[lastMinute]
+		if idle := time.Since(s.lastUpdate); idle < snapshot.IdleFor {
+			snapshot.IdleFor = idle
+		}
+	}
+	return snapshot
+}
+
+func evaluateAlerts(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "evaluateAlerts")
+	defer span.End()
+
+	snapshot := alertSnapshot()
+
+	for _, rule := range alertRules {
+		breached, detail := rule.Evaluate(snapshot)
+
+		alertStateMutex.Lock()
+		wasFiring := alertState[rule.Name]
+		alertState[rule.Name] = breached
+		alertStateMutex.Unlock()
+
+		switch {
+		case breached && !wasFiring:
+			loggerFor(ctx).Warn("Alert firing",
+				zap.String("rule", rule.Name),
+				zap.String("detail", detail),
+			)
+			sendAlert(ctx, fmt.Sprintf(":rotating_light: [FIRING] %s: %s", rule.Name, detail))
+		case !breached && wasFiring:
+			loggerFor(ctx).Info("Alert resolved",
+				zap.String("rule", rule.Name),
+				zap.String("detail", detail),
+			)
+			sendAlert(ctx, fmt.Sprintf(":white_check_mark: [RESOLVED] %s: %s", rule.Name, detail))
+		}
+	}
+
+	span.SetAttributes(attribute.Int("alerts.rules", len(alertRules)))
+}
+
+func sendAlert(ctx context.Context, text string) {
+	payload, err := json.Marshal(SlackMessage{Text: text})
+	if err != nil {
+		logger.Error("Failed to encode alert", zap.Error(err))
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, url := range alertWebhooks {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			logger.Error("Failed to create alert request", zap.String("webhook", url), zap.Error(err))
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Warn("Failed to deliver alert", zap.String("webhook", url), zap.Error(err))
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			logger.Warn("Alert webhook rejected payload",
+				zap.String("webhook", url),
+				zap.Int("status_code", resp.StatusCode),
+			)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Each tenant's per-minute joke rate is compared with an exponentially
+// weighted moving average and standard deviation of the minutes before it.
+// A minute more than ANOMALY_THRESHOLD deviations above the average is a
+// spike, below it a drought; the anomaly lasts until a minute is back
+// within the threshold.
+
+// Anomaly kinds
+const (
+	anomalyNone    = ""
+	anomalySpike   = "spike"
+	anomalyDrought = "drought"
+)
+
+// maxAnomalyHistory bounds the past anomalies kept per tenant
+const maxAnomalyHistory = 50
+
+// Anomaly is a period during which the joke rate was abnormal.
+type Anomaly struct {
+	Kind      string     `json:"kind"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	// Peak is the furthest the rate strayed from the average, in standard
+	// deviations, and PeakRate the jokes per minute at that point
+	Peak     float64 `json:"peak_deviations"`
+	PeakRate int64   `json:"peak_rate"`
+	// Baseline is the average rate when the anomaly started
+	Baseline float64 `json:"baseline"`
+}
+
+// anomalyDetector tracks the EWMA of one tenant's rate. It is part of
+// Stats and guarded by statsMutex.
+type anomalyDetector struct {
+	mean     float64
+	variance float64
+	samples  int
+	// lastMinute is the last minute evaluated, as a unix timestamp
+	lastMinute int64
+	lastRate   int64
+	lastScore  float64
+
+	current *Anomaly
+	history []Anomaly
+}
+
+var (
+	anomalyAlpha     float64
+	anomalyThreshold float64
+	anomalyWarmup    int
+
+	anomalyEvents metric.Int64Counter
+)
+
+func initAnomalyDetection() {
+	anomalyAlpha = getEnvFloat("ANOMALY_EWMA_ALPHA", 0.1)
+	anomalyThreshold = getEnvFloat("ANOMALY_THRESHOLD", 3)
+	anomalyWarmup = getEnvInt("ANOMALY_WARMUP_MINUTES", 30)
+
+	var err error
+	anomalyEvents, err = meter.Int64Counter(
+		"analytics.anomalies",
+		metric.WithDescription("Number of traffic anomalies started and ended, by kind"),
+		metric.WithUnit("{anomaly}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create anomaly counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"analytics.anomaly.active",
+		metric.WithDescription("Whether a traffic anomaly of the kind is in progress"),
+		metric.WithUnit("{anomaly}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			statsMutex.RLock()
+			defer statsMutex.RUnlock()
+			for tenant, s := range stats {
+				for _, kind := range []string{anomalySpike, anomalyDrought} {
+					var active int64
+					if s.anomalies.current != nil && s.anomalies.current.Kind == kind {
+						active = 1
+					}
+					o.Observe(active, metric.WithAttributes(
+						attribute.String("kind", kind),
+						attribute.String("tenant_id", tenant),
+					))
+				}
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create anomaly gauge", zap.Error(err))
+	}
+}
+
+// runAnomalyDetection evaluates every tenant shortly after each minute
+// ends, until ctx is cancelled.
+func runAnomalyDetection(ctx context.Context) {
+	logger.Info("Anomaly detection started",
+		zap.Float64("alpha", anomalyAlpha),
+		zap.Float64("threshold", anomalyThreshold),
+		zap.Int("warmup_minutes", anomalyWarmup),
+	)
+
+	for {
+		// Leave a few seconds for the ingestion batches of the minute
+		next := time.Now().Truncate(time.Minute).Add(time.Minute + 5*time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			detectAnomalies(ctx, time.Now())
+		}
+	}
+}
+
+// detectAnomalies feeds the last complete minute to every tenant's
+// detector and reports anomalies that start or end.
+func detectAnomalies(ctx context.Context, now time.Time) {
+	ctx, span := tracer.Start(ctx, "detectAnomalies")
+	defer span.End()
+
+	minute := now.Truncate(time.Minute).Add(-time.Minute).Unix()
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	for tenant, s := range stats {
+		rate := s.minuteBuckets[minute]
+		started, ended := s.anomalies.observe(minute, rate, now)
+
+		tenantCtx := telemetry.WithTenant(ctx, tenant)
+		if ended != nil {
+			reportAnomaly(tenantCtx, span, "ended", *ended)
+		}
+		if started != nil {
+			reportAnomaly(tenantCtx, span, "started", *started)
+		}
+	}
+	span.SetAttributes(attribute.Int("anomalies.tenants", len(stats)))
+}
+
+// observe adds one minute's rate and returns the anomaly that started or
+// ended with it, if any.
+func (d *anomalyDetector) observe(minute, rate int64, now time.Time) (started, ended *Anomaly) {
+	if minute <= d.lastMinute {
+		return nil, nil
+	}
+	d.lastMinute = minute
+	d.lastRate = rate
+
+	// A floor of one joke per minute keeps flat traffic from turning every
+	// small change into an anomaly
+	stddev := math.Max(math.Sqrt(d.variance), 1)
+	score := (float64(rate) - d.mean) / stddev
+	d.lastScore = score
+
+	kind := anomalyNone
+	if d.samples >= anomalyWarmup {
+		switch {
+		case score > anomalyThreshold:
+			kind = anomalySpike
+		case score < -anomalyThreshold:
+			kind = anomalyDrought
+		}
+	}
+
+	if d.current != nil && d.current.Kind != kind {
+		d.current.EndedAt = &now
+		ended = d.current
+		d.history = append(d.history, *d.current)
+		if len(d.history) > maxAnomalyHistory {
+			d.history = d.history[len(d.history)-maxAnomalyHistory:]
+		}
+		d.current = nil
+	}
+	if kind != anomalyNone {
+		if d.current == nil {
+			d.current = &Anomaly{Kind: kind, StartedAt: now, Baseline: d.mean}
+			started = d.current
+		}
+		if math.Abs(score) > math.Abs(d.current.Peak) {
+			d.current.Peak = score
+			d.current.PeakRate = rate
+		}
+	}
+
+	// Once warmed up, outliers are clamped to the threshold before updating
+	// the average, so one burst doesn't inflate the deviation and mask what
+	// follows. The average still drifts toward a lasting change in traffic,
+	// which eventually becomes the new normal.
+	value := float64(rate)
+	if d.samples >= anomalyWarmup {
+		limit := anomalyThreshold * stddev
+		value = math.Min(math.Max(value, d.mean-limit), d.mean+limit)
+	}
+	if d.samples == 0 {
+		d.mean = value
+	} else {
+		diff := value - d.mean
+		incr := anomalyAlpha * diff
+		d.mean += incr
+		d.variance = (1 - anomalyAlpha) * (d.variance + diff*incr)
+	}
+	d.samples++
+
+	return started, ended
+}
+
+func reportAnomaly(ctx context.Context, span trace.Span, event string, a Anomaly) {
+	attrs := []attribute.KeyValue{
+		attribute.String("kind", a.Kind),
+		attribute.String("event", event),
+		telemetry.TenantAttr(ctx),
+	}
+	anomalyEvents.Add(ctx, 1, metric.WithAttributes(attrs...))
+	span.AddEvent("anomaly."+event, trace.WithAttributes(
+		attribute.String("anomaly.kind", a.Kind),
+		attribute.String(telemetry.TenantBaggageKey, telemetry.TenantFromContext(ctx)),
+		attribute.Float64("anomaly.peak_deviations", a.Peak),
+		attribute.Int64("anomaly.peak_rate", a.PeakRate),
+		attribute.Float64("anomaly.baseline", a.Baseline),
+	))
+
+	fields := []zap.Field{
+		zap.String("kind", a.Kind),
+		zap.Float64("peak_deviations", a.Peak),
+		zap.Int64("peak_rate", a.PeakRate),
+		zap.Float64("baseline", a.Baseline),
+	}
+	if event == "started" {
+		loggerFor(ctx).Warn("Traffic anomaly started", fields...)
+	} else {
+		loggerFor(ctx).Info("Traffic anomaly ended", append(fields, zap.Time("started_at", a.StartedAt))...)
+	}
+}
+
+// anomalyStatus describes the tenant's detector: the current anomaly, if
+// any, the baseline and recent anomalies, newest first.
+func anomalyStatus(tenant string) gin.H {
+	statsMutex.RLock()
+	defer statsMutex.RUnlock()
+
+	status := gin.H{
+		"anomaly":         nil,
+		"recent":          []Anomaly{},
+		"warming_up":      true,
+		"threshold":       anomalyThreshold,
+		"warmup_minutes":  anomalyWarmup,
+		"minutes_sampled": 0,
+	}
+	s, ok := stats[tenant]
+	if !ok {
+		return status
+	}
+	d := s.anomalies
+
+	recent := make([]Anomaly, 0, len(d.history))
+	for i := len(d.history) - 1; i >= 0; i-- {
+		recent = append(recent, d.history[i])
+	}
+	if d.current != nil {
+		status["anomaly"] = *d.current
+	}
+	status["recent"] = recent
+	status["warming_up"] = d.samples < anomalyWarmup
+	status["minutes_sampled"] = d.samples
+	status["baseline"] = gin.H{
+		"mean":   d.mean,
+		"stddev": math.Sqrt(d.variance),
+	}
+	if d.lastMinute != 0 {
+		status["last_minute"] = gin.H{
+			"minute":     time.Unix(d.lastMinute, 0).UTC().Format(time.RFC3339),
+			"rate":       d.lastRate,
+			"deviations": d.lastScore,
+		}
+	}
+	return status
+}
+
+// anomalyHistory returns the tenant's recent anomalies and the current one,
+// if any, oldest first.
+func anomalyHistory(tenant string) []Anomaly {
+	statsMutex.RLock()
+	defer statsMutex.RUnlock()
+
+	s, ok := stats[tenant]
+	if !ok {
+		return nil
+	}
+	history := append([]Anomaly(nil), s.anomalies.history...)
+	if s.anomalies.current != nil {
+		history = append(history, *s.anomalies.current)
+	}
+	return history
+}
+
+// anomalyText describes an anomaly in a line.
+func anomalyText(a Anomaly) string {
+	return fmt.Sprintf("Peaked at %d jokes/min, %.1f standard deviations from a baseline of %.1f",
+		a.PeakRate, a.Peak, a.Baseline)
+}
+
+func anomaliesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getAnomalies")
+	defer span.End()
+
+	c.JSON(http.StatusOK, anomalyStatus(telemetry.TenantFromContext(ctx)))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Contributors see how their jokes perform per author: how often their
+// jokes were served and favorited. The jokes service reports the author
+// with each joke served; favorite_added events carry only the joke ID, so
+// a favorite counts for the author the joke was served with. Favorites of
+// jokes without an author, or not served since startup, are not counted
+// for anyone.
+//
+// Counts are kept per tenant and author since startup, like the funnel's.
+
+// maxAuthors bounds the authors counted per tenant; jokes by further
+// authors are not counted. The authors of jokes are bounded by
+// maxTrendingJokes
+const maxAuthors = 10000
+
+// authorCounts are what an author's jokes did.
+type authorCounts struct {
+	served    int64
+	favorited int64
+}
+
+// AuthorStats is how the jokes of one author performed.
+type AuthorStats struct {
+	Author string `json:"author"`
+	// Jokes is the number of the author's jokes served
+	Jokes        int     `json:"jokes"`
+	Served       int64   `json:"served"`
+	Favorited    int64   `json:"favorited"`
+	FavoriteRate float64 `json:"favorite_rate_percent"`
+}
+
+// recordAuthorServing counts a serving of jokeID for its author, and
+// remembers the author for the joke's favorites. Callers must hold
+// statsMutex for writing.
+func (s *Stats) recordAuthorServing(jokeID, author string) {
+	if author == "" {
+		return
+	}
+	counts, ok := s.authors[author]
+	if !ok {
+		if len(s.authors) >= maxAuthors {
+			return
+		}
+		counts = &authorCounts{}
+		s.authors[author] = counts
+	}
+	counts.served++
+
+	if _, known := s.jokeAuthors[jokeID]; known || len(s.jokeAuthors) < maxTrendingJokes {
+		s.jokeAuthors[jokeID] = author
+	}
+}
+
+// recordAuthorFavorite counts a favorite of jokeID for its author, if
+// known. Callers must hold statsMutex for writing.
+func (s *Stats) recordAuthorFavorite(jokeID string) {
+	if counts, ok := s.authors[s.jokeAuthors[jokeID]]; ok {
+		counts.favorited++
+	}
+}
+
+// authorStatsHandler serves GET /api/v1/stats/authors?limit=20: the
+// authors whose jokes were served most, or only ?author=, regardless of
+// case.
+func authorStatsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getAuthorStats")
+	defer span.End()
+
+	limit := defaultFunnelLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxFunnelLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxFunnelLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+	only := strings.TrimSpace(c.Query("author"))
+
+	authors := []AuthorStats{}
+	statsMutex.RLock()
+	if s, ok := stats[telemetry.TenantFromContext(ctx)]; ok {
+		jokes := map[string]int{}
+		for _, author := range s.jokeAuthors {
+			jokes[author]++
+		}
+		for author, counts := range s.authors {
+			if only != "" && !strings.EqualFold(author, only) {
+				continue
+			}
+			authors = append(authors, AuthorStats{
+				Author:       author,
+				Jokes:        jokes[author],
+				Served:       counts.served,
+				Favorited:    counts.favorited,
+				FavoriteRate: conversion(counts.served, counts.favorited),
+			})
+		}
+	}
+	statsMutex.RUnlock()
+
+	sort.Slice(authors, func(i, j int) bool {
+		if authors[i].Served != authors[j].Served {
+			return authors[i].Served > authors[j].Served
+		}
+		return authors[i].Author < authors[j].Author
+	})
+	total := len(authors)
+	if len(authors) > limit {
+		authors = authors[:limit]
+	}
+
+	span.SetAttributes(
+		attribute.String("authors.author", only),
+		attribute.Int("authors.total", total),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"authors":       authors,
+		"count":         len(authors),
+		"total_authors": total,
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+)
+
+// ClientAttributes identify the client behind a tracked request: the app
+// it declared, its user agent family and the gateway route it called, and
+// the country and region the gateway located it in (see geo.go).
+type ClientAttributes struct {
+	AppID    string `json:"app_id,omitempty"`
+	UAFamily string `json:"ua_family,omitempty"`
+	Route    string `json:"route,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+}
+
+// TrackPayload is the payload of a joke_served event (see events.go).
+type TrackPayload struct {
+	JokeID string `json:"joke_id,omitempty"`
+	// UserID is the user the joke was served to, when known
+	UserID string `json:"user_id,omitempty"`
+	// Visitor is the gateway's keyed hash of the client IP
+	Visitor string `json:"visitor,omitempty"`
+	// Author of the joke, if it has one
+	Author string `json:"author,omitempty"`
+	LatencySample
+	Client ClientAttributes `json:"client"`
+}
+
+// ClientCount is the number of jokes served to one client combination.
+type ClientCount struct {
+	ClientAttributes
+	Count int64 `json:"count"`
+}
+
+// maxClientCombinations bounds the distinct clients counted per tenant;
+// further ones are counted under an "other" app
+const maxClientCombinations = 1000
+
+// countClient attributes one event to a client, leaving its location to
+// countLocation. Callers must hold statsMutex for writing.
+func (s *Stats) countClient(client ClientAttributes) {
+	client.Country, client.Region = "", ""
+	if client.AppID == "" {
+		client.AppID = "unknown"
+	}
+	if client.UAFamily == "" {
+		client.UAFamily = "unknown"
+	}
+	if client.Route == "" {
+		client.Route = "direct"
+	}
+
+	if _, ok := s.clients[client]; !ok && len(s.clients) >= maxClientCombinations {
+		client = ClientAttributes{AppID: "other", UAFamily: "other", Route: "other"}
+	}
+	s.clients[client]++
+}
+
+// clientStats breaks the tenant's traffic down by client, overall and per
+// app, user agent family and route, each sorted by count.
+func clientStats(tenant string) gin.H {
+	statsMutex.RLock()
+	clients := make([]ClientCount, 0)
+	var total int64
+	if s, ok := stats[tenant]; ok {
+		for client, count := range s.clients {
+			clients = append(clients, ClientCount{ClientAttributes: client, Count: count})
+			total += count
+		}
+	}
+	statsMutex.RUnlock()
+
+	apps := map[string]int64{}
+	families := map[string]int64{}
+	routes := map[string]int64{}
+	for _, c := range clients {
+		apps[c.AppID] += c.Count
+		families[c.UAFamily] += c.Count
+		routes[c.Route] += c.Count
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Count > clients[j].Count
+	})
+
+	return gin.H{
+		"total":       total,
+		"apps":        rankCounts(apps, "app_id"),
+		"user_agents": rankCounts(families, "ua_family"),
+		"routes":      rankCounts(routes, "route"),
+		"clients":     clients,
+	}
+}
+
+// rankCounts turns counts into a list of {key: name, "count": n}, highest
+// count first.
+func rankCounts(counts map[string]int64, key string) []gin.H {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	ranked := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		ranked = append(ranked, gin.H{key: name, "count": counts[name]})
+	}
+	return ranked
+}
+
+func clientStatsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getClientStats")
+	defer span.End()
+
+	c.JSON(http.StatusOK, clientStats(telemetry.TenantFromContext(ctx)))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GET /api/v1/stats/compare?window=7d compares the last window with the
+// window before it, with the change of each metric in absolute terms and in
+// percent, so a dashboard can show "+23% jokes served vs last week" without
+// doing the arithmetic itself. Periods are whole hours, the current one
+// ending with the last complete hour, so both are the same length and an
+// hour still under way doesn't read as a drop.
+//
+// Jokes served come from the joke buckets, which cover every window. The
+// favorites added and active users (users who requested a joke or added
+// a favorite) come from the leaderboard's hourly activity, which
+// compaction keeps for two of the longest window for this (see
+// retention.go); like the leaderboard, they leave out anonymous clients.
+
+// compareWindows are the windows that can be compared
+var compareWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+const (
+	defaultCompareWindow = "7d"
+	maxCompareWindow     = 30 * 24 * time.Hour
+)
+
+// MetricChange is a metric in the current and the previous period.
+// ChangePercent is null when the previous period is zero.
+type MetricChange struct {
+	Current       int64    `json:"current"`
+	Previous      int64    `json:"previous"`
+	Change        int64    `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+// ComparePeriod is the time range of a compared period, From inclusive
+// and To exclusive.
+type ComparePeriod struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Comparison is the tenant's metrics over two consecutive periods.
+type Comparison struct {
+	Window   string                  `json:"window"`
+	Current  ComparePeriod           `json:"current"`
+	Previous ComparePeriod           `json:"previous"`
+	Metrics  map[string]MetricChange `json:"metrics"`
+}
+
+// metricChange compares a metric's values in the two periods.
+func metricChange(current, previous int64) MetricChange {
+	change := MetricChange{Current: current, Previous: previous, Change: current - previous}
+	if previous > 0 {
+		percent := roundTo(float64(current-previous)*100/float64(previous), 1)
+		change.ChangePercent = &percent
+	}
+	return change
+}
+
+// compare compares the tenant's last window of complete hours before now
+// with the window before it.
+func compare(tenant string, window time.Duration, now time.Time) (ComparePeriod, ComparePeriod, map[string]MetricChange) {
+	size := int64(window / time.Second)
+	end := hourOf(now.Unix())
+	start := end - size
+	previousStart := start - size
+
+	// period is 0 for the current period and 1 for the previous one
+	period := func(t int64) (int, bool) {
+		switch {
+		case t >= start && t < end:
+			return 0, true
+		case t >= previousStart && t < start:
+			return 1, true
+		}
+		return 0, false
+	}
+
+	var served, favorites, users [2]int64
+	statsMutex.RLock()
+	if s, ok := stats[tenant]; ok {
+		for _, buckets := range []map[int64]int64{s.minuteBuckets, s.hourBuckets} {
+			for t, count := range buckets {
+				if p, ok := period(t); ok {
+					served[p] += count
+				}
+			}
+		}
+		for _, hours := range s.users {
+			var active [2]bool
+			for hour, activity := range hours {
+				if p, ok := period(hour); ok {
+					favorites[p] += activity.favorites
+					active[p] = true
+				}
+			}
+			for p, ok := range active {
+				if ok {
+					users[p]++
+				}
+			}
+		}
+	}
+	statsMutex.RUnlock()
+
+	current := ComparePeriod{From: time.Unix(start, 0).UTC(), To: time.Unix(end, 0).UTC()}
+	previous := ComparePeriod{From: time.Unix(previousStart, 0).UTC(), To: time.Unix(start, 0).UTC()}
+	return current, previous, map[string]MetricChange{
+		"jokes_served":    metricChange(served[0], served[1]),
+		"favorites_added": metricChange(favorites[0], favorites[1]),
+		"active_users":    metricChange(users[0], users[1]),
+	}
+}
+
+// compareHandler serves GET /api/v1/stats/compare?window=7d.
+func compareHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getComparison")
+	defer span.End()
+
+	windowName := c.DefaultQuery("window", defaultCompareWindow)
+	window, ok := compareWindows[windowName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be one of 1h, 24h, 7d or 30d"})
+		return
+	}
+
+	current, previous, metrics := compare(telemetry.TenantFromContext(ctx), window, time.Now())
+
+	span.SetAttributes(
+		attribute.String("compare.window", windowName),
+		attribute.Int64("compare.jokes_served", metrics["jokes_served"].Current),
+	)
+
+	c.JSON(http.StatusOK, Comparison{
+		Window:   windowName,
+		Current:  current,
+		Previous: previous,
+		Metrics:  metrics,
+	})
+}
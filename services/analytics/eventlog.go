@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The aggregates are only as right as the code that built them. With
+// EVENT_LOG_PATH set, every valid tracking event is also appended, as
+// received, to a JSON lines file along with its tenant and the time it
+// was received, and so is every backfill. Nothing is ever rewritten but
+// for user erasure, which drops the lines mentioning the deleted user, as
+// it does in the quarantine.
+//
+// POST /internal/admin/replay?from=RFC3339 rebuilds the aggregates from the
+// log: it zeroes this replica's counters, latencies, SLOs, route statuses,
+// reactions and experiments, then decodes and applies the events logged at
+// or after from (the whole log by default) in order, with the current code
+// and the times they were received. Events the current schemas reject are
+// skipped. The shared headline counters (see sharedstats.go) sum every
+// replica's log, so replay leaves them alone; reset them if they are wrong.
+// joke_served events still queued for aggregation when a replay starts (see
+// ingest.go) are counted twice.
+//
+// The log grows with the traffic and is never trimmed; it is the history.
+
+// replayBatchSize is the number of joke_served events replayed per batch
+const replayBatchSize = 1000
+
+// LoggedEvent is a line of the event log: an event or a backfill.
+type LoggedEvent struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Tenant     string    `json:"tenant,omitempty"`
+	// EndpointType is the type of v1 events of the endpoint the event
+	// was posted to (see decodeEvent), empty for POST /internal/events
+	EndpointType string          `json:"endpoint_type,omitempty"`
+	Body         json.RawMessage `json:"body,omitempty"`
+	// Backfill holds the events of a backfill (see admin.go)
+	Backfill []BackfillEvent `json:"backfill,omitempty"`
+}
+
+// ReplayResult counts what a replay did.
+type ReplayResult struct {
+	Replayed int64            `json:"replayed"`
+	ByType   map[string]int64 `json:"by_type"`
+	// Skipped events are rejected by the current schemas
+	Skipped int64 `json:"skipped"`
+	// Unreadable lines are not log entries, such as a line cut short
+	Unreadable int64 `json:"unreadable"`
+}
+
+var (
+	errEventLogDisabled = errors.New("the event log is disabled (EVENT_LOG_PATH)")
+	errReplayRunning    = errors.New("a replay is already running")
+)
+
+var (
+	eventLogPath  string
+	eventLog      *os.File
+	eventLogMutex sync.Mutex
+
+	replayMutex sync.Mutex
+)
+
+func initEventLog() {
+	eventLogPath = os.Getenv("EVENT_LOG_PATH")
+	if eventLogPath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(eventLogPath), 0o700); err != nil {
+		logger.Fatal("Failed to create event log directory", zap.Error(err))
+	}
+	var err error
+	eventLog, err = openEventLog()
+	if err != nil {
+		logger.Fatal("Failed to open event log", zap.String("path", eventLogPath), zap.Error(err))
+	}
+	logger.Info("Event log enabled", zap.String("path", eventLogPath))
+}
+
+func openEventLog() (*os.File, error) {
+	return os.OpenFile(eventLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+}
+
+// appendEventLog writes an entry to the log, if enabled. Failures are
+// logged, not returned, as the event has been counted regardless.
+func appendEventLog(ctx context.Context, entry LoggedEvent) {
+	if eventLog == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		eventLogMutex.Lock()
+		_, err = eventLog.Write(append(line, '\n'))
+		eventLogMutex.Unlock()
+	}
+	if err != nil {
+		loggerFor(ctx).Error("Failed to write event log", zap.Error(err))
+	}
+}
+
+// logEvent logs a valid event with the body it was received with.
+// endpointType is the type of v1 events of the endpoint it came from.
+func logEvent(ctx context.Context, endpointType string, body []byte, event Event) {
+	appendEventLog(ctx, LoggedEvent{
+		ReceivedAt:   event.ReceivedAt,
+		Tenant:       telemetry.TenantFromContext(ctx),
+		EndpointType: endpointType,
+		Body:         body,
+	})
+}
+
+// logBackfill logs a backfill of the tenant's stats.
+func logBackfill(ctx context.Context, tenant string, events []BackfillEvent) {
+	appendEventLog(ctx, LoggedEvent{
+		ReceivedAt: time.Now(),
+		Tenant:     tenant,
+		Backfill:   events,
+	})
+}
+
+// eraseLoggedUser drops the tenant's logged events that mention userID and
+// returns how many there were.
+func eraseLoggedUser(ctx context.Context, userID string) (int, error) {
+	if eventLog == nil {
+		return 0, nil
+	}
+	tenant := telemetry.TenantFromContext(ctx)
+	quoted, _ := json.Marshal(userID)
+
+	eventLogMutex.Lock()
+	defer eventLogMutex.Unlock()
+
+	src, err := os.Open(eventLogPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Dir(eventLogPath), filepath.Base(eventLogPath)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(dst.Name())
+
+	dropped := 0
+	w := bufio.NewWriter(dst)
+	scanner := newEventLogScanner(src)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry LoggedEvent
+		if strings.Contains(string(line), string(quoted)) && json.Unmarshal(line, &entry) == nil && entry.Tenant == tenant {
+			dropped++
+			continue
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	if err := os.Rename(dst.Name(), eventLogPath); err != nil {
+		return 0, err
+	}
+	reopened, err := openEventLog()
+	if err != nil {
+		return dropped, err
+	}
+	eventLog.Close()
+	eventLog = reopened
+	return dropped, nil
+}
+
+// newEventLogScanner reads the log line by line; lines hold events of up
+// to maxEventBody bytes.
+func newEventLogScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*maxEventBody)
+	return scanner
+}
+
+// replayEvents zeroes this replica's aggregates and rebuilds them from the
+// events logged at or after from.
+func replayEvents(ctx context.Context, from time.Time) (ReplayResult, error) {
+	result := ReplayResult{ByType: map[string]int64{}}
+	if eventLog == nil {
+		return result, errEventLogDisabled
+	}
+	if !replayMutex.TryLock() {
+		return result, errReplayRunning
+	}
+	defer replayMutex.Unlock()
+
+	ctx, span := tracer.Start(ctx, "replayEvents")
+	defer span.End()
+
+	// Events logged from now on are aggregated as they arrive, so only
+	// what is logged so far is replayed
+	eventLogMutex.Lock()
+	f, err := os.Open(eventLogPath)
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	eventLogMutex.Unlock()
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return result, err
+	}
+	defer f.Close()
+
+	statsMutex.Lock()
+	for name := range stats {
+		stats[name] = newStats()
+	}
+	statsMutex.Unlock()
+	resetLatencies()
+	resetSLIs()
+	resetRouteStatuses()
+	resetReactions()
+	resetExperiments()
+
+	batch := make([]TrackEvent, 0, replayBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			applyEventBatch(ctx, batch, false)
+			batch = batch[:0]
+		}
+	}
+
+	scanner := newEventLogScanner(io.LimitReader(f, size))
+	for scanner.Scan() {
+		var entry LoggedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			result.Unreadable++
+			continue
+		}
+		if entry.ReceivedAt.Before(from) {
+			continue
+		}
+		tenantCtx := telemetry.WithTenant(ctx, entry.Tenant)
+
+		if len(entry.Backfill) > 0 {
+			flush()
+			backfillStats(tenantCtx, entry.Tenant, entry.Backfill, false)
+			result.Replayed++
+			result.ByType["backfill"]++
+			continue
+		}
+
+		event, err := decodeEvent(entry.Body, entry.EndpointType)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		event.ReceivedAt = entry.ReceivedAt
+		result.Replayed++
+		result.ByType[event.Type]++
+
+		if event.Type == eventJokeServed {
+			track := newTrackEvent(tenantCtx, event.Track, event.ReceivedAt)
+			// Replayed events aren't linked to the replay's span one by one
+			track.SpanContext = trace.SpanContext{}
+			batch = append(batch, track)
+			if len(batch) >= replayBatchSize {
+				flush()
+			}
+			continue
+		}
+		// Favorites are credited to what was served before them
+		flush()
+		applyEvent(tenantCtx, event)
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	span.SetAttributes(
+		attribute.String("replay.from", from.Format(time.RFC3339)),
+		attribute.Int64("replay.replayed", result.Replayed),
+		attribute.Int64("replay.skipped", result.Skipped),
+	)
+	loggerFor(ctx).Info("Events replayed",
+		zap.Time("from", from),
+		zap.Int64("replayed", result.Replayed),
+		zap.Int64("skipped", result.Skipped),
+		zap.Int64("unreadable", result.Unreadable),
+	)
+	return result, nil
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/ids"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Tracking events follow a versioned schema. Version 2 wraps every event
+// in an envelope naming its type and version:
+//
+//	{"event_type": "joke_served", "schema_version": 2, "payload": {...}}
+//
+// posted to POST /internal/events, or as span events exported over OTLP
+// (see otlp.go). Version 1 is the bare payload posted to the event type's
+// own endpoint (/internal/reaction and /internal/favorite). Those
+// endpoints keep reading v1, as well as v2 envelopes of their type, while
+// producers and their queued outbox messages move over. joke_served had
+// POST /internal/track, which is gone: the jokes service sends it as a v2
+// envelope or over OTLP. v1 joke_served events in the event log are still
+// replayed. The payload of each type and version is described by
+// eventSchemas.
+//
+// Events that fail validation are answered with 422, which producers don't
+// retry, counted in analytics.events.rejected and quarantined: the last
+// EVENT_QUARANTINE_SIZE of them are kept for inspection at
+// GET /internal/admin/quarantine.
+
+const (
+	eventJokeServed      = "joke_served"
+	eventReaction        = "reaction"
+	eventFavoriteAdded   = "favorite_added"
+	eventFavoriteDeleted = "favorite_deleted"
+	eventUserMerged      = "user_merged"
+	eventRequestFailed   = "request_failed"
+	eventUserDeleted     = "user_deleted"
+	eventExposure        = "experiment_exposure"
+	eventRouteStatuses   = "route_statuses"
+
+	// maxEventBody bounds an event body; larger ones are rejected
+	maxEventBody = 64 << 10
+	// maxQuarantinedBody bounds the body kept for a quarantined event
+	maxQuarantinedBody = 4 << 10
+)
+
+// EventEnvelope is a v2 tracking event.
+type EventEnvelope struct {
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// Event is a validated tracking event, its payload read into the struct of
+// its type whatever the schema version.
+type Event struct {
+	Type    string
+	Version int
+	// ReceivedAt is when the event was received; replayed events keep it
+	// (see eventlog.go)
+	ReceivedAt time.Time
+	Track      TrackPayload
+	Reaction   ReactionEvent
+	Favorite   FavoriteEvent
+	Failure    RequestFailure
+	Deletion   UserDeletion
+	Merge      UserMerge
+	Exposure   ExperimentExposure
+	// RouteStatuses are the gateway's response counts (see routeerrors.go)
+	RouteStatuses []RouteStatusCount
+}
+
+// eventError is a validation failure. reason is a short fixed label for
+// the rejects metric.
+type eventError struct {
+	reason  string
+	message string
+}
+
+func (e *eventError) Error() string { return e.message }
+
+func invalidEvent(reason, format string, args ...interface{}) error {
+	return &eventError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// Payloads of v2 are decoded strictly, rejecting unknown fields, and
+// report latency as a nested object rather than flattened fields.
+type (
+	jokeServedV2 struct {
+		JokeID  string           `json:"joke_id"`
+		UserID  string           `json:"user_id,omitempty"`
+		Visitor string           `json:"visitor,omitempty"`
+		Author  string           `json:"author,omitempty"`
+		Latency *LatencySample   `json:"latency,omitempty"`
+		Client  ClientAttributes `json:"client"`
+	}
+	reactionV2 struct {
+		JokeID   string         `json:"joke_id"`
+		Reaction string         `json:"reaction"`
+		Latency  *LatencySample `json:"latency,omitempty"`
+		// The experiment and variant of the reacting client, if the joke
+		// is under test (see experiments.go)
+		ExperimentID string `json:"experiment_id,omitempty"`
+		Variant      string `json:"variant,omitempty"`
+	}
+	favoriteAddedV2 struct {
+		UserID string `json:"user_id"`
+		JokeID string `json:"joke_id,omitempty"`
+	}
+	requestFailedV2 struct {
+		Status  int            `json:"status"`
+		Latency *LatencySample `json:"latency"`
+	}
+	userDeletedV2 struct {
+		UserID string `json:"user_id"`
+	}
+	userMergedV2 struct {
+		FromUserID string `json:"from_user_id"`
+		ToUserID   string `json:"to_user_id"`
+	}
+	experimentExposureV2 struct {
+		ExperimentID string `json:"experiment_id"`
+		JokeID       string `json:"joke_id"`
+		Variant      string `json:"variant"`
+		UserID       string `json:"user_id,omitempty"`
+	}
+	routeStatusesV2 struct {
+		Routes []RouteStatusCount `json:"routes"`
+	}
+)
+
+// eventSchemas decode and validate the payload of each event type and
+// schema version into event.
+var eventSchemas = map[string]map[int]func(payload []byte, event *Event) error{
+	eventJokeServed: {
+		1: func(payload []byte, event *Event) error {
+			// The body is optional in v1; older clients send none
+			if len(payload) > 0 {
+				if err := decodeLenient(payload, &event.Track); err != nil {
+					return err
+				}
+			}
+			return validateTrack(event.Track)
+		},
+		2: func(payload []byte, event *Event) error {
+			var p jokeServedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			if p.JokeID == "" {
+				return invalidEvent("missing_field", "payload.joke_id is required")
+			}
+			event.Track = TrackPayload{JokeID: p.JokeID, UserID: p.UserID, Visitor: p.Visitor, Author: p.Author, Client: p.Client}
+			if p.Latency != nil {
+				event.Track.LatencySample = *p.Latency
+			}
+			return validateTrack(event.Track)
+		},
+	},
+	eventReaction: {
+		1: func(payload []byte, event *Event) error {
+			if err := decodeLenient(payload, &event.Reaction); err != nil {
+				return err
+			}
+			return validateReaction(event.Reaction)
+		},
+		2: func(payload []byte, event *Event) error {
+			var p reactionV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Reaction = ReactionEvent{JokeID: p.JokeID, Reaction: p.Reaction, ExperimentID: p.ExperimentID, Variant: p.Variant}
+			if p.Latency != nil {
+				event.Reaction.LatencySample = *p.Latency
+			}
+			return validateReaction(event.Reaction)
+		},
+	},
+	eventFavoriteAdded: {
+		1: func(payload []byte, event *Event) error {
+			if err := decodeLenient(payload, &event.Favorite); err != nil {
+				return err
+			}
+			return validateFavorite(event.Favorite)
+		},
+		2: func(payload []byte, event *Event) error {
+			var p favoriteAddedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Favorite = FavoriteEvent(p)
+			return validateFavorite(event.Favorite)
+		},
+	},
+	// favorite_deleted was introduced with v2 and has no v1
+	eventFavoriteDeleted: {
+		2: func(payload []byte, event *Event) error {
+			var p favoriteAddedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Favorite = FavoriteEvent(p)
+			return validateFavorite(event.Favorite)
+		},
+	},
+	// request_failed was introduced with v2 and has no v1
+	eventRequestFailed: {
+		2: func(payload []byte, event *Event) error {
+			var p requestFailedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			if p.Latency == nil || p.Latency.Endpoint == "" {
+				return invalidEvent("missing_field", "payload.latency.endpoint is required")
+			}
+			event.Failure = RequestFailure{Status: p.Status, LatencySample: *p.Latency}
+			return validateFailure(event.Failure)
+		},
+	},
+	// user_deleted was introduced with v2 and has no v1
+	eventUserDeleted: {
+		2: func(payload []byte, event *Event) error {
+			var p userDeletedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Deletion = UserDeletion(p)
+			return validateDeletion(event.Deletion)
+		},
+	},
+	// user_merged was introduced with v2 and has no v1
+	eventUserMerged: {
+		2: func(payload []byte, event *Event) error {
+			var p userMergedV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Merge = UserMerge(p)
+			return validateMerge(event.Merge)
+		},
+	},
+	// experiment_exposure was introduced with v2 and has no v1
+	eventExposure: {
+		2: func(payload []byte, event *Event) error {
+			var p experimentExposureV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.Exposure = ExperimentExposure(p)
+			return validateExposure(event.Exposure)
+		},
+	},
+	// route_statuses was introduced with v2 and has no v1
+	eventRouteStatuses: {
+		2: func(payload []byte, event *Event) error {
+			var p routeStatusesV2
+			if err := decodeStrict(payload, &p); err != nil {
+				return err
+			}
+			event.RouteStatuses = p.Routes
+			return validateRouteStatuses(event.RouteStatuses)
+		},
+	},
+}
+
+var (
+	eventJokeIDPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	eventVisitorPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+	eventCountryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	eventRegionPattern  = regexp.MustCompile(`^[A-Z0-9]{1,3}$`)
+
+	validReactions = map[string]bool{"laugh": true, "groan": true, "meh": true}
+)
+
+const (
+	maxEventUserIDLength = 256
+	maxEventFieldLength  = 200
+)
+
+func validateTrack(p TrackPayload) error {
+	if p.JokeID != "" && !eventJokeIDPattern.MatchString(p.JokeID) {
+		return invalidEvent("invalid_field", "joke_id must be 1-64 letters, digits, '-' or '_'")
+	}
+	if len(p.UserID) > maxEventUserIDLength {
+		return invalidEvent("invalid_field", "user_id must be at most %d bytes", maxEventUserIDLength)
+	}
+	if p.Visitor != "" && !eventVisitorPattern.MatchString(p.Visitor) {
+		return invalidEvent("invalid_field", "visitor must be 1-64 lowercase hex digits")
+	}
+	if p.Client.Country != "" && !eventCountryPattern.MatchString(p.Client.Country) {
+		return invalidEvent("invalid_field", "client.country must be an ISO 3166-1 alpha-2 code")
+	}
+	if p.Client.Region != "" && (p.Client.Country == "" || !eventRegionPattern.MatchString(p.Client.Region)) {
+		return invalidEvent("invalid_field", "client.region must be 1-3 uppercase letters or digits, with client.country")
+	}
+	for name, value := range map[string]string{
+		"client.app_id":    p.Client.AppID,
+		"client.ua_family": p.Client.UAFamily,
+		"client.route":     p.Client.Route,
+		"author":           p.Author,
+	} {
+		if len(value) > maxEventFieldLength {
+			return invalidEvent("invalid_field", "%s must be at most %d bytes", name, maxEventFieldLength)
+		}
+	}
+	return validateLatency(p.LatencySample)
+}
+
+func validateReaction(e ReactionEvent) error {
+	switch {
+	case e.JokeID == "":
+		return invalidEvent("missing_field", "joke_id is required")
+	case !eventJokeIDPattern.MatchString(e.JokeID):
+		return invalidEvent("invalid_field", "joke_id must be 1-64 letters, digits, '-' or '_'")
+	case e.Reaction == "":
+		return invalidEvent("missing_field", "reaction is required")
+	case !validReactions[e.Reaction]:
+		return invalidEvent("invalid_field", "reaction must be laugh, groan or meh")
+	case (e.ExperimentID == "") != (e.Variant == ""):
+		return invalidEvent("missing_field", "experiment_id and variant go together")
+	case e.ExperimentID != "" && !eventJokeIDPattern.MatchString(e.ExperimentID):
+		return invalidEvent("invalid_field", "experiment_id must be 1-64 letters, digits, '-' or '_'")
+	case e.Variant != "" && !eventJokeIDPattern.MatchString(e.Variant):
+		return invalidEvent("invalid_field", "variant must be 1-64 letters, digits, '-' or '_'")
+	}
+	return validateLatency(e.LatencySample)
+}
+
+func validateFavorite(e FavoriteEvent) error {
+	switch {
+	case e.UserID == "":
+		return invalidEvent("missing_field", "user_id is required")
+	case len(e.UserID) > maxEventUserIDLength:
+		return invalidEvent("invalid_field", "user_id must be at most %d bytes", maxEventUserIDLength)
+	case e.JokeID != "" && !eventJokeIDPattern.MatchString(e.JokeID):
+		return invalidEvent("invalid_field", "joke_id must be 1-64 letters, digits, '-' or '_'")
+	}
+	return nil
+}
+
+func validateExposure(e ExperimentExposure) error {
+	switch {
+	case !eventJokeIDPattern.MatchString(e.ExperimentID):
+		return invalidEvent("invalid_field", "experiment_id must be 1-64 letters, digits, '-' or '_'")
+	case !eventJokeIDPattern.MatchString(e.JokeID):
+		return invalidEvent("invalid_field", "joke_id must be 1-64 letters, digits, '-' or '_'")
+	case !eventJokeIDPattern.MatchString(e.Variant):
+		return invalidEvent("invalid_field", "variant must be 1-64 letters, digits, '-' or '_'")
+	case len(e.UserID) > maxEventUserIDLength:
+		return invalidEvent("invalid_field", "user_id must be at most %d bytes", maxEventUserIDLength)
+	}
+	return nil
+}
+
+func validateDeletion(d UserDeletion) error {
+	switch {
+	case d.UserID == "":
+		return invalidEvent("missing_field", "user_id is required")
+	case len(d.UserID) > maxEventUserIDLength:
+		return invalidEvent("invalid_field", "user_id must be at most %d bytes", maxEventUserIDLength)
+	}
+	return nil
+}
+
+func validateFailure(f RequestFailure) error {
+	if f.Status < 500 || f.Status > 599 {
+		return invalidEvent("invalid_field", "status must be a 5xx status code")
+	}
+	return validateLatency(f.LatencySample)
+}
+
+func validateLatency(s LatencySample) error {
+	switch {
+	case s.LatencyMs < 0:
+		return invalidEvent("invalid_field", "latency_ms must not be negative")
+	case len(s.Endpoint) > maxEventFieldLength:
+		return invalidEvent("invalid_field", "endpoint must be at most %d bytes", maxEventFieldLength)
+	}
+	return nil
+}
+
+// decodeLenient reads a v1 payload, ignoring unknown fields as v1 always
+// has.
+func decodeLenient(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return malformedEvent(err)
+	}
+	return nil
+}
+
+// decodeStrict reads a v2 payload, rejecting unknown fields and trailing
+// data.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return malformedEvent(err)
+	}
+	if dec.More() {
+		return invalidEvent("malformed_json", "payload has trailing data")
+	}
+	return nil
+}
+
+func malformedEvent(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return invalidEvent("invalid_field", "%s must be %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind()))
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return invalidEvent("unknown_field", "unknown field %s", field)
+	}
+	return invalidEvent("malformed_json", "invalid JSON: %v", err)
+}
+
+// jsonTypeName names the JSON type a Go kind is decoded from.
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Slice:
+		return "an array"
+	}
+	return "of another type"
+}
+
+// decodeEvent reads an event body. A body with a schema_version is a v2
+// envelope; anything else is a v1 payload of endpointType, the type the
+// endpoint it was posted to implies. Envelopes posted to a type's own
+// endpoint must be of that type.
+func decodeEvent(body []byte, endpointType string) (Event, error) {
+	var probe struct {
+		SchemaVersion *json.RawMessage `json:"schema_version"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &probe); err != nil {
+			return Event{Type: endpointType}, malformedEvent(err)
+		}
+	}
+
+	if probe.SchemaVersion == nil {
+		if endpointType == "" {
+			return Event{}, invalidEvent("missing_field", "schema_version is required")
+		}
+		event := Event{Type: endpointType, Version: 1}
+		return event, eventSchemas[endpointType][1](body, &event)
+	}
+
+	var envelope EventEnvelope
+	if err := decodeStrict(body, &envelope); err != nil {
+		return Event{Type: endpointType}, err
+	}
+	event := Event{Type: envelope.EventType, Version: envelope.SchemaVersion}
+
+	versions, ok := eventSchemas[envelope.EventType]
+	switch {
+	case envelope.EventType == "":
+		return event, invalidEvent("missing_field", "event_type is required")
+	case !ok:
+		return event, invalidEvent("unknown_event_type", "unknown event_type %q", envelope.EventType)
+	case endpointType != "" && envelope.EventType != endpointType:
+		return event, invalidEvent("wrong_endpoint", "%s events can't be posted here", envelope.EventType)
+	}
+	// v1 has no envelope, so an envelope must be v2 or later
+	decode, ok := versions[envelope.SchemaVersion]
+	if !ok || envelope.SchemaVersion < 2 {
+		return event, invalidEvent("unsupported_version", "unsupported schema_version %d for %s", envelope.SchemaVersion, envelope.EventType)
+	}
+	if len(envelope.Payload) == 0 || string(envelope.Payload) == "null" {
+		return event, invalidEvent("missing_field", "payload is required")
+	}
+	return event, decode(envelope.Payload, &event)
+}
+
+// QuarantinedEvent is a rejected event kept for inspection.
+type QuarantinedEvent struct {
+	ID            string    `json:"id"`
+	ReceivedAt    time.Time `json:"received_at"`
+	Endpoint      string    `json:"endpoint"`
+	Service       string    `json:"service,omitempty"`
+	Tenant        string    `json:"tenant"`
+	EventType     string    `json:"event_type,omitempty"`
+	SchemaVersion int       `json:"schema_version,omitempty"`
+	Reason        string    `json:"reason"`
+	Error         string    `json:"error"`
+	// Body is the event as received, cut to maxQuarantinedBody bytes
+	Body      string `json:"body"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+var (
+	quarantineSize  int
+	quarantine      []QuarantinedEvent
+	quarantineMutex sync.Mutex
+
+	eventsReceived metric.Int64Counter
+	eventsRejected metric.Int64Counter
+)
+
+func initEvents() {
+	quarantineSize = getEnvInt("EVENT_QUARANTINE_SIZE", 100)
+
+	var err error
+	eventsReceived, err = meter.Int64Counter(
+		"analytics.events.received",
+		metric.WithDescription("Number of valid tracking events received, by type and schema version"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create received events counter", zap.Error(err))
+	}
+
+	eventsRejected, err = meter.Int64Counter(
+		"analytics.events.rejected",
+		metric.WithDescription("Number of tracking events rejected by schema validation"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create rejected events counter", zap.Error(err))
+	}
+}
+
+// eventHandler serves an event endpoint. endpointType is the type of v1
+// events posted to it, or empty for POST /internal/events, which only
+// takes envelopes.
+func eventHandler(endpointType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxEventBody+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unreadable body"})
+			return
+		}
+
+		var event Event
+		if len(body) > maxEventBody {
+			err = invalidEvent("too_large", "event body exceeds %d bytes", maxEventBody)
+		} else {
+			event, err = decodeEvent(body, endpointType)
+		}
+		if err != nil {
+			rejectEvent(c, body, event, err)
+			return
+		}
+		event.ReceivedAt = time.Now()
+		logEvent(ctx, endpointType, body, event)
+
+		eventsReceived.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("event_type", event.Type),
+			attribute.Int("schema_version", event.Version),
+		), telemetry.ContextAttrs(ctx))
+		c.JSON(http.StatusAccepted, gin.H{"status": applyEvent(ctx, event)})
+	}
+}
+
+// applyEvent records a valid event and returns its status for the
+// response.
+func applyEvent(ctx context.Context, event Event) string {
+	switch event.Type {
+	case eventJokeServed:
+		return trackJokeServed(ctx, event.Track, event.ReceivedAt)
+	case eventReaction:
+		trackReaction(ctx, event.Reaction, event.ReceivedAt)
+	case eventFavoriteAdded:
+		trackFavorite(ctx, event.Favorite, event.ReceivedAt)
+	case eventFavoriteDeleted:
+		trackFavoriteDeleted(ctx, event.Favorite)
+	case eventUserMerged:
+		trackUserMerge(ctx, event.Merge)
+	case eventRequestFailed:
+		trackFailure(ctx, event.Failure, event.ReceivedAt)
+	case eventExposure:
+		trackExposure(ctx, event.Exposure)
+	case eventRouteStatuses:
+		trackRouteStatuses(ctx, event.RouteStatuses, event.ReceivedAt)
+	case eventUserDeleted:
+		eraseUser(ctx, event.Deletion)
+		return "erased"
+	}
+	return "tracked"
+}
+
+// rejectEvent answers an invalid event with 422, counts it and keeps it in
+// the quarantine.
+func rejectEvent(c *gin.Context, body []byte, event Event, err error) {
+	reason := quarantineEvent(c.Request.Context(), c.FullPath(), c.GetHeader(middleware.InternalServiceHeader), body, event, err)
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "reason": reason})
+}
+
+// quarantineEvent counts an invalid event received at endpoint from
+// service, keeps it in the quarantine and returns the reason it was
+// rejected.
+func quarantineEvent(ctx context.Context, endpoint, service string, body []byte, event Event, err error) string {
+	reason := "invalid"
+	var eventErr *eventError
+	if errors.As(err, &eventErr) {
+		reason = eventErr.reason
+	}
+
+	eventsRejected.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("event_type", eventTypeLabel(event.Type)),
+		attribute.Int("schema_version", event.Version),
+		attribute.String("reason", reason),
+	), telemetry.ContextAttrs(ctx))
+	loggerFor(ctx).Warn("Tracking event rejected",
+		zap.String("endpoint", endpoint),
+		zap.String("service", service),
+		zap.String("event_type", event.Type),
+		zap.Int("schema_version", event.Version),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+
+	if quarantineSize > 0 {
+		entry := QuarantinedEvent{
+			ID:            ids.New(),
+			ReceivedAt:    time.Now(),
+			Endpoint:      endpoint,
+			Service:       service,
+			Tenant:        telemetry.TenantFromContext(ctx),
+			EventType:     event.Type,
+			SchemaVersion: event.Version,
+			Reason:        reason,
+			Error:         err.Error(),
+			Body:          string(body),
+		}
+		if len(body) > maxQuarantinedBody {
+			entry.Body = string(body[:maxQuarantinedBody])
+			entry.Truncated = true
+		}
+
+		quarantineMutex.Lock()
+		quarantine = append(quarantine, entry)
+		if len(quarantine) > quarantineSize {
+			quarantine = quarantine[len(quarantine)-quarantineSize:]
+		}
+		quarantineMutex.Unlock()
+	}
+	return reason
+}
+
+// unquarantineUser drops the tenant's quarantined events that mention
+// userID and returns how many there were.
+func unquarantineUser(ctx context.Context, userID string) int {
+	tenant := telemetry.TenantFromContext(ctx)
+	quoted, _ := json.Marshal(userID)
+
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+	kept := quarantine[:0]
+	for _, entry := range quarantine {
+		if entry.Tenant == tenant && strings.Contains(entry.Body, string(quoted)) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	dropped := len(quarantine) - len(kept)
+	quarantine = kept
+	return dropped
+}
+
+// eventTypeLabel bounds the event_type metric label to the known types.
+func eventTypeLabel(eventType string) string {
+	if _, ok := eventSchemas[eventType]; ok {
+		return eventType
+	}
+	if eventType == "" {
+		return "none"
+	}
+	return "unknown"
+}
+
+// quarantineHandler serves GET /internal/admin/quarantine, newest first.
+// ?limit caps the events returned.
+func quarantineHandler(c *gin.Context) {
+	quarantineMutex.Lock()
+	events := make([]QuarantinedEvent, 0, len(quarantine))
+	for i := len(quarantine) - 1; i >= 0; i-- {
+		events = append(events, quarantine[i])
+	}
+	quarantineMutex.Unlock()
+
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit >= 0 && limit < len(events) {
+		events = events[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"count":  len(events),
+	})
+}
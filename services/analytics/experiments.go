@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The jokes service runs A/B tests of joke variants (see its
+// experiments.go): every client is bucketed into one variant of a joke
+// under test, and each serving of a variant is reported as an
+// experiment_exposure event. Reactions to the joke carry the experiment
+// and variant of the reacting client. Favorites don't, as the user
+// service doesn't know about experiments, so a favorite of the joke is
+// credited to the variant the user was last exposed to, if any.
+//
+// GET /api/v1/stats/experiments/:id returns the counts per variant, which
+// the jokes service turns into results. Counts are kept per tenant.
+
+// maxExperimentUsers bounds the users whose variant is remembered per
+// experiment; favorites of further users are not credited
+const maxExperimentUsers = 10000
+
+// ExperimentExposure is sent by the jokes service whenever a joke variant
+// is served.
+type ExperimentExposure struct {
+	ExperimentID string `json:"experiment_id"`
+	JokeID       string `json:"joke_id"`
+	Variant      string `json:"variant"`
+	// UserID is the user served the variant; anonymous clients are not
+	// reported, so their favorites can't be credited
+	UserID string `json:"user_id,omitempty"`
+}
+
+// VariantCounts are the outcomes of a joke variant.
+type VariantCounts struct {
+	Exposures int64            `json:"exposures"`
+	Favorites int64            `json:"favorites"`
+	Reactions map[string]int64 `json:"reactions"`
+}
+
+// experimentCounts are the outcomes of an experiment's variants.
+type experimentCounts struct {
+	jokeID   string
+	variants map[string]*VariantCounts
+	// users holds the variant each user was last exposed to
+	users map[string]string
+}
+
+var (
+	// Experiment counts per tenant, keyed by experiment ID
+	experiments      = map[string]map[string]*experimentCounts{}
+	experimentsMutex sync.RWMutex
+)
+
+// experimentFor returns the tenant's counts of an experiment, creating
+// them on first use. Callers must hold experimentsMutex for writing.
+func experimentFor(tenant, experimentID, jokeID string) *experimentCounts {
+	tenantExperiments, ok := experiments[tenant]
+	if !ok {
+		tenantExperiments = map[string]*experimentCounts{}
+		experiments[tenant] = tenantExperiments
+	}
+	e, ok := tenantExperiments[experimentID]
+	if !ok {
+		e = &experimentCounts{jokeID: jokeID, variants: map[string]*VariantCounts{}, users: map[string]string{}}
+		tenantExperiments[experimentID] = e
+	}
+	return e
+}
+
+// variant returns the counts of a variant, creating them on first use.
+func (e *experimentCounts) variant(name string) *VariantCounts {
+	v, ok := e.variants[name]
+	if !ok {
+		v = &VariantCounts{Reactions: map[string]int64{}}
+		e.variants[name] = v
+	}
+	return v
+}
+
+// resetExperiments discards the counts of every experiment.
+func resetExperiments() {
+	experimentsMutex.Lock()
+	experiments = map[string]map[string]*experimentCounts{}
+	experimentsMutex.Unlock()
+}
+
+// trackExposure records a validated experiment_exposure event.
+func trackExposure(ctx context.Context, exposure ExperimentExposure) {
+	experimentsMutex.Lock()
+	e := experimentFor(telemetry.TenantFromContext(ctx), exposure.ExperimentID, exposure.JokeID)
+	e.variant(exposure.Variant).Exposures++
+	if exposure.UserID != "" {
+		if _, known := e.users[exposure.UserID]; known || len(e.users) < maxExperimentUsers {
+			e.users[exposure.UserID] = exposure.Variant
+		}
+	}
+	experimentsMutex.Unlock()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("experiment.id", exposure.ExperimentID),
+		attribute.String("experiment.variant", exposure.Variant),
+	)
+}
+
+// recordExperimentReaction credits a reaction to the variant it names.
+func recordExperimentReaction(tenant string, event ReactionEvent) {
+	if event.ExperimentID == "" {
+		return
+	}
+	experimentsMutex.Lock()
+	defer experimentsMutex.Unlock()
+	e := experimentFor(tenant, event.ExperimentID, event.JokeID)
+	e.variant(event.Variant).Reactions[event.Reaction]++
+}
+
+// recordExperimentFavorite credits a favorite to the variant the user was
+// exposed to in every experiment on the joke.
+func recordExperimentFavorite(tenant string, event FavoriteEvent) {
+	if event.JokeID == "" {
+		return
+	}
+	experimentsMutex.Lock()
+	defer experimentsMutex.Unlock()
+	for _, e := range experiments[tenant] {
+		if e.jokeID != event.JokeID {
+			continue
+		}
+		if variant, ok := e.users[event.UserID]; ok {
+			e.variant(variant).Favorites++
+		}
+	}
+}
+
+// experimentHandler serves GET /api/v1/stats/experiments/:id.
+func experimentHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	experimentsMutex.RLock()
+	e, ok := experiments[telemetry.TenantFromContext(ctx)][id]
+	if !ok {
+		experimentsMutex.RUnlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "No events recorded for this experiment"})
+		return
+	}
+	variants := make(map[string]VariantCounts, len(e.variants))
+	for name, v := range e.variants {
+		counts := VariantCounts{Exposures: v.Exposures, Favorites: v.Favorites, Reactions: make(map[string]int64, len(v.Reactions))}
+		for reaction, n := range v.Reactions {
+			counts.Reactions[reaction] = n
+		}
+		variants[name] = counts
+	}
+	jokeID, users := e.jokeID, len(e.users)
+	experimentsMutex.RUnlock()
+
+	loggerFor(ctx).Debug("Experiment counts requested", zap.String("experiment_id", id))
+	c.JSON(http.StatusOK, gin.H{
+		"experiment_id": id,
+		"joke_id":       jokeID,
+		"variants":      variants,
+		"users":         users,
+	})
+}
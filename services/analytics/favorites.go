@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The user service reports favorites added and deleted and user merges as
+// favorite_added, favorite_deleted and user_merged events, so favorites
+// are counted by the service that owns them. The headline stats count the
+// favorites added and deleted and the merges per tenant since startup.
+//
+// A merge moves an anonymous user's activity to the account they signed
+// in with: their leaderboard activity is added to the target's, and their
+// servings awaiting a favorite are the target's from then on, so a joke
+// served before signing in and favorited after converts. A joke served to
+// both counts as served once, as if served to one user.
+
+// UserMerge is sent by the user service when a user is merged into
+// another.
+type UserMerge struct {
+	FromUserID string `json:"from_user_id"`
+	ToUserID   string `json:"to_user_id"`
+}
+
+func validateMerge(m UserMerge) error {
+	switch {
+	case m.FromUserID == "" || m.ToUserID == "":
+		return invalidEvent("missing_field", "from_user_id and to_user_id are required")
+	case len(m.FromUserID) > maxEventUserIDLength || len(m.ToUserID) > maxEventUserIDLength:
+		return invalidEvent("invalid_field", "user IDs must be at most %d bytes", maxEventUserIDLength)
+	case m.FromUserID == m.ToUserID:
+		return invalidEvent("invalid_field", "from_user_id and to_user_id must differ")
+	}
+	return nil
+}
+
+// trackFavoriteDeleted records a validated favorite_deleted event. Favorites
+// already counted on the leaderboard and in the funnel stay counted there:
+// they rank and convert by favorites added.
+func trackFavoriteDeleted(ctx context.Context, event FavoriteEvent) {
+	statsMutex.Lock()
+	statsFor(telemetry.TenantFromContext(ctx)).favoritesDeleted++
+	statsMutex.Unlock()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("favorite.user_id", event.UserID),
+		attribute.String("joke.id", event.JokeID),
+	)
+	loggerFor(ctx).Info("Favorite deletion tracked",
+		zap.String("user_id", event.UserID),
+		zap.String("joke_id", event.JokeID),
+	)
+}
+
+// trackUserMerge records a validated user_merged event, moving the source
+// user's activity to the target.
+func trackUserMerge(ctx context.Context, merge UserMerge) {
+	statsMutex.Lock()
+	s := statsFor(telemetry.TenantFromContext(ctx))
+	s.userMerges++
+	hours := s.mergeActivity(merge.FromUserID, merge.ToUserID)
+	servings := s.mergeFunnelUser(merge.FromUserID, merge.ToUserID)
+	statsMutex.Unlock()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("merge.from_user_id", merge.FromUserID),
+		attribute.String("merge.to_user_id", merge.ToUserID),
+		attribute.Int("merge.hours", hours),
+		attribute.Int("merge.servings", servings),
+	)
+	loggerFor(ctx).Info("User merge tracked",
+		zap.String("from_user_id", merge.FromUserID),
+		zap.String("to_user_id", merge.ToUserID),
+		zap.Int("hours", hours),
+		zap.Int("servings", servings),
+	)
+}
+
+// mergeActivity adds fromUserID's hourly activity to toUserID's and
+// returns the number of hours moved. Callers must hold statsMutex for
+// writing.
+func (s *Stats) mergeActivity(fromUserID, toUserID string) int {
+	from, ok := s.users[fromUserID]
+	if !ok {
+		return 0
+	}
+	delete(s.users, fromUserID)
+	to, ok := s.users[toUserID]
+	if !ok {
+		s.users[toUserID] = from
+		return len(from)
+	}
+	for hour, activity := range from {
+		if existing, ok := to[hour]; ok {
+			existing.jokes += activity.jokes
+			existing.favorites += activity.favorites
+			continue
+		}
+		to[hour] = activity
+	}
+	return len(from)
+}
+
+// mergeFunnelUser makes fromUserID's servings awaiting a favorite
+// toUserID's and returns the number moved. A joke served to both keeps the
+// later serving and is no longer counted as served twice. Callers must
+// hold statsMutex for writing.
+func (s *Stats) mergeFunnelUser(fromUserID, toUserID string) int {
+	from, ok := s.funnelServings[fromUserID]
+	if !ok {
+		return 0
+	}
+	delete(s.funnelServings, fromUserID)
+	to, ok := s.funnelServings[toUserID]
+	if !ok {
+		s.funnelServings[toUserID] = from
+		return len(from)
+	}
+	for jokeID, serving := range from {
+		existing, ok := to[jokeID]
+		if !ok {
+			to[jokeID] = serving
+			continue
+		}
+		s.pendingServings--
+		if counts, ok := s.funnel[jokeID]; ok {
+			counts.served--
+			if existing.favorited && serving.favorited {
+				counts.favorited--
+			}
+		}
+		existing.servedAt = max(existing.servedAt, serving.servedAt)
+		existing.favorited = existing.favorited || serving.favorited
+	}
+	return len(from)
+}
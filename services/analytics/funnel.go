@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The served → favorited funnel correlates joke_served events with
+// favorite_added events by joke ID and user. A joke counts as served once
+// per user, and as favorited when that user favorites it within
+// FUNNEL_WINDOW of the serving; a serving older than the window that is
+// served again starts over. Jokes served to anonymous clients can't be
+// correlated and are not counted, and favorites of jokes the user wasn't
+// served in the window are counted as unattributed.
+//
+// Counts are kept per tenant and joke since startup; the servings awaiting
+// a favorite are dropped by compaction once past the window (see
+// retention.go), and erasing a user drops theirs.
+
+const (
+	defaultFunnelLimit = 20
+	maxFunnelLimit     = 100
+
+	// maxFunnelServings bounds the servings awaiting a favorite per tenant;
+	// further ones are not counted until compaction frees room. Jokes are
+	// bounded by maxTrendingJokes
+	maxFunnelServings = 100000
+)
+
+var funnelWindow time.Duration
+
+// funnelCounts are a joke's funnel counts.
+type funnelCounts struct {
+	served    int64
+	favorited int64
+}
+
+// funnelServing is a joke served to a user, awaiting a favorite.
+type funnelServing struct {
+	servedAt  int64
+	favorited bool
+}
+
+// FunnelStage is the funnel of one joke, or of all of them.
+type FunnelStage struct {
+	JokeID     string  `json:"joke_id,omitempty"`
+	Served     int64   `json:"served"`
+	Favorited  int64   `json:"favorited"`
+	Conversion float64 `json:"conversion_percent"`
+}
+
+func initFunnel() {
+	funnelWindow = getEnvDuration("FUNNEL_WINDOW", 24*time.Hour)
+}
+
+// recordFunnelServing counts jokeID served to userID at t, unless it was
+// already served to them within the window. Callers must hold statsMutex
+// for writing.
+func (s *Stats) recordFunnelServing(userID, jokeID string, t time.Time) {
+	servings := s.funnelServings[userID]
+	serving, seen := servings[jokeID]
+	if seen && t.Unix()-serving.servedAt < int64(funnelWindow/time.Second) {
+		return
+	}
+	counts, ok := s.funnel[jokeID]
+	if !seen {
+		if s.pendingServings >= maxFunnelServings || !ok && len(s.funnel) >= maxTrendingJokes {
+			return
+		}
+		if servings == nil {
+			servings = map[string]*funnelServing{}
+			s.funnelServings[userID] = servings
+		}
+		s.pendingServings++
+	}
+	servings[jokeID] = &funnelServing{servedAt: t.Unix()}
+
+	if !ok {
+		counts = &funnelCounts{}
+		s.funnel[jokeID] = counts
+	}
+	counts.served++
+}
+
+// recordFunnelFavorite counts jokeID favorited by userID at t if it was
+// served to them within the window, and as unattributed otherwise.
+// Callers must hold statsMutex for writing.
+func (s *Stats) recordFunnelFavorite(userID, jokeID string, t time.Time) {
+	serving, ok := s.funnelServings[userID][jokeID]
+	if !ok || t.Unix()-serving.servedAt >= int64(funnelWindow/time.Second) {
+		s.unattributedFavorites++
+		return
+	}
+	if serving.favorited {
+		return
+	}
+	serving.favorited = true
+	s.funnel[jokeID].favorited++
+}
+
+// pruneFunnel drops servings before cutoff. It returns the number dropped.
+// Callers must hold statsMutex for writing.
+func (s *Stats) pruneFunnel(cutoff int64) int {
+	pruned := 0
+	for userID, servings := range s.funnelServings {
+		for jokeID, serving := range servings {
+			if serving.servedAt < cutoff {
+				delete(servings, jokeID)
+				pruned++
+			}
+		}
+		if len(servings) == 0 {
+			delete(s.funnelServings, userID)
+		}
+	}
+	s.pendingServings -= pruned
+	return pruned
+}
+
+// eraseFunnelUser drops a user's servings; the counts are kept. Callers
+// must hold statsMutex for writing.
+func (s *Stats) eraseFunnelUser(userID string) {
+	s.pendingServings -= len(s.funnelServings[userID])
+	delete(s.funnelServings, userID)
+}
+
+func conversion(served, favorited int64) float64 {
+	if served == 0 {
+		return 0
+	}
+	return float64(favorited) / float64(served) * 100
+}
+
+// funnelHandler serves GET /api/v1/stats/funnel?limit=20: the overall
+// funnel and that of the most served jokes.
+func funnelHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getFunnel")
+	defer span.End()
+
+	limit := defaultFunnelLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxFunnelLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxFunnelLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	overall := FunnelStage{}
+	jokes := []FunnelStage{}
+	var unattributed int64
+	statsMutex.RLock()
+	if s, ok := stats[telemetry.TenantFromContext(ctx)]; ok {
+		for jokeID, counts := range s.funnel {
+			overall.Served += counts.served
+			overall.Favorited += counts.favorited
+			jokes = append(jokes, FunnelStage{
+				JokeID:     jokeID,
+				Served:     counts.served,
+				Favorited:  counts.favorited,
+				Conversion: conversion(counts.served, counts.favorited),
+			})
+		}
+		unattributed = s.unattributedFavorites
+	}
+	statsMutex.RUnlock()
+	overall.Conversion = conversion(overall.Served, overall.Favorited)
+
+	sort.Slice(jokes, func(i, j int) bool {
+		if jokes[i].Served != jokes[j].Served {
+			return jokes[i].Served > jokes[j].Served
+		}
+		return jokes[i].JokeID < jokes[j].JokeID
+	})
+	total := len(jokes)
+	if len(jokes) > limit {
+		jokes = jokes[:limit]
+	}
+
+	span.SetAttributes(
+		attribute.Int64("funnel.served", overall.Served),
+		attribute.Int64("funnel.favorited", overall.Favorited),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"window":                 funnelWindow.String(),
+		"overall":                overall,
+		"jokes":                  jokes,
+		"count":                  len(jokes),
+		"total_jokes":            total,
+		"unattributed_favorites": unattributed,
+	})
+}
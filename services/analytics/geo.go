@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Traffic is broken down by where clients are: the gateway locates each
+// client from its IP when GEOIP_PROVIDER is set (see its geo.go) and the
+// jokes service reports the country and region with the joke served. The
+// IP itself never reaches analytics. Jokes served to clients the gateway
+// didn't locate count under the "unknown" country, and those located only
+// to a country under its "unknown" region.
+//
+// Counts are kept per tenant since startup, like the client counts.
+
+// maxLocations bounds the countries and regions counted per tenant;
+// further ones are counted under an "other" country
+const maxLocations = 5000
+
+// Location is a country, and a region within it.
+type Location struct {
+	Country string
+	Region  string
+}
+
+// RegionCount is the number of jokes served to clients in one region.
+type RegionCount struct {
+	Region string `json:"region"`
+	Count  int64  `json:"count"`
+}
+
+// CountryCount is the number of jokes served to clients in one country,
+// and per region of it.
+type CountryCount struct {
+	Country string        `json:"country"`
+	Count   int64         `json:"count"`
+	Regions []RegionCount `json:"regions"`
+}
+
+// countLocation counts one event for the client's location. Callers must
+// hold statsMutex for writing.
+func (s *Stats) countLocation(client ClientAttributes) {
+	location := Location{Country: client.Country, Region: client.Region}
+	if location.Country == "" {
+		location.Country = "unknown"
+	}
+	if location.Region == "" {
+		location.Region = "unknown"
+	}
+
+	if _, ok := s.locations[location]; !ok && len(s.locations) >= maxLocations {
+		location = Location{Country: "other", Region: "other"}
+	}
+	s.locations[location]++
+}
+
+// geoStats breaks the tenant's traffic down by country, and each country
+// by region, highest count first.
+func geoStats(tenant string) ([]CountryCount, int64) {
+	byCountry := map[string]*CountryCount{}
+	var total int64
+	statsMutex.RLock()
+	if s, ok := stats[tenant]; ok {
+		for location, count := range s.locations {
+			country, ok := byCountry[location.Country]
+			if !ok {
+				country = &CountryCount{Country: location.Country}
+				byCountry[location.Country] = country
+			}
+			country.Count += count
+			country.Regions = append(country.Regions, RegionCount{Region: location.Region, Count: count})
+			total += count
+		}
+	}
+	statsMutex.RUnlock()
+
+	countries := make([]CountryCount, 0, len(byCountry))
+	for _, country := range byCountry {
+		sort.Slice(country.Regions, func(i, j int) bool {
+			if country.Regions[i].Count != country.Regions[j].Count {
+				return country.Regions[i].Count > country.Regions[j].Count
+			}
+			return country.Regions[i].Region < country.Regions[j].Region
+		})
+		countries = append(countries, *country)
+	}
+	sort.Slice(countries, func(i, j int) bool {
+		if countries[i].Count != countries[j].Count {
+			return countries[i].Count > countries[j].Count
+		}
+		return countries[i].Country < countries[j].Country
+	})
+	return countries, total
+}
+
+func geoStatsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getGeoStats")
+	defer span.End()
+
+	countries, total := geoStats(telemetry.TenantFromContext(ctx))
+	span.SetAttributes(attribute.Int("geo.countries", len(countries)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":     total,
+		"countries": countries,
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Grafana reads the tenant's stats through the JSON datasource contract
+// (the simple-JSON and Infinity plugins), with the datasource URL set to
+// /api/v1/grafana:
+//
+//   - GET / answers the connection test
+//   - POST /search lists the targets containing the request's "target"
+//   - POST /query returns each target over the dashboard's range: time
+//     series as [value, unix ms] datapoints, one per interval, and tables
+//     as columns and rows
+//   - POST /annotations returns the traffic anomalies overlapping the
+//     range; the annotation's query, if set, keeps one kind
+//
+// Time series use the retained buckets (see retention.go): jokes served
+// per minute, or per hour once rolled up, so intervals shorter than an
+// hour count a rolled-up hour in the interval it starts; distinct users
+// and visitors per hour, for the last day only. Intervals are at least a
+// minute, or an hour for distinct counts, and widened to keep within the
+// request's maxDataPoints.
+
+// Time series targets
+const (
+	grafanaJokesServed    = "jokes_served"
+	grafanaUniqueUsers    = "unique_users"
+	grafanaUniqueVisitors = "unique_visitors"
+)
+
+// Table targets
+const (
+	grafanaTrending  = "trending"
+	grafanaReactions = "reactions"
+	grafanaSLOs      = "slo"
+)
+
+var grafanaTargets = []string{
+	grafanaJokesServed,
+	grafanaUniqueUsers,
+	grafanaUniqueVisitors,
+	grafanaTrending,
+	grafanaReactions,
+	grafanaSLOs,
+}
+
+// maxGrafanaPoints bounds the datapoints of a series whatever the request
+// asks for
+const maxGrafanaPoints = 10000
+
+// GrafanaRange is the dashboard's time range.
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// GrafanaTarget is a query of a panel.
+type GrafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	// Type is "timeserie" (default) or "table"; tables ignore it
+	Type string `json:"type"`
+}
+
+// GrafanaQuery is the body of POST /query.
+type GrafanaQuery struct {
+	Range         GrafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
+	Targets       []GrafanaTarget `json:"targets"`
+}
+
+// GrafanaAnnotationQuery is the body of POST /annotations.
+type GrafanaAnnotationQuery struct {
+	Range      GrafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+// GrafanaAnnotation is an anomaly as a Grafana region annotation.
+type GrafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Title   string   `json:"title"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+func registerGrafanaRoutes(r *gin.Engine) {
+	grafana := r.Group("/api/v1/grafana")
+	grafana.GET("", grafanaTestHandler)
+	grafana.GET("/", grafanaTestHandler)
+	grafana.POST("/search", grafanaSearchHandler)
+	grafana.POST("/query", grafanaQueryHandler)
+	grafana.POST("/annotations", grafanaAnnotationsHandler)
+}
+
+// grafanaTestHandler answers the datasource's connection test.
+func grafanaTestHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// grafanaSearchHandler serves POST /api/v1/grafana/search.
+func grafanaSearchHandler(c *gin.Context) {
+	var request struct {
+		Target string `json:"target"`
+	}
+	// Grafana sends an empty body from the query editor
+	if c.Request.ContentLength != 0 {
+		if !middleware.BindJSON(c, &request) {
+			return
+		}
+	}
+
+	targets := []string{}
+	for _, target := range grafanaTargets {
+		if strings.Contains(target, request.Target) {
+			targets = append(targets, target)
+		}
+	}
+	c.JSON(http.StatusOK, targets)
+}
+
+// grafanaQueryHandler serves POST /api/v1/grafana/query.
+func grafanaQueryHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "grafanaQuery")
+	defer span.End()
+
+	var query GrafanaQuery
+	if !middleware.BindJSON(c, &query) {
+		return
+	}
+	if !query.Range.To.After(query.Range.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "range.to must be after range.from"})
+		return
+	}
+
+	tenant := telemetry.TenantFromContext(ctx)
+	now := time.Now()
+	results := make([]gin.H, 0, len(query.Targets))
+	for _, target := range query.Targets {
+		var result gin.H
+		switch target.Target {
+		case grafanaJokesServed:
+			step := grafanaStep(query, time.Minute)
+			result = gin.H{"datapoints": jokesServedSeries(tenant, query.Range, step)}
+		case grafanaUniqueUsers, grafanaUniqueVisitors:
+			step := grafanaStep(query, time.Hour)
+			result = gin.H{"datapoints": uniquesSeries(tenant, target.Target == grafanaUniqueUsers, query.Range, step, now)}
+		case grafanaTrending:
+			result = trendingTable(tenant, now)
+		case grafanaReactions:
+			result = reactionsTable(tenant)
+		case grafanaSLOs:
+			result = sloTable(now)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown target " + target.Target})
+			return
+		}
+		result["target"] = target.Target
+		result["refId"] = target.RefID
+		results = append(results, result)
+	}
+
+	span.SetAttributes(
+		attribute.Int("grafana.targets", len(query.Targets)),
+		attribute.String("grafana.range", query.Range.To.Sub(query.Range.From).String()),
+	)
+
+	c.JSON(http.StatusOK, results)
+}
+
+// grafanaStep is the query's interval rounded up to a multiple of unit,
+// widened so the range takes no more than its maxDataPoints.
+func grafanaStep(query GrafanaQuery, unit time.Duration) int64 {
+	step := time.Duration(query.IntervalMs) * time.Millisecond
+	span := query.Range.To.Sub(query.Range.From)
+	points := query.MaxDataPoints
+	if points <= 0 || points > maxGrafanaPoints {
+		points = maxGrafanaPoints
+	}
+	if minStep := span / time.Duration(points); step < minStep {
+		step = minStep
+	}
+	if step < unit {
+		step = unit
+	}
+	step = (step + unit - 1) / unit * unit
+	return int64(step / time.Second)
+}
+
+// grafanaIntervals returns the start of each step-second interval
+// overlapping r.
+func grafanaIntervals(r GrafanaRange, step int64) []int64 {
+	from, to := r.From.Unix(), r.To.Unix()
+	var intervals []int64
+	for t := from - from%step; t < to; t += step {
+		intervals = append(intervals, t)
+	}
+	return intervals
+}
+
+// jokesServedSeries returns the tenant's jokes served per step seconds
+// over r.
+func jokesServedSeries(tenant string, r GrafanaRange, step int64) [][2]int64 {
+	intervals := grafanaIntervals(r, step)
+	counts := make(map[int64]int64, len(intervals))
+
+	statsMutex.RLock()
+	if s, ok := stats[tenant]; ok {
+		for _, buckets := range []map[int64]int64{s.minuteBuckets, s.hourBuckets} {
+			for t, count := range buckets {
+				counts[t-t%step] += count
+			}
+		}
+	}
+	statsMutex.RUnlock()
+
+	datapoints := make([][2]int64, 0, len(intervals))
+	for _, t := range intervals {
+		datapoints = append(datapoints, [2]int64{counts[t], t * 1000})
+	}
+	return datapoints
+}
+
+// uniquesSeries returns the tenant's distinct users, or visitors, per step
+// seconds over the part of r hourly sketches are kept for.
+func uniquesSeries(tenant string, users bool, r GrafanaRange, step int64, now time.Time) [][2]int64 {
+	kept := hourOf(now.Add(-maxHourlyUniques).Unix())
+	intervals := grafanaIntervals(r, step)
+	sketches := make(map[int64]*hyperLogLog, len(intervals))
+
+	statsMutex.RLock()
+	if s, ok := stats[tenant]; ok {
+		for hour, hourly := range s.hourlyUniques {
+			sketch := hourly.visitors
+			if users {
+				sketch = hourly.users
+			}
+			if sketch == nil {
+				continue
+			}
+			interval := hour - hour%step
+			merged, ok := sketches[interval]
+			if !ok {
+				merged = &hyperLogLog{}
+				sketches[interval] = merged
+			}
+			merged.merge(sketch)
+		}
+	}
+	statsMutex.RUnlock()
+
+	datapoints := make([][2]int64, 0, len(intervals))
+	for _, t := range intervals {
+		if t < kept-kept%step {
+			continue
+		}
+		datapoints = append(datapoints, [2]int64{sketches[t].estimateOrZero(), t * 1000})
+	}
+	return datapoints
+}
+
+func trendingTable(tenant string, now time.Time) gin.H {
+	rows := [][]any{}
+	for _, joke := range trending(tenant, trendingWindows[defaultTrendingWindow], maxTrendingLimit, now) {
+		rows = append(rows, []any{joke.Rank, joke.JokeID, joke.Served, joke.Previous, joke.Momentum})
+	}
+	return grafanaTable([]string{"Rank", "Joke ID", "Served", "Previous", "Momentum"},
+		[]string{"number", "string", "number", "number", "number"}, rows)
+}
+
+func reactionsTable(tenant string) gin.H {
+	rows := [][]any{}
+	for _, r := range reactionRanking(tenant) {
+		rows = append(rows, []any{r.JokeID, r.Laugh, r.Groan, r.Meh, r.Total, r.GroanRatio})
+	}
+	return grafanaTable([]string{"Joke ID", "Laugh", "Groan", "Meh", "Total", "Groan ratio"},
+		[]string{"string", "number", "number", "number", "number", "number"}, rows)
+}
+
+func sloTable(now time.Time) gin.H {
+	rows := [][]any{}
+	for _, status := range evaluateSLOs("", now) {
+		rows = append(rows, []any{
+			status.Name, status.Window, status.Objective, status.Compliance,
+			status.ErrorBudgetRemaining, status.BurnRates["1h"], status.Status,
+		})
+	}
+	return grafanaTable([]string{"SLO", "Window", "Objective", "Compliance", "Error budget remaining", "Burn rate (1h)", "Status"},
+		[]string{"string", "string", "number", "number", "number", "number", "string"}, rows)
+}
+
+func grafanaTable(names, types []string, rows [][]any) gin.H {
+	columns := make([]gin.H, len(names))
+	for i, name := range names {
+		columns[i] = gin.H{"text": name, "type": types[i]}
+	}
+	return gin.H{"type": "table", "columns": columns, "rows": rows}
+}
+
+// grafanaAnnotationsHandler serves POST /api/v1/grafana/annotations.
+func grafanaAnnotationsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "grafanaAnnotations")
+	defer span.End()
+
+	var query GrafanaAnnotationQuery
+	if !middleware.BindJSON(c, &query) {
+		return
+	}
+	kind := strings.TrimSpace(query.Annotation.Query)
+	if kind != "" && kind != anomalySpike && kind != anomalyDrought {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "annotation query must be empty, spike or drought"})
+		return
+	}
+
+	now := time.Now()
+	annotations := []GrafanaAnnotation{}
+	for _, a := range anomalyHistory(telemetry.TenantFromContext(ctx)) {
+		ended := now
+		if a.EndedAt != nil {
+			ended = *a.EndedAt
+		}
+		if (kind != "" && a.Kind != kind) || ended.Before(query.Range.From) || a.StartedAt.After(query.Range.To) {
+			continue
+		}
+		annotations = append(annotations, GrafanaAnnotation{
+			Time:    a.StartedAt.UnixMilli(),
+			TimeEnd: ended.UnixMilli(),
+			Title:   "Joke rate " + a.Kind,
+			Text:    anomalyText(a),
+			Tags:    []string{"anomaly", a.Kind},
+		})
+	}
+	sort.Slice(annotations, func(i, j int) bool { return annotations[i].Time < annotations[j].Time })
+
+	span.SetAttributes(attribute.Int("grafana.annotations", len(annotations)))
+	c.JSON(http.StatusOK, annotations)
+}
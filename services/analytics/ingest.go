@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// TrackEvent is a single tracking event waiting to be aggregated.
+type TrackEvent struct {
+	Timestamp time.Time
+	// SpanContext of the request that produced the event, linked from the
+	// batch span so traces can be followed across the queue
+	SpanContext trace.SpanContext
+	// Tenant whose stats the event counts towards
+	Tenant string
+	// JokeID of the joke served, if reported (see trending.go)
+	JokeID string
+	// UserID the joke was served to, if known (see leaderboard.go)
+	UserID string
+	// Visitor is the gateway's hash of the client IP, if reported (see
+	// uniques.go)
+	Visitor string
+	// Author of the joke served, if it has one (see authors.go)
+	Author string
+	// Latency of the backend request, if reported
+	Latency LatencySample
+	// Client that made the request, if reported
+	Client ClientAttributes
+}
+
+var (
+	eventQueue    chan TrackEvent
+	droppedEvents metric.Int64Counter
+)
+
+func initIngestion() {
+	eventQueue = make(chan TrackEvent, getEnvInt("TRACK_QUEUE_SIZE", 1024))
+
+	var err error
+	droppedEvents, err = meter.Int64Counter(
+		"analytics.events.dropped",
+		metric.WithDescription("Number of tracking events dropped because the queue was full"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create dropped events counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"analytics.events.queue_depth",
+		metric.WithDescription("Number of tracking events waiting to be aggregated"),
+		metric.WithUnit("{event}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(len(eventQueue)))
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create queue depth gauge", zap.Error(err))
+	}
+}
+
+// trackJokeServed queues a validated joke_served event received at at for
+// aggregation and returns "queued", or "dropped" if the queue is full.
+func trackJokeServed(ctx context.Context, payload TrackPayload, at time.Time) string {
+	if !enqueueEvent(ctx, newTrackEvent(ctx, payload, at)) {
+		loggerFor(ctx).Warn("Track event dropped, queue full")
+		return "dropped"
+	}
+
+	loggerFor(ctx).Info("Track event queued")
+	return "queued"
+}
+
+// newTrackEvent is the aggregation of a joke_served event received at at.
+func newTrackEvent(ctx context.Context, payload TrackPayload, at time.Time) TrackEvent {
+	return TrackEvent{
+		Timestamp:   at,
+		SpanContext: trace.SpanFromContext(ctx).SpanContext(),
+		Tenant:      telemetry.TenantFromContext(ctx),
+		JokeID:      payload.JokeID,
+		UserID:      payload.UserID,
+		Visitor:     payload.Visitor,
+		Author:      payload.Author,
+		Latency:     payload.LatencySample,
+		Client:      payload.Client,
+	}
+}
+
+// enqueueEvent hands an event to the worker pool without blocking. It
+// returns false if the queue is full and the event was dropped.
+func enqueueEvent(ctx context.Context, event TrackEvent) bool {
+	select {
+	case eventQueue <- event:
+		return true
+	default:
+		droppedEvents.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+		return false
+	}
+}
+
+// startIngestionWorkers launches the workers that drain the event queue.
+func startIngestionWorkers(ctx context.Context) {
+	workers := getEnvInt("TRACK_WORKERS", 4)
+	batchSize := getEnvInt("TRACK_BATCH_SIZE", 100)
+	flushInterval := getEnvDuration("TRACK_FLUSH_INTERVAL", 250*time.Millisecond)
+
+	for i := 0; i < workers; i++ {
+		go ingestionWorker(ctx, batchSize, flushInterval)
+	}
+
+	logger.Info("Ingestion workers started",
+		zap.Int("workers", workers),
+		zap.Int("queue_size", cap(eventQueue)),
+		zap.Int("batch_size", batchSize),
+		zap.Duration("flush_interval", flushInterval),
+	)
+}
+
+// ingestionWorker collects events into batches, flushing when the batch is
+// full or the flush interval elapses, so the stats lock is taken once per
+// batch instead of once per event.
+func ingestionWorker(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	batch := make([]TrackEvent, 0, batchSize)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			applyEventBatch(ctx, batch, true)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case event := <-eventQueue:
+			batch = append(batch, event)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// applyEventBatch aggregates a batch of events, adding them to the shared
+// counters if share is set (see sharedstats.go).
+func applyEventBatch(ctx context.Context, batch []TrackEvent, share bool) {
+	links := make([]trace.Link, 0, len(batch))
+	byTenant := map[string][]TrackEvent{}
+	for _, event := range batch {
+		if event.SpanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: event.SpanContext})
+		}
+		byTenant[event.Tenant] = append(byTenant[event.Tenant], event)
+	}
+
+	ctx, span := tracer.Start(ctx, "applyEventBatch", trace.WithLinks(links...))
+	defer span.End()
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	now := time.Now()
+	for tenant, events := range byTenant {
+		s := statsFor(tenant)
+		var latest time.Time
+		for _, event := range events {
+			if event.Timestamp.After(latest) {
+				latest = event.Timestamp
+			}
+			s.requests++
+			s.totalJokes++
+			if event.Timestamp.After(s.lastUpdate) {
+				s.lastUpdate = event.Timestamp
+			}
+			s.addToBuckets(event.Timestamp, now, 1)
+			s.countClient(event.Client)
+			s.countLocation(event.Client)
+			if event.UserID != "" {
+				s.recordActivity(event.UserID, event.Timestamp, 1, 0)
+			}
+			if event.JokeID != "" {
+				s.recordServing(event.JokeID, event.Timestamp)
+				s.recordAuthorServing(event.JokeID, event.Author)
+				if event.UserID != "" {
+					s.recordFunnelServing(event.UserID, event.JokeID, event.Timestamp)
+				}
+			}
+			s.recordUnique(event.UserID, event.Visitor, event.Timestamp)
+			recordLatency(event.Latency)
+			recordSLI(event.Latency, false, event.Timestamp)
+		}
+		if share {
+			shareStats(tenant, int64(len(events)), int64(len(events)), latest)
+		}
+
+		tenantCtx := telemetry.WithTenant(ctx, tenant)
+		trackingCount.Add(tenantCtx, int64(len(events)), metric.WithAttributes(telemetry.TenantAttr(tenantCtx)))
+
+		loggerFor(tenantCtx).Info("Event batch applied",
+			zap.Int("batch_size", len(events)),
+			zap.Int64("total_requests", s.requests),
+			zap.Int64("total_jokes", s.totalJokes),
+		)
+	}
+
+	span.SetAttributes(
+		attribute.Int("batch.size", len(batch)),
+		attribute.Int("batch.tenants", len(byTenant)),
+	)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Internal requests are signed with INTERNAL_AUTH_SECRET (see
+// pkg/middleware). With REDIS_ADDR set, the nonces of verified requests
+// are kept in Redis, so a request can't be replayed to another replica.
+
+// Internal payloads are small; cap what we read before verifying
+const internalAuthMaxBody = 1 << 20
+
+var (
+	internalAuth         middleware.InternalAuth
+	internalAuthFailures metric.Int64Counter
+)
+
+// initInternalAuth shares the replay guard through the stats Redis, so it
+// must run after initSharedStats.
+func initInternalAuth() {
+	secret := []byte(os.Getenv("INTERNAL_AUTH_SECRET"))
+	if len(secret) == 0 {
+		logger.Error("INTERNAL_AUTH_SECRET not set, /internal routes will reject every request")
+	}
+
+	var err error
+	internalAuthFailures, err = meter.Int64Counter(
+		"analytics.internal_auth.failures",
+		metric.WithDescription("Number of rejected internal requests"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create internal auth counter", zap.Error(err))
+	}
+
+	internalAuth = middleware.InternalAuth{
+		Service:  "analytics-service",
+		Secret:   secret,
+		MaxBody:  internalAuthMaxBody,
+		OnReject: rejectInternalRequest,
+	}
+	if sharedStats != nil {
+		internalAuth.Replays = middleware.RedisReplayGuard{Client: sharedStats, Prefix: "internal-nonce:"}
+	}
+}
+
+func rejectInternalRequest(c *gin.Context, reason string) {
+	ctx := c.Request.Context()
+	internalAuthFailures.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+	loggerFor(ctx).Warn("Internal request rejected",
+		zap.String("reason", reason),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("service", c.GetHeader(middleware.InternalServiceHeader)),
+		zap.String("client_ip", c.ClientIP()),
+	)
+}
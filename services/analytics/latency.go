@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Latency percentiles per endpoint are estimated with a DDSketch-style
+// sketch (latencySketch) rather than a t-digest or an HDR histogram. Like
+// an HDR histogram it has fixed buckets that merge and reset trivially, and
+// unlike a t-digest its error bound doesn't depend on the quantile or the
+// order samples arrive in. Every quantile it reports, p99 included, is
+// within 1% (latencyRelativeAccuracy) of the true latency, for any latency
+// above minLatencyMs. Memory grows with the log of the latency range (under
+// a thousand buckets from 1µs to minutes), not with the number of samples.
+
+// LatencySample is reported by backends alongside tracking events: how long
+// they took to serve the request that produced the event.
+type LatencySample struct {
+	Endpoint  string  `json:"endpoint,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
+
+// latencyRelativeAccuracy bounds the relative error of every quantile
+const latencyRelativeAccuracy = 0.01
+
+// minLatencyMs is the smallest latency the sketch distinguishes
+const minLatencyMs = 0.001
+
+var (
+	latencyGamma    = (1 + latencyRelativeAccuracy) / (1 - latencyRelativeAccuracy)
+	latencyLogGamma = math.Log(latencyGamma)
+
+	// Latency sketches keyed by endpoint ("METHOD /path")
+	latencies    = map[string]*latencySketch{}
+	latencyMutex sync.RWMutex
+
+	// latencyResetAt is when the sketches were last reset
+	latencyResetAt = startedAt
+)
+
+// latencySketch is a streaming quantile estimator in the style of DDSketch:
+// values are counted in logarithmically sized buckets, so memory grows with
+// the range of latencies seen rather than the number of samples, and any
+// quantile is within latencyRelativeAccuracy of the true value.
+type latencySketch struct {
+	buckets map[int]uint64
+	count   uint64
+	sum     float64
+	max     float64
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: map[int]uint64{}}
+}
+
+func (s *latencySketch) add(ms float64) {
+	if ms < minLatencyMs {
+		ms = minLatencyMs
+	}
+	s.buckets[int(math.Ceil(math.Log(ms)/latencyLogGamma))]++
+	s.count++
+	s.sum += ms
+	if ms > s.max {
+		s.max = ms
+	}
+}
+
+// quantile returns the estimated value at q (0 <= q <= 1).
+func (s *latencySketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	keys := make([]int, 0, len(s.buckets))
+	for k := range s.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	rank := q * float64(s.count-1)
+	var seen uint64
+	for _, k := range keys {
+		seen += s.buckets[k]
+		if float64(seen) > rank {
+			return math.Min(2*math.Pow(latencyGamma, float64(k))/(latencyGamma+1), s.max)
+		}
+	}
+	return s.max
+}
+
+// recordLatency adds a sample to its endpoint's sketch; samples without an
+// endpoint are ignored.
+func recordLatency(sample LatencySample) {
+	if sample.Endpoint == "" || sample.LatencyMs <= 0 {
+		return
+	}
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	sketch, ok := latencies[sample.Endpoint]
+	if !ok {
+		sketch = newLatencySketch()
+		latencies[sample.Endpoint] = sketch
+	}
+	sketch.add(sample.LatencyMs)
+}
+
+// resetLatencies discards all latency sketches.
+func resetLatencies() {
+	latencyMutex.Lock()
+	latencies = map[string]*latencySketch{}
+	latencyResetAt = time.Now()
+	latencyMutex.Unlock()
+}
+
+// latencySummary returns count, mean, max and p50/p95/p99 per endpoint.
+func latencySummary(endpoint string) map[string]gin.H {
+	latencyMutex.RLock()
+	defer latencyMutex.RUnlock()
+
+	summary := map[string]gin.H{}
+	for name, sketch := range latencies {
+		if endpoint != "" && name != endpoint {
+			continue
+		}
+		summary[name] = gin.H{
+			"count":   sketch.count,
+			"mean_ms": sketch.sum / float64(sketch.count),
+			"max_ms":  sketch.max,
+			"p50_ms":  sketch.quantile(0.50),
+			"p95_ms":  sketch.quantile(0.95),
+			"p99_ms":  sketch.quantile(0.99),
+		}
+	}
+	return summary
+}
+
+func latencyStatsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	_, span := tracer.Start(ctx, "getLatencyStats")
+	defer span.End()
+
+	summary := latencySummary(c.Query("endpoint"))
+	c.JSON(http.StatusOK, gin.H{
+		"endpoints":         summary,
+		"relative_accuracy": latencyRelativeAccuracy,
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Users are ranked by the jokes they requested and the favorites they
+// added. The jokes service reports the user behind each tracked joke, and
+// the user service reports favorite_added events (see events.go). Both are
+// counted per user in hourly buckets, so windows are whole hours ending
+// with the current one; compaction drops buckets older than two of the
+// longest window, which comparisons read (see compare.go and retention.go).
+
+// leaderboardWindows are the windows the leaderboard can be ranked over
+var leaderboardWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+const (
+	defaultLeaderboardWindow = "24h"
+	maxLeaderboardWindow     = 30 * 24 * time.Hour
+
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+
+	// maxLeaderboardUsers bounds the users tracked per tenant; activity of
+	// further users is not ranked until compaction frees room
+	maxLeaderboardUsers = 10000
+)
+
+// FavoriteEvent is sent by the user service for every favorite added or
+// deleted; this is the v1 schema of favorite_added (see events.go).
+type FavoriteEvent struct {
+	UserID string `json:"user_id"`
+	JokeID string `json:"joke_id"`
+}
+
+// UserDeletion is sent by the user service when a user's data is erased.
+type UserDeletion struct {
+	UserID string `json:"user_id"`
+}
+
+// userActivity counts what a user did in an hour.
+type userActivity struct {
+	jokes     int64
+	favorites int64
+}
+
+// LeaderboardEntry is a ranked user.
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	UserID    string `json:"user_id"`
+	Favorites int64  `json:"favorites"`
+	Jokes     int64  `json:"jokes"`
+}
+
+// recordActivity adds to userID's counts for the hour of t. Callers must
+// hold statsMutex for writing.
+func (s *Stats) recordActivity(userID string, t time.Time, jokes, favorites int64) {
+	hours, ok := s.users[userID]
+	if !ok {
+		if len(s.users) >= maxLeaderboardUsers {
+			return
+		}
+		hours = map[int64]*userActivity{}
+		s.users[userID] = hours
+	}
+
+	hour := hourOf(t.Unix())
+	activity, ok := hours[hour]
+	if !ok {
+		activity = &userActivity{}
+		hours[hour] = activity
+	}
+	activity.jokes += jokes
+	activity.favorites += favorites
+}
+
+// pruneActivity drops activity before cutoff, and users left without any.
+// It returns the number of hourly buckets dropped. Callers must hold
+// statsMutex for writing.
+func (s *Stats) pruneActivity(cutoff int64) int {
+	pruned := 0
+	for userID, hours := range s.users {
+		for hour := range hours {
+			if hour < cutoff {
+				delete(hours, hour)
+				pruned++
+			}
+		}
+		if len(hours) == 0 {
+			delete(s.users, userID)
+		}
+	}
+	return pruned
+}
+
+// leaderboard ranks the tenant's users over window by favorites or jokes,
+// breaking ties with the other count and then the user ID.
+func leaderboard(tenant string, window time.Duration, by string, limit int, now time.Time) []LeaderboardEntry {
+	// The window's hours, the current one last
+	since := hourOf(now.Unix()) - int64(window/time.Second) + 3600
+	return rankUsers(tenant, since, math.MaxInt64, by, limit)
+}
+
+// rankUsers ranks the tenant's users by their activity in the hours from
+// since up to, but not including, until.
+func rankUsers(tenant string, since, until int64, by string, limit int) []LeaderboardEntry {
+	statsMutex.RLock()
+	entries := []LeaderboardEntry{}
+	if s, ok := stats[tenant]; ok {
+		for userID, hours := range s.users {
+			entry := LeaderboardEntry{UserID: userID}
+			for hour, activity := range hours {
+				if hour >= since && hour < until {
+					entry.Favorites += activity.favorites
+					entry.Jokes += activity.jokes
+				}
+			}
+			if entry.Favorites > 0 || entry.Jokes > 0 {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	statsMutex.RUnlock()
+
+	primary := func(e LeaderboardEntry) (int64, int64) {
+		if by == "jokes" {
+			return e.Jokes, e.Favorites
+		}
+		return e.Favorites, e.Jokes
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		pi, si := primary(entries[i])
+		pj, sj := primary(entries[j])
+		if pi != pj {
+			return pi > pj
+		}
+		if si != sj {
+			return si > sj
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+// leaderboardHandler serves GET /api/v1/stats/leaderboard?window=7d&by=jokes&limit=10.
+func leaderboardHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getLeaderboard")
+	defer span.End()
+
+	windowName := c.DefaultQuery("window", defaultLeaderboardWindow)
+	window, ok := leaderboardWindows[windowName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be one of 1h, 24h, 7d or 30d"})
+		return
+	}
+
+	by := c.DefaultQuery("by", "favorites")
+	if by != "favorites" && by != "jokes" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by must be favorites or jokes"})
+		return
+	}
+
+	limit := defaultLeaderboardLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxLeaderboardLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxLeaderboardLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	entries := leaderboard(telemetry.TenantFromContext(ctx), window, by, limit, time.Now())
+
+	span.SetAttributes(
+		attribute.String("leaderboard.window", windowName),
+		attribute.String("leaderboard.by", by),
+		attribute.Int("leaderboard.count", len(entries)),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"window":  windowName,
+		"by":      by,
+		"leaders": entries,
+		"count":   len(entries),
+	})
+}
+
+// trackFavorite records a validated favorite_added event received at at.
+func trackFavorite(ctx context.Context, event FavoriteEvent, at time.Time) {
+	statsMutex.Lock()
+	s := statsFor(telemetry.TenantFromContext(ctx))
+	s.favoritesAdded++
+	s.recordActivity(event.UserID, at, 0, 1)
+	if event.JokeID != "" {
+		s.recordFunnelFavorite(event.UserID, event.JokeID, at)
+		s.recordAuthorFavorite(event.JokeID)
+	}
+	statsMutex.Unlock()
+	recordExperimentFavorite(telemetry.TenantFromContext(ctx), event)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("favorite.user_id", event.UserID),
+		attribute.String("joke.id", event.JokeID),
+	)
+
+	loggerFor(ctx).Info("Favorite tracked",
+		zap.String("user_id", event.UserID),
+		zap.String("joke_id", event.JokeID),
+	)
+}
+
+// eraseUser drops a deleted user's activity from the tenant's leaderboard
+// and funnel, and their events from the quarantine and the event log.
+// Distinct user counts can't forget a user, but their sketches keep only
+// hashes.
+func eraseUser(ctx context.Context, deletion UserDeletion) {
+	statsMutex.Lock()
+	s := statsFor(telemetry.TenantFromContext(ctx))
+	delete(s.users, deletion.UserID)
+	s.eraseFunnelUser(deletion.UserID)
+	statsMutex.Unlock()
+
+	quarantined := unquarantineUser(ctx, deletion.UserID)
+	logged, err := eraseLoggedUser(ctx, deletion.UserID)
+	if err != nil {
+		loggerFor(ctx).Error("Failed to erase user from the event log", zap.Error(err))
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("erasure.quarantined", quarantined),
+		attribute.Int("erasure.logged", logged),
+	)
+	loggerFor(ctx).Info("User erased", zap.Int("quarantined", quarantined), zap.Int("logged", logged))
+}
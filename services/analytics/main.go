@@ -2,7 +2,59 @@
 // Routes:
 //   GET /healthz            -> health check
 //   GET /api/v1/stats       -> returns joke statistics
-//   POST /internal/track    -> internal endpoint for tracking (called by jokes service)
+//   GET /api/v1/stats/reactions -> jokes ranked by groan ratio
+//   GET /api/v1/stats/latency   -> p50/p95/p99 latency per backend endpoint
+//   GET /api/v1/stats/clients   -> jokes served per client app, user agent
+//                                  family and gateway route
+//   GET /api/v1/stats/geo       -> jokes served per country and region (see geo.go)
+//   GET /api/v1/stats/anomalies -> current and recent spikes/droughts in the joke rate
+//   GET /api/v1/stats/leaderboard -> users ranked by favorites added or jokes
+//                                    requested over a window (see leaderboard.go)
+//   GET /api/v1/stats/trending   -> fastest-rising jokes over a window (see trending.go)
+//   GET /api/v1/stats/unique     -> approximate distinct users and visitors (see uniques.go)
+//   GET /api/v1/stats/compare    -> metrics over a window against the window before
+//                                   (see compare.go)
+//   GET /api/v1/stats/slo        -> SLO compliance, error budget and burn rates (see slo.go)
+//   GET /api/v1/stats/errors     -> requests and error rates per gateway route and
+//                                   backend over a window (see routeerrors.go)
+//   GET /api/v1/stats/funnel     -> served → favorited conversion per joke (see funnel.go)
+//   GET /api/v1/stats/authors    -> jokes served and favorited per joke author (see authors.go)
+//   GET /api/v1/stats/experiments/:id -> exposures, favorites and reactions per
+//                                        joke variant of an A/B test (see experiments.go)
+//   GET /api/v1/reports/weekly   -> a week's traffic, top jokes and users, latency
+//                                   and anomalies as JSON, HTML or PDF (see report.go)
+//   GET /api/v1/grafana, POST /api/v1/grafana/{search,query,annotations}
+//                                -> Grafana JSON datasource (see grafana.go)
+//   POST /internal/events   -> versioned tracking events (see events.go), including
+//                              joke_served events from the jokes service, queued
+//                              for batch aggregation (see ingest.go),
+//                              request_failed events from backends (see slo.go),
+//                              route_statuses events from the gateway and favorite
+//                              and user merge events from the user service (see
+//                              favorites.go)
+//   POST /internal/reaction        -> reaction events (called by jokes service); v1
+//   POST /internal/favorite        -> favorite events (called by user service); v1
+//   POST /v1/traces         -> OTLP/HTTP traces from the collector; span events
+//                              recording tracking events (see otlp.go)
+//   POST /internal/admin/reset     -> zero all counters
+//   GET /internal/admin/dump       -> raw counters, alert state and audit trail
+//   POST /internal/admin/backfill  -> import historical events
+//   GET /internal/admin/quarantine -> recently rejected tracking events
+//   POST /internal/admin/replay    -> rebuild the aggregates from the event log
+//                                     (see eventlog.go)
+//
+// All /internal routes require an HMAC signature (see internalauth.go).
+//
+// Stats and reactions are kept per tenant, taken from the request baggage
+// set by the gateway (see telemetry.TenantOf). With Redis, the headline
+// stats count every replica (see sharedstats.go).
+//
+// Threshold alerts are evaluated in the background and POSTed to the
+// webhooks listed in ALERT_WEBHOOK_URLS (see alerts.go). Spikes and
+// droughts relative to recent traffic are detected per tenant (see
+// anomalies.go). Per-minute counts are compacted into hourly ones in the
+// background (see retention.go). The aggregates are exported for
+// Prometheus and SigNoz on METRICS_PORT (see openmetrics.go).
 
 package main
 
@@ -10,14 +62,15 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -25,7 +78,6 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -34,28 +86,130 @@ var (
 	meter         metric.Meter
 	trackingCount metric.Int64Counter
 
-	// In-memory stats (in production, use a database)
-	stats      = &Stats{requests: 0, totalJokes: 0}
+	// In-memory stats per tenant (in production, use a database)
+	stats      = map[string]*Stats{}
 	statsMutex sync.RWMutex
+
+	// startedAt stands in for the last update before any event arrives
+	startedAt = time.Now()
 )
 
 type Stats struct {
 	requests   int64
 	totalJokes int64
 	lastUpdate time.Time
+
+	// Jokes tracked per minute and per hour, keyed by the unix timestamp
+	// of the minute or hour; older minutes are rolled up into hours (see
+	// retention.go)
+	minuteBuckets map[int64]int64
+	hourBuckets   map[int64]int64
+
+	// Jokes tracked per client (see clients.go)
+	clients map[ClientAttributes]int64
+
+	// Jokes tracked per country and region (see geo.go)
+	locations map[Location]int64
+
+	// Jokes and favorites per user and hour (see leaderboard.go)
+	users map[string]map[int64]*userActivity
+
+	// Servings per joke and five-minute bucket (see trending.go), and per
+	// joke and day (see report.go)
+	jokes         map[string]map[int64]int64
+	dailyServings map[string]map[int64]int64
+
+	// Distinct users and visitors per hour and per day (see uniques.go)
+	hourlyUniques map[int64]*uniqueSketches
+	dailyUniques  map[int64]*uniqueSketches
+
+	// Rate anomaly detection state (see anomalies.go)
+	anomalies anomalyDetector
+
+	// Served → favorited funnel counts per joke, and the servings per user
+	// and joke awaiting a favorite (see funnel.go)
+	funnel                map[string]*funnelCounts
+	funnelServings        map[string]map[string]*funnelServing
+	pendingServings       int
+	unattributedFavorites int64
+
+	// Servings and favorites per joke author, and the author of each joke
+	// served (see authors.go)
+	authors     map[string]*authorCounts
+	jokeAuthors map[string]string
+
+	// Favorites added and deleted and users merged, as the user service
+	// reports them (see favorites.go)
+	favoritesAdded   int64
+	favoritesDeleted int64
+	userMerges       int64
+}
+
+func newStats() *Stats {
+	return &Stats{
+		lastUpdate:     time.Now(),
+		minuteBuckets:  map[int64]int64{},
+		hourBuckets:    map[int64]int64{},
+		clients:        map[ClientAttributes]int64{},
+		locations:      map[Location]int64{},
+		users:          map[string]map[int64]*userActivity{},
+		jokes:          map[string]map[int64]int64{},
+		dailyServings:  map[string]map[int64]int64{},
+		hourlyUniques:  map[int64]*uniqueSketches{},
+		dailyUniques:   map[int64]*uniqueSketches{},
+		funnel:         map[string]*funnelCounts{},
+		funnelServings: map[string]map[string]*funnelServing{},
+		authors:        map[string]*authorCounts{},
+		jokeAuthors:    map[string]string{},
+	}
+}
+
+// statsFor returns the tenant's stats, creating them on first use. Callers
+// must hold statsMutex for writing.
+func statsFor(tenant string) *Stats {
+	s, ok := stats[tenant]
+	if !ok {
+		s = newStats()
+		stats[tenant] = s
+	}
+	return s
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
 }
 
 func initLogger() {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	var err error
-	logger, err = config.Build()
+	logger, err = telemetry.NewLogger()
 	if err != nil {
 		panic(err)
 	}
 }
 
+// loggerFor returns the service logger bound to ctx (see
+// telemetry.LoggerFor).
+func loggerFor(ctx context.Context) *zap.Logger {
+	return telemetry.LoggerFor(ctx, logger)
+}
+
 func initTracer() func() {
 	ctx := context.Background()
 
@@ -64,13 +218,7 @@ func initTracer() func() {
 		signozEndpoint = "signoz-otel-collector.platform.svc.cluster.local:4317"
 	}
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(signozEndpoint),
-		otlptracegrpc.WithInsecure(),
-	)
-	if err != nil {
-		logger.Fatal("Failed to create trace exporter", zap.Error(err))
-	}
+	exporter := telemetry.NewSpanExporter(signozEndpoint)
 
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
@@ -78,6 +226,7 @@ func initTracer() func() {
 			semconv.ServiceVersion("1.0.0"),
 			attribute.String("environment", "production"),
 		),
+		resource.WithAttributes(telemetry.K8sResourceAttributes()...),
 	)
 	if err != nil {
 		logger.Fatal("Failed to create resource", zap.Error(err))
@@ -86,7 +235,8 @@ func initTracer() func() {
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(telemetry.ContextSpanProcessor{}),
+		sdktrace.WithSampler(telemetry.NewSampler(nil)),
 	)
 
 	otel.SetTracerProvider(tp)
@@ -97,10 +247,19 @@ func initTracer() func() {
 
 	tracer = tp.Tracer("analytics-service")
 
+	exported, lp, err := telemetry.ExportLogs(logger, "analytics-service", signozEndpoint, res)
+	if err != nil {
+		logger.Fatal("Failed to create log export core", zap.Error(err))
+	}
+	logger = exported
+
 	return func() {
 		if err := tp.Shutdown(ctx); err != nil {
 			logger.Error("Error shutting down tracer provider", zap.Error(err))
 		}
+		if err := lp.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down logger provider", zap.Error(err))
+		}
 	}
 }
 
@@ -118,53 +277,61 @@ func initMetrics() {
 	}
 }
 
-func trackEvent(ctx context.Context) {
-	_, span := tracer.Start(ctx, "trackEvent")
-	defer span.End()
-
-	statsMutex.Lock()
-	defer statsMutex.Unlock()
-
-	stats.requests++
-	stats.totalJokes++
-	stats.lastUpdate = time.Now()
-
-	trackingCount.Add(ctx, 1)
-
-	span.SetAttributes(
-		attribute.Int64("stats.requests", stats.requests),
-		attribute.Int64("stats.total_jokes", stats.totalJokes),
-	)
-
-	logger.Info("Event tracked",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
-		zap.Int64("total_requests", stats.requests),
-		zap.Int64("total_jokes", stats.totalJokes),
-	)
-}
-
 func getStats(ctx context.Context) map[string]interface{} {
-	_, span := tracer.Start(ctx, "getStats")
+	ctx, span := tracer.Start(ctx, "getStats")
 	defer span.End()
 
+	tenant := telemetry.TenantFromContext(ctx)
 	statsMutex.RLock()
-	defer statsMutex.RUnlock()
+	s, ok := stats[tenant]
+	if !ok {
+		s = newStats()
+	}
+	requests, totalJokes, lastUpdate := s.requests, s.totalJokes, s.lastUpdate
+	favoritesAdded, favoritesDeleted, userMerges := s.favoritesAdded, s.favoritesDeleted, s.userMerges
+	statsMutex.RUnlock()
+
+	// With Redis, the counters of every replica (see sharedstats.go)
+	shared := false
+	var replicas int64
+	if sharedStats != nil {
+		counters, err := readSharedStats(ctx, tenant)
+		if err != nil {
+			loggerFor(ctx).Warn("Failed to read shared stats, answering with this replica's", zap.Error(err))
+		} else {
+			shared = true
+			requests, totalJokes, replicas = counters.requests, counters.totalJokes, counters.replicas
+			if counters.lastUpdate.After(lastUpdate) {
+				lastUpdate = counters.lastUpdate
+			}
+		}
+	}
 
 	result := map[string]interface{}{
-		"total_requests": stats.requests,
-		"total_jokes":    stats.totalJokes,
-		"last_update":    stats.lastUpdate.Format(time.RFC3339),
-		"uptime_seconds": time.Since(stats.lastUpdate).Seconds(),
+		"total_requests": requests,
+		"total_jokes":    totalJokes,
+		"last_update":    lastUpdate.Format(time.RFC3339),
+		"uptime_seconds": time.Since(lastUpdate).Seconds(),
+		// Counted by this replica, with or without Redis
+		"favorites_added":   favoritesAdded,
+		"favorites_deleted": favoritesDeleted,
+		"user_merges":       userMerges,
+	}
+	if sharedStats != nil {
+		result["shared"] = shared
+		if shared {
+			result["replicas"] = replicas
+		}
 	}
 
 	span.SetAttributes(
-		attribute.Int64("stats.requests", stats.requests),
-		attribute.Int64("stats.total_jokes", stats.totalJokes),
+		attribute.Int64("stats.requests", requests),
+		attribute.Int64("stats.total_jokes", totalJokes),
+		attribute.Bool("stats.shared", shared),
 	)
 
-	logger.Info("Stats retrieved",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
-		zap.Int64("total_requests", stats.requests),
+	loggerFor(ctx).Info("Stats retrieved",
+		zap.Int64("total_requests", requests),
 	)
 
 	return result
@@ -173,17 +340,47 @@ func getStats(ctx context.Context) map[string]interface{} {
 func main() {
 	initLogger()
 	defer logger.Sync()
+	telemetry.InitRuntimeConfig()
 
 	shutdown := initTracer()
 	defer shutdown()
 
 	initMetrics()
 
-	// Initialize stats
-	stats.lastUpdate = time.Now()
-
-	r := gin.Default()
-	r.Use(otelgin.Middleware("analytics-service"))
+	// Background workers run until main returns
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	initSharedStats()
+	initInternalAuth()
+	go runStatsSharing(bgCtx)
+	initIngestion()
+	initEvents()
+	initOTLPIngestion()
+	initEventLog()
+	startIngestionWorkers(bgCtx)
+
+	initAlerting()
+	go runAlerting(bgCtx)
+
+	initAnomalyDetection()
+	go runAnomalyDetection(bgCtx)
+
+	initRetention()
+	initFunnel()
+	initSLOs()
+	go runCompaction(bgCtx)
+
+	initMetricsExport()
+
+	r := gin.New()
+	// Accept HTTP/2 without TLS from the gateway (BACKEND_HTTP2)
+	r.UseH2C = true
+	r.Use(middleware.Default("analytics-service",
+		middleware.WithLogger(loggerFor),
+		middleware.WithMetricAttributes(telemetry.ContextAttrs),
+	)...)
+	r.Use(telemetry.TenantMiddleware())
 
 	r.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -195,10 +392,8 @@ func main() {
 
 	r.GET("/api/v1/stats", func(c *gin.Context) {
 		ctx := c.Request.Context()
-		span := trace.SpanFromContext(ctx)
 
-		logger.Info("Stats requested",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		loggerFor(ctx).Info("Stats requested",
 			zap.String("client_ip", c.ClientIP()),
 		)
 
@@ -206,17 +401,34 @@ func main() {
 		c.JSON(http.StatusOK, statistics)
 	})
 
-	r.POST("/internal/track", func(c *gin.Context) {
-		ctx := c.Request.Context()
-		span := trace.SpanFromContext(ctx)
-
-		logger.Info("Track event received",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
-		)
-
-		trackEvent(ctx)
-		c.JSON(http.StatusOK, gin.H{"status": "tracked"})
-	})
+	r.GET("/api/v1/stats/reactions", reactionStatsHandler)
+	r.GET("/api/v1/stats/latency", latencyStatsHandler)
+	r.GET("/api/v1/stats/clients", clientStatsHandler)
+	r.GET("/api/v1/stats/geo", geoStatsHandler)
+	r.GET("/api/v1/stats/anomalies", anomaliesHandler)
+	r.GET("/api/v1/stats/leaderboard", leaderboardHandler)
+	r.GET("/api/v1/stats/trending", trendingHandler)
+	r.GET("/api/v1/stats/unique", uniquesHandler)
+	r.GET("/api/v1/stats/compare", compareHandler)
+	r.GET("/api/v1/stats/slo", sloHandler)
+	r.GET("/api/v1/stats/errors", errorStatsHandler)
+	r.GET("/api/v1/stats/funnel", funnelHandler)
+	r.GET("/api/v1/stats/authors", authorStatsHandler)
+	r.GET("/api/v1/stats/experiments/:id", experimentHandler)
+	r.GET("/api/v1/reports/weekly", weeklyReportHandler)
+	registerGrafanaRoutes(r)
+
+	// Service-to-service routes, authenticated with a shared HMAC secret
+	internal := r.Group("/internal", internalAuth.Middleware())
+
+	internal.POST("/events", eventHandler(""))
+	internal.POST("/reaction", eventHandler(eventReaction))
+	internal.POST("/favorite", eventHandler(eventFavoriteAdded))
+
+	registerAdminRoutes(internal)
+
+	// Analytics events exported as spans by the collector (see otlp.go)
+	r.POST("/v1/traces", otlpTracesHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
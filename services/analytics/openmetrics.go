@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The aggregates behind the stats API are exported for scraping on
+// METRICS_PORT (default 9464), apart from the API port so only the cluster
+// reaches them: GET /metrics serves per-tenant joke, request, favorite and
+// merge counters, funnel and reaction counts per joke, and the latency of
+// every backend endpoint as a histogram, in the OpenMetrics text format, or
+// the Prometheus one to scrapers that don't ask for OpenMetrics. They come
+// straight from the aggregates, so Prometheus and SigNoz (through the
+// collector's prometheus receiver) graph the numbers the API reports.
+//
+// Each replica exports its own aggregates, not the shared headline stats
+// (see sharedstats.go), so sum over instances. Counters start over on
+// POST /internal/admin/reset. Latency buckets are derived from the
+// sketches, so a latency is counted under the bucket boundaries its sketch
+// bucket falls in, within latencyRelativeAccuracy. METRICS_PORT=off turns
+// the export off.
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// latencyBucketsSeconds are the upper bounds of the exported latency
+// histogram buckets
+var latencyBucketsSeconds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsWriter writes metric families in either exposition format.
+type metricsWriter struct {
+	w           *bufio.Writer
+	openMetrics bool
+}
+
+// family starts a metric family. Counter samples are name_total, which in
+// the Prometheus format is also the family name.
+func (m *metricsWriter) family(name, kind, help string) {
+	if kind == "counter" && !m.openMetrics {
+		name += "_total"
+	}
+	fmt.Fprintf(m.w, "# TYPE %s %s\n# HELP %s %s\n", name, kind, name, help)
+}
+
+// sample writes a sample; labels alternate names and values.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatMetricValue(value))
+	m.w.WriteByte('\n')
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// initMetricsExport serves the aggregates on METRICS_PORT in the
+// background.
+func initMetricsExport() {
+	port := os.Getenv("METRICS_PORT")
+	switch port {
+	case "off":
+		return
+	case "":
+		port = "9464"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		logger.Info("Starting metrics export", zap.String("port", port))
+		if err := server.ListenAndServe(); err != nil {
+			logger.Fatal("Failed to start metrics export", zap.Error(err))
+		}
+	}()
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+
+	m := &metricsWriter{w: bufio.NewWriter(w), openMetrics: openMetrics}
+	writeTenantMetrics(m)
+	writeReactionMetrics(m)
+	writeLatencyMetrics(m)
+	if openMetrics {
+		m.w.WriteString("# EOF\n")
+	}
+	if err := m.w.Flush(); err != nil {
+		logger.Debug("Metrics scrape aborted", zap.Error(err))
+	}
+}
+
+// sortedTenants returns the tenants with stats in order. Callers must hold
+// statsMutex.
+func sortedTenants() []string {
+	tenants := make([]string, 0, len(stats))
+	for tenant := range stats {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// writeTenantMetrics writes the per-tenant counters and funnel.
+func writeTenantMetrics(m *metricsWriter) {
+	statsMutex.RLock()
+	defer statsMutex.RUnlock()
+	tenants := sortedTenants()
+
+	counters := []struct {
+		name, help string
+		value      func(*Stats) int64
+	}{
+		{"analytics_requests", "Tracking requests received", func(s *Stats) int64 { return s.requests }},
+		{"analytics_jokes_served", "Jokes served", func(s *Stats) int64 { return s.totalJokes }},
+		{"analytics_favorites_added", "Favorites added", func(s *Stats) int64 { return s.favoritesAdded }},
+		{"analytics_favorites_deleted", "Favorites deleted", func(s *Stats) int64 { return s.favoritesDeleted }},
+		{"analytics_user_merges", "Users merged into another", func(s *Stats) int64 { return s.userMerges }},
+		{"analytics_unattributed_favorites", "Favorites of jokes not served to the user within the funnel window", func(s *Stats) int64 { return s.unattributedFavorites }},
+	}
+	for _, c := range counters {
+		m.family(c.name, "counter", c.help+".")
+		for _, tenant := range tenants {
+			m.sample(c.name+"_total", float64(c.value(stats[tenant])), "tenant", tenant)
+		}
+	}
+
+	m.family("analytics_funnel_pending_servings", "gauge", "Servings awaiting a favorite within the funnel window.")
+	for _, tenant := range tenants {
+		m.sample("analytics_funnel_pending_servings", float64(stats[tenant].pendingServings), "tenant", tenant)
+	}
+
+	for _, stage := range []string{"served", "favorited"} {
+		name := "analytics_funnel_" + stage
+		m.family(name, "counter", "Jokes "+stage+" in the served → favorited funnel, once per user and funnel window.")
+		for _, tenant := range tenants {
+			s := stats[tenant]
+			jokeIDs := make([]string, 0, len(s.funnel))
+			for jokeID := range s.funnel {
+				jokeIDs = append(jokeIDs, jokeID)
+			}
+			sort.Strings(jokeIDs)
+			for _, jokeID := range jokeIDs {
+				value := s.funnel[jokeID].served
+				if stage == "favorited" {
+					value = s.funnel[jokeID].favorited
+				}
+				m.sample(name+"_total", float64(value), "tenant", tenant, "joke_id", jokeID)
+			}
+		}
+	}
+}
+
+// writeReactionMetrics writes the reactions per joke.
+func writeReactionMetrics(m *metricsWriter) {
+	jokeReactionsMutex.RLock()
+	defer jokeReactionsMutex.RUnlock()
+
+	tenants := make([]string, 0, len(jokeReactions))
+	for tenant := range jokeReactions {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	m.family("analytics_joke_reactions", "counter", "Reactions to a joke, by kind.")
+	for _, tenant := range tenants {
+		jokeIDs := make([]string, 0, len(jokeReactions[tenant]))
+		for jokeID := range jokeReactions[tenant] {
+			jokeIDs = append(jokeIDs, jokeID)
+		}
+		sort.Strings(jokeIDs)
+		for _, jokeID := range jokeIDs {
+			r := jokeReactions[tenant][jokeID]
+			for _, kind := range []struct {
+				name  string
+				count int64
+			}{{"laugh", r.Laugh}, {"groan", r.Groan}, {"meh", r.Meh}} {
+				m.sample("analytics_joke_reactions_total", float64(kind.count),
+					"tenant", tenant, "joke_id", jokeID, "reaction", kind.name)
+			}
+		}
+	}
+}
+
+// writeLatencyMetrics writes the backend endpoint latencies as histograms.
+func writeLatencyMetrics(m *metricsWriter) {
+	latencyMutex.RLock()
+	defer latencyMutex.RUnlock()
+
+	endpoints := make([]string, 0, len(latencies))
+	for endpoint := range latencies {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	const name = "analytics_backend_latency_seconds"
+	m.family(name, "histogram", "Time backends took to serve the requests behind tracking events, by endpoint.")
+	for _, endpoint := range endpoints {
+		sketch := latencies[endpoint]
+		counts := sketch.cumulativeCounts(latencyBucketsSeconds)
+		for i, le := range latencyBucketsSeconds {
+			m.sample(name+"_bucket", float64(counts[i]), "endpoint", endpoint, "le", formatMetricValue(le))
+		}
+		m.sample(name+"_bucket", float64(sketch.count), "endpoint", endpoint, "le", "+Inf")
+		m.sample(name+"_count", float64(sketch.count), "endpoint", endpoint)
+		m.sample(name+"_sum", sketch.sum/1000, "endpoint", endpoint)
+	}
+}
+
+// cumulativeCounts returns the samples at or under each bound, in seconds,
+// counting every sketch bucket at its estimated value.
+func (s *latencySketch) cumulativeCounts(boundsSeconds []float64) []uint64 {
+	counts := make([]uint64, len(boundsSeconds))
+	for k, n := range s.buckets {
+		seconds := 2 * math.Pow(latencyGamma, float64(k)) / (latencyGamma + 1) / 1000
+		for i, bound := range boundsSeconds {
+			if seconds <= bound {
+				counts[i] += n
+			}
+		}
+	}
+	return counts
+}
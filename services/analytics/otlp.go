@@ -0,0 +1,306 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Besides POST /internal/events, tracking events can reach analytics as
+// standard telemetry: backends with ANALYTICS_TRANSPORT=otlp record each
+// event as a span event named after its type on a span marked with the
+// analytics.event attribute, and the collector forwards those spans, and
+// only those, to POST /v1/traces here, the OTLP/HTTP traces endpoint.
+//
+// The span event's attributes are the event's v2 payload, nested fields
+// flattened with dots ("client.app_id", "latency.endpoint"), and are
+// validated against the same schema as an envelope posted to
+// /internal/events. The tenant is read from the span's tenant.id
+// attribute. Spans without analytics events are ignored, so pointing a
+// whole pipeline here is harmless, if wasteful.
+//
+// The collector authenticates with a bearer token, OTLP_INGEST_TOKEN, as it
+// can't sign requests the way /internal routes expect. Without a token
+// every export is rejected, so an unconfigured replica can't be fed
+// events by anyone who can reach it.
+
+const (
+	// analyticsSchemaVersion is the schema version of span event payloads
+	analyticsSchemaVersion = 2
+	// maxOTLPBody bounds an export request, decompressed
+	maxOTLPBody = 8 << 20
+
+	otlpProtobufContentType = "application/x-protobuf"
+	otlpJSONContentType     = "application/json"
+)
+
+var (
+	otlpIngestToken []byte
+	otlpSpans       metric.Int64Counter
+)
+
+func initOTLPIngestion() {
+	otlpIngestToken = []byte(os.Getenv("OTLP_INGEST_TOKEN"))
+	if len(otlpIngestToken) == 0 {
+		logger.Warn("OTLP_INGEST_TOKEN not set, /v1/traces rejects every export")
+	}
+
+	var err error
+	otlpSpans, err = meter.Int64Counter(
+		"analytics.otlp.spans",
+		metric.WithDescription("Number of spans received over OTLP, by whether they carried analytics events"),
+		metric.WithUnit("{span}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create OTLP spans counter", zap.Error(err))
+	}
+}
+
+// otlpTracesHandler serves POST /v1/traces, in protobuf or JSON.
+func otlpTracesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	reason := ""
+	switch {
+	case len(otlpIngestToken) == 0:
+		reason = "no ingest token configured"
+	case subtle.ConstantTimeCompare([]byte(token), otlpIngestToken) != 1:
+		reason = "bad token"
+	}
+	if reason != "" {
+		internalAuthFailures.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+		loggerFor(ctx).Warn("OTLP export rejected",
+			zap.String("reason", reason),
+			zap.String("client_ip", c.ClientIP()),
+		)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if contentType != otlpProtobufContentType && contentType != otlpJSONContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/x-protobuf or application/json"})
+		return
+	}
+
+	body, err := readOTLPBody(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var request coltracepb.ExportTraceServiceRequest
+	if contentType == otlpJSONContentType {
+		err = protojson.Unmarshal(body, &request)
+	} else {
+		err = proto.Unmarshal(body, &request)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid OTLP traces request: " + err.Error()})
+		return
+	}
+
+	response := &coltracepb.ExportTraceServiceResponse{}
+	if rejected, message := ingestResourceSpans(ctx, request.GetResourceSpans()); rejected > 0 {
+		response.PartialSuccess = &coltracepb.ExportTracePartialSuccess{
+			RejectedSpans: rejected,
+			ErrorMessage:  message,
+		}
+	}
+
+	var out []byte
+	if contentType == otlpJSONContentType {
+		out, err = protojson.Marshal(response)
+	} else {
+		out, err = proto.Marshal(response)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	c.Data(http.StatusOK, contentType, out)
+}
+
+// readOTLPBody reads an export request, which the collector gzips by
+// default.
+func readOTLPBody(r *http.Request) ([]byte, error) {
+	var reader io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errors.New("invalid gzip body")
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		return nil, errors.New("unsupported Content-Encoding")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxOTLPBody+1))
+	if err != nil {
+		return nil, errors.New("unreadable body")
+	}
+	if len(body) > maxOTLPBody {
+		return nil, errors.New("request body too large")
+	}
+	return body, nil
+}
+
+// ingestResourceSpans applies the analytics events in an export request.
+// It returns the number of spans with rejected events and the last
+// rejection, for the partial success response; rejected events are
+// quarantined like those posted to /internal/events.
+func ingestResourceSpans(ctx context.Context, resourceSpans []*tracepb.ResourceSpans) (rejected int64, message string) {
+	var carrying, ignored int64
+	for _, rs := range resourceSpans {
+		service := stringAttribute(rs.GetResource().GetAttributes(), "service.name")
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				if stringAttribute(span.GetAttributes(), telemetry.AnalyticsEventAttribute) == "" {
+					ignored++
+					continue
+				}
+				carrying++
+				if err := ingestSpan(ctx, service, span); err != nil {
+					rejected++
+					message = err.Error()
+				}
+			}
+		}
+	}
+
+	otlpSpans.Add(ctx, carrying, metric.WithAttributes(attribute.Bool("analytics_event", true)))
+	otlpSpans.Add(ctx, ignored, metric.WithAttributes(attribute.Bool("analytics_event", false)))
+	return rejected, message
+}
+
+// ingestSpan applies the analytics events recorded on span, in the tenant
+// and trace the span belongs to. It returns the last validation error.
+func ingestSpan(ctx context.Context, service string, span *tracepb.Span) error {
+	tenant := stringAttribute(span.GetAttributes(), telemetry.TenantBaggageKey)
+	if tenant == "" {
+		tenant = telemetry.DefaultTenant
+	}
+	ctx = telemetry.WithTenant(ctx, tenant)
+
+	// Link the batch span to the producer's span (see ingest.go)
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], span.GetTraceId())
+	copy(spanID[:], span.GetSpanId())
+	eventCtx := trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+
+	var lastErr error
+	for _, spanEvent := range span.GetEvents() {
+		if _, ok := eventSchemas[spanEvent.GetName()]; !ok {
+			continue
+		}
+
+		payload, err := json.Marshal(unflattenAttributes(spanEvent.GetAttributes()))
+		if err != nil {
+			continue
+		}
+		event := Event{Type: spanEvent.GetName(), Version: analyticsSchemaVersion}
+		decode, ok := eventSchemas[event.Type][event.Version]
+		if !ok {
+			err = invalidEvent("unsupported_version", "%s has no schema_version %d", event.Type, event.Version)
+		} else {
+			err = decode(payload, &event)
+		}
+		if err != nil {
+			quarantineEvent(ctx, "/v1/traces", service, payload, event, err)
+			lastErr = err
+			continue
+		}
+
+		event.ReceivedAt = time.Now()
+		if envelope, err := json.Marshal(EventEnvelope{EventType: event.Type, SchemaVersion: event.Version, Payload: payload}); err == nil {
+			logEvent(ctx, "", envelope, event)
+		}
+
+		eventsReceived.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("event_type", event.Type),
+			attribute.Int("schema_version", event.Version),
+		), telemetry.ContextAttrs(ctx))
+		applyEvent(eventCtx, event)
+	}
+	return lastErr
+}
+
+// unflattenAttributes turns span event attributes into the payload they
+// flatten: "latency.endpoint" becomes {"latency": {"endpoint": ...}}.
+func unflattenAttributes(attrs []*commonpb.KeyValue) map[string]interface{} {
+	payload := map[string]interface{}{}
+	for _, kv := range attrs {
+		value := attributeValue(kv.GetValue())
+		if value == nil {
+			continue
+		}
+
+		parts := strings.Split(kv.GetKey(), ".")
+		object := payload
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := object[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				object[part] = child
+			}
+			object = child
+		}
+		object[parts[len(parts)-1]] = value
+	}
+	return payload
+}
+
+// attributeValue is the JSON value of a scalar attribute, or nil.
+func attributeValue(v *commonpb.AnyValue) interface{} {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return value.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return value.DoubleValue
+	case *commonpb.AnyValue_BoolValue:
+		return value.BoolValue
+	}
+	return nil
+}
+
+// stringAttribute returns the string attribute key, or "".
+func stringAttribute(attrs []*commonpb.KeyValue, key string) string {
+	for _, kv := range attrs {
+		if kv.GetKey() == key {
+			return kv.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
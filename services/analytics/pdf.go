@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// renderPDF lays out lines of text as a minimal PDF document: A4 pages in
+// Helvetica, with lines starting with "# " set in bold as headings and long
+// lines wrapped. It covers what the weekly report needs without a PDF
+// library; characters outside Latin-1 are replaced with '?'.
+func renderPDF(title string, lines []string) []byte {
+	const (
+		pageWidth, pageHeight = 595, 842
+		margin                = 50
+		fontSize, leading     = 10, 14
+		headingSize           = 12
+		// wrapWidth is the characters that fit a line at fontSize
+		wrapWidth = 95
+	)
+	linesPerPage := (pageHeight - 2*margin) / leading
+
+	// Wrap first, so pagination counts what is drawn
+	var wrapped []string
+	for _, line := range append([]string{"# " + title, ""}, lines...) {
+		heading := strings.HasPrefix(line, "# ")
+		for len([]rune(line)) > wrapWidth {
+			cut := strings.LastIndex(string([]rune(line)[:wrapWidth]), " ")
+			if cut <= 0 {
+				cut = len(string([]rune(line)[:wrapWidth]))
+			}
+			wrapped = append(wrapped, line[:cut])
+			line = "  " + strings.TrimLeft(line[cut:], " ")
+			if heading {
+				line = "# " + line
+			}
+		}
+		wrapped = append(wrapped, line)
+	}
+
+	var pages [][]byte
+	for start := 0; start < len(wrapped); start += linesPerPage {
+		end := min(start+linesPerPage, len(wrapped))
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", leading, margin, pageHeight-margin)
+		for _, line := range wrapped[start:end] {
+			if text, ok := strings.CutPrefix(line, "# "); ok {
+				fmt.Fprintf(&content, "/F2 %d Tf\n(%s) Tj T*\n", headingSize, pdfString(text))
+				continue
+			}
+			fmt.Fprintf(&content, "/F1 %d Tf\n(%s) Tj T*\n", fontSize, pdfString(line))
+		}
+		content.WriteString("ET\n")
+		pages = append(pages, content.Bytes())
+	}
+
+	// Objects 1-4 are the catalog, page tree and fonts; each page is then a
+	// page object followed by its content stream
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfString escapes text for a PDF string literal in WinAnsiEncoding.
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r < 0x20 || r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
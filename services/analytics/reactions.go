@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// ReactionEvent is sent by the jokes service for every reaction; this is
+// its v1 schema (see events.go).
+type ReactionEvent struct {
+	JokeID   string `json:"joke_id"`
+	Reaction string `json:"reaction"`
+	LatencySample
+	// ExperimentID and Variant are set from v2 on reactions to jokes under
+	// test (see experiments.go)
+	ExperimentID string `json:"-"`
+	Variant      string `json:"-"`
+}
+
+// JokeReactions summarizes the reactions to a single joke.
+type JokeReactions struct {
+	JokeID     string  `json:"joke_id"`
+	Laugh      int64   `json:"laugh"`
+	Groan      int64   `json:"groan"`
+	Meh        int64   `json:"meh"`
+	Total      int64   `json:"total"`
+	GroanRatio float64 `json:"groan_ratio"`
+}
+
+var (
+	// Reactions per tenant, keyed by joke ID
+	jokeReactions      = map[string]map[string]*JokeReactions{}
+	jokeReactionsMutex sync.RWMutex
+)
+
+func recordReaction(tenant string, event ReactionEvent) {
+	jokeReactionsMutex.Lock()
+	defer jokeReactionsMutex.Unlock()
+
+	tenantReactions, ok := jokeReactions[tenant]
+	if !ok {
+		tenantReactions = map[string]*JokeReactions{}
+		jokeReactions[tenant] = tenantReactions
+	}
+
+	r, ok := tenantReactions[event.JokeID]
+	if !ok {
+		r = &JokeReactions{JokeID: event.JokeID}
+		tenantReactions[event.JokeID] = r
+	}
+
+	switch event.Reaction {
+	case "laugh":
+		r.Laugh++
+	case "groan":
+		r.Groan++
+	case "meh":
+		r.Meh++
+	}
+	r.Total++
+	r.GroanRatio = float64(r.Groan) / float64(r.Total)
+}
+
+// resetReactions discards the reactions of every tenant.
+func resetReactions() {
+	jokeReactionsMutex.Lock()
+	jokeReactions = map[string]map[string]*JokeReactions{}
+	jokeReactionsMutex.Unlock()
+}
+
+// reactionRanking returns the tenant's jokes ordered by groan ratio,
+// highest first.
+func reactionRanking(tenant string) []JokeReactions {
+	jokeReactionsMutex.RLock()
+	ranking := make([]JokeReactions, 0, len(jokeReactions[tenant]))
+	for _, r := range jokeReactions[tenant] {
+		ranking = append(ranking, *r)
+	}
+	jokeReactionsMutex.RUnlock()
+
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].GroanRatio != ranking[j].GroanRatio {
+			return ranking[i].GroanRatio > ranking[j].GroanRatio
+		}
+		return ranking[i].Total > ranking[j].Total
+	})
+	return ranking
+}
+
+// trackReaction records a validated reaction event received at at.
+func trackReaction(ctx context.Context, event ReactionEvent, at time.Time) {
+	recordReaction(telemetry.TenantFromContext(ctx), event)
+	recordExperimentReaction(telemetry.TenantFromContext(ctx), event)
+	recordLatency(event.LatencySample)
+	recordSLI(event.LatencySample, false, at)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("joke.id", event.JokeID),
+		attribute.String("joke.reaction", event.Reaction),
+	)
+
+	loggerFor(ctx).Info("Reaction tracked",
+		zap.String("joke_id", event.JokeID),
+		zap.String("reaction", event.Reaction),
+	)
+}
+
+func reactionStatsHandler(c *gin.Context) {
+	ranking := reactionRanking(telemetry.TenantFromContext(c.Request.Context()))
+	c.JSON(http.StatusOK, gin.H{
+		"jokes": ranking,
+		"count": len(ranking),
+	})
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/reports/weekly assembles a report of a week, the seven days
+// (UTC) ending with ?end= (yesterday by default), for posting to the team
+// channel: traffic against the week before, the most served jokes, the
+// most active users, latency percentiles and the anomalies that started in
+// the week. It is computed from the stored stats, so it can cover weeks
+// ending in the last maxReportAge; jokes are counted per day for it, and
+// those counts are dropped by compaction after that (see retention.go).
+// Latency percentiles are the service's sketches, which cover everything
+// since it started or was last reset, not just the week.
+//
+// ?format=html renders it as a page and ?format=pdf as a document;
+// JSON is the default.
+
+const (
+	// maxReportAge is how long ago the last day of a report may be
+	maxReportAge = 28 * 24 * time.Hour
+
+	defaultReportLimit = 10
+	maxReportLimit     = 50
+)
+
+// WeeklyReport is the report of the seven days From to To, inclusive.
+type WeeklyReport struct {
+	Tenant      string             `json:"tenant"`
+	From        string             `json:"from"`
+	To          string             `json:"to"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Traffic     ReportTraffic      `json:"traffic"`
+	TopJokes    []ReportJoke       `json:"top_jokes"`
+	TopUsers    []LeaderboardEntry `json:"top_users"`
+	Latency     []ReportLatency    `json:"latency"`
+	// LatencySince is when the latency sketches started counting
+	LatencySince time.Time `json:"latency_since"`
+	Anomalies    []Anomaly `json:"anomalies"`
+}
+
+// ReportTraffic summarizes a week's traffic. ChangePercent compares the
+// jokes served with the week before, and is absent when none were.
+type ReportTraffic struct {
+	JokesServed    int64       `json:"jokes_served"`
+	PreviousWeek   int64       `json:"previous_week"`
+	ChangePercent  *float64    `json:"change_percent,omitempty"`
+	Favorites      int64       `json:"favorites"`
+	UniqueUsers    int64       `json:"unique_users"`
+	UniqueVisitors int64       `json:"unique_visitors"`
+	Days           []ReportDay `json:"days"`
+}
+
+// ReportDay is a day's traffic.
+type ReportDay struct {
+	Date        string `json:"date"`
+	JokesServed int64  `json:"jokes_served"`
+	Favorites   int64  `json:"favorites"`
+}
+
+// ReportJoke is one of the week's most served jokes.
+type ReportJoke struct {
+	Rank   int    `json:"rank"`
+	JokeID string `json:"joke_id"`
+	Served int64  `json:"served"`
+}
+
+// ReportLatency is an endpoint's latency percentiles.
+type ReportLatency struct {
+	Endpoint string  `json:"endpoint"`
+	Count    uint64  `json:"count"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+}
+
+// recordDailyServing counts a serving of jokeID on the day of t. Callers
+// must hold statsMutex for writing.
+func (s *Stats) recordDailyServing(jokeID string, t time.Time) {
+	days, ok := s.dailyServings[jokeID]
+	if !ok {
+		if len(s.dailyServings) >= maxTrendingJokes {
+			return
+		}
+		days = map[int64]int64{}
+		s.dailyServings[jokeID] = days
+	}
+	days[dayOf(t.Unix())]++
+}
+
+// pruneDailyServings drops daily servings before cutoff, and jokes left
+// without any. Callers must hold statsMutex for writing.
+func (s *Stats) pruneDailyServings(cutoff int64) int {
+	pruned := 0
+	for jokeID, days := range s.dailyServings {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+				pruned++
+			}
+		}
+		if len(days) == 0 {
+			delete(s.dailyServings, jokeID)
+		}
+	}
+	return pruned
+}
+
+// weeklyReport assembles the tenant's report of the seven days starting
+// on the day from.
+func weeklyReport(tenant string, from time.Time, limit int, now time.Time) WeeklyReport {
+	const day = 24 * 60 * 60
+	start := from.Unix()
+	end := start + 7*day
+	previous := start - 7*day
+
+	report := WeeklyReport{
+		Tenant:      tenant,
+		From:        from.Format(time.DateOnly),
+		To:          time.Unix(end-day, 0).UTC().Format(time.DateOnly),
+		GeneratedAt: now,
+		TopJokes:    []ReportJoke{},
+		Latency:     []ReportLatency{},
+		Anomalies:   []Anomaly{},
+	}
+
+	served := map[int64]int64{}
+	favorites := map[int64]int64{}
+	var jokes []ReportJoke
+	var users, visitors hyperLogLog
+
+	statsMutex.RLock()
+	if s, ok := stats[tenant]; ok {
+		for _, buckets := range []map[int64]int64{s.minuteBuckets, s.hourBuckets} {
+			for t, count := range buckets {
+				switch {
+				case t >= start && t < end:
+					served[dayOf(t)] += count
+				case t >= previous && t < start:
+					report.Traffic.PreviousWeek += count
+				}
+			}
+		}
+		for _, hours := range s.users {
+			for hour, activity := range hours {
+				if hour >= start && hour < end {
+					favorites[dayOf(hour)] += activity.favorites
+				}
+			}
+		}
+		for jokeID, days := range s.dailyServings {
+			joke := ReportJoke{JokeID: jokeID}
+			for d, count := range days {
+				if d >= start && d < end {
+					joke.Served += count
+				}
+			}
+			if joke.Served > 0 {
+				jokes = append(jokes, joke)
+			}
+		}
+		for d := start; d < end; d += day {
+			if sketches, ok := s.dailyUniques[d]; ok {
+				if sketches.users != nil {
+					users.merge(sketches.users)
+				}
+				if sketches.visitors != nil {
+					visitors.merge(sketches.visitors)
+				}
+			}
+		}
+	}
+	statsMutex.RUnlock()
+
+	for d := start; d < end; d += day {
+		report.Traffic.Days = append(report.Traffic.Days, ReportDay{
+			Date:        time.Unix(d, 0).UTC().Format(time.DateOnly),
+			JokesServed: served[d],
+			Favorites:   favorites[d],
+		})
+		report.Traffic.JokesServed += served[d]
+		report.Traffic.Favorites += favorites[d]
+	}
+	if report.Traffic.PreviousWeek > 0 {
+		change := roundTo(float64(report.Traffic.JokesServed-report.Traffic.PreviousWeek)*100/float64(report.Traffic.PreviousWeek), 1)
+		report.Traffic.ChangePercent = &change
+	}
+	report.Traffic.UniqueUsers = users.estimate()
+	report.Traffic.UniqueVisitors = visitors.estimate()
+
+	sort.Slice(jokes, func(i, j int) bool {
+		if jokes[i].Served != jokes[j].Served {
+			return jokes[i].Served > jokes[j].Served
+		}
+		return jokes[i].JokeID < jokes[j].JokeID
+	})
+	for i, joke := range jokes {
+		if i == limit {
+			break
+		}
+		joke.Rank = i + 1
+		report.TopJokes = append(report.TopJokes, joke)
+	}
+
+	report.TopUsers = rankUsers(tenant, start, end, "favorites", limit)
+
+	latencyMutex.RLock()
+	for endpoint, sketch := range latencies {
+		report.Latency = append(report.Latency, ReportLatency{
+			Endpoint: endpoint,
+			Count:    sketch.count,
+			P50:      roundTo(sketch.quantile(0.50), 1),
+			P95:      roundTo(sketch.quantile(0.95), 1),
+			P99:      roundTo(sketch.quantile(0.99), 1),
+		})
+	}
+	report.LatencySince = latencyResetAt
+	latencyMutex.RUnlock()
+	sort.Slice(report.Latency, func(i, j int) bool {
+		return report.Latency[i].Endpoint < report.Latency[j].Endpoint
+	})
+
+	for _, a := range anomalyHistory(tenant) {
+		if t := a.StartedAt.Unix(); t >= start && t < end {
+			report.Anomalies = append(report.Anomalies, a)
+		}
+	}
+	return report
+}
+
+// reportLines writes the report as text, one line per entry and "# "
+// before headings, for the PDF.
+func reportLines(r WeeklyReport) []string {
+	lines := []string{
+		fmt.Sprintf("Tenant %s, generated %s", r.Tenant, r.GeneratedAt.UTC().Format(time.RFC1123)),
+		"",
+		"# Traffic",
+		fmt.Sprintf("Jokes served: %d (previous week %d%s)", r.Traffic.JokesServed, r.Traffic.PreviousWeek, changeText(r.Traffic.ChangePercent)),
+		fmt.Sprintf("Favorites added: %d", r.Traffic.Favorites),
+		fmt.Sprintf("Unique users: %d, unique visitors: %d", r.Traffic.UniqueUsers, r.Traffic.UniqueVisitors),
+	}
+	for _, d := range r.Traffic.Days {
+		lines = append(lines, fmt.Sprintf("  %s  %d jokes, %d favorites", d.Date, d.JokesServed, d.Favorites))
+	}
+
+	lines = append(lines, "", "# Top jokes")
+	for _, j := range r.TopJokes {
+		lines = append(lines, fmt.Sprintf("%d. %s - served %d times", j.Rank, j.JokeID, j.Served))
+	}
+	if len(r.TopJokes) == 0 {
+		lines = append(lines, "No jokes served")
+	}
+
+	lines = append(lines, "", "# Top users")
+	for _, u := range r.TopUsers {
+		lines = append(lines, fmt.Sprintf("%d. %s - %d favorites, %d jokes", u.Rank, u.UserID, u.Favorites, u.Jokes))
+	}
+	if len(r.TopUsers) == 0 {
+		lines = append(lines, "No signed-in activity")
+	}
+
+	lines = append(lines, "", "# Latency (since "+r.LatencySince.UTC().Format(time.DateOnly)+")")
+	for _, l := range r.Latency {
+		lines = append(lines, fmt.Sprintf("%s - p50 %.1f ms, p95 %.1f ms, p99 %.1f ms (%d requests)", l.Endpoint, l.P50, l.P95, l.P99, l.Count))
+	}
+	if len(r.Latency) == 0 {
+		lines = append(lines, "No latency samples")
+	}
+
+	lines = append(lines, "", "# Anomalies")
+	for _, a := range r.Anomalies {
+		lines = append(lines, fmt.Sprintf("%s %s: %s", a.StartedAt.UTC().Format("Mon 15:04"), a.Kind, anomalyText(a)))
+	}
+	if len(r.Anomalies) == 0 {
+		lines = append(lines, "None")
+	}
+	return lines
+}
+
+// changeText describes a change against the previous week.
+func changeText(change *float64) string {
+	if change == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %+.1f%%", *change)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"change":  changeText,
+	"date":    func(t time.Time) string { return t.UTC().Format(time.DateOnly) },
+	"minute":  func(t time.Time) string { return t.UTC().Format("Mon 15:04") },
+	"anomaly": anomalyText,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Weekly report {{.From}} to {{.To}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1rem; }
+th, td { padding: 0.25rem 0.75rem; border-bottom: 1px solid #ddd; text-align: left; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Weekly report {{.From}} to {{.To}}</h1>
+<p>Tenant {{.Tenant}}, generated {{date .GeneratedAt}}</p>
+
+<h2>Traffic</h2>
+<p>{{.Traffic.JokesServed}} jokes served (previous week {{.Traffic.PreviousWeek}}{{change .Traffic.ChangePercent}}),
+{{.Traffic.Favorites}} favorites added, {{.Traffic.UniqueUsers}} unique users and {{.Traffic.UniqueVisitors}} unique visitors.</p>
+<table>
+<tr><th>Day</th><th>Jokes</th><th>Favorites</th></tr>
+{{range .Traffic.Days}}<tr><td>{{.Date}}</td><td class="n">{{.JokesServed}}</td><td class="n">{{.Favorites}}</td></tr>
+{{end}}</table>
+
+<h2>Top jokes</h2>
+{{if .TopJokes}}<table>
+<tr><th>#</th><th>Joke</th><th>Served</th></tr>
+{{range .TopJokes}}<tr><td>{{.Rank}}</td><td>{{.JokeID}}</td><td class="n">{{.Served}}</td></tr>
+{{end}}</table>{{else}}<p>No jokes served.</p>{{end}}
+
+<h2>Top users</h2>
+{{if .TopUsers}}<table>
+<tr><th>#</th><th>User</th><th>Favorites</th><th>Jokes</th></tr>
+{{range .TopUsers}}<tr><td>{{.Rank}}</td><td>{{.UserID}}</td><td class="n">{{.Favorites}}</td><td class="n">{{.Jokes}}</td></tr>
+{{end}}</table>{{else}}<p>No signed-in activity.</p>{{end}}
+
+<h2>Latency</h2>
+<p>Since {{date .LatencySince}}.</p>
+{{if .Latency}}<table>
+<tr><th>Endpoint</th><th>p50 ms</th><th>p95 ms</th><th>p99 ms</th><th>Requests</th></tr>
+{{range .Latency}}<tr><td>{{.Endpoint}}</td><td class="n">{{.P50}}</td><td class="n">{{.P95}}</td><td class="n">{{.P99}}</td><td class="n">{{.Count}}</td></tr>
+{{end}}</table>{{else}}<p>No latency samples.</p>{{end}}
+
+<h2>Anomalies</h2>
+{{if .Anomalies}}<ul>
+{{range .Anomalies}}<li>{{minute .StartedAt}} {{.Kind}}: {{anomaly .}}</li>
+{{end}}</ul>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+// weeklyReportHandler serves GET /api/v1/reports/weekly?end=2026-10-11&format=html&limit=10.
+func weeklyReportHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getWeeklyReport")
+	defer span.End()
+
+	now := time.Now()
+	today := time.Unix(dayOf(now.Unix()), 0).UTC()
+	end := today.AddDate(0, 0, -1)
+	if v := c.Query("end"); v != "" {
+		parsed, err := time.Parse(time.DateOnly, v)
+		if err != nil || parsed.After(today) || parsed.Before(today.Add(-maxReportAge)) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("end must be a date (YYYY-MM-DD) in the last %d days", int(maxReportAge.Hours()/24)),
+			})
+			return
+		}
+		end = parsed
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "html" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, html or pdf"})
+		return
+	}
+
+	limit := defaultReportLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxReportLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxReportLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	tenant := telemetry.TenantFromContext(ctx)
+	report := weeklyReport(tenant, end.AddDate(0, 0, -6), limit, now)
+
+	span.SetAttributes(
+		attribute.String("report.from", report.From),
+		attribute.String("report.to", report.To),
+		attribute.String("report.format", format),
+		attribute.Int64("report.jokes_served", report.Traffic.JokesServed),
+	)
+	loggerFor(ctx).Info("Weekly report generated",
+		zap.String("from", report.From),
+		zap.String("to", report.To),
+		zap.String("format", format),
+	)
+
+	filename := fmt.Sprintf("weekly-report-%s-%s", tenant, report.To)
+	switch format {
+	case "html":
+		var page bytes.Buffer
+		if err := reportTemplate.Execute(&page, report); err != nil {
+			loggerFor(ctx).Error("Failed to render weekly report", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render report"})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+	case "pdf":
+		title := fmt.Sprintf("Weekly report %s to %s", report.From, report.To)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, filename))
+		c.Data(http.StatusOK, "application/pdf", renderPDF(title, reportLines(report)))
+	default:
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Per-minute joke counts are kept for MINUTE_BUCKET_RETENTION. The
+// compaction job rolls older minutes up into hourly buckets, which are
+// kept for HOUR_BUCKET_RETENTION and then deleted.
+
+var (
+	minuteBucketRetention time.Duration
+	hourBucketRetention   time.Duration
+	compactionInterval    time.Duration
+
+	compactionRuns     metric.Int64Counter
+	compactionBuckets  metric.Int64Counter
+	compactionDuration metric.Float64Histogram
+)
+
+func initRetention() {
+	minuteBucketRetention = getEnvDuration("MINUTE_BUCKET_RETENTION", 7*24*time.Hour)
+	hourBucketRetention = getEnvDuration("HOUR_BUCKET_RETENTION", 90*24*time.Hour)
+	compactionInterval = getEnvDuration("COMPACTION_INTERVAL", 10*time.Minute)
+	if minuteBucketRetention < time.Hour {
+		// Anomaly detection and alerting read the last hour of minutes
+		minuteBucketRetention = time.Hour
+	}
+
+	var err error
+	compactionRuns, err = meter.Int64Counter(
+		"analytics.compaction.runs",
+		metric.WithDescription("Number of compaction runs"),
+		metric.WithUnit("{run}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create compaction runs counter", zap.Error(err))
+	}
+
+	compactionBuckets, err = meter.Int64Counter(
+		"analytics.compaction.buckets",
+		metric.WithDescription("Number of buckets rolled up or deleted by compaction"),
+		metric.WithUnit("{bucket}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create compaction buckets counter", zap.Error(err))
+	}
+
+	compactionDuration, err = meter.Float64Histogram(
+		"analytics.compaction.duration",
+		metric.WithDescription("Time taken by a compaction run"),
+		metric.WithUnit("ms"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create compaction duration histogram", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"analytics.storage.buckets",
+		metric.WithDescription("Number of stored time buckets by granularity"),
+		metric.WithUnit("{bucket}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			statsMutex.RLock()
+			defer statsMutex.RUnlock()
+			for tenant, s := range stats {
+				o.Observe(int64(len(s.minuteBuckets)), metric.WithAttributes(
+					attribute.String("granularity", "minute"),
+					attribute.String("tenant_id", tenant),
+				))
+				o.Observe(int64(len(s.hourBuckets)), metric.WithAttributes(
+					attribute.String("granularity", "hour"),
+					attribute.String("tenant_id", tenant),
+				))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create storage gauge", zap.Error(err))
+	}
+}
+
+// runCompaction compacts the buckets every compactionInterval until ctx
+// is cancelled.
+func runCompaction(ctx context.Context) {
+	logger.Info("Compaction started",
+		zap.Duration("minute_retention", minuteBucketRetention),
+		zap.Duration("hour_retention", hourBucketRetention),
+		zap.Duration("interval", compactionInterval),
+	)
+
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			compactBuckets(ctx, time.Now())
+		}
+	}
+}
+
+// compactBuckets rolls minute buckets past their retention up into hourly
+// buckets and deletes hourly buckets past theirs, user activity older
+// than two of the longest comparison window, funnel servings past the funnel
+// window, and unique count sketches, daily joke servings and SLO counts
+// no window or report reads any more.
+func compactBuckets(ctx context.Context, now time.Time) {
+	ctx, span := tracer.Start(ctx, "compactBuckets")
+	defer span.End()
+
+	start := time.Now()
+	minuteCutoff := now.Add(-minuteBucketRetention).Unix()
+	hourCutoff := now.Add(-hourBucketRetention).Unix()
+	activityCutoff := hourOf(now.Add(-2 * maxCompareWindow).Unix())
+	servingCutoff := bucketOf(now.Add(-2 * maxTrendingWindow).Unix())
+	uniqueHourCutoff := hourOf(now.Add(-maxHourlyUniques).Unix())
+	uniqueDayCutoff := dayOf(now.Add(-maxUniqueWindow).Unix())
+	funnelCutoff := now.Add(-funnelWindow).Unix()
+	dailyServingCutoff := dayOf(now.Add(-maxReportAge - 7*24*time.Hour).Unix())
+
+	statsMutex.Lock()
+	var rolledUp, deleted int
+	for _, s := range stats {
+		for minute, count := range s.minuteBuckets {
+			if minute >= minuteCutoff {
+				continue
+			}
+			if hour := hourOf(minute); hour >= hourCutoff {
+				s.hourBuckets[hour] += count
+			}
+			delete(s.minuteBuckets, minute)
+			rolledUp++
+		}
+		for hour := range s.hourBuckets {
+			if hour < hourCutoff {
+				delete(s.hourBuckets, hour)
+				deleted++
+			}
+		}
+		deleted += s.pruneActivity(activityCutoff)
+		deleted += s.pruneServings(servingCutoff)
+		deleted += s.pruneUniques(uniqueHourCutoff, uniqueDayCutoff)
+		deleted += s.pruneFunnel(funnelCutoff)
+		deleted += s.pruneDailyServings(dailyServingCutoff)
+	}
+	statsMutex.Unlock()
+	deleted += pruneSLIs(now)
+	deleted += pruneRouteStatuses(now)
+
+	duration := float64(time.Since(start).Microseconds()) / 1000
+	compactionRuns.Add(ctx, 1)
+	compactionBuckets.Add(ctx, int64(rolledUp), metric.WithAttributes(attribute.String("action", "rolled_up")))
+	compactionBuckets.Add(ctx, int64(deleted), metric.WithAttributes(attribute.String("action", "deleted")))
+	compactionDuration.Record(ctx, duration)
+
+	span.SetAttributes(
+		attribute.Int("compaction.rolled_up", rolledUp),
+		attribute.Int("compaction.deleted", deleted),
+	)
+	if rolledUp > 0 || deleted > 0 {
+		loggerFor(ctx).Info("Buckets compacted",
+			zap.Int("rolled_up", rolledUp),
+			zap.Int("deleted", deleted),
+			zap.Float64("duration_ms", duration),
+		)
+	}
+}
+
+// addToBuckets counts jokes at t in the bucket its age calls for: a
+// minute bucket, an hour bucket, or none once past both retentions.
+// Callers must hold statsMutex for writing.
+func (s *Stats) addToBuckets(t, now time.Time, count int64) {
+	switch {
+	case t.After(now.Add(-minuteBucketRetention)):
+		s.minuteBuckets[t.Truncate(time.Minute).Unix()] += count
+	case t.After(now.Add(-hourBucketRetention)):
+		s.hourBuckets[hourOf(t.Unix())] += count
+	}
+}
+
+// hourOf returns the start of the hour containing the unix timestamp.
+func hourOf(unix int64) int64 {
+	return unix - unix%3600
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The gateway counts the status of every response by route and backend
+// and reports the counts in batches as route_statuses events (see its
+// routestatus.go). They are kept per minute for the longest window, across
+// tenants like the SLOs: they describe the service, not a tenant's
+// traffic. GET /api/v1/stats/errors?window=1h reports requests, server
+// errors (5xx) and client errors (4xx) per route and per backend over the
+// window, and rates each backend "operational", "degraded" or "outage" by
+// its server error rate, so a status page can be built on it alone.
+// Counts are attributed to the minute they were received in.
+
+// errorWindows are the windows error rates can be reported over
+var errorWindows = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"24h": 24 * time.Hour,
+}
+
+const (
+	defaultErrorWindow = "1h"
+	maxErrorWindow     = 24 * time.Hour
+
+	// maxRouteStatuses bounds the counts in a route_statuses event
+	maxRouteStatuses = 1000
+
+	// Server error rates from which a backend is degraded or out
+	degradedErrorRate = 0.05
+	outageErrorRate   = 0.5
+
+	backendOperational = "operational"
+	backendDegraded    = "degraded"
+	backendOutage      = "outage"
+)
+
+// RouteStatusCount is a count of responses with a status to requests for
+// a route, "METHOD /path" as the gateway routes it, sent to a backend.
+type RouteStatusCount struct {
+	Route   string `json:"route"`
+	Backend string `json:"backend"`
+	Status  int    `json:"status"`
+	Count   int64  `json:"count"`
+}
+
+// routeKey is what route statuses are counted by.
+type routeKey struct {
+	route, backend string
+}
+
+// RouteErrors are a route's (or a backend's) requests and errors over a
+// window.
+type RouteErrors struct {
+	Route        string           `json:"route,omitempty"`
+	Backend      string           `json:"backend"`
+	Requests     int64            `json:"requests"`
+	Errors       int64            `json:"errors"`
+	ClientErrors int64            `json:"client_errors"`
+	ErrorRate    float64          `json:"error_rate"`
+	Statuses     map[string]int64 `json:"statuses,omitempty"`
+	// Status rates a backend by its error rate
+	Status string `json:"status,omitempty"`
+}
+
+var (
+	// routeStatusBuckets holds the counts by minute, then route and
+	// status
+	routeStatusBuckets = map[int64]map[routeKey]map[int]int64{}
+	routeStatusMutex   sync.RWMutex
+)
+
+func validateRouteStatuses(counts []RouteStatusCount) error {
+	switch {
+	case len(counts) == 0:
+		return invalidEvent("missing_field", "routes is required")
+	case len(counts) > maxRouteStatuses:
+		return invalidEvent("invalid_field", "routes must hold at most %d counts", maxRouteStatuses)
+	}
+	for i, count := range counts {
+		switch {
+		case count.Route == "" || len(count.Route) > maxEventFieldLength:
+			return invalidEvent("invalid_field", "routes[%d].route must be 1-%d bytes", i, maxEventFieldLength)
+		case !eventJokeIDPattern.MatchString(count.Backend):
+			return invalidEvent("invalid_field", "routes[%d].backend must be 1-64 letters, digits, '-' or '_'", i)
+		case count.Status < 100 || count.Status > 599:
+			return invalidEvent("invalid_field", "routes[%d].status must be an HTTP status code", i)
+		case count.Count < 1:
+			return invalidEvent("invalid_field", "routes[%d].count must be positive", i)
+		}
+	}
+	return nil
+}
+
+// trackRouteStatuses records a validated route_statuses event received at
+// at.
+func trackRouteStatuses(ctx context.Context, counts []RouteStatusCount, at time.Time) {
+	minute := at.Truncate(time.Minute).Unix()
+	var requests, errors int64
+
+	routeStatusMutex.Lock()
+	routes, ok := routeStatusBuckets[minute]
+	if !ok {
+		routes = map[routeKey]map[int]int64{}
+		routeStatusBuckets[minute] = routes
+	}
+	for _, count := range counts {
+		key := routeKey{count.Route, count.Backend}
+		statuses, ok := routes[key]
+		if !ok {
+			statuses = map[int]int64{}
+			routes[key] = statuses
+		}
+		statuses[count.Status] += count.Count
+		requests += count.Count
+		if count.Status >= 500 {
+			errors += count.Count
+		}
+	}
+	routeStatusMutex.Unlock()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("route_statuses.requests", requests),
+		attribute.Int64("route_statuses.errors", errors),
+	)
+	loggerFor(ctx).Debug("Route statuses tracked",
+		zap.Int("counts", len(counts)),
+		zap.Int64("requests", requests),
+		zap.Int64("errors", errors),
+	)
+}
+
+// pruneRouteStatuses drops the minutes older than the longest window and
+// returns how many were dropped.
+func pruneRouteStatuses(now time.Time) int {
+	cutoff := now.Add(-maxErrorWindow).Truncate(time.Minute).Unix()
+
+	routeStatusMutex.Lock()
+	defer routeStatusMutex.Unlock()
+
+	pruned := 0
+	for minute := range routeStatusBuckets {
+		if minute < cutoff {
+			delete(routeStatusBuckets, minute)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// resetRouteStatuses discards the route status counts.
+func resetRouteStatuses() {
+	routeStatusMutex.Lock()
+	routeStatusBuckets = map[int64]map[routeKey]map[int]int64{}
+	routeStatusMutex.Unlock()
+}
+
+// add counts n responses with status.
+func (e *RouteErrors) add(status int, n int64) {
+	e.Requests += n
+	switch {
+	case status >= 500:
+		e.Errors += n
+	case status >= 400:
+		e.ClientErrors += n
+	}
+}
+
+// finish computes the error rate.
+func (e *RouteErrors) finish() {
+	if e.Requests > 0 {
+		e.ErrorRate = roundTo(float64(e.Errors)/float64(e.Requests), 4)
+	}
+}
+
+// routeErrors sums the counts of the window ending at now per route and
+// per backend, sorted by errors, most first, then by name. route and
+// backend, if set, keep only theirs.
+func routeErrors(window time.Duration, route, backend string, now time.Time) (routes, backends []RouteErrors) {
+	since := now.Truncate(time.Minute).Unix() - int64(window/time.Second) + 60
+	byRoute := map[routeKey]*RouteErrors{}
+	byBackend := map[string]*RouteErrors{}
+
+	routeStatusMutex.RLock()
+	for minute, counts := range routeStatusBuckets {
+		if minute < since {
+			continue
+		}
+		for key, statuses := range counts {
+			if (route != "" && key.route != route) || (backend != "" && key.backend != backend) {
+				continue
+			}
+			r, ok := byRoute[key]
+			if !ok {
+				r = &RouteErrors{Route: key.route, Backend: key.backend, Statuses: map[string]int64{}}
+				byRoute[key] = r
+			}
+			b, ok := byBackend[key.backend]
+			if !ok {
+				b = &RouteErrors{Backend: key.backend}
+				byBackend[key.backend] = b
+			}
+			for status, n := range statuses {
+				r.add(status, n)
+				r.Statuses[strconv.Itoa(status)] += n
+				b.add(status, n)
+			}
+		}
+	}
+	routeStatusMutex.RUnlock()
+
+	routes = make([]RouteErrors, 0, len(byRoute))
+	for _, r := range byRoute {
+		r.finish()
+		routes = append(routes, *r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Errors != routes[j].Errors {
+			return routes[i].Errors > routes[j].Errors
+		}
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Backend < routes[j].Backend
+	})
+
+	backends = make([]RouteErrors, 0, len(byBackend))
+	for _, b := range byBackend {
+		b.finish()
+		switch {
+		case b.ErrorRate >= outageErrorRate:
+			b.Status = backendOutage
+		case b.ErrorRate >= degradedErrorRate:
+			b.Status = backendDegraded
+		default:
+			b.Status = backendOperational
+		}
+		backends = append(backends, *b)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].Errors != backends[j].Errors {
+			return backends[i].Errors > backends[j].Errors
+		}
+		return backends[i].Backend < backends[j].Backend
+	})
+	return routes, backends
+}
+
+// errorStatsHandler serves GET /api/v1/stats/errors?window=1h, optionally
+// for one ?route ("GET /api/v1/joke") or ?backend.
+func errorStatsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	_, span := tracer.Start(ctx, "getErrorStats")
+	defer span.End()
+
+	windowName := c.DefaultQuery("window", defaultErrorWindow)
+	window, ok := errorWindows[windowName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be one of 5m, 1h, 6h or 24h"})
+		return
+	}
+
+	routes, backends := routeErrors(window, c.Query("route"), c.Query("backend"), time.Now())
+	total := RouteErrors{}
+	for _, b := range backends {
+		total.Requests += b.Requests
+		total.Errors += b.Errors
+		total.ClientErrors += b.ClientErrors
+	}
+	total.finish()
+
+	span.SetAttributes(
+		attribute.String("errors.window", windowName),
+		attribute.Int("errors.routes", len(routes)),
+		attribute.Int64("errors.count", total.Errors),
+	)
+	c.JSON(http.StatusOK, gin.H{
+		"window":        windowName,
+		"requests":      total.Requests,
+		"errors":        total.Errors,
+		"client_errors": total.ClientErrors,
+		"error_rate":    total.ErrorRate,
+		"routes":        routes,
+		"backends":      backends,
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Each replica aggregates the events it receives in memory, so behind a
+// load balancer every replica sees part of the traffic. With REDIS_ADDR
+// set, the headline counters of GET /api/v1/stats are shared: every
+// STATS_SHARE_INTERVAL each replica adds what it tracked since to a hash
+// per tenant in Redis, and the stats are read from there, adding what this
+// replica hasn't shared yet. Counts that fail to reach Redis are kept and
+// added on the next attempt; if Redis can't be read, the replica answers
+// with its own counts and "shared": false. Resets clear the shared
+// counters too.
+//
+// The breakdowns (per minute, client, user, joke, reactions, latency and
+// the rest) stay per replica.
+
+// sharedStatsPrefix keys the shared counters of each tenant
+const sharedStatsPrefix = "analytics:stats:"
+
+// sharedReplicasKey is a sorted set of the replicas sharing counters, by
+// when they last did
+const sharedReplicasKey = "analytics:replicas"
+
+// addSharedStats adds a replica's counts to a tenant's hash; last_update
+// is kept as the latest of all replicas, in Unix milliseconds.
+var addSharedStats = redis.NewScript(`
+redis.call('HINCRBY', KEYS[1], 'requests', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'total_jokes', ARGV[2])
+local last = tonumber(redis.call('HGET', KEYS[1], 'last_update') or '0')
+if tonumber(ARGV[3]) > last then
+	redis.call('HSET', KEYS[1], 'last_update', ARGV[3])
+end
+return 1
+`)
+
+// statsDelta is what a replica tracked for a tenant and hasn't shared yet.
+type statsDelta struct {
+	requests   int64
+	totalJokes int64
+	lastUpdate time.Time
+}
+
+// sharedCounters are a tenant's headline counters across the replicas.
+type sharedCounters struct {
+	requests   int64
+	totalJokes int64
+	lastUpdate time.Time
+	replicas   int64
+}
+
+var (
+	// sharedStats is nil unless REDIS_ADDR is set
+	sharedStats   *redis.Client
+	shareInterval = 5 * time.Second
+	replicaName   string
+
+	pendingShares      = map[string]*statsDelta{}
+	pendingSharesMutex sync.Mutex
+)
+
+func initSharedStats() {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		logger.Warn("REDIS_ADDR not set, stats cover this replica only")
+		return
+	}
+	sharedStats = redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+	shareInterval = getEnvDuration("STATS_SHARE_INTERVAL", shareInterval)
+	if shareInterval <= 0 {
+		shareInterval = 5 * time.Second
+	}
+
+	replicaName = os.Getenv("POD_NAME")
+	if replicaName == "" {
+		replicaName, _ = os.Hostname()
+	}
+
+	logger.Info("Stats shared in Redis",
+		zap.String("addr", addr),
+		zap.Duration("interval", shareInterval),
+		zap.String("replica", replicaName),
+	)
+}
+
+// shareStats records counts tracked for tenant, to be added to the shared
+// counters on the next flush. It does nothing without Redis.
+func shareStats(tenant string, requests, totalJokes int64, lastUpdate time.Time) {
+	if sharedStats == nil {
+		return
+	}
+	pendingSharesMutex.Lock()
+	defer pendingSharesMutex.Unlock()
+
+	d, ok := pendingShares[tenant]
+	if !ok {
+		d = &statsDelta{}
+		pendingShares[tenant] = d
+	}
+	d.requests += requests
+	d.totalJokes += totalJokes
+	if lastUpdate.After(d.lastUpdate) {
+		d.lastUpdate = lastUpdate
+	}
+}
+
+// pendingShare returns what has been tracked for tenant and not shared
+// yet.
+func pendingShare(tenant string) statsDelta {
+	pendingSharesMutex.Lock()
+	defer pendingSharesMutex.Unlock()
+	if d, ok := pendingShares[tenant]; ok {
+		return *d
+	}
+	return statsDelta{}
+}
+
+// runStatsSharing flushes the pending counts every shareInterval until
+// ctx is done, and once more then.
+func runStatsSharing(ctx context.Context) {
+	if sharedStats == nil {
+		return
+	}
+	ticker := time.NewTicker(shareInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), shareInterval)
+			flushSharedStats(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			flushSharedStats(ctx)
+		}
+	}
+}
+
+// flushSharedStats adds the pending counts to the shared counters. Counts
+// that fail are put back for the next flush.
+func flushSharedStats(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushSharedStats")
+	defer span.End()
+
+	pendingSharesMutex.Lock()
+	pending := pendingShares
+	pendingShares = map[string]*statsDelta{}
+	pendingSharesMutex.Unlock()
+
+	for tenant, d := range pending {
+		err := addSharedStats.Run(ctx, sharedStats, []string{sharedStatsPrefix + tenant},
+			d.requests, d.totalJokes, d.lastUpdate.UnixMilli()).Err()
+		if err != nil {
+			loggerFor(ctx).Warn("Failed to share stats, retrying on the next flush",
+				zap.String("tenant", tenant),
+				zap.Error(err),
+			)
+			shareStats(tenant, d.requests, d.totalJokes, d.lastUpdate)
+		}
+	}
+
+	if err := sharedStats.ZAdd(ctx, sharedReplicasKey, redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: replicaName,
+	}).Err(); err != nil {
+		loggerFor(ctx).Warn("Failed to record replica in Redis", zap.Error(err))
+	}
+}
+
+// readSharedStats returns the tenant's counters across the replicas, with
+// what this replica hasn't shared yet, and how many replicas shared
+// counters recently.
+func readSharedStats(ctx context.Context, tenant string) (sharedCounters, error) {
+	ctx, span := tracer.Start(ctx, "readSharedStats")
+	defer span.End()
+
+	// Replicas that haven't flushed for three intervals are gone
+	active := strconv.FormatInt(time.Now().Add(-3*shareInterval).Unix(), 10)
+	pipe := sharedStats.Pipeline()
+	values := pipe.HGetAll(ctx, sharedStatsPrefix+tenant)
+	pipe.ZRemRangeByScore(ctx, sharedReplicasKey, "-inf", "("+active)
+	replicas := pipe.ZCard(ctx, sharedReplicasKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return sharedCounters{}, err
+	}
+
+	fields := values.Val()
+	counters := sharedCounters{replicas: replicas.Val()}
+	counters.requests, _ = strconv.ParseInt(fields["requests"], 10, 64)
+	counters.totalJokes, _ = strconv.ParseInt(fields["total_jokes"], 10, 64)
+	if ms, err := strconv.ParseInt(fields["last_update"], 10, 64); err == nil {
+		counters.lastUpdate = time.UnixMilli(ms)
+	}
+
+	own := pendingShare(tenant)
+	counters.requests += own.requests
+	counters.totalJokes += own.totalJokes
+	if own.lastUpdate.After(counters.lastUpdate) {
+		counters.lastUpdate = own.lastUpdate
+	}
+	return counters, nil
+}
+
+// resetSharedStats clears the shared counters of tenant, or of every
+// tenant when it is empty, with what this replica hasn't shared yet.
+func resetSharedStats(ctx context.Context, tenant string) {
+	if sharedStats == nil {
+		return
+	}
+
+	pendingSharesMutex.Lock()
+	if tenant == "" {
+		pendingShares = map[string]*statsDelta{}
+	} else {
+		delete(pendingShares, tenant)
+	}
+	pendingSharesMutex.Unlock()
+
+	keys := []string{sharedStatsPrefix + tenant}
+	if tenant == "" {
+		keys = nil
+		iter := sharedStats.Scan(ctx, 0, sharedStatsPrefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			loggerFor(ctx).Error("Failed to list shared stats", zap.Error(err))
+			return
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := sharedStats.Del(ctx, keys...).Err(); err != nil {
+		loggerFor(ctx).Error("Failed to reset shared stats",
+			zap.String("keys", strings.Join(keys, ",")),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Service level objectives are evaluated from the requests backends report:
+// every joke served or reaction recorded with its latency, and every
+// request that failed (request_failed events). An SLO covers one endpoint,
+// or all of them, and counts a request as good when it didn't fail and,
+// for latency SLOs, took at most its threshold: "99% of GET /api/v1/joke
+// requests under 200ms over 7 days" is
+//
+//	name=joke-latency,endpoint=GET /api/v1/joke,objective=99,latency=200ms,window=7d
+//
+// SLO_DEFINITIONS lists them separated by ";"; the default is the latency
+// SLO above and a 99.9% availability SLO for the same endpoint.
+//
+// Good and total counts are kept per minute for each SLO's window, across
+// tenants: SLOs describe the service, not a tenant's traffic. For each SLO
+// GET /api/v1/stats/slo reports the compliance over the window, the share
+// of the error budget (the failures the objective allows) remaining, and
+// the burn rate over the last 5m, 1h and 6h: how many times faster than
+// the objective allows the budget is being spent.
+
+// SLODefinition is a service level objective.
+type SLODefinition struct {
+	Name string `json:"name"`
+	// Endpoint is "METHOD /path" as backends report it; empty for all
+	Endpoint string `json:"endpoint,omitempty"`
+	// Objective is the fraction of requests that must be good
+	Objective float64 `json:"objective"`
+	// LatencyMs is the latency threshold of good requests; 0 for an
+	// availability SLO
+	LatencyMs float64       `json:"latency_threshold_ms,omitempty"`
+	Window    time.Duration `json:"-"`
+}
+
+// RequestFailure is a request a backend failed to serve, reported so
+// availability SLOs can count it.
+type RequestFailure struct {
+	LatencySample
+	Status int `json:"status"`
+}
+
+// sliCounts are the requests an SLO counted in a minute.
+type sliCounts struct {
+	good, total int64
+}
+
+// SLOStatus is the evaluation of an SLO.
+type SLOStatus struct {
+	SLODefinition
+	Window     string  `json:"window"`
+	Good       int64   `json:"good"`
+	Total      int64   `json:"total"`
+	Compliance float64 `json:"compliance"`
+	// ErrorBudgetRemaining is the share of the budget left; negative once
+	// the objective is missed
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+	// BurnRates are by window, "5m", "1h" and "6h"
+	BurnRates map[string]float64 `json:"burn_rates"`
+	// Status is "ok", "fast_burn" (the last hour's burn rate is at least
+	// fastBurnRate) or "exhausted"
+	Status string `json:"status"`
+}
+
+const (
+	sloStatusOK        = "ok"
+	sloStatusFastBurn  = "fast_burn"
+	sloStatusExhausted = "exhausted"
+
+	// fastBurnRate spends 2% of a 30-day budget in an hour
+	fastBurnRate = 14.4
+)
+
+// burnRateWindows are the windows burn rates are reported over
+var burnRateWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+var (
+	sloDefinitions []SLODefinition
+	// sliBuckets holds each SLO's counts by minute, in the order of
+	// sloDefinitions
+	sliBuckets []map[int64]*sliCounts
+	sloMutex   sync.RWMutex
+)
+
+const defaultSLODefinitions = "name=joke-latency,endpoint=GET /api/v1/joke,objective=99,latency=200ms,window=7d;" +
+	"name=joke-availability,endpoint=GET /api/v1/joke,objective=99.9,window=7d"
+
+func initSLOs() {
+	spec := os.Getenv("SLO_DEFINITIONS")
+	if spec == "" {
+		spec = defaultSLODefinitions
+	}
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		slo, err := parseSLODefinition(entry)
+		if err != nil {
+			logger.Fatal("Invalid SLO_DEFINITIONS", zap.String("entry", entry), zap.Error(err))
+		}
+		sloDefinitions = append(sloDefinitions, slo)
+		sliBuckets = append(sliBuckets, map[int64]*sliCounts{})
+	}
+
+	for _, slo := range sloDefinitions {
+		logger.Info("SLO defined",
+			zap.String("name", slo.Name),
+			zap.String("endpoint", slo.Endpoint),
+			zap.Float64("objective", slo.Objective),
+			zap.Float64("latency_threshold_ms", slo.LatencyMs),
+			zap.Duration("window", slo.Window),
+		)
+	}
+}
+
+// parseSLODefinition reads one comma-separated list of key=value fields.
+func parseSLODefinition(entry string) (SLODefinition, error) {
+	slo := SLODefinition{Window: 30 * 24 * time.Hour}
+	for _, field := range strings.Split(entry, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return slo, fmt.Errorf("%q is not key=value", field)
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "name":
+			slo.Name = value
+		case "endpoint":
+			slo.Endpoint = value
+		case "objective":
+			percent, err := strconv.ParseFloat(value, 64)
+			if err != nil || percent <= 0 || percent >= 100 {
+				return slo, fmt.Errorf("objective must be a percentage between 0 and 100, exclusive")
+			}
+			slo.Objective = roundTo(percent/100, 8)
+		case "latency":
+			threshold, err := time.ParseDuration(value)
+			if err != nil || threshold <= 0 {
+				return slo, fmt.Errorf("latency must be a positive duration")
+			}
+			slo.LatencyMs = float64(threshold.Microseconds()) / 1000
+		case "window":
+			window, err := parseSLOWindow(value)
+			if err != nil {
+				return slo, err
+			}
+			slo.Window = window
+		default:
+			return slo, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	switch {
+	case slo.Name == "":
+		return slo, fmt.Errorf("name is required")
+	case slo.Objective == 0:
+		return slo, fmt.Errorf("objective is required")
+	}
+	return slo, nil
+}
+
+// parseSLOWindow reads a duration, also taking whole days ("7d").
+func parseSLOWindow(value string) (time.Duration, error) {
+	var window time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("window must be a duration or a number of days")
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("window must be a duration or a number of days")
+		}
+	}
+	if window < time.Hour {
+		return 0, fmt.Errorf("window must be at least 1h")
+	}
+	return window, nil
+}
+
+// formatSLOWindow formats a window the way it is usually written.
+func formatSLOWindow(window time.Duration) string {
+	if window%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(window/(24*time.Hour))) + "d"
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(window.String(), "0s"), "0m")
+}
+
+// good reports whether a request counts towards the objective.
+func (slo SLODefinition) good(sample LatencySample, failed bool) bool {
+	return !failed && (slo.LatencyMs == 0 || sample.LatencyMs <= slo.LatencyMs)
+}
+
+// recordSLI counts a request at t in every SLO covering its endpoint.
+// Requests without an endpoint are ignored.
+func recordSLI(sample LatencySample, failed bool, t time.Time) {
+	if sample.Endpoint == "" {
+		return
+	}
+	minute := t.Truncate(time.Minute).Unix()
+
+	sloMutex.Lock()
+	defer sloMutex.Unlock()
+
+	for i, slo := range sloDefinitions {
+		if slo.Endpoint != "" && slo.Endpoint != sample.Endpoint {
+			continue
+		}
+		counts, ok := sliBuckets[i][minute]
+		if !ok {
+			counts = &sliCounts{}
+			sliBuckets[i][minute] = counts
+		}
+		counts.total++
+		if slo.good(sample, failed) {
+			counts.good++
+		}
+	}
+}
+
+// trackFailure records a validated request_failed event received at at.
+func trackFailure(ctx context.Context, failure RequestFailure, at time.Time) {
+	recordSLI(failure.LatencySample, true, at)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("request.endpoint", failure.Endpoint),
+		attribute.Int("request.status", failure.Status),
+	)
+	loggerFor(ctx).Info("Request failure tracked",
+		zap.String("endpoint", failure.Endpoint),
+		zap.Int("status", failure.Status),
+	)
+}
+
+// pruneSLIs drops the minutes that have left their SLO's window and
+// returns how many were dropped.
+func pruneSLIs(now time.Time) int {
+	sloMutex.Lock()
+	defer sloMutex.Unlock()
+
+	pruned := 0
+	for i, slo := range sloDefinitions {
+		cutoff := now.Add(-slo.Window).Truncate(time.Minute).Unix()
+		for minute := range sliBuckets[i] {
+			if minute < cutoff {
+				delete(sliBuckets[i], minute)
+				pruned++
+			}
+		}
+	}
+	return pruned
+}
+
+// resetSLIs discards the counts of every SLO.
+func resetSLIs() {
+	sloMutex.Lock()
+	for i := range sliBuckets {
+		sliBuckets[i] = map[int64]*sliCounts{}
+	}
+	sloMutex.Unlock()
+}
+
+// evaluateSLOs evaluates the SLOs at now; name picks one, empty for all.
+func evaluateSLOs(name string, now time.Time) []SLOStatus {
+	sloMutex.RLock()
+	defer sloMutex.RUnlock()
+
+	statuses := []SLOStatus{}
+	current := now.Truncate(time.Minute).Unix()
+	for i, slo := range sloDefinitions {
+		if name != "" && slo.Name != name {
+			continue
+		}
+
+		// Good and total counts since the start of each burn rate window
+		// and of the SLO window
+		var good, total int64
+		recentGood := make([]int64, len(burnRateWindows))
+		recentTotal := make([]int64, len(burnRateWindows))
+		since := current - int64(slo.Window/time.Second) + 60
+		for minute, counts := range sliBuckets[i] {
+			if minute < since {
+				continue
+			}
+			good += counts.good
+			total += counts.total
+			for j, w := range burnRateWindows {
+				if minute >= current-int64(w.window/time.Second)+60 {
+					recentGood[j] += counts.good
+					recentTotal[j] += counts.total
+				}
+			}
+		}
+
+		budget := 1 - slo.Objective
+		status := SLOStatus{
+			SLODefinition:        slo,
+			Window:               formatSLOWindow(slo.Window),
+			Good:                 good,
+			Total:                total,
+			Compliance:           1,
+			ErrorBudgetRemaining: 1,
+			BurnRates:            map[string]float64{},
+			Status:               sloStatusOK,
+		}
+		if total > 0 {
+			badRatio := float64(total-good) / float64(total)
+			status.Compliance = 1 - badRatio
+			status.ErrorBudgetRemaining = 1 - badRatio/budget
+		}
+		for j, w := range burnRateWindows {
+			rate := 0.0
+			if recentTotal[j] > 0 {
+				rate = float64(recentTotal[j]-recentGood[j]) / float64(recentTotal[j]) / budget
+			}
+			status.BurnRates[w.name] = roundTo(rate, 4)
+		}
+		status.Compliance = roundTo(status.Compliance, 6)
+		status.ErrorBudgetRemaining = roundTo(status.ErrorBudgetRemaining, 4)
+
+		switch {
+		case status.ErrorBudgetRemaining <= 0:
+			status.Status = sloStatusExhausted
+		case status.BurnRates["1h"] >= fastBurnRate:
+			status.Status = sloStatusFastBurn
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func roundTo(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
+
+// sloHandler serves GET /api/v1/stats/slo, optionally for one ?name.
+func sloHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	_, span := tracer.Start(ctx, "getSLOs")
+	defer span.End()
+
+	name := c.Query("name")
+	statuses := evaluateSLOs(name, time.Now())
+	if name != "" && len(statuses) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SLO not found"})
+		return
+	}
+
+	breached := 0
+	for _, status := range statuses {
+		if status.Status != sloStatusOK {
+			breached++
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("slo.count", len(statuses)),
+		attribute.Int("slo.not_ok", breached),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"slos":  statuses,
+		"count": len(statuses),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Jokes are ranked by momentum: how much more often they were served in
+// the window than in the window before it. Servings are counted per joke
+// in five-minute buckets, so windows are whole buckets ending with the
+// current one; buckets older than two of the longest window are dropped by
+// compaction (see retention.go).
+//
+//	momentum = (served - previous) / (previous + trendingSmoothing)
+//
+// The smoothing keeps a joke going from 0 to 2 servings from outranking one
+// going from 50 to 200.
+
+// trendingWindows are the windows jokes can be ranked over
+var trendingWindows = map[string]time.Duration{
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+}
+
+const (
+	trendingBucket        = 5 * time.Minute
+	defaultTrendingWindow = "1h"
+	maxTrendingWindow     = 6 * time.Hour
+	trendingSmoothing     = 5
+
+	// minTrendingServed is the servings in the window a joke needs to rank
+	minTrendingServed = 3
+
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 50
+
+	// maxTrendingJokes bounds the jokes tracked per tenant; servings of
+	// further jokes are not ranked until compaction frees room
+	maxTrendingJokes = 10000
+)
+
+// TrendingJoke is a joke ranked by momentum.
+type TrendingJoke struct {
+	Rank     int     `json:"rank"`
+	JokeID   string  `json:"joke_id"`
+	Served   int64   `json:"served"`
+	Previous int64   `json:"previous"`
+	Momentum float64 `json:"momentum"`
+}
+
+// bucketOf is the start of the trending bucket holding unix time t.
+func bucketOf(t int64) int64 {
+	size := int64(trendingBucket / time.Second)
+	return t - t%size
+}
+
+// recordServing counts a serving of jokeID at t, and for the day of t
+// (see report.go). Callers must hold statsMutex for writing.
+func (s *Stats) recordServing(jokeID string, t time.Time) {
+	s.recordDailyServing(jokeID, t)
+
+	buckets, ok := s.jokes[jokeID]
+	if !ok {
+		if len(s.jokes) >= maxTrendingJokes {
+			return
+		}
+		buckets = map[int64]int64{}
+		s.jokes[jokeID] = buckets
+	}
+	buckets[bucketOf(t.Unix())]++
+}
+
+// pruneServings drops servings before cutoff, and jokes left without any.
+// It returns the number of buckets dropped. Callers must hold statsMutex
+// for writing.
+func (s *Stats) pruneServings(cutoff int64) int {
+	pruned := 0
+	for jokeID, buckets := range s.jokes {
+		for bucket := range buckets {
+			if bucket < cutoff {
+				delete(buckets, bucket)
+				pruned++
+			}
+		}
+		if len(buckets) == 0 {
+			delete(s.jokes, jokeID)
+		}
+	}
+	return pruned
+}
+
+// trending ranks the tenant's jokes served at least minTrendingServed
+// times in window by momentum, leaving out those not rising.
+func trending(tenant string, window time.Duration, limit int, now time.Time) []TrendingJoke {
+	// The window's buckets, the current one last, and the window before
+	size := int64(window / time.Second)
+	since := bucketOf(now.Unix()) - size + int64(trendingBucket/time.Second)
+	previousSince := since - size
+
+	statsMutex.RLock()
+	ranked := []TrendingJoke{}
+	if s, ok := stats[tenant]; ok {
+		for jokeID, buckets := range s.jokes {
+			entry := TrendingJoke{JokeID: jokeID}
+			for bucket, count := range buckets {
+				switch {
+				case bucket >= since:
+					entry.Served += count
+				case bucket >= previousSince:
+					entry.Previous += count
+				}
+			}
+			if entry.Served < minTrendingServed || entry.Served <= entry.Previous {
+				continue
+			}
+			entry.Momentum = float64(entry.Served-entry.Previous) / float64(entry.Previous+trendingSmoothing)
+			ranked = append(ranked, entry)
+		}
+	}
+	statsMutex.RUnlock()
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Momentum != ranked[j].Momentum {
+			return ranked[i].Momentum > ranked[j].Momentum
+		}
+		if ranked[i].Served != ranked[j].Served {
+			return ranked[i].Served > ranked[j].Served
+		}
+		return ranked[i].JokeID < ranked[j].JokeID
+	})
+
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+	}
+	return ranked
+}
+
+// trendingHandler serves GET /api/v1/stats/trending?window=1h&limit=10.
+func trendingHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getTrending")
+	defer span.End()
+
+	windowName := c.DefaultQuery("window", defaultTrendingWindow)
+	window, ok := trendingWindows[windowName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be one of 15m, 1h or 6h"})
+		return
+	}
+
+	limit := defaultTrendingLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxTrendingLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxTrendingLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	ranked := trending(telemetry.TenantFromContext(ctx), window, limit, time.Now())
+
+	span.SetAttributes(
+		attribute.String("trending.window", windowName),
+		attribute.Int("trending.count", len(ranked)),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"window":   windowName,
+		"trending": ranked,
+		"count":    len(ranked),
+	})
+}
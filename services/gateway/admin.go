@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.uber.org/zap"
+)
+
+// The gateway's own state can be inspected under /admin/gateway for
+// on-call debugging: the route table, each backend's replicas, in-flight
+// limit and connection pool, the quota counters and the effective
+// configuration. Like the proxied admin routes these are only served on
+// the admin host, and only to operators: callers carrying
+// GATEWAY_ADMIN_TOKEN in X-Admin-Token, or signed in as one of the user IDs
+// in ADMIN_USERS. The Host header is chosen by the client, so it only
+// routes; with neither setting configured every admin request is refused.
+//
+// Everything is per replica, except the quota counters when they are kept
+// in Redis. The gateway has no circuit breakers to inspect or reset: an
+// overloaded backend sheds requests at its in-flight limit (see
+// limiter.go). Cached responses are purged by the backend's writes (see
+// cache.go).
+
+const adminTokenHeader = "X-Admin-Token"
+
+// adminCallerKey marks operators, which get the admin scope (see scopes.go)
+const adminCallerKey = "admin_caller"
+
+const (
+	defaultAdminQuotaClients = 100
+	maxAdminQuotaClients     = 1000
+)
+
+// redactedConfigKeys mark settings whose values are secrets or hold them
+var redactedConfigKeys = []string{"SECRET", "PASSWORD", "TOKEN", "KEY"}
+
+// adminConfigKeys are the settings the effective config lists, besides
+// the backend and host addresses
+var adminConfigKeys = []string{
+	"ADMIN_USERS", "ANONYMOUS_SCOPES", "API_KEY_QUOTAS", "API_KEY_SCOPES", "API_KEY_TENANTS", "AUTH_JWT_SECRET",
+	"BACKEND_DIAL_TIMEOUT", "BACKEND_HTTP2", "BACKEND_IDLE_CONN_TIMEOUT",
+	"BACKEND_IN_FLIGHT_LIMITS", "BACKEND_MAX_CONNS_PER_HOST", "BACKEND_MAX_IDLE_CONNS_PER_HOST",
+	"BACKEND_MAX_IN_FLIGHT", "BACKEND_QUEUE_TIMEOUT", "BACKEND_TIMEOUT",
+	"BOT_ACTION", "BOT_DETECTION", "BOT_RATE_THRESHOLD", "BOT_SCORER_TIMEOUT", "BOT_SCORER_URL",
+	"BOT_SCORE_THRESHOLD", "BOT_THROTTLE_RATE",
+	"CLIENT_APP_IDS", "CLUSTER_DOMAIN", "COALESCE_REQUESTS", "CONFIG_FILE", "CONFIG_RELOAD_INTERVAL",
+	"CORS_ALLOWED_ORIGINS", "CORS_MAX_AGE",
+	"DEPRECATION_RETENTION", "DISCOVERY_REFRESH_INTERVAL", "GATEWAY_ADMIN_TOKEN",
+	"GEOIP_COUNTRY_HEADER", "GEOIP_DB_FILE", "GEOIP_PROVIDER", "GEOIP_REGION_HEADER", "HSTS_MAX_AGE", "INTERNAL_AUTH_SECRET",
+	"INVALIDATION_CHANNEL",
+	"LOG_LEVEL", "LONGPOLL_INTERVAL", "LONGPOLL_MAX_WAIT", "LONGPOLL_MAX_WAITERS", "LONGPOLL_TRENDING_LIMIT",
+	"MAX_REQUEST_BODY_BYTES",
+	"MIRROR_BACKEND", "MIRROR_MAX_IN_FLIGHT", "MIRROR_METHODS", "MIRROR_PERCENT", "MIRROR_TIMEOUT", "MIRROR_URL",
+	"OIDC_CLIENT_ID", "OIDC_CLIENT_SECRET", "OIDC_ISSUER_URL", "OIDC_REDIRECT_URL",
+	"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORT_QUEUE_SIZE", "OTEL_TRACES_SAMPLER", "OTEL_TRACES_SAMPLER_ARG",
+	"PARTNER_SECRETS_DIR", "PARTNER_SECRETS_RELOAD_INTERVAL", "PARTNER_SIGNATURE_MAX_SKEW",
+	"PORT", "QUOTA_DAILY_REQUESTS", "QUOTA_MONTHLY_REQUESTS", "REDIS_ADDR", "REDIS_PASSWORD",
+	"RESPONSE_CACHE", "RESPONSE_CACHE_MAX_ENTRIES", "RESPONSE_CACHE_TTL", "ROUTE_STATUS_INTERVAL",
+	"SERVICE_DISCOVERY", "SESSION_COOKIE_INSECURE", "SESSION_SECRET", "SESSION_TTL",
+	"STARTUP_CHECK", "STARTUP_PROBE_BACKENDS", "STARTUP_PROBE_TIMEOUT", "STARTUP_REQUIRED_SECRETS", "STATUS_CACHE_TTL",
+	"STREAM_CONTENT_TYPES", "STREAM_THRESHOLD_BYTES", "STREAM_WRITE_TIMEOUT",
+	"TLS_AUTOCERT_CACHE_DIR", "TLS_AUTOCERT_DOMAINS", "TLS_AUTOCERT_EMAIL", "TLS_CERT_FILE", "TLS_KEY_FILE",
+	"TLS_REDIRECT_PORT", "TRACE_ROUTE_SAMPLING", "TRACE_SLOW_THRESHOLD", "VISITOR_HASH_KEY",
+}
+
+var (
+	adminToken []byte
+	// adminUsers are the signed-in users allowed to call admin routes
+	adminUsers map[string]bool
+)
+
+// AdminRoute is a route table entry as listed to operators.
+type AdminRoute struct {
+	Method      string   `json:"method"`
+	Path        string   `json:"path"`
+	Backend     string   `json:"backend"`
+	Target      string   `json:"target"`
+	Match       string   `json:"match,omitempty"`
+	RequireUser bool     `json:"require_user"`
+	Admin       bool     `json:"admin"`
+	Scope       string   `json:"scope,omitempty"`
+	Internal    bool     `json:"internal"`
+	Coalesce    bool     `json:"coalesce"`
+	Cache       bool     `json:"cache"`
+	Transforms  []string `json:"transforms,omitempty"`
+}
+
+// AdminBackend is a backend's replicas, in-flight limit and connection
+// pool on this replica.
+type AdminBackend struct {
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	Endpoints []string `json:"endpoints"`
+	Sticky    bool     `json:"sticky"`
+	// InFlightLimit is 0 for an unlimited backend
+	InFlightLimit int   `json:"in_flight_limit"`
+	InFlight      int   `json:"in_flight"`
+	Waiting       int64 `json:"waiting"`
+	// Connections open, and taken by requests since startup
+	OpenConnections     int64 `json:"open_connections"`
+	AcquiredConnections int64 `json:"acquired_connections"`
+	ReusedConnections   int64 `json:"reused_connections"`
+}
+
+// ConfigValue is a setting's effective value and where it comes from:
+// "runtime" (CONFIG_FILE), "env" or "unset", in which case the default
+// applies.
+type ConfigValue struct {
+	Value  string `json:"value,omitempty"`
+	Source string `json:"source"`
+}
+
+// initAdmin reads GATEWAY_ADMIN_TOKEN and ADMIN_USERS ("id,id,...").
+func initAdmin() {
+	adminToken = []byte(os.Getenv("GATEWAY_ADMIN_TOKEN"))
+	adminUsers = map[string]bool{}
+	for _, id := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adminUsers[id] = true
+		}
+	}
+	if len(adminToken) == 0 && len(adminUsers) == 0 {
+		logger.Warn("Neither GATEWAY_ADMIN_TOKEN nor ADMIN_USERS is set, admin routes will refuse every request")
+	}
+}
+
+// adminMiddleware serves the admin group on the admin host only, to
+// operators.
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !(Match{Host: "admin"}).matches(c) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		if requireAdmin(c); c.IsAborted() {
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin rejects callers that neither carry the admin token nor are
+// signed in as an admin user: with 401 when they sent no credentials, else
+// with 403.
+func requireAdmin(c *gin.Context) {
+	token := c.GetHeader(adminTokenHeader)
+	if len(adminToken) > 0 && subtle.ConstantTimeCompare([]byte(token), adminToken) == 1 {
+		c.Set(adminCallerKey, true)
+		return
+	}
+	user := c.GetString(userIDKey)
+	if user != "" && adminUsers[user] {
+		c.Set(adminCallerKey, true)
+		return
+	}
+
+	loggerFor(c.Request.Context()).Warn("Admin request rejected",
+		zap.String("path", c.Request.URL.Path),
+		zap.String("user_id", user),
+		zap.String("client_ip", c.ClientIP()),
+	)
+	if token == "" && user == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin credentials required"})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not allowed to use admin routes"})
+}
+
+// adminRoutes lists the route table in order.
+func adminRoutes() []AdminRoute {
+	listed := make([]AdminRoute, 0, len(routes))
+	for _, route := range routes {
+		target := route.Target
+		if target == "" {
+			target = route.Path
+		}
+		listed = append(listed, AdminRoute{
+			Method:      route.Method,
+			Path:        route.Path,
+			Backend:     route.Backend,
+			Target:      target,
+			Match:       route.Match.describe(),
+			RequireUser: route.RequireUser,
+			Admin:       route.Admin,
+			Scope:       route.Scope,
+			Internal:    route.Internal,
+			Coalesce:    route.Coalesce,
+			Cache:       route.Cache,
+			Transforms:  route.Transforms,
+		})
+	}
+	return listed
+}
+
+// adminBackends describes every backend, by name.
+func adminBackends() []AdminBackend {
+	listed := make([]AdminBackend, 0, len(backends))
+	for name, b := range backends {
+		backend := AdminBackend{
+			Name:      name,
+			Address:   backendURL(name),
+			Endpoints: backendEndpoints(name),
+			Sticky:    b.Sticky,
+		}
+		if backend.Endpoints == nil {
+			backend.Endpoints = []string{}
+		}
+		if l, ok := backendLimiters[name]; ok {
+			backend.InFlightLimit = cap(l.slots)
+			backend.InFlight = len(l.slots)
+			backend.Waiting = l.waiting.Load()
+		}
+		if pool, ok := backendPools[name]; ok {
+			backend.OpenConnections = pool.open.Load()
+			backend.AcquiredConnections = pool.acquired.Load()
+			backend.ReusedConnections = pool.reused.Load()
+		}
+		listed = append(listed, backend)
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Name < listed[j].Name })
+	return listed
+}
+
+// effectiveConfig returns every listed setting, with secrets redacted.
+func effectiveConfig() map[string]ConfigValue {
+	keys := append([]string{}, adminConfigKeys...)
+	for _, b := range backends {
+		keys = append(keys, b.EnvVar)
+	}
+	for _, h := range hosts {
+		keys = append(keys, h.EnvVar)
+	}
+
+	config := make(map[string]ConfigValue, len(keys))
+	for _, key := range keys {
+		value := ConfigValue{Source: "unset"}
+		if v, ok := telemetry.RuntimeOverride(key); ok {
+			value = ConfigValue{Value: v, Source: "runtime"}
+		} else if v, ok := os.LookupEnv(key); ok {
+			value = ConfigValue{Value: v, Source: "env"}
+		}
+		if value.Value != "" && redactedConfigKey(key) {
+			value.Value = "[redacted]"
+		}
+		config[key] = value
+	}
+	return config
+}
+
+func redactedConfigKey(key string) bool {
+	for _, marker := range redactedConfigKeys {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerAdminRoutes installs the gateway admin endpoints.
+func registerAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin/gateway", adminMiddleware())
+
+	admin.GET("/routes", func(c *gin.Context) {
+		listed := adminRoutes()
+		c.JSON(http.StatusOK, gin.H{"routes": listed, "count": len(listed)})
+	})
+
+	admin.GET("/backends", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"backends":      adminBackends(),
+			"discovery":     discoveryMode,
+			"queue_timeout": queueTimeout.String(),
+			"pool": gin.H{
+				"timeout":                 poolSettings.timeout.String(),
+				"dial_timeout":            poolSettings.dialTimeout.String(),
+				"max_idle_conns_per_host": poolSettings.maxIdleConnsPerHost,
+				"max_conns_per_host":      poolSettings.maxConnsPerHost,
+				"idle_conn_timeout":       poolSettings.idleConnTimeout.String(),
+				"http2":                   poolSettings.http2,
+			},
+		})
+	})
+
+	admin.GET("/quotas", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		limit := defaultAdminQuotaClients
+		if v := c.Query("limit"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 1 || parsed > maxAdminQuotaClients {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "limit must be an integer between 1 and " + strconv.Itoa(maxAdminQuotaClients),
+				})
+				return
+			}
+			limit = parsed
+		}
+
+		usage, err := quotas.Clients(ctx, time.Now().UTC(), limit)
+		if err != nil {
+			loggerFor(ctx).Error("Failed to read quota counters", zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Quota counters are unavailable"})
+			return
+		}
+		sort.Slice(usage, func(i, j int) bool { return usage[i].Daily > usage[j].Daily })
+
+		_, shared := quotas.(*redisQuotaStore)
+		c.JSON(http.StatusOK, gin.H{
+			"clients": usage,
+			"count":   len(usage),
+			"shared":  shared,
+			"default": gin.H{"daily": defaultQuota.Daily, "monthly": defaultQuota.Monthly},
+			// Per-key quotas are keyed by raw API keys, so only their number
+			// is listed
+			"key_overrides": len(keyQuotas),
+		})
+	})
+
+	admin.GET("/config", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"config":             effectiveConfig(),
+			"log_level":          telemetry.LogLevel.String(),
+			"coalescing":         coalescingEnabled,
+			"mirror_percent":     math.Float64frombits(mirrorPercent.Load()),
+			"backend_timeout":    backendTimeout.String(),
+			"max_request_body":   maxRequestBodyBytes,
+			"stream_threshold":   streamThreshold,
+			"oidc_enabled":       oidcEnabled,
+			"magic_link_login":   len(magicLinkSessions.Secret) > 0,
+			"internal_auth_sign": len(internalAuth.Secret) > 0,
+		})
+	})
+}
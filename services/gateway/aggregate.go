@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/client"
+	"go.uber.org/zap"
+)
+
+// aggregateTimeout bounds each backend call made by aggregate endpoints
+const aggregateTimeout = 3 * time.Second
+
+// Typed backend clients used by the aggregate and GraphQL endpoints
+var (
+	jokesClient     *client.JokesClient
+	userClient      *client.UserClient
+	analyticsClient *client.AnalyticsClient
+)
+
+func initClients() {
+	// The host in each base URL is replaced by a replica of the backend
+	opts := func(backend string) []client.Option {
+		return []client.Option{
+			client.WithHTTPClient(&http.Client{
+				Transport: balancedTransport{backend: backend, base: backendTransport(backend)},
+			}),
+			client.WithTimeout(aggregateTimeout),
+			client.WithRetries(1),
+			client.WithUserAgent("api-gateway"),
+		}
+	}
+	jokesClient = client.NewJokesClient("http://jokes", opts("jokes")...)
+	userClient = client.NewUserClient("http://user", opts("user")...)
+	analyticsClient = client.NewAnalyticsClient("http://analytics", opts("analytics")...)
+}
+
+// homeHandler serves GET /api/v1/home: a random joke, the caller's favorite
+// count and headline stats fetched concurrently. Sections that fail, or
+// that the caller's API key lacks the scope for, are returned as null and
+// the reason is listed under "errors".
+func homeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID := c.GetString(userIDKey)
+	if userID == "" {
+		userID = c.Query("user_id")
+	}
+
+	type section struct {
+		name  string
+		scope string
+		fetch func() (interface{}, error)
+	}
+
+	sections := []section{
+		{"joke", scopeJokesRead, func() (interface{}, error) {
+			return jokesClient.RandomJoke(ctx, client.JokeOptions{UserID: userID})
+		}},
+		{"stats", scopeStatsRead, func() (interface{}, error) {
+			stats, err := analyticsClient.Stats(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{
+				"total_jokes":    stats.TotalJokes,
+				"total_requests": stats.TotalRequests,
+			}, nil
+		}},
+	}
+	if userID != "" {
+		sections = append(sections, section{"favorites", scopeFavoritesRead, func() (interface{}, error) {
+			// The stats endpoint counts without listing every favorite
+			stats, err := userClient.FavoriteStats(ctx, userID, 1)
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{"count": stats.Count}, nil
+		}})
+	}
+
+	response := gin.H{"joke": nil, "favorites": nil, "stats": nil}
+	errs := gin.H{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, s := range sections {
+		// Sections the caller can't read are left out
+		if !hasScope(c, s.scope) {
+			errs[s.name] = missingScopeMessage(s.scope)
+			continue
+		}
+		wg.Add(1)
+		go func(s section) {
+			defer wg.Done()
+			result, err := s.fetch()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[s.name] = err.Error()
+				loggerFor(ctx).Warn("Home section unavailable",
+					zap.String("section", s.name),
+					zap.Error(err),
+				)
+				return
+			}
+			response[s.name] = result
+		}(s)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		response["errors"] = errs
+	}
+	response["timestamp"] = time.Now().Format(time.RFC3339)
+
+	c.JSON(http.StatusOK, response)
+}
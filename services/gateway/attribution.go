@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// clientAppHeader lets API consumers identify their application
+const clientAppHeader = "X-Client-App-ID"
+
+// Baggage members describing the client besides its app
+// (telemetry.ClientAppBaggageKey), read by the jokes service when it
+// reports tracking events to analytics
+const (
+	clientUAFamilyBaggageKey = "client.ua_family"
+	gatewayRouteBaggageKey   = "gateway.route"
+	clientVisitorBaggageKey  = "client.visitor"
+)
+
+// visitorHashKey keys the visitor hash, so the IPs behind visitor IDs
+// can't be recovered by hashing every address
+var visitorHashKey []byte
+
+func initVisitorHashing() {
+	visitorHashKey = []byte(os.Getenv("VISITOR_HASH_KEY"))
+	if len(visitorHashKey) == 0 {
+		visitorHashKey = make([]byte, 32)
+		if _, err := rand.Read(visitorHashKey); err != nil {
+			logger.Fatal("Failed to generate visitor hash key", zap.Error(err))
+		}
+		logger.Warn("VISITOR_HASH_KEY not set, using a random key; gateway replicas will count the same visitor separately")
+	}
+}
+
+// visitorID identifies a client for unique visitor counts without
+// revealing its IP: the hex HMAC-SHA256 of the IP, truncated to 128 bits.
+func visitorID(clientIP string) string {
+	mac := hmac.New(sha256.New, visitorHashKey)
+	mac.Write([]byte(clientIP))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+var validClientApp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// knownClientApps, when CLIENT_APP_IDS lists any, are the only app IDs
+// forwarded; others become "other". Services tag their metrics with the
+// app, so the list bounds how many series a client can create.
+var knownClientApps map[string]bool
+
+func initClientApps() {
+	for _, app := range strings.Split(os.Getenv("CLIENT_APP_IDS"), ",") {
+		app = strings.TrimSpace(app)
+		if !validClientApp.MatchString(app) {
+			continue
+		}
+		if knownClientApps == nil {
+			knownClientApps = map[string]bool{}
+		}
+		knownClientApps[app] = true
+	}
+}
+
+// uaFamilies maps User-Agent substrings to a family name. Order matters:
+// Edge and Chrome both claim to be Safari, and Edge claims to be Chrome.
+var uaFamilies = []struct {
+	match  string
+	family string
+}{
+	{"bot", "bot"},
+	{"spider", "bot"},
+	{"curl/", "curl"},
+	{"wget/", "wget"},
+	{"postmanruntime/", "postman"},
+	{"python-requests/", "python-requests"},
+	{"go-http-client/", "go-http-client"},
+	{"okhttp/", "okhttp"},
+	{"edg/", "edge"},
+	{"firefox/", "firefox"},
+	{"chrome/", "chrome"},
+	{"safari/", "safari"},
+}
+
+// userAgentFamily reduces a User-Agent to a low-cardinality family name.
+func userAgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return "unknown"
+	}
+	ua := strings.ToLower(userAgent)
+	for _, f := range uaFamilies {
+		if strings.Contains(ua, f.match) {
+			return f.family
+		}
+	}
+	return "other"
+}
+
+// clientAttributionMiddleware records which app, user agent family and
+// gateway route a request came through, and the visitor it came from and
+// where (see geo.go), as baggage so the attributes reach the backends
+// along with the tenant.
+func clientAttributionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app := c.GetHeader(clientAppHeader)
+		switch {
+		case !validClientApp.MatchString(app):
+			app = "unknown"
+		case knownClientApps != nil && !knownClientApps[app]:
+			app = "other"
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		family := userAgentFamily(c.Request.UserAgent())
+
+		ctx := withBaggageMembers(c.Request.Context(), map[string]string{
+			telemetry.ClientAppBaggageKey: app,
+			clientUAFamilyBaggageKey:      family,
+			gatewayRouteBaggageKey:        route,
+			clientVisitorBaggageKey:       visitorID(c.ClientIP()),
+		})
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String(telemetry.ClientAppBaggageKey, app),
+			attribute.String(clientUAFamilyBaggageKey, family),
+		)
+		ctx = withClientLocation(ctx, c)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// withBaggageMembers returns a copy of ctx whose baggage carries members,
+// replacing any the client sent under the same keys.
+func withBaggageMembers(ctx context.Context, members map[string]string) context.Context {
+	b := baggage.FromContext(ctx)
+	for key, value := range members {
+		member, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			continue
+		}
+		if updated, err := b.SetMember(member); err == nil {
+			b = updated
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
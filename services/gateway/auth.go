@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "jokes_session"
+	stateCookie   = "jokes_oauth_state"
+
+	// userIDKey is the gin context key holding the authenticated user ID
+	userIDKey = "user_id"
+	// userIDHeader carries the authenticated user ID to backends
+	userIDHeader = "X-User-ID"
+)
+
+// Session is the payload of the signed session cookie.
+type Session struct {
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var (
+	oidcEnabled       bool
+	oidcConfig        oauth2.Config
+	oidcVerifier      *oidc.IDTokenVerifier
+	sessionSecret     []byte
+	sessionTTL        time.Duration
+	secureCookies     bool
+	errBadSession     = errors.New("invalid session")
+	errSessionExpired = errors.New("session expired")
+
+	// magicLinkSessions verifies the session tokens the user service
+	// issues for magic-link sign-ins; set with AUTH_JWT_SECRET
+	magicLinkSessions middleware.SessionTokens
+)
+
+// initAuth configures the OIDC provider and magic-link sessions from the
+// environment. OIDC login is disabled when OIDC_ISSUER_URL is not set,
+// magic-link sessions when AUTH_JWT_SECRET is not.
+func initAuth(ctx context.Context) {
+	if secret := os.Getenv("AUTH_JWT_SECRET"); secret != "" {
+		magicLinkSessions = middleware.SessionTokens{Secret: []byte(secret)}
+		logger.Info("Magic-link sessions enabled")
+	}
+
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		logger.Info("OIDC login disabled, OIDC_ISSUER_URL not set")
+		return
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		logger.Fatal("Failed to discover OIDC provider", zap.String("issuer", issuer), zap.Error(err))
+	}
+
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	oidcConfig = oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: clientID})
+
+	sessionSecret = []byte(os.Getenv("SESSION_SECRET"))
+	if len(sessionSecret) == 0 {
+		logger.Warn("SESSION_SECRET not set, generating a random one; sessions will not survive restarts or span replicas")
+		sessionSecret = make([]byte, 32)
+		if _, err := rand.Read(sessionSecret); err != nil {
+			logger.Fatal("Failed to generate session secret", zap.Error(err))
+		}
+	}
+
+	sessionTTL = 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil {
+		sessionTTL = v
+	}
+	secureCookies = os.Getenv("SESSION_COOKIE_INSECURE") != "true"
+
+	oidcEnabled = true
+	logger.Info("OIDC login enabled", zap.String("issuer", issuer), zap.String("client_id", clientID))
+}
+
+// registerAuthRoutes installs /auth/login, /auth/callback and /auth/logout.
+func registerAuthRoutes(r *gin.Engine) {
+	if !oidcEnabled {
+		return
+	}
+
+	r.GET("/auth/login", func(c *gin.Context) {
+		state, err := randomToken()
+		if err != nil {
+			logger.Error("Failed to generate OAuth state", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(stateCookie, state, 600, "/auth", "", secureCookies, true)
+		c.Redirect(http.StatusFound, oidcConfig.AuthCodeURL(state))
+	})
+
+	r.GET("/auth/callback", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		state, err := c.Cookie(stateCookie)
+		if err != nil || state == "" || c.Query("state") != state {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
+			return
+		}
+		c.SetCookie(stateCookie, "", -1, "/auth", "", secureCookies, true)
+
+		token, err := oidcConfig.Exchange(ctx, c.Query("code"))
+		if err != nil {
+			logger.Warn("OAuth code exchange failed", zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+			return
+		}
+
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed: no id_token"})
+			return
+		}
+
+		session, err := sessionFromIDToken(ctx, rawIDToken)
+		if err != nil {
+			logger.Warn("ID token verification failed", zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+			return
+		}
+
+		cookie, err := encodeSession(session)
+		if err != nil {
+			logger.Error("Failed to encode session", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Login failed"})
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(sessionCookie, cookie, int(sessionTTL.Seconds()), "/", "", secureCookies, true)
+
+		logger.Info("User logged in", zap.String("user_id", session.Subject))
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":    session.Subject,
+			"email":      session.Email,
+			"expires_at": time.Unix(session.ExpiresAt, 0).Format(time.RFC3339),
+		})
+	})
+
+	r.POST("/auth/logout", func(c *gin.Context) {
+		c.SetCookie(sessionCookie, "", -1, "/", "", secureCookies, true)
+		c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+	})
+}
+
+// loginEnabled reports whether callers can authenticate, with OIDC or a
+// magic link.
+func loginEnabled() bool {
+	return oidcEnabled || len(magicLinkSessions.Secret) > 0
+}
+
+// identityMiddleware resolves the caller's identity from the session cookie
+// or a bearer token and stores the user ID in the gin context.
+func identityMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !loginEnabled() {
+			c.Next()
+			return
+		}
+
+		var session Session
+		var err error
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			session, err = sessionFromBearer(c, bearer)
+		} else if cookie, cerr := c.Cookie(sessionCookie); cerr == nil && oidcEnabled {
+			session, err = decodeSession(cookie)
+		} else {
+			c.Next()
+			return
+		}
+
+		if err != nil {
+			logger.Debug("Ignoring invalid credentials", zap.Error(err))
+			c.Next()
+			return
+		}
+
+		c.Set(userIDKey, session.Subject)
+		c.Next()
+	}
+}
+
+// requireUser rejects requests without an authenticated identity when
+// login is enabled.
+func requireUser(c *gin.Context) {
+	if !loginEnabled() {
+		return
+	}
+	if c.GetString(userIDKey) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+	}
+}
+
+// sessionFromBearer accepts a magic-link session token of the caller's
+// tenant or, with OIDC login, an OIDC ID token.
+func sessionFromBearer(c *gin.Context, bearer string) (Session, error) {
+	claims, err := magicLinkSessions.Verify(bearer)
+	if err == nil {
+		if tenant, terr := requestTenant(c); terr != nil || tenant != claims.Tenant {
+			return Session{}, errTenantMismatch
+		}
+		return Session{Subject: claims.Subject, Email: claims.Email, ExpiresAt: claims.ExpiresAt}, nil
+	}
+	if !oidcEnabled {
+		return Session{}, err
+	}
+	return sessionFromIDToken(c.Request.Context(), bearer)
+}
+
+func sessionFromIDToken(ctx context.Context, rawIDToken string) (Session, error) {
+	idToken, err := oidcVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Session{}, err
+	}
+
+	var claims struct {
+		Email string `json:"email"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return Session{}, err
+	}
+
+	return Session{
+		Subject:   idToken.Subject,
+		Email:     claims.Email,
+		ExpiresAt: time.Now().Add(sessionTTL).Unix(),
+	}, nil
+}
+
+// encodeSession serializes and signs a session as "payload.signature".
+func encodeSession(s Session) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signSession(encoded), nil
+}
+
+func decodeSession(cookie string) (Session, error) {
+	encoded, sig, ok := strings.Cut(cookie, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signSession(encoded))) {
+		return Session{}, errBadSession
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Session{}, errBadSession
+	}
+
+	var s Session
+	if err := json.Unmarshal(payload, &s); err != nil || s.Subject == "" {
+		return Session{}, errBadSession
+	}
+	if time.Now().Unix() > s.ExpiresAt {
+		return Session{}, errSessionExpired
+	}
+	return s, nil
+}
+
+func signSession(encoded string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A backend may have several replicas, listed in its address or found by
+// service discovery (see discovery.go). Requests to a sticky backend are
+// spread by user with rendezvous (highest random weight) hashing, so a
+// user keeps reaching the same replica while the list is unchanged and
+// only the users of a removed replica move. Other backends,
+// and requests without a user, rotate through the replicas.
+
+// roundRobin holds a *atomic.Uint64 counter per backend
+var roundRobin sync.Map
+
+// backendEndpoints returns the replica addresses of a backend.
+func backendEndpoints(name string) []string {
+	if r, ok := resolvers[name]; ok {
+		return r.endpoints()
+	}
+	return nil
+}
+
+// pickEndpoint chooses the replica of a backend for a request whose user
+// is key, or that has no user if key is empty.
+func pickEndpoint(name, key string) string {
+	endpoints := backendEndpoints(name)
+	switch {
+	case len(endpoints) == 0:
+		return ""
+	case len(endpoints) == 1:
+		return endpoints[0]
+	case key != "" && backends[name].Sticky:
+		return rendezvous(endpoints, key)
+	}
+
+	counter, _ := roundRobin.LoadOrStore(name, new(atomic.Uint64))
+	n := counter.(*atomic.Uint64).Add(1)
+	return endpoints[n%uint64(len(endpoints))]
+}
+
+// rendezvous returns the endpoint with the highest hash of key and
+// endpoint.
+func rendezvous(endpoints []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, endpoint := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(endpoint))
+		if score := mix64(h.Sum64()); best == "" || score > bestScore {
+			best, bestScore = endpoint, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer. FNV barely spreads changes in the
+// last bytes, which would make similar endpoint names win for most keys.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// stickyKey identifies the user behind a request for sticky routing: the
+// authenticated user, else a user_id in the query or JSON body, else the
+// session cookie.
+func stickyKey(c *gin.Context) string {
+	if userID := c.GetString(userIDKey); userID != "" {
+		return userID
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		return userID
+	}
+	if userID := bodyUserID(c, "user_id"); userID != "" {
+		return userID
+	}
+	if cookie, err := c.Cookie(sessionCookie); err == nil {
+		return cookie
+	}
+	return ""
+}
+
+// bodyUserID returns the string field of the request's JSON body, or ""
+// if there is none.
+func bodyUserID(c *gin.Context, field string) string {
+	body, err := requestBody(c)
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+	var payload map[string]json.RawMessage
+	if json.NewDecoder(bytes.NewReader(body)).Decode(&payload) != nil {
+		return ""
+	}
+	var userID string
+	if json.Unmarshal(payload[field], &userID) != nil {
+		return ""
+	}
+	return userID
+}
+
+// balancedTransport sends the typed clients' requests to a replica of
+// backend, keyed by the user ID header they set, within the backend's
+// in-flight limit (see limiter.go).
+type balancedTransport struct {
+	backend string
+	base    http.RoundTripper
+}
+
+func (t balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := acquireBackend(req.Context(), t.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Host = pickEndpoint(t.backend, req.Header.Get(userIDHeader))
+	req.Host = ""
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
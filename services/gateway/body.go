@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// requestBodyKey caches the buffered request body in the gin context
+const requestBodyKey = "request_body"
+
+var (
+	// maxRequestBodyBytes caps how much of a request body is buffered;
+	// larger requests are rejected with 413
+	maxRequestBodyBytes int64 = 1 << 20
+
+	requestBodySize  metric.Int64Histogram
+	responseBodySize metric.Int64Histogram
+)
+
+func initBodyBuffering() {
+	if v, err := strconv.ParseInt(os.Getenv("MAX_REQUEST_BODY_BYTES"), 10, 64); err == nil && v > 0 {
+		maxRequestBodyBytes = v
+	}
+
+	var err error
+	requestBodySize, err = meter.Int64Histogram(
+		"http.server.request.body.size",
+		metric.WithDescription("Size of proxied request bodies"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create request size histogram", zap.Error(err))
+	}
+
+	responseBodySize, err = meter.Int64Histogram(
+		"http.server.response.body.size",
+		metric.WithDescription("Size of proxied response bodies"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create response size histogram", zap.Error(err))
+	}
+}
+
+// requestBody reads the request body into memory, up to
+// maxRequestBodyBytes, and caches it so it can be read again by retries,
+// audit logging and the proxy. c.Request.Body is replaced with a fresh
+// reader over the buffered bytes.
+func requestBody(c *gin.Context) ([]byte, error) {
+	if cached, ok := c.Get(requestBodyKey); ok {
+		body := cached.([]byte)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		return body, nil
+	}
+
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		c.Set(requestBodyKey, []byte(nil))
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestBodyBytes))
+	c.Request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(requestBodyKey, body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// isBodyTooLarge reports whether err came from exceeding the body cap.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Every request is scored for how likely it is to come from a bot, from
+// 0 to 1, so scrapers can be told apart from people in the stats. The
+// heuristics each give a score for what they find, combined as independent
+// odds, so a command-line tool sending requests quickly scores higher
+// than either alone:
+//
+//   - the User-Agent: none at all, a self-declared bot or crawler, or an
+//     HTTP library or command-line tool
+//   - missing headers every browser sends (Accept, and Accept-Language
+//     from a browser User-Agent)
+//   - the visitor's request rate over the last minute beyond
+//     BOT_RATE_THRESHOLD requests (default 120; 0 ignores the rate)
+//
+// A pluggable BotScorer can raise the score: BOT_SCORER_URL sets up one
+// that posts the request's BotSignals to a scoring service, waiting up to
+// BOT_SCORER_TIMEOUT (default 100ms); the higher score wins.
+//
+// Requests scoring BOT_SCORE_THRESHOLD (default 0.7) or more are likely
+// bots: their spans get client.bot, the request baggage carries
+// client.bot=true and the user agent family "bot", so the backends and
+// analytics' client stats count them apart, and gateway metrics get the
+// client_bot attribute. BOT_ACTION says what else happens to their API
+// requests: "tag" (default) nothing, "throttle" limits them to
+// BOT_THROTTLE_RATE requests a minute (default 30) with 429, and
+// "challenge" answers 403 with a cookie the client must send back, which
+// clients that keep cookies do and most scrapers don't. Partner-signed
+// requests are never scored; BOT_DETECTION=false turns scoring off.
+
+const (
+	botActionTag       = "tag"
+	botActionThrottle  = "throttle"
+	botActionChallenge = "challenge"
+
+	botBaggageKey = "client.bot"
+
+	// botChallengeCookie holds the visitor's answer to the challenge
+	botChallengeCookie = "bot_check"
+	botChallengeTTL    = 24 * time.Hour
+
+	// maxBotVisitors bounds the visitors whose rate is tracked; further
+	// visitors aren't rate scored until the next minute frees room
+	maxBotVisitors = 100000
+)
+
+// BotSignals describe a request to a BotScorer.
+type BotSignals struct {
+	Visitor           string  `json:"visitor"`
+	Method            string  `json:"method"`
+	Route             string  `json:"route"`
+	UserAgent         string  `json:"user_agent"`
+	UAFamily          string  `json:"ua_family"`
+	HasAccept         bool    `json:"has_accept"`
+	HasAcceptLanguage bool    `json:"has_accept_language"`
+	RatePerMinute     float64 `json:"rate_per_minute"`
+	// HeuristicScore is the gateway's own score, and Reasons what it is
+	// made of
+	HeuristicScore float64  `json:"heuristic_score"`
+	Reasons        []string `json:"reasons"`
+}
+
+// BotScorer scores how likely a request is to come from a bot, from 0 to
+// 1.
+type BotScorer interface {
+	Score(ctx context.Context, signals BotSignals) (float64, error)
+}
+
+// botUAScores score User-Agent families (see attribution.go)
+var botUAScores = map[string]float64{
+	"bot":             0.9,
+	"unknown":         0.8,
+	"curl":            0.5,
+	"wget":            0.5,
+	"python-requests": 0.5,
+	"go-http-client":  0.5,
+	"postman":         0.3,
+	"okhttp":          0.2,
+	"other":           0.1,
+}
+
+// botUAMarkers are User-Agent substrings of crawlers and headless browsers
+// that don't say "bot"
+var botUAMarkers = []string{"crawler", "scrapy", "headlesschrome", "phantomjs", "slurp"}
+
+// browserFamilies are the families expected to send Accept-Language
+var browserFamilies = map[string]bool{"chrome": true, "edge": true, "firefox": true, "safari": true}
+
+// visitorRate counts a visitor's requests in the current and previous
+// minute.
+type visitorRate struct {
+	minute          int64
+	count, previous int
+}
+
+var (
+	botDetection      = true
+	botAction         = botActionTag
+	botScoreThreshold = 0.7
+	botRateThreshold  = 120
+	botThrottleRate   = 30
+	botScorer         BotScorer
+
+	botRates      = map[string]*visitorRate{}
+	botRatesMutex sync.Mutex
+
+	botRequests metric.Int64Counter
+)
+
+func initBotDetection() {
+	// Spans and logs carry client.bot like the other request members
+	telemetry.AddContextBaggageKey(botBaggageKey)
+
+	if v, err := strconv.ParseBool(os.Getenv("BOT_DETECTION")); err == nil {
+		botDetection = v
+	}
+	if !botDetection {
+		logger.Info("Bot detection disabled")
+		return
+	}
+	switch v := os.Getenv("BOT_ACTION"); v {
+	case "":
+	case botActionTag, botActionThrottle, botActionChallenge:
+		botAction = v
+	default:
+		// The startup check rejects it (see selfcheck.go)
+		logger.Warn("Unknown BOT_ACTION, only tagging likely bots", zap.String("value", v))
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("BOT_SCORE_THRESHOLD"), 64); err == nil && v > 0 && v <= 1 {
+		botScoreThreshold = v
+	}
+	botRateThreshold = envInt("BOT_RATE_THRESHOLD", botRateThreshold)
+	botThrottleRate = envInt("BOT_THROTTLE_RATE", botThrottleRate)
+	if url := os.Getenv("BOT_SCORER_URL"); url != "" {
+		botScorer = &httpBotScorer{
+			url:    url,
+			client: &http.Client{Timeout: envDuration("BOT_SCORER_TIMEOUT", 100*time.Millisecond)},
+		}
+	}
+
+	var err error
+	botRequests, err = meter.Int64Counter(
+		"gateway.bot.requests",
+		metric.WithDescription("Number of requests scored as likely bots, by action taken"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create bot requests counter", zap.Error(err))
+	}
+
+	go pruneBotRates()
+	logger.Info("Bot detection enabled",
+		zap.String("action", botAction),
+		zap.Float64("threshold", botScoreThreshold),
+		zap.Bool("scorer", botScorer != nil),
+	)
+}
+
+// botMiddleware scores every request and tags, throttles or challenges
+// likely bots.
+func botMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		// Clients can't mark themselves
+		ctx = baggage.ContextWithBaggage(ctx, baggage.FromContext(ctx).DeleteMember(botBaggageKey))
+		c.Request = c.Request.WithContext(ctx)
+		if !botDetection || c.FullPath() == "/healthz" || c.GetString(partnerKey) != "" {
+			c.Next()
+			return
+		}
+
+		visitor := visitorID(c.ClientIP())
+		signals := botSignals(c, visitor, recordBotRate(visitor, time.Now()))
+		score := signals.HeuristicScore
+		if botScorer != nil {
+			external, err := botScorer.Score(ctx, signals)
+			if err != nil {
+				loggerFor(ctx).Debug("Bot scorer unavailable, using the heuristic score", zap.Error(err))
+			} else {
+				score = max(score, min(max(external, 0), 1))
+			}
+		}
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.Float64("client.bot_score", score))
+		if score < botScoreThreshold {
+			c.Next()
+			return
+		}
+
+		ctx = withBaggageMembers(ctx, map[string]string{
+			botBaggageKey:            "true",
+			clientUAFamilyBaggageKey: "bot",
+		})
+		c.Request = c.Request.WithContext(ctx)
+		span.SetAttributes(
+			attribute.Bool(botBaggageKey, true),
+			attribute.StringSlice("client.bot_reasons", signals.Reasons),
+		)
+
+		action := botActionTag
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, "/api/") || path == "/graphql" {
+			action = botAction
+		}
+		switch action {
+		case botActionThrottle:
+			if signals.RatePerMinute <= float64(botThrottleRate) {
+				action = botActionTag
+			}
+		case botActionChallenge:
+			if validBotChallenge(c, visitor) {
+				action = botActionTag
+			}
+		}
+		botRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("action", action)), contextAttrs(ctx))
+
+		switch action {
+		case botActionThrottle:
+			loggerFor(ctx).Info("Likely bot throttled", zap.Float64("score", score), zap.Strings("reasons", signals.Reasons))
+			c.Header("Retry-After", strconv.Itoa(60-time.Now().Second()))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, slow down"})
+		case botActionChallenge:
+			loggerFor(ctx).Info("Likely bot challenged", zap.Float64("score", score), zap.Strings("reasons", signals.Reasons))
+			c.SetCookie(botChallengeCookie, botChallengeAnswer(visitor, time.Now()), int(botChallengeTTL.Seconds()), "/", "", secureCookies, true)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Automated traffic check, retry with the cookie set"})
+		default:
+			c.Next()
+		}
+	}
+}
+
+// botSignals describes the request and scores it with the heuristics.
+func botSignals(c *gin.Context, visitor string, rate float64) BotSignals {
+	userAgent := c.Request.UserAgent()
+	family := userAgentFamily(userAgent)
+	signals := BotSignals{
+		Visitor:           visitor,
+		Method:            c.Request.Method,
+		Route:             c.FullPath(),
+		UserAgent:         userAgent,
+		UAFamily:          family,
+		HasAccept:         c.GetHeader("Accept") != "",
+		HasAcceptLanguage: c.GetHeader("Accept-Language") != "",
+		RatePerMinute:     rate,
+		Reasons:           []string{},
+	}
+
+	score := func(reason string, s float64) {
+		signals.Reasons = append(signals.Reasons, reason)
+		signals.HeuristicScore = 1 - (1-signals.HeuristicScore)*(1-s)
+	}
+	if s := botUAScores[family]; s > 0 {
+		score("user_agent:"+family, s)
+	}
+	ua := strings.ToLower(userAgent)
+	for _, marker := range botUAMarkers {
+		if strings.Contains(ua, marker) {
+			score("user_agent:"+marker, 0.9)
+			break
+		}
+	}
+	if !signals.HasAccept {
+		score("no_accept", 0.3)
+	}
+	if browserFamilies[family] && !signals.HasAcceptLanguage {
+		score("browser_without_language", 0.6)
+	}
+	if botRateThreshold > 0 && rate > float64(botRateThreshold) {
+		// Twice the threshold is as sure as it gets
+		score("rate", min(0.5+0.5*(rate-float64(botRateThreshold))/float64(botRateThreshold), 1))
+	}
+	return signals
+}
+
+// recordBotRate counts a request from visitor at now and returns its
+// requests over the last minute, the previous minute weighted by how much
+// of it the last minute still covers.
+func recordBotRate(visitor string, now time.Time) float64 {
+	minute := now.Unix() / 60
+	botRatesMutex.Lock()
+	defer botRatesMutex.Unlock()
+
+	r, ok := botRates[visitor]
+	if !ok {
+		if len(botRates) >= maxBotVisitors {
+			return 0
+		}
+		r = &visitorRate{minute: minute}
+		botRates[visitor] = r
+	}
+	switch {
+	case r.minute == minute-1:
+		r.minute, r.previous, r.count = minute, r.count, 0
+	case r.minute < minute-1:
+		r.minute, r.previous, r.count = minute, 0, 0
+	}
+	r.count++
+	elapsed := float64(now.Unix()%60) / 60
+	return float64(r.count) + float64(r.previous)*(1-elapsed)
+}
+
+// pruneBotRates drops visitors idle for more than a minute, every minute.
+func pruneBotRates() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		minute := now.Unix() / 60
+		botRatesMutex.Lock()
+		for visitor, r := range botRates {
+			if r.minute < minute-1 {
+				delete(botRates, visitor)
+			}
+		}
+		botRatesMutex.Unlock()
+	}
+}
+
+// botChallengeAnswer is the challenge cookie of a visitor for the day of
+// at: an HMAC of both, so it can't be made up or moved to another IP.
+func botChallengeAnswer(visitor string, at time.Time) string {
+	mac := hmac.New(sha256.New, visitorHashKey)
+	fmt.Fprintf(mac, "bot-check:%s:%s", visitor, at.UTC().Format(time.DateOnly))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validBotChallenge reports whether the request carries the visitor's
+// challenge cookie of today or yesterday.
+func validBotChallenge(c *gin.Context, visitor string) bool {
+	cookie, err := c.Cookie(botChallengeCookie)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	for _, day := range []time.Time{now, now.Add(-botChallengeTTL)} {
+		if hmac.Equal([]byte(cookie), []byte(botChallengeAnswer(visitor, day))) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpBotScorer asks a scoring service: it posts the signals as JSON and
+// reads {"score": 0.9} back.
+type httpBotScorer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpBotScorer) Score(ctx context.Context, signals BotSignals) (float64, error) {
+	body, err := json.Marshal(signals)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("scorer answered %s", resp.Status)
+	}
+	var result struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if result.Score == nil {
+		return 0, fmt.Errorf("scorer answered without a score")
+	}
+	return *result.Score, nil
+}
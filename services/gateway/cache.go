@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Successful responses of Cache routes are kept per replica for
+// RESPONSE_CACHE_TTL (default 30s), keyed like coalesced requests (see
+// coalesce.go), so repeated reads of the catalogue don't reach the jokes
+// service. Writes to jokes and reactions name the paths they made stale
+// (see services/jokes/invalidation.go), which are purged without waiting
+// for the TTL:
+//   - from the X-Cache-Invalidate header of the write's response, on the
+//     replica that proxied it; the header is not passed on to the client
+//   - from INVALIDATION_CHANNEL (default "jokes:invalidations") when
+//     REDIS_ADDR is set, on every replica, which also covers catalogue
+//     refreshes no request sees
+//
+// A stale path ending in "/*" covers every path under it. At most
+// RESPONSE_CACHE_MAX_ENTRIES (default 10000) responses are kept;
+// RESPONSE_CACHE=false turns the cache off. Responses say whether they
+// came from the cache in X-Cache (HIT or MISS).
+
+const (
+	invalidationHeader = "X-Cache-Invalidate"
+	cacheStatusHeader  = "X-Cache"
+)
+
+// cachedResponse is a response kept for identical requests.
+type cachedResponse struct {
+	// path is the request path, matched against invalidations
+	path    string
+	status  int
+	headers http.Header
+	body    []byte
+	expires time.Time
+}
+
+var (
+	responseCacheEnabled    = true
+	responseCacheTTL        = 30 * time.Second
+	responseCacheMaxEntries = 10000
+	invalidationChannel     = "jokes:invalidations"
+
+	responseCache      = map[string]*cachedResponse{}
+	responseCacheMutex sync.Mutex
+
+	cacheRequests metric.Int64Counter
+	cachePurges   metric.Int64Counter
+)
+
+func initResponseCache() {
+	if v, err := strconv.ParseBool(os.Getenv("RESPONSE_CACHE")); err == nil {
+		responseCacheEnabled = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("RESPONSE_CACHE_TTL")); err == nil && v > 0 {
+		responseCacheTTL = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_MAX_ENTRIES")); err == nil && v > 0 {
+		responseCacheMaxEntries = v
+	}
+	if v := os.Getenv("INVALIDATION_CHANNEL"); v != "" {
+		invalidationChannel = v
+	}
+
+	var err error
+	cacheRequests, err = meter.Int64Counter(
+		"gateway.cache.requests",
+		metric.WithDescription("Number of requests to cached routes, by route and result (hit or miss)"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create cache requests counter", zap.Error(err))
+	}
+	cachePurges, err = meter.Int64Counter(
+		"gateway.cache.purged",
+		metric.WithDescription("Number of cached responses purged by invalidations, by source"),
+		metric.WithUnit("{response}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create cache purges counter", zap.Error(err))
+	}
+
+	if !responseCacheEnabled {
+		return
+	}
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		client := redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})
+		go subscribeInvalidations(context.Background(), client)
+		logger.Info("Response cache invalidations read from Redis", zap.String("channel", invalidationChannel))
+	} else {
+		logger.Warn("REDIS_ADDR not set, cached responses are only purged by writes proxied through the same replica")
+	}
+}
+
+// subscribeInvalidations purges the paths of the invalidations published
+// on the invalidation channel until ctx is cancelled. The subscription
+// reconnects by itself; invalidations published while it is down are
+// lost, and those paths expire by TTL.
+func subscribeInvalidations(ctx context.Context, client *redis.Client) {
+	sub := client.Subscribe(ctx, invalidationChannel)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		var inv struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+			logger.Warn("Malformed cache invalidation", zap.Error(err))
+			continue
+		}
+		purgeCached(ctx, inv.Paths, "channel")
+	}
+}
+
+// serveCached serves the request from the cache, or through proxy, keeping
+// the response if it succeeded.
+func serveCached(c *gin.Context, route Route, proxy func()) {
+	ctx := c.Request.Context()
+	key := coalesceKey(c, route)
+	now := time.Now()
+
+	responseCacheMutex.Lock()
+	cached, ok := responseCache[key]
+	if ok && now.After(cached.expires) {
+		delete(responseCache, key)
+		ok = false
+	}
+	responseCacheMutex.Unlock()
+
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	cacheRequests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("route", route.Path),
+		attribute.String("result", result),
+	), contextAttrs(ctx))
+
+	if ok {
+		for name, values := range cached.headers {
+			c.Writer.Header()[name] = values
+		}
+		c.Header(cacheStatusHeader, "HIT")
+		c.Status(cached.status)
+		c.Writer.Write(cached.body)
+		return
+	}
+
+	before := c.Writer.Header().Clone()
+	c.Header(cacheStatusHeader, "MISS")
+	recorder := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = recorder
+
+	proxy()
+
+	c.Writer = recorder.ResponseWriter
+	if c.Writer.Status() != http.StatusOK {
+		return
+	}
+	headers := http.Header{}
+	for name, values := range c.Writer.Header() {
+		if !slices.Equal(before[name], values) {
+			headers[name] = values
+		}
+	}
+	storeCached(key, &cachedResponse{
+		path:    c.Request.URL.Path,
+		status:  http.StatusOK,
+		headers: headers,
+		body:    recorder.body,
+		expires: now.Add(responseCacheTTL),
+	})
+}
+
+// storeCached keeps response under key, making room by dropping expired
+// responses, or failing that an arbitrary one.
+func storeCached(key string, response *cachedResponse) {
+	responseCacheMutex.Lock()
+	defer responseCacheMutex.Unlock()
+
+	if len(responseCache) >= responseCacheMaxEntries {
+		now := time.Now()
+		for k, cached := range responseCache {
+			if now.After(cached.expires) {
+				delete(responseCache, k)
+			}
+		}
+	}
+	for k := range responseCache {
+		if len(responseCache) < responseCacheMaxEntries {
+			break
+		}
+		delete(responseCache, k)
+	}
+	responseCache[key] = response
+}
+
+// purgeCached drops the cached responses for paths, reporting how many
+// were dropped. source (header or channel) is recorded on the metric.
+func purgeCached(ctx context.Context, paths []string, source string) int {
+	var exact []string
+	var prefixes []string
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if prefix, ok := strings.CutSuffix(path, "*"); ok {
+			prefixes = append(prefixes, prefix)
+		} else if path != "" {
+			exact = append(exact, path)
+		}
+	}
+
+	responseCacheMutex.Lock()
+	purged := 0
+	for key, cached := range responseCache {
+		stale := slices.Contains(exact, cached.path)
+		for _, prefix := range prefixes {
+			stale = stale || strings.HasPrefix(cached.path, prefix)
+		}
+		if stale {
+			delete(responseCache, key)
+			purged++
+		}
+	}
+	responseCacheMutex.Unlock()
+
+	if purged > 0 {
+		cachePurges.Add(ctx, int64(purged), metric.WithAttributes(attribute.String("source", source)))
+	}
+	return purged
+}
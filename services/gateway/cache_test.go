@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// useTestCache gives the test an empty response cache.
+func useTestCache(t *testing.T) {
+	meter := noop.NewMeterProvider().Meter("test")
+	cacheRequests, _ = meter.Int64Counter("cache.requests")
+	cachePurges, _ = meter.Int64Counter("cache.purged")
+	responseCache = map[string]*cachedResponse{}
+	t.Cleanup(func() { responseCache = map[string]*cachedResponse{} })
+}
+
+func TestPurgeCached(t *testing.T) {
+	paths := []string{"/api/v1/jokes", "/api/v1/jokes/trending", "/api/v1/jokes/j1", "/api/v1/jokes/j2", "/api/v1/favorites"}
+	tests := []struct {
+		name  string
+		stale []string
+		kept  []string
+	}{
+		{"one joke", []string{"/api/v1/jokes", " /api/v1/jokes/j1"}, []string{"/api/v1/jokes/trending", "/api/v1/jokes/j2", "/api/v1/favorites"}},
+		{"whole catalogue", []string{"/api/v1/jokes", "/api/v1/jokes/*"}, []string{"/api/v1/favorites"}},
+		{"unknown path", []string{"/api/v1/jokes/j3"}, paths},
+		{"nothing", []string{""}, paths},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestCache(t)
+			for _, path := range paths {
+				responseCache[path] = &cachedResponse{path: path, expires: time.Now().Add(time.Minute)}
+			}
+
+			purged := purgeCached(context.Background(), tt.stale, "header")
+			if want := len(paths) - len(tt.kept); purged != want {
+				t.Errorf("purged %d responses, want %d", purged, want)
+			}
+			for _, path := range tt.kept {
+				if _, ok := responseCache[path]; !ok {
+					t.Errorf("%s was purged", path)
+				}
+			}
+		})
+	}
+}
+
+func TestServeCached(t *testing.T) {
+	useTestCache(t)
+	route := Route{Method: "GET", Path: "/api/v1/jokes/:id", Cache: true}
+
+	calls := 0
+	serve := func(status int) (int, string) {
+		c, w := testContext("jokes.example", nil)
+		c.Request.URL.Path = "/api/v1/jokes/j1"
+		serveCached(c, route, func() {
+			calls++
+			c.String(status, "joke")
+		})
+		return w.Code, w.Header().Get(cacheStatusHeader)
+	}
+
+	if code, cache := serve(http.StatusNotFound); code != http.StatusNotFound || cache != "MISS" {
+		t.Fatalf("first request got %d %s, want 404 MISS", code, cache)
+	}
+	if _, cache := serve(http.StatusOK); cache != "MISS" {
+		t.Errorf("request after a 404 got %s, want MISS", cache)
+	}
+	if code, cache := serve(http.StatusOK); code != http.StatusOK || cache != "HIT" {
+		t.Errorf("repeated request got %d %s, want 200 HIT", code, cache)
+	}
+	if calls != 2 {
+		t.Errorf("backend called %d times, want 2", calls)
+	}
+
+	purgeCached(context.Background(), []string{"/api/v1/jokes/j1"}, "channel")
+	if _, cache := serve(http.StatusOK); cache != "MISS" {
+		t.Errorf("request after an invalidation got %s, want MISS", cache)
+	}
+}
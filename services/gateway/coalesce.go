@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Identical GETs arriving while one is in flight on a Coalesce route share
+// its backend call, so a dashboard refreshed by many viewers at once costs
+// one backend request instead of one per viewer. Requests are identical
+// when they have the same route, path, query (parameter order aside),
+// tenant, user, Accept and Accept-Encoding headers and error language (see
+// i18n.go). The first request is proxied as usual; the others wait for it
+// and get a copy of its response. Coalescing keeps nothing: a request
+// arriving after the response is written makes a new call, unless the
+// route is also cached (see cache.go).
+//
+// The shared call is not cancelled when the client that started it goes
+// away, as others are waiting on it; BACKEND_TIMEOUT still bounds it.
+// COALESCE_REQUESTS=false turns coalescing off.
+
+// flight is a backend call shared by identical requests.
+type flight struct {
+	done chan struct{}
+	// The response, set before done is closed
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+var (
+	coalescingEnabled = true
+
+	flights      = map[string]*flight{}
+	flightsMutex sync.Mutex
+
+	coalescedRequests metric.Int64Counter
+)
+
+func initCoalescing() {
+	if v, err := strconv.ParseBool(os.Getenv("COALESCE_REQUESTS")); err == nil {
+		coalescingEnabled = v
+	}
+
+	var err error
+	coalescedRequests, err = meter.Int64Counter(
+		"gateway.requests.coalesced",
+		metric.WithDescription("Number of requests served from an identical request's backend call, by route"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create coalesced requests counter", zap.Error(err))
+	}
+}
+
+// coalesceKey identifies the requests a route may answer with one backend
+// call.
+func coalesceKey(c *gin.Context, route Route) string {
+	return strings.Join([]string{
+		route.Method,
+		route.Path,
+		route.Match.describe(),
+		c.Request.URL.Path,
+		// Encode sorts by parameter name
+		c.Request.URL.Query().Encode(),
+		telemetry.TenantFromContext(c.Request.Context()),
+		c.GetString(userIDKey),
+		c.GetHeader("Accept"),
+		// Compressed bodies are passed through as the backend sent them
+		c.GetHeader("Accept-Encoding"),
+		// Error bodies are localized before they are copied to waiters
+		requestLanguage(c.GetHeader("Accept-Language")),
+	}, "\n")
+}
+
+// serveCoalesced serves the request through proxy, unless an identical
+// request is in flight, in which case it waits for that request's response
+// and writes a copy.
+func serveCoalesced(c *gin.Context, route Route, proxy func()) {
+	key := coalesceKey(c, route)
+
+	flightsMutex.Lock()
+	if f, ok := flights[key]; ok {
+		flightsMutex.Unlock()
+		waitForFlight(c, route, f)
+		return
+	}
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+	flightsMutex.Unlock()
+
+	defer func() {
+		flightsMutex.Lock()
+		delete(flights, key)
+		flightsMutex.Unlock()
+		close(f.done)
+	}()
+
+	// Record what the proxy writes, so waiters can be sent the same
+	before := c.Writer.Header().Clone()
+	recorder := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(context.WithoutCancel(ctx))
+
+	proxy()
+
+	c.Writer = recorder.ResponseWriter
+	c.Request = c.Request.WithContext(ctx)
+
+	f.status = c.Writer.Status()
+	f.body = recorder.body
+	f.headers = http.Header{}
+	for name, values := range c.Writer.Header() {
+		if !slices.Equal(before[name], values) {
+			f.headers[name] = values
+		}
+	}
+}
+
+// waitForFlight writes the response of an identical request's call.
+func waitForFlight(c *gin.Context, route Route, f *flight) {
+	ctx := c.Request.Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("gateway.coalesced", true))
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		c.Abort()
+		return
+	}
+
+	// The call that was shared panicked without writing a response
+	if f.status == 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Service unavailable"})
+		return
+	}
+
+	coalescedRequests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("route", route.Path),
+	), contextAttrs(ctx))
+	for name, values := range f.headers {
+		c.Writer.Header()[name] = values
+	}
+	c.Status(f.status)
+	c.Writer.Write(f.body)
+}
+
+// recordingWriter keeps a copy of the response body written through it.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body []byte
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body = append(w.body, b...)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body = append(w.body, s...)
+	return w.ResponseWriter.WriteString(s)
+}
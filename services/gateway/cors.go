@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Browser apps served from other origins can call the API once their
+// origin is listed in CORS_ALLOWED_ORIGINS ("*" allows any). Their requests
+// get Access-Control-Allow-Origin, with the headers clients read exposed,
+// and the preflight OPTIONS requests browsers send first are answered on
+// every proxied route (see methods.go), cacheable for CORS_MAX_AGE. Cookies
+// are not allowed cross-origin, so the session cookie stays first-party;
+// such apps authenticate with an API key or bearer token.
+//
+// CORS is off by default: no CORS headers are sent and browsers keep
+// cross-origin apps out.
+
+// corsExposedHeaders are the response headers cross-origin apps can read
+var corsExposedHeaders = strings.Join([]string{
+	"X-Request-Id", "Retry-After", "ETag", "Content-Language", "Content-Disposition",
+	"X-Quota-Daily-Limit", "X-Quota-Daily-Remaining", "X-Quota-Monthly-Limit", "X-Quota-Monthly-Remaining",
+	"Deprecation", "Sunset", "Link", "Warning", "X-Cache",
+}, ", ")
+
+var (
+	// corsOrigins are the origins allowed, nil when CORS is off
+	corsOrigins []string
+	corsMaxAge  = 10 * time.Minute
+)
+
+func initCORS() {
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	if v, err := time.ParseDuration(os.Getenv("CORS_MAX_AGE")); err == nil && v >= 0 {
+		corsMaxAge = v
+	}
+	if len(corsOrigins) > 0 {
+		logger.Info("CORS enabled",
+			zap.Strings("origins", corsOrigins),
+			zap.Duration("max_age", corsMaxAge),
+		)
+	}
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin of a request
+// from origin, or "" if the origin isn't allowed.
+func corsAllowOrigin(origin string) string {
+	switch {
+	case origin == "" || len(corsOrigins) == 0:
+		return ""
+	case slices.Contains(corsOrigins, "*"):
+		return "*"
+	case slices.Contains(corsOrigins, origin):
+		return origin
+	}
+	return ""
+}
+
+// corsMiddleware allows the requests of allowed origins.
+func corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(corsOrigins) == 0 {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		h.Add("Vary", "Origin")
+		if allowed := corsAllowOrigin(c.GetHeader("Origin")); allowed != "" {
+			h.Set("Access-Control-Allow-Origin", allowed)
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		c.Next()
+	}
+}
+
+// answerPreflight adds the CORS preflight headers to an OPTIONS response
+// for a path answering methods, if the origin is allowed and the method
+// the browser asks for is one of them.
+func answerPreflight(c *gin.Context, methods []string) {
+	method := c.GetHeader("Access-Control-Request-Method")
+	if method == "" || corsAllowOrigin(c.GetHeader("Origin")) == "" || !slices.Contains(methods, method) {
+		return
+	}
+	h := c.Writer.Header()
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers := c.GetHeader("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Routes on their way out are marked with a Deprecation in the route
+// table, as are query parameters and JSON body fields replaced by others.
+// Responses to deprecated routes carry the standard headers: Deprecation
+// with the date it was deprecated, Sunset once a removal date is set, and
+// a Link to the successor. Both deprecated routes and fields add a Warning
+// saying what to use instead, for clients that only log warnings.
+//
+// Every deprecated call is counted per client, identified as for quotas
+// (partner, API key hash or IP), so GET /admin/deprecations shows who
+// still has to migrate before a route can be removed. Counts are kept in
+// Redis at REDIS_ADDR, shared by the replicas, or in memory, and expire
+// DEPRECATION_RETENTION after a client's last deprecated call.
+
+// Deprecation marks a route, or only some of its parameters, as
+// deprecated.
+type Deprecation struct {
+	// Since is the date the deprecation was announced, YYYY-MM-DD
+	Since string
+	// Sunset is the date the route will be removed, YYYY-MM-DD, once set
+	Sunset string
+	// Successor is the path clients should move to
+	Successor string
+	// Fields, when set, deprecates only these query parameters and JSON
+	// body fields rather than the route, each mapped to its replacement
+	Fields map[string]string
+}
+
+// DeprecationUsage is a deprecated route or field and the clients still
+// calling it.
+type DeprecationUsage struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Field       string `json:"field,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	Since       string `json:"since"`
+	Sunset      string `json:"sunset,omitempty"`
+	Calls       int64  `json:"calls"`
+	// Clients are sorted by calls, most first
+	Clients []DeprecatedClient `json:"clients"`
+}
+
+// DeprecatedClient is a client's calls to a deprecated route or field.
+type DeprecatedClient struct {
+	Client   string    `json:"client"`
+	Calls    int64     `json:"calls"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// deprecationStore counts deprecated calls per client.
+type deprecationStore interface {
+	// Record counts a call by client to the deprecated item
+	Record(ctx context.Context, item, client string, now time.Time) error
+	// Clients returns the clients that called item within the retention
+	Clients(ctx context.Context, item string, now time.Time) ([]DeprecatedClient, error)
+}
+
+var (
+	deprecations         deprecationStore
+	deprecationRetention = 30 * 24 * time.Hour
+
+	deprecatedCalls metric.Int64Counter
+)
+
+func initDeprecations() {
+	if v, err := time.ParseDuration(os.Getenv("DEPRECATION_RETENTION")); err == nil && v > 0 {
+		deprecationRetention = v
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		deprecations = &redisDeprecationStore{client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})}
+	} else {
+		deprecations = &memoryDeprecationStore{calls: map[string]map[string]*DeprecatedClient{}}
+	}
+
+	for _, route := range routes {
+		d := route.Deprecation
+		if d == nil {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, d.Since); err != nil {
+			logger.Fatal("Deprecation needs a valid since date", zap.String("path", route.Path), zap.String("since", d.Since))
+		}
+		if _, err := time.Parse(time.DateOnly, d.Sunset); d.Sunset != "" && err != nil {
+			logger.Fatal("Invalid deprecation sunset date", zap.String("path", route.Path), zap.String("sunset", d.Sunset))
+		}
+	}
+
+	var err error
+	deprecatedCalls, err = meter.Int64Counter(
+		"gateway.deprecated.calls",
+		metric.WithDescription("Number of calls to deprecated routes and fields, by route and field"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create deprecated calls counter", zap.Error(err))
+	}
+}
+
+// deprecationItem names a deprecated route, or a field of it.
+func deprecationItem(route Route, field string) string {
+	item := route.Method + " " + route.Path
+	if field != "" {
+		item += " " + field
+	}
+	return item
+}
+
+// noteDeprecatedUse adds the deprecation headers to the response of a
+// deprecated route, or one using deprecated fields, and counts the call.
+func noteDeprecatedUse(c *gin.Context, route Route) {
+	d := route.Deprecation
+	if d == nil {
+		return
+	}
+
+	var used []string
+	if len(d.Fields) == 0 {
+		since, _ := time.Parse(time.DateOnly, d.Since)
+		c.Header("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+		if sunset, err := time.Parse(time.DateOnly, d.Sunset); err == nil {
+			c.Header("Sunset", sunset.Format(http.TimeFormat))
+		}
+		message := route.Method + " " + route.Path + " is deprecated"
+		if d.Successor != "" {
+			c.Header("Link", "<"+d.Successor+`>; rel="successor-version"`)
+			message += ", use " + d.Successor
+		}
+		c.Writer.Header().Add("Warning", `299 - "`+message+`"`)
+		used = []string{""}
+	} else {
+		for _, field := range deprecatedFieldsUsed(c, d.Fields) {
+			c.Writer.Header().Add("Warning", `299 - "`+field+" is deprecated, use "+d.Fields[field]+`"`)
+			used = append(used, field)
+		}
+	}
+	if len(used) == 0 {
+		return
+	}
+
+	ctx := c.Request.Context()
+	client, _ := quotaClient(c)
+	now := time.Now()
+	for _, field := range used {
+		deprecatedCalls.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("route", route.Method+" "+route.Path),
+			attribute.String("field", field),
+		), contextAttrs(ctx))
+	}
+	// Counted off the request path, so a slow Redis doesn't slow the call
+	go func(ctx context.Context) {
+		for _, field := range used {
+			if err := deprecations.Record(ctx, deprecationItem(route, field), client, now); err != nil {
+				loggerFor(ctx).Warn("Failed to record deprecated call", zap.Error(err))
+				return
+			}
+		}
+	}(context.WithoutCancel(ctx))
+}
+
+// deprecatedFieldsUsed returns the deprecated fields the request sends,
+// as query parameters or top-level fields of a JSON body, sorted.
+func deprecatedFieldsUsed(c *gin.Context, fields map[string]string) []string {
+	query := c.Request.URL.Query()
+	var body map[string]json.RawMessage
+	if strings.HasPrefix(c.ContentType(), gin.MIMEJSON) {
+		// Oversized or unreadable bodies are left for the proxy to reject
+		if raw, err := requestBody(c); err == nil {
+			_ = json.Unmarshal(raw, &body)
+		}
+	}
+
+	var used []string
+	for field := range fields {
+		_, inQuery := query[field]
+		_, inBody := body[field]
+		if inQuery || inBody {
+			used = append(used, field)
+		}
+	}
+	sort.Strings(used)
+	return used
+}
+
+// deprecationUsage summarizes every deprecated route and field.
+func deprecationUsage(ctx context.Context, now time.Time) ([]DeprecationUsage, error) {
+	usage := []DeprecationUsage{}
+	for _, route := range routes {
+		d := route.Deprecation
+		if d == nil {
+			continue
+		}
+		entries := []DeprecationUsage{{Replacement: d.Successor}}
+		if len(d.Fields) > 0 {
+			entries = entries[:0]
+			for field, replacement := range d.Fields {
+				entries = append(entries, DeprecationUsage{Field: field, Replacement: replacement})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Field < entries[j].Field })
+		}
+
+		for _, entry := range entries {
+			clients, err := deprecations.Clients(ctx, deprecationItem(route, entry.Field), now)
+			if err != nil {
+				return nil, err
+			}
+			sort.Slice(clients, func(i, j int) bool { return clients[i].Calls > clients[j].Calls })
+			entry.Method, entry.Path = route.Method, route.Path
+			entry.Since, entry.Sunset = d.Since, d.Sunset
+			entry.Clients = clients
+			for _, client := range clients {
+				entry.Calls += client.Calls
+			}
+			usage = append(usage, entry)
+		}
+	}
+	return usage, nil
+}
+
+// registerDeprecationRoutes serves GET /admin/deprecations, guarded like
+// the gateway's other admin routes.
+func registerDeprecationRoutes(r *gin.Engine) {
+	r.GET("/admin/deprecations", adminMiddleware(), func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		usage, err := deprecationUsage(ctx, time.Now())
+		if err != nil {
+			loggerFor(ctx).Error("Failed to read deprecated calls", zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Deprecation counters are unavailable"})
+			return
+		}
+
+		_, shared := deprecations.(*redisDeprecationStore)
+		c.JSON(http.StatusOK, gin.H{
+			"deprecations": usage,
+			"count":        len(usage),
+			"retention":    deprecationRetention.String(),
+			"shared":       shared,
+		})
+	})
+}
+
+// redisDeprecationStore keeps, for each deprecated item, a hash of calls
+// per client and a sorted set of clients by last call, so every gateway
+// replica shares them.
+type redisDeprecationStore struct {
+	client *redis.Client
+}
+
+func deprecationKeys(item string) (string, string) {
+	return "deprecation:" + item + ":calls", "deprecation:" + item + ":seen"
+}
+
+func (s *redisDeprecationStore) Record(ctx context.Context, item, client string, now time.Time) error {
+	callsKey, seenKey := deprecationKeys(item)
+	pipe := s.client.TxPipeline()
+	pipe.HIncrBy(ctx, callsKey, client, 1)
+	pipe.Expire(ctx, callsKey, deprecationRetention)
+	pipe.ZAdd(ctx, seenKey, redis.Z{Score: float64(now.Unix()), Member: client})
+	pipe.Expire(ctx, seenKey, deprecationRetention)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisDeprecationStore) Clients(ctx context.Context, item string, now time.Time) ([]DeprecatedClient, error) {
+	ctx, span := tracer.Start(ctx, "deprecations.clients")
+	defer span.End()
+
+	callsKey, seenKey := deprecationKeys(item)
+	cutoff := strconv.FormatInt(now.Add(-deprecationRetention).Unix(), 10)
+
+	// Clients whose last call is past the retention are dropped
+	pipe := s.client.TxPipeline()
+	expired := pipe.ZRangeByScore(ctx, seenKey, &redis.ZRangeBy{Min: "-inf", Max: "(" + cutoff})
+	pipe.ZRemRangeByScore(ctx, seenKey, "-inf", "("+cutoff)
+	seen := pipe.ZRangeWithScores(ctx, seenKey, 0, -1)
+	calls := pipe.HGetAll(ctx, callsKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if gone := expired.Val(); len(gone) > 0 {
+		s.client.HDel(ctx, callsKey, gone...)
+	}
+
+	clients := make([]DeprecatedClient, 0, len(seen.Val()))
+	for _, z := range seen.Val() {
+		client, _ := z.Member.(string)
+		n, _ := strconv.ParseInt(calls.Val()[client], 10, 64)
+		clients = append(clients, DeprecatedClient{
+			Client:   client,
+			Calls:    n,
+			LastSeen: time.Unix(int64(z.Score), 0).UTC(),
+		})
+	}
+	return clients, nil
+}
+
+// memoryDeprecationStore is the single-replica fallback used without
+// Redis.
+type memoryDeprecationStore struct {
+	mu    sync.Mutex
+	calls map[string]map[string]*DeprecatedClient
+}
+
+func (s *memoryDeprecationStore) Record(_ context.Context, item, client string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients, ok := s.calls[item]
+	if !ok {
+		clients = map[string]*DeprecatedClient{}
+		s.calls[item] = clients
+	}
+	entry, ok := clients[client]
+	if !ok {
+		entry = &DeprecatedClient{Client: client}
+		clients[client] = entry
+	}
+	entry.Calls++
+	entry.LastSeen = now.UTC().Truncate(time.Second)
+	return nil
+}
+
+func (s *memoryDeprecationStore) Clients(_ context.Context, item string, now time.Time) ([]DeprecatedClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-deprecationRetention)
+	clients := []DeprecatedClient{}
+	for name, entry := range s.calls[item] {
+		if entry.LastSeen.Before(cutoff) {
+			delete(s.calls[item], name)
+			continue
+		}
+		clients = append(clients, *entry)
+	}
+	return clients, nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// A backend's replicas are found by a resolver, chosen by the form of its
+// address (the backend's environment variable, see routes.go):
+//
+//   - "host[:port],..." static addresses, used as given
+//   - "dns+srv://_http._tcp.jokes-service.prod.svc.cluster.local" the
+//     targets of a DNS SRV lookup, e.g. the pods behind a headless service
+//   - "k8s://jokes-service.prod:http" the ready addresses of a service's
+//     Endpoints, watched through the Kubernetes API. The namespace defaults
+//     to the gateway's own; the port, a name or a pod port number, to the
+//     one named "http" or the only one
+//
+// A backend whose variable is unset is found by its service name in the
+// gateway's namespace (POD_NAMESPACE, else the service account's), the
+// way SERVICE_DISCOVERY says: "static" (the default) addresses the
+// service's cluster IP, "dns" looks up its "http" SRV records and
+// "kubernetes" watches its Endpoints. The last two reach the pods
+// directly, so round robin and sticky routing (see balance.go) spread
+// requests over pods rather than over connections to the cluster IP.
+//
+// SRV lookups are repeated every DISCOVERY_REFRESH_INTERVAL (default 10s),
+// and a failed watch is restarted after it; both keep the endpoints they
+// last found meanwhile. Until they find any, e.g. when the Kubernetes API
+// can't be reached or the gateway may not read Endpoints, the service's
+// cluster DNS name is used instead.
+
+// Service discovery modes
+const (
+	discoveryStatic     = "static"
+	discoveryDNS        = "dns"
+	discoveryKubernetes = "kubernetes"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// watchTimeout is how long the Kubernetes API keeps a watch open
+const watchTimeout = 5 * time.Minute
+
+// resolver finds the replica addresses of a backend.
+type resolver interface {
+	endpoints() []string
+}
+
+var (
+	discoveryMode     = discoveryStatic
+	discoveryInterval = 10 * time.Second
+	clusterDomain     = "cluster.local"
+	podNamespace      = "default"
+
+	// resolvers holds the resolver of every configured backend; it is
+	// filled at startup and only read afterwards
+	resolvers = map[string]resolver{}
+
+	// kubernetes is the in-cluster API client, set up for the first
+	// k8s:// address
+	kubernetes *kubernetesAPI
+
+	errNotInCluster = errors.New("not running in a Kubernetes cluster")
+)
+
+func initDiscovery() {
+	switch mode := strings.ToLower(os.Getenv("SERVICE_DISCOVERY")); mode {
+	case "", discoveryStatic:
+	case discoveryDNS, discoveryKubernetes:
+		discoveryMode = mode
+	default:
+		logger.Warn("Unknown service discovery mode, using static", zap.String("mode", mode))
+	}
+	if v, err := time.ParseDuration(os.Getenv("DISCOVERY_REFRESH_INTERVAL")); err == nil && v > 0 {
+		discoveryInterval = v
+	}
+	if v := os.Getenv("CLUSTER_DOMAIN"); v != "" {
+		clusterDomain = v
+	}
+	podNamespace = currentNamespace()
+
+	for name := range backends {
+		addr := backendURL(name)
+		if addr == "" {
+			continue
+		}
+		r, err := newResolver(name, addr)
+		if err != nil {
+			logger.Fatal("Invalid backend address",
+				zap.String("backend", name),
+				zap.String("address", addr),
+				zap.Error(err),
+			)
+		}
+		resolvers[name] = r
+	}
+
+	_, err := meter.Int64ObservableGauge(
+		"gateway.backend.endpoints",
+		metric.WithDescription("Number of replica addresses known for each backend"),
+		metric.WithUnit("{endpoint}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for name, r := range resolvers {
+				o.Observe(int64(len(r.endpoints())), metric.WithAttributes(attribute.String("backend", name)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create backend endpoints gauge", zap.Error(err))
+	}
+
+	logger.Info("Service discovery configured",
+		zap.String("mode", discoveryMode),
+		zap.String("namespace", podNamespace),
+	)
+}
+
+// currentNamespace returns the namespace the gateway runs in.
+func currentNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		if ns = bytes.TrimSpace(ns); len(ns) > 0 {
+			return string(ns)
+		}
+	}
+	return "default"
+}
+
+// serviceDomain returns the cluster DNS name of a service.
+func serviceDomain(service, namespace string) string {
+	return service + "." + namespace + ".svc." + clusterDomain
+}
+
+// defaultBackendAddress returns the address of a service in the gateway's
+// namespace for the discovery mode.
+func defaultBackendAddress(service string) string {
+	switch discoveryMode {
+	case discoveryDNS:
+		return "dns+srv://_http._tcp." + serviceDomain(service, podNamespace)
+	case discoveryKubernetes:
+		return "k8s://" + service + "." + podNamespace
+	}
+	return serviceDomain(service, podNamespace)
+}
+
+// newResolver returns the resolver for a backend address.
+func newResolver(backend, addr string) (resolver, error) {
+	switch {
+	case strings.HasPrefix(addr, "dns+srv://"):
+		name := strings.TrimPrefix(addr, "dns+srv://")
+		if name == "" {
+			return nil, errors.New("missing SRV name")
+		}
+		r := &srvResolver{
+			dynamicEndpoints: dynamicEndpoints{backend: backend, fallback: []string{srvHost(name)}},
+			name:             name,
+		}
+		go r.run()
+		return r, nil
+
+	case strings.HasPrefix(addr, "k8s://"):
+		target, port, _ := strings.Cut(strings.TrimPrefix(addr, "k8s://"), ":")
+		service, namespace, _ := strings.Cut(target, ".")
+		if service == "" {
+			return nil, errors.New("missing service name")
+		}
+		if namespace == "" {
+			namespace = podNamespace
+		}
+		fallback := serviceDomain(service, namespace)
+
+		if kubernetes == nil {
+			api, err := inClusterAPI()
+			if err != nil {
+				logger.Warn("Cannot watch Endpoints, using the service address",
+					zap.String("backend", backend),
+					zap.String("address", fallback),
+					zap.Error(err),
+				)
+				return staticResolver{fallback}, nil
+			}
+			kubernetes = api
+		}
+		w := &endpointsWatcher{
+			dynamicEndpoints: dynamicEndpoints{backend: backend, fallback: []string{fallback}},
+			namespace:        namespace,
+			service:          service,
+			port:             port,
+		}
+		go w.run()
+		return w, nil
+	}
+	return staticResolver(splitList(addr)), nil
+}
+
+// staticResolver returns the addresses it was configured with.
+type staticResolver []string
+
+func (r staticResolver) endpoints() []string {
+	return r
+}
+
+// dynamicEndpoints holds the endpoints a background lookup last found.
+type dynamicEndpoints struct {
+	backend string
+	current atomic.Pointer[[]string]
+	// fallback is used while no endpoints are known
+	fallback []string
+}
+
+func (d *dynamicEndpoints) endpoints() []string {
+	if current := d.current.Load(); current != nil && len(*current) > 0 {
+		return *current
+	}
+	return d.fallback
+}
+
+// update replaces the endpoints, sorted so that unchanged sets compare
+// equal whatever order they were found in.
+func (d *dynamicEndpoints) update(endpoints []string) {
+	slices.Sort(endpoints)
+	if current := d.current.Load(); current != nil && slices.Equal(*current, endpoints) {
+		return
+	}
+	d.current.Store(&endpoints)
+	logger.Info("Backend endpoints changed",
+		zap.String("backend", d.backend),
+		zap.Strings("endpoints", endpoints),
+	)
+}
+
+// srvResolver polls the targets of a DNS SRV name.
+type srvResolver struct {
+	dynamicEndpoints
+	name string
+}
+
+func (r *srvResolver) run() {
+	for {
+		r.lookup()
+		time.Sleep(discoveryInterval)
+	}
+}
+
+func (r *srvResolver) lookup() {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryInterval)
+	defer cancel()
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		logger.Warn("SRV lookup failed",
+			zap.String("backend", r.backend),
+			zap.String("name", r.name),
+			zap.Error(err),
+		)
+		return
+	}
+	endpoints := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	r.update(endpoints)
+}
+
+// srvHost strips the service and protocol labels from an SRV name.
+func srvHost(name string) string {
+	for strings.HasPrefix(name, "_") {
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return name
+}
+
+// kubernetesAPI calls the API server with the pod's service account.
+type kubernetesAPI struct {
+	base   string
+	client *http.Client
+}
+
+func inClusterAPI() (*kubernetesAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errNotInCluster
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account CA bundle")
+	}
+	return &kubernetesAPI{
+		base: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:       &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+			ResponseHeaderTimeout: 10 * time.Second,
+		}},
+	}, nil
+}
+
+// get sends an authenticated GET. The token is read for every request, as
+// the kubelet rotates it.
+func (api *kubernetesAPI) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// k8sEndpoints is the part of a Kubernetes Endpoints object the watcher
+// reads; only ready addresses are listed in Addresses.
+type k8sEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// k8sWatchEvent is one event of a Kubernetes watch stream.
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// endpointsWatcher follows the Endpoints of a service.
+type endpointsWatcher struct {
+	dynamicEndpoints
+	namespace string
+	service   string
+	port      string
+}
+
+func (w *endpointsWatcher) run() {
+	for {
+		if err := w.watch(); err != nil {
+			logger.Warn("Endpoints watch failed",
+				zap.String("backend", w.backend),
+				zap.String("service", w.namespace+"/"+w.service),
+				zap.Error(err),
+			)
+			time.Sleep(discoveryInterval)
+		}
+	}
+}
+
+// watch follows the service's Endpoints until the API server ends the
+// watch. A watch without a resourceVersion starts with the current state,
+// so restarting it never misses a change.
+func (w *endpointsWatcher) watch() error {
+	query := url.Values{
+		"watch":          {"true"},
+		"fieldSelector":  {"metadata.name=" + w.service},
+		"timeoutSeconds": {strconv.Itoa(int(watchTimeout.Seconds()))},
+	}
+	resp, err := kubernetes.get(context.Background(), "/api/v1/namespaces/"+url.PathEscape(w.namespace)+"/endpoints", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event k8sWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var endpoints k8sEndpoints
+			if err := json.Unmarshal(event.Object, &endpoints); err != nil {
+				return err
+			}
+			w.update(w.addresses(endpoints))
+		case "DELETED":
+			w.update(nil)
+		case "ERROR":
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+	}
+}
+
+// addresses lists the ready pod addresses of endpoints on the watched port.
+func (w *endpointsWatcher) addresses(endpoints k8sEndpoints) []string {
+	var addrs []string
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		if n, err := strconv.Atoi(w.port); err == nil {
+			port = n
+		} else {
+			for _, p := range subset.Ports {
+				if p.Name == w.port || (w.port == "" && (p.Name == "http" || len(subset.Ports) == 1)) {
+					port = p.Port
+					break
+				}
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			addrs = append(addrs, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+	}
+	return addrs
+}
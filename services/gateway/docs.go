@@ -0,0 +1,126 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed static/docs.html
+var docsPage []byte
+
+// openAPISpec builds an OpenAPI 3 document from the route table, so the
+// docs always match what the gateway actually serves.
+func openAPISpec() gin.H {
+	paths := gin.H{}
+
+	for _, route := range append(append([]Route{}, localRoutes...), routes...) {
+		path, params := openAPIPath(route.Path)
+
+		parameters := []gin.H{}
+		for _, p := range params {
+			parameters = append(parameters, gin.H{
+				"name": p, "in": "path", "required": true,
+				"schema": gin.H{"type": "string"},
+			})
+		}
+		for _, q := range route.Query {
+			parameters = append(parameters, gin.H{
+				"name": q, "in": "query", "required": false,
+				"schema": gin.H{"type": "string"},
+			})
+		}
+
+		operation := gin.H{
+			"summary":    route.Summary,
+			"parameters": parameters,
+			"responses": gin.H{
+				"200": gin.H{"description": "Success"},
+			},
+		}
+		if route.Backend != "" {
+			operation["tags"] = []string{route.Backend}
+		}
+		var notes []string
+		if match := route.Match.describe(); match != "" {
+			notes = append(notes, "Only served for requests with "+match+".")
+		}
+		if route.Admin {
+			notes = append(notes, "Requires the admin token or a signed-in admin user.")
+		}
+		if route.RequireUser {
+			notes = append(notes, "Requires login when OIDC or magic-link login is enabled.")
+		}
+		if route.Scope != "" {
+			notes = append(notes, "API keys limited to scopes need "+route.Scope+".")
+		}
+		if d := route.Deprecation; d != nil && len(d.Fields) == 0 {
+			operation["deprecated"] = true
+			if d.Sunset != "" {
+				notes = append(notes, "Removed on "+d.Sunset+".")
+			}
+		}
+		if len(notes) > 0 {
+			operation["description"] = strings.Join(notes, " ")
+		}
+		if route.Example != "" {
+			operation["requestBody"] = gin.H{
+				"required": true,
+				"content": gin.H{
+					"application/json": gin.H{"example": route.Example},
+				},
+			}
+		}
+
+		item, ok := paths[path].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "Jokes API",
+			"version": "1.0.0",
+		},
+		"components": gin.H{
+			"securitySchemes": gin.H{
+				"apiKey": gin.H{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIPath converts gin path syntax to OpenAPI syntax and returns the
+// names of the path parameters.
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if len(seg) > 1 && (seg[0] == ':' || seg[0] == '*') {
+			params = append(params, seg[1:])
+			segments[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// registerDocsRoutes serves the OpenAPI spec and the embedded API explorer.
+func registerDocsRoutes(r *gin.Engine) {
+	spec := openAPISpec()
+
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+
+	r.GET("/docs", func(c *gin.Context) {
+		c.Header("Content-Security-Policy", docsContentSecurityPolicy)
+		c.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Requests are located coarsely, to a country and, where the provider
+// knows it, a region, so analytics can break the traffic down by
+// geography (GET /api/v1/stats/geo). The gateway looks the client IP up
+// with the GeoIPProvider GEOIP_PROVIDER names and forwards only the result,
+// as the client.country and client.region baggage members the jokes
+// service reports to analytics; the IP never leaves the gateway.
+//
+//   - "header" takes the location an edge proxy or CDN in front of the
+//     gateway already worked out, from GEOIP_COUNTRY_HEADER (default
+//     CF-IPCountry) and GEOIP_REGION_HEADER (default none). Only for
+//     gateways that every request reaches through that edge, as clients
+//     can send the headers themselves.
+//   - "file" reads GEOIP_DB_FILE, lines of "network,country[,region]"
+//     such as "203.0.113.0/24,AU,NSW"; the longest matching network wins.
+//     Most GeoIP databases export to it.
+//
+// Without GEOIP_PROVIDER requests aren't located. Countries are ISO 3166-1
+// alpha-2 codes and regions the subdivision part of ISO 3166-2 codes
+// ("NSW" of "AU-NSW"); anything else a provider returns is dropped, which
+// also bounds what analytics has to count.
+
+// Baggage members carrying the client's location
+const (
+	clientCountryBaggageKey = "client.country"
+	clientRegionBaggageKey  = "client.region"
+)
+
+// GeoLocation is where a client is, as far as its IP tells.
+type GeoLocation struct {
+	Country string
+	Region  string
+}
+
+// GeoIPProvider locates the client of a request from its IP.
+type GeoIPProvider interface {
+	Locate(r *http.Request, ip netip.Addr) (GeoLocation, bool)
+}
+
+var (
+	geoIPProvider GeoIPProvider
+
+	validCountry = regexp.MustCompile(`^[A-Z]{2}$`)
+	validRegion  = regexp.MustCompile(`^[A-Z0-9]{1,3}$`)
+)
+
+func initGeoIP() {
+	switch provider := os.Getenv("GEOIP_PROVIDER"); provider {
+	case "":
+		return
+	case "header":
+		country := os.Getenv("GEOIP_COUNTRY_HEADER")
+		if country == "" {
+			country = "CF-IPCountry"
+		}
+		geoIPProvider = headerGeoIP{countryHeader: country, regionHeader: os.Getenv("GEOIP_REGION_HEADER")}
+	case "file":
+		db, err := loadGeoIPFile(os.Getenv("GEOIP_DB_FILE"))
+		if err != nil {
+			logger.Fatal("Failed to load GEOIP_DB_FILE", zap.Error(err))
+		}
+		geoIPProvider = db
+	default:
+		// The startup check rejects it (see selfcheck.go)
+		logger.Warn("Unknown GEOIP_PROVIDER, not locating clients", zap.String("value", provider))
+		return
+	}
+	logger.Info("Client geolocation enabled", zap.String("provider", os.Getenv("GEOIP_PROVIDER")))
+}
+
+// headerGeoIP reads the location set by an edge proxy.
+type headerGeoIP struct {
+	countryHeader string
+	regionHeader  string
+}
+
+func (h headerGeoIP) Locate(r *http.Request, _ netip.Addr) (GeoLocation, bool) {
+	location := GeoLocation{Country: strings.ToUpper(strings.TrimSpace(r.Header.Get(h.countryHeader)))}
+	if h.regionHeader != "" {
+		location.Region = strings.ToUpper(strings.TrimSpace(r.Header.Get(h.regionHeader)))
+	}
+	return location, location.Country != ""
+}
+
+// fileGeoIP is a table of networks, looked up by prefix length, longest
+// first.
+type fileGeoIP struct {
+	networks map[netip.Prefix]GeoLocation
+	// bits are the prefix lengths in the table, longest first
+	bits []int
+}
+
+// loadGeoIPFile reads a "network,country[,region]" table. Blank lines and
+// lines starting with # are skipped.
+func loadGeoIPFile(path string) (*fileGeoIP, error) {
+	if path == "" {
+		return nil, fmt.Errorf("GEOIP_DB_FILE is not set")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &fileGeoIP{networks: map[netip.Prefix]GeoLocation{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want network,country[,region]", path, line)
+		}
+		network, err := netip.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		location := GeoLocation{Country: strings.ToUpper(strings.TrimSpace(fields[1]))}
+		if len(fields) == 3 {
+			location.Region = strings.ToUpper(strings.TrimSpace(fields[2]))
+		}
+		network = network.Masked()
+		db.networks[network] = location
+		if !slices.Contains(db.bits, network.Bits()) {
+			db.bits = append(db.bits, network.Bits())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(db.bits)
+	slices.Reverse(db.bits)
+	return db, nil
+}
+
+func (db *fileGeoIP) Locate(_ *http.Request, ip netip.Addr) (GeoLocation, bool) {
+	ip = ip.Unmap()
+	for _, bits := range db.bits {
+		if bits > ip.BitLen() {
+			continue
+		}
+		network, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if location, ok := db.networks[network]; ok {
+			return location, true
+		}
+	}
+	return GeoLocation{}, false
+}
+
+// locateClient returns the client's location, if the provider knows it
+// and it is well formed.
+func locateClient(c *gin.Context) (GeoLocation, bool) {
+	if geoIPProvider == nil {
+		return GeoLocation{}, false
+	}
+	ip, err := netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return GeoLocation{}, false
+	}
+	location, ok := geoIPProvider.Locate(c.Request, ip)
+	if !ok || !validCountry.MatchString(location.Country) {
+		return GeoLocation{}, false
+	}
+	if !validRegion.MatchString(location.Region) {
+		location.Region = ""
+	}
+	return location, true
+}
+
+// withClientLocation returns a copy of ctx whose baggage carries the
+// client's location, and never one the client sent.
+func withClientLocation(ctx context.Context, c *gin.Context) context.Context {
+	b := baggage.FromContext(ctx).DeleteMember(clientCountryBaggageKey).DeleteMember(clientRegionBaggageKey)
+	ctx = baggage.ContextWithBaggage(ctx, b)
+
+	location, ok := locateClient(c)
+	if !ok {
+		return ctx
+	}
+	members := map[string]string{clientCountryBaggageKey: location.Country}
+	attrs := []attribute.KeyValue{attribute.String(clientCountryBaggageKey, location.Country)}
+	if location.Region != "" {
+		members[clientRegionBaggageKey] = location.Region
+		attrs = append(attrs, attribute.String(clientRegionBaggageKey, location.Region))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+	return withBaggageMembers(ctx, members)
+}
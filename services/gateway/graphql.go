@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlotel "github.com/graph-gophers/graphql-go/trace/otel"
+	"github.com/navyn13/microservice-joke/pkg/client"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// The schema in static/schema.graphql is served with graph-gophers/
+// graphql-go rather than gqlgen. graphql-go binds the schema to the
+// resolver methods by reflection when the gateway starts, so there is no
+// generated code to regenerate and check in with every schema change, and
+// its OpenTelemetry tracer gives every resolver a span. What gqlgen would
+// catch at compile time, a schema field without a matching resolver, fails
+// ParseSchema instead, which stops the gateway at startup and fails
+// TestGraphQLSchema.
+
+//go:embed static/schema.graphql
+var graphqlSchema string
+
+// graphqlUserKey carries the authenticated user ID into resolvers
+type graphqlUserKey struct{}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Resolved types. Fields are resolved by name (UseFieldResolvers), so
+// they must match the schema.
+type gqlJoke struct {
+	ID        graphql.ID
+	Joke      string
+	Category  string
+	Author    string
+	Language  string
+	CreatedAt string
+	Reactions *gqlReactions
+}
+
+type gqlReactions struct {
+	Laugh int32
+	Groan int32
+	Meh   int32
+}
+
+type gqlFavorite struct {
+	ID               graphql.ID
+	JokeID           string
+	Joke             string
+	UserID           string
+	CreatedAt        string
+	AlreadyFavorited bool
+}
+
+type gqlFavoriteList struct {
+	Count     int32
+	Favorites []*gqlFavorite
+}
+
+type gqlStats struct {
+	TotalJokes    float64
+	TotalRequests float64
+	LastUpdate    string
+}
+
+// graphqlResolver resolves the root Query and Mutation types. Sibling
+// fields are resolved concurrently by graphql-go, so a query for joke,
+// favorites and stats calls the three backends in parallel.
+type graphqlResolver struct{}
+
+// graphqlUser returns the user a resolver acts for: the logged-in user,
+// else the userId argument. It fails if login is required and missing.
+func graphqlUser(ctx context.Context, arg *string, requireLogin bool) (string, error) {
+	if userID, _ := ctx.Value(graphqlUserKey{}).(string); userID != "" {
+		return userID, nil
+	}
+	if requireLogin && loginEnabled() {
+		return "", errors.New("authentication required")
+	}
+	if arg != nil {
+		return *arg, nil
+	}
+	return "", nil
+}
+
+// graphqlScope fails a field needing a scope the caller lacks.
+func graphqlScope(ctx context.Context, scope string) error {
+	if !contextHasScope(ctx, scope) {
+		return errors.New(missingScopeMessage(scope))
+	}
+	return nil
+}
+
+func (*graphqlResolver) Joke(ctx context.Context, args struct{ UserID *string }) (*gqlJoke, error) {
+	if err := graphqlScope(ctx, scopeJokesRead); err != nil {
+		return nil, err
+	}
+	userID, err := graphqlUser(ctx, args.UserID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	joke, err := jokesClient.RandomJoke(ctx, client.JokeOptions{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &gqlJoke{
+		ID:        graphql.ID(joke.ID),
+		Joke:      joke.Joke,
+		Category:  joke.Category,
+		Author:    joke.Author,
+		Language:  joke.Language,
+		CreatedAt: joke.CreatedAt.Format(time.RFC3339),
+		Reactions: &gqlReactions{
+			Laugh: int32(joke.Reactions.Laugh),
+			Groan: int32(joke.Reactions.Groan),
+			Meh:   int32(joke.Reactions.Meh),
+		},
+	}, nil
+}
+
+func (*graphqlResolver) Favorites(ctx context.Context, args struct{ UserID *string }) (*gqlFavoriteList, error) {
+	if err := graphqlScope(ctx, scopeFavoritesRead); err != nil {
+		return nil, err
+	}
+	userID, err := graphqlUser(ctx, args.UserID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	favorites, err := userClient.Favorites(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &gqlFavoriteList{Count: int32(favorites.Count), Favorites: []*gqlFavorite{}}
+	for _, fav := range favorites.Favorites {
+		list.Favorites = append(list.Favorites, toGQLFavorite(fav))
+	}
+	return list, nil
+}
+
+func (*graphqlResolver) Stats(ctx context.Context) (*gqlStats, error) {
+	if err := graphqlScope(ctx, scopeStatsRead); err != nil {
+		return nil, err
+	}
+	stats, err := analyticsClient.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlStats{
+		TotalJokes:    float64(stats.TotalJokes),
+		TotalRequests: float64(stats.TotalRequests),
+		LastUpdate:    stats.LastUpdate.Format(time.RFC3339),
+	}, nil
+}
+
+func (*graphqlResolver) AddFavorite(ctx context.Context, args struct {
+	JokeID *graphql.ID
+	Joke   *string
+	UserID *string
+}) (*gqlFavorite, error) {
+	if err := graphqlScope(ctx, scopeFavoritesWrite); err != nil {
+		return nil, err
+	}
+	userID, err := graphqlUser(ctx, args.UserID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var fav *client.Favorite
+	switch {
+	case args.JokeID != nil:
+		fav, err = userClient.AddFavoriteByID(ctx, userID, string(*args.JokeID))
+	case args.Joke != nil:
+		fav, err = userClient.AddFavorite(ctx, userID, *args.Joke)
+	default:
+		return nil, errors.New("jokeId or joke is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return toGQLFavorite(*fav), nil
+}
+
+func toGQLFavorite(fav client.Favorite) *gqlFavorite {
+	return &gqlFavorite{
+		ID:               graphql.ID(fav.ID),
+		JokeID:           fav.JokeID,
+		Joke:             fav.Joke,
+		UserID:           fav.UserID,
+		CreatedAt:        fav.CreatedAt.Format(time.RFC3339Nano),
+		AlreadyFavorited: fav.AlreadyFavorited,
+	}
+}
+
+// registerGraphQLRoutes serves POST /graphql. Each resolver gets its own
+// span, alongside the spans of the backend calls it makes.
+func registerGraphQLRoutes(r *gin.Engine) {
+	schema, err := graphql.ParseSchema(graphqlSchema, &graphqlResolver{},
+		graphql.UseFieldResolvers(),
+		graphql.Tracer(&gqlotel.Tracer{Tracer: tracer}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to parse GraphQL schema", zap.Error(err))
+	}
+
+	r.POST("/graphql", func(c *gin.Context) {
+		var req graphqlRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), graphqlUserKey{}, c.GetString(userIDKey))
+		ctx = withCallerScopes(ctx, c)
+		c.JSON(http.StatusOK, schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+	})
+}
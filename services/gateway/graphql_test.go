@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+func TestGraphQLSchema(t *testing.T) {
+	if _, err := graphql.ParseSchema(graphqlSchema, &graphqlResolver{}, graphql.UseFieldResolvers()); err != nil {
+		t.Fatalf("schema doesn't match the resolvers: %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Error responses are localized for the client's Accept-Language. The
+// gateway writes its errors in English as usual, {"error": "..."}; on the
+// way out, JSON responses with a 4xx or 5xx status are matched against the
+// English catalog, and a known message is replaced with its translation
+// in the best language the client accepts, with its catalog ID added as
+// "code" so clients can tell errors apart in any language. Messages that
+// aren't in the catalog, such as most backend errors, are left in English.
+//
+// Catalogs are embedded from i18n/<language>.json, message ID to text;
+// {name} placeholders stand for the variable parts of a message, and IDs
+// starting with "page_" are the text of error pages rather than messages.
+// Clients that prefer HTML, such as browsers, get the error as a page
+// instead.
+
+//go:embed i18n/*.json
+var catalogFiles embed.FS
+
+// defaultLanguage is the language the gateway writes its errors in
+const defaultLanguage = "en"
+
+var (
+	// catalogs maps language and message ID to text
+	catalogs = map[string]map[string]string{}
+	// messagePatterns match English messages to their IDs
+	messagePatterns []messagePattern
+
+	placeholder = regexp.MustCompile(`\{(\w+)\}`)
+)
+
+// messagePattern matches the English text of a message.
+type messagePattern struct {
+	id      string
+	pattern *regexp.Regexp
+	// names are the placeholders, in order
+	names []string
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Language}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+func initI18n() {
+	files, err := catalogFiles.ReadDir("i18n")
+	if err != nil {
+		logger.Fatal("Failed to read message catalogs", zap.Error(err))
+	}
+	for _, file := range files {
+		content, err := catalogFiles.ReadFile("i18n/" + file.Name())
+		if err != nil {
+			logger.Fatal("Failed to read message catalog", zap.String("file", file.Name()), zap.Error(err))
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(content, &catalog); err != nil {
+			logger.Fatal("Invalid message catalog", zap.String("file", file.Name()), zap.Error(err))
+		}
+		catalogs[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = catalog
+	}
+
+	ids := make([]string, 0, len(catalogs[defaultLanguage]))
+	for id := range catalogs[defaultLanguage] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if strings.HasPrefix(id, "page_") {
+			continue
+		}
+		text := catalogs[defaultLanguage][id]
+		p := messagePattern{id: id}
+		expr := "^"
+		last := 0
+		for _, m := range placeholder.FindAllStringSubmatchIndex(text, -1) {
+			expr += regexp.QuoteMeta(text[last:m[0]]) + "(.+?)"
+			p.names = append(p.names, text[m[2]:m[3]])
+			last = m[1]
+		}
+		p.pattern = regexp.MustCompile(expr + regexp.QuoteMeta(text[last:]) + "$")
+		messagePatterns = append(messagePatterns, p)
+	}
+
+	languages := make([]string, 0, len(catalogs))
+	for language := range catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	logger.Info("Error message catalogs loaded", zap.Strings("languages", languages))
+}
+
+// requestLanguage picks the catalog language for an Accept-Language
+// header: the accepted language with the highest weight that has a
+// catalog, by exact tag or by its primary language ("pt-BR" takes "pt"),
+// else defaultLanguage.
+func requestLanguage(acceptLanguage string) string {
+	type accepted struct {
+		tag    string
+		weight float64
+	}
+	var tags []accepted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = v
+			}
+		}
+		if tag != "" && weight > 0 {
+			tags = append(tags, accepted{strings.ToLower(tag), weight})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].weight > tags[j].weight })
+
+	for _, t := range tags {
+		if _, ok := catalogs[t.tag]; ok {
+			return t.tag
+		}
+		primary, _, _ := strings.Cut(t.tag, "-")
+		if _, ok := catalogs[primary]; ok {
+			return primary
+		}
+	}
+	return defaultLanguage
+}
+
+// localizeMessage translates an English catalog message into language,
+// returning its ID, or false if it isn't in the catalog.
+func localizeMessage(message, language string) (string, string, bool) {
+	for _, p := range messagePatterns {
+		m := p.pattern.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		args := map[string]string{}
+		for i, name := range p.names {
+			args[name] = m[i+1]
+		}
+		return translate(language, p.id, args), p.id, true
+	}
+	return message, "", false
+}
+
+// translate returns the text of message id in language, falling back to
+// defaultLanguage, with its placeholders filled in from args.
+func translate(language, id string, args map[string]string) string {
+	text, ok := catalogs[language][id]
+	if !ok {
+		text = catalogs[defaultLanguage][id]
+	}
+	for name, value := range args {
+		text = strings.ReplaceAll(text, "{"+name+"}", value)
+	}
+	return text
+}
+
+// localizeErrorsMiddleware localizes JSON error responses, and renders
+// them as pages for clients that prefer HTML. It must run outside the
+// panic recovery and body limit (see main.go), whose errors it localizes
+// too.
+func localizeErrorsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := &localizingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if writer.buffering {
+			writeLocalizedError(c, writer.body.Bytes())
+		}
+	}
+}
+
+// writeLocalizedError writes a buffered JSON error body localized for the
+// client.
+func writeLocalizedError(c *gin.Context, body []byte) {
+	header := c.Writer.Header()
+	header.Add("Vary", "Accept-Language")
+	header.Add("Vary", "Accept")
+
+	// Numbers are kept as written, however large
+	var response map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	message, isString := "", false
+	if err := decoder.Decode(&response); err == nil {
+		message, isString = response["error"].(string)
+	}
+	if !isString {
+		c.Writer.Write(body)
+		return
+	}
+
+	language := requestLanguage(c.GetHeader("Accept-Language"))
+	localized, id, known := localizeMessage(message, language)
+	if known {
+		header.Set("Content-Language", language)
+		response["error"] = localized
+		if _, exists := response["code"]; !exists {
+			response["code"] = id
+		}
+	}
+
+	status := c.Writer.Status()
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		title := translate(language, "page_title", map[string]string{"status": strconv.Itoa(status)})
+		var page bytes.Buffer
+		if err := errorPage.Execute(&page, gin.H{
+			"Language": language,
+			"Title":    title,
+			"Message":  response["error"],
+		}); err == nil {
+			header.Set("Content-Type", "text/html; charset=utf-8")
+			header.Del("Content-Length")
+			c.Writer.Write(page.Bytes())
+			return
+		}
+	}
+
+	localizedBody, err := json.Marshal(response)
+	if err != nil {
+		c.Writer.Write(body)
+		return
+	}
+	header.Del("Content-Length")
+	c.Writer.Write(localizedBody)
+}
+
+// localizingWriter holds back the body of JSON error responses, so it can
+// be localized once the handler is done; other responses pass through,
+// streamed ones included.
+type localizingWriter struct {
+	gin.ResponseWriter
+	decided   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+// decide chooses whether to buffer the response, once its status and
+// content type are set.
+func (w *localizingWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	mediaType, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
+	w.buffering = w.Status() >= http.StatusBadRequest && strings.TrimSpace(mediaType) == gin.MIMEJSON
+}
+
+func (w *localizingWriter) Write(b []byte) (int, error) {
+	w.decide()
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *localizingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *localizingWriter) WriteHeaderNow() {
+	w.decide()
+	if !w.buffering {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *localizingWriter) Flush() {
+	if !w.buffering {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *localizingWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
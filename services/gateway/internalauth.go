@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+)
+
+// Routes marked Internal reach the backends' /internal routes, which expect
+// requests signed with INTERNAL_AUTH_SECRET (see pkg/middleware).
+var internalAuth middleware.InternalAuth
+
+func initInternalAuth() {
+	internalAuth = middleware.InternalAuth{
+		Service: "api-gateway",
+		Secret:  []byte(os.Getenv("INTERNAL_AUTH_SECRET")),
+	}
+	if len(internalAuth.Secret) == 0 {
+		logger.Warn("INTERNAL_AUTH_SECRET not set, admin routes will be proxied unsigned and rejected by the backends")
+	}
+}
+
+// signRequest adds the internal auth headers to req. body must be the
+// exact bytes sent as the request body.
+func signRequest(req *http.Request, body []byte) {
+	internalAuth.Sign(req, body)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Each gateway replica holds at most a fixed number of in-flight requests
+// per backend, so a slow backend gets a bounded number of connections
+// instead of a pile-up. A request finding the backend full waits up to
+// BACKEND_QUEUE_TIMEOUT for a slot, with at most as many requests waiting
+// as the limit allows in flight, and is otherwise shed with 503.
+
+// backendLimiter bounds the in-flight requests to one backend.
+type backendLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+var (
+	// backendLimiters holds the limiter of every limited backend; it is
+	// filled at startup and only read afterwards
+	backendLimiters = map[string]*backendLimiter{}
+	queueTimeout    = 250 * time.Millisecond
+
+	backendShed metric.Int64Counter
+
+	errBackendOverloaded = errors.New("backend overloaded")
+)
+
+// initBackendLimits reads BACKEND_MAX_IN_FLIGHT (default 100, 0 for no
+// limit), per-backend overrides in BACKEND_IN_FLIGHT_LIMITS
+// ("user=20,analytics=50") and BACKEND_QUEUE_TIMEOUT.
+func initBackendLimits() {
+	limits := map[string]int{}
+	defaultLimit := 100
+	if v, err := strconv.Atoi(os.Getenv("BACKEND_MAX_IN_FLIGHT")); err == nil && v >= 0 {
+		defaultLimit = v
+	}
+	for name := range backends {
+		limits[name] = defaultLimit
+	}
+	for _, entry := range strings.Split(os.Getenv("BACKEND_IN_FLIGHT_LIMITS"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(value)
+		if _, known := backends[name]; !known || err != nil || limit < 0 {
+			logger.Warn("Ignoring invalid backend limit", zap.String("entry", entry))
+			continue
+		}
+		limits[name] = limit
+	}
+	if v, err := time.ParseDuration(os.Getenv("BACKEND_QUEUE_TIMEOUT")); err == nil && v >= 0 {
+		queueTimeout = v
+	}
+
+	for name, limit := range limits {
+		if limit > 0 {
+			backendLimiters[name] = &backendLimiter{slots: make(chan struct{}, limit)}
+		}
+	}
+
+	var err error
+	backendShed, err = meter.Int64Counter(
+		"gateway.backend.shed",
+		metric.WithDescription("Number of requests shed because a backend had too many in flight"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create backend shed counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"gateway.backend.in_flight",
+		metric.WithDescription("Number of requests in flight to each backend"),
+		metric.WithUnit("{request}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for name, l := range backendLimiters {
+				o.Observe(int64(len(l.slots)), metric.WithAttributes(attribute.String("backend", name)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create backend in-flight gauge", zap.Error(err))
+	}
+
+	logger.Info("Backend concurrency limits configured",
+		zap.Any("limits", limits),
+		zap.Duration("queue_timeout", queueTimeout),
+	)
+}
+
+// acquireBackend takes an in-flight slot for a request to backend, waiting
+// up to queueTimeout for one. It returns the function releasing the slot,
+// or errBackendOverloaded if the request is shed.
+func acquireBackend(ctx context.Context, backend string) (func(), error) {
+	l, ok := backendLimiters[backend]
+	if !ok {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	reason := "queue_full"
+	if l.waiting.Add(1) <= int64(cap(l.slots)) {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			l.waiting.Add(-1)
+			return release, nil
+		case <-timer.C:
+			reason = "timeout"
+		case <-ctx.Done():
+			reason = "canceled"
+		}
+	}
+	l.waiting.Add(-1)
+
+	backendShed.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("backend", backend),
+		attribute.String("reason", reason),
+	), contextAttrs(ctx))
+	loggerFor(ctx).Warn("Request shed, backend at its in-flight limit",
+		zap.String("backend", backend),
+		zap.String("reason", reason),
+	)
+	return nil, errBackendOverloaded
+}
+
+// shedRequest answers a request shed by acquireBackend.
+func shedRequest(c *gin.Context) {
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service overloaded, try again shortly"})
+}
+
+// releasingBody releases an in-flight slot when the response body is
+// closed, so typed-client requests hold their slot until read.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    atomic.Bool
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.once.CompareAndSwap(false, true) {
+		b.release()
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/joke/next?wait=30s long-polls for news, for clients that
+// can't hold an event stream open: it answers as soon as the joke of the
+// day or the trending jokes change, or with 204 No Content once wait
+// (default 30s, at most LONGPOLL_MAX_WAIT, default 60s) passes. Every
+// answer carries a cursor; passing it back as ?cursor= returns at once if
+// something changed since, so nothing is missed between polls.
+//
+// The joke of the day is the jokes service's pick for the date's seed
+// (GET /api/v1/joke?seed=YYYYMMDD, see its random.go), the same on every
+// replica; trending is its top LONGPOLL_TRENDING_LIMIT (default 5)
+// trending jokes. One watcher per gateway replica checks them every
+// LONGPOLL_INTERVAL (default 10s), from the first long poll on, and wakes
+// every waiting client, so clients add no backend traffic. At most
+// LONGPOLL_MAX_WAITERS (default 1000) requests wait at once; more get 503.
+// A client going away ends its wait and frees its place.
+
+// Kinds of change a long poll reports
+const (
+	changeJokeOfTheDay = "joke_of_the_day"
+	changeTrending     = "trending"
+)
+
+// JokeNews is the answer to a long poll: what changed, and the current
+// joke of the day and trending jokes.
+type JokeNews struct {
+	Cursor       int64                 `json:"cursor"`
+	Changes      []string              `json:"changes"`
+	JokeOfTheDay *client.Joke          `json:"joke_of_the_day"`
+	Trending     []client.TrendingJoke `json:"trending"`
+	UpdatedAt    time.Time             `json:"updated_at"`
+}
+
+var (
+	longPollInterval      = 10 * time.Second
+	longPollMaxWait       = 60 * time.Second
+	longPollMaxWaiters    = 1000
+	longPollTrendingLimit = 5
+
+	jokeWatcher = &newsWatcher{changed: make(chan struct{})}
+
+	longPollWaiting  atomic.Int64
+	longPollRequests metric.Int64Counter
+)
+
+// newsWatcher polls the jokes service for changes and wakes the long polls
+// waiting for them.
+type newsWatcher struct {
+	start sync.Once
+	mutex sync.RWMutex
+	news  JokeNews
+	day   string
+	// changed is closed, and replaced, on every change
+	changed chan struct{}
+}
+
+func initLongPolling() {
+	if v := envDuration("LONGPOLL_INTERVAL", longPollInterval); v > 0 {
+		longPollInterval = v
+	}
+	if v := envDuration("LONGPOLL_MAX_WAIT", longPollMaxWait); v > 0 {
+		longPollMaxWait = v
+	}
+	longPollMaxWaiters = envInt("LONGPOLL_MAX_WAITERS", longPollMaxWaiters)
+	if v := envInt("LONGPOLL_TRENDING_LIMIT", longPollTrendingLimit); v > 0 {
+		longPollTrendingLimit = v
+	}
+
+	var err error
+	longPollRequests, err = meter.Int64Counter(
+		"gateway.longpoll.requests",
+		metric.WithDescription("Number of long polls, by outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create long poll requests counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"gateway.longpoll.waiting",
+		metric.WithDescription("Number of long polls waiting for a change"),
+		metric.WithUnit("{request}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(longPollWaiting.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create long poll waiting gauge", zap.Error(err))
+	}
+}
+
+// run checks for changes every interval until ctx is cancelled.
+func (w *newsWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(longPollInterval)
+	defer ticker.Stop()
+	for {
+		w.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check fetches the trending jokes, and the joke of the day when the date
+// changed or it isn't known yet, and wakes the waiting long polls if either
+// changed. The first check sets the baseline.
+func (w *newsWatcher) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, aggregateTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "check_joke_news")
+	defer span.End()
+
+	now := time.Now().UTC()
+	day := now.Format("20060102")
+
+	w.mutex.RLock()
+	needJoke := w.day != day || w.news.JokeOfTheDay == nil
+	w.mutex.RUnlock()
+
+	var joke *client.Joke
+	if needJoke {
+		seed, _ := strconv.ParseInt(day, 10, 64)
+		var err error
+		if joke, err = jokesClient.RandomJoke(ctx, client.JokeOptions{Seed: &seed}); err != nil {
+			loggerFor(ctx).Warn("Failed to fetch the joke of the day", zap.Error(err))
+		}
+	}
+	trending, err := jokesClient.Trending(ctx, longPollTrendingLimit, client.JokeOptions{})
+	if err != nil {
+		loggerFor(ctx).Warn("Failed to fetch trending jokes for long polls", zap.Error(err))
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	baseline := w.news.UpdatedAt.IsZero()
+	var changes []string
+	if joke != nil {
+		if w.news.JokeOfTheDay == nil || w.news.JokeOfTheDay.ID != joke.ID {
+			changes = append(changes, changeJokeOfTheDay)
+		}
+		w.news.JokeOfTheDay = joke
+		w.day = day
+	}
+	if err == nil {
+		if !slices.Equal(trendingIDs(w.news.Trending), trendingIDs(trending)) {
+			changes = append(changes, changeTrending)
+		}
+		w.news.Trending = trending
+	}
+	if len(changes) == 0 {
+		return
+	}
+	w.news.UpdatedAt = now
+	w.news.Changes = changes
+	if baseline {
+		return
+	}
+	w.news.Cursor++
+	close(w.changed)
+	w.changed = make(chan struct{})
+
+	span.SetAttributes(attribute.StringSlice("news.changes", changes))
+	loggerFor(ctx).Info("Joke news changed",
+		zap.Strings("changes", changes),
+		zap.Int64("cursor", w.news.Cursor),
+		zap.Int64("waiting", longPollWaiting.Load()),
+	)
+}
+
+// current returns the latest news and the channel closed on the next
+// change.
+func (w *newsWatcher) current() (JokeNews, <-chan struct{}) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.news, w.changed
+}
+
+func trendingIDs(trending []client.TrendingJoke) []string {
+	ids := make([]string, len(trending))
+	for i, joke := range trending {
+		ids[i] = joke.ID
+	}
+	return ids
+}
+
+// nextJokeHandler serves GET /api/v1/joke/next?wait=30s&cursor=N.
+func nextJokeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	wait := 30 * time.Second
+	if v := c.Query("wait"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 || parsed > longPollMaxWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a duration up to " + longPollMaxWait.String()})
+			return
+		}
+		wait = parsed
+	}
+	cursor := int64(-1)
+	if v := c.Query("cursor"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor must be a non-negative integer"})
+			return
+		}
+		cursor = parsed
+	}
+
+	// Not tied to the request: the watcher outlives it
+	jokeWatcher.start.Do(func() { go jokeWatcher.run(context.Background()) })
+
+	outcome := "changed"
+	defer func() {
+		longPollRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}()
+
+	news, changed := jokeWatcher.current()
+	if cursor >= 0 && cursor < news.Cursor {
+		c.JSON(http.StatusOK, news)
+		return
+	}
+
+	if longPollWaiting.Add(1) > int64(longPollMaxWaiters) {
+		longPollWaiting.Add(-1)
+		outcome = "rejected"
+		c.Header("Retry-After", strconv.Itoa(int(longPollInterval/time.Second)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many clients waiting, try again later"})
+		return
+	}
+	defer longPollWaiting.Add(-1)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		news, _ = jokeWatcher.current()
+		c.JSON(http.StatusOK, news)
+	case <-timer.C:
+		outcome = "timeout"
+		c.Header("X-Poll-Cursor", strconv.FormatInt(news.Cursor, 10))
+		c.Status(http.StatusNoContent)
+	case <-ctx.Done():
+		outcome = "cancelled"
+		loggerFor(ctx).Debug("Long poll cancelled", zap.Error(ctx.Err()))
+	}
+}
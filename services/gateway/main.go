@@ -1,26 +1,86 @@
 // API Gateway Service - Entry point for all microservices
 // Routes:
-//   GET /healthz          -> health check
-//   GET /api/v1/joke      -> get random joke (proxies to jokes-service)
-//   POST /api/v1/favorite -> add favorite joke (proxies to user-service)
-//   GET /api/v1/stats     -> get analytics (proxies to analytics-service)
+//   GET /healthz           -> health check
+//   GET /status            -> public status summary as JSON or HTML (see status.go)
+//   GET /api/v1/joke       -> get random joke (proxies to jokes-service)
+//   GET /api/v1/joke/audio -> a joke as synthesized speech (jokes-service)
+//   GET /api/v1/joke/next  -> long-poll until the joke of the day or trending
+//                             jokes change (see longpoll.go)
+//   GET /api/v1/jokes/random -> several distinct random jokes (jokes-service)
+//   GET /api/v1/jokes/trending -> fastest-rising jokes of the last hour (jokes-service)
+//   GET /api/v1/jokes?author= -> jokes by an author, paged (jokes-service)
+//   GET /api/v1/jokes/:id  -> a joke and its metadata by ID (jokes-service)
+//   POST /api/v1/joke/:id/reaction -> react to a joke (proxies to jokes-service)
+//   POST /api/v1/favorites  -> add favorite joke (proxies to user-service)
+//   GET /api/v1/favorites  -> list favorite jokes (proxies to user-service)
+//   /api/v1/collections/... -> named collections of favorites (user-service)
+//   GET /api/v1/shared/collections/:token -> a shared collection, no login needed
+//   POST /api/v1/users/merge -> merge an anonymous user into the signed-in one, with a
+//                               token from POST /api/v1/users/merge/token
+//   /api/v1/users/:id/preferences -> joke delivery preferences (user-service)
+//   GET /api/v1/stats      -> get analytics (proxies to analytics-service)
+//   GET /api/v1/stats/reactions -> jokes ranked by groan ratio (analytics-service)
+//   GET /api/v1/stats/clients   -> traffic per client app, user agent and route
+//   GET /api/v1/stats/geo       -> traffic per country and region
+//   GET /api/v1/stats/anomalies -> spikes and droughts in the joke rate
+//   GET /api/v1/stats/leaderboard -> users ranked by favorites or jokes requested
+//   GET /api/v1/stats/trending  -> joke IDs ranked by momentum (analytics-service)
+//   GET /api/v1/stats/compare   -> metrics over a window against the window before
+//   GET /api/v1/stats/funnel    -> served to favorited conversion per joke
+//   GET /api/v1/stats/authors   -> jokes served and favorited per joke author
+//   GET /api/v1/stats/errors    -> error counts and rates per route and backend
+//   GET /api/v1/reports/weekly  -> a week's report as JSON, HTML or PDF
+//   GET /api/v1/home       -> joke, favorite count and stats in one response
+//   GET /api/v1/usage      -> the caller's quota usage (see quota.go)
+//   GET /auth/login        -> start OIDC login (when OIDC_ISSUER_URL is set)
+//   GET /auth/callback     -> OIDC redirect target, issues a session cookie
+//   POST /auth/logout      -> clear the session cookie
+//   POST /graphql          -> GraphQL queries over jokes, favorites and stats
+//   GET /openapi.json      -> OpenAPI spec generated from the route table
+//   GET /docs              -> embedded API explorer
+//   GET /admin/...         -> admin routes, only on the admin host (ADMIN_HOST);
+//                             used by cmd/jokesctl
+//   GET /admin/gateway/... -> the gateway's routes, backends, quota counters
+//                             and effective config (see admin.go)
+//   GET /admin/deprecations -> clients still calling deprecated routes and
+//                              fields (see deprecation.go)
+//
+// Proxied routes are declared in the route table in routes.go; host and
+// header routing rules are in routing.go.
+// Every request is assigned a tenant, which is propagated to the backends
+// as baggage (see tenant.go).
+// Requests in flight to each backend are capped, and shed with 503 when a
+// backend stays full (see limiter.go). Downloads and large responses are
+// streamed to the client rather than buffered (see stream.go). Catalogue
+// reads are cached until the jokes service invalidates them (see
+// cache.go). A fraction of the traffic can be mirrored to a shadow
+// backend (see mirror.go).
+// Partner integrations sign their requests, and the signature is verified
+// before anything else (see partnerauth.go). Error responses are localized
+// for the client's Accept-Language (see i18n.go). Response statuses are
+// counted per route and reported to analytics (see routestatus.go). Likely
+// bots are tagged, and optionally throttled or challenged (see bot.go).
+// The configuration and the backends are checked at startup, which fails
+// fast on errors (see selfcheck.go).
 
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -28,28 +88,29 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 var (
 	logger         *zap.Logger
 	tracer         trace.Tracer
 	meter          metric.Meter
-	requestCount   metric.Int64Counter
 	requestLatency metric.Float64Histogram
 )
 
 func initLogger() {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	var err error
-	logger, err = config.Build()
+	logger, err = telemetry.NewLogger()
 	if err != nil {
 		log.Fatal("Failed to initialize logger:", err)
 	}
 }
 
+// loggerFor returns the service logger bound to ctx (see
+// telemetry.LoggerFor).
+func loggerFor(ctx context.Context) *zap.Logger {
+	return telemetry.LoggerFor(ctx, logger)
+}
+
 func initTracer() func() {
 	ctx := context.Background()
 
@@ -58,13 +119,7 @@ func initTracer() func() {
 		signozEndpoint = "signoz-otel-collector.platform.svc.cluster.local:4317"
 	}
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(signozEndpoint),
-		otlptracegrpc.WithInsecure(),
-	)
-	if err != nil {
-		logger.Fatal("Failed to create trace exporter", zap.Error(err))
-	}
+	exporter := telemetry.NewSpanExporter(signozEndpoint)
 
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
@@ -72,6 +127,7 @@ func initTracer() func() {
 			semconv.ServiceVersion("1.0.0"),
 			attribute.String("environment", "production"),
 		),
+		resource.WithAttributes(telemetry.K8sResourceAttributes()...),
 	)
 	if err != nil {
 		logger.Fatal("Failed to create resource", zap.Error(err))
@@ -80,7 +136,10 @@ func initTracer() func() {
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(contextSpanProcessor{}),
+		sdktrace.WithSampler(newRouteSampler(telemetry.NewSampler(nil))),
+		// Keep unsampled traces that turn out to be errors or slow requests
+		sdktrace.WithSpanProcessor(newErrorKeepProcessor(exporter)),
 	)
 
 	otel.SetTracerProvider(tp)
@@ -91,26 +150,30 @@ func initTracer() func() {
 
 	tracer = tp.Tracer("api-gateway")
 
+	exported, lp, err := telemetry.ExportLogs(logger, "api-gateway", signozEndpoint, res)
+	if err != nil {
+		logger.Fatal("Failed to create log export core", zap.Error(err))
+	}
+	logger = exported
+
 	return func() {
 		if err := tp.Shutdown(ctx); err != nil {
 			logger.Error("Error shutting down tracer provider", zap.Error(err))
 		}
+		if err := lp.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down logger provider", zap.Error(err))
+		}
 	}
 }
 
+// initMetrics sets up the gateway's meter. The count and duration of
+// every request are recorded by the standard middleware (see
+// pkg/middleware); the gateway adds the duration of proxied requests by
+// backend.
 func initMetrics() {
 	meter = otel.Meter("api-gateway")
 
 	var err error
-	requestCount, err = meter.Int64Counter(
-		"http.server.request_count",
-		metric.WithDescription("Total number of HTTP requests"),
-		metric.WithUnit("{request}"),
-	)
-	if err != nil {
-		logger.Fatal("Failed to create request counter", zap.Error(err))
-	}
-
 	requestLatency, err = meter.Float64Histogram(
 		"http.server.request_duration",
 		metric.WithDescription("HTTP request latency"),
@@ -121,29 +184,68 @@ func initMetrics() {
 	}
 }
 
-func proxyRequest(c *gin.Context, serviceURL, path string) {
+// proxyRequest forwards the request to path on serviceURL, a replica of
+// backend. Internal requests are signed for the backend's /internal routes.
+func proxyRequest(c *gin.Context, backend, serviceURL, path string, route Route) {
 	ctx := c.Request.Context()
 
 	// Create child span for proxy request
-	_, span := tracer.Start(ctx, fmt.Sprintf("proxy_to_%s", path))
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("proxy_to_%s", path))
 	defer span.End()
 
 	start := time.Now()
 
-	// Build target URL
+	// Build target URL, keeping the original query string
 	targetURL := fmt.Sprintf("http://%s%s", serviceURL, path)
+	if c.Request.URL.RawQuery != "" {
+		targetURL += "?" + c.Request.URL.RawQuery
+	}
 
-	logger.Info("Proxying request",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	loggerFor(ctx).Info("Proxying request",
 		zap.String("target", targetURL),
 		zap.String("method", c.Request.Method),
 	)
 
-	// Create new request
-	req, err := http.NewRequestWithContext(ctx, c.Request.Method, targetURL, c.Request.Body)
+	// Buffer the body so the outgoing request is replayable and its size known
+	body, err := requestBody(c)
 	if err != nil {
-		logger.Error("Failed to create proxy request",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		if isBodyTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Request body exceeds %d bytes", maxRequestBodyBytes),
+			})
+			return
+		}
+		loggerFor(ctx).Error("Failed to read request body",
+			zap.Error(err),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	sizeAttrs := metric.WithAttributes(
+		attribute.String("service", serviceURL),
+		attribute.String("method", c.Request.Method),
+	)
+	requestBodySize.Record(ctx, int64(len(body)), sizeAttrs, contextAttrs(ctx))
+
+	requestRewrites, responseRewrites := routeRewrites(route)
+	body = rewriteBody(body, c.GetHeader("Content-Type"), requestRewrites)
+
+	// Create new request; a bytes.Reader body sets ContentLength and GetBody
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	// BACKEND_TIMEOUT bounds the response; streamed responses reset it for
+	// every chunk (see stream.go)
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deadline := time.AfterFunc(backendTimeout, cancel)
+	defer deadline.Stop()
+
+	req, err := http.NewRequestWithContext(reqCtx, backendMethod(c.Request.Method), targetURL, reqBody)
+	if err != nil {
+		loggerFor(ctx).Error("Failed to create proxy request",
 			zap.Error(err),
 		)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
@@ -152,14 +254,39 @@ func proxyRequest(c *gin.Context, serviceURL, path string) {
 
 	// Propagate headers
 	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
-	req.Header.Set("Content-Type", "application/json")
+	if contentType := c.GetHeader("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept := c.GetHeader("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if encoding := c.GetHeader("Accept-Encoding"); encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
+	// Favorite edits are conditional on the version last seen
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	req.Header.Set(middleware.RequestIDHeader, middleware.RequestIDFromContext(ctx))
+	if userID := c.GetString(userIDKey); userID != "" && !route.ForQueryUser {
+		req.Header.Set(userIDHeader, userID)
+	}
+	for _, rw := range requestRewrites {
+		rw.applyHeaders(req.Header)
+	}
+	if route.Internal {
+		signRequest(req, body)
+	}
 
-	// Execute request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	// Execute request on the backend's pooled client (see pool.go)
+	resp, err := backendStreamingClient(backend).Do(req)
 	if err != nil {
-		logger.Error("Failed to proxy request",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		reason := proxyFailureReason(ctx, err, proxyFailureConnect)
+		if reason != "" {
+			recordProxyFailure(ctx, backend, reason, err.Error(), 0)
+		}
+		loggerFor(ctx).Error("Failed to proxy request",
+			zap.String("reason", reason),
 			zap.Error(err),
 		)
 		c.JSON(http.StatusBadGateway, gin.H{"error": "Service unavailable"})
@@ -167,6 +294,11 @@ func proxyRequest(c *gin.Context, serviceURL, path string) {
 	}
 	defer resp.Body.Close()
 
+	// Writes name the cached responses they made stale (see cache.go)
+	if stale := resp.Header.Get(invalidationHeader); stale != "" {
+		purgeCached(ctx, strings.Split(stale, ","), "header")
+	}
+
 	// Record metrics
 	duration := time.Since(start).Milliseconds()
 	requestLatency.Record(ctx, float64(duration),
@@ -174,60 +306,135 @@ func proxyRequest(c *gin.Context, serviceURL, path string) {
 			attribute.String("service", serviceURL),
 			attribute.Int("status_code", resp.StatusCode),
 		),
+		contextAttrs(ctx),
 	)
+	if resp.StatusCode >= 500 {
+		recordProxyFailure(ctx, backend, proxyFailure5xx, resp.Status, resp.StatusCode)
+	}
 
-	// Copy response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logger.Error("Failed to read response",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
-			zap.Error(err),
-		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
-		return
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	rewritten := rewritesBody(responseRewrites, contentType)
+
+	// Copy response, unless it is streamed (see stream.go)
+	reason := streamReason(resp, rewritten)
+	var respBody []byte
+	if reason == "" {
+		reader := io.Reader(resp.Body)
+		if !rewritten {
+			reader = io.LimitReader(resp.Body, streamThreshold+1)
+		}
+		respBody, err = io.ReadAll(reader)
+		if err != nil {
+			reason := proxyFailureReason(ctx, err, proxyFailureBodyRead)
+			if reason != "" {
+				recordProxyFailure(ctx, backend, reason, err.Error(), 0)
+			}
+			loggerFor(ctx).Error("Failed to read response",
+				zap.String("reason", reason),
+				zap.Error(err),
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+			return
+		}
+		if int64(len(respBody)) > streamThreshold && !rewritten {
+			reason = "size"
+		}
 	}
 
-	logger.Info("Proxy request completed",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	loggerFor(ctx).Info("Proxy request completed",
 		zap.Int("status_code", resp.StatusCode),
 		zap.Int64("duration_ms", duration),
 	)
 
-	c.Data(resp.StatusCode, "application/json", body)
+	if reason != "" {
+		written := streamResponse(c, resp, respBody, reason, responseRewrites, deadline)
+		responseBodySize.Record(ctx, written, sizeAttrs, contextAttrs(ctx))
+		return
+	}
+
+	respBody = rewriteBody(respBody, contentType, responseRewrites)
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		c.Header("Content-Disposition", disposition)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		c.Header("ETag", etag)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		c.Header("Retry-After", retryAfter)
+	}
+	for _, rw := range responseRewrites {
+		rw.applyHeaders(c.Writer.Header())
+	}
+	responseBodySize.Record(ctx, int64(len(respBody)), sizeAttrs, contextAttrs(ctx))
+	c.Data(resp.StatusCode, contentType, respBody)
 }
 
 func main() {
 	initLogger()
 	defer logger.Sync()
+	telemetry.InitRuntimeConfig()
 
 	shutdown := initTracer()
 	defer shutdown()
 
 	initMetrics()
-
-	r := gin.Default()
-	r.Use(otelgin.Middleware("api-gateway"))
-
-	// Middleware for metrics
-	r.Use(func(c *gin.Context) {
-		start := time.Now()
-		c.Next()
-
-		duration := time.Since(start).Milliseconds()
-		requestCount.Add(c.Request.Context(), 1,
-			metric.WithAttributes(
-				attribute.String("method", c.Request.Method),
-				attribute.String("path", c.Request.URL.Path),
-				attribute.Int("status_code", c.Writer.Status()),
-			),
-		)
-		requestLatency.Record(c.Request.Context(), float64(duration),
-			metric.WithAttributes(
-				attribute.String("method", c.Request.Method),
-				attribute.String("path", c.Request.URL.Path),
-			),
-		)
-	})
+	initBodyBuffering()
+	initStreaming()
+	initProxyFailures()
+	initQuotas()
+	initTenants()
+	initScopes()
+	initInternalAuth()
+	initPartnerAuth()
+	initVisitorHashing()
+	initClientApps()
+	initGeoIP()
+	initBotDetection()
+	initDiscovery()
+	initBackendLimits()
+	initBackendPools()
+	initCoalescing()
+	initResponseCache()
+	initMirroring()
+	initAdmin()
+	initDeprecations()
+	initAuth(context.Background())
+	initClients()
+	initLongPolling()
+	initRouteStatuses()
+	initStatus()
+	initSecurityHeaders()
+	initCORS()
+	initI18n()
+
+	// Misconfiguration stops the gateway here, not on the first request
+	checkStartup()
+
+	r := gin.New()
+	r.Use(middleware.Default("api-gateway",
+		middleware.WithLogger(loggerFor),
+		middleware.WithMetricAttributes(contextAttrs),
+		// Bodies are buffered up to the same limit before proxying (see body.go)
+		middleware.WithMaxBodyBytes(maxRequestBodyBytes),
+		// Error responses are localized, panics and oversized bodies included
+		middleware.WithObservers(localizeErrorsMiddleware()),
+	)...)
+	// Counts every response, rejected ones included (see routestatus.go)
+	r.Use(routeStatusMiddleware())
+	r.Use(securityHeadersMiddleware())
+	r.Use(corsMiddleware())
+	r.Use(partnerAuthMiddleware())
+	r.Use(apiKeyMiddleware())
+	r.Use(identityMiddleware())
+	r.Use(tenantMiddleware())
+	r.Use(clientAttributionMiddleware())
+	r.Use(botMiddleware())
+	r.Use(requestContextMiddleware())
+
+	r.Use(quotaMiddleware())
 
 	// Health check
 	r.GET("/healthz", func(c *gin.Context) {
@@ -239,31 +446,33 @@ func main() {
 		})
 	})
 
-	// Proxy to jokes service
-	r.GET("/api/v1/joke", func(c *gin.Context) {
-		jokesService := os.Getenv("JOKES_SERVICE_URL")
-		if jokesService == "" {
-			jokesService = "jokes-service.default.svc.cluster.local"
-		}
-		proxyRequest(c, jokesService, "/api/v1/joke")
-	})
+	// OIDC login and identity resolution
+	registerAuthRoutes(r)
 
-	// Proxy to user service
-	r.POST("/api/v1/favorite", func(c *gin.Context) {
-		userService := os.Getenv("USER_SERVICE_URL")
-		if userService == "" {
-			userService = "user-service.default.svc.cluster.local"
-		}
-		proxyRequest(c, userService, "/api/v1/favorite")
-	})
+	// Proxy routes from the route table
+	registerRoutes(r)
 
-	// Proxy to analytics service
-	r.GET("/api/v1/stats", func(c *gin.Context) {
-		analyticsService := os.Getenv("ANALYTICS_SERVICE_URL")
-		if analyticsService == "" {
-			analyticsService = "analytics-service.default.svc.cluster.local"
-		}
-		proxyRequest(c, analyticsService, "/api/v1/stats")
+	// Runtime inspection of the gateway itself
+	registerAdminRoutes(r)
+	registerDeprecationRoutes(r)
+
+	// Aggregate endpoints fanning out to several backends
+	r.GET("/api/v1/home", scopeMiddleware(scopeJokesRead), homeHandler)
+	r.GET("/api/v1/usage", usageHandler)
+
+	// Long polling for clients that can't use an event stream
+	r.GET("/api/v1/joke/next", scopeMiddleware(scopeJokesRead), nextJokeHandler)
+
+	// OpenAPI spec and interactive API explorer
+	registerGraphQLRoutes(r)
+	registerDocsRoutes(r)
+
+	// Public status summary
+	registerStatusRoutes(r)
+
+	// Unknown paths get an error like any other, localized (see i18n.go)
+	r.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
 	})
 
 	port := os.Getenv("PORT")
@@ -271,8 +480,7 @@ func main() {
 		port = "8080"
 	}
 
-	logger.Info("Starting API Gateway", zap.String("port", port))
-	if err := r.Run(":" + port); err != nil {
+	if err := serve(r, port); err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
 	}
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health checkers and browsers probe routes with HEAD and OPTIONS, which
+// the route table doesn't list. Every proxied path answering GET answers
+// HEAD too: the request goes to the backend as a GET, which every backend
+// serves, and the client gets its status and headers without the body.
+// Every proxied path answers OPTIONS with 204 and an Allow header listing
+// its methods, and answers CORS preflights when CORS is enabled (see
+// cors.go). Routes the table does list for these methods are left alone.
+
+// registerImplicitMethods adds HEAD and OPTIONS to a proxied path
+// answering methods; get are the path's GET routes, if any.
+func registerImplicitMethods(r *gin.Engine, path string, methods []string, get []Route) {
+	methods = slices.Clone(methods)
+	if len(get) > 0 && !slices.Contains(methods, http.MethodHead) {
+		r.HEAD(path, routeHandler(get))
+		methods = append(methods, http.MethodHead)
+	}
+	if slices.Contains(methods, http.MethodOptions) {
+		return
+	}
+	methods = append(methods, http.MethodOptions)
+	slices.Sort(methods)
+	allow := strings.Join(methods, ", ")
+	r.OPTIONS(path, func(c *gin.Context) {
+		c.Header("Allow", allow)
+		answerPreflight(c, methods)
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// backendMethod is the method a request is sent to backends with: HEAD
+// goes as GET, its body dropped by the server, as the backends don't
+// route HEAD.
+func backendMethod(method string) string {
+	if method == http.MethodHead {
+		return http.MethodGet
+	}
+	return method
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// A fraction of the requests proxied to MIRROR_BACKEND's routes can be
+// copied to a shadow deployment at MIRROR_URL, to load test a new version
+// with real traffic. Mirroring is fire-and-forget: the copy is sent in the
+// background once the request has been read, its response is discarded,
+// and the client's response, latency and metrics don't depend on it.
+//
+// Mirrored requests carry mirroredRequestHeader, so the shadow can tell
+// them apart; the jokes service doesn't report them to analytics or add
+// them to user histories. Their spans start traces of their own, linked to
+// the original request's. Internal routes are never mirrored, and only
+// MIRROR_METHODS (GET and HEAD by default) are, as the shadow may share
+// state with the live backend.
+//
+// MIRROR_PERCENT is re-read from the runtime config file, so mirroring can
+// be ramped up, or stopped, without a restart.
+
+const mirroredRequestHeader = "X-Mirrored-Request"
+
+var (
+	mirrorURL     string
+	mirrorBackend = "jokes"
+	mirrorMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
+	// mirrorPercent holds the float64 bits of MIRROR_PERCENT
+	mirrorPercent atomic.Uint64
+	mirrorClient  *http.Client
+	// mirrorSlots bounds the mirrored requests in flight; copies that find
+	// it full are dropped
+	mirrorSlots chan struct{}
+
+	mirrorRequests metric.Int64Counter
+	mirrorLatency  metric.Float64Histogram
+)
+
+// initMirroring reads MIRROR_URL, MIRROR_BACKEND, MIRROR_PERCENT (0-100),
+// MIRROR_METHODS ("GET,HEAD,POST"), MIRROR_TIMEOUT and
+// MIRROR_MAX_IN_FLIGHT. Mirroring is off without MIRROR_URL.
+func initMirroring() {
+	mirrorURL = os.Getenv("MIRROR_URL")
+	if mirrorURL == "" {
+		return
+	}
+	if v := os.Getenv("MIRROR_BACKEND"); v != "" {
+		if _, ok := backends[v]; !ok {
+			logger.Fatal("MIRROR_BACKEND is not a known backend", zap.String("backend", v))
+		}
+		mirrorBackend = v
+	}
+	if v := os.Getenv("MIRROR_METHODS"); v != "" {
+		mirrorMethods = map[string]bool{}
+		for _, method := range splitList(v) {
+			mirrorMethods[strings.ToUpper(method)] = true
+		}
+	}
+	mirrorClient = &http.Client{Timeout: envDuration("MIRROR_TIMEOUT", backendTimeout)}
+	mirrorSlots = make(chan struct{}, envInt("MIRROR_MAX_IN_FLIGHT", 50))
+
+	loadMirrorPercent()
+	telemetry.OnRuntimeChange("MIRROR_PERCENT", loadMirrorPercent)
+
+	var err error
+	mirrorRequests, err = meter.Int64Counter(
+		"gateway.mirror.requests",
+		metric.WithDescription("Number of requests copied to the shadow backend, by outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create mirror requests counter", zap.Error(err))
+	}
+
+	mirrorLatency, err = meter.Float64Histogram(
+		"gateway.mirror.duration",
+		metric.WithDescription("Shadow backend latency of mirrored requests"),
+		metric.WithUnit("ms"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create mirror latency histogram", zap.Error(err))
+	}
+
+	logger.Info("Traffic mirroring configured",
+		zap.String("url", mirrorURL),
+		zap.String("backend", mirrorBackend),
+		zap.Float64("percent", math.Float64frombits(mirrorPercent.Load())),
+	)
+}
+
+func loadMirrorPercent() {
+	percent, err := strconv.ParseFloat(telemetry.RuntimeValue("MIRROR_PERCENT"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		if v := telemetry.RuntimeValue("MIRROR_PERCENT"); v != "" {
+			logger.Warn("Ignoring invalid MIRROR_PERCENT, mirroring nothing", zap.String("value", v))
+		}
+		percent = 0
+	}
+	mirrorPercent.Store(math.Float64bits(percent))
+}
+
+// mirrorRequest copies the request to the shadow backend in the background
+// if route is mirrored and the request is picked. path is the upstream
+// path.
+func mirrorRequest(c *gin.Context, route Route, path string) {
+	if mirrorURL == "" || route.Backend != mirrorBackend || route.Internal || !mirrorMethods[c.Request.Method] {
+		return
+	}
+	if rand.Float64()*100 >= math.Float64frombits(mirrorPercent.Load()) {
+		return
+	}
+	// The proxy reports unreadable and oversized bodies itself
+	body, err := requestBody(c)
+	if err != nil {
+		return
+	}
+
+	ctx := c.Request.Context()
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirrorRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", "dropped")), contextAttrs(ctx))
+		return
+	}
+
+	targetURL := fmt.Sprintf("http://%s%s", mirrorURL, path)
+	if c.Request.URL.RawQuery != "" {
+		targetURL += "?" + c.Request.URL.RawQuery
+	}
+	header := http.Header{}
+	for _, name := range []string{"Content-Type", "Accept"} {
+		if value := c.GetHeader(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	if userID := c.GetString(userIDKey); userID != "" && !route.ForQueryUser {
+		header.Set(userIDHeader, userID)
+	}
+	header.Set(mirroredRequestHeader, "true")
+
+	// Keep the baggage, but not the client's deadline or trace; c is
+	// reused once the request completes
+	ctx = context.WithoutCancel(ctx)
+	method := backendMethod(c.Request.Method)
+	go func() {
+		defer func() { <-mirrorSlots }()
+		sendMirror(ctx, method, targetURL, header, body)
+	}()
+}
+
+// sendMirror sends a mirrored request and discards the response.
+func sendMirror(ctx context.Context, method, targetURL string, header http.Header, body []byte) {
+	ctx, span := tracer.Start(ctx, "mirror_request",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attribute.String("mirror.url", targetURL)),
+	)
+	defer span.End()
+
+	start := time.Now()
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, reqBody)
+	if err != nil {
+		return
+	}
+	req.Header = header
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		mirrorRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", "failed")), contextAttrs(ctx))
+		loggerFor(ctx).Debug("Mirrored request failed", zap.String("target", targetURL), zap.Error(err))
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	mirrorRequests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("outcome", "sent"),
+		attribute.Int("status_code", resp.StatusCode),
+	), contextAttrs(ctx))
+	mirrorLatency.Record(ctx, float64(time.Since(start).Milliseconds()),
+		metric.WithAttributes(attribute.Int("status_code", resp.StatusCode)),
+		contextAttrs(ctx),
+	)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Partner integrations sign their requests with a secret shared with the
+// gateway. A request carrying X-Partner-ID must also carry:
+//   - X-Partner-Timestamp: Unix seconds, within PARTNER_SIGNATURE_MAX_SKEW
+//     of the gateway's clock
+//   - X-Partner-Signature: hex HMAC-SHA256, keyed with the partner's secret,
+//     of "METHOD\nPATH?QUERY\nTIMESTAMP\nhex(SHA256(BODY))"
+//
+// A signature is accepted once: replays within the skew window are
+// rejected, and older ones fail the timestamp check. Seen signatures are
+// kept in Redis at REDIS_ADDR, shared by the replicas, or in memory. When
+// Redis can't be reached, signed requests are refused with 503 rather
+// than accepted unchecked.
+//
+// Secrets are read from PARTNER_SECRETS_DIR, typically a mounted
+// Kubernetes Secret: one file per partner, named by partner ID, holding
+// one secret per line. Every secret in the file is accepted, so a secret
+// is rotated by adding the new one, moving partners over and removing the
+// old one. The directory is re-read every PARTNER_SECRETS_RELOAD_INTERVAL.
+//
+// Requests without X-Partner-ID are not affected.
+const (
+	partnerIDHeader        = "X-Partner-ID"
+	partnerTimestampHeader = "X-Partner-Timestamp"
+	partnerSignatureHeader = "X-Partner-Signature"
+
+	// partnerKey holds the verified partner ID in the gin context
+	partnerKey = "partner_id"
+)
+
+var (
+	partnerSecrets      map[string][][]byte
+	partnerSecretsMutex sync.RWMutex
+	partnerMaxSkew      = 5 * time.Minute
+	partnerReplays      middleware.ReplayGuard
+
+	partnerAuthFailures metric.Int64Counter
+)
+
+func initPartnerAuth() {
+	if v, err := time.ParseDuration(os.Getenv("PARTNER_SIGNATURE_MAX_SKEW")); err == nil && v > 0 {
+		partnerMaxSkew = v
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		partnerReplays = middleware.RedisReplayGuard{
+			Client: redis.NewClient(&redis.Options{
+				Addr:     addr,
+				Password: os.Getenv("REDIS_PASSWORD"),
+			}),
+			Prefix: "partner-signature:",
+		}
+	} else {
+		partnerReplays = middleware.NewMemoryReplayGuard()
+	}
+
+	var err error
+	partnerAuthFailures, err = meter.Int64Counter(
+		"gateway.partner_auth.failures",
+		metric.WithDescription("Number of partner requests rejected for a bad signature, by reason"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create partner auth failures counter", zap.Error(err))
+	}
+
+	dir := os.Getenv("PARTNER_SECRETS_DIR")
+	if dir == "" {
+		return
+	}
+	loadPartnerSecrets(dir)
+
+	interval := time.Minute
+	if v, err := time.ParseDuration(os.Getenv("PARTNER_SECRETS_RELOAD_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+	go func() {
+		for range time.Tick(interval) {
+			loadPartnerSecrets(dir)
+		}
+	}()
+}
+
+// loadPartnerSecrets replaces the partner secrets with those in dir. A
+// directory that can't be read keeps the secrets loaded last.
+func loadPartnerSecrets(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Warn("Failed to read partner secrets", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+
+	secrets := map[string][][]byte{}
+	for _, entry := range entries {
+		// Kubernetes mounts Secrets through hidden ..data symlinks
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !validTenant.MatchString(name) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				secrets[name] = append(secrets[name], []byte(line))
+			}
+		}
+	}
+
+	partnerSecretsMutex.Lock()
+	changed := len(secrets) != len(partnerSecrets)
+	partnerSecrets = secrets
+	partnerSecretsMutex.Unlock()
+	if changed {
+		logger.Info("Partner secrets loaded", zap.Int("partners", len(secrets)))
+	}
+}
+
+// partnerSecretsFor returns the secrets accepted for partner.
+func partnerSecretsFor(partner string) [][]byte {
+	partnerSecretsMutex.RLock()
+	defer partnerSecretsMutex.RUnlock()
+	return partnerSecrets[partner]
+}
+
+// partnerSignature signs a request with secret.
+func partnerSignature(secret []byte, method, target, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + target + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+// partnerAuthMiddleware verifies the signature of partner requests before
+// they go any further, and records the partner for quota accounting.
+func partnerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		partner := c.GetHeader(partnerIDHeader)
+		if partner == "" {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		reject := func(status int, reason string) {
+			// Unknown IDs are sent by clients, so they share one label
+			label := partner
+			if len(partnerSecretsFor(partner)) == 0 {
+				label = "unknown"
+			}
+			partnerAuthFailures.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("partner", label),
+				attribute.String("reason", reason),
+			), contextAttrs(ctx))
+			loggerFor(ctx).Warn("Partner request rejected",
+				zap.String("partner", partner),
+				zap.String("reason", reason),
+				zap.String("path", c.Request.URL.Path),
+			)
+			message := "Invalid partner signature"
+			if status == http.StatusServiceUnavailable {
+				message = "Service unavailable"
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": message})
+		}
+
+		secrets := partnerSecretsFor(partner)
+		if len(secrets) == 0 {
+			reject(http.StatusUnauthorized, "unknown_partner")
+			return
+		}
+
+		timestamp := c.GetHeader(partnerTimestampHeader)
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			reject(http.StatusUnauthorized, "malformed_timestamp")
+			return
+		}
+		if skew := time.Since(time.Unix(unix, 0)); skew > partnerMaxSkew || skew < -partnerMaxSkew {
+			reject(http.StatusUnauthorized, "expired_timestamp")
+			return
+		}
+
+		signature, err := hex.DecodeString(c.GetHeader(partnerSignatureHeader))
+		if err != nil || len(signature) != sha256.Size {
+			reject(http.StatusUnauthorized, "malformed_signature")
+			return
+		}
+
+		body, err := requestBody(c)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				reject(http.StatusRequestEntityTooLarge, "body_too_large")
+				return
+			}
+			reject(http.StatusBadRequest, "unreadable_body")
+			return
+		}
+
+		valid := false
+		for _, secret := range secrets {
+			if hmac.Equal(signature, partnerSignature(secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, body)) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			reject(http.StatusUnauthorized, "signature_mismatch")
+			return
+		}
+
+		// Checked last, so only genuine signatures are remembered
+		first, err := partnerReplays.FirstUse(ctx, partner+":"+hex.EncodeToString(signature), partnerMaxSkew*2)
+		if err != nil {
+			loggerFor(ctx).Error("Partner replay check failed", zap.Error(err))
+			reject(http.StatusServiceUnavailable, "replay_check_failed")
+			return
+		}
+		if !first {
+			reject(http.StatusUnauthorized, "replayed")
+			return
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("partner.id", partner))
+		c.Set(partnerKey, partner)
+		c.Next()
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// Every backend has a long-lived HTTP client with its own connection pool,
+// shared by proxied routes and the typed clients, so connections are kept
+// alive and reused across requests. The pool settings apply to each
+// backend:
+//
+//	BACKEND_TIMEOUT                  whole request timeout (default 10s)
+//	BACKEND_DIAL_TIMEOUT             connection timeout (default 2s)
+//	BACKEND_MAX_IDLE_CONNS_PER_HOST  idle connections kept per replica (default 32)
+//	BACKEND_MAX_CONNS_PER_HOST       connections per replica, 0 for no limit (default 0)
+//	BACKEND_IDLE_CONN_TIMEOUT        how long idle connections are kept (default 90s)
+//	BACKEND_HTTP2                    speak HTTP/2 without TLS (h2c) to backends (default false)
+//
+// With BACKEND_HTTP2 requests to a replica are multiplexed over a single
+// connection; the backends accept h2c alongside HTTP/1.1.
+//
+// Proxied routes use the same pool without the client's timeout, so large
+// responses can be streamed for longer; proxyRequest applies
+// BACKEND_TIMEOUT itself (see stream.go).
+
+// poolConfig holds the connection pool settings.
+type poolConfig struct {
+	timeout             time.Duration
+	dialTimeout         time.Duration
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	http2               bool
+}
+
+// backendPool is the HTTP client of one backend.
+type backendPool struct {
+	backend string
+	client  *http.Client
+	// streaming shares client's transport, without its timeout
+	streaming *http.Client
+	// open counts the connections currently open to the backend
+	open atomic.Int64
+	// acquired counts the connections requests got, reused those that
+	// came from the pool
+	acquired atomic.Int64
+	reused   atomic.Int64
+}
+
+var (
+	// backendPools holds the pool of every backend; it is filled at
+	// startup and only read afterwards
+	backendPools = map[string]*backendPool{}
+
+	// fallbackClient serves backends without a pool
+	fallbackClient = &http.Client{Timeout: 10 * time.Second}
+
+	// backendTimeout is BACKEND_TIMEOUT, the time a backend has to respond
+	backendTimeout = 10 * time.Second
+
+	// poolSettings are the settings every pool was built with
+	poolSettings poolConfig
+
+	connectionsAcquired metric.Int64Counter
+)
+
+func initBackendPools() {
+	cfg := poolConfig{
+		timeout:             envDuration("BACKEND_TIMEOUT", 10*time.Second),
+		dialTimeout:         envDuration("BACKEND_DIAL_TIMEOUT", 2*time.Second),
+		maxIdleConnsPerHost: envInt("BACKEND_MAX_IDLE_CONNS_PER_HOST", 32),
+		maxConnsPerHost:     envInt("BACKEND_MAX_CONNS_PER_HOST", 0),
+		idleConnTimeout:     envDuration("BACKEND_IDLE_CONN_TIMEOUT", 90*time.Second),
+	}
+	cfg.http2, _ = strconv.ParseBool(os.Getenv("BACKEND_HTTP2"))
+	backendTimeout = cfg.timeout
+	poolSettings = cfg
+
+	for name := range backends {
+		pool := &backendPool{backend: name}
+		pool.client = &http.Client{
+			Timeout:   cfg.timeout,
+			Transport: tracedTransport{pool: pool, base: pool.transport(cfg)},
+		}
+		pool.streaming = &http.Client{Transport: pool.client.Transport}
+		backendPools[name] = pool
+	}
+
+	var err error
+	connectionsAcquired, err = meter.Int64Counter(
+		"gateway.backend.connections.acquired",
+		metric.WithDescription("Number of backend connections taken for a request, by whether they were reused"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create connections acquired counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"gateway.backend.connections.open",
+		metric.WithDescription("Number of connections open to each backend"),
+		metric.WithUnit("{connection}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for name, pool := range backendPools {
+				o.Observe(pool.open.Load(), metric.WithAttributes(attribute.String("backend", name)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create open connections gauge", zap.Error(err))
+	}
+
+	logger.Info("Backend connection pools configured",
+		zap.Duration("timeout", cfg.timeout),
+		zap.Int("max_idle_conns_per_host", cfg.maxIdleConnsPerHost),
+		zap.Int("max_conns_per_host", cfg.maxConnsPerHost),
+		zap.Duration("idle_conn_timeout", cfg.idleConnTimeout),
+		zap.Bool("http2", cfg.http2),
+	)
+}
+
+// backendClient returns the HTTP client of backend.
+func backendClient(backend string) *http.Client {
+	if pool, ok := backendPools[backend]; ok {
+		return pool.client
+	}
+	return fallbackClient
+}
+
+// backendStreamingClient returns the HTTP client of backend without an
+// overall timeout; callers bound the request themselves.
+func backendStreamingClient(backend string) *http.Client {
+	if pool, ok := backendPools[backend]; ok {
+		return pool.streaming
+	}
+	return http.DefaultClient
+}
+
+// backendTransport returns the transport of backend's pool, for clients
+// that set their own timeout.
+func backendTransport(backend string) http.RoundTripper {
+	return backendClient(backend).Transport
+}
+
+// transport builds the pool's transport from cfg.
+func (p *backendPool) transport(cfg poolConfig) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout, KeepAlive: 30 * time.Second}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.open.Add(1)
+		return &countedConn{Conn: conn, open: &p.open}, nil
+	}
+
+	if cfg.http2 {
+		return &http2.Transport{
+			// h2c: the backends are plain HTTP, so "TLS" dials are plain
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: cfg.idleConnTimeout,
+			// Ping connections idle this long, so dead ones are noticed
+			ReadIdleTimeout: 30 * time.Second,
+		}
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConnsPerHost:   cfg.maxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.maxConnsPerHost,
+		IdleConnTimeout:       cfg.idleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// tracedTransport counts the connections requests get, and whether they
+// were reused from the pool.
+type tracedTransport struct {
+	pool *backendPool
+	base http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.pool.acquired.Add(1)
+			if info.Reused {
+				t.pool.reused.Add(1)
+			}
+			connectionsAcquired.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("backend", t.pool.backend),
+				attribute.Bool("reused", info.Reused),
+			))
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+}
+
+// countedConn keeps its pool's count of open connections.
+type countedConn struct {
+	net.Conn
+	open   *atomic.Int64
+	closed atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.open.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
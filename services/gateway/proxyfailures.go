@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Proxied requests that fail, or that the backend answers with a 5xx, are
+// recorded by cause, so dashboards can break gateway errors down by it:
+// a "proxy.failure" event on the span with the reason, the backend and
+// the error or status, an error status on the span, and the
+// gateway.proxy.failures counter by backend and reason. Reasons:
+//
+//   - dns: the backend's host name didn't resolve
+//   - connect: the backend refused or dropped the connection before
+//     answering
+//   - timeout: the backend didn't answer within BACKEND_TIMEOUT, or a
+//     connection attempt timed out
+//   - 5xx: the backend answered with a server error
+//   - body_read: the backend's response broke off while being read or
+//     streamed
+//
+// Requests whose client went away are not failures of the backend, and
+// are left out.
+
+// Proxy failure reasons
+const (
+	proxyFailureDNS      = "dns"
+	proxyFailureConnect  = "connect"
+	proxyFailureTimeout  = "timeout"
+	proxyFailure5xx      = "5xx"
+	proxyFailureBodyRead = "body_read"
+)
+
+var proxyFailures metric.Int64Counter
+
+func initProxyFailures() {
+	var err error
+	proxyFailures, err = meter.Int64Counter(
+		"gateway.proxy.failures",
+		metric.WithDescription("Number of proxied requests that failed or got a 5xx, by backend and reason"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create proxy failures counter", zap.Error(err))
+	}
+}
+
+// proxyFailureReason categorizes err, an error of a request proxied on
+// behalf of ctx; fallback is the reason of errors that aren't a DNS
+// failure or a timeout. It returns "" if the client went away.
+func proxyFailureReason(ctx context.Context, err error, fallback string) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case ctx.Err() != nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		return proxyFailureDNS
+	// The backend request is canceled when BACKEND_TIMEOUT passes
+	case errors.Is(err, context.Canceled), errors.As(err, &netErr) && netErr.Timeout():
+		return proxyFailureTimeout
+	}
+	return fallback
+}
+
+// recordProxyFailure records a failure of a request proxied to backend on
+// the span of ctx and in the failure counter. detail is the error or the
+// status the backend answered with.
+func recordProxyFailure(ctx context.Context, backend, reason, detail string, statusCode int) {
+	attrs := []attribute.KeyValue{
+		attribute.String("failure.reason", reason),
+		attribute.String("backend", backend),
+	}
+	if statusCode != 0 {
+		attrs = append(attrs, attribute.Int("http.status_code", statusCode))
+	} else {
+		attrs = append(attrs, attribute.String("error", detail))
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("proxy.failure", trace.WithAttributes(attrs...))
+	span.SetStatus(codes.Error, reason+": "+detail)
+
+	proxyFailures.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("backend", backend),
+		attribute.String("reason", reason),
+	), contextAttrs(ctx))
+}
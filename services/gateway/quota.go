@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// apiKeyHeader identifies API clients for quota accounting
+const apiKeyHeader = "X-API-Key"
+
+// Quota is a client's request allowance; zero means unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// quotaStore counts requests per client and period.
+type quotaStore interface {
+	// Increment adds one request and returns the new daily and monthly totals
+	Increment(ctx context.Context, client string, now time.Time) (int64, int64, error)
+	// Usage returns the current daily and monthly totals
+	Usage(ctx context.Context, client string, now time.Time) (int64, int64, error)
+	// Clients returns the totals of up to limit clients seen today
+	Clients(ctx context.Context, now time.Time, limit int) ([]QuotaUsage, error)
+}
+
+// QuotaUsage is a client's request totals for the current day and month.
+type QuotaUsage struct {
+	Client  string `json:"client"`
+	Daily   int64  `json:"daily"`
+	Monthly int64  `json:"monthly"`
+}
+
+var (
+	defaultQuota Quota
+	keyQuotas    map[string]Quota
+	quotas       quotaStore
+
+	quotaRejections metric.Int64Counter
+)
+
+// initQuotas reads QUOTA_DAILY_REQUESTS, QUOTA_MONTHLY_REQUESTS and per-key
+// overrides in API_KEY_QUOTAS ("key=daily/monthly,..."). Counters live in
+// Redis at REDIS_ADDR, or in memory when it is unset.
+func initQuotas() {
+	defaultQuota.Daily, _ = strconv.ParseInt(os.Getenv("QUOTA_DAILY_REQUESTS"), 10, 64)
+	defaultQuota.Monthly, _ = strconv.ParseInt(os.Getenv("QUOTA_MONTHLY_REQUESTS"), 10, 64)
+
+	keyQuotas = map[string]Quota{}
+	for _, entry := range strings.Split(os.Getenv("API_KEY_QUOTAS"), ",") {
+		key, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		daily, monthly, _ := strings.Cut(limits, "/")
+		var q Quota
+		q.Daily, _ = strconv.ParseInt(daily, 10, 64)
+		q.Monthly, _ = strconv.ParseInt(monthly, 10, 64)
+		keyQuotas[key] = q
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		quotas = &redisQuotaStore{client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})}
+		logger.Info("Quota counters stored in Redis", zap.String("addr", addr))
+	} else {
+		quotas = &memoryQuotaStore{counts: map[string]int64{}}
+		logger.Warn("REDIS_ADDR not set, quota counters are kept in memory per replica")
+	}
+
+	var err error
+	quotaRejections, err = meter.Int64Counter(
+		"gateway.quota.rejections",
+		metric.WithDescription("Number of requests rejected for exceeding a quota"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create quota rejections counter", zap.Error(err))
+	}
+}
+
+// quotaClient identifies the caller: the partner whose signature it
+// carries, else a hash of its API key, so keys never reach Redis or the
+// logs, else its IP address. Unknown keys count against the IP address,
+// so a new key on every request gets no fresh quota.
+func quotaClient(c *gin.Context) (string, Quota) {
+	if partner := c.GetString(partnerKey); partner != "" {
+		return "partner:" + partner, defaultQuota
+	}
+	if key := c.GetHeader(apiKeyHeader); key != "" && knownAPIKey(key) {
+		quota, ok := keyQuotas[key]
+		if !ok {
+			quota = defaultQuota
+		}
+		return "key:" + apiKeyID(key), quota
+	}
+	return "ip:" + c.ClientIP(), defaultQuota
+}
+
+// apiKeyID identifies an API key without revealing it: the hex SHA-256 of
+// the key, truncated to 64 bits.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// quotaMiddleware counts API requests against the caller's quota and
+// rejects them with 429 once either limit is exceeded. Counter failures
+// let the request through rather than taking the API down with Redis.
+func quotaMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		// OPTIONS is answered by the gateway itself (see methods.go)
+		if !strings.HasPrefix(path, "/api/") && path != "/graphql" || path == "/api/v1/usage" || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		client, quota := quotaClient(c)
+		now := time.Now().UTC()
+
+		daily, monthly, err := quotas.Increment(ctx, client, now)
+		if err != nil {
+			loggerFor(ctx).Warn("Quota accounting unavailable", zap.Error(err))
+			c.Next()
+			return
+		}
+
+		setQuotaHeaders(c, quota, daily, monthly)
+
+		var exceeded string
+		var reset time.Time
+		switch {
+		case quota.Daily > 0 && daily > quota.Daily:
+			exceeded, reset = "daily", nextDay(now)
+		case quota.Monthly > 0 && monthly > quota.Monthly:
+			exceeded, reset = "monthly", nextMonth(now)
+		}
+		if exceeded != "" {
+			quotaRejections.Add(ctx, 1, metric.WithAttributes(attribute.String("period", exceeded)), contextAttrs(ctx))
+			loggerFor(ctx).Info("Quota exceeded",
+				zap.String("client", client),
+				zap.String("period", exceeded),
+			)
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":     fmt.Sprintf("%s quota exceeded", exceeded),
+				"resets_at": reset.Format(time.RFC3339),
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func setQuotaHeaders(c *gin.Context, quota Quota, daily, monthly int64) {
+	if quota.Daily > 0 {
+		c.Header("X-Quota-Daily-Limit", strconv.FormatInt(quota.Daily, 10))
+		c.Header("X-Quota-Daily-Remaining", strconv.FormatInt(max(quota.Daily-daily, 0), 10))
+	}
+	if quota.Monthly > 0 {
+		c.Header("X-Quota-Monthly-Limit", strconv.FormatInt(quota.Monthly, 10))
+		c.Header("X-Quota-Monthly-Remaining", strconv.FormatInt(max(quota.Monthly-monthly, 0), 10))
+	}
+}
+
+// usageHandler serves GET /api/v1/usage: the caller's usage and remaining
+// quota for the current day and month (UTC).
+func usageHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	client, quota := quotaClient(c)
+	now := time.Now().UTC()
+
+	daily, monthly, err := quotas.Usage(ctx, client, now)
+	if err != nil {
+		loggerFor(ctx).Error("Failed to read quota usage", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Usage temporarily unavailable"})
+		return
+	}
+
+	period := func(used, limit int64, reset time.Time) gin.H {
+		h := gin.H{"used": used, "limit": nil, "remaining": nil, "resets_at": reset.Format(time.RFC3339)}
+		if limit > 0 {
+			h["limit"] = limit
+			h["remaining"] = max(limit-used, 0)
+		}
+		return h
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"client":  client,
+		"daily":   period(daily, quota.Daily, nextDay(now)),
+		"monthly": period(monthly, quota.Monthly, nextMonth(now)),
+	})
+}
+
+func nextDay(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func quotaKeys(client string, now time.Time) (string, string) {
+	return "quota:" + client + ":d:" + now.Format("20060102"),
+		"quota:" + client + ":m:" + now.Format("200601")
+}
+
+// redisQuotaStore keeps counters in Redis so every gateway replica shares
+// them. Keys expire shortly after their period ends.
+type redisQuotaStore struct {
+	client *redis.Client
+}
+
+func (s *redisQuotaStore) Increment(ctx context.Context, client string, now time.Time) (int64, int64, error) {
+	ctx, span := tracer.Start(ctx, "quota.increment")
+	defer span.End()
+
+	dayKey, monthKey := quotaKeys(client, now)
+	pipe := s.client.TxPipeline()
+	day := pipe.Incr(ctx, dayKey)
+	pipe.ExpireAt(ctx, dayKey, nextDay(now).Add(time.Hour))
+	month := pipe.Incr(ctx, monthKey)
+	pipe.ExpireAt(ctx, monthKey, nextMonth(now).Add(time.Hour))
+	if _, err := pipe.Exec(ctx); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+	return day.Val(), month.Val(), nil
+}
+
+func (s *redisQuotaStore) Usage(ctx context.Context, client string, now time.Time) (int64, int64, error) {
+	ctx, span := tracer.Start(ctx, "quota.usage")
+	defer span.End()
+
+	dayKey, monthKey := quotaKeys(client, now)
+	values, err := s.client.MGet(ctx, dayKey, monthKey).Result()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+
+	parse := func(v interface{}) int64 {
+		s, _ := v.(string)
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	return parse(values[0]), parse(values[1]), nil
+}
+
+func (s *redisQuotaStore) Clients(ctx context.Context, now time.Time, limit int) ([]QuotaUsage, error) {
+	ctx, span := tracer.Start(ctx, "quota.clients")
+	defer span.End()
+
+	suffix := ":d:" + now.Format("20060102")
+	var clients []string
+	iter := s.client.Scan(ctx, 0, "quota:*"+suffix, 100).Iterator()
+	for iter.Next(ctx) && len(clients) < limit {
+		client := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "quota:"), suffix)
+		clients = append(clients, client)
+	}
+	if err := iter.Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	usage := make([]QuotaUsage, 0, len(clients))
+	for _, client := range clients {
+		daily, monthly, err := s.Usage(ctx, client, now)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, QuotaUsage{Client: client, Daily: daily, Monthly: monthly})
+	}
+	return usage, nil
+}
+
+// memoryQuotaStore is the single-replica fallback used without Redis.
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	// day is the period the counters were last pruned for
+	day string
+}
+
+func (s *memoryQuotaStore) Increment(_ context.Context, client string, now time.Time) (int64, int64, error) {
+	dayKey, monthKey := quotaKeys(client, now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop counters from earlier periods once a day
+	if today := now.Format("20060102"); today != s.day {
+		s.day = today
+		suffixDay, suffixMonth := ":d:"+today, ":m:"+now.Format("200601")
+		for key := range s.counts {
+			if !strings.HasSuffix(key, suffixDay) && !strings.HasSuffix(key, suffixMonth) {
+				delete(s.counts, key)
+			}
+		}
+	}
+
+	s.counts[dayKey]++
+	s.counts[monthKey]++
+	return s.counts[dayKey], s.counts[monthKey], nil
+}
+
+func (s *memoryQuotaStore) Usage(_ context.Context, client string, now time.Time) (int64, int64, error) {
+	dayKey, monthKey := quotaKeys(client, now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[dayKey], s.counts[monthKey], nil
+}
+
+func (s *memoryQuotaStore) Clients(_ context.Context, now time.Time, limit int) ([]QuotaUsage, error) {
+	suffix := ":d:" + now.Format("20060102")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := []QuotaUsage{}
+	for key, daily := range s.counts {
+		if len(usage) == limit {
+			break
+		}
+		client, ok := strings.CutSuffix(strings.TrimPrefix(key, "quota:"), suffix)
+		if !ok {
+			continue
+		}
+		_, monthKey := quotaKeys(client, now)
+		usage = append(usage, QuotaUsage{Client: client, Daily: daily, Monthly: s.counts[monthKey]})
+	}
+	return usage, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The gateway describes every request in its baggage: the tenant (see
+// tenant.go), the client app (see attribution.go), the user the request
+// acts for and a hash of the API key it came with. Members a client sends
+// under these keys are replaced or removed. The propagator forwards the
+// baggage on every backend call, and each service tags its spans and logs
+// with the same members, and its metrics with the bounded ones, the tenant
+// and the client app.
+
+// maxBaggageUserID bounds the user IDs forwarded as baggage, which every
+// downstream request carries
+const maxBaggageUserID = 128
+
+// requestContextKey marks contexts whose baggage members the gateway set
+type requestContextKey struct{}
+
+// requestContextMiddleware records the caller in the request baggage: the
+// authenticated user, else the user_id in the query, and the API key's
+// hash, as the quota counts it (see quota.go).
+func requestContextMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString(userIDKey)
+		if userID == "" {
+			userID = c.Query("user_id")
+		}
+		if len(userID) > maxBaggageUserID {
+			userID = ""
+		}
+		var keyID string
+		if key := c.GetHeader(apiKeyHeader); key != "" {
+			keyID = apiKeyID(key)
+		}
+
+		ctx := c.Request.Context()
+		b := baggage.FromContext(ctx)
+		members := map[string]string{}
+		for key, value := range map[string]string{telemetry.UserBaggageKey: userID, telemetry.APIKeyBaggageKey: keyID} {
+			if value == "" {
+				b = b.DeleteMember(key)
+			} else {
+				members[key] = value
+			}
+		}
+		ctx = withBaggageMembers(baggage.ContextWithBaggage(ctx, b), members)
+		ctx = context.WithValue(ctx, requestContextKey{}, true)
+
+		// The server span started before the members were set
+		span := trace.SpanFromContext(ctx)
+		for key, value := range members {
+			span.SetAttributes(attribute.String(key, value))
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// contextAttrs are the metric attributes of the request in ctx: its tenant
+// and, if known, its client app, and client_bot for likely bots (see
+// bot.go).
+func contextAttrs(ctx context.Context) metric.MeasurementOption {
+	attrs := telemetry.ContextAttributes(ctx)
+	if baggage.FromContext(ctx).Member(botBaggageKey).Value() == "true" {
+		attrs = append(attrs, attribute.Bool("client_bot", true))
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+// contextSpanProcessor tags every span started within a request's context
+// with its baggage members. Spans started before requestContextMiddleware,
+// the server span among them, are skipped, as their baggage is still the
+// client's.
+type contextSpanProcessor struct {
+	telemetry.ContextSpanProcessor
+}
+
+func (p contextSpanProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if ctx.Value(requestContextKey{}) == nil {
+		return
+	}
+	p.ContextSpanProcessor.OnStart(ctx, s)
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Backend is a downstream service the gateway can proxy to.
+type Backend struct {
+	// EnvVar names the environment variable holding the service address,
+	// or several replica addresses separated by commas (see balance.go)
+	EnvVar string
+	// Service is the Kubernetes service found when EnvVar is unset (see
+	// discovery.go)
+	Service string
+	// Sticky sends each user's requests to the same replica
+	Sticky bool
+}
+
+// Route maps a gateway endpoint onto a backend endpoint. Path uses gin
+// syntax, so path parameters (":id") and wildcards ("*path") are supported;
+// parameters in Target are substituted from the incoming request.
+type Route struct {
+	Method  string
+	Path    string
+	Backend string
+	// Target is the upstream path; empty means the same as Path
+	Target string
+	// RequireUser rejects unauthenticated callers when login is enabled
+	RequireUser bool
+	// Scope is the scope API keys limited to scopes need (see scopes.go);
+	// empty lets every key call the route
+	Scope string
+	// Match restricts the route to a host or header values; routes sharing
+	// a method and path are tried in table order
+	Match Match
+	// Admin restricts the route to operators: callers with the admin token
+	// or signed in as one of ADMIN_USERS (see admin.go)
+	Admin bool
+	// Internal signs the upstream request for the backend's /internal
+	// routes; only allowed on Admin routes
+	Internal bool
+	// ForQueryUser acts for the user_id in the query instead of the caller:
+	// X-User-ID is not sent and sticky routing follows the queried user,
+	// as admin lookups of another user's data need
+	ForQueryUser bool
+	// BodyUser names a JSON body field holding a second user the request
+	// acts on, such as the source of a merge. A sticky backend only sees
+	// the users of its replica, so requests for which that user and the
+	// caller map to different replicas are refused with 409 rather than
+	// acting on no data.
+	BodyUser string
+	// Coalesce lets identical concurrent GETs share one backend call (see
+	// coalesce.go); only for routes whose responses don't depend on
+	// anything but the request and have no side effects
+	Coalesce bool
+	// Cache keeps successful GET responses for RESPONSE_CACHE_TTL (see
+	// cache.go); only for routes whose backend announces the writes that
+	// make them stale
+	Cache bool
+	// Transforms names the entries of transforms applied to the request
+	// and response, after defaultTransforms
+	Transforms []string
+	// Deprecation marks the route, or some of its parameters, as on the
+	// way out (see deprecation.go)
+	Deprecation *Deprecation
+
+	// Documentation used for the OpenAPI spec and the /docs explorer
+	Summary string
+	// Query lists the documented query parameters
+	Query []string
+	// Example is a sample JSON request body
+	Example string
+}
+
+var backends = map[string]Backend{
+	"jokes": {
+		EnvVar:  "JOKES_SERVICE_URL",
+		Service: "jokes-service",
+	},
+	// The user service keeps favorites in memory, so its replicas don't
+	// share state
+	"user": {
+		EnvVar:  "USER_SERVICE_URL",
+		Service: "user-service",
+		Sticky:  true,
+	},
+	"analytics": {
+		EnvVar:  "ANALYTICS_SERVICE_URL",
+		Service: "analytics-service",
+	},
+	// Backends for internal clients (see backendRules); unused unless set
+	"jokes-internal": {
+		EnvVar: "JOKES_INTERNAL_SERVICE_URL",
+	},
+	"user-internal": {
+		EnvVar: "USER_INTERNAL_SERVICE_URL",
+		Sticky: true,
+	},
+	"analytics-internal": {
+		EnvVar: "ANALYTICS_INTERNAL_SERVICE_URL",
+	},
+}
+
+var routes = []Route{
+	{
+		Method: "GET", Path: "/api/v1/joke", Backend: "jokes",
+		Scope:   scopeJokesRead,
+		Summary: "Get a random joke; only jokes passing the content filter unless safe=false, and only ones the user hasn't seen with unseen=true",
+		Query:   []string{"user_id", "safe", "unseen", "seed"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/joke/audio", Backend: "jokes",
+		Scope:   scopeJokesRead,
+		Summary: "A random joke, or the one named by id, as synthesized speech (audio/mpeg, or audio/wav without an MP3 encoder)",
+		Query:   []string{"id", "user_id", "safe", "seed"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/history", Backend: "jokes", RequireUser: true,
+		Scope:   scopeJokesRead,
+		Summary: "Jokes served to the user, newest first",
+		Query:   []string{"user_id", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/jokes/random", Backend: "jokes",
+		Scope:   scopeJokesRead,
+		Summary: "Get up to count distinct random jokes in one call",
+		Query:   []string{"count", "user_id", "safe", "seed"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/jokes/trending", Backend: "jokes", Coalesce: true, Cache: true,
+		Scope:   scopeJokesRead,
+		Summary: "Get the fastest-rising jokes of the last hour with their momentum",
+		Query:   []string{"limit", "safe"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/jokes", Backend: "jokes", Cache: true,
+		Scope:   scopeJokesRead,
+		Summary: "List the jokes of an author, or of the whole catalogue, a page at a time",
+		Query:   []string{"author", "limit", "offset", "safe"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/jokes/:id", Backend: "jokes", Coalesce: true, Cache: true,
+		Scope:   scopeJokesRead,
+		Summary: "Get a joke and its metadata by ID",
+	},
+	{
+		Method: "POST", Path: "/api/v1/joke/:id/reaction", Backend: "jokes",
+		Scope:   scopeJokesWrite,
+		Summary: "React to a joke (laugh, groan or meh)",
+		Example: `{"reaction": "laugh"}`,
+	},
+	{
+		Method: "POST", Path: "/api/v1/favorites", Backend: "user", RequireUser: true,
+		Transforms: []string{"stamp-source"},
+		Scope:      scopeFavoritesWrite,
+		Summary:    "Add a joke to the user's favorites",
+		Example:    `{"joke_id": "j_9b97cc0a4f0e0f95", "user_id": "user123"}`,
+	},
+	{
+		Method: "POST", Path: "/api/v1/favorite", Backend: "user", RequireUser: true,
+		Transforms:  []string{"stamp-source"},
+		Deprecation: &Deprecation{Since: "2026-10-16", Successor: "/api/v1/favorites"},
+		Scope:       scopeFavoritesWrite,
+		Summary:     "Add a joke to the user's favorites; deprecated, use POST /api/v1/favorites",
+		Example:     `{"joke_id": "j_9b97cc0a4f0e0f95", "user_id": "user123"}`,
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "List the user's favorite jokes; render=html adds notes rendered to HTML",
+		Query:   []string{"user_id", "render"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/changes", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "Favorites added, updated or deleted since a sync cursor; omit since for a snapshot",
+		Query:   []string{"user_id", "since", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/stats", Backend: "user", RequireUser: true, Coalesce: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "Favorite count, first and last favorite times and favorites per day",
+		Query:   []string{"user_id", "days"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/search", Backend: "user", RequireUser: true, Coalesce: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "Search the user's favorites by the words of the joke and note, best match first",
+		Query:   []string{"user_id", "q", "limit", "offset", "render"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/favorites/:id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Move a favorite to the trash",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/favorites", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Move all of the user's favorites to the trash; without confirm, answers 428 with the count and a confirmation token to repeat the request with",
+		Query:   []string{"user_id", "confirm"},
+	},
+	{
+		// gin has no literal colons in paths, so the custom method is a
+		// parameter holding ":batchDelete"; other methods get 404 upstream
+		Method: "POST", Path: "/api/v1/favorites:method", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "POST /api/v1/favorites:batchDelete moves up to 500 favorites to the trash, with a result per ID",
+		Example: `{"ids": ["01JA8Z3T4M6Q9W2XK5RB7N1HCE", "01JA8Z4B2C7D0E5F3G8H1J6K9M"], "user_id": "user123"}`,
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/:id/note", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "A favorite's note; render=html adds it rendered to sanitized HTML",
+		Query:   []string{"user_id", "render"},
+	},
+	{
+		Method: "PUT", Path: "/api/v1/favorites/:id/note", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Set a favorite's markdown note; an empty note removes it",
+		Example: `{"note": "Opened the Q3 review with this one. **Big laugh.**"}`,
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/favorites/:id/note", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Remove a favorite's note",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/export", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "Download the user's favorites and notes as JSON, CSV or markdown",
+		Query:   []string{"user_id", "format", "render"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/favorites/trash", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "List the user's deleted favorites",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/favorites/:id/restore", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Restore a favorite from the trash",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/collections", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Create a named collection of the user's favorites",
+		Example: `{"name": "Work talks", "description": "Openers for presentations", "user_id": "user123"}`,
+	},
+	{
+		Method: "GET", Path: "/api/v1/collections", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "List the user's collections",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/collections/:id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "A collection and its favorites; render=html adds notes rendered to HTML",
+		Query:   []string{"user_id", "render"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/collections/:id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Remove a collection; its favorites are kept",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "PUT", Path: "/api/v1/collections/:id/favorites/:favorite_id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Add a favorite to a collection",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/collections/:id/favorites/:favorite_id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Take a favorite out of a collection",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/collections/:id/share", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Share a collection by link, replacing any previous link",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/collections/:id/share", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Stop sharing a collection",
+		Query:   []string{"user_id"},
+	},
+	{
+		// The link's user_id is the owner's, whose replica holds the
+		// collection; no login needed
+		Method: "GET", Path: "/api/v1/shared/collections/:token", Backend: "user", ForQueryUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "The jokes of a shared collection, without notes",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/subscriptions", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Subscribe to a daily or weekly joke digest",
+		Example: `{"frequency": "weekly", "channel": "webhook", "target": "https://example.com/hook", "user_id": "user123"}`,
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/subscriptions", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Unsubscribe from joke digests",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/webhooks", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Register a webhook called on favorite.added and favorite.removed events",
+		Example: `{"url": "https://example.com/hooks/favorites", "events": ["favorite.added"], "user_id": "user123"}`,
+	},
+	{
+		Method: "GET", Path: "/api/v1/webhooks", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "List a user's webhooks",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/webhooks/:id", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesWrite,
+		Summary: "Remove a webhook",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/webhooks/dead-letters", Backend: "user", RequireUser: true,
+		Scope:   scopeFavoritesRead,
+		Summary: "Webhook deliveries given up on after retries",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "POST", Path: "/api/v1/users/merge/token", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersWrite,
+		Summary: "A short-lived token letting the signed-in user's data be merged into another user",
+	},
+	{
+		Method: "POST", Path: "/api/v1/users/merge", Backend: "user", RequireUser: true,
+		BodyUser: "from_user_id",
+		Scope:    scopeUsersWrite,
+		Summary:  "Move another user's favorites and subscription to the signed-in user, given that user's merge token",
+		Example:  `{"from_user_id": "anon-5f2c", "merge_token": "1760620800.5d41402abc4b2a76b9719d911017c592"}`,
+	},
+	{
+		Method: "GET", Path: "/api/v1/users/merges", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersRead,
+		Summary: "List the merges into or out of the user",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/users/:id/data", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersRead,
+		Summary: "Export everything stored about the signed-in user",
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/users/:id/data", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersWrite,
+		Summary: "Erase the signed-in user's data and report the erasure to analytics",
+	},
+	{
+		Method: "GET", Path: "/api/v1/users/:id/preferences", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersRead,
+		Summary: "The signed-in user's joke delivery preferences",
+	},
+	{
+		Method: "PUT", Path: "/api/v1/users/:id/preferences", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersWrite,
+		Summary: "Set the safe mode, categories and language jokes are served with",
+		Example: `{"safe_mode": true, "categories": ["programming"], "language": "en"}`,
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/users/:id/preferences", Backend: "user", RequireUser: true,
+		Scope:   scopeUsersWrite,
+		Summary: "Reset the signed-in user's delivery preferences",
+	},
+	{
+		Method: "POST", Path: "/api/v1/auth/magic-link", Backend: "user",
+		Summary: "Email a one-time sign-in link",
+		Example: `{"email": "ada@example.com"}`,
+	},
+	{
+		// The link's user_id routes it to the replica that remembers the
+		// links already used
+		Method: "GET", Path: "/api/v1/auth/verify", Backend: "user", ForQueryUser: true,
+		Summary: "Exchange a sign-in link for a bearer session token",
+		Query:   []string{"token", "user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Get joke statistics",
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/reactions", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Jokes ranked by groan ratio",
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/latency", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Latency percentiles (p50/p95/p99) per backend endpoint",
+		Query:   []string{"endpoint"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/clients", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Jokes served per client app, user agent family and gateway route",
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/geo", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Jokes served per country and region, as located by the gateway",
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/anomalies", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Current and recent spikes and droughts in the joke serving rate",
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/leaderboard", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Users ranked by favorites added or jokes requested over a window (1h, 24h, 7d or 30d)",
+		Query:   []string{"window", "by", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/slo", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "SLO compliance, error budget remaining and burn rates",
+		Query:   []string{"name"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/unique", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Approximate distinct users and visitors over a window (1h, 24h, 7d or 30d)",
+		Query:   []string{"window"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/trending", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Joke IDs ranked by momentum over a window (15m, 1h or 6h)",
+		Query:   []string{"window", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/compare", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Jokes served, favorites added and active users over a window (1h, 24h, 7d or 30d) against the window before",
+		Query:   []string{"window"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/funnel", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Served to favorited conversion per joke and overall",
+		Query:   []string{"limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/authors", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Jokes served and favorited per joke author",
+		Query:   []string{"author", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/stats/errors", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "Error counts and rates per route and per backend over a window",
+		Query:   []string{"window", "route", "backend"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/reports/weekly", Backend: "analytics", Coalesce: true,
+		Scope:   scopeStatsRead,
+		Summary: "A week's traffic, top jokes and users, latency and anomalies as JSON, HTML or PDF",
+		Query:   []string{"end", "format", "limit"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/grafana", Backend: "analytics",
+		Scope:   scopeStatsRead,
+		Summary: "Grafana JSON datasource connection test",
+	},
+	{
+		Method: "POST", Path: "/api/v1/grafana/search", Backend: "analytics",
+		Scope:   scopeStatsRead,
+		Summary: "Grafana JSON datasource targets",
+		Example: `{"target": ""}`,
+	},
+	{
+		Method: "POST", Path: "/api/v1/grafana/query", Backend: "analytics",
+		Scope:   scopeStatsRead,
+		Summary: "Grafana JSON datasource time series (jokes_served, unique_users, unique_visitors) and tables (trending, reactions, slo)",
+		Example: `{"range": {"from": "2025-01-01T00:00:00Z", "to": "2025-01-01T06:00:00Z"}, "intervalMs": 60000, "maxDataPoints": 500, "targets": [{"target": "jokes_served", "refId": "A"}]}`,
+	},
+	{
+		Method: "POST", Path: "/api/v1/grafana/annotations", Backend: "analytics",
+		Scope:   scopeStatsRead,
+		Summary: "Joke rate anomalies as Grafana annotations",
+		Example: `{"range": {"from": "2025-01-01T00:00:00Z", "to": "2025-01-01T06:00:00Z"}, "annotation": {"name": "Anomalies", "query": "spike"}}`,
+	},
+	{
+		Method: "GET", Path: "/admin/jokes/filtered", Backend: "jokes",
+		Target: "/internal/admin/filtered", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Jokes withheld from safe mode and why",
+	},
+	{
+		Method: "GET", Path: "/admin/stats/dump", Backend: "analytics",
+		Target: "/internal/admin/dump", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Raw analytics counters, alert state and audit trail",
+	},
+	{
+		Method: "GET", Path: "/admin/events/quarantine", Backend: "analytics",
+		Target: "/internal/admin/quarantine", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Tracking events rejected by analytics schema validation, newest first",
+		Query:   []string{"limit"},
+	},
+	{
+		Method: "POST", Path: "/admin/stats/reset", Backend: "analytics",
+		Target: "/internal/admin/reset", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Zero the analytics counters of a tenant, or of all tenants",
+		Query:   []string{"tenant"},
+	},
+	{
+		Method: "POST", Path: "/admin/stats/replay", Backend: "analytics",
+		Target: "/internal/admin/replay", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Rebuild the analytics aggregates from the raw event log",
+		Query:   []string{"from"},
+	},
+	{
+		Method: "GET", Path: "/admin/jokes", Backend: "jokes",
+		Target: "/internal/admin/jokes", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "All jokes with their metadata, safety and state",
+		Query:   []string{"include_retired", "state"},
+	},
+	{
+		Method: "POST", Path: "/admin/jokes", Backend: "jokes",
+		Target: "/internal/admin/jokes", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Add a joke",
+		Example: `{"joke": "Why do Java developers wear glasses? Because they don't C#.", "category": "programming"}`,
+	},
+	{
+		Method: "DELETE", Path: "/admin/jokes/:id", Backend: "jokes",
+		Target: "/internal/admin/jokes/:id", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Retire a joke; it keeps its ID and returns if the catalogue lists it",
+	},
+	{
+		Method: "PUT", Path: "/admin/jokes/:id/state", Backend: "jokes",
+		Target: "/internal/admin/jokes/:id/state", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Move a joke to draft, published or archived, optionally embargoing a draft",
+		Example: `{"state": "draft", "publish_at": "2026-12-24T18:00:00Z"}`,
+	},
+	{
+		Method: "GET", Path: "/admin/schedules", Backend: "jokes",
+		Target: "/internal/admin/schedules", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Seasonal joke schedules and whether each joke is in season",
+	},
+	{
+		Method: "PUT", Path: "/admin/jokes/:id/schedule", Backend: "jokes",
+		Target: "/internal/admin/jokes/:id/schedule", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Limit when a joke is served to yearly or one-off windows and/or a cron expression",
+		Example: `{"windows": [{"from": "10-01", "to": "10-31"}], "timezone": "America/New_York"}`,
+	},
+	{
+		Method: "DELETE", Path: "/admin/jokes/:id/schedule", Backend: "jokes",
+		Target: "/internal/admin/jokes/:id/schedule", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Remove a joke's schedule so it is served all year",
+	},
+	{
+		Method: "GET", Path: "/admin/experiments", Backend: "jokes",
+		Target: "/internal/experiments", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "A/B tests of joke variants, most recently started first",
+	},
+	{
+		Method: "POST", Path: "/admin/experiments", Backend: "jokes",
+		Target: "/internal/experiments", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Start testing alternate punchlines of a joke against the joke itself",
+		Example: `{"joke_id": "j_9b97cc0a4f0e0f95", "variants": [{"name": "short", "joke": "Why do Java developers wear glasses? C#."}]}`,
+	},
+	{
+		Method: "DELETE", Path: "/admin/experiments/:id", Backend: "jokes",
+		Target: "/internal/experiments/:id", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "End an experiment, serving the joke itself to everyone again",
+	},
+	{
+		Method: "GET", Path: "/admin/experiments/:id/results", Backend: "jokes",
+		Target: "/internal/experiments/:id/results", Match: Match{Host: "admin"},
+		Admin: true, Internal: true,
+		Scope:   scopeAdmin,
+		Summary: "Exposures, favorites and reactions per variant, and the leading variants",
+	},
+	{
+		Method: "GET", Path: "/admin/favorites", Backend: "user",
+		Target: "/api/v1/favorites", Match: Match{Host: "admin"},
+		Admin: true, ForQueryUser: true,
+		Scope:   scopeAdmin,
+		Summary: "A user's favorites, for support",
+		Query:   []string{"user_id"},
+	},
+}
+
+// localRoutes are served by the gateway itself; they are only listed here
+// so they appear in the API documentation.
+var localRoutes = []Route{
+	{Method: "GET", Path: "/healthz", Summary: "Gateway health check"},
+	{
+		Method: "GET", Path: "/status",
+		Summary: "Public status summary: each service up or down, its error rate and p95 latency",
+		Query:   []string{"format"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/home",
+		Scope:   scopeJokesRead,
+		Summary: "Joke, favorite count and stats in one response",
+		Query:   []string{"user_id"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/joke/next",
+		Scope:   scopeJokesRead,
+		Summary: "Wait up to ?wait= for the joke of the day or trending jokes to change; 204 if they don't",
+		Query:   []string{"wait", "cursor"},
+	},
+	{
+		Method: "GET", Path: "/api/v1/usage",
+		Summary: "Requests used and remaining quota for the caller's API key",
+	},
+	{
+		Method: "POST", Path: "/graphql",
+		Summary: "GraphQL queries for joke, favorites and stats, and the addFavorite mutation",
+		Example: `{"query": "{ joke { id joke } stats { totalJokes } }"}`,
+	},
+}
+
+// backendURL resolves the address of a backend from its environment
+// variable, else its service; it is "" for a backend that is not set up.
+func backendURL(name string) string {
+	b := backends[name]
+	if addr := os.Getenv(b.EnvVar); addr != "" {
+		return addr
+	}
+	if b.Service == "" {
+		return ""
+	}
+	return defaultBackendAddress(b.Service)
+}
+
+// registerRoutes installs a proxy handler for every method and path in the
+// route table, and HEAD and OPTIONS handlers (see methods.go). Each request
+// is served by the first route for its path whose Match accepts it, so
+// conditional routes share a path with a fallback.
+func registerRoutes(r *gin.Engine) {
+	type endpoint struct{ method, path string }
+	var order []endpoint
+	candidates := map[endpoint][]Route{}
+
+	for _, route := range routes {
+		if _, ok := backends[route.Backend]; !ok {
+			logger.Fatal("Route references unknown backend",
+				zap.String("path", route.Path),
+				zap.String("backend", route.Backend),
+			)
+		}
+		if route.Match.Host != "" {
+			if _, ok := hosts[route.Match.Host]; !ok {
+				logger.Fatal("Route references unknown host",
+					zap.String("path", route.Path),
+					zap.String("host", route.Match.Host),
+				)
+			}
+		}
+		for _, name := range route.Transforms {
+			if _, ok := transforms[name]; !ok {
+				logger.Fatal("Route references unknown transform",
+					zap.String("path", route.Path),
+					zap.String("transform", name),
+				)
+			}
+		}
+		if route.Internal && !route.Admin {
+			logger.Fatal("Internal route is not an admin route",
+				zap.String("path", route.Path),
+			)
+		}
+		if route.Target == "" {
+			route.Target = route.Path
+		}
+
+		key := endpoint{route.Method, route.Path}
+		if _, ok := candidates[key]; !ok {
+			order = append(order, key)
+		}
+		candidates[key] = append(candidates[key], route)
+
+		logger.Info("Route registered",
+			zap.String("method", route.Method),
+			zap.String("path", route.Path),
+			zap.String("backend", route.Backend),
+			zap.String("target", route.Target),
+			zap.String("match", route.Match.describe()),
+		)
+	}
+
+	var paths []string
+	methods := map[string][]string{}
+	for _, key := range order {
+		r.Handle(key.method, key.path, routeHandler(candidates[key]))
+		if _, ok := methods[key.path]; !ok {
+			paths = append(paths, key.path)
+		}
+		methods[key.path] = append(methods[key.path], key.method)
+	}
+	// Every path also answers OPTIONS, and HEAD if it answers GET
+	for _, path := range paths {
+		registerImplicitMethods(r, path, methods[path], candidates[endpoint{http.MethodGet, path}])
+	}
+}
+
+// matchRoute returns the first of candidates whose Match accepts the
+// request.
+func matchRoute(c *gin.Context, candidates []Route) (Route, bool) {
+	for _, route := range candidates {
+		if route.Match.matches(c) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// routeHandler serves a request with the first of candidates whose Match
+// accepts it.
+func routeHandler(candidates []Route) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, ok := matchRoute(c, candidates)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		serveRoute(c, route)
+	}
+}
+
+// serveRoute proxies a request to the backend selected for route.
+func serveRoute(c *gin.Context, route Route) {
+	c.Set(routeBackendKey, routeBackend(c, route.Backend))
+	noteDeprecatedUse(c, route)
+	if route.Admin {
+		if requireAdmin(c); c.IsAborted() {
+			return
+		}
+	}
+	if route.RequireUser {
+		if requireUser(c); c.IsAborted() {
+			return
+		}
+	}
+	if requireScope(c, route.Scope); c.IsAborted() {
+		return
+	}
+	proxy := func() { proxyRoute(c, route) }
+	if route.Coalesce && coalescingEnabled && c.Request.Method == http.MethodGet {
+		next := proxy
+		proxy = func() { serveCoalesced(c, route, next) }
+	}
+	if route.Cache && responseCacheEnabled && c.Request.Method == http.MethodGet {
+		serveCached(c, route, proxy)
+		return
+	}
+	proxy()
+}
+
+// proxyRoute proxies a request to a replica of the route's backend, once
+// the backend has room for it.
+func proxyRoute(c *gin.Context, route Route) {
+	backend := routeBackend(c, route.Backend)
+	release, err := acquireBackend(c.Request.Context(), backend)
+	if err != nil {
+		shedRequest(c)
+		return
+	}
+	defer release()
+
+	key := stickyKey(c)
+	if route.ForQueryUser {
+		key = c.Query("user_id")
+	}
+	serviceURL := pickEndpoint(backend, key)
+	if route.BodyUser != "" {
+		if other := bodyUserID(c, route.BodyUser); other != "" && pickEndpoint(backend, other) != serviceURL {
+			loggerFor(c.Request.Context()).Warn("Request spans replicas",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("field", route.BodyUser),
+			)
+			c.JSON(http.StatusConflict, gin.H{
+				"error": route.BodyUser + " is held by another replica than the caller",
+			})
+			return
+		}
+	}
+	path := expandPath(route.Target, c.Params)
+	mirrorRequest(c, route, path)
+	proxyRequest(c, backend, serviceURL, path, route)
+}
+
+// expandPath substitutes ":name" and "*name" segments, and ":name" after a
+// literal prefix, with request params.
+func expandPath(pattern string, params gin.Params) string {
+	segments := strings.Split(pattern, "/")
+	for i, seg := range segments {
+		if len(seg) < 2 {
+			continue
+		}
+		switch seg[0] {
+		case ':':
+			value, _ := params.Get(seg[1:])
+			segments[i] = url.PathEscape(value)
+		case '*':
+			value, _ := params.Get(seg[1:])
+			segments[i] = strings.TrimPrefix(value, "/")
+		default:
+			// A parameter after a literal prefix, as in "favorites:method"
+			if j := strings.IndexByte(seg, ':'); j > 0 {
+				value, _ := params.Get(seg[j+1:])
+				segments[i] = seg[:j] + url.PathEscape(value)
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// The status of every response is counted by route and backend, and the
+// counts are reported to analytics as a route_statuses event every
+// ROUTE_STATUS_INTERVAL (default 10s; 0 turns reporting off), so
+// GET /api/v1/stats/errors can show error rates per route and backend.
+// Routes are "METHOD /path" as in the route table. Requests the gateway
+// answers itself (aggregates, GraphQL, docs, admin) count under the
+// "gateway" backend; health checks and requests matching no route aren't
+// counted. Counts analytics doesn't take are kept for the next report, up
+// to maxPendingRouteStatuses distinct route, backend and status triples.
+
+// gatewayBackend is the backend of the routes the gateway serves itself
+const gatewayBackend = "gateway"
+
+// routeBackendKey holds the backend a proxied request was sent to
+const routeBackendKey = "route_backend"
+
+const (
+	// routeStatusBatchSize is the most counts sent in one event, keeping
+	// events well under analytics' size limit
+	routeStatusBatchSize = 250
+	// maxPendingRouteStatuses bounds the counts kept while analytics is
+	// down
+	maxPendingRouteStatuses = 5000
+)
+
+// routeStatus is what a response is counted by.
+type routeStatus struct {
+	route, backend string
+	status         int
+}
+
+// RouteStatusCount is a count of responses in a route_statuses event.
+type RouteStatusCount struct {
+	Route   string `json:"route"`
+	Backend string `json:"backend"`
+	Status  int    `json:"status"`
+	Count   int64  `json:"count"`
+}
+
+var (
+	routeStatusInterval = 10 * time.Second
+
+	routeStatuses      = map[routeStatus]int64{}
+	routeStatusesMutex sync.Mutex
+)
+
+func initRouteStatuses() {
+	routeStatusInterval = envDuration("ROUTE_STATUS_INTERVAL", routeStatusInterval)
+	if routeStatusInterval == 0 {
+		logger.Info("Route status reporting disabled")
+		return
+	}
+	go reportRouteStatuses()
+}
+
+// routeStatusMiddleware counts the status of every routed response.
+func routeStatusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		path := c.FullPath()
+		if routeStatusInterval == 0 || path == "" || path == "/healthz" {
+			return
+		}
+		backend := c.GetString(routeBackendKey)
+		if backend == "" {
+			backend = gatewayBackend
+		}
+		key := routeStatus{route: c.Request.Method + " " + path, backend: backend, status: c.Writer.Status()}
+
+		routeStatusesMutex.Lock()
+		routeStatuses[key]++
+		routeStatusesMutex.Unlock()
+	}
+}
+
+// reportRouteStatuses sends the counts to analytics every interval.
+func reportRouteStatuses() {
+	ticker := time.NewTicker(routeStatusInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		routeStatusesMutex.Lock()
+		counts := make([]RouteStatusCount, 0, len(routeStatuses))
+		for key, n := range routeStatuses {
+			counts = append(counts, RouteStatusCount{Route: key.route, Backend: key.backend, Status: key.status, Count: n})
+		}
+		routeStatuses = map[routeStatus]int64{}
+		routeStatusesMutex.Unlock()
+
+		for start := 0; start < len(counts); start += routeStatusBatchSize {
+			batch := counts[start:min(start+routeStatusBatchSize, len(counts))]
+			if err := sendRouteStatuses(context.Background(), batch); err != nil {
+				logger.Warn("Failed to report route statuses, keeping them for the next report",
+					zap.Int("counts", len(counts)-start),
+					zap.Error(err),
+				)
+				keepRouteStatuses(counts[start:])
+				break
+			}
+		}
+	}
+}
+
+// keepRouteStatuses adds counts that couldn't be reported back to the
+// next report.
+func keepRouteStatuses(counts []RouteStatusCount) {
+	routeStatusesMutex.Lock()
+	defer routeStatusesMutex.Unlock()
+	for _, count := range counts {
+		key := routeStatus{route: count.Route, backend: count.Backend, status: count.Status}
+		if _, ok := routeStatuses[key]; ok || len(routeStatuses) < maxPendingRouteStatuses {
+			routeStatuses[key] += count.Count
+		}
+	}
+}
+
+// sendRouteStatuses posts counts to analytics as a route_statuses event.
+func sendRouteStatuses(ctx context.Context, counts []RouteStatusCount) error {
+	ctx, span := tracer.Start(ctx, "report_route_statuses")
+	defer span.End()
+
+	endpoint := pickEndpoint("analytics", "")
+	if endpoint == "" {
+		return fmt.Errorf("no analytics endpoint")
+	}
+
+	payload := struct {
+		Routes []RouteStatusCount `json:"routes"`
+	}{Routes: counts}
+	body, err := json.Marshal(gin.H{
+		"event_type":     "route_statuses",
+		"schema_version": 2,
+		"payload":        payload,
+	})
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("route_statuses.count", len(counts)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+endpoint+"/internal/events", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	signRequest(req, body)
+
+	resp, err := backendClient("analytics").Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnprocessableEntity:
+		// Analytics rejected the event as invalid; resending won't help
+		logger.Error("Analytics rejected route statuses", zap.Int("counts", len(counts)))
+		return nil
+	case resp.StatusCode >= 300:
+		span.SetStatus(codes.Error, resp.Status)
+		return fmt.Errorf("analytics answered %s", resp.Status)
+	}
+	return nil
+}
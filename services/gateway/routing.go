@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Match restricts a route or backend rule to some requests. Empty fields
+// match everything.
+type Match struct {
+	// Host names an entry in hosts; requests must be addressed to it
+	Host string
+	// Headers must all be present with exactly these values
+	Headers map[string]string
+}
+
+// VirtualHost is a hostname the gateway serves dedicated routes on.
+type VirtualHost struct {
+	// EnvVar names the environment variable holding the hostname
+	EnvVar string
+	// Default is used when EnvVar is unset
+	Default string
+}
+
+var hosts = map[string]VirtualHost{
+	// Admin routes are only reachable through this host, which should be
+	// exposed on an internal ingress only
+	"admin": {
+		EnvVar:  "ADMIN_HOST",
+		Default: "admin.jokes.example",
+	},
+}
+
+// BackendRule sends requests matching Match to a different backend than
+// the one named in the route table.
+type BackendRule struct {
+	Match Match
+	// Backends maps a route's backend to the backend used instead
+	Backends map[string]string
+}
+
+// backendRules are tried in order; the first match wins. A rule whose
+// replacement backend has no address configured is skipped.
+var backendRules = []BackendRule{
+	{
+		Match: Match{Headers: map[string]string{"X-Client": "internal"}},
+		Backends: map[string]string{
+			"jokes":     "jokes-internal",
+			"user":      "user-internal",
+			"analytics": "analytics-internal",
+		},
+	},
+}
+
+// hostName resolves a virtual host from its environment variable.
+func hostName(name string) string {
+	h := hosts[name]
+	if v := os.Getenv(h.EnvVar); v != "" {
+		return strings.ToLower(v)
+	}
+	return strings.ToLower(h.Default)
+}
+
+// matches reports whether the request satisfies m.
+func (m Match) matches(c *gin.Context) bool {
+	if m.Host != "" && requestHost(c) != hostName(m.Host) {
+		return false
+	}
+	for name, value := range m.Headers {
+		if strings.TrimSpace(c.GetHeader(name)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// describe summarizes m for logs and the API docs.
+func (m Match) describe() string {
+	var parts []string
+	if m.Host != "" {
+		parts = append(parts, "host "+hostName(m.Host))
+	}
+	for name, value := range m.Headers {
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// requestHost is the lowercased Host of the request without the port.
+func requestHost(c *gin.Context) string {
+	host := c.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// routeBackend picks the backend serving a request for a route, applying
+// the first matching backend rule.
+func routeBackend(c *gin.Context, backend string) string {
+	for _, rule := range backendRules {
+		replacement, ok := rule.Backends[backend]
+		if !ok || backendURL(replacement) == "" || !rule.Match.matches(c) {
+			continue
+		}
+		return replacement
+	}
+	return backend
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// testContext returns a context for a GET to host with headers.
+func testContext(host string, headers map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/joke", nil)
+	c.Request.Host = host
+	for name, value := range headers {
+		c.Request.Header.Set(name, value)
+	}
+	return c, w
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		name      string
+		adminHost string
+		host      string
+		want      bool
+	}{
+		{"default host", "", "admin.jokes.example", true},
+		{"default host with port", "", "admin.jokes.example:8443", true},
+		{"default host in capitals", "", "ADMIN.Jokes.Example", true},
+		{"public host", "", "jokes.example", false},
+		{"subdomain of the host", "", "x.admin.jokes.example", false},
+		{"empty host", "", "", false},
+		{"configured host", "Admin.Internal", "admin.internal", true},
+		{"configured host with port", "admin.internal", "ADMIN.INTERNAL:80", true},
+		{"default host when another is configured", "admin.internal", "admin.jokes.example", false},
+		{"IPv6 address", "::1", "[::1]:8080", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_HOST", tt.adminHost)
+			c, _ := testContext(tt.host, nil)
+			if got := (Match{Host: "admin"}).matches(c); got != tt.want {
+				t.Errorf("Host %q matched %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	match := Match{Headers: map[string]string{"X-Client": "internal", "X-Env": "staging"}}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"all headers", map[string]string{"X-Client": "internal", "X-Env": "staging"}, true},
+		{"header names in any case", map[string]string{"x-client": "internal", "X-ENV": "staging"}, true},
+		{"surrounding spaces", map[string]string{"X-Client": " internal ", "X-Env": "staging"}, true},
+		{"value in another case", map[string]string{"X-Client": "Internal", "X-Env": "staging"}, false},
+		{"other value", map[string]string{"X-Client": "partner", "X-Env": "staging"}, false},
+		{"one header missing", map[string]string{"X-Client": "internal"}, false},
+		{"no headers", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext("jokes.example", tt.headers)
+			if got := match.matches(c); got != tt.want {
+				t.Errorf("headers %v matched %v, want %v", tt.headers, got, tt.want)
+			}
+		})
+	}
+
+	c, _ := testContext("jokes.example", nil)
+	if !(Match{}).matches(c) {
+		t.Error("an empty Match rejected a request")
+	}
+}
+
+func TestMatchRoutePrecedence(t *testing.T) {
+	t.Setenv("ADMIN_HOST", "")
+	byHost := Route{Target: "admin", Match: Match{Host: "admin"}}
+	byHeader := Route{Target: "internal", Match: Match{Headers: map[string]string{"X-Client": "internal"}}}
+	pathOnly := Route{Target: "public"}
+
+	tests := []struct {
+		name       string
+		candidates []Route
+		host       string
+		headers    map[string]string
+		want       string
+	}{
+		{"host rule before path-only route", []Route{byHost, pathOnly}, "admin.jokes.example", nil, "admin"},
+		{"path-only route when the host differs", []Route{byHost, pathOnly}, "jokes.example", nil, "public"},
+		{"header rule before path-only route", []Route{byHeader, pathOnly}, "jokes.example", map[string]string{"X-Client": "internal"}, "internal"},
+		{"path-only route without the header", []Route{byHeader, pathOnly}, "jokes.example", nil, "public"},
+		{"first of several matching rules", []Route{byHeader, byHost, pathOnly}, "admin.jokes.example", map[string]string{"X-Client": "internal"}, "internal"},
+		{"path-only route listed first shadows rules", []Route{pathOnly, byHost}, "admin.jokes.example", nil, "public"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(tt.host, tt.headers)
+			route, ok := matchRoute(c, tt.candidates)
+			if !ok || route.Target != tt.want {
+				t.Errorf("matched %q (%v), want %q", route.Target, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteHandlerNoMatch(t *testing.T) {
+	t.Setenv("ADMIN_HOST", "")
+	candidates := []Route{
+		{Target: "admin", Match: Match{Host: "admin"}},
+		{Target: "internal", Match: Match{Headers: map[string]string{"X-Client": "internal"}}},
+	}
+
+	c, w := testContext("jokes.example", map[string]string{"X-Client": "partner"})
+	if route, ok := matchRoute(c, candidates); ok {
+		t.Fatalf("matched %q, want no route", route.Target)
+	}
+	routeHandler(candidates)(c)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRouteBackend(t *testing.T) {
+	internal := map[string]string{"X-Client": "internal"}
+	tests := []struct {
+		name       string
+		backendURL string
+		headers    map[string]string
+		backend    string
+		want       string
+	}{
+		{"internal client", "jokes-internal:8081", internal, "jokes", "jokes-internal"},
+		{"internal client without an internal backend", "", internal, "jokes", "jokes"},
+		{"other client", "jokes-internal:8081", map[string]string{"X-Client": "web"}, "jokes", "jokes"},
+		{"backend without a rule", "jokes-internal:8081", internal, "gateway", "gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JOKES_INTERNAL_SERVICE_URL", tt.backendURL)
+			c, _ := testContext("jokes.example", tt.headers)
+			if got := routeBackend(c, tt.backend); got != tt.want {
+				t.Errorf("backend %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAdminRoutesIgnoreHost checks that addressing a request to the admin
+// host is not enough to reach an admin route.
+func TestAdminRoutesIgnoreHost(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("ADMIN_HOST", "")
+
+	tests := []struct {
+		name       string
+		adminToken string
+		adminUsers string
+		headers    map[string]string
+		user       string
+		want       int
+	}{
+		{"nothing configured", "", "", nil, "", http.StatusUnauthorized},
+		{"no credentials", "s3cret", "ops1", nil, "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "", map[string]string{adminTokenHeader: "guess"}, "", http.StatusForbidden},
+		{"signed-in user not allowed", "s3cret", "ops1", nil, "magic-user", http.StatusForbidden},
+		{"signed-in user when no users are allowed", "s3cret", "", nil, "ops1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GATEWAY_ADMIN_TOKEN", tt.adminToken)
+			t.Setenv("ADMIN_USERS", tt.adminUsers)
+			initAdmin()
+
+			check := func(path string, handler gin.HandlerFunc) {
+				c, w := testContext("admin.jokes.example", tt.headers)
+				if tt.user != "" {
+					c.Set(userIDKey, tt.user)
+				}
+				handler(c)
+				if w.Code != tt.want {
+					t.Errorf("%s: status %d, want %d", path, w.Code, tt.want)
+				}
+			}
+			for _, route := range routes {
+				if route.Match.Host != "admin" {
+					continue
+				}
+				if !route.Admin {
+					t.Errorf("%s %s is served on the admin host but is not an admin route", route.Method, route.Path)
+					continue
+				}
+				check(route.Path, routeHandler([]Route{route}))
+			}
+			check("/admin/gateway", adminMiddleware())
+		})
+	}
+}
+
+func TestAdminRoutesAllowOperators(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("ADMIN_HOST", "")
+	t.Setenv("GATEWAY_ADMIN_TOKEN", "s3cret")
+	t.Setenv("ADMIN_USERS", "ops1, ops2")
+	initAdmin()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		user    string
+	}{
+		{"admin token", map[string]string{adminTokenHeader: "s3cret"}, ""},
+		{"admin user", nil, "ops2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext("admin.jokes.example", tt.headers)
+			if tt.user != "" {
+				c.Set(userIDKey, tt.user)
+			}
+			if requireAdmin(c); c.IsAborted() {
+				t.Error("operator rejected")
+			}
+		})
+	}
+}
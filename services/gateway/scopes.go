@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// API keys can be limited to scopes, so a dashboard can get a read-only
+// key. API_KEY_SCOPES lists the scopes of each limited key
+// ("key=stats:read|jokes:read,..."); every route in the table names the
+// scope it needs (Route.Scope), and a caller calling a route whose scope
+// it lacks gets 403 naming the missing scope. Access is denied by default:
+//   - keys listed in none of API_KEY_SCOPES, API_KEY_QUOTAS and
+//     API_KEY_TENANTS are rejected with 401 (see apiKeyMiddleware)
+//   - keys listed elsewhere but not in API_KEY_SCOPES get defaultKeyScopes
+//   - callers without a key get ANONYMOUS_SCOPES, by default the same
+//   - the admin scope is never a default; callers without a key get it
+//     only as operators (see requireAdmin)
+// Routes without a scope, such as login and GET /api/v1/usage, are open to
+// every caller.
+//
+// GraphQL checks the scope of each field it resolves, and GET /api/v1/home
+// leaves out the sections the caller can't read.
+
+// Scopes
+const (
+	scopeJokesRead      = "jokes:read"
+	scopeJokesWrite     = "jokes:write"
+	scopeFavoritesRead  = "favorites:read"
+	scopeFavoritesWrite = "favorites:write"
+	scopeUsersRead      = "users:read"
+	scopeUsersWrite     = "users:write"
+	scopeStatsRead      = "stats:read"
+	scopeAdmin          = "admin"
+)
+
+// knownScopes are the scopes routes and keys may name. Favorites scopes
+// cover collections, digest subscriptions and webhooks too; users scopes
+// cover merges and data export and erasure.
+var knownScopes = map[string]bool{
+	scopeJokesRead: true, scopeJokesWrite: true,
+	scopeFavoritesRead: true, scopeFavoritesWrite: true,
+	scopeUsersRead: true, scopeUsersWrite: true,
+	scopeStatsRead: true, scopeAdmin: true,
+}
+
+// defaultKeyScopes are the scopes of keys not listed in API_KEY_SCOPES:
+// every scope but admin
+var defaultKeyScopes = map[string]bool{
+	scopeJokesRead: true, scopeJokesWrite: true,
+	scopeFavoritesRead: true, scopeFavoritesWrite: true,
+	scopeUsersRead: true, scopeUsersWrite: true,
+	scopeStatsRead: true,
+}
+
+var (
+	// apiKeyScopes maps limited API keys to their scopes
+	apiKeyScopes map[string]map[string]bool
+	// anonymousScopes are the scopes of callers without an API key
+	anonymousScopes map[string]bool
+)
+
+// apiKeyScopesKey is the context key of the caller's scopes, for GraphQL
+type apiKeyScopesKey struct{}
+
+// initScopes reads API_KEY_SCOPES ("key=scope|scope,...") and
+// ANONYMOUS_SCOPES ("scope,scope,..."). It must run after initQuotas and
+// initTenants, which list API keys too.
+func initScopes() {
+	apiKeyScopes = map[string]map[string]bool{}
+	for _, entry := range strings.Split(os.Getenv("API_KEY_SCOPES"), ",") {
+		key, list, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || key == "" {
+			continue
+		}
+		scopes := apiKeyScopes[key]
+		if scopes == nil {
+			// A key listed with no valid scope can call only unscoped routes
+			scopes = map[string]bool{}
+			apiKeyScopes[key] = scopes
+		}
+		for _, scope := range strings.Split(list, "|") {
+			scope = strings.TrimSpace(scope)
+			if !knownScopes[scope] {
+				logger.Warn("Ignoring unknown scope in API_KEY_SCOPES", zap.String("scope", scope))
+				continue
+			}
+			scopes[scope] = true
+		}
+	}
+	if len(apiKeyScopes) > 0 {
+		logger.Info("API key scopes loaded", zap.Int("keys", len(apiKeyScopes)))
+	}
+
+	anonymousScopes = defaultKeyScopes
+	if v, ok := os.LookupEnv("ANONYMOUS_SCOPES"); ok {
+		anonymousScopes = map[string]bool{}
+		for _, scope := range strings.Split(v, ",") {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			if !knownScopes[scope] || scope == scopeAdmin {
+				logger.Warn("Ignoring scope in ANONYMOUS_SCOPES", zap.String("scope", scope))
+				continue
+			}
+			anonymousScopes[scope] = true
+		}
+	}
+}
+
+// knownAPIKey reports whether key is listed in any of the API key settings.
+func knownAPIKey(key string) bool {
+	_, scoped := apiKeyScopes[key]
+	_, quota := keyQuotas[key]
+	_, tenant := apiKeyTenants[key]
+	return scoped || quota || tenant
+}
+
+// apiKeyMiddleware rejects requests carrying an API key the gateway
+// doesn't know.
+func apiKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader(apiKeyHeader); key != "" && !knownAPIKey(key) {
+			loggerFor(c.Request.Context()).Info("Unknown API key",
+				zap.String("api_key", apiKeyID(key)),
+				zap.String("path", c.Request.URL.Path),
+			)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unknown API key"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// callerScopes returns the scopes of the caller: those of its API key,
+// else the anonymous scopes, with admin for operators.
+func callerScopes(c *gin.Context) map[string]bool {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		if scopes, ok := apiKeyScopes[key]; ok {
+			return scopes
+		}
+		if knownAPIKey(key) {
+			return defaultKeyScopes
+		}
+		return nil
+	}
+	if !c.GetBool(adminCallerKey) {
+		return anonymousScopes
+	}
+	scopes := map[string]bool{scopeAdmin: true}
+	for scope := range anonymousScopes {
+		scopes[scope] = true
+	}
+	return scopes
+}
+
+// hasScope reports whether the caller may use routes needing scope.
+func hasScope(c *gin.Context, scope string) bool {
+	return scope == "" || callerScopes(c)[scope]
+}
+
+// missingScopeMessage is the error for a caller lacking scope
+func missingScopeMessage(scope string) string {
+	return "Caller lacks the " + scope + " scope"
+}
+
+// requireScope rejects callers lacking scope.
+func requireScope(c *gin.Context, scope string) {
+	if hasScope(c, scope) {
+		return
+	}
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("api_key.missing_scope", scope))
+	loggerFor(c.Request.Context()).Info("Caller lacks scope",
+		zap.String("scope", scope),
+		zap.String("path", c.FullPath()),
+	)
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":         missingScopeMessage(scope),
+		"missing_scope": scope,
+	})
+}
+
+// scopeMiddleware guards a handler served by the gateway itself like a
+// route needing scope.
+func scopeMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requireScope(c, scope)
+	}
+}
+
+// withCallerScopes returns a copy of ctx carrying the caller's scopes, for
+// checks that have only the context.
+func withCallerScopes(ctx context.Context, c *gin.Context) context.Context {
+	return context.WithValue(ctx, apiKeyScopesKey{}, callerScopes(c))
+}
+
+// contextHasScope is hasScope for a context made by withCallerScopes; a
+// context without scopes has none.
+func contextHasScope(ctx context.Context, scope string) bool {
+	scopes, _ := ctx.Value(apiKeyScopesKey{}).(map[string]bool)
+	return scope == "" || scopes[scope]
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestScopesDenyByDefault(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("API_KEY_SCOPES", "dash1=stats:read,ops1=admin|stats:read")
+	keyQuotas = map[string]Quota{"partner1": {Daily: 1000, Monthly: 20000}}
+	t.Cleanup(func() { keyQuotas = nil })
+	initScopes()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		scope   string
+		want    bool
+	}{
+		{"no key on an admin route", nil, scopeAdmin, false},
+		{"no key on a public route", nil, scopeJokesRead, true},
+		{"no key on an unscoped route", nil, "", true},
+		{"read-only key on a write route", map[string]string{apiKeyHeader: "dash1"}, scopeJokesWrite, false},
+		{"read-only key on its scope", map[string]string{apiKeyHeader: "dash1"}, scopeStatsRead, true},
+		{"read-only key on an admin route", map[string]string{apiKeyHeader: "dash1"}, scopeAdmin, false},
+		{"admin key on an admin route", map[string]string{apiKeyHeader: "ops1"}, scopeAdmin, true},
+		{"key without scopes on a write route", map[string]string{apiKeyHeader: "partner1"}, scopeFavoritesWrite, true},
+		{"key without scopes on an admin route", map[string]string{apiKeyHeader: "partner1"}, scopeAdmin, false},
+		{"unknown key", map[string]string{apiKeyHeader: "guess"}, scopeJokesRead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext("jokes.example", tt.headers)
+			if got := hasScope(c, tt.scope); got != tt.want {
+				t.Errorf("hasScope(%q) = %v, want %v", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminScopeWithoutKey(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("ADMIN_HOST", "")
+	t.Setenv("API_KEY_SCOPES", "")
+	t.Setenv("GATEWAY_ADMIN_TOKEN", "s3cret")
+	t.Setenv("ADMIN_USERS", "")
+	initScopes()
+	initAdmin()
+
+	for _, route := range routes {
+		if route.Scope != scopeAdmin {
+			continue
+		}
+		c, w := testContext("jokes.example", nil)
+		if requireScope(c, route.Scope); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s without a key: status %d, want %d", route.Method, route.Path, w.Code, http.StatusForbidden)
+		}
+	}
+
+	c, _ := testContext("admin.jokes.example", map[string]string{adminTokenHeader: "s3cret"})
+	if requireAdmin(c); c.IsAborted() {
+		t.Fatal("operator rejected")
+	}
+	if !hasScope(c, scopeAdmin) {
+		t.Error("operator without a key lacks the admin scope")
+	}
+}
+
+func TestUnknownAPIKeyRejected(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("API_KEY_SCOPES", "dash1=stats:read")
+	initScopes()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"known key", map[string]string{apiKeyHeader: "dash1"}, http.StatusOK},
+		{"unknown key", map[string]string{apiKeyHeader: "guess"}, http.StatusUnauthorized},
+		{"no key", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := testContext("jokes.example", tt.headers)
+			apiKeyMiddleware()(c)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymousScopes(t *testing.T) {
+	logger = zap.NewNop()
+	t.Setenv("API_KEY_SCOPES", "")
+	t.Setenv("ANONYMOUS_SCOPES", "jokes:read, stats:read, admin")
+	initScopes()
+
+	c, _ := testContext("jokes.example", nil)
+	for scope, want := range map[string]bool{scopeJokesRead: true, scopeStatsRead: true, scopeFavoritesWrite: false, scopeAdmin: false} {
+		if got := hasScope(c, scope); got != want {
+			t.Errorf("hasScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
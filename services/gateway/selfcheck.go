@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Misconfiguration is found at startup rather than by the first request
+// tripping over it. Once every setting is read, checkStartup looks for
+//
+//   - malformed numbers and durations, which the settings otherwise ignore
+//     in favor of their defaults
+//   - conflicting or incomplete settings, such as a TLS certificate without
+//     its key, or both a certificate and TLS_AUTOCERT_DOMAINS
+//   - missing secrets: those listed in STARTUP_REQUIRED_SECRETS must be
+//     set, the others are only warned about
+//   - backends whose hosts don't resolve and, with STARTUP_PROBE_BACKENDS,
+//     replicas not answering GET /healthz within STARTUP_PROBE_TIMEOUT
+//     (default 2s)
+//
+// and logs what it found as one startup report. Errors stop the gateway
+// with a non-zero exit status unless STARTUP_CHECK is "warn", in which
+// case it starts anyway and serves what it can; "off" skips the checks.
+// Failed probes are only warnings, as the backends may be starting too.
+
+// Startup check modes
+const (
+	startupCheckFail = "fail"
+	startupCheckWarn = "warn"
+	startupCheckOff  = "off"
+)
+
+// Finding severities
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// durationSettings, countSettings and boolSettings are the settings
+// holding a duration, a non-negative integer or true or false
+var (
+	durationSettings = []string{
+		"BACKEND_DIAL_TIMEOUT", "BACKEND_IDLE_CONN_TIMEOUT", "BACKEND_QUEUE_TIMEOUT", "BACKEND_TIMEOUT",
+		"BOT_SCORER_TIMEOUT", "CONFIG_RELOAD_INTERVAL", "CORS_MAX_AGE", "DEPRECATION_RETENTION", "DISCOVERY_REFRESH_INTERVAL",
+		"LONGPOLL_INTERVAL", "LONGPOLL_MAX_WAIT", "MIRROR_TIMEOUT", "PARTNER_SECRETS_RELOAD_INTERVAL", "PARTNER_SIGNATURE_MAX_SKEW", "ROUTE_STATUS_INTERVAL",
+		"SESSION_TTL", "STARTUP_PROBE_TIMEOUT", "STATUS_CACHE_TTL", "STREAM_WRITE_TIMEOUT", "TRACE_SLOW_THRESHOLD",
+	}
+	countSettings = []string{
+		"BACKEND_MAX_CONNS_PER_HOST", "BACKEND_MAX_IDLE_CONNS_PER_HOST", "BACKEND_MAX_IN_FLIGHT",
+		"BOT_RATE_THRESHOLD", "BOT_THROTTLE_RATE", "HSTS_MAX_AGE", "LONGPOLL_MAX_WAITERS", "LONGPOLL_TRENDING_LIMIT",
+		"MAX_REQUEST_BODY_BYTES", "MIRROR_MAX_IN_FLIGHT", "OTEL_EXPORT_QUEUE_SIZE",
+		"QUOTA_DAILY_REQUESTS", "QUOTA_MONTHLY_REQUESTS", "STREAM_THRESHOLD_BYTES",
+	}
+	boolSettings = []string{"BACKEND_HTTP2", "BOT_DETECTION", "COALESCE_REQUESTS", "STARTUP_PROBE_BACKENDS"}
+)
+
+// Finding is something wrong with the configuration. Setting names the
+// variable at fault, or the backend for backend checks.
+type Finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Setting  string `json:"setting,omitempty"`
+	Message  string `json:"message"`
+}
+
+// BackendCheck is what the startup check found of a backend.
+type BackendCheck struct {
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	Endpoints []string `json:"endpoints"`
+	// Healthy are the endpoints answering /healthz, if they were probed
+	Healthy []string `json:"healthy,omitempty"`
+}
+
+// startupReport collects the findings of the startup check.
+type startupReport struct {
+	mutex    sync.Mutex
+	findings []Finding
+	backends []BackendCheck
+}
+
+func (r *startupReport) add(severity, check, setting, message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.findings = append(r.findings, Finding{Severity: severity, Check: check, Setting: setting, Message: message})
+}
+
+func (r *startupReport) count(severity string) int {
+	n := 0
+	for _, f := range r.findings {
+		if f.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// checkStartup checks the configuration and logs the startup report,
+// exiting if it found errors and STARTUP_CHECK allows it.
+func checkStartup() {
+	mode := strings.ToLower(os.Getenv("STARTUP_CHECK"))
+	switch mode {
+	case "":
+		mode = startupCheckFail
+	case startupCheckFail, startupCheckWarn:
+	case startupCheckOff:
+		return
+	default:
+		logger.Fatal("Unknown STARTUP_CHECK mode, use fail, warn or off", zap.String("mode", mode))
+	}
+
+	report := &startupReport{}
+	checkSettingValues(report)
+	checkConflicts(report)
+	checkSecrets(report)
+	checkBackends(report)
+
+	for _, f := range report.findings {
+		log := logger.Warn
+		if f.Severity == severityError {
+			log = logger.Error
+		}
+		log("Startup check: "+f.Message,
+			zap.String("check", f.Check),
+			zap.String("setting", f.Setting),
+		)
+	}
+
+	failed := report.count(severityError)
+	fields := []zap.Field{
+		zap.String("mode", mode),
+		zap.Int("errors", failed),
+		zap.Int("warnings", report.count(severityWarning)),
+		zap.Any("backends", report.backends),
+	}
+	switch {
+	case failed == 0:
+		logger.Info("Startup check passed", fields...)
+	case mode == startupCheckWarn:
+		logger.Warn("Startup check failed, starting anyway (STARTUP_CHECK=warn)", fields...)
+	default:
+		logger.Fatal("Startup check failed, set STARTUP_CHECK=warn to start anyway", fields...)
+	}
+}
+
+// checkSettingValues reports settings whose values don't parse.
+func checkSettingValues(report *startupReport) {
+	for _, key := range durationSettings {
+		if v := os.Getenv(key); v != "" {
+			if d, err := time.ParseDuration(v); err != nil || d < 0 {
+				report.add(severityError, "value", key, key+" is not a duration, e.g. 30s: "+strconv.Quote(v))
+			}
+		}
+	}
+	for _, key := range countSettings {
+		if v := os.Getenv(key); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+				report.add(severityError, "value", key, key+" is not a non-negative integer: "+strconv.Quote(v))
+			}
+		}
+	}
+	for _, key := range boolSettings {
+		if v := os.Getenv(key); v != "" {
+			if _, err := strconv.ParseBool(v); err != nil {
+				report.add(severityError, "value", key, key+" is not true or false: "+strconv.Quote(v))
+			}
+		}
+	}
+	if v := os.Getenv("MIRROR_PERCENT"); v != "" {
+		if p, err := strconv.ParseFloat(v, 64); err != nil || p < 0 || p > 100 {
+			report.add(severityError, "value", "MIRROR_PERCENT", "MIRROR_PERCENT is not a percentage from 0 to 100: "+strconv.Quote(v))
+		}
+	}
+	switch action := os.Getenv("BOT_ACTION"); action {
+	case "", botActionTag, botActionThrottle, botActionChallenge:
+	default:
+		report.add(severityError, "value", "BOT_ACTION", "BOT_ACTION is not tag, throttle or challenge: "+strconv.Quote(action))
+	}
+	switch provider := os.Getenv("GEOIP_PROVIDER"); provider {
+	case "", "header":
+	case "file":
+		if os.Getenv("GEOIP_DB_FILE") == "" {
+			report.add(severityError, "value", "GEOIP_DB_FILE", "GEOIP_PROVIDER is file but GEOIP_DB_FILE is not set")
+		}
+	default:
+		report.add(severityError, "value", "GEOIP_PROVIDER", "GEOIP_PROVIDER is not header or file: "+strconv.Quote(provider))
+	}
+	if v := os.Getenv("BOT_SCORE_THRESHOLD"); v != "" {
+		if t, err := strconv.ParseFloat(v, 64); err != nil || t <= 0 || t > 1 {
+			report.add(severityError, "value", "BOT_SCORE_THRESHOLD", "BOT_SCORE_THRESHOLD is not a score above 0 and up to 1: "+strconv.Quote(v))
+		}
+	}
+	switch mode := strings.ToLower(os.Getenv("SERVICE_DISCOVERY")); mode {
+	case "", discoveryStatic, discoveryDNS, discoveryKubernetes:
+	default:
+		report.add(severityError, "value", "SERVICE_DISCOVERY", "SERVICE_DISCOVERY is not static, dns or kubernetes: "+strconv.Quote(mode))
+	}
+}
+
+// checkConflicts reports settings that contradict each other or are
+// missing their counterparts.
+func checkConflicts(report *startupReport) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	domains := splitList(os.Getenv("TLS_AUTOCERT_DOMAINS"))
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		report.add(severityError, "conflict", "TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case certFile != "" && len(domains) > 0:
+		report.add(severityError, "conflict", "TLS_AUTOCERT_DOMAINS",
+			"TLS_AUTOCERT_DOMAINS and TLS_CERT_FILE are both set; the certificate would be ignored")
+	case certFile != "":
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			report.add(severityError, "tls", "TLS_CERT_FILE", "The TLS certificate cannot be loaded: "+err.Error())
+		}
+	}
+	tlsEnabled := certFile != "" || len(domains) > 0
+	if redirect := os.Getenv("TLS_REDIRECT_PORT"); redirect != "" && redirect == os.Getenv("PORT") {
+		report.add(severityError, "conflict", "TLS_REDIRECT_PORT", "TLS_REDIRECT_PORT is the gateway's own PORT")
+	}
+
+	if os.Getenv("OIDC_ISSUER_URL") != "" {
+		for _, key := range []string{"OIDC_CLIENT_ID", "OIDC_REDIRECT_URL"} {
+			if os.Getenv(key) == "" {
+				report.add(severityError, "conflict", key, key+" must be set with OIDC_ISSUER_URL")
+			}
+		}
+		if tlsEnabled && os.Getenv("SESSION_COOKIE_INSECURE") == "true" {
+			report.add(severityWarning, "conflict", "SESSION_COOKIE_INSECURE",
+				"SESSION_COOKIE_INSECURE is set although the gateway serves TLS")
+		}
+	}
+
+	if os.Getenv("MIRROR_URL") == "" && os.Getenv("MIRROR_BACKEND") != "" {
+		report.add(severityWarning, "conflict", "MIRROR_BACKEND", "MIRROR_BACKEND is ignored without MIRROR_URL")
+	}
+	if slices.Contains(corsOrigins, "*") && len(corsOrigins) > 1 {
+		report.add(severityWarning, "conflict", "CORS_ALLOWED_ORIGINS",
+			`CORS_ALLOWED_ORIGINS lists "*" along with other origins; any origin is allowed`)
+	}
+}
+
+// checkSecrets reports unset secrets, as errors if STARTUP_REQUIRED_SECRETS
+// lists them.
+func checkSecrets(report *startupReport) {
+	required := splitList(os.Getenv("STARTUP_REQUIRED_SECRETS"))
+	for _, key := range required {
+		if os.Getenv(key) == "" {
+			report.add(severityError, "secret", key, key+" is required (STARTUP_REQUIRED_SECRETS) but not set")
+		}
+	}
+
+	secrets := []string{"GATEWAY_ADMIN_TOKEN", "INTERNAL_AUTH_SECRET", "VISITOR_HASH_KEY"}
+	if oidcEnabled {
+		secrets = append(secrets, "SESSION_SECRET")
+	}
+	for _, key := range secrets {
+		if os.Getenv(key) == "" && !slices.Contains(required, key) {
+			report.add(severityWarning, "secret", key, key+" is not set")
+		}
+	}
+}
+
+// checkBackends resolves the host of every backend endpoint and, with
+// STARTUP_PROBE_BACKENDS, probes their /healthz, all at once.
+func checkBackends(report *startupReport) {
+	probe, _ := strconv.ParseBool(os.Getenv("STARTUP_PROBE_BACKENDS"))
+	timeout := envDuration("STARTUP_PROBE_TIMEOUT", 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	checks := make([]*BackendCheck, 0, len(resolvers))
+	var wg sync.WaitGroup
+	for name := range resolvers {
+		check := &BackendCheck{Name: name, Address: backendURL(name), Endpoints: backendEndpoints(name)}
+		checks = append(checks, check)
+		if len(check.Endpoints) == 0 {
+			report.add(severityWarning, "backend", name, "Backend "+name+" has no endpoints yet")
+		}
+		for _, endpoint := range check.Endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if !resolveEndpoint(ctx, report, name, endpoint) || !probe {
+					return
+				}
+				if err := probeEndpoint(ctx, name, endpoint); err != nil {
+					report.add(severityWarning, "probe", name,
+						"Backend "+name+" replica "+endpoint+" failed its health check: "+err.Error())
+					return
+				}
+				report.mutex.Lock()
+				check.Healthy = append(check.Healthy, endpoint)
+				report.mutex.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	for _, check := range checks {
+		report.backends = append(report.backends, *check)
+	}
+}
+
+// resolveEndpoint reports whether the host of a backend endpoint
+// resolves, reporting it if it doesn't.
+func resolveEndpoint(ctx context.Context, report *startupReport, backend, endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		report.add(severityError, "dns", backend, "Backend "+backend+" host "+host+" does not resolve: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// probeEndpoint checks that a backend replica answers GET /healthz with 200.
+func probeEndpoint(ctx context.Context, backend, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+endpoint+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient(backend).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// GET /status is a public summary of the service's health, for users and
+// the status badge on the website: whether each backend is up, its recent
+// server error rate and p95 latency, as JSON or, with ?format=html or a
+// browser's Accept header, as a small page. The gateway checks /healthz on
+// every replica of the jokes, user and analytics backends itself, and
+// takes error rates over the last hour (GET /api/v1/stats/errors) and p95
+// latencies (GET /api/v1/stats/latency) from analytics; when analytics
+// can't be reached those are null and the status rests on the
+// health checks alone. A backend is "outage" when no replica is healthy or
+// half its requests fail, and "degraded" when some replica is down or 5%
+// fail. The summary is cached for STATUS_CACHE_TTL (default 15s) so the
+// page can't be used to hammer the backends; it is outside the API quota.
+
+//go:embed static/status.html
+var statusPage string
+
+const (
+	statusOperational = "operational"
+	statusDegraded    = "degraded"
+	statusOutage      = "outage"
+
+	// statusErrorWindow is the analytics window error rates are taken over
+	statusErrorWindow = "1h"
+)
+
+// statusBackends are the backends the status page reports, in order
+var statusBackends = []string{"jokes", "user", "analytics"}
+
+// statusRank orders statuses from best to worst
+var statusRank = map[string]int{statusOperational: 0, statusDegraded: 1, statusOutage: 2}
+
+// ServiceStatus is one backend on the status page.
+type ServiceStatus struct {
+	Name            string `json:"name"`
+	Status          string `json:"status"`
+	Up              bool   `json:"up"`
+	Replicas        int    `json:"replicas"`
+	HealthyReplicas int    `json:"healthy_replicas"`
+	// HealthCheckMs is the slowest replica health check
+	HealthCheckMs float64 `json:"health_check_ms"`
+	// Requests, ErrorRate and P95LatencyMs come from analytics; null when
+	// it is unavailable
+	Requests     *int64   `json:"requests"`
+	ErrorRate    *float64 `json:"error_rate"`
+	P95LatencyMs *float64 `json:"p95_latency_ms"`
+}
+
+// StatusSummary is the status page.
+type StatusSummary struct {
+	Status      string          `json:"status"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	ErrorWindow string          `json:"error_window"`
+	Services    []ServiceStatus `json:"services"`
+}
+
+var (
+	statusCacheTTL = 15 * time.Second
+
+	statusTemplate              *template.Template
+	statusContentSecurityPolicy string
+	cachedStatus                *StatusSummary
+	statusMutex                 sync.Mutex
+)
+
+func initStatus() {
+	statusCacheTTL = envDuration("STATUS_CACHE_TTL", statusCacheTTL)
+	statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+		"statusText": func(status string) string {
+			switch status {
+			case statusOperational:
+				return "Operational"
+			case statusDegraded:
+				return "Degraded"
+			}
+			return "Outage"
+		},
+		"percent": func(rate *float64) string {
+			if rate == nil {
+				return "–"
+			}
+			return fmt.Sprintf("%.2f%%", *rate*100)
+		},
+		"milliseconds": func(ms *float64) string {
+			if ms == nil {
+				return "–"
+			}
+			return fmt.Sprintf("%.0f ms", *ms)
+		},
+		"time": func(t time.Time) string {
+			return t.UTC().Format("2006-01-02 15:04:05 UTC")
+		},
+	}).Parse(statusPage))
+	statusContentSecurityPolicy = fmt.Sprintf(
+		"default-src 'none'; style-src %s; frame-ancestors 'none'; base-uri 'none'; form-action 'none'",
+		inlineHashes(inlineStyle, []byte(statusPage)),
+	)
+}
+
+// registerStatusRoutes serves the public status page.
+func registerStatusRoutes(r *gin.Engine) {
+	r.GET("/status", statusHandler)
+}
+
+// statusHandler serves GET /status?format=json|html.
+func statusHandler(c *gin.Context) {
+	format := c.Query("format")
+	switch format {
+	case "":
+		if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+			format = "html"
+		} else {
+			format = "json"
+		}
+	case "json", "html":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or html"})
+		return
+	}
+
+	summary := currentStatus(c.Request.Context())
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusCacheTTL/time.Second)))
+	if format == "json" {
+		c.JSON(http.StatusOK, summary)
+		return
+	}
+	c.Header("Content-Security-Policy", statusContentSecurityPolicy)
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(c.Writer, summary); err != nil {
+		loggerFor(c.Request.Context()).Error("Failed to render the status page", zap.Error(err))
+	}
+}
+
+// currentStatus returns the cached summary, building a new one when it is
+// older than the cache TTL. Concurrent requests wait for the one building
+// it rather than all checking the backends.
+func currentStatus(ctx context.Context) *StatusSummary {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	if cachedStatus != nil && time.Since(cachedStatus.UpdatedAt) < statusCacheTTL {
+		return cachedStatus
+	}
+	// Not tied to the request: one client going away shouldn't leave the
+	// others without a summary
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), aggregateTimeout)
+	defer cancel()
+	cachedStatus = buildStatus(ctx)
+	return cachedStatus
+}
+
+// buildStatus checks the backends and asks analytics for their error rates
+// and latencies, all concurrently.
+func buildStatus(ctx context.Context) *StatusSummary {
+	ctx, span := tracer.Start(ctx, "build_status")
+	defer span.End()
+
+	services := make([]ServiceStatus, len(statusBackends))
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		rates  map[string]float64
+		counts map[string]int64
+		p95s   map[string]float64
+	)
+	for i, name := range statusBackends {
+		services[i] = ServiceStatus{Name: name}
+		for _, endpoint := range backendEndpoints(name) {
+			services[i].Replicas++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				err := probeEndpoint(ctx, name, endpoint)
+				elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				services[i].HealthCheckMs = max(services[i].HealthCheckMs, elapsed)
+				if err != nil {
+					loggerFor(ctx).Warn("Status health check failed",
+						zap.String("backend", name),
+						zap.String("endpoint", endpoint),
+						zap.Error(err),
+					)
+					return
+				}
+				services[i].HealthyReplicas++
+			}()
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stats, err := analyticsClient.ErrorStats(ctx, statusErrorWindow)
+		if err != nil {
+			loggerFor(ctx).Warn("Error rates unavailable for the status page", zap.Error(err))
+			return
+		}
+		rates, counts = map[string]float64{}, map[string]int64{}
+		for _, b := range stats.Backends {
+			rates[b.Backend], counts[b.Backend] = b.ErrorRate, b.Requests
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		stats, err := analyticsClient.LatencyStats(ctx, "")
+		if err != nil {
+			loggerFor(ctx).Warn("Latencies unavailable for the status page", zap.Error(err))
+			return
+		}
+		p95s = backendLatencies(stats.Endpoints)
+	}()
+	wg.Wait()
+
+	summary := &StatusSummary{
+		Status:      statusOperational,
+		UpdatedAt:   time.Now(),
+		ErrorWindow: statusErrorWindow,
+		Services:    services,
+	}
+	for i := range services {
+		s := &services[i]
+		s.Up = s.HealthyReplicas > 0
+		switch {
+		case !s.Up:
+			s.Status = statusOutage
+		case s.HealthyReplicas < s.Replicas:
+			s.Status = statusDegraded
+		default:
+			s.Status = statusOperational
+		}
+		if rates != nil {
+			rate, requests := rates[s.Name], counts[s.Name]
+			s.ErrorRate, s.Requests = &rate, &requests
+			s.Status = worseStatus(s.Status, errorRateStatus(rate))
+		}
+		if p95, ok := p95s[s.Name]; ok {
+			p95 = math.Round(p95*10) / 10
+			s.P95LatencyMs = &p95
+		}
+		summary.Status = worseStatus(summary.Status, s.Status)
+	}
+
+	span.SetAttributes(attribute.String("status", summary.Status))
+	return summary
+}
+
+// backendLatencies returns each backend's slowest endpoint p95, finding
+// the backend of an endpoint ("METHOD /path" as the backend serves it) in
+// the route table.
+func backendLatencies(endpoints map[string]client.LatencySummary) map[string]float64 {
+	owners := map[string]string{}
+	for _, route := range routes {
+		target := route.Target
+		if target == "" {
+			target = route.Path
+		}
+		owners[route.Method+" "+target] = route.Backend
+	}
+
+	p95s := map[string]float64{}
+	for endpoint, summary := range endpoints {
+		backend, ok := owners[endpoint]
+		if !ok || summary.Count == 0 {
+			continue
+		}
+		p95s[backend] = max(p95s[backend], summary.P95Ms)
+	}
+	return p95s
+}
+
+// errorRateStatus rates a server error rate like analytics rates backends.
+func errorRateStatus(rate float64) string {
+	switch {
+	case rate >= 0.5:
+		return statusOutage
+	case rate >= 0.05:
+		return statusDegraded
+	}
+	return statusOperational
+}
+
+// worseStatus returns the worse of two statuses.
+func worseStatus(a, b string) string {
+	if statusRank[b] > statusRank[a] {
+		return b
+	}
+	return a
+}
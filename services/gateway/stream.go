@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Responses are normally read whole, so their JSON can be rewritten (see
+// transform.go), and then written to the client. Responses that may be
+// large are streamed instead, chunk by chunk, each flushed to the client
+// as it arrives, so the gateway holds one chunk of them at a time:
+//
+//   - downloads: a Content-Disposition of attachment, or a content type in
+//     STREAM_CONTENT_TYPES (default text/csv, application/octet-stream and
+//     the joke audio types, audio/mpeg and audio/wav)
+//   - compressed responses, passed through with their Content-Encoding
+//     (the client's Accept-Encoding is forwarded to the backend)
+//   - responses over STREAM_THRESHOLD_BYTES (default 1MiB), unless their
+//     JSON is rewritten; a response without a Content-Length is read up to
+//     the threshold first
+//
+// Streamed bodies are not rewritten; response header rewrites still apply.
+// Backpressure carries through: the gateway reads the next chunk from the
+// backend only once the client has taken the last one. A client that takes
+// no data for STREAM_WRITE_TIMEOUT (default 30s) is cut off, and so is a
+// backend that sends none for BACKEND_TIMEOUT. A stream cut off midway is
+// aborted, so the client sees a truncated response rather than a short
+// one.
+
+// streamChunkSize is the size of the chunks streamed responses are read in
+const streamChunkSize = 32 << 10
+
+// streamedHeaders are the backend response headers streamed responses keep
+var streamedHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Vary",
+	"ETag",
+	"Last-Modified",
+}
+
+// Outcomes of streamed responses
+const (
+	streamComplete     = "complete"
+	streamClientError  = "client_error"
+	streamBackendError = "backend_error"
+)
+
+var (
+	streamThreshold    int64 = 1 << 20
+	streamContentTypes       = map[string]bool{"text/csv": true, "application/octet-stream": true, "audio/mpeg": true, "audio/wav": true}
+	streamWriteTimeout       = 30 * time.Second
+
+	streamedResponses metric.Int64Counter
+)
+
+func initStreaming() {
+	if v, err := strconv.ParseInt(os.Getenv("STREAM_THRESHOLD_BYTES"), 10, 64); err == nil && v > 0 {
+		streamThreshold = v
+	}
+	if v := os.Getenv("STREAM_CONTENT_TYPES"); v != "" {
+		streamContentTypes = map[string]bool{}
+		for _, contentType := range strings.Split(v, ",") {
+			if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+				streamContentTypes[contentType] = true
+			}
+		}
+	}
+	if v, err := time.ParseDuration(os.Getenv("STREAM_WRITE_TIMEOUT")); err == nil && v > 0 {
+		streamWriteTimeout = v
+	}
+
+	var err error
+	streamedResponses, err = meter.Int64Counter(
+		"gateway.responses.streamed",
+		metric.WithDescription("Number of responses streamed to the client rather than buffered, by reason and outcome"),
+		metric.WithUnit("{response}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create streamed responses counter", zap.Error(err))
+	}
+}
+
+// streamReason returns why resp is streamed, or "" if it can be buffered
+// as far as its headers tell. rewritten is whether its body would be
+// rewritten.
+func streamReason(resp *http.Response, rewritten bool) string {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	disposition, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	encoding := resp.Header.Get("Content-Encoding")
+
+	switch {
+	case disposition == "attachment":
+		return "attachment"
+	case streamContentTypes[mediaType]:
+		return "content_type"
+	case encoding != "" && encoding != "identity":
+		return "encoded"
+	case !rewritten && resp.ContentLength > streamThreshold:
+		return "size"
+	}
+	return ""
+}
+
+// streamResponse writes resp to the client as it is read; prefix is what
+// was already read of its body. deadline bounds the wait for each chunk
+// from the backend. It returns the number of body bytes written.
+func streamResponse(c *gin.Context, resp *http.Response, prefix []byte, reason string, rewrites []Rewrite, deadline *time.Timer) int64 {
+	ctx := c.Request.Context()
+
+	header := c.Writer.Header()
+	for _, name := range streamedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+	for _, rw := range rewrites {
+		rw.applyHeaders(header)
+	}
+	c.Status(resp.StatusCode)
+	c.Writer.WriteHeaderNow()
+	// HEAD responses have no body to wait for
+	if c.Request.Method == http.MethodHead {
+		return 0
+	}
+
+	controller := http.NewResponseController(c.Writer)
+	var written int64
+	write := func(chunk []byte) error {
+		// Not every writer supports deadlines (see coalesce.go)
+		controller.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		n, err := c.Writer.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	outcome := streamComplete
+	var streamErr error
+	if len(prefix) > 0 {
+		if streamErr = write(prefix); streamErr != nil {
+			outcome = streamClientError
+		}
+	}
+	buf := make([]byte, streamChunkSize)
+	for outcome == streamComplete {
+		deadline.Reset(backendTimeout)
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if streamErr = write(buf[:n]); streamErr != nil {
+				outcome = streamClientError
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			streamErr = err
+			outcome = streamBackendError
+		}
+	}
+	deadline.Stop()
+	controller.SetWriteDeadline(time.Time{})
+
+	streamedResponses.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("reason", reason),
+		attribute.String("outcome", outcome),
+	), contextAttrs(ctx))
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("gateway.stream.reason", reason),
+		attribute.String("gateway.stream.outcome", outcome),
+		attribute.Int64("gateway.stream.bytes", written),
+	)
+
+	if outcome == streamBackendError {
+		if failure := proxyFailureReason(ctx, streamErr, proxyFailureBodyRead); failure != "" {
+			recordProxyFailure(ctx, c.GetString(routeBackendKey), failure, streamErr.Error(), 0)
+		}
+	}
+	if outcome != streamComplete {
+		loggerFor(ctx).Warn("Streamed response cut off",
+			zap.String("reason", reason),
+			zap.String("outcome", outcome),
+			zap.Int64("bytes", written),
+			zap.Error(streamErr),
+		)
+		// Abort the connection, so the client can't take what it got for
+		// the whole response (see pkg/middleware)
+		panic(http.ErrAbortHandler)
+	}
+	loggerFor(ctx).Info("Response streamed",
+		zap.String("reason", reason),
+		zap.Int64("bytes", written),
+	)
+	return written
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// routeSampler applies per-route sampling ratios to new traces, taken from
+// TRACE_ROUTE_SAMPLING (e.g. "/healthz=0,/api/v1/stats=0.1"). Routes without
+// an override use the base sampler. Traces that are not sampled are still
+// recorded so errorKeepProcessor can export them if they fail or are slow.
+// The overrides are reloaded when TRACE_ROUTE_SAMPLING changes in the
+// runtime config file.
+type routeSampler struct {
+	base   sdktrace.Sampler
+	routes atomic.Pointer[map[string]sdktrace.Sampler]
+}
+
+func newRouteSampler(base sdktrace.Sampler) sdktrace.Sampler {
+	s := &routeSampler{base: base}
+	s.loadRoutes()
+	telemetry.OnRuntimeChange("TRACE_ROUTE_SAMPLING", s.loadRoutes)
+	return s
+}
+
+func (s *routeSampler) loadRoutes() {
+	routes := map[string]sdktrace.Sampler{}
+	for _, entry := range strings.Split(telemetry.RuntimeValue("TRACE_ROUTE_SAMPLING"), ",") {
+		route, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			logger.Warn("Ignoring invalid route sampling ratio", zap.String("entry", entry))
+			continue
+		}
+		routes[route] = sdktrace.TraceIDRatioBased(ratio)
+	}
+	s.routes.Store(&routes)
+}
+
+func (s *routeSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	// Child spans follow the decision made for their parent
+	if parent := trace.SpanContextFromContext(p.ParentContext); parent.IsValid() {
+		return s.base.ShouldSample(p)
+	}
+
+	sampler := s.base
+	routes := *s.routes.Load()
+	for _, attr := range p.Attributes {
+		if attr.Key == "http.route" {
+			if override, ok := routes[attr.Value.AsString()]; ok {
+				sampler = override
+			}
+			break
+		}
+	}
+
+	result := sampler.ShouldSample(p)
+	if result.Decision == sdktrace.Drop {
+		result.Decision = sdktrace.RecordOnly
+	}
+	return result
+}
+
+func (s *routeSampler) Description() string {
+	return "RouteSampler{" + s.base.Description() + "}"
+}
+
+// errorKeepProcessor exports traces that were not sampled when their local
+// root span ends with an error status or exceeds the slow threshold. Spans
+// of unsampled traces are buffered until the root span ends.
+type errorKeepProcessor struct {
+	exporter      sdktrace.SpanExporter
+	slowThreshold time.Duration
+	maxTraces     int
+
+	mu      sync.Mutex
+	pending map[trace.TraceID][]sdktrace.ReadOnlySpan
+}
+
+func newErrorKeepProcessor(exporter sdktrace.SpanExporter) *errorKeepProcessor {
+	slow := 500 * time.Millisecond
+	if v, err := time.ParseDuration(os.Getenv("TRACE_SLOW_THRESHOLD")); err == nil {
+		slow = v
+	}
+	return &errorKeepProcessor{
+		exporter:      exporter,
+		slowThreshold: slow,
+		maxTraces:     10000,
+		pending:       map[trace.TraceID][]sdktrace.ReadOnlySpan{},
+	}
+}
+
+func (p *errorKeepProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *errorKeepProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		return
+	}
+
+	traceID := s.SpanContext().TraceID()
+	isRoot := !s.Parent().IsValid() || s.Parent().IsRemote()
+
+	p.mu.Lock()
+	spans := append(p.pending[traceID], s)
+	if !isRoot {
+		if _, tracked := p.pending[traceID]; tracked || len(p.pending) < p.maxTraces {
+			p.pending[traceID] = spans
+		}
+		p.mu.Unlock()
+		return
+	}
+	delete(p.pending, traceID)
+	p.mu.Unlock()
+
+	failed := s.Status().Code == codes.Error
+	slow := s.EndTime().Sub(s.StartTime()) > p.slowThreshold
+	if !failed && !slow {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := p.exporter.ExportSpans(ctx, spans); err != nil {
+			logger.Warn("Failed to export kept trace", zap.Error(err))
+		}
+	}()
+}
+
+func (p *errorKeepProcessor) Shutdown(context.Context) error {
+	p.mu.Lock()
+	p.pending = map[trace.TraceID][]sdktrace.ReadOnlySpan{}
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *errorKeepProcessor) ForceFlush(context.Context) error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The tenant travels in the request baggage (see telemetry.TenantOf). The
+// gateway resolves it from the API key or the X-Tenant-ID header.
+
+// tenantHeader lets callers without a tenant-bound API key name their tenant
+const tenantHeader = "X-Tenant-ID"
+
+var (
+	// apiKeyTenants maps API keys to the tenant they belong to
+	apiKeyTenants map[string]string
+
+	validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	errInvalidTenant  = errors.New("invalid tenant ID")
+	errTenantMismatch = errors.New("tenant does not match API key")
+)
+
+// initTenants reads API_KEY_TENANTS ("key=tenant,...").
+func initTenants() {
+	apiKeyTenants = map[string]string{}
+	for _, entry := range strings.Split(os.Getenv("API_KEY_TENANTS"), ",") {
+		key, tenant, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if !validTenant.MatchString(tenant) {
+			logger.Warn("Ignoring invalid tenant in API_KEY_TENANTS", zap.String("tenant", tenant))
+			continue
+		}
+		apiKeyTenants[key] = tenant
+	}
+}
+
+// requestTenant derives the caller's tenant: the tenant its API key is
+// bound to, else the X-Tenant-ID header, else telemetry.DefaultTenant.
+func requestTenant(c *gin.Context) (string, error) {
+	header := c.GetHeader(tenantHeader)
+	if header != "" && !validTenant.MatchString(header) {
+		return "", errInvalidTenant
+	}
+
+	if tenant, ok := apiKeyTenants[c.GetHeader(apiKeyHeader)]; ok {
+		if header != "" && header != tenant {
+			return "", errTenantMismatch
+		}
+		return tenant, nil
+	}
+	if header != "" {
+		return header, nil
+	}
+	return telemetry.DefaultTenant, nil
+}
+
+// tenantMiddleware resolves the caller's tenant and stores it in the
+// request baggage, replacing any tenant the client sent, so it reaches
+// every backend the request fans out to.
+func tenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, err := requestTenant(c)
+		if errors.Is(err, errTenantMismatch) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := telemetry.WithTenant(c.Request.Context(), tenant)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String(telemetry.TenantBaggageKey, tenant))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The gateway can terminate TLS itself, for deployments without an ingress
+// controller in front: either with a certificate and key from
+// TLS_CERT_FILE and TLS_KEY_FILE, or with certificates obtained from Let's
+// Encrypt for the hosts in TLS_AUTOCERT_DOMAINS. Without either it serves
+// plain HTTP.
+
+// serve runs the gateway on port until it fails.
+func serve(r *gin.Engine, port string) error {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	domains := splitList(os.Getenv("TLS_AUTOCERT_DOMAINS"))
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	switch {
+	case len(domains) > 0:
+		cacheDir := os.Getenv("TLS_AUTOCERT_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = "/var/cache/autocert"
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      os.Getenv("TLS_AUTOCERT_EMAIL"),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+
+		// HTTP-01 challenges must be answered on port 80; everything else
+		// there is redirected to HTTPS
+		go serveHTTPRedirect(manager.HTTPHandler(httpsRedirect(port)))
+
+		logger.Info("Starting API Gateway with automatic TLS",
+			zap.String("port", port),
+			zap.Strings("domains", domains),
+			zap.String("cache_dir", cacheDir),
+		)
+		return server.ListenAndServeTLS("", "")
+
+	case certFile != "" || keyFile != "":
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if os.Getenv("TLS_REDIRECT_PORT") != "" {
+			go serveHTTPRedirect(httpsRedirect(port))
+		}
+
+		logger.Info("Starting API Gateway with TLS",
+			zap.String("port", port),
+			zap.String("cert_file", certFile),
+		)
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+
+	logger.Info("Starting API Gateway", zap.String("port", port))
+	return server.ListenAndServe()
+}
+
+// httpsRedirect redirects requests to the same URL over HTTPS on tlsPort.
+func httpsRedirect(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPRedirect serves handler on TLS_REDIRECT_PORT (default 80).
+func serveHTTPRedirect(handler http.Handler) {
+	port := os.Getenv("TLS_REDIRECT_PORT")
+	if port == "" {
+		port = "80"
+	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Info("Redirecting HTTP to HTTPS", zap.String("port", port))
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error("HTTP redirect listener stopped", zap.Error(err))
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Transforms rewrite proxied requests and responses. A route lists the
+// transforms it uses by name, after those in defaultTransforms, and they
+// are applied in that order. JSON field rewrites only apply to bodies that
+// are JSON objects; anything else passes through untouched.
+
+// Rewrite changes the headers and JSON body of a request or response.
+// Field paths are dot-separated; a path through an array applies to each
+// of its elements, e.g. "favorites.tenant".
+type Rewrite struct {
+	// SetHeaders and RemoveHeaders change headers; SetHeaders is applied
+	// last, so a header can be replaced
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	// Defaults sets fields that are missing
+	Defaults map[string]interface{}
+	// SetFields sets fields, overwriting any existing value
+	SetFields map[string]interface{}
+	// RemoveFields deletes fields
+	RemoveFields []string
+}
+
+// Transform is a named pair of request and response rewrites.
+type Transform struct {
+	Request  Rewrite
+	Response Rewrite
+}
+
+var transforms = map[string]Transform{
+	// Tells the backends a write came through the gateway
+	"stamp-source": {
+		Request: Rewrite{
+			SetFields: map[string]interface{}{"source": "gateway"},
+		},
+	},
+	// Backends report their own service name, which clients shouldn't
+	// depend on
+	"strip-internal-fields": {
+		Response: Rewrite{
+			RemoveFields: []string{"service"},
+		},
+	},
+}
+
+// defaultTransforms apply to every proxied route
+var defaultTransforms = []string{"strip-internal-fields"}
+
+// routeRewrites returns the request and response rewrites of the
+// transforms applying to route, in order.
+func routeRewrites(route Route) (request, response []Rewrite) {
+	names := append(append([]string{}, defaultTransforms...), route.Transforms...)
+	for _, name := range names {
+		request = append(request, transforms[name].Request)
+		response = append(response, transforms[name].Response)
+	}
+	return request, response
+}
+
+// applyHeaders rewrites the headers in h.
+func (rw Rewrite) applyHeaders(h http.Header) {
+	for _, name := range rw.RemoveHeaders {
+		h.Del(name)
+	}
+	for name, value := range rw.SetHeaders {
+		h.Set(name, value)
+	}
+}
+
+// hasFieldRules reports whether rw changes JSON bodies.
+func (rw Rewrite) hasFieldRules() bool {
+	return len(rw.Defaults) > 0 || len(rw.SetFields) > 0 || len(rw.RemoveFields) > 0
+}
+
+// rewritesBody reports whether rewrites change bodies of contentType.
+func rewritesBody(rewrites []Rewrite, contentType string) bool {
+	apply := false
+	for _, rw := range rewrites {
+		apply = apply || rw.hasFieldRules()
+	}
+	return apply && isJSON(contentType)
+}
+
+// rewriteBody applies the field rules of every rewrite to body, returning
+// it unchanged if it isn't a JSON object or no rule applies.
+func rewriteBody(body []byte, contentType string, rewrites []Rewrite) []byte {
+	if len(body) == 0 || !rewritesBody(rewrites, contentType) {
+		return body
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return body
+	}
+
+	changed := false
+	for _, rw := range rewrites {
+		for path, value := range rw.Defaults {
+			changed = setField(doc, strings.Split(path, "."), value, false) || changed
+		}
+		for path, value := range rw.SetFields {
+			changed = setField(doc, strings.Split(path, "."), value, true) || changed
+		}
+		for _, path := range rw.RemoveFields {
+			changed = removeField(doc, strings.Split(path, ".")) || changed
+		}
+	}
+	if !changed {
+		return body
+	}
+
+	rewritten, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
+
+// setField sets the field at path, creating missing objects along the
+// way. Existing values are only replaced when overwrite is set.
+func setField(doc map[string]interface{}, path []string, value interface{}, overwrite bool) bool {
+	if len(path) == 1 {
+		if _, exists := doc[path[0]]; exists && !overwrite {
+			return false
+		}
+		doc[path[0]] = value
+		return true
+	}
+
+	switch child := doc[path[0]].(type) {
+	case map[string]interface{}:
+		return setField(child, path[1:], value, overwrite)
+	case []interface{}:
+		changed := false
+		for _, item := range child {
+			if obj, ok := item.(map[string]interface{}); ok {
+				changed = setField(obj, path[1:], value, overwrite) || changed
+			}
+		}
+		return changed
+	case nil:
+		obj := map[string]interface{}{}
+		doc[path[0]] = obj
+		return setField(obj, path[1:], value, overwrite)
+	}
+	return false
+}
+
+// removeField deletes the field at path.
+func removeField(doc map[string]interface{}, path []string) bool {
+	if len(path) == 1 {
+		_, exists := doc[path[0]]
+		delete(doc, path[0])
+		return exists
+	}
+
+	switch child := doc[path[0]].(type) {
+	case map[string]interface{}:
+		return removeField(child, path[1:])
+	case []interface{}:
+		changed := false
+		for _, item := range child {
+			if obj, ok := item.(map[string]interface{}); ok {
+				changed = removeField(obj, path[1:]) || changed
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
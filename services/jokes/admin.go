@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// AdminJoke is a joke as listed to operators, with its serving state.
+type AdminJoke struct {
+	Joke
+	Safe    bool `json:"safe"`
+	Retired bool `json:"retired"`
+	// State is draft, published or archived (see lifecycle.go); PublishAt
+	// is when an embargoed draft is published
+	State     string     `json:"state"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// Schedule limits when the joke is served, InSeason whether it is now
+	Schedule *JokeSchedule `json:"schedule,omitempty"`
+	InSeason bool          `json:"in_season"`
+	// NearDuplicateOf is set on jokes added as flagged near duplicates
+	// (see duplicates.go)
+	NearDuplicateOf *DuplicateMatch `json:"near_duplicate_of,omitempty"`
+}
+
+// AddJokeRequest adds one joke; the fields are those of an import row, and
+// an optional schedule for seasonal jokes. State "draft" adds it for
+// review, embargoed until PublishAt if set. Force adds a near duplicate.
+type AddJokeRequest struct {
+	Joke      string        `json:"joke"`
+	Setup     string        `json:"setup"`
+	Punchline string        `json:"punchline"`
+	Format    string        `json:"format"`
+	ID        string        `json:"id"`
+	Category  string        `json:"category"`
+	Author    string        `json:"author"`
+	Language  string        `json:"language"`
+	Schedule  *JokeSchedule `json:"schedule"`
+	State     string        `json:"state"`
+	PublishAt *time.Time    `json:"publish_at"`
+	Force     bool          `json:"force"`
+}
+
+// adminJokes lists the jokes in the order they were added, leaving out
+// retired ones unless includeRetired is set, all but flagged near
+// duplicates if onlyDuplicates is, and all but those in state if it is set.
+func adminJokes(includeRetired, onlyDuplicates bool, state string) []AdminJoke {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	now := time.Now()
+	listed := []AdminJoke{}
+	for i, joke := range jokes {
+		if retiredJokes[i] && !includeRetired && state != jokeArchived {
+			continue
+		}
+		if _, flagged := duplicateFlags[joke.ID]; onlyDuplicates && !flagged {
+			continue
+		}
+		listedJoke := adminJoke(i, joke, now)
+		if state != "" && listedJoke.State != state {
+			continue
+		}
+		listed = append(listed, listedJoke)
+	}
+	return listed
+}
+
+// adminJoke describes the joke at index. Callers must hold jokesMutex.
+func adminJoke(index int, joke Joke, now time.Time) AdminJoke {
+	listed := AdminJoke{Joke: joke, Safe: jokeSafety[index].Safe, Retired: retiredJokes[index], InSeason: true}
+	listed.State, listed.PublishAt = jokeState(index, now)
+	if schedule := jokeSchedule(joke.ID); schedule != nil {
+		listed.Schedule = schedule
+		listed.InSeason = schedule.activeAt(now)
+	}
+	if match, ok := duplicateFlags[joke.ID]; ok {
+		listed.NearDuplicateOf = &match
+	}
+	return listed
+}
+
+// retireJoke withdraws the joke at index from serving, reporting false if
+// it already was. Like catalogue retirement, the joke keeps its ID and
+// comes back if the catalogue lists it.
+func retireJoke(index int) bool {
+	jokesMutex.Lock()
+	defer jokesMutex.Unlock()
+
+	if retiredJokes[index] {
+		return false
+	}
+	retiredJokes[index] = true
+	return true
+}
+
+// registerAdminRoutes installs the joke management routes on the internal
+// group.
+func registerAdminRoutes(internal *gin.RouterGroup) {
+	internal.GET("/admin/jokes", func(c *gin.Context) {
+		includeRetired, _ := strconv.ParseBool(c.Query("include_retired"))
+		onlyDuplicates, _ := strconv.ParseBool(c.Query("near_duplicates"))
+		state := c.Query("state")
+		switch state {
+		case "", jokeDraft, jokePublished, jokeArchived:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be draft, published or archived"})
+			return
+		}
+		listed := adminJokes(includeRetired, onlyDuplicates, state)
+		c.JSON(http.StatusOK, gin.H{
+			"jokes": listed,
+			"count": len(listed),
+		})
+	})
+
+	internal.POST("/admin/jokes", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req AddJokeRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+
+		if req.Schedule != nil {
+			if err := req.Schedule.compile(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "schedule: " + err.Error()})
+				return
+			}
+		}
+
+		if req.State == "" {
+			req.State = jokePublished
+		}
+		if req.State == jokeArchived {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be draft or published"})
+			return
+		}
+		if err := validateJokeState(req.State, req.PublishAt, time.Now()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if v, err := strconv.ParseBool(c.Query("force")); err == nil {
+			req.Force = v
+		}
+
+		fields := importFields{
+			Joke: req.Joke, Setup: req.Setup, Punchline: req.Punchline, Format: req.Format,
+			ID: req.ID, Category: req.Category, Author: req.Author, Language: req.Language,
+		}
+		id := strings.TrimSpace(req.ID)
+		if id == "" {
+			id = derivedJokeID(fields.jokeText())
+		}
+		// Drafts are staged before the joke is added so it is never served
+		staged := req.State == jokeDraft && stageDraft(id, req.PublishAt)
+
+		report := importJokes(ctx, []importRow{{row: 1, importFields: fields}}, false, req.Force)
+		if staged && report.Added == 0 {
+			unstageDraft(id)
+		}
+		switch {
+		case report.Errored > 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": report.Errors[0].Error})
+			return
+		case report.Skipped > 0:
+			c.JSON(http.StatusConflict, gin.H{"error": "Joke already exists"})
+			return
+		case report.Duplicates > 0:
+			match := report.NearDuplicates[0].DuplicateMatch
+			c.JSON(http.StatusConflict, gin.H{
+				"error":             "Joke nearly duplicates an existing joke, add it with force=true",
+				"near_duplicate_of": match,
+			})
+			return
+		}
+
+		index, _ := jokeIndex(id)
+		added := AdminJoke{Joke: jokeAt(index), Safe: isSafe(index), State: req.State, InSeason: true, NearDuplicateOf: nearDuplicateOf(id)}
+		if req.State == jokeDraft {
+			added.PublishAt = req.PublishAt
+		}
+		if req.Schedule != nil {
+			schedulesMutex.Lock()
+			jokeSchedules[added.ID] = req.Schedule
+			schedulesMutex.Unlock()
+			added.Schedule = req.Schedule
+			added.InSeason = req.Schedule.activeAt(time.Now())
+		}
+		loggerFor(ctx).Info("Joke added",
+			zap.String("joke_id", id),
+			zap.String("state", req.State),
+			zap.Bool("scheduled", req.Schedule != nil),
+		)
+		invalidateJokes(c, "added", id)
+		c.JSON(http.StatusCreated, added)
+	})
+
+	internal.DELETE("/admin/jokes/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		index, ok := jokeIndex(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+		id := jokeID(index)
+		if !retireJoke(index) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke is already retired"})
+			return
+		}
+
+		loggerFor(ctx).Info("Joke retired", zap.String("joke_id", id))
+		invalidateJokes(c, "retired", id)
+		c.JSON(http.StatusOK, gin.H{
+			"id":         id,
+			"retired":    true,
+			"retired_at": time.Now().Format(time.RFC3339),
+		})
+	})
+}
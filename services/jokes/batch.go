@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// maxBatchJokes caps the count of GET /api/v1/jokes/random
+var maxBatchJokes = 20
+
+func initBatch() {
+	if v, err := strconv.Atoi(os.Getenv("MAX_BATCH_JOKES")); err == nil && v > 0 {
+		maxBatchJokes = v
+	}
+}
+
+// getRandomJokes picks up to count distinct jokes for the client, or from
+// seed, like getRandomJoke. It returns fewer if fewer are servable.
+func getRandomJokes(ctx context.Context, client string, seed *int64, safeMode bool, count int) []int {
+	ctx, span := tracer.Start(ctx, "getRandomJokes")
+	defer span.End()
+
+	start := time.Now()
+
+	// Simulate some processing, once for the whole batch
+	time.Sleep(time.Millisecond * time.Duration(random.Intn(50)))
+
+	indices := selectJokes(client, seed, servableJokes(safeMode), count)
+
+	span.SetAttributes(
+		attribute.Bool("joke.safe_mode", safeMode),
+		attribute.Int("jokes.requested", count),
+		attribute.Int("jokes.count", len(indices)),
+	)
+
+	duration := time.Since(start).Milliseconds()
+	jokeLatency.Record(ctx, float64(duration), telemetry.ContextAttrs(ctx))
+
+	loggerFor(ctx).Info("Jokes retrieved",
+		zap.Int("requested", count),
+		zap.Int("count", len(indices)),
+		zap.Int64("duration_ms", duration),
+	)
+
+	return indices
+}
+
+// randomJokesHandler serves GET /api/v1/jokes/random?count=N, returning up
+// to N distinct jokes so clients needing several make one call.
+func randomJokesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	start := time.Now()
+
+	count := 1
+	if v := c.Query("count"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxBatchJokes {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "count must be an integer between 1 and " + strconv.Itoa(maxBatchJokes),
+			})
+			return
+		}
+		count = parsed
+	}
+
+	safeMode := true
+	if v := c.Query("safe"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "safe must be true or false"})
+			return
+		}
+		safeMode = parsed
+	}
+
+	seed, ok := requestSeed(c)
+	if !ok {
+		return
+	}
+
+	client := clientID(c)
+	indices := getRandomJokes(ctx, client, seed, safeMode, count)
+	if len(indices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No jokes available"})
+		return
+	}
+
+	jokesServed.Add(ctx, int64(len(indices)), telemetry.ContextAttrs(ctx))
+	recordServed(ctx, requestUserID(c), indices, false)
+
+	batch := make([]gin.H, 0, len(indices))
+	for i, index := range indices {
+		joke := jokeAt(index)
+
+		// Every joke counts as served, but the request's latency is only
+		// reported once
+		latency := LatencySample{}
+		if i == 0 {
+			latency = latencySince(c, start)
+		}
+		notifyAnalytics(ctx, joke, requestUserID(c), latency)
+
+		response := jokeResponse(index)
+		applyExperiment(ctx, response, client, requestUserID(c))
+		batch = append(batch, response)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"jokes":     batch,
+		"count":     len(batch),
+		"requested": count,
+		"service":   "jokes-service",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// The joke catalogue can be pulled from CATALOGUE_URL, in the import
+// format: an http(s) URL, e.g. a raw JSON or CSV file in a Git repository,
+// or an s3://bucket/key object in S3 or MinIO (see objectstore.go), so new
+// content ships by uploading it. A valid catalogue replaces the served set
+// in one step: jokes missing from it are retired and new ones are added.
+// Retired jokes keep their ID and reactions, and come back if the
+// catalogue lists them again. Catalogue rows match existing jokes by their
+// text, ignoring case and whitespace; the category, author and language of
+// a matched joke are updated from the row. A row's ID never moves a joke:
+// it must be the ID of the joke the text matches, and an ID that belongs
+// to another joke rejects the catalogue. Jokes imported through
+// /internal/jokes/import are retired by the next refresh unless the
+// catalogue includes them.
+
+// Catalogue is where the joke catalogue is pulled from.
+type Catalogue interface {
+	// Source names the catalogue in logs and refresh reports
+	Source() string
+	// Fetch returns the catalogue, or errCatalogueNotModified if its
+	// version is still since. Catalogues without versions always return it.
+	Fetch(ctx context.Context, since string) (CatalogueObject, error)
+}
+
+// CatalogueObject is a fetched catalogue.
+type CatalogueObject struct {
+	Data        []byte
+	ContentType string
+	// Version identifies the contents, e.g. an ETag; empty if unknown
+	Version string
+}
+
+// urlCatalogue is a catalogue at an http(s) URL, fetched with an optional
+// bearer token.
+type urlCatalogue struct {
+	url   string
+	token string
+}
+
+func (u urlCatalogue) Source() string { return u.url }
+
+func (u urlCatalogue) Fetch(ctx context.Context, _ string) (CatalogueObject, error) {
+	data, contentType, err := fetchImport(ctx, u.url, u.token)
+	return CatalogueObject{Data: data, ContentType: contentType}, err
+}
+
+// RefreshReport summarizes a catalogue refresh.
+type RefreshReport struct {
+	Source string `json:"source"`
+	Format string `json:"format"`
+	// Unchanged is set when the served set already matched the catalogue
+	Unchanged   bool `json:"unchanged"`
+	Total       int  `json:"total"`
+	Added       int  `json:"added"`
+	Retired     int  `json:"retired"`
+	Reactivated int  `json:"reactivated"`
+	Active      int  `json:"active"`
+	// Updated counts existing jokes whose metadata changed
+	Updated int `json:"updated"`
+}
+
+var (
+	// retiredJokes holds the indices of jokes no longer in the catalogue;
+	// guarded by jokesMutex
+	retiredJokes = map[int]bool{}
+
+	// catalogue is nil unless CATALOGUE_URL is set
+	catalogue         Catalogue
+	catalogueInterval time.Duration
+	// catalogueVersion is the version of the catalogue last applied;
+	// guarded by refreshMutex
+	catalogueVersion string
+
+	// refreshMutex serializes refreshes
+	refreshMutex sync.Mutex
+
+	catalogueRefreshes metric.Int64Counter
+
+	errCatalogueDisabled = errors.New("catalogue refresh is not configured, set CATALOGUE_URL")
+	errCatalogueInvalid  = errors.New("invalid catalogue")
+	// errCatalogueNotModified is returned by Catalogue.Fetch
+	errCatalogueNotModified = errors.New("catalogue not modified")
+)
+
+func initCatalogue() {
+	catalogueInterval = 5 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("CATALOGUE_REFRESH_INTERVAL")); err == nil && v > 0 {
+		catalogueInterval = v
+	}
+
+	var err error
+	catalogueRefreshes, err = meter.Int64Counter(
+		"jokes.catalogue.refreshes",
+		metric.WithDescription("Number of catalogue refreshes by trigger and result"),
+		metric.WithUnit("{refresh}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create catalogue refresh counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"jokes.catalogue.active",
+		metric.WithDescription("Number of jokes in the served catalogue"),
+		metric.WithUnit("{joke}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			jokesMutex.RLock()
+			active := len(jokes) - len(retiredJokes)
+			jokesMutex.RUnlock()
+			o.Observe(int64(active))
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create active jokes gauge", zap.Error(err))
+	}
+
+	catalogueURL := os.Getenv("CATALOGUE_URL")
+	switch {
+	case catalogueURL == "":
+		logger.Info("Catalogue refresh disabled, CATALOGUE_URL not set")
+		return
+	case strings.HasPrefix(catalogueURL, "s3://"):
+		s3, err := newS3Catalogue(catalogueURL)
+		if err != nil {
+			logger.Fatal("Invalid S3 catalogue", zap.Error(err))
+		}
+		catalogue = s3
+	default:
+		catalogue = urlCatalogue{url: catalogueURL, token: os.Getenv("CATALOGUE_TOKEN")}
+	}
+	logger.Info("Catalogue refresh enabled",
+		zap.String("source", catalogue.Source()),
+		zap.Duration("interval", catalogueInterval),
+	)
+}
+
+// runCatalogueRefresh refreshes the catalogue on startup and then every
+// catalogueInterval until ctx is cancelled. Failures keep the current set.
+func runCatalogueRefresh(ctx context.Context) {
+	if catalogue == nil {
+		return
+	}
+
+	ticker := time.NewTicker(catalogueInterval)
+	defer ticker.Stop()
+	for {
+		refreshCatalogue(ctx, "scheduled")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshCatalogue fetches, validates and applies the catalogue. trigger
+// ("scheduled" or "manual") is recorded on the metric.
+func refreshCatalogue(ctx context.Context, trigger string) (RefreshReport, error) {
+	ctx, span := tracer.Start(ctx, "refreshCatalogue")
+	defer span.End()
+
+	report, err := applyCatalogue(ctx)
+
+	result := "success"
+	switch {
+	case err != nil:
+		result = "failure"
+		span.SetStatus(codes.Error, err.Error())
+		loggerFor(ctx).Error("Catalogue refresh failed",
+			zap.String("trigger", trigger),
+			zap.String("source", report.Source),
+			zap.Error(err),
+		)
+	case report.Unchanged:
+		result = "unchanged"
+	default:
+		loggerFor(ctx).Info("Catalogue refreshed",
+			zap.String("trigger", trigger),
+			zap.Int("total", report.Total),
+			zap.Int("added", report.Added),
+			zap.Int("retired", report.Retired),
+			zap.Int("reactivated", report.Reactivated),
+			zap.Int("active", report.Active),
+		)
+		publishInvalidation(ctx, Invalidation{Reason: "catalogue", Paths: invalidationPaths(), At: time.Now()})
+	}
+
+	span.SetAttributes(
+		attribute.String("catalogue.trigger", trigger),
+		attribute.String("catalogue.result", result),
+		attribute.Int("catalogue.added", report.Added),
+		attribute.Int("catalogue.retired", report.Retired),
+	)
+	catalogueRefreshes.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("trigger", trigger),
+		attribute.String("result", result),
+	))
+	return report, err
+}
+
+func applyCatalogue(ctx context.Context) (RefreshReport, error) {
+	if catalogue == nil {
+		return RefreshReport{}, errCatalogueDisabled
+	}
+	report := RefreshReport{Source: catalogue.Source()}
+
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+
+	object, err := catalogue.Fetch(ctx, catalogueVersion)
+	if errors.Is(err, errCatalogueNotModified) {
+		jokesMutex.RLock()
+		report.Active = len(jokes) - len(retiredJokes)
+		jokesMutex.RUnlock()
+		report.Unchanged = true
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("fetching catalogue: %w", err)
+	}
+
+	report.Format = detectFormat(report.Source, object.ContentType, object.Data)
+	rows, err := parseImport(object.Data, report.Format)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", errCatalogueInvalid, err)
+	}
+
+	// Unlike an import, one bad row rejects the whole catalogue, so a
+	// broken file never retires jokes
+	type catalogueRow struct {
+		row  int
+		joke Joke
+	}
+	seen := map[string]bool{}
+	seenIDs := map[string]bool{}
+	var entries []catalogueRow
+	for _, r := range rows {
+		joke, msg := validateRow(r)
+		if msg != "" {
+			return report, fmt.Errorf("%w: row %d: %s", errCatalogueInvalid, r.row, msg)
+		}
+		if key := normalizeJoke(joke.Text); !seen[key] {
+			if joke.ID != "" {
+				if seenIDs[joke.ID] {
+					return report, fmt.Errorf("%w: row %d: duplicate id %s", errCatalogueInvalid, r.row, joke.ID)
+				}
+				seenIDs[joke.ID] = true
+			}
+			seen[key] = true
+			entries = append(entries, catalogueRow{row: r.row, joke: joke})
+		}
+	}
+	if len(entries) == 0 {
+		return report, fmt.Errorf("%w: no jokes", errCatalogueInvalid)
+	}
+	report.Total = len(entries)
+
+	jokesMutex.Lock()
+	defer jokesMutex.Unlock()
+
+	existing := make(map[string]int, len(jokes))
+	for i, joke := range jokes {
+		existing[normalizeJoke(joke.Text)] = i
+	}
+
+	// Match every row before changing anything, since IDs can't move
+	// between jokes
+	matches := make([]int, len(entries))
+	for i, entry := range entries {
+		key := normalizeJoke(entry.joke.Text)
+		index, ok := existing[key]
+		if entry.joke.ID != "" {
+			if byID, taken := jokeIndexByID[entry.joke.ID]; taken && normalizeJoke(jokes[byID].Text) != key {
+				return report, fmt.Errorf("%w: row %d: id %s belongs to another joke", errCatalogueInvalid, entry.row, entry.joke.ID)
+			}
+			if ok && jokes[index].ID != entry.joke.ID {
+				return report, fmt.Errorf("%w: row %d: joke already has id %s", errCatalogueInvalid, entry.row, jokes[index].ID)
+			}
+		}
+		matches[i] = -1
+		if ok {
+			matches[i] = index
+		}
+	}
+
+	var added []Joke
+	for i, entry := range entries {
+		index := matches[i]
+		if index < 0 {
+			added = append(added, entry.joke)
+			continue
+		}
+		if retiredJokes[index] {
+			delete(retiredJokes, index)
+			report.Reactivated++
+		}
+		if updateJokeMetadata(&jokes[index], entry.joke) {
+			report.Updated++
+		}
+	}
+	for i, joke := range jokes {
+		if !seen[normalizeJoke(joke.Text)] && !retiredJokes[i] {
+			retiredJokes[i] = true
+			report.Retired++
+		}
+	}
+
+	if len(added) > 0 {
+		appendJokes(added)
+		selector.Add(len(added))
+	}
+	report.Added = len(added)
+	report.Active = len(jokes) - len(retiredJokes)
+	report.Unchanged = report.Added+report.Retired+report.Reactivated+report.Updated == 0
+	// Only once applied, so an object rejected as invalid is fetched, and
+	// rejected, again rather than passing as unchanged
+	catalogueVersion = object.Version
+
+	return report, nil
+}
+
+// updateJokeMetadata copies the metadata a catalogue row sets onto joke,
+// and how the row formats it, reporting whether anything changed. The row
+// matched the joke, so only line breaks and case can differ in the text.
+func updateJokeMetadata(joke *Joke, row Joke) bool {
+	changed := false
+	if row.Text != joke.Text || row.Setup != joke.Setup || row.Punchline != joke.Punchline || row.Format != joke.Format {
+		joke.Text, joke.Setup, joke.Punchline, joke.Format = row.Text, row.Setup, row.Punchline, row.Format
+		changed = true
+	}
+	if row.Category != "" && row.Category != joke.Category {
+		joke.Category, changed = row.Category, true
+	}
+	if row.Author != "" && row.Author != joke.Author {
+		joke.Author, changed = row.Author, true
+	}
+	if row.Language != "" && row.Language != joke.Language {
+		joke.Language, changed = row.Language, true
+	}
+	return changed
+}
+
+// refreshHandler serves POST /internal/jokes/refresh, refreshing the
+// catalogue immediately.
+func refreshHandler(c *gin.Context) {
+	report, err := refreshCatalogue(c.Request.Context(), "manual")
+	switch {
+	case errors.Is(err, errCatalogueDisabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errCatalogueInvalid):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		if !report.Unchanged {
+			c.Header(invalidationHeader, strings.Join(invalidationPaths(), ", "))
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Jokes added through the import and the admin API are checked for near
+// duplicates of the known jokes, retired ones included, and of earlier
+// rows of the same import. Exact duplicates, equal but for case and
+// whitespace, are skipped as before. Beyond that, texts are compared with
+// punctuation stripped:
+//
+//   - texts that are equal once stripped, found by hash, score 1
+//   - otherwise DUPLICATE_SIMILARITY picks the score: "minhash" (default)
+//     estimates the Jaccard similarity of their character 3-grams from 64
+//     hashes, "levenshtein" is one minus their edit distance over the
+//     longer length (slower with large catalogues), and "off" only
+//     compares hashes
+//
+// A joke scoring DUPLICATE_THRESHOLD (default 0.8) or more against
+// another is a near duplicate. DUPLICATE_ACTION "reject" (default) turns
+// it away; "flag" adds it and shows its match in the admin listing. With
+// force=true it is added regardless, unflagged. Catalogue refreshes are
+// not checked, as the catalogue is the source of truth.
+
+// Similarity measures
+const (
+	similarityMinHash     = "minhash"
+	similarityLevenshtein = "levenshtein"
+	similarityOff         = "off"
+)
+
+// Actions on near duplicates
+const (
+	duplicateRejected = "rejected"
+	duplicateFlagged  = "flagged"
+	duplicateForced   = "forced"
+)
+
+const (
+	// minHashSize is the number of hashes in a MinHash signature
+	minHashSize = 64
+	// shingleSize is the length of the character n-grams MinHash compares
+	shingleSize = 3
+)
+
+// DuplicateMatch is the joke a new joke nearly duplicates, and their
+// similarity from 0 to 1.
+type DuplicateMatch struct {
+	JokeID string  `json:"joke_id"`
+	Score  float64 `json:"score"`
+}
+
+var (
+	duplicateSimilarity = similarityMinHash
+	duplicateThreshold  = 0.8
+	// duplicateAction is duplicateRejected or duplicateFlagged
+	duplicateAction = duplicateRejected
+
+	// duplicateFlags holds the matches of jokes added as flagged near
+	// duplicates, by joke ID; guarded by jokesMutex
+	duplicateFlags = map[string]DuplicateMatch{}
+
+	// minHashSeeds derive the signature's hash functions from one hash
+	minHashSeeds [minHashSize]uint64
+
+	nearDuplicates metric.Int64Counter
+)
+
+func initDuplicates() {
+	switch v := strings.ToLower(os.Getenv("DUPLICATE_SIMILARITY")); v {
+	case "":
+	case similarityMinHash, similarityLevenshtein, similarityOff:
+		duplicateSimilarity = v
+	default:
+		logger.Warn("Unknown duplicate similarity, using minhash", zap.String("similarity", v))
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("DUPLICATE_THRESHOLD"), 64); err == nil && v > 0 && v <= 1 {
+		duplicateThreshold = v
+	}
+	switch v := strings.ToLower(os.Getenv("DUPLICATE_ACTION")); v {
+	case "", "reject":
+	case "flag":
+		duplicateAction = duplicateFlagged
+	default:
+		logger.Warn("Unknown duplicate action, rejecting", zap.String("action", v))
+	}
+
+	// Fixed seeds keep signatures comparable across restarts
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range minHashSeeds {
+		seed += 0x9e3779b97f4a7c15
+		minHashSeeds[i] = mix64(seed)
+	}
+
+	var err error
+	nearDuplicates, err = meter.Int64Counter(
+		"jokes.duplicates.detected",
+		metric.WithDescription("Number of near-duplicate jokes detected on import or creation, by action"),
+		metric.WithUnit("{joke}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create near duplicates counter", zap.Error(err))
+	}
+}
+
+// duplicateText strips a joke down to lowercase letters and digits
+// separated by single spaces.
+func duplicateText(text string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			space = false
+		} else {
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// duplicateEntry is an indexed joke, stripped.
+type duplicateEntry struct {
+	id        string
+	text      []rune
+	signature []uint64
+}
+
+// duplicateIndex finds near duplicates among a set of jokes.
+type duplicateIndex struct {
+	byHash  map[[sha256.Size]byte]string
+	entries []duplicateEntry
+}
+
+// newDuplicateIndex indexes jokes. Callers must hold jokesMutex.
+func newDuplicateIndex(existing []Joke) *duplicateIndex {
+	x := &duplicateIndex{byHash: make(map[[sha256.Size]byte]string, len(existing))}
+	for _, joke := range existing {
+		x.add(joke.ID, joke.Text)
+	}
+	return x
+}
+
+// add indexes a joke.
+func (x *duplicateIndex) add(id, text string) {
+	stripped := duplicateText(text)
+	hash := sha256.Sum256([]byte(stripped))
+	if _, ok := x.byHash[hash]; !ok {
+		x.byHash[hash] = id
+	}
+
+	entry := duplicateEntry{id: id}
+	switch duplicateSimilarity {
+	case similarityMinHash:
+		entry.signature = minHash(stripped)
+	case similarityLevenshtein:
+		entry.text = []rune(stripped)
+	default:
+		return
+	}
+	x.entries = append(x.entries, entry)
+}
+
+// match returns the indexed joke most similar to text, if it is a near
+// duplicate.
+func (x *duplicateIndex) match(text string) (DuplicateMatch, bool) {
+	stripped := duplicateText(text)
+	if id, ok := x.byHash[sha256.Sum256([]byte(stripped))]; ok {
+		return DuplicateMatch{JokeID: id, Score: 1}, true
+	}
+
+	var best DuplicateMatch
+	switch duplicateSimilarity {
+	case similarityMinHash:
+		signature := minHash(stripped)
+		for _, entry := range x.entries {
+			if score := signatureSimilarity(signature, entry.signature); score > best.Score {
+				best = DuplicateMatch{JokeID: entry.id, Score: score}
+			}
+		}
+	case similarityLevenshtein:
+		runes := []rune(stripped)
+		for _, entry := range x.entries {
+			// The length difference bounds the edit distance from below
+			longer := max(len(runes), len(entry.text))
+			if longer == 0 {
+				continue
+			}
+			bound := 1 - float64(abs(len(runes)-len(entry.text)))/float64(longer)
+			if bound < duplicateThreshold || bound <= best.Score {
+				continue
+			}
+			score := 1 - float64(levenshtein(runes, entry.text))/float64(longer)
+			if score > best.Score {
+				best = DuplicateMatch{JokeID: entry.id, Score: score}
+			}
+		}
+	}
+
+	best.Score = math.Round(best.Score*1000) / 1000
+	return best, best.JokeID != "" && best.Score >= duplicateThreshold
+}
+
+// minHash returns the MinHash signature of the character shingles of text.
+func minHash(text string) []uint64 {
+	signature := make([]uint64, minHashSize)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+
+	runes := []rune(text)
+	n := shingleSize
+	if len(runes) < n {
+		n = len(runes)
+	}
+	for i := 0; i+n <= len(runes); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(runes[i : i+n])))
+		shingle := h.Sum64()
+		for j, seed := range minHashSeeds {
+			if v := mix64(shingle ^ seed); v < signature[j] {
+				signature[j] = v
+			}
+		}
+	}
+	return signature
+}
+
+// signatureSimilarity estimates the Jaccard similarity of two signatures'
+// shingle sets.
+func signatureSimilarity(a, b []uint64) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// nearDuplicateOf returns the match a joke was flagged with, if any.
+func nearDuplicateOf(id string) *DuplicateMatch {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+	if match, ok := duplicateFlags[id]; ok {
+		return &match
+	}
+	return nil
+}
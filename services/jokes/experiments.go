@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/ids"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// A joke can be A/B tested against variants of it, alternate punchlines.
+// While an experiment runs, every client is bucketed into the control, the
+// joke as it is, or one of the variants, in proportion to their weights,
+// and is served that text whenever the joke comes up. Bucketing hashes the
+// experiment ID with the client's identity (the user ID, or the client
+// cookie for anonymous clients), so it is consistent across requests and
+// replicas without storing assignments.
+//
+// Each serving is reported to analytics as an experiment_exposure event,
+// and reactions to the joke carry the reacting client's variant. Analytics
+// credits favorites of the joke to the variant the user was exposed to
+// (see its experiments.go). GET /internal/experiments/:id/results combines
+// the counts analytics keeps with the experiment's variants into rates per
+// variant and names the leaders once every variant has been served
+// EXPERIMENT_MIN_EXPOSURES times (default 100).
+//
+// Experiments are kept by joke ID, so they survive catalogue refreshes.
+// Ending one serves the control to everyone again; its results remain.
+
+const (
+	// controlVariant names the joke's own text in an experiment
+	controlVariant = "control"
+
+	maxExperimentVariants = 5
+	maxVariantWeight      = 100
+)
+
+// JokeVariant is an alternate text of a joke under test.
+type JokeVariant struct {
+	Name   string `json:"name"`
+	Text   string `json:"joke"`
+	Weight int    `json:"weight"`
+}
+
+// JokeExperiment tests variants of a joke against the joke itself.
+type JokeExperiment struct {
+	ID     string `json:"id"`
+	JokeID string `json:"joke_id"`
+	// ControlWeight is the control's share of clients against the
+	// variants' weights
+	ControlWeight int           `json:"control_weight"`
+	Variants      []JokeVariant `json:"variants"`
+	StartedAt     time.Time     `json:"started_at"`
+	EndedAt       *time.Time    `json:"ended_at,omitempty"`
+}
+
+// StartExperimentRequest starts an experiment; weights default to 1.
+type StartExperimentRequest struct {
+	ID            string        `json:"id"`
+	JokeID        string        `json:"joke_id" binding:"required"`
+	ControlWeight int           `json:"control_weight"`
+	Variants      []JokeVariant `json:"variants" binding:"required"`
+}
+
+// ExposureEvent is the payload of the experiment_exposure event sent to
+// analytics whenever a variant is served.
+type ExposureEvent struct {
+	ExperimentID string `json:"experiment_id"`
+	JokeID       string `json:"joke_id"`
+	Variant      string `json:"variant"`
+	// UserID lets analytics credit the user's favorites to the variant;
+	// anonymous clients are not reported
+	UserID string `json:"user_id,omitempty"`
+}
+
+// VariantCounts are the outcomes of a variant as analytics counts them.
+type VariantCounts struct {
+	Exposures int64            `json:"exposures"`
+	Favorites int64            `json:"favorites"`
+	Reactions map[string]int64 `json:"reactions"`
+}
+
+// VariantResult is a variant's outcomes and rates per exposure.
+type VariantResult struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	VariantCounts
+	FavoriteRate float64 `json:"favorite_rate"`
+	ReactionRate float64 `json:"reaction_rate"`
+	LaughRate    float64 `json:"laugh_rate"`
+}
+
+var (
+	// jokeExperiments holds every experiment by ID, runningExperiments the
+	// running one of each joke by joke ID
+	jokeExperiments    = map[string]*JokeExperiment{}
+	runningExperiments = map[string]*JokeExperiment{}
+	experimentsMutex   sync.RWMutex
+
+	experimentMinExposures int64 = 100
+	experimentsClient            = &http.Client{Timeout: 2 * time.Second}
+
+	experimentExposures metric.Int64Counter
+
+	errExperimentNotFound = errors.New("no events recorded for the experiment")
+)
+
+func initExperiments() {
+	if v, err := strconv.ParseInt(os.Getenv("EXPERIMENT_MIN_EXPOSURES"), 10, 64); err == nil && v >= 0 {
+		experimentMinExposures = v
+	}
+
+	var err error
+	experimentExposures, err = meter.Int64Counter(
+		"jokes.experiment.exposures",
+		metric.WithDescription("Number of joke variants served in experiments, by experiment and variant"),
+		metric.WithUnit("{joke}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create experiment exposures counter", zap.Error(err))
+	}
+}
+
+// validate checks the request against the joke under test, whose text and
+// safety are given, and fills in default weights.
+func (r *StartExperimentRequest) validate(jokeText string, jokeSafe bool) error {
+	if r.ID != "" && !jokeIDPattern.MatchString(r.ID) {
+		return fmt.Errorf("id must be 1-64 letters, digits, '-' or '_'")
+	}
+	if len(r.Variants) == 0 || len(r.Variants) > maxExperimentVariants {
+		return fmt.Errorf("an experiment needs 1 to %d variants", maxExperimentVariants)
+	}
+	if r.ControlWeight == 0 {
+		r.ControlWeight = 1
+	}
+	if r.ControlWeight < 0 || r.ControlWeight > maxVariantWeight {
+		return fmt.Errorf("control_weight must be between 1 and %d", maxVariantWeight)
+	}
+
+	names := map[string]bool{controlVariant: true}
+	for i := range r.Variants {
+		v := &r.Variants[i]
+		v.Text = strings.TrimSpace(v.Text)
+		switch {
+		case !jokeIDPattern.MatchString(v.Name):
+			return fmt.Errorf("variant %d: name must be 1-64 letters, digits, '-' or '_'", i+1)
+		case names[v.Name]:
+			return fmt.Errorf("variant %d: name %q is taken", i+1, v.Name)
+		case v.Text == "" || !utf8.ValidString(v.Text):
+			return fmt.Errorf("variant %d: joke is empty or not valid UTF-8", i+1)
+		case utf8.RuneCountInString(v.Text) > maxJokeLength:
+			return fmt.Errorf("variant %d: joke is longer than %d characters", i+1, maxJokeLength)
+		case normalizeJoke(v.Text) == normalizeJoke(jokeText):
+			return fmt.Errorf("variant %d: joke is the same as the control", i+1)
+		case jokeSafe && !classifyWords(v.Text).Safe:
+			return fmt.Errorf("variant %d: joke would not pass the content filter", i+1)
+		}
+		names[v.Name] = true
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		if v.Weight < 0 || v.Weight > maxVariantWeight {
+			return fmt.Errorf("variant %d: weight must be between 1 and %d", i+1, maxVariantWeight)
+		}
+	}
+	return nil
+}
+
+// running reports whether the experiment still buckets clients.
+func (e *JokeExperiment) running() bool {
+	return e.EndedAt == nil
+}
+
+// assign buckets a client into the control or one of the variants and
+// returns the variant, nil for the control.
+func (e *JokeExperiment) assign(client string) *JokeVariant {
+	total := e.ControlWeight
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	sum := sha256.Sum256([]byte(e.ID + ":" + client))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	if bucket < e.ControlWeight {
+		return nil
+	}
+	bucket -= e.ControlWeight
+	for i := range e.Variants {
+		if bucket < e.Variants[i].Weight {
+			return &e.Variants[i]
+		}
+		bucket -= e.Variants[i].Weight
+	}
+	return nil
+}
+
+// experimentVariant returns the running experiment on a joke and the
+// client's variant in it, nil for the control. ok is false if the joke is
+// not under test.
+func experimentVariant(jokeID, client string) (experiment *JokeExperiment, variant *JokeVariant, ok bool) {
+	experimentsMutex.RLock()
+	defer experimentsMutex.RUnlock()
+
+	experiment, ok = runningExperiments[jokeID]
+	if !ok || client == "" {
+		return nil, nil, false
+	}
+	return experiment, experiment.assign(client), true
+}
+
+// variantName is the name of an assigned variant.
+func variantName(variant *JokeVariant) string {
+	if variant == nil {
+		return controlVariant
+	}
+	return variant.Name
+}
+
+// applyExperiment serves the client's variant in response, the JSON of a
+// joke about to be served, if the joke is under test, and reports the
+// exposure.
+func applyExperiment(ctx context.Context, response gin.H, client, userID string) {
+	jokeID, _ := response["id"].(string)
+	experiment, variant, ok := experimentVariant(jokeID, client)
+	if !ok {
+		return
+	}
+	if variant != nil {
+		response["joke"] = variant.Text
+		response["format"] = jokeFormatPlain
+		delete(response, "setup")
+		delete(response, "punchline")
+	}
+	name := variantName(variant)
+	response["experiment"] = gin.H{"id": experiment.ID, "variant": name}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("experiment.id", experiment.ID),
+		attribute.String("experiment.variant", name),
+	)
+	experimentExposures.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("experiment_id", experiment.ID),
+		attribute.String("variant", name),
+	), telemetry.ContextAttrs(ctx))
+	trackEvent(ctx, "experiment_exposure", ExposureEvent{
+		ExperimentID: experiment.ID,
+		JokeID:       jokeID,
+		Variant:      name,
+		UserID:       userID,
+	}, nil)
+}
+
+// newExperimentID generates an experiment ID.
+func newExperimentID() string {
+	return ids.WithPrefix("exp_")
+}
+
+// startExperiment starts an experiment on the joke at index.
+func startExperiment(ctx context.Context, index int, req StartExperimentRequest) (*JokeExperiment, int, error) {
+	joke := jokeAt(index)
+	if err := req.validate(joke.Text, isSafe(index)); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	experiment := &JokeExperiment{
+		ID:            req.ID,
+		JokeID:        joke.ID,
+		ControlWeight: req.ControlWeight,
+		Variants:      req.Variants,
+		StartedAt:     time.Now().UTC(),
+	}
+	if experiment.ID == "" {
+		experiment.ID = newExperimentID()
+	}
+
+	experimentsMutex.Lock()
+	defer experimentsMutex.Unlock()
+	if _, exists := jokeExperiments[experiment.ID]; exists {
+		return nil, http.StatusConflict, fmt.Errorf("experiment %s already exists", experiment.ID)
+	}
+	if running, ok := runningExperiments[joke.ID]; ok {
+		return nil, http.StatusConflict, fmt.Errorf("experiment %s is already running on the joke", running.ID)
+	}
+	jokeExperiments[experiment.ID] = experiment
+	runningExperiments[joke.ID] = experiment
+
+	loggerFor(ctx).Info("Experiment started",
+		zap.String("experiment_id", experiment.ID),
+		zap.String("joke_id", joke.ID),
+		zap.Int("variants", len(experiment.Variants)),
+	)
+	return experiment, http.StatusCreated, nil
+}
+
+// listExperiments returns every experiment, most recently started first.
+func listExperiments() []JokeExperiment {
+	experimentsMutex.RLock()
+	listed := make([]JokeExperiment, 0, len(jokeExperiments))
+	for _, e := range jokeExperiments {
+		listed = append(listed, *e)
+	}
+	experimentsMutex.RUnlock()
+
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].StartedAt.After(listed[j].StartedAt)
+	})
+	return listed
+}
+
+// fetchExperimentCounts gets an experiment's counts per variant from
+// analytics. The tenant travels in the propagated baggage.
+func fetchExperimentCounts(ctx context.Context, id string) (map[string]VariantCounts, error) {
+	ctx, span := tracer.Start(ctx, "fetchExperimentCounts")
+	defer span.End()
+
+	target := fmt.Sprintf("http://%s/api/v1/stats/experiments/%s", analyticsServiceAddr(), url.PathEscape(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := experimentsClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errExperimentNotFound
+	default:
+		return nil, fmt.Errorf("analytics returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Variants map[string]VariantCounts `json:"variants"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Variants, nil
+}
+
+// experimentResults computes the rates of each variant, control first, and
+// the leading variant by favorites and by reactions per exposure. Leaders
+// are only named once every variant has been served experimentMinExposures
+// times, and not on a tie.
+func experimentResults(experiment JokeExperiment, counts map[string]VariantCounts) ([]VariantResult, gin.H) {
+	results := []VariantResult{{Name: controlVariant, Weight: experiment.ControlWeight}}
+	for _, v := range experiment.Variants {
+		results = append(results, VariantResult{Name: v.Name, Weight: v.Weight})
+	}
+
+	conclusive := true
+	for i := range results {
+		r := &results[i]
+		r.VariantCounts = counts[r.Name]
+		if r.Reactions == nil {
+			r.Reactions = map[string]int64{}
+		}
+		if r.Exposures < experimentMinExposures {
+			conclusive = false
+		}
+		if r.Exposures == 0 {
+			continue
+		}
+		var reactions int64
+		for _, n := range r.Reactions {
+			reactions += n
+		}
+		exposures := float64(r.Exposures)
+		r.FavoriteRate = float64(r.Favorites) / exposures
+		r.ReactionRate = float64(reactions) / exposures
+		r.LaughRate = float64(r.Reactions["laugh"]) / exposures
+	}
+
+	leaders := gin.H{"favorites": nil, "reactions": nil}
+	if !conclusive {
+		return results, leaders
+	}
+	leader := func(rate func(VariantResult) float64) interface{} {
+		best, tied := 0, false
+		for i := 1; i < len(results); i++ {
+			switch {
+			case rate(results[i]) > rate(results[best]):
+				best, tied = i, false
+			case rate(results[i]) == rate(results[best]):
+				tied = true
+			}
+		}
+		if tied {
+			return nil
+		}
+		return results[best].Name
+	}
+	leaders["favorites"] = leader(func(r VariantResult) float64 { return r.FavoriteRate })
+	leaders["reactions"] = leader(func(r VariantResult) float64 { return r.ReactionRate })
+	return results, leaders
+}
+
+// registerExperimentRoutes installs the experiment endpoints.
+func registerExperimentRoutes(internal *gin.RouterGroup) {
+	internal.GET("/experiments", func(c *gin.Context) {
+		listed := listExperiments()
+		c.JSON(http.StatusOK, gin.H{
+			"experiments": listed,
+			"count":       len(listed),
+		})
+	})
+
+	internal.POST("/experiments", func(c *gin.Context) {
+		var req StartExperimentRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		index, ok := jokeIndex(req.JokeID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+
+		experiment, status, err := startExperiment(c.Request.Context(), index, req)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(status, experiment)
+	})
+
+	internal.DELETE("/experiments/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		experimentsMutex.Lock()
+		experiment, ok := jokeExperiments[c.Param("id")]
+		if !ok || !experiment.running() {
+			experimentsMutex.Unlock()
+			c.JSON(http.StatusNotFound, gin.H{"error": "Experiment not found or already ended"})
+			return
+		}
+		ended := time.Now().UTC()
+		experiment.EndedAt = &ended
+		delete(runningExperiments, experiment.JokeID)
+		listed := *experiment
+		experimentsMutex.Unlock()
+
+		loggerFor(ctx).Info("Experiment ended", zap.String("experiment_id", listed.ID))
+		c.JSON(http.StatusOK, listed)
+	})
+
+	internal.GET("/experiments/:id/results", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		experimentsMutex.RLock()
+		experiment, ok := jokeExperiments[c.Param("id")]
+		var listed JokeExperiment
+		if ok {
+			listed = *experiment
+		}
+		experimentsMutex.RUnlock()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Experiment not found"})
+			return
+		}
+
+		counts, err := fetchExperimentCounts(ctx, listed.ID)
+		if err != nil && !errors.Is(err, errExperimentNotFound) {
+			loggerFor(ctx).Error("Failed to fetch experiment counts", zap.String("experiment_id", listed.ID), zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Experiment results are unavailable"})
+			return
+		}
+
+		results, leaders := experimentResults(listed, counts)
+		c.JSON(http.StatusOK, gin.H{
+			"experiment":    listed,
+			"variants":      results,
+			"leaders":       leaders,
+			"min_exposures": experimentMinExposures,
+		})
+	})
+}
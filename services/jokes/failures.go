@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requests to the public API that fail with a 5xx status, panics included,
+// are reported to analytics as request_failed events, so its availability
+// SLOs count them alongside the jokes served (see the analytics service's
+// slo.go).
+
+// RequestFailedPayload is the payload of a request_failed event.
+type RequestFailedPayload struct {
+	Status  int            `json:"status"`
+	Latency *LatencySample `json:"latency"`
+}
+
+// failureReportingMiddleware reports failed API requests. Install it outside
+// the panic recovery (middleware.WithObservers), so the 500 a panic ends in
+// is reported too.
+func failureReportingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		if status < 500 || !strings.HasPrefix(c.FullPath(), "/api/") {
+			return
+		}
+		latency := latencySince(c, start)
+		// Middleware further down may have replaced the request
+		trackEvent(c.Request.Context(), "request_failed", RequestFailedPayload{
+			Status:  status,
+			Latency: &latency,
+		}, nil)
+	}
+}
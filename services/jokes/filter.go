@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Classification is the content filter's verdict on a joke.
+type Classification struct {
+	Safe bool `json:"safe"`
+	// Reasons lists the blocked words or moderation categories that matched
+	Reasons []string `json:"reasons,omitempty"`
+	// Source is "wordlist" or "moderation"
+	Source string `json:"source"`
+}
+
+// FilteredJoke is a joke withheld from safe mode, for the admin listing.
+type FilteredJoke struct {
+	ID   string `json:"id"`
+	Joke string `json:"joke"`
+	Classification
+}
+
+// defaultBlockedWords is extended with CONTENT_FILTER_WORDS
+var defaultBlockedWords = []string{
+	"fuck", "fucking", "shit", "bitch", "bastard", "asshole", "dick",
+	"cunt", "piss", "cock", "slut", "whore", "porn", "sex", "nude",
+}
+
+var (
+	// jokeSafety holds the classification of each joke, parallel to jokes;
+	// guarded by jokesMutex
+	jokeSafety []Classification
+
+	blockedWords map[string]bool
+
+	// OpenAI-compatible moderation endpoint; jokes are reviewed in the
+	// background and flagged ones are withheld from safe mode
+	moderationURL   string
+	moderationKey   string
+	moderationQueue chan int
+
+	moderationChecks metric.Int64Counter
+)
+
+// initContentFilter builds the word list, classifies the built-in jokes and,
+// when MODERATION_API_URL is set, queues them for moderation.
+func initContentFilter() {
+	blockedWords = map[string]bool{}
+	for _, word := range defaultBlockedWords {
+		blockedWords[word] = true
+	}
+	for _, word := range strings.Split(os.Getenv("CONTENT_FILTER_WORDS"), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			blockedWords[word] = true
+		}
+	}
+
+	moderationURL = os.Getenv("MODERATION_API_URL")
+	moderationKey = os.Getenv("MODERATION_API_KEY")
+	if moderationURL != "" {
+		moderationQueue = make(chan int, 10000)
+	}
+
+	var err error
+	moderationChecks, err = meter.Int64Counter(
+		"jokes.moderation.checks",
+		metric.WithDescription("Number of jokes reviewed by the moderation API"),
+		metric.WithUnit("{joke}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create moderation counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"jokes.unsafe",
+		metric.WithDescription("Number of jokes withheld from safe mode"),
+		metric.WithUnit("{joke}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(len(filteredJokes())))
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create unsafe jokes gauge", zap.Error(err))
+	}
+
+	// Classify and queue the built-in jokes like imported ones
+	jokesMutex.Lock()
+	builtin := jokes
+	jokes = nil
+	appendJokes(builtin)
+	jokesMutex.Unlock()
+
+	logger.Info("Content filter initialized",
+		zap.Int("blocked_words", len(blockedWords)),
+		zap.Bool("moderation", moderationURL != ""),
+	)
+}
+
+// appendJokes adds jokes with their word list classification and queues
+// them for moderation, filling in a derived ID, the default language and
+// the creation time where missing. Callers must hold jokesMutex for
+// writing.
+func appendJokes(added []Joke) {
+	now := time.Now().UTC()
+	for _, joke := range added {
+		if joke.ID == "" {
+			joke.ID = derivedJokeID(joke.Text)
+		}
+		if joke.Language == "" {
+			joke.Language = defaultJokeLanguage
+		}
+		if joke.CreatedAt.IsZero() {
+			joke.CreatedAt = now
+		}
+		jokeIndexByID[joke.ID] = len(jokes)
+		jokes = append(jokes, joke)
+		jokeSafety = append(jokeSafety, classifyWords(joke.Text))
+
+		if moderationQueue == nil {
+			continue
+		}
+		select {
+		case moderationQueue <- len(jokes) - 1:
+		default:
+			logger.Warn("Moderation queue full, keeping word list verdict",
+				zap.Int("index", len(jokes)-1),
+			)
+		}
+	}
+}
+
+// classifyWords flags jokes containing a blocked word. Words are matched
+// whole and case-insensitively, so "Scunthorpe" is not flagged.
+func classifyWords(joke string) Classification {
+	var matched []string
+	seen := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(joke), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		if blockedWords[word] && !seen[word] {
+			seen[word] = true
+			matched = append(matched, word)
+		}
+	}
+	return Classification{Safe: len(matched) == 0, Reasons: matched, Source: "wordlist"}
+}
+
+// isSafe reports whether the joke at index may be served in safe mode.
+func isSafe(index int) bool {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+	return jokeSafety[index].Safe
+}
+
+// servableJokes returns which jokes may be served, by index: published
+// jokes (see lifecycle.go) still in the catalogue, in season (see
+// schedule.go) and, in safe mode, passing the filter. It returns nil when
+// every joke may be served.
+func servableJokes(safeMode bool) []bool {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	now := time.Now()
+	season := inSeason(now)
+	drafted := draftedJokes(now)
+	if !safeMode && len(retiredJokes) == 0 && season == nil && drafted == nil {
+		return nil
+	}
+	servable := make([]bool, len(jokeSafety))
+	for i, c := range jokeSafety {
+		active, scheduled := season[i]
+		servable[i] = (c.Safe || !safeMode) && !retiredJokes[i] && !drafted[i] && (!scheduled || active)
+	}
+	return servable
+}
+
+// filteredJokes lists the jokes withheld from safe mode.
+func filteredJokes() []FilteredJoke {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	filtered := []FilteredJoke{}
+	for i, c := range jokeSafety {
+		if !c.Safe {
+			filtered = append(filtered, FilteredJoke{ID: jokes[i].ID, Joke: jokes[i].Text, Classification: c})
+		}
+	}
+	return filtered
+}
+
+// runModeration reviews queued jokes with the moderation API until ctx is
+// cancelled. A joke flagged by either the word list or the API is unsafe;
+// while the API is failing, the word list verdict stands and the check is
+// retried with backoff.
+func runModeration(ctx context.Context) {
+	if moderationQueue == nil {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case index := <-moderationQueue:
+			verdict, err := moderate(ctx, jokeAt(index).Text)
+			for err != nil {
+				moderationChecks.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "error")))
+				logger.Warn("Moderation check failed, retrying",
+					zap.String("joke_id", jokeID(index)),
+					zap.Duration("backoff", backoff),
+					zap.Error(err),
+				)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(2*backoff, time.Minute)
+				verdict, err = moderate(ctx, jokeAt(index).Text)
+			}
+			backoff = time.Second
+
+			result := "safe"
+			if !verdict.Safe {
+				result = "unsafe"
+				jokesMutex.Lock()
+				jokeSafety[index] = verdict
+				jokesMutex.Unlock()
+
+				logger.Info("Joke flagged by moderation",
+					zap.String("joke_id", jokeID(index)),
+					zap.Strings("categories", verdict.Reasons),
+				)
+			}
+			moderationChecks.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+		}
+	}
+}
+
+// moderate classifies a joke with the moderation API.
+func moderate(ctx context.Context, joke string) (Classification, error) {
+	ctx, span := tracer.Start(ctx, "moderateJoke")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	payload, err := json.Marshal(map[string]string{"input": joke})
+	if err != nil {
+		return Classification{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, moderationURL, bytes.NewReader(payload))
+	if err != nil {
+		return Classification{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if moderationKey != "" {
+		req.Header.Set("Authorization", "Bearer "+moderationKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return Classification{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("moderation API returned status %d", resp.StatusCode)
+		span.SetStatus(codes.Error, err.Error())
+		return Classification{}, err
+	}
+
+	var body struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Classification{}, err
+	}
+	if len(body.Results) == 0 {
+		return Classification{}, fmt.Errorf("moderation API returned no results")
+	}
+
+	verdict := Classification{Safe: !body.Results[0].Flagged, Source: "moderation"}
+	for category, flagged := range body.Results[0].Categories {
+		if flagged {
+			verdict.Reasons = append(verdict.Reasons, category)
+		}
+	}
+	sort.Strings(verdict.Reasons)
+
+	span.SetAttributes(attribute.Bool("joke.safe", verdict.Safe))
+	return verdict, nil
+}
+
+// filteredHandler serves GET /internal/admin/filtered: the jokes withheld
+// from safe mode and why.
+func filteredHandler(c *gin.Context) {
+	filtered := filteredJokes()
+
+	loggerFor(c.Request.Context()).Info("Filtered jokes listed",
+		zap.Int("count", len(filtered)),
+		zap.String("service", c.GetHeader(middleware.InternalServiceHeader)),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"jokes":      filtered,
+		"count":      len(filtered),
+		"total":      jokeCount(),
+		"moderation": moderationURL != "",
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Jokes can be more than a line of plain text:
+//
+//   - a joke can be given as a "setup" and a "punchline" instead of one
+//     "joke"; both may span lines, and the joke text is the setup and the
+//     punchline on lines of their own, so the content filter, duplicate
+//     detection and derived IDs see the whole joke
+//   - any text may have line breaks (up to maxJokeLines lines) and emoji
+//   - a joke with "format": "markdown" may use inline **bold**, *italics*
+//     and `code` within a line; HTML, links and images are rejected, as
+//     are unclosed ** and backticks. Other jokes are "plain", and asterisks in them are
+//     just asterisks
+//
+// Control characters other than line breaks and tabs, and invisible
+// formatting characters other than those emoji are built from, are
+// rejected everywhere, as they can hide text or reorder it on screen.
+//
+// Clients asking for text/plain get a plain rendering of the joke: the
+// markdown markers are dropped, and a punchline goes after a blank line.
+
+// Joke formats
+const (
+	jokeFormatPlain    = "plain"
+	jokeFormatMarkdown = "markdown"
+)
+
+// maxJokeLines is the most lines a joke may have
+const maxJokeLines = 20
+
+var (
+	markdownHTMLPattern = regexp.MustCompile(`<[A-Za-z/!?]`)
+	markdownLinkPattern = regexp.MustCompile(`\[[^\]\n]*\]\([^)\n]*\)`)
+	// markdownEscapePattern matches the characters markdown escapes
+	markdownEscapePattern = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!>])")
+	markdownCodePattern   = regexp.MustCompile("`([^`\n]+)`")
+	markdownBoldPattern   = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	markdownItalicPattern = regexp.MustCompile(`\*([^*\n]+)\*|\b_([^_\n]+)_\b`)
+)
+
+// jokeFormat is the format of a joke, plain unless it is markdown.
+func jokeFormat(format string) string {
+	if format == jokeFormatMarkdown {
+		return jokeFormatMarkdown
+	}
+	return jokeFormatPlain
+}
+
+// emojiFormatRune reports whether r is an invisible formatting character
+// emoji are built from: the zero width joiner of sequences such as
+// "woman technologist", and the tag characters of subdivision flags.
+func emojiFormatRune(r rune) bool {
+	return r == '\u200d' || r >= 0xE0020 && r <= 0xE007F
+}
+
+// validateFormatting reports why text is rejected in format, if it is.
+func validateFormatting(text, format string) string {
+	if format != "" && format != jokeFormatPlain && format != jokeFormatMarkdown {
+		return "format must be plain or markdown"
+	}
+	if strings.Count(text, "\n") >= maxJokeLines {
+		return "joke has more than " + strconv.Itoa(maxJokeLines) + " lines"
+	}
+	for _, r := range text {
+		switch {
+		case r == '\n' || r == '\t':
+		case unicode.IsControl(r):
+			return "joke has control characters"
+		case unicode.Is(unicode.Cf, r) && !emojiFormatRune(r):
+			return "joke has invisible formatting characters"
+		}
+	}
+	if format != jokeFormatMarkdown {
+		return ""
+	}
+
+	switch {
+	case markdownHTMLPattern.MatchString(text):
+		return "markdown jokes can't contain HTML"
+	case markdownLinkPattern.MatchString(text):
+		return "markdown jokes can't contain links or images"
+	}
+	// Markers don't span lines
+	for _, line := range strings.Split(markdownEscapePattern.ReplaceAllString(text, ""), "\n") {
+		switch {
+		case strings.Count(line, "**")%2 != 0:
+			return "markdown has an unclosed **"
+		case strings.Count(line, "`")%2 != 0:
+			return "markdown has an unclosed `"
+		}
+	}
+	return ""
+}
+
+// plainText renders text in format as plain text.
+func plainText(text, format string) string {
+	if format != jokeFormatMarkdown {
+		return text
+	}
+	// Escaped characters are set aside as private use runes, so they
+	// aren't taken for markers
+	text = markdownEscapePattern.ReplaceAllStringFunc(text, func(m string) string {
+		return string(rune(0xF000) + rune(m[1]))
+	})
+	text = markdownCodePattern.ReplaceAllString(text, "$1")
+	text = markdownBoldPattern.ReplaceAllString(text, "$1$2")
+	text = markdownItalicPattern.ReplaceAllString(text, "$1$2")
+	return strings.Map(func(r rune) rune {
+		if r > 0xF000 && r < 0xF080 {
+			return r - 0xF000
+		}
+		return r
+	}, text)
+}
+
+// plainJokeText renders a joke as plain text.
+func plainJokeText(joke Joke) string {
+	if joke.Setup != "" {
+		return plainText(joke.Setup, joke.Format) + "\n\n" + plainText(joke.Punchline, joke.Format)
+	}
+	return plainText(joke.Text, joke.Format)
+}
+
+// plainResponseText renders the joke of response, the JSON of a joke as
+// served, as plain text.
+func plainResponseText(response gin.H) string {
+	text, _ := response["joke"].(string)
+	setup, _ := response["setup"].(string)
+	punchline, _ := response["punchline"].(string)
+	format, _ := response["format"].(string)
+	return plainJokeText(Joke{Text: text, Setup: setup, Punchline: punchline, Format: format})
+}
+
+// writeJoke writes response, the JSON of a joke as served, as JSON, or as
+// plain text to clients preferring text/plain.
+func writeJoke(c *gin.Context, response gin.H) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain) == gin.MIMEPlain {
+		c.String(http.StatusOK, "%s\n", plainResponseText(response))
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Every joke served to a known user, by the single and the batch endpoint,
+// is added to the user's history, per tenant. The history keeps the last
+// HISTORY_MAX_ENTRIES servings for GET /api/v1/history, and the set of
+// jokes the user has seen in the current round.
+//
+// With unseen=true, GET /api/v1/joke only picks jokes outside that set, so
+// a user sees every servable joke once before any repeats. Once none is
+// left, a new round starts: the set is cleared and the pick is made from
+// the whole catalogue again. Jokes added to the catalogue are unseen.
+//
+// The history lives in Redis at REDIS_ADDR, shared by every replica, and
+// expires HISTORY_TTL after the user's last serving; without Redis each
+// replica keeps its own, for up to maxHistoryUsers users.
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+
+	// maxHistoryUsers bounds the users kept in memory without Redis
+	maxHistoryUsers = 10000
+)
+
+// HistoryEntry is a joke served to a user.
+type HistoryEntry struct {
+	JokeID   string    `json:"joke_id"`
+	ServedAt time.Time `json:"served_at"`
+}
+
+// historyStore keeps each user's served jokes. Users are keyed by tenant
+// and user ID.
+type historyStore interface {
+	// Seen returns the jokes the user has seen in the current round
+	Seen(ctx context.Context, user string) (map[string]bool, error)
+	// Record adds servings to the user's history and current round; with
+	// newRound the round is cleared first
+	Record(ctx context.Context, user string, entries []HistoryEntry, newRound bool) error
+	// List returns up to limit of the user's servings, newest first
+	List(ctx context.Context, user string, limit int) ([]HistoryEntry, error)
+}
+
+var (
+	historyMaxEntries = 500
+	historyTTL        = 90 * 24 * time.Hour
+
+	history historyStore
+
+	historyRounds metric.Int64Counter
+)
+
+func initHistory() {
+	if v, err := strconv.Atoi(os.Getenv("HISTORY_MAX_ENTRIES")); err == nil && v > 0 {
+		historyMaxEntries = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("HISTORY_TTL")); err == nil && v > 0 {
+		historyTTL = v
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		history = &redisHistoryStore{client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})}
+		logger.Info("Joke history stored in Redis", zap.String("addr", addr))
+	} else {
+		history = &memoryHistoryStore{users: map[string]*userHistory{}}
+		logger.Warn("REDIS_ADDR not set, joke history is kept in memory per replica")
+	}
+
+	var err error
+	historyRounds, err = meter.Int64Counter(
+		"jokes.history.rounds",
+		metric.WithDescription("Number of times a user saw every servable joke and a new round started"),
+		metric.WithUnit("{round}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create history rounds counter", zap.Error(err))
+	}
+}
+
+// historyUser keys a user's history.
+func historyUser(ctx context.Context, userID string) string {
+	return telemetry.TenantFromContext(ctx) + ":" + userID
+}
+
+// recordServed adds jokes served to userID to their history, unless the
+// request is mirrored. Failures are logged: the jokes were served either
+// way.
+func recordServed(ctx context.Context, userID string, indices []int, newRound bool) {
+	if userID == "" || len(indices) == 0 || isMirrored(ctx) {
+		return
+	}
+	now := time.Now()
+	entries := make([]HistoryEntry, len(indices))
+	for i, index := range indices {
+		entries[i] = HistoryEntry{JokeID: jokeAt(index).ID, ServedAt: now}
+	}
+	if err := history.Record(ctx, historyUser(ctx, userID), entries, newRound); err != nil {
+		loggerFor(ctx).Warn("Failed to record joke history", zap.Error(err))
+	}
+}
+
+// unseenJokes narrows servable, as servableJokes returns it, to the jokes
+// the user hasn't seen this round, and counts them. newRound is set when
+// they have seen every servable joke, and servable is returned unchanged.
+func unseenJokes(ctx context.Context, userID string, servable []bool) (unseen []bool, remaining int, newRound bool, err error) {
+	seen, err := history.Seen(ctx, historyUser(ctx, userID))
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	jokesMutex.RLock()
+	total := 0
+	unseen = make([]bool, len(jokes))
+	for i, joke := range jokes {
+		if servable != nil && !servable[i] {
+			continue
+		}
+		total++
+		if !seen[joke.ID] {
+			unseen[i] = true
+			remaining++
+		}
+	}
+	jokesMutex.RUnlock()
+
+	if remaining == 0 {
+		return servable, total, true, nil
+	}
+	return unseen, remaining, false, nil
+}
+
+// historyHandler serves GET /api/v1/history?user_id=...&limit=50: the
+// jokes served to the user, newest first.
+func historyHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := tracer.Start(ctx, "getHistory")
+	defer span.End()
+
+	userID := requestUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxHistoryLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := history.List(ctx, historyUser(ctx, userID), limit)
+	if err != nil {
+		loggerFor(ctx).Error("Failed to read joke history", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Joke history is unavailable"})
+		return
+	}
+
+	listed := make([]gin.H, 0, len(entries))
+	for _, entry := range entries {
+		item := gin.H{"joke_id": entry.JokeID, "served_at": entry.ServedAt.Format(time.RFC3339)}
+		// Jokes dropped from the catalogue since are listed by ID only
+		if index, ok := jokeIndex(entry.JokeID); ok {
+			joke := jokeAt(index)
+			item["joke"] = joke.Text
+			item["category"] = joke.Category
+		}
+		listed = append(listed, item)
+	}
+
+	span.SetAttributes(attribute.Int("history.count", len(listed)))
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": userID,
+		"history": listed,
+		"count":   len(listed),
+	})
+}
+
+// redisHistoryStore keeps histories in Redis: a list of JSON entries,
+// newest first, and a set of the joke IDs seen this round.
+type redisHistoryStore struct {
+	client *redis.Client
+}
+
+func historyKeys(user string) (string, string) {
+	return "history:" + user + ":served", "history:" + user + ":seen"
+}
+
+func (s *redisHistoryStore) Seen(ctx context.Context, user string) (map[string]bool, error) {
+	ctx, span := tracer.Start(ctx, "history.seen")
+	defer span.End()
+
+	_, seenKey := historyKeys(user)
+	ids, err := s.client.SMembers(ctx, seenKey).Result()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen, nil
+}
+
+func (s *redisHistoryStore) Record(ctx context.Context, user string, entries []HistoryEntry, newRound bool) error {
+	ctx, span := tracer.Start(ctx, "history.record")
+	defer span.End()
+
+	servedKey, seenKey := historyKeys(user)
+	values := make([]interface{}, len(entries))
+	ids := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		values[i] = line
+		ids[i] = entry.JokeID
+	}
+
+	pipe := s.client.TxPipeline()
+	if newRound {
+		pipe.Del(ctx, seenKey)
+	}
+	pipe.LPush(ctx, servedKey, values...)
+	pipe.LTrim(ctx, servedKey, 0, int64(historyMaxEntries-1))
+	pipe.Expire(ctx, servedKey, historyTTL)
+	pipe.SAdd(ctx, seenKey, ids...)
+	pipe.Expire(ctx, seenKey, historyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *redisHistoryStore) List(ctx context.Context, user string, limit int) ([]HistoryEntry, error) {
+	ctx, span := tracer.Start(ctx, "history.list")
+	defer span.End()
+
+	servedKey, _ := historyKeys(user)
+	lines, err := s.client.LRange(ctx, servedKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(lines))
+	for _, line := range lines {
+		var entry HistoryEntry
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// memoryHistoryStore is the single-replica fallback used without Redis.
+type memoryHistoryStore struct {
+	mu    sync.Mutex
+	users map[string]*userHistory
+}
+
+// userHistory is a user's servings, oldest first, and the jokes seen this
+// round.
+type userHistory struct {
+	served   []HistoryEntry
+	seen     map[string]bool
+	lastSeen time.Time
+}
+
+func (s *memoryHistoryStore) Seen(_ context.Context, user string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	if h, ok := s.users[user]; ok && time.Since(h.lastSeen) < historyTTL {
+		for id := range h.seen {
+			seen[id] = true
+		}
+	}
+	return seen, nil
+}
+
+func (s *memoryHistoryStore) Record(_ context.Context, user string, entries []HistoryEntry, newRound bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.users[user]
+	if !ok || time.Since(h.lastSeen) >= historyTTL {
+		if !ok && len(s.users) >= maxHistoryUsers {
+			// Evict an arbitrary user to keep memory bounded
+			for id := range s.users {
+				delete(s.users, id)
+				break
+			}
+		}
+		h = &userHistory{seen: map[string]bool{}}
+		s.users[user] = h
+	}
+	if newRound {
+		h.seen = map[string]bool{}
+	}
+	for _, entry := range entries {
+		h.served = append(h.served, entry)
+		h.seen[entry.JokeID] = true
+	}
+	if len(h.served) > historyMaxEntries {
+		h.served = h.served[len(h.served)-historyMaxEntries:]
+	}
+	h.lastSeen = time.Now()
+	return nil
+}
+
+func (s *memoryHistoryStore) List(_ context.Context, user string, limit int) ([]HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []HistoryEntry{}
+	h, ok := s.users[user]
+	if !ok || time.Since(h.lastSeen) >= historyTTL {
+		return entries, nil
+	}
+	for i := len(h.served) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, h.served[i])
+	}
+	return entries, nil
+}
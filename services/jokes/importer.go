@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxImportBytes caps an uploaded or fetched import file
+	maxImportBytes = 5 << 20
+	// maxJokeLength is the longest joke accepted, in characters
+	maxJokeLength = 500
+	// maxImportErrors bounds the per-row errors listed in a report
+	maxImportErrors = 50
+)
+
+// ImportURLRequest imports jokes from a file fetched over HTTP(S).
+type ImportURLRequest struct {
+	URL string `json:"url" binding:"required,url"`
+	// Format is "json" or "csv"; detected from the response when empty
+	Format string `json:"format" binding:"omitempty,oneof=json csv"`
+	DryRun bool   `json:"dry_run"`
+	// Force adds near duplicates (see duplicates.go)
+	Force bool `json:"force"`
+}
+
+// ImportReport summarizes an import.
+type ImportReport struct {
+	Source  string        `json:"source"`
+	Format  string        `json:"format"`
+	DryRun  bool          `json:"dry_run"`
+	Total   int           `json:"total"`
+	Added   int           `json:"added"`
+	Skipped int           `json:"skipped"`
+	Errored int           `json:"errored"`
+	Errors  []ImportError `json:"errors,omitempty"`
+	// Duplicates counts rows rejected as near duplicates; NearDuplicates
+	// lists the near duplicates found, whatever was done with them
+	Duplicates     int               `json:"duplicates"`
+	NearDuplicates []ImportDuplicate `json:"near_duplicates,omitempty"`
+}
+
+// ImportError describes a rejected row; Row is 1-based.
+type ImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportDuplicate is a row that nearly duplicates a known joke or an
+// earlier row. Action is "rejected", or "flagged" or "forced" for rows
+// added anyway.
+type ImportDuplicate struct {
+	Row int `json:"row"`
+	DuplicateMatch
+	Action string `json:"action"`
+}
+
+// importRow is a candidate joke and where it came from; err is set when
+// the row could not be decoded.
+type importRow struct {
+	row int
+	importFields
+	err string
+}
+
+// importFields are the columns of an import row; a joke, or a setup and a
+// punchline, is required (see formatting.go).
+type importFields struct {
+	Joke      string `json:"joke"`
+	Setup     string `json:"setup"`
+	Punchline string `json:"punchline"`
+	Format    string `json:"format"`
+	ID        string `json:"id"`
+	Category  string `json:"category"`
+	Author    string `json:"author"`
+	Language  string `json:"language"`
+}
+
+// jokeText is the text of the joke of f: the joke, or the setup and the
+// punchline on lines of their own, trimmed and with Unix line breaks.
+func (f importFields) jokeText() string {
+	if f.Setup == "" && f.Punchline == "" {
+		return trimJokeText(f.Joke)
+	}
+	return trimJokeText(f.Setup) + "\n" + trimJokeText(f.Punchline)
+}
+
+// trimJokeText trims text and gives it Unix line breaks.
+func trimJokeText(text string) string {
+	return strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+}
+
+// normalizeJoke is the dedupe key: case and whitespace are ignored.
+func normalizeJoke(joke string) string {
+	return strings.Join(strings.Fields(strings.ToLower(joke)), " ")
+}
+
+// parseImport decodes a JSON or CSV import. JSON is an array of strings or
+// of objects with a "joke" field, or "setup" and "punchline" fields, and
+// optional "format", "id", "category", "author" and "language" fields. CSV
+// uses the columns of those names if the header has a "joke" or "setup"
+// column, and takes the joke from the first column otherwise.
+func parseImport(data []byte, format string) ([]importRow, error) {
+	switch format {
+	case "json":
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		rows := make([]importRow, 0, len(items))
+		for i, item := range items {
+			var fields importFields
+			if err := json.Unmarshal(item, &fields.Joke); err != nil {
+				if err := json.Unmarshal(item, &fields); err != nil {
+					rows = append(rows, importRow{row: i + 1, err: "not a string or an object with a joke field"})
+					continue
+				}
+			}
+			rows = append(rows, importRow{row: i + 1, importFields: fields})
+		}
+		return rows, nil
+
+	case "csv":
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		columns := map[string]int{"joke": 0}
+		start := 0
+		if len(records) > 0 {
+			header := map[string]int{}
+			for i, name := range records[0] {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if _, dup := header[name]; !dup {
+					header[name] = i
+				}
+			}
+			_, hasJoke := header["joke"]
+			_, hasSetup := header["setup"]
+			if hasJoke || hasSetup {
+				columns, start = header, 1
+			}
+		}
+		rows := make([]importRow, 0, len(records))
+		for i := start; i < len(records); i++ {
+			record := records[i]
+			field := func(name string) string {
+				if column, ok := columns[name]; ok && column < len(record) {
+					return record[column]
+				}
+				return ""
+			}
+			rows = append(rows, importRow{row: i + 1, importFields: importFields{
+				Joke:      field("joke"),
+				Setup:     field("setup"),
+				Punchline: field("punchline"),
+				Format:    field("format"),
+				ID:        field("id"),
+				Category:  field("category"),
+				Author:    field("author"),
+				Language:  field("language"),
+			}})
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// detectFormat guesses the format from a file name or content type, then
+// from the content itself.
+func detectFormat(name, contentType string, data []byte) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".csv":
+		return "csv"
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "application/json":
+			return "json"
+		case "text/csv":
+			return "csv"
+		}
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return "json"
+	}
+	return "csv"
+}
+
+// validateRow returns the trimmed joke of a row, or why it is rejected.
+// The ID is only set if the row has one; categories, languages and formats
+// are lowercased.
+func validateRow(r importRow) (joke Joke, msg string) {
+	format := strings.ToLower(strings.TrimSpace(r.Format))
+	joke = Joke{
+		ID:        strings.TrimSpace(r.ID),
+		Text:      r.jokeText(),
+		Setup:     trimJokeText(r.Setup),
+		Punchline: trimJokeText(r.Punchline),
+		Category:  strings.ToLower(strings.TrimSpace(r.Category)),
+		Author:    strings.TrimSpace(r.Author),
+		Language:  strings.ToLower(strings.TrimSpace(r.Language)),
+	}
+	if format == jokeFormatMarkdown {
+		joke.Format = jokeFormatMarkdown
+	}
+	switch {
+	case r.err != "":
+		return Joke{}, r.err
+	case joke.Setup != "" || joke.Punchline != "":
+		if strings.TrimSpace(r.Joke) != "" {
+			return Joke{}, "give either joke or setup and punchline"
+		}
+		if joke.Setup == "" || joke.Punchline == "" {
+			return Joke{}, "setup and punchline go together"
+		}
+	}
+	switch {
+	case joke.Text == "":
+		return Joke{}, "joke is empty"
+	case !utf8.ValidString(joke.Text) || !utf8.ValidString(joke.Author) || !utf8.ValidString(joke.Category):
+		return Joke{}, "joke is not valid UTF-8"
+	case utf8.RuneCountInString(joke.Text) > maxJokeLength:
+		return Joke{}, "joke is longer than " + strconv.Itoa(maxJokeLength) + " characters"
+	case utf8.RuneCountInString(joke.Category) > maxCategoryLength:
+		return Joke{}, "category is longer than " + strconv.Itoa(maxCategoryLength) + " characters"
+	case utf8.RuneCountInString(joke.Author) > maxAuthorLength:
+		return Joke{}, "author is longer than " + strconv.Itoa(maxAuthorLength) + " characters"
+	case joke.Language != "" && !languagePattern.MatchString(joke.Language):
+		return Joke{}, "language must be a language tag such as en or pt-br"
+	}
+	if msg := validateFormatting(joke.Text, format); msg != "" {
+		return Joke{}, msg
+	}
+	if joke.ID != "" {
+		if msg := validateJokeID(joke.ID); msg != "" {
+			return Joke{}, msg
+		}
+	}
+	return joke, ""
+}
+
+// importJokes validates and dedupes rows against the existing jokes and
+// each other, then adds the survivors unless dryRun is set. Near
+// duplicates are added only with force or when they are flagged.
+func importJokes(ctx context.Context, rows []importRow, dryRun, force bool) ImportReport {
+	ctx, span := tracer.Start(ctx, "importJokes")
+	defer span.End()
+
+	report := ImportReport{DryRun: dryRun, Total: len(rows)}
+	addError := func(row int, msg string) {
+		report.Errored++
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, ImportError{Row: row, Error: msg})
+		}
+	}
+
+	jokesMutex.Lock()
+	defer jokesMutex.Unlock()
+
+	seen := make(map[string]bool, len(jokes)+len(rows))
+	for _, joke := range jokes {
+		seen[normalizeJoke(joke.Text)] = true
+	}
+	usedIDs := map[string]bool{}
+	duplicates := newDuplicateIndex(jokes)
+	flagged := map[string]DuplicateMatch{}
+
+	var added []Joke
+	for _, r := range rows {
+		joke, msg := validateRow(r)
+		if msg != "" {
+			addError(r.row, msg)
+			continue
+		}
+
+		key := normalizeJoke(joke.Text)
+		if seen[key] {
+			report.Skipped++
+			continue
+		}
+		if joke.ID != "" {
+			if _, taken := jokeIndexByID[joke.ID]; taken || usedIDs[joke.ID] {
+				addError(r.row, "id "+joke.ID+" is already used by another joke")
+				continue
+			}
+		}
+
+		id := joke.ID
+		if id == "" {
+			id = derivedJokeID(joke.Text)
+		}
+		if match, ok := duplicates.match(joke.Text); ok {
+			duplicate := ImportDuplicate{Row: r.row, DuplicateMatch: match, Action: duplicateAction}
+			if force {
+				duplicate.Action = duplicateForced
+			}
+			if len(report.NearDuplicates) < maxImportErrors {
+				report.NearDuplicates = append(report.NearDuplicates, duplicate)
+			}
+			nearDuplicates.Add(ctx, 1, metric.WithAttributes(attribute.String("action", duplicate.Action)))
+			switch duplicate.Action {
+			case duplicateRejected:
+				report.Duplicates++
+				continue
+			case duplicateFlagged:
+				flagged[id] = match
+			}
+		}
+
+		if joke.ID != "" {
+			usedIDs[joke.ID] = true
+		}
+		seen[key] = true
+		duplicates.add(id, joke.Text)
+		added = append(added, joke)
+	}
+	report.Added = len(added)
+
+	if !dryRun && len(added) > 0 {
+		appendJokes(added)
+		selector.Add(len(added))
+		for id, match := range flagged {
+			duplicateFlags[id] = match
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Bool("import.dry_run", dryRun),
+		attribute.Int("import.total", report.Total),
+		attribute.Int("import.added", report.Added),
+		attribute.Int("import.skipped", report.Skipped),
+		attribute.Int("import.errored", report.Errored),
+		attribute.Int("import.duplicates", report.Duplicates),
+	)
+
+	loggerFor(ctx).Info("Jokes imported",
+		zap.Bool("dry_run", dryRun),
+		zap.Int("total", report.Total),
+		zap.Int("added", report.Added),
+		zap.Int("skipped", report.Skipped),
+		zap.Int("errored", report.Errored),
+		zap.Int("duplicates", report.Duplicates),
+		zap.Int("jokes_available", len(jokes)),
+	)
+
+	return report
+}
+
+// fetchImport downloads an import file, returning its content type. token,
+// when set, is sent as a bearer token.
+func fetchImport(ctx context.Context, url, token string) ([]byte, string, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, "", errors.New("url must be http or https")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetch returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxImportBytes {
+		return nil, "", fmt.Errorf("file exceeds %d bytes", maxImportBytes)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// importHandler serves POST /internal/jokes/import. It accepts either a
+// multipart upload in the "file" field (with optional "format", "dry_run"
+// and "force" form values) or a JSON ImportURLRequest.
+func importHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var (
+		data        []byte
+		source      string
+		name        string
+		contentType string
+		format      string
+		dryRun      bool
+		force       bool
+	)
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		if fileHeader.Size > maxImportBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds %d bytes", maxImportBytes)})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		source, name = fileHeader.Filename, fileHeader.Filename
+		contentType = fileHeader.Header.Get("Content-Type")
+		format = c.PostForm("format")
+		dryRun, _ = strconv.ParseBool(c.PostForm("dry_run"))
+		force, _ = strconv.ParseBool(c.PostForm("force"))
+	} else {
+		var req ImportURLRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+
+		var err error
+		data, contentType, err = fetchImport(ctx, req.URL, "")
+		if err != nil {
+			loggerFor(ctx).Warn("Failed to fetch import", zap.String("url", req.URL), zap.Error(err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch import: " + err.Error()})
+			return
+		}
+
+		source, name = req.URL, req.URL
+		format = req.Format
+		dryRun = req.DryRun
+		force = req.Force
+	}
+
+	if v, err := strconv.ParseBool(c.Query("dry_run")); err == nil {
+		dryRun = v
+	}
+	if v, err := strconv.ParseBool(c.Query("force")); err == nil {
+		force = v
+	}
+	if format == "" {
+		format = detectFormat(name, contentType, data)
+	}
+
+	rows, err := parseImport(data, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := importJokes(ctx, rows, dryRun, force)
+	report.Source = source
+	report.Format = format
+	if !dryRun && report.Added > 0 {
+		invalidateJokes(c, "import")
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Internal requests, both those sent to other services and those served
+// on /internal, are signed with INTERNAL_AUTH_SECRET (see
+// pkg/middleware). With REDIS_ADDR set, the nonces of verified requests
+// are kept in Redis, so a request can't be replayed to another replica.
+
+// Imports can carry hundreds of jokes; cap what we read before verifying
+const internalAuthMaxBody = 8 << 20
+
+var (
+	internalAuth         middleware.InternalAuth
+	internalAuthFailures metric.Int64Counter
+)
+
+// initInternalAuth shares the replay guard through the history Redis, so
+// it must run after initHistory.
+func initInternalAuth() {
+	secret := []byte(os.Getenv("INTERNAL_AUTH_SECRET"))
+	if len(secret) == 0 {
+		logger.Error("INTERNAL_AUTH_SECRET not set, internal requests will be sent unsigned and /internal routes will reject every request")
+	}
+
+	var err error
+	internalAuthFailures, err = meter.Int64Counter(
+		"jokes.internal_auth.failures",
+		metric.WithDescription("Number of rejected internal requests"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create internal auth counter", zap.Error(err))
+	}
+
+	internalAuth = middleware.InternalAuth{
+		Service:  "jokes-service",
+		Secret:   secret,
+		MaxBody:  internalAuthMaxBody,
+		OnReject: rejectInternalRequest,
+	}
+	if store, ok := history.(*redisHistoryStore); ok {
+		internalAuth.Replays = middleware.RedisReplayGuard{Client: store.client, Prefix: "internal-nonce:"}
+	}
+}
+
+// signRequest adds the internal auth headers to req. body must be the
+// exact bytes sent as the request body.
+func signRequest(req *http.Request, body []byte) {
+	internalAuth.Sign(req, body)
+}
+
+func rejectInternalRequest(c *gin.Context, reason string) {
+	ctx := c.Request.Context()
+	internalAuthFailures.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+	loggerFor(ctx).Warn("Internal request rejected",
+		zap.String("reason", reason),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("service", c.GetHeader(middleware.InternalServiceHeader)),
+		zap.String("client_ip", c.ClientIP()),
+	)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Writes that change what the /api/v1/jokes* routes serve (adding,
+// retiring, rescheduling or moving a joke between states, reactions,
+// imports and catalogue refreshes) emit an invalidation naming the paths
+// they made stale, so the gateway's response cache (see
+// services/gateway/cache.go) purges them instead of waiting for its TTL.
+// The response to the write carries the paths in the X-Cache-Invalidate
+// header, which the gateway reads and doesn't pass on to clients, and with
+// REDIS_ADDR set each invalidation is also published as JSON on
+// INVALIDATION_CHANNEL (default "jokes:invalidations"), which reaches every
+// gateway replica and covers the scheduled catalogue refreshes no request
+// sees.
+
+// invalidationHeader lists the stale paths, comma separated. A path ending
+// in "/*" stands for every path under it; query strings are not included,
+// so every variant of a path is stale.
+const invalidationHeader = "X-Cache-Invalidate"
+
+// Invalidation is a write that made cached joke responses stale.
+type Invalidation struct {
+	Reason  string    `json:"reason"`
+	JokeIDs []string  `json:"joke_ids,omitempty"`
+	Paths   []string  `json:"paths"`
+	At      time.Time `json:"at"`
+}
+
+var (
+	invalidationClient  *redis.Client
+	invalidationChannel = "jokes:invalidations"
+)
+
+// initInvalidation publishes through the history Redis, so it must run
+// after initHistory.
+func initInvalidation() {
+	if v := os.Getenv("INVALIDATION_CHANNEL"); v != "" {
+		invalidationChannel = v
+	}
+	if store, ok := history.(*redisHistoryStore); ok {
+		invalidationClient = store.client
+		logger.Info("Cache invalidations published to Redis", zap.String("channel", invalidationChannel))
+	}
+}
+
+// invalidationPaths returns the paths stale after a write to the jokes
+// with ids, or to the whole catalogue when there are none.
+func invalidationPaths(ids ...string) []string {
+	if len(ids) == 0 {
+		return []string{"/api/v1/jokes", "/api/v1/jokes/*"}
+	}
+	paths := []string{"/api/v1/jokes", "/api/v1/jokes/trending"}
+	for _, id := range ids {
+		paths = append(paths, "/api/v1/jokes/"+id)
+	}
+	return paths
+}
+
+// invalidateJokes lists the paths made stale by a write to the jokes with
+// ids (or to the whole catalogue, with none) on its response, and
+// publishes the invalidation.
+func invalidateJokes(c *gin.Context, reason string, ids ...string) {
+	paths := invalidationPaths(ids...)
+	c.Header(invalidationHeader, strings.Join(paths, ", "))
+	publishInvalidation(c.Request.Context(), Invalidation{Reason: reason, JokeIDs: ids, Paths: paths, At: time.Now()})
+}
+
+// publishInvalidation sends inv on the invalidation channel, if there is
+// one. Publishing doesn't hold up the write; a failure only means caches
+// expire the paths by TTL.
+func publishInvalidation(ctx context.Context, inv Invalidation) {
+	if invalidationClient == nil {
+		return
+	}
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		if err := invalidationClient.Publish(ctx, invalidationChannel, payload).Err(); err != nil {
+			loggerFor(ctx).Warn("Failed to publish cache invalidation",
+				zap.String("reason", inv.Reason),
+				zap.Error(err),
+			)
+		}
+	}()
+}
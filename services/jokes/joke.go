@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Jokes are identified by a stable ID rather than their position, so the
+// same joke has the same ID on every replica and across restarts, and
+// favorites and reactions keep pointing at it. Unless an import or the
+// catalogue supplies one, the ID is derived from the normalized text.
+
+// Joke is a joke and its metadata. Jokes given as a setup and a punchline
+// keep them apart, and have them on lines of their own as the text; Format
+// is empty for plain jokes (see formatting.go).
+type Joke struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"joke"`
+	Setup     string    `json:"setup,omitempty"`
+	Punchline string    `json:"punchline,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Language  string    `json:"language"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	// derivedIDPrefix starts every derived ID; explicit IDs can't use it
+	derivedIDPrefix = "j_"
+	// defaultJokeLanguage applies to jokes imported without a language
+	defaultJokeLanguage = "en"
+
+	maxCategoryLength = 50
+	maxAuthorLength   = 100
+
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+var (
+	jokeIDPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// derivedJokeID is the ID of a joke imported without one.
+func derivedJokeID(text string) string {
+	sum := sha256.Sum256([]byte(normalizeJoke(text)))
+	return derivedIDPrefix + hex.EncodeToString(sum[:8])
+}
+
+// validateJokeID reports why an explicit joke ID is rejected, if it is.
+// All-digit IDs are reserved for the old index IDs.
+func validateJokeID(id string) string {
+	switch {
+	case !jokeIDPattern.MatchString(id):
+		return "id must be 1-64 letters, digits, '-' or '_'"
+	case strings.HasPrefix(id, derivedIDPrefix):
+		return "id must not start with " + derivedIDPrefix
+	}
+	if _, err := strconv.Atoi(id); err == nil {
+		return "id must not be a number"
+	}
+	return ""
+}
+
+// jokeID is the public identifier of the joke at index.
+func jokeID(index int) string {
+	return jokeAt(index).ID
+}
+
+// jokeIndex resolves a public joke ID, reporting false if it is unknown.
+// Numeric IDs are read as the index IDs clients were given before jokes
+// had stable IDs.
+func jokeIndex(id string) (int, bool) {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	if index, ok := jokeIndexByID[id]; ok {
+		return index, true
+	}
+	index, err := strconv.Atoi(id)
+	if err != nil || index < 0 || index >= len(jokes) {
+		return 0, false
+	}
+	return index, true
+}
+
+// jokeResponse is the JSON for the joke at index.
+func jokeResponse(index int) gin.H {
+	joke := jokeAt(index)
+	response := gin.H{
+		"id":         joke.ID,
+		"joke":       joke.Text,
+		"format":     jokeFormat(joke.Format),
+		"category":   joke.Category,
+		"author":     joke.Author,
+		"language":   joke.Language,
+		"created_at": joke.CreatedAt.Format(time.RFC3339),
+		"reactions":  reactionCounts(index),
+		"safe":       isSafe(index),
+	}
+	if joke.Setup != "" {
+		response["setup"] = joke.Setup
+		response["punchline"] = joke.Punchline
+	}
+	return response
+}
+
+// jokeHandler serves GET /api/v1/jokes/:id, as JSON or plain text. Retired
+// jokes are still returned, flagged, so favorites of them can be displayed;
+// drafts are not found until they are published.
+func jokeHandler(c *gin.Context) {
+	index, ok := jokeIndex(c.Param("id"))
+	if !ok || isDraft(jokeID(index), time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+		return
+	}
+
+	jokesMutex.RLock()
+	retired := retiredJokes[index]
+	jokesMutex.RUnlock()
+
+	response := jokeResponse(index)
+	response["retired"] = retired
+	response["service"] = "jokes-service"
+	response["timestamp"] = time.Now().Format(time.RFC3339)
+	writeJoke(c, response)
+}
+
+// authorJokes returns the indices of the jokes in the catalogue by author,
+// or all of them when author is empty, in catalogue order. Authors match
+// regardless of case; drafts are left out, and in safe mode jokes failing
+// the filter.
+func authorJokes(author string, safeMode bool) []int {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	drafted := draftedJokes(time.Now())
+	indices := []int{}
+	for i, joke := range jokes {
+		if retiredJokes[i] || drafted[i] || safeMode && !jokeSafety[i].Safe {
+			continue
+		}
+		if author != "" && !strings.EqualFold(joke.Author, author) {
+			continue
+		}
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// listJokesHandler serves GET /api/v1/jokes?author=, the jokes of an
+// author, or of the whole catalogue without one, paged with limit
+// (default 20, at most 100) and offset. How they perform is in the
+// analytics service's GET /api/v1/stats/authors.
+func listJokesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	author := strings.TrimSpace(c.Query("author"))
+	if utf8.RuneCountInString(author) > maxAuthorLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "author is longer than " + strconv.Itoa(maxAuthorLength) + " characters"})
+		return
+	}
+
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxListLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = parsed
+	}
+
+	safeMode := true
+	if v := c.Query("safe"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "safe must be true or false"})
+			return
+		}
+		safeMode = parsed
+	}
+
+	indices := authorJokes(author, safeMode)
+	total := len(indices)
+	page := []gin.H{}
+	if offset < total {
+		for _, index := range indices[offset:min(offset+limit, total)] {
+			page = append(page, jokeResponse(index))
+		}
+	}
+
+	loggerFor(ctx).Info("Jokes listed",
+		zap.String("author", author),
+		zap.Int("total", total),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"author":    author,
+		"jokes":     page,
+		"count":     len(page),
+		"total":     total,
+		"offset":    offset,
+		"has_more":  offset+len(page) < total,
+		"service":   "jokes-service",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// Jokes are "draft", "published" or "archived". New jokes can be added as
+// drafts (POST /internal/admin/jokes with "state": "draft") to be reviewed
+// before they go live, optionally under an embargo: a draft with a
+// publish_at time is published by itself once it passes. Drafts are left
+// out of selection and listings and can't be fetched by ID, so an embargoed
+// joke doesn't leak early; operators see them in the admin list. Archived
+// jokes are retired ones (see admin.go), and come back like them if the
+// catalogue lists them. PUT /internal/admin/jokes/:id/state moves a joke
+// between the states.
+//
+// Drafts are kept by joke ID, like schedules, so they survive catalogue
+// refreshes.
+
+const (
+	jokeDraft     = "draft"
+	jokePublished = "published"
+	jokeArchived  = "archived"
+)
+
+// JokeStateRequest moves a joke to another state. PublishAt embargoes a
+// draft until then.
+type JokeStateRequest struct {
+	State     string     `json:"state" binding:"required"`
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+var (
+	// draftJokes holds the drafts by joke ID, with the time each is
+	// published at, nil for drafts waiting for review
+	draftJokes  = map[string]*time.Time{}
+	draftsMutex sync.RWMutex
+)
+
+// validateJokeState checks a requested state and embargo.
+func validateJokeState(state string, publishAt *time.Time, now time.Time) error {
+	switch state {
+	case jokeDraft:
+		if publishAt != nil && !publishAt.After(now) {
+			return fmt.Errorf("publish_at must be in the future")
+		}
+	case jokePublished, jokeArchived:
+		if publishAt != nil {
+			return fmt.Errorf("publish_at is only allowed for drafts")
+		}
+	default:
+		return fmt.Errorf("state must be draft, published or archived")
+	}
+	return nil
+}
+
+// embargoed reports whether a draft published at publishAt is still a
+// draft at now.
+func embargoed(publishAt *time.Time, now time.Time) bool {
+	return publishAt == nil || now.Before(*publishAt)
+}
+
+// isDraft reports whether the joke is a draft at now.
+func isDraft(id string, now time.Time) bool {
+	draftsMutex.RLock()
+	defer draftsMutex.RUnlock()
+	publishAt, ok := draftJokes[id]
+	return ok && embargoed(publishAt, now)
+}
+
+// draftedJokes returns, by joke index, the jokes that are drafts at now.
+// It returns nil when there are none. Callers must hold jokesMutex.
+func draftedJokes(now time.Time) map[int]bool {
+	draftsMutex.RLock()
+	defer draftsMutex.RUnlock()
+
+	var drafted map[int]bool
+	for id, publishAt := range draftJokes {
+		if !embargoed(publishAt, now) {
+			continue
+		}
+		if index, ok := jokeIndexByID[id]; ok {
+			if drafted == nil {
+				drafted = map[int]bool{}
+			}
+			drafted[index] = true
+		}
+	}
+	return drafted
+}
+
+// jokeState returns the state of the joke at index and, for drafts, when
+// it is published. Callers must hold jokesMutex.
+func jokeState(index int, now time.Time) (string, *time.Time) {
+	if retiredJokes[index] {
+		return jokeArchived, nil
+	}
+	draftsMutex.RLock()
+	defer draftsMutex.RUnlock()
+	if publishAt, ok := draftJokes[jokes[index].ID]; ok && embargoed(publishAt, now) {
+		return jokeDraft, publishAt
+	}
+	return jokePublished, nil
+}
+
+// setJokeState moves the joke at index to state, returning the state it
+// was in.
+func setJokeState(index int, state string, publishAt *time.Time) string {
+	jokesMutex.Lock()
+	defer jokesMutex.Unlock()
+
+	previous, _ := jokeState(index, time.Now())
+	id := jokes[index].ID
+
+	draftsMutex.Lock()
+	defer draftsMutex.Unlock()
+	switch state {
+	case jokeDraft:
+		delete(retiredJokes, index)
+		draftJokes[id] = publishAt
+	case jokePublished:
+		delete(retiredJokes, index)
+		delete(draftJokes, id)
+	case jokeArchived:
+		retiredJokes[index] = true
+		delete(draftJokes, id)
+	}
+	return previous
+}
+
+// stageDraft marks a joke about to be added as a draft, so it is never
+// served before it is reviewed. It reports false, leaving the drafts
+// alone, if the ID is already a joke's.
+func stageDraft(id string, publishAt *time.Time) bool {
+	if _, exists := jokeIndex(id); exists {
+		return false
+	}
+	draftsMutex.Lock()
+	draftJokes[id] = publishAt
+	draftsMutex.Unlock()
+	return true
+}
+
+// unstageDraft drops a draft staged for a joke that wasn't added.
+func unstageDraft(id string) {
+	draftsMutex.Lock()
+	delete(draftJokes, id)
+	draftsMutex.Unlock()
+}
+
+// registerLifecycleRoutes installs the joke state routes on the internal
+// group.
+func registerLifecycleRoutes(internal *gin.RouterGroup) {
+	internal.PUT("/admin/jokes/:id/state", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		index, ok := jokeIndex(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+
+		var req JokeStateRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		if err := validateJokeState(req.State, req.PublishAt, time.Now()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		previous := setJokeState(index, req.State, req.PublishAt)
+
+		jokesMutex.RLock()
+		updated := adminJoke(index, jokes[index], time.Now())
+		jokesMutex.RUnlock()
+
+		fields := []zap.Field{
+			zap.String("joke_id", updated.ID),
+			zap.String("from", previous),
+			zap.String("to", req.State),
+		}
+		if req.PublishAt != nil {
+			fields = append(fields, zap.Time("publish_at", *req.PublishAt))
+		}
+		loggerFor(ctx).Info("Joke state changed", fields...)
+		invalidateJokes(c, "state", updated.ID)
+		c.JSON(http.StatusOK, updated)
+	})
+}
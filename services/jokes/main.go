@@ -1,22 +1,69 @@
 // Jokes Service - Returns random jokes
 // Routes:
 //   GET /healthz         -> health check
-//   GET /api/v1/joke     -> returns a random joke
+//   GET /api/v1/joke     -> returns a random joke, well-liked ones more often,
+//                           avoiding recent repeats per user or client cookie
+//                           (see selector.go); only jokes passing the content
+//                           filter unless ?safe=false (see filter.go); with
+//                           ?unseen=true only jokes the user hasn't seen until
+//                           they have seen them all (see history.go);
+//                           reproducible with ?seed= (see random.go); plain
+//                           text with Accept: text/plain (see formatting.go);
+//                           by the user's delivery preferences when identified
+//                           (see preferences.go)
+//   GET /api/v1/joke/audio -> a random joke, or ?id=, as synthesized speech (see tts.go)
+//   GET /api/v1/jokes/random?count=N -> up to N distinct random jokes (see batch.go)
+//   GET /api/v1/jokes/trending     -> fastest-rising jokes of the last hour, ranked by
+//                                     analytics (see trending.go)
+//   GET /api/v1/jokes?author=      -> jokes by an author, or all of them, paged (see joke.go)
+//   GET /api/v1/jokes/:id          -> a joke and its metadata by stable ID (see joke.go)
+//   GET /api/v1/history            -> jokes served to a user, newest first
+//   POST /api/v1/joke/:id/reaction -> record a laugh, groan or meh for a joke
+//   POST /internal/jokes/import    -> bulk import jokes from an uploaded JSON/CSV
+//                                     file or a URL (see importer.go)
+//   POST /internal/jokes/refresh   -> refresh the catalogue from CATALOGUE_URL now
+//                                     (an http(s) URL or s3://bucket/key, see objectstore.go)
+//   GET /internal/admin/filtered   -> jokes withheld from safe mode and why
+//   GET /internal/admin/jokes      -> all jokes with their state (?include_retired=true,
+//                                     ?state=draft|published|archived)
+//   POST /internal/admin/jokes     -> add one joke, unless it nearly duplicates
+//                                     another (see admin.go, duplicates.go); as a
+//                                     draft with "state": "draft"
+//   DELETE /internal/admin/jokes/:id -> retire a joke
+//   PUT /internal/admin/jokes/:id/state -> draft, publish or archive a joke, or
+//                                          embargo a draft (see lifecycle.go)
+//   GET /internal/admin/schedules  -> seasonal joke schedules and whether each is active
+//   PUT /internal/admin/jokes/:id/schedule    -> set when a joke is served (see schedule.go)
+//   DELETE /internal/admin/jokes/:id/schedule -> serve a joke all year again
+//   GET /internal/experiments      -> A/B tests of joke variants (see experiments.go)
+//   POST /internal/experiments     -> start testing variants of a joke
+//   DELETE /internal/experiments/:id         -> end an experiment
+//   GET /internal/experiments/:id/results    -> favorites and reactions per variant
+//
+// All /internal routes require an HMAC signature (see internalauth.go).
+// Failed API requests are reported to analytics (see failures.go).
+// Low-priority requests are shed while the service is saturated (see
+// shedding.go).
 
 package main
 
 import (
 	"context"
-	"math/rand"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -24,7 +71,6 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -33,30 +79,72 @@ var (
 	meter       metric.Meter
 	jokesServed metric.Int64Counter
 	jokeLatency metric.Float64Histogram
+
+	selector *JokeSelector
+
+	// analyticsOverOTLP exports tracking events as spans instead of
+	// posting them (see telemetry.AnalyticsOverOTLP)
+	analyticsOverOTLP bool
+)
+
+// clientCookie identifies anonymous clients for repeat avoidance
+const clientCookie = "joke_client"
+
+// builtinJokesAdded is the created_at of the built-in jokes
+var builtinJokesAdded = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var jokes = []Joke{
+	builtinJoke("Why do programmers hate nature? It has too many bugs."),
+	builtinJoke("I told my computer I needed a break, and it said 'No problem — I'll go to sleep.'"),
+	builtinJoke("Debugging is like being the detective in a crime movie where you are also the murderer."),
+	builtinJoke("Why do Java developers wear glasses? Because they don't C#."),
+	builtinJoke("To understand recursion, you must first understand recursion."),
+	builtinJoke("There are 10 types of people: those who understand binary and those who don't."),
+	builtinJoke("Why did the programmer quit? Because they didn't get arrays."),
+	builtinJoke("A SQL query walks into a bar, walks up to two tables and asks: 'Can I join you?'"),
+}
+
+func builtinJoke(text string) Joke {
+	return Joke{Text: text, Category: "programming", Language: defaultJokeLanguage, CreatedAt: builtinJokesAdded}
+}
+
+var (
+	// jokesMutex guards jokes, which grows when jokes are imported or the
+	// catalogue is refreshed (see catalogue.go), and jokeIndexByID
+	jokesMutex sync.RWMutex
+
+	// jokeIndexByID maps joke IDs to their index in jokes
+	jokeIndexByID = map[string]int{}
 )
 
-var jokes = []string{
-	"Why do programmers hate nature? It has too many bugs.",
-	"I told my computer I needed a break, and it said 'No problem — I'll go to sleep.'",
-	"Debugging is like being the detective in a crime movie where you are also the murderer.",
-	"Why do Java developers wear glasses? Because they don't C#.",
-	"To understand recursion, you must first understand recursion.",
-	"There are 10 types of people: those who understand binary and those who don't.",
-	"Why did the programmer quit? Because they didn't get arrays.",
-	"A SQL query walks into a bar, walks up to two tables and asks: 'Can I join you?'",
+// jokeAt returns the joke at index.
+func jokeAt(index int) Joke {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+	return jokes[index]
+}
+
+// jokeCount returns the number of jokes available.
+func jokeCount() int {
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+	return len(jokes)
 }
 
 func initLogger() {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	var err error
-	logger, err = config.Build()
+	logger, err = telemetry.NewLogger()
 	if err != nil {
 		panic(err)
 	}
 }
 
+// loggerFor returns the service logger bound to ctx (see
+// telemetry.LoggerFor).
+func loggerFor(ctx context.Context) *zap.Logger {
+	return telemetry.LoggerFor(ctx, logger)
+}
+
 func initTracer() func() {
 	ctx := context.Background()
 
@@ -65,13 +153,7 @@ func initTracer() func() {
 		signozEndpoint = "signoz-otel-collector.platform.svc.cluster.local:4317"
 	}
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(signozEndpoint),
-		otlptracegrpc.WithInsecure(),
-	)
-	if err != nil {
-		logger.Fatal("Failed to create trace exporter", zap.Error(err))
-	}
+	exporter := telemetry.NewSpanExporter(signozEndpoint)
 
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
@@ -79,6 +161,7 @@ func initTracer() func() {
 			semconv.ServiceVersion("1.0.0"),
 			attribute.String("environment", "production"),
 		),
+		resource.WithAttributes(telemetry.K8sResourceAttributes()...),
 	)
 	if err != nil {
 		logger.Fatal("Failed to create resource", zap.Error(err))
@@ -87,7 +170,8 @@ func initTracer() func() {
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(telemetry.ContextSpanProcessor{}),
+		sdktrace.WithSampler(telemetry.NewSampler(telemetry.IsAnalyticsSpan)),
 	)
 
 	otel.SetTracerProvider(tp)
@@ -98,10 +182,19 @@ func initTracer() func() {
 
 	tracer = tp.Tracer("jokes-service")
 
+	exported, lp, err := telemetry.ExportLogs(logger, "jokes-service", signozEndpoint, res)
+	if err != nil {
+		logger.Fatal("Failed to create log export core", zap.Error(err))
+	}
+	logger = exported
+
 	return func() {
 		if err := tp.Shutdown(ctx); err != nil {
 			logger.Error("Error shutting down tracer provider", zap.Error(err))
 		}
+		if err := lp.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down logger provider", zap.Error(err))
+		}
 	}
 }
 
@@ -128,71 +221,258 @@ func initMetrics() {
 	}
 }
 
-func getRandomJoke(ctx context.Context) string {
-	_, span := tracer.Start(ctx, "getRandomJoke")
+func initSelector() {
+	historySize := 3
+	if v, err := strconv.Atoi(os.Getenv("JOKE_HISTORY_SIZE")); err == nil && v >= 0 {
+		historySize = v
+	}
+	seed := time.Now().UnixNano()
+	if randomSeed != nil {
+		seed = *randomSeed
+	}
+	selector = NewJokeSelector(jokeCount(), historySize, 10000, seed)
+}
+
+// clientID identifies the caller for repeat avoidance: the user the
+// gateway authenticated, else the user_id query parameter, else a random
+// ID kept in a cookie. The header comes first, so a signed-in caller can't
+// name another user's history with ?user_id=.
+func clientID(c *gin.Context) string {
+	if id := c.GetHeader("X-User-ID"); id != "" {
+		return "user:" + id
+	}
+	if id := c.Query("user_id"); id != "" {
+		return "user:" + id
+	}
+	if id, err := c.Cookie(clientCookie); err == nil && id != "" {
+		return "client:" + id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	c.SetCookie(clientCookie, id, 30*24*3600, "/", "", false, true)
+	return "client:" + id
+}
+
+// requestUserID returns the user behind the request: the one the gateway
+// authenticated, else the user_id query parameter. It is empty for
+// anonymous clients.
+func requestUserID(c *gin.Context) string {
+	if id := c.GetHeader("X-User-ID"); id != "" {
+		return id
+	}
+	return c.Query("user_id")
+}
+
+// getRandomJoke picks one of the eligible jokes, as servableJokes returns
+// them, for the client, or from seed if it isn't nil (see random.go). ok is
+// false if none is eligible.
+func getRandomJoke(ctx context.Context, client string, seed *int64, safeMode bool, eligible []bool) (index int, joke Joke, ok bool) {
+	ctx, span := tracer.Start(ctx, "getRandomJoke")
 	defer span.End()
 
 	start := time.Now()
 
 	// Simulate some processing
-	time.Sleep(time.Millisecond * time.Duration(rand.Intn(50)))
+	time.Sleep(time.Millisecond * time.Duration(random.Intn(50)))
 
-	joke := jokes[rand.Intn(len(jokes))]
+	picks := selectJokes(client, seed, eligible, 1)
+	span.SetAttributes(attribute.Bool("joke.safe_mode", safeMode))
+	if seed != nil {
+		span.SetAttributes(attribute.Int64("joke.seed", *seed))
+	}
+	if len(picks) == 0 {
+		loggerFor(ctx).Warn("No joke eligible", zap.Bool("safe_mode", safeMode))
+		return 0, Joke{}, false
+	}
+	index = picks[0]
+	joke = jokeAt(index)
 
 	span.SetAttributes(
-		attribute.String("joke.content", joke),
-		attribute.Int("joke.length", len(joke)),
+		attribute.String("joke.id", joke.ID),
+		attribute.String("joke.content", joke.Text),
+		attribute.Int("joke.index", index),
+		attribute.Int("joke.length", len(joke.Text)),
 	)
 
 	duration := time.Since(start).Milliseconds()
-	jokeLatency.Record(ctx, float64(duration))
+	jokeLatency.Record(ctx, float64(duration), telemetry.ContextAttrs(ctx))
 
-	logger.Info("Joke retrieved",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
-		zap.Int("joke_length", len(joke)),
+	loggerFor(ctx).Info("Joke retrieved",
+		zap.String("joke_id", joke.ID),
+		zap.Int("joke_length", len(joke.Text)),
 		zap.Int64("duration_ms", duration),
 	)
 
-	return joke
+	return index, joke, true
 }
 
-func notifyAnalytics(ctx context.Context, joke string) {
-	_, span := tracer.Start(ctx, "notifyAnalytics")
-	defer span.End()
+// LatencySample reports how long a request took to serve, so analytics can
+// track latency percentiles per endpoint.
+type LatencySample struct {
+	Endpoint  string  `json:"endpoint,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
 
-	analyticsService := os.Getenv("ANALYTICS_SERVICE_URL")
-	if analyticsService == "" {
-		analyticsService = "analytics-service.default.svc.cluster.local"
+// latencySince measures the current request from start.
+func latencySince(c *gin.Context, start time.Time) LatencySample {
+	return LatencySample{
+		Endpoint:  c.Request.Method + " " + c.FullPath(),
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
 	}
+}
 
-	// Make async call to analytics service
-	go func() {
-		client := &http.Client{Timeout: 2 * time.Second}
-		req, _ := http.NewRequest("POST", "http://"+analyticsService+"/internal/track", nil)
-		req.Header.Set("X-Joke-Length", string(rune(len(joke))))
+// ClientAttributes identify the client behind a request, and where it is
+// when the gateway locates clients. The gateway forwards them as baggage.
+type ClientAttributes struct {
+	AppID    string `json:"app_id,omitempty"`
+	UAFamily string `json:"ua_family,omitempty"`
+	Route    string `json:"route,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+}
 
-		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+// clientAttributes reads the client attributes from ctx's baggage.
+func clientAttributes(ctx context.Context) ClientAttributes {
+	b := baggage.FromContext(ctx)
+	return ClientAttributes{
+		AppID:    b.Member(telemetry.ClientAppBaggageKey).Value(),
+		UAFamily: b.Member("client.ua_family").Value(),
+		Route:    b.Member("gateway.route").Value(),
+		Country:  b.Member("client.country").Value(),
+		Region:   b.Member("client.region").Value(),
+	}
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			logger.Warn("Failed to notify analytics", zap.Error(err))
-			return
-		}
-		defer resp.Body.Close()
-	}()
+// Tracking events are sent to analytics in its versioned event schema:
+// an envelope naming the event type and schema version, posted to
+// /internal/events.
+const analyticsSchemaVersion = 2
+
+// AnalyticsEvent is the envelope of a tracking event.
+type AnalyticsEvent struct {
+	EventType     string      `json:"event_type"`
+	SchemaVersion int         `json:"schema_version"`
+	Payload       interface{} `json:"payload"`
+}
+
+// TrackPayload is the payload of a joke_served event.
+type TrackPayload struct {
+	JokeID string `json:"joke_id"`
+	// UserID is the user the joke was served to, for the leaderboard;
+	// anonymous clients are not reported
+	UserID string `json:"user_id,omitempty"`
+	// Visitor is the gateway's hash of the client IP, for unique visitor
+	// counts
+	Visitor string `json:"visitor,omitempty"`
+	// Author of the joke, for the contributor stats
+	Author  string           `json:"author,omitempty"`
+	Latency *LatencySample   `json:"latency,omitempty"`
+	Client  ClientAttributes `json:"client"`
+}
+
+func notifyAnalytics(ctx context.Context, joke Joke, userID string, latency LatencySample) {
+	ctx, span := tracer.Start(ctx, "notifyAnalytics")
+	defer span.End()
+
+	payload := TrackPayload{
+		JokeID:  joke.ID,
+		UserID:  userID,
+		Visitor: baggage.FromContext(ctx).Member("client.visitor").Value(),
+		Author:  joke.Author,
+		Client:  clientAttributes(ctx),
+	}
+	if latency.Endpoint != "" {
+		payload.Latency = &latency
+	}
+	trackEvent(ctx, "joke_served", payload, map[string]string{
+		"X-Joke-Length": strconv.Itoa(len(joke.Text)),
+	})
+}
+
+// trackEvent sends a tracking event to analytics through the outbox, or
+// records it as a span event with ANALYTICS_TRANSPORT=otlp (see
+// pkg/telemetry). Events of mirrored requests are dropped (see mirror.go).
+func trackEvent(ctx context.Context, eventType string, payload interface{}, headers map[string]string) {
+	if isMirrored(ctx) {
+		return
+	}
+	if analyticsOverOTLP {
+		telemetry.RecordAnalyticsEvent(ctx, tracer, eventType, payload)
+		return
+	}
+	body, err := json.Marshal(AnalyticsEvent{
+		EventType:     eventType,
+		SchemaVersion: analyticsSchemaVersion,
+		Payload:       payload,
+	})
+	if err != nil {
+		loggerFor(ctx).Error("Failed to encode tracking event", zap.String("event_type", eventType), zap.Error(err))
+		return
+	}
+	postToAnalytics(ctx, "/internal/events", body, headers)
+}
+
+// postToAnalytics queues a request to an analytics internal endpoint in
+// the outbox, which delivers it asynchronously and retries on failure.
+func postToAnalytics(ctx context.Context, path string, body []byte, headers map[string]string) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	analyticsOutbox.enqueue(ctx, &OutboxMessage{
+		Path:      path,
+		Body:      body,
+		Headers:   headers,
+		Carrier:   carrier,
+		CreatedAt: time.Now(),
+	})
 }
 
 func main() {
 	initLogger()
 	defer logger.Sync()
+	telemetry.InitRuntimeConfig()
 
 	shutdown := initTracer()
 	defer shutdown()
 
 	initMetrics()
-
-	r := gin.Default()
-	r.Use(otelgin.Middleware("jokes-service"))
+	initRandom()
+	initSelector()
+	initBatch()
+	initTrending()
+	initPreferences()
+	initSchedules()
+	initContentFilter()
+	initCatalogue()
+	initDuplicates()
+	initHistory()
+	initInvalidation()
+	initExperiments()
+	initTTS()
+	initLoadShedding()
+	initInternalAuth()
+	analyticsOverOTLP = telemetry.AnalyticsOverOTLP()
+	initOutbox()
+	startOutboxDispatchers(context.Background())
+	go runModeration(context.Background())
+	go runCatalogueRefresh(context.Background())
+
+	r := gin.New()
+	// Accept HTTP/2 without TLS from the gateway (BACKEND_HTTP2)
+	r.UseH2C = true
+	r.Use(middleware.Default("jokes-service",
+		middleware.WithLogger(loggerFor),
+		middleware.WithMetricAttributes(telemetry.ContextAttrs),
+		// Reports the 500 a panic ends in too
+		middleware.WithObservers(failureReportingMiddleware()),
+	)...)
+	r.Use(telemetry.TenantMiddleware())
+	r.Use(mirroredRequestMiddleware())
+	r.Use(loadSheddingMiddleware())
 
 	r.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -204,28 +484,121 @@ func main() {
 
 	r.GET("/api/v1/joke", func(c *gin.Context) {
 		ctx := c.Request.Context()
-		span := trace.SpanFromContext(ctx)
+		start := time.Now()
 
-		logger.Info("Joke requested",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		loggerFor(ctx).Info("Joke requested",
 			zap.String("client_ip", c.ClientIP()),
 		)
 
-		joke := getRandomJoke(ctx)
+		safeMode := true
+		safeParam := c.Query("safe")
+		if safeParam != "" {
+			parsed, err := strconv.ParseBool(safeParam)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "safe must be true or false"})
+				return
+			}
+			safeMode = parsed
+		}
+
+		unseen := false
+		if v := c.Query("unseen"); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unseen must be true or false"})
+				return
+			}
+			unseen = parsed
+		}
+		userID := requestUserID(c)
+		if unseen && userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required with unseen=true"})
+			return
+		}
+
+		// Identified users get jokes by their delivery preferences (see
+		// preferences.go)
+		personalized := false
+		var prefs DeliveryPreferences
+		if userID != "" {
+			prefs = userPreferences(ctx, userID)
+			if prefs.SafeMode != nil && safeParam == "" {
+				safeMode, personalized = *prefs.SafeMode, true
+			}
+		}
+
+		// With unseen=true only jokes outside the user's history this round
+		// are eligible (see history.go)
+		eligible := servableJokes(safeMode)
+		if preferred, ok := preferredJokes(eligible, prefs); ok {
+			eligible, personalized = preferred, true
+		}
+		var remaining int
+		var newRound bool
+		if unseen {
+			var err error
+			eligible, remaining, newRound, err = unseenJokes(ctx, userID, eligible)
+			if err != nil {
+				loggerFor(ctx).Error("Failed to read joke history", zap.Error(err))
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Joke history is unavailable"})
+				return
+			}
+		}
+
+		seed, ok := requestSeed(c)
+		if !ok {
+			return
+		}
+
+		client := clientID(c)
+		index, joke, ok := getRandomJoke(ctx, client, seed, safeMode, eligible)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No jokes available"})
+			return
+		}
 
 		// Increment counter
-		jokesServed.Add(ctx, 1)
+		jokesServed.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+		recordServed(ctx, userID, []int{index}, newRound)
+		if newRound {
+			historyRounds.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+		}
 
 		// Notify analytics asynchronously
-		notifyAnalytics(ctx, joke)
+		notifyAnalytics(ctx, joke, userID, latencySince(c, start))
 
-		c.JSON(http.StatusOK, gin.H{
-			"joke":      joke,
-			"service":   "jokes-service",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		response := jokeResponse(index)
+		applyExperiment(ctx, response, client, userID)
+		if unseen {
+			response["unseen_remaining"] = remaining - 1
+			response["new_round"] = newRound
+		}
+		if personalized {
+			response["personalized"] = true
+		}
+		response["service"] = "jokes-service"
+		response["timestamp"] = time.Now().Format(time.RFC3339)
+		writeJoke(c, response)
 	})
 
+	r.GET("/api/v1/joke/audio", jokeAudioHandler)
+	r.GET("/api/v1/jokes/random", randomJokesHandler)
+	r.GET("/api/v1/history", historyHandler)
+	r.GET("/api/v1/jokes/trending", trendingHandler)
+	r.GET("/api/v1/jokes", listJokesHandler)
+	r.GET("/api/v1/jokes/:id", jokeHandler)
+	r.POST("/api/v1/joke/:id/reaction", reactionHandler)
+
+	// Service-to-service routes, authenticated with a shared HMAC secret
+	internal := r.Group("/internal", internalAuth.Middleware())
+	internal.POST("/jokes/import", importHandler)
+	internal.POST("/jokes/refresh", refreshHandler)
+	internal.GET("/admin/filtered", filteredHandler)
+	registerAdminRoutes(internal)
+	registerScheduleRoutes(internal)
+	registerLifecycleRoutes(internal)
+	registerExperimentRoutes(internal)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The gateway can mirror live traffic to a shadow deployment of this
+// service (see the gateway's mirror.go), marking the copies with
+// mirroredRequestHeader. Mirrored requests are served as usual, but aren't
+// reported to analytics or added to user histories, so the shadow doesn't
+// count every mirrored joke a second time.
+
+const mirroredRequestHeader = "X-Mirrored-Request"
+
+// mirroredKey marks the context of a mirrored request
+type mirroredKey struct{}
+
+// mirroredRequestMiddleware marks mirrored requests in their context and
+// tags their server span.
+func mirroredRequestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(mirroredRequestHeader) != "" {
+			ctx := context.WithValue(c.Request.Context(), mirroredKey{}, true)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("request.mirrored", true))
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Next()
+	}
+}
+
+// isMirrored reports whether ctx belongs to a mirrored request.
+func isMirrored(ctx context.Context) bool {
+	return ctx.Value(mirroredKey{}) != nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A CATALOGUE_URL of s3://bucket/key pulls the catalogue from an object in
+// S3 or an S3-compatible store such as MinIO, so content updates are an
+// upload away. Requests go to CATALOGUE_S3_ENDPOINT (default the AWS
+// endpoint of CATALOGUE_S3_REGION, itself defaulting to AWS_REGION or
+// us-east-1) with path-style addressing, which MinIO needs and AWS
+// accepts. They are signed with Signature Version 4 using the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and, for temporary credentials,
+// AWS_SESSION_TOKEN; without a key they are sent unsigned, for public
+// buckets.
+//
+// Refreshes send the ETag of the object last applied as If-None-Match, so
+// an unchanged catalogue costs a 304 rather than a download and a parse.
+
+// emptyPayloadHash is the SHA-256 of an empty body, as signed for GETs
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Catalogue is a catalogue object in S3 or MinIO.
+type s3Catalogue struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	key      string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Catalogue configures the catalogue at an s3://bucket/key URL from
+// the environment.
+func newS3Catalogue(raw string) (*s3Catalogue, error) {
+	location, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(location.Path, "/")
+	if location.Host == "" || key == "" {
+		return nil, errors.New("CATALOGUE_URL must be s3://bucket/key")
+	}
+
+	region := os.Getenv("CATALOGUE_S3_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	rawEndpoint := os.Getenv("CATALOGUE_S3_ENDPOINT")
+	if rawEndpoint == "" {
+		rawEndpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("CATALOGUE_S3_ENDPOINT must be an http or https URL: %q", rawEndpoint)
+	}
+
+	return &s3Catalogue{
+		endpoint:     endpoint,
+		region:       region,
+		bucket:       location.Host,
+		key:          key,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func (s *s3Catalogue) Source() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+// Fetch gets the object, unless its ETag is still since.
+func (s *s3Catalogue) Fetch(ctx context.Context, since string) (CatalogueObject, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	path := "/" + s3Escape(s.bucket) + "/" + s3Escape(s.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint.Scheme+"://"+s.endpoint.Host+path, nil)
+	if err != nil {
+		return CatalogueObject{}, err
+	}
+	if since != "" {
+		req.Header.Set("If-None-Match", since)
+	}
+	s.sign(req, path, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return CatalogueObject{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return CatalogueObject{}, errCatalogueNotModified
+	default:
+		return CatalogueObject{}, fmt.Errorf("object storage returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportBytes+1))
+	if err != nil {
+		return CatalogueObject{}, err
+	}
+	if len(data) > maxImportBytes {
+		return CatalogueObject{}, fmt.Errorf("object exceeds %d bytes", maxImportBytes)
+	}
+	return CatalogueObject{
+		Data:        data,
+		ContentType: resp.Header.Get("Content-Type"),
+		Version:     resp.Header.Get("ETag"),
+	}, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to a bodiless
+// request for the escaped path, if there are credentials.
+func (s *s3Catalogue) sign(req *http.Request, path string, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := []string{req.URL.Host, emptyPayloadHash, amzDate}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values = append(values, s.sessionToken)
+	}
+
+	var canonicalHeaders strings.Builder
+	for i, name := range headers {
+		canonicalHeaders.WriteString(name + ":" + values[i] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes an object key the way S3 signs it: everything
+// but unreserved characters and '/'.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
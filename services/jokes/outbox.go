@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// OutboxMessage is a pending request to an analytics internal endpoint.
+type OutboxMessage struct {
+	Path    string            `json:"path"`
+	Body    []byte            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Trace context of the request that produced the message
+	Carrier   map[string]string `json:"carrier,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Attempts  int               `json:"attempts"`
+}
+
+// outbox holds analytics notifications until they are delivered. Messages
+// are kept in memory up to capacity; beyond that they spill to a JSON
+// lines file, which is also reloaded on startup so spilled messages
+// survive restarts. Failed deliveries are retried with exponential
+// backoff until they are older than maxAge.
+type outbox struct {
+	mu        sync.Mutex
+	queue     []*OutboxMessage
+	capacity  int
+	spillPath string
+	spilled   int
+
+	// Consecutive failures; while paused no deliveries are attempted
+	failures    int
+	pausedUntil time.Time
+
+	maxAge      time.Duration
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	notify      chan struct{}
+}
+
+var (
+	analyticsOutbox *outbox
+
+	outboxDelivered metric.Int64Counter
+	outboxRetries   metric.Int64Counter
+	outboxDropped   metric.Int64Counter
+)
+
+func initOutbox() {
+	capacity := 10000
+	if v, err := strconv.Atoi(os.Getenv("OUTBOX_SIZE")); err == nil && v > 0 {
+		capacity = v
+	}
+	spillPath := filepath.Join(os.TempDir(), "jokes-outbox.jsonl")
+	if v, ok := os.LookupEnv("OUTBOX_SPILL_PATH"); ok {
+		spillPath = v
+	}
+	maxAge := time.Hour
+	if v, err := time.ParseDuration(os.Getenv("OUTBOX_MAX_AGE")); err == nil && v > 0 {
+		maxAge = v
+	}
+
+	analyticsOutbox = &outbox{
+		capacity:    capacity,
+		spillPath:   spillPath,
+		maxAge:      maxAge,
+		baseBackoff: 500 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		notify:      make(chan struct{}, 1),
+	}
+	analyticsOutbox.spilled = countSpilled(spillPath)
+
+	var err error
+	outboxDelivered, err = meter.Int64Counter(
+		"jokes.outbox.delivered",
+		metric.WithDescription("Number of outbox messages delivered to analytics"),
+		metric.WithUnit("{message}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create outbox delivered counter", zap.Error(err))
+	}
+
+	outboxRetries, err = meter.Int64Counter(
+		"jokes.outbox.retries",
+		metric.WithDescription("Number of failed outbox deliveries that will be retried"),
+		metric.WithUnit("{message}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create outbox retries counter", zap.Error(err))
+	}
+
+	outboxDropped, err = meter.Int64Counter(
+		"jokes.outbox.dropped",
+		metric.WithDescription("Number of outbox messages given up on"),
+		metric.WithUnit("{message}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create outbox dropped counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"jokes.outbox.depth",
+		metric.WithDescription("Number of outbox messages waiting for delivery"),
+		metric.WithUnit("{message}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			memory, spilled := analyticsOutbox.depth()
+			o.Observe(int64(memory), metric.WithAttributes(attribute.String("storage", "memory")))
+			o.Observe(int64(spilled), metric.WithAttributes(attribute.String("storage", "disk")))
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create outbox depth gauge", zap.Error(err))
+	}
+
+	logger.Info("Analytics outbox initialized",
+		zap.Int("capacity", capacity),
+		zap.String("spill_path", spillPath),
+		zap.Int("spilled", analyticsOutbox.spilled),
+		zap.Duration("max_age", maxAge),
+	)
+}
+
+// startOutboxDispatchers launches the workers that deliver outbox messages.
+func startOutboxDispatchers(ctx context.Context) {
+	workers := 4
+	if v, err := strconv.Atoi(os.Getenv("OUTBOX_WORKERS")); err == nil && v > 0 {
+		workers = v
+	}
+	for i := 0; i < workers; i++ {
+		go analyticsOutbox.dispatch(ctx)
+	}
+}
+
+// enqueue adds a message, spilling to disk when memory is full.
+func (o *outbox) enqueue(ctx context.Context, msg *OutboxMessage) {
+	o.mu.Lock()
+	switch {
+	case len(o.queue) < o.capacity && o.spilled == 0:
+		o.queue = append(o.queue, msg)
+	case o.spillPath != "":
+		// Once anything has spilled, new messages go to disk too so they
+		// are delivered after the older spilled ones
+		if err := appendSpill(o.spillPath, msg); err != nil {
+			o.mu.Unlock()
+			o.drop(ctx, "spill_failed")
+			loggerFor(ctx).Warn("Failed to spill outbox message", zap.Error(err))
+			return
+		}
+		o.spilled++
+	default:
+		o.mu.Unlock()
+		o.drop(ctx, "full")
+		return
+	}
+	o.mu.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the oldest message, refilling memory from the spill file when
+// it runs dry. It returns how long to wait when nothing can be sent now.
+func (o *outbox) next() (*OutboxMessage, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if wait := time.Until(o.pausedUntil); wait > 0 {
+		return nil, wait
+	}
+	if len(o.queue) == 0 && o.spilled > 0 {
+		o.reload()
+	}
+	if len(o.queue) == 0 {
+		return nil, time.Second
+	}
+
+	msg := o.queue[0]
+	o.queue[0] = nil
+	o.queue = o.queue[1:]
+	return msg, 0
+}
+
+// reload moves up to capacity messages from the spill file into memory.
+// Callers must hold o.mu.
+func (o *outbox) reload() {
+	data, err := os.ReadFile(o.spillPath)
+	if err != nil {
+		logger.Warn("Failed to read outbox spill file", zap.Error(err))
+		o.spilled = 0
+		return
+	}
+
+	var rest bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(o.queue) >= o.capacity {
+			rest.Write(line)
+			rest.WriteByte('\n')
+			continue
+		}
+		var msg OutboxMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+		o.queue = append(o.queue, &msg)
+	}
+
+	if err := os.WriteFile(o.spillPath, rest.Bytes(), 0o600); err != nil {
+		logger.Warn("Failed to rewrite outbox spill file", zap.Error(err))
+	}
+	o.spilled = bytes.Count(rest.Bytes(), []byte("\n"))
+}
+
+// retry puts a failed message back at the head and pauses delivery.
+func (o *outbox) retry(msg *OutboxMessage) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.queue = append([]*OutboxMessage{msg}, o.queue...)
+	o.failures++
+
+	backoff := o.baseBackoff << min(o.failures-1, 16)
+	if backoff > o.maxBackoff || backoff <= 0 {
+		backoff = o.maxBackoff
+	}
+	// Up to 20% jitter so replicas don't retry in lockstep
+	backoff += time.Duration(random.Int63n(int64(backoff)/5 + 1))
+	o.pausedUntil = time.Now().Add(backoff)
+	return backoff
+}
+
+func (o *outbox) succeeded() {
+	o.mu.Lock()
+	o.failures = 0
+	o.mu.Unlock()
+}
+
+func (o *outbox) drop(ctx context.Context, reason string) {
+	outboxDropped.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+func (o *outbox) depth() (memory, spilled int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue), o.spilled
+}
+
+func (o *outbox) dispatch(ctx context.Context) {
+	for {
+		msg, wait := o.next()
+		if msg == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.notify:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		if time.Since(msg.CreatedAt) > o.maxAge {
+			o.drop(ctx, "expired")
+			logger.Warn("Dropping expired outbox message",
+				zap.String("path", msg.Path),
+				zap.Int("attempts", msg.Attempts),
+			)
+			continue
+		}
+
+		msg.Attempts++
+		retryable, err := deliverOutboxMessage(msg)
+		switch {
+		case err == nil:
+			o.succeeded()
+			outboxDelivered.Add(ctx, 1)
+		case !retryable:
+			o.drop(ctx, "rejected")
+			logger.Warn("Analytics rejected outbox message",
+				zap.String("path", msg.Path),
+				zap.Error(err),
+			)
+		default:
+			outboxRetries.Add(ctx, 1)
+			backoff := o.retry(msg)
+			logger.Warn("Failed to notify analytics, will retry",
+				zap.String("path", msg.Path),
+				zap.Int("attempts", msg.Attempts),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// analyticsServiceAddr is the address of the analytics service.
+func analyticsServiceAddr() string {
+	if addr := os.Getenv("ANALYTICS_SERVICE_URL"); addr != "" {
+		return addr
+	}
+	return telemetry.ClusterServiceAddr("analytics-service")
+}
+
+// deliverOutboxMessage sends a message, signing it at send time so retries
+// carry a fresh timestamp. Client errors other than 408 and 429 are not
+// retryable.
+func deliverOutboxMessage(msg *OutboxMessage) (bool, error) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Carrier))
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+analyticsServiceAddr()+msg.Path, bytes.NewReader(msg.Body))
+	if err != nil {
+		return false, err
+	}
+	if msg.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range msg.Headers {
+		req.Header.Set(k, v)
+	}
+	signRequest(req, msg.Body)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, fmt.Errorf("analytics returned status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+func appendSpill(path string, msg *OutboxMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func countSpilled(path string) int {
+	if path == "" {
+		return 0
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte("\n"))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/joke is personalized for identified users with the delivery
+// preferences they set in the user service
+// (GET /api/v1/users/:id/preferences):
+//
+//   - safe_mode applies unless the request passes ?safe=
+//   - only jokes in the preferred categories and language are picked;
+//     languages match by their primary subtag, so "en" matches "en-gb".
+//     When no servable joke matches, the preferences are ignored rather
+//     than answering 404
+//
+// A personalized response has "personalized": true. Preferences are cached
+// per tenant and user for PREFERENCES_CACHE_TTL (default 1m). A failed
+// fetch is cached as no preferences, so while the user service is down
+// each user costs one timeout per TTL and gets unpersonalized jokes.
+
+// DeliveryPreferences are a user's preferences as the user service
+// returns them.
+type DeliveryPreferences struct {
+	SafeMode   *bool    `json:"safe_mode"`
+	Categories []string `json:"categories"`
+	Language   string   `json:"language"`
+}
+
+// cachedPreferences are a user's preferences as fetched at fetchedAt.
+type cachedPreferences struct {
+	prefs     DeliveryPreferences
+	fetchedAt time.Time
+}
+
+// maxCachedPreferences bounds the cache; it is emptied when full
+const maxCachedPreferences = 10000
+
+var (
+	preferencesCacheTTL = time.Minute
+
+	// preferencesCache maps tenant/user to the user's preferences
+	preferencesCache = map[string]cachedPreferences{}
+	preferencesMutex sync.Mutex
+
+	preferencesClient = &http.Client{Timeout: time.Second}
+)
+
+func initPreferences() {
+	if v, err := time.ParseDuration(os.Getenv("PREFERENCES_CACHE_TTL")); err == nil && v >= 0 {
+		preferencesCacheTTL = v
+	}
+}
+
+// userServiceAddr is the address of the user service.
+func userServiceAddr() string {
+	if addr := os.Getenv("USER_SERVICE_URL"); addr != "" {
+		return addr
+	}
+	return telemetry.ClusterServiceAddr("user-service")
+}
+
+// userPreferences returns the delivery preferences of userID, from the
+// cache while they are fresh.
+func userPreferences(ctx context.Context, userID string) DeliveryPreferences {
+	key := telemetry.TenantFromContext(ctx) + "/" + userID
+	now := time.Now()
+
+	preferencesMutex.Lock()
+	cached, ok := preferencesCache[key]
+	preferencesMutex.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < preferencesCacheTTL {
+		return cached.prefs
+	}
+
+	prefs, err := fetchPreferences(ctx, userID)
+	if err != nil {
+		loggerFor(ctx).Warn("Failed to fetch preferences, serving unpersonalized", zap.Error(err))
+	}
+
+	preferencesMutex.Lock()
+	if len(preferencesCache) >= maxCachedPreferences {
+		preferencesCache = map[string]cachedPreferences{}
+	}
+	preferencesCache[key] = cachedPreferences{prefs: prefs, fetchedAt: now}
+	preferencesMutex.Unlock()
+	return prefs
+}
+
+// fetchPreferences gets the preferences of userID from the user service,
+// as that user. The tenant travels in the propagated baggage.
+func fetchPreferences(ctx context.Context, userID string) (DeliveryPreferences, error) {
+	ctx, span := tracer.Start(ctx, "fetchPreferences")
+	defer span.End()
+
+	target := fmt.Sprintf("http://%s/api/v1/users/%s/preferences", userServiceAddr(), url.PathEscape(userID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return DeliveryPreferences{}, err
+	}
+	req.Header.Set("X-User-ID", userID)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := preferencesClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return DeliveryPreferences{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return DeliveryPreferences{}, fmt.Errorf("user service returned status %d", resp.StatusCode)
+	}
+
+	var prefs DeliveryPreferences
+	if err := json.NewDecoder(resp.Body).Decode(&prefs); err != nil {
+		return DeliveryPreferences{}, err
+	}
+	span.SetAttributes(
+		attribute.Int("preferences.categories", len(prefs.Categories)),
+		attribute.String("preferences.language", prefs.Language),
+	)
+	return prefs, nil
+}
+
+// primaryLanguage is the primary subtag of a language tag.
+func primaryLanguage(tag string) string {
+	primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+	return primary
+}
+
+// preferredJokes narrows eligible, as servableJokes returns it, to the
+// jokes in the preferred categories and language. ok is false, and
+// eligible is returned unchanged, if prefs restrict nothing or no eligible
+// joke matches them.
+func preferredJokes(eligible []bool, prefs DeliveryPreferences) (preferred []bool, ok bool) {
+	if len(prefs.Categories) == 0 && prefs.Language == "" {
+		return eligible, false
+	}
+	categories := map[string]bool{}
+	for _, category := range prefs.Categories {
+		categories[strings.ToLower(category)] = true
+	}
+	language := primaryLanguage(prefs.Language)
+
+	jokesMutex.RLock()
+	defer jokesMutex.RUnlock()
+
+	preferred = make([]bool, len(jokes))
+	for i, joke := range jokes {
+		switch {
+		case eligible != nil && !eligible[i]:
+		case len(categories) > 0 && !categories[joke.Category]:
+		case language != "" && primaryLanguage(joke.Language) != language:
+		default:
+			preferred[i] = true
+			ok = true
+		}
+	}
+	if !ok {
+		return eligible, false
+	}
+	return preferred, true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Jokes are picked at random, from a source seeded with the time unless
+// RANDOM_SEED is set: then the selector (see selector.go) and the service's
+// other randomness, such as the simulated latency and retry jitter, start
+// from that seed, so a fresh process serves the same sequence of jokes to
+// the same sequence of requests. Requests served concurrently may still
+// take their turns in any order.
+//
+// A request can also pin its own pick with ?seed=N on GET /api/v1/joke,
+// /api/v1/joke/audio and /api/v1/jokes/random: the same seed, against the
+// same catalogue and weights, always picks the same jokes, whoever asks
+// and whatever else was served. Seeded picks neither avoid nor count as
+// the client's recent jokes; the content filter and ?unseen=true still
+// narrow the candidates. Integration tests and demo recordings use it.
+
+// random is the service-wide source, safe for concurrent use
+var random = rand.New(newLockedSource(time.Now().UnixNano()))
+
+// randomSeed is RANDOM_SEED, if set
+var randomSeed *int64
+
+func initRandom() {
+	v := os.Getenv("RANDOM_SEED")
+	if v == "" {
+		return
+	}
+	seed, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logger.Fatal("RANDOM_SEED must be an integer", zap.String("value", v))
+	}
+	randomSeed = &seed
+	random = rand.New(newLockedSource(seed))
+	logger.Info("Deterministic mode, random sources seeded", zap.Int64("seed", seed))
+}
+
+// lockedSource is a rand.Source that may be used concurrently.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func newLockedSource(seed int64) *lockedSource {
+	return &lockedSource{src: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// requestSeed returns the request's ?seed=, nil if it has none. On an
+// invalid seed it responds with 400 and ok is false.
+func requestSeed(c *gin.Context) (seed *int64, ok bool) {
+	v := c.Query("seed")
+	if v == "" {
+		return nil, true
+	}
+	parsed, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seed must be an integer"})
+		return nil, false
+	}
+	return &parsed, true
+}
+
+// selectJokes picks up to n distinct eligible jokes for the client, from
+// seed if it isn't nil.
+func selectJokes(client string, seed *int64, eligible []bool, n int) []int {
+	if seed != nil {
+		return selector.NextSeeded(*seed, eligible, n)
+	}
+	return selector.NextN(client, eligible, n)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Reaction types accepted by the reaction endpoint
+var reactionTypes = []string{"laugh", "groan", "meh"}
+
+type ReactionRequest struct {
+	Reaction string `json:"reaction" binding:"required,oneof=laugh groan meh"`
+}
+
+// ReactionEvent is the payload of the reaction event sent to analytics for
+// every reaction.
+type ReactionEvent struct {
+	JokeID   string         `json:"joke_id"`
+	Reaction string         `json:"reaction"`
+	Latency  *LatencySample `json:"latency,omitempty"`
+	// ExperimentID and Variant are the reacting client's, if the joke is
+	// under test (see experiments.go)
+	ExperimentID string `json:"experiment_id,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// reactionWeightPrior damps the weight of jokes with few reactions, as if
+// each had this many more neutral ones
+const reactionWeightPrior = 10
+
+var (
+	// Reaction counts per joke index, by reaction type
+	reactions      = map[int]map[string]int64{}
+	reactionsMutex sync.RWMutex
+)
+
+// reactionCounts returns the counts for every reaction type of a joke.
+func reactionCounts(index int) map[string]int64 {
+	reactionsMutex.RLock()
+	defer reactionsMutex.RUnlock()
+
+	counts := make(map[string]int64, len(reactionTypes))
+	for _, t := range reactionTypes {
+		counts[t] = reactions[index][t]
+	}
+	return counts
+}
+
+// reactionWeight is a joke's selection weight from its reaction counts: 1
+// for a joke nobody reacted to, rising towards 2 as laughs outnumber groans
+// and falling towards 0.5 as groans outnumber laughs. Meh reactions pull
+// it back towards 1.
+func reactionWeight(counts map[string]int64) float64 {
+	total := counts["laugh"] + counts["groan"] + counts["meh"]
+	score := float64(counts["laugh"]-counts["groan"]) / float64(total+reactionWeightPrior)
+	return math.Pow(2, score)
+}
+
+func reactionHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	start := time.Now()
+
+	index, ok := jokeIndex(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+		return
+	}
+
+	var req ReactionRequest
+	if !middleware.BindJSON(c, &req) {
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "addReaction")
+	defer span.End()
+
+	reactionsMutex.Lock()
+	if reactions[index] == nil {
+		reactions[index] = map[string]int64{}
+	}
+	reactions[index][req.Reaction]++
+	reactionsMutex.Unlock()
+
+	// Well-liked jokes come up more often (see selector.go)
+	weight := reactionWeight(reactionCounts(index))
+	selector.SetWeight(index, weight)
+
+	span.SetAttributes(
+		attribute.String("joke.id", jokeID(index)),
+		attribute.String("joke.reaction", req.Reaction),
+		attribute.Float64("joke.weight", weight),
+	)
+
+	loggerFor(ctx).Info("Reaction recorded",
+		zap.String("joke_id", jokeID(index)),
+		zap.String("reaction", req.Reaction),
+	)
+
+	latency := latencySince(c, start)
+	event := ReactionEvent{
+		JokeID:   jokeID(index),
+		Reaction: req.Reaction,
+		Latency:  &latency,
+	}
+	if experiment, variant, ok := experimentVariant(event.JokeID, clientID(c)); ok {
+		event.ExperimentID = experiment.ID
+		event.Variant = variantName(variant)
+	}
+	trackEvent(ctx, "reaction", event, nil)
+	invalidateJokes(c, "reaction", jokeID(index))
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":        jokeID(index),
+		"reaction":  req.Reaction,
+		"reactions": reactionCounts(index),
+	})
+}
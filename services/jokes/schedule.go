@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// Seasonal jokes carry a schedule limiting when they are served. A
+// schedule has active windows, a cron expression, or both, in which case
+// the joke is served while the cron expression matches within one of the
+// windows. Windows are either yearly, "MM-DD" to "MM-DD" inclusive and
+// wrapping over new year ("12-20" to "01-06"), or one-off, RFC 3339 times
+// from inclusive to exclusive. The cron expression has the usual five
+// fields, minute hour day-of-month month day-of-week, and the joke is
+// served during every minute it matches: "* * * 10 *" is all of October,
+// "* 17-23 * * 5" Friday evenings.
+//
+// Schedules are kept by joke ID, so they survive catalogue refreshes, and
+// evaluated in the schedule's timezone, SCHEDULE_TIMEZONE (default UTC)
+// unless it names one. Jokes out of season are left out of selection like
+// retired ones, but can still be fetched by ID.
+
+// ScheduleWindow is a period a scheduled joke is served in.
+type ScheduleWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// JokeSchedule limits when a joke is served.
+type JokeSchedule struct {
+	Windows  []ScheduleWindow `json:"windows,omitempty"`
+	Cron     string           `json:"cron,omitempty"`
+	Timezone string           `json:"timezone,omitempty"`
+
+	location *time.Location
+	cron     *cronExpression
+}
+
+// ScheduledJoke is a schedule as listed to operators.
+type ScheduledJoke struct {
+	JokeID string `json:"joke_id"`
+	JokeSchedule
+	Active bool `json:"active"`
+}
+
+var (
+	// jokeSchedules holds the schedule of every scheduled joke, by ID
+	jokeSchedules  = map[string]*JokeSchedule{}
+	schedulesMutex sync.RWMutex
+
+	defaultScheduleLocation = time.UTC
+)
+
+func initSchedules() {
+	if name := os.Getenv("SCHEDULE_TIMEZONE"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			logger.Fatal("Invalid SCHEDULE_TIMEZONE", zap.String("timezone", name), zap.Error(err))
+		}
+		defaultScheduleLocation = location
+	}
+}
+
+// compile validates the schedule and prepares it for evaluation.
+func (s *JokeSchedule) compile() error {
+	if len(s.Windows) == 0 && s.Cron == "" {
+		return fmt.Errorf("a schedule needs windows, a cron expression or both")
+	}
+
+	s.location = defaultScheduleLocation
+	if s.Timezone != "" {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+		s.location = location
+	}
+
+	for i, w := range s.Windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+
+	s.cron = nil
+	if s.Cron != "" {
+		cron, err := parseCron(s.Cron)
+		if err != nil {
+			return fmt.Errorf("cron: %w", err)
+		}
+		s.cron = cron
+	}
+	return nil
+}
+
+// activeAt reports whether the schedule serves its joke at t.
+func (s *JokeSchedule) activeAt(t time.Time) bool {
+	t = t.In(s.location)
+	if len(s.Windows) > 0 {
+		inWindow := false
+		for _, w := range s.Windows {
+			if w.contains(t) {
+				inWindow = true
+				break
+			}
+		}
+		if !inWindow {
+			return false
+		}
+	}
+	return s.cron == nil || s.cron.matches(t)
+}
+
+// yearly reports whether the window recurs every year.
+func (w ScheduleWindow) yearly() bool {
+	return len(w.From) == len("01-02")
+}
+
+func (w ScheduleWindow) validate() error {
+	if w.yearly() {
+		for _, v := range []string{w.From, w.To} {
+			// 2024 is a leap year, so "02-29" is accepted
+			if _, err := time.Parse("2006-01-02", "2024-"+v); err != nil || len(v) != len("01-02") {
+				return fmt.Errorf("%q is not a MM-DD date", v)
+			}
+		}
+		return nil
+	}
+
+	from, err := time.Parse(time.RFC3339, w.From)
+	if err != nil {
+		return fmt.Errorf("from must be MM-DD or an RFC 3339 time")
+	}
+	to, err := time.Parse(time.RFC3339, w.To)
+	if err != nil {
+		return fmt.Errorf("to must be an RFC 3339 time when from is")
+	}
+	if !to.After(from) {
+		return fmt.Errorf("to must be after from")
+	}
+	return nil
+}
+
+// contains reports whether t falls in the window; t is in the schedule's
+// timezone.
+func (w ScheduleWindow) contains(t time.Time) bool {
+	if !w.yearly() {
+		from, _ := time.Parse(time.RFC3339, w.From)
+		to, _ := time.Parse(time.RFC3339, w.To)
+		return !t.Before(from) && t.Before(to)
+	}
+
+	// MM-DD strings compare in calendar order
+	day := t.Format("01-02")
+	if w.From <= w.To {
+		return w.From <= day && day <= w.To
+	}
+	return day >= w.From || day <= w.To
+}
+
+// cronExpression is a parsed five-field cron expression; each field is the
+// set of values it matches.
+type cronExpression struct {
+	minute, hour, dayOfMonth, month, dayOfWeek map[int]bool
+	// A restricted day of month or day of week matches either, as in cron
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+func parseCron(expr string) (*cronExpression, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("want 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	bounds := []struct {
+		name     string
+		min, max int
+	}{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bounds[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 or 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &cronExpression{
+		minute:        sets[0],
+		hour:          sets[1],
+		dayOfMonth:    sets[2],
+		month:         sets[3],
+		dayOfWeek:     sets[4],
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "N", "N-M", each
+// optionally followed by "/STEP".
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", from)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is out of range %d-%d", rangePart, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronExpression) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dayOfMonth := c.dayOfMonth[t.Day()]
+	dayOfWeek := c.dayOfWeek[int(t.Weekday())]
+	switch {
+	case c.anyDayOfMonth && c.anyDayOfWeek:
+		return true
+	case c.anyDayOfMonth:
+		return dayOfWeek
+	case c.anyDayOfWeek:
+		return dayOfMonth
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// jokeSchedule returns the schedule of the joke, nil if it has none.
+func jokeSchedule(id string) *JokeSchedule {
+	schedulesMutex.RLock()
+	defer schedulesMutex.RUnlock()
+	return jokeSchedules[id]
+}
+
+// inSeason returns, by joke index, whether each scheduled joke is served
+// at now; unscheduled jokes are left out. It returns nil when no joke is
+// scheduled. Callers must hold jokesMutex.
+func inSeason(now time.Time) map[int]bool {
+	schedulesMutex.RLock()
+	defer schedulesMutex.RUnlock()
+
+	if len(jokeSchedules) == 0 {
+		return nil
+	}
+	active := make(map[int]bool, len(jokeSchedules))
+	for id, schedule := range jokeSchedules {
+		if index, ok := jokeIndexByID[id]; ok {
+			active[index] = schedule.activeAt(now)
+		}
+	}
+	return active
+}
+
+// scheduledJokes lists the schedules by joke ID.
+func scheduledJokes(now time.Time) []ScheduledJoke {
+	schedulesMutex.RLock()
+	defer schedulesMutex.RUnlock()
+
+	listed := make([]ScheduledJoke, 0, len(jokeSchedules))
+	for id, schedule := range jokeSchedules {
+		listed = append(listed, ScheduledJoke{JokeID: id, JokeSchedule: *schedule, Active: schedule.activeAt(now)})
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].JokeID < listed[j].JokeID })
+	return listed
+}
+
+// registerScheduleRoutes installs the schedule management routes on the
+// internal group.
+func registerScheduleRoutes(internal *gin.RouterGroup) {
+	internal.GET("/admin/schedules", func(c *gin.Context) {
+		listed := scheduledJokes(time.Now())
+		c.JSON(http.StatusOK, gin.H{
+			"schedules": listed,
+			"count":     len(listed),
+		})
+	})
+
+	internal.PUT("/admin/jokes/:id/schedule", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		index, ok := jokeIndex(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+		id := jokeID(index)
+
+		var schedule JokeSchedule
+		if !middleware.BindJSON(c, &schedule) {
+			return
+		}
+		if err := schedule.compile(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		schedulesMutex.Lock()
+		_, existed := jokeSchedules[id]
+		jokeSchedules[id] = &schedule
+		schedulesMutex.Unlock()
+
+		active := schedule.activeAt(time.Now())
+		loggerFor(ctx).Info("Joke schedule set",
+			zap.String("joke_id", id),
+			zap.Int("windows", len(schedule.Windows)),
+			zap.String("cron", schedule.Cron),
+			zap.Bool("active", active),
+		)
+
+		invalidateJokes(c, "schedule", id)
+		status := http.StatusCreated
+		if existed {
+			status = http.StatusOK
+		}
+		c.JSON(status, ScheduledJoke{JokeID: id, JokeSchedule: schedule, Active: active})
+	})
+
+	internal.DELETE("/admin/jokes/:id/schedule", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		index, ok := jokeIndex(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+		id := jokeID(index)
+
+		schedulesMutex.Lock()
+		_, existed := jokeSchedules[id]
+		delete(jokeSchedules, id)
+		schedulesMutex.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke has no schedule"})
+			return
+		}
+
+		loggerFor(ctx).Info("Joke schedule removed", zap.String("joke_id", id))
+		invalidateJokes(c, "schedule", id)
+		c.JSON(http.StatusOK, gin.H{"joke_id": id, "status": "unscheduled"})
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// JokeSelector picks jokes at random, weighted per joke, while avoiding
+// serving a client any of the jokes it saw most recently.
+type JokeSelector struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	weights []float64
+
+	// Recently served joke indices per client, oldest first
+	history     map[string][]int
+	historySize int
+	maxClients  int
+}
+
+// NewJokeSelector creates a selector over n jokes with uniform weights,
+// picking from seed. historySize is the number of recent jokes remembered
+// per client.
+func NewJokeSelector(n, historySize, maxClients int, seed int64) *JokeSelector {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return &JokeSelector{
+		rng:         rand.New(rand.NewSource(seed)),
+		weights:     weights,
+		history:     make(map[string][]int),
+		historySize: historySize,
+		maxClients:  maxClients,
+	}
+}
+
+// SetWeight sets the relative selection weight of a joke; reactions set
+// it from the joke's laughs and groans (see reactionWeight). Weights must
+// be non-negative.
+func (s *JokeSelector) SetWeight(index int, weight float64) {
+	if weight < 0 {
+		weight = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index >= 0 && index < len(s.weights) {
+		s.weights[index] = weight
+	}
+}
+
+// Add makes n more jokes available for selection, with uniform weight.
+func (s *JokeSelector) Add(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.weights = append(s.weights, 1)
+	}
+}
+
+// Next returns the index of the next joke for a client. An empty clientID
+// disables repeat avoidance. When eligible is non-nil, only jokes whose
+// entry is true are considered; ok is false if there are none.
+func (s *JokeSelector) Next(clientID string, eligible []bool) (index int, ok bool) {
+	picks := s.NextN(clientID, eligible, 1)
+	if len(picks) == 0 {
+		return 0, false
+	}
+	return picks[0], true
+}
+
+// NextN returns up to n distinct jokes for a client, fewer if fewer are
+// eligible, and none if no joke is. Recent repeats are avoided as in Next.
+func (s *JokeSelector) NextN(clientID string, eligible []bool, n int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next(clientID, eligible, n, s.rng)
+}
+
+// NextSeeded returns up to n distinct eligible jokes picked from seed
+// alone: the same seed picks the same jokes as long as the weights don't
+// change. No client's recent jokes are avoided or remembered.
+func (s *JokeSelector) NextSeeded(seed int64, eligible []bool, n int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next("", eligible, n, rand.New(rand.NewSource(seed)))
+}
+
+// next picks jokes as NextN does, from rng.
+func (s *JokeSelector) next(clientID string, eligible []bool, n int, rng *rand.Rand) []int {
+	excluded := map[int]bool{}
+	if eligible != nil {
+		for i := range s.weights {
+			if i >= len(eligible) || !eligible[i] {
+				excluded[i] = true
+			}
+		}
+	}
+	if available := len(s.weights) - len(excluded); n > available {
+		n = available
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// Never exclude so many jokes that fewer than n candidates remain
+	recent := s.history[clientID]
+	limit := len(s.weights) - n
+	for i := len(recent) - 1; i >= 0 && len(excluded) < limit; i-- {
+		excluded[recent[i]] = true
+	}
+
+	picks := make([]int, 0, n)
+	for len(picks) < n {
+		index := s.pick(excluded, rng)
+		excluded[index] = true
+		picks = append(picks, index)
+		if clientID != "" {
+			s.remember(clientID, index)
+		}
+	}
+	return picks
+}
+
+// pick chooses a weighted random index among those not excluded, falling
+// back to a uniform pick when every remaining candidate has zero weight.
+func (s *JokeSelector) pick(excluded map[int]bool, rng *rand.Rand) int {
+	total := 0.0
+	for i, w := range s.weights {
+		if !excluded[i] {
+			total += w
+		}
+	}
+
+	if total > 0 {
+		r := rng.Float64() * total
+		for i, w := range s.weights {
+			if excluded[i] || w == 0 {
+				continue
+			}
+			if r < w {
+				return i
+			}
+			r -= w
+		}
+	}
+
+	candidates := make([]int, 0, len(s.weights))
+	for i := range s.weights {
+		if !excluded[i] {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates[rng.Intn(len(candidates))]
+}
+
+func (s *JokeSelector) remember(clientID string, index int) {
+	recent, known := s.history[clientID]
+	if !known && len(s.history) >= s.maxClients {
+		// Evict an arbitrary client to keep memory bounded
+		for id := range s.history {
+			delete(s.history, id)
+			break
+		}
+	}
+
+	recent = append(recent, index)
+	if len(recent) > s.historySize {
+		recent = recent[len(recent)-s.historySize:]
+	}
+	s.history[clientID] = recent
+}
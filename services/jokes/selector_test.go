@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSelectorAvoidsImmediateRepeats(t *testing.T) {
+	s := NewJokeSelector(5, 1, 10, 42)
+
+	for _, client := range []string{"user:a", "user:b"} {
+		last := -1
+		for i := 0; i < 1000; i++ {
+			index, ok := s.Next(client, nil)
+			if !ok {
+				t.Fatalf("%s: no joke picked", client)
+			}
+			if index == last {
+				t.Fatalf("%s: joke %d served twice in a row at pick %d", client, index, i)
+			}
+			last = index
+		}
+	}
+}
+
+func TestSelectorAvoidsRecentJokes(t *testing.T) {
+	const historySize = 3
+	s := NewJokeSelector(10, historySize, 10, 7)
+
+	var recent []int
+	for i := 0; i < 500; i++ {
+		index, _ := s.Next("user:a", nil)
+		for _, r := range recent {
+			if index == r {
+				t.Fatalf("joke %d repeated within the last %d picks (%v)", index, historySize, recent)
+			}
+		}
+		recent = append(recent, index)
+		if len(recent) > historySize {
+			recent = recent[1:]
+		}
+	}
+}
+
+func TestSelectorWeightedFrequency(t *testing.T) {
+	weights := []float64{1, 2, 3, 0}
+	s := NewJokeSelector(len(weights), 0, 10, 1)
+	for i, w := range weights {
+		s.SetWeight(i, w)
+	}
+
+	const picks = 60000
+	counts := make([]int, len(weights))
+	for i := 0; i < picks; i++ {
+		// No client, so nothing is avoided and only the weights count
+		index, _ := s.Next("", nil)
+		counts[index]++
+	}
+
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	for i, w := range weights {
+		want := w / total
+		got := float64(counts[i]) / picks
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("joke %d: frequency %.3f, want %.3f ± 0.01", i, got, want)
+		}
+	}
+}
+
+func TestSelectorZeroWeightsFallBackToUniform(t *testing.T) {
+	s := NewJokeSelector(2, 0, 10, 3)
+	s.SetWeight(0, 0)
+	s.SetWeight(1, 0)
+
+	seen := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		index, ok := s.Next("", nil)
+		if !ok {
+			t.Fatal("no joke picked with zero weights")
+		}
+		seen[index] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("picked %v, want both jokes", seen)
+	}
+}
+
+func TestSelectorEligible(t *testing.T) {
+	s := NewJokeSelector(4, 2, 10, 5)
+	eligible := []bool{false, true, false, false}
+
+	for i := 0; i < 10; i++ {
+		// With one eligible joke, repeat avoidance gives way
+		index, ok := s.Next("user:a", eligible)
+		if !ok || index != 1 {
+			t.Fatalf("got %d, %v; want the only eligible joke", index, ok)
+		}
+	}
+	if _, ok := s.Next("user:a", make([]bool, 4)); ok {
+		t.Error("picked a joke with none eligible")
+	}
+}
+
+func TestSelectorSeededPicksRepeat(t *testing.T) {
+	s := NewJokeSelector(20, 5, 10, 9)
+
+	first := s.NextSeeded(1234, nil, 3)
+	s.NextN("user:a", nil, 5)
+	second := s.NextSeeded(1234, nil, 3)
+	if len(first) != 3 {
+		t.Fatalf("got %d picks, want 3", len(first))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("seeded picks differ: %v then %v", first, second)
+		}
+	}
+	if len(s.history) != 1 {
+		t.Errorf("seeded picks were remembered: %d clients", len(s.history))
+	}
+}
+
+func TestSelectorEvictsClientsAtMax(t *testing.T) {
+	const maxClients = 3
+	s := NewJokeSelector(10, 2, maxClients, 11)
+
+	for i := 0; i < 10; i++ {
+		client := "client:" + strconv.Itoa(i)
+		s.Next(client, nil)
+		if len(s.history) > maxClients {
+			t.Fatalf("%d clients remembered, want at most %d", len(s.history), maxClients)
+		}
+		if _, ok := s.history[client]; !ok {
+			t.Fatalf("%s, the latest client, was evicted", client)
+		}
+	}
+
+	// A known client doesn't evict anyone
+	before := len(s.history)
+	for client := range s.history {
+		s.Next(client, nil)
+		break
+	}
+	if len(s.history) != before {
+		t.Errorf("%d clients after a known client's pick, want %d", len(s.history), before)
+	}
+}
+
+func TestReactionWeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts map[string]int64
+		min    float64
+		max    float64
+	}{
+		{"no reactions", map[string]int64{}, 1, 1},
+		{"mostly laughs", map[string]int64{"laugh": 1000, "groan": 10}, 1.9, 2},
+		{"mostly groans", map[string]int64{"laugh": 10, "groan": 1000}, 0.5, 0.55},
+		{"balanced", map[string]int64{"laugh": 50, "groan": 50, "meh": 20}, 1, 1},
+		{"few laughs", map[string]int64{"laugh": 1}, 1, 1.1},
+	}
+	for _, tt := range tests {
+		if got := reactionWeight(tt.counts); got < tt.min || got > tt.max {
+			t.Errorf("%s: weight %.3f, want between %.2f and %.2f", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Under pressure the service sheds low-priority requests with 503 and
+// Retry-After, so the jokes clients are waiting for keep being served. The
+// service counts as saturated while any of these is over its threshold:
+//   - requests in flight (SHED_MAX_IN_FLIGHT)
+//   - the mean latency of the requests completed in the last second,
+//     leaving out the low-priority ones, slow by nature
+//     (SHED_LATENCY_THRESHOLD)
+//   - CPU use as a share of the container's CPU limit (SHED_CPU_THRESHOLD)
+//   - memory use as a share of the container's memory limit
+//     (SHED_MEMORY_THRESHOLD)
+//
+// CPU and memory are read from cgroup v2 every second. Without a CPU limit
+// CPU use is measured against the machine's CPUs; without a memory limit,
+// or outside cgroup v2, the signal is left out. Low-priority requests are
+// the expensive or deferrable ones: speech, batches, history, trending and
+// mirrored traffic. Single jokes and reactions are never shed, nor are
+// health checks and /internal routes. The thresholds can be changed at
+// runtime (see pkg/telemetry), and LOAD_SHEDDING=false turns shedding off.
+
+// cgroupRoot is where the container's cgroup v2 files are mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// lowPriorityRoutes are shed first when the service is saturated
+var lowPriorityRoutes = map[string]bool{
+	"/api/v1/joke/audio":     true,
+	"/api/v1/jokes/random":   true,
+	"/api/v1/jokes/trending": true,
+	"/api/v1/history":        true,
+}
+
+// shedConfig holds the shedding thresholds; zero disables a signal.
+type shedConfig struct {
+	enabled     bool
+	maxInFlight int64
+	maxLatency  time.Duration
+	maxCPU      float64
+	maxMemory   float64
+}
+
+// loadSample is the latest reading of the sampled signals.
+type loadSample struct {
+	latency time.Duration
+	// cpu and memory are shares of the limits, -1 when unknown
+	cpu    float64
+	memory float64
+}
+
+var (
+	shedSettings atomic.Pointer[shedConfig]
+	lastSample   atomic.Pointer[loadSample]
+	inFlight     atomic.Int64
+
+	// completed collects the latencies of the current sampling window
+	completed struct {
+		sync.Mutex
+		count int64
+		total time.Duration
+	}
+
+	requestsShed metric.Int64Counter
+)
+
+func initLoadShedding() {
+	applyShedConfig()
+	for _, key := range []string{"LOAD_SHEDDING", "SHED_MAX_IN_FLIGHT", "SHED_LATENCY_THRESHOLD", "SHED_CPU_THRESHOLD", "SHED_MEMORY_THRESHOLD"} {
+		telemetry.OnRuntimeChange(key, applyShedConfig)
+	}
+	lastSample.Store(&loadSample{cpu: -1, memory: -1})
+
+	var err error
+	requestsShed, err = meter.Int64Counter(
+		"jokes.requests.shed",
+		metric.WithDescription("Number of low-priority requests shed while the service was saturated, by reason"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create shed requests counter", zap.Error(err))
+	}
+
+	_, err = meter.Int64ObservableGauge(
+		"jokes.requests.in_flight",
+		metric.WithDescription("Number of requests being served"),
+		metric.WithUnit("{request}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(inFlight.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create in-flight gauge", zap.Error(err))
+	}
+
+	go sampleLoad()
+}
+
+// applyShedConfig reads the thresholds, keeping the default of any that
+// is missing or invalid.
+func applyShedConfig() {
+	cfg := &shedConfig{
+		enabled:     true,
+		maxInFlight: 200,
+		maxLatency:  500 * time.Millisecond,
+		maxCPU:      0.9,
+		maxMemory:   0.9,
+	}
+	if v, err := strconv.ParseBool(telemetry.RuntimeValue("LOAD_SHEDDING")); err == nil {
+		cfg.enabled = v
+	}
+	if v, err := strconv.ParseInt(telemetry.RuntimeValue("SHED_MAX_IN_FLIGHT"), 10, 64); err == nil && v >= 0 {
+		cfg.maxInFlight = v
+	}
+	if v, err := time.ParseDuration(telemetry.RuntimeValue("SHED_LATENCY_THRESHOLD")); err == nil && v >= 0 {
+		cfg.maxLatency = v
+	}
+	if v, err := strconv.ParseFloat(telemetry.RuntimeValue("SHED_CPU_THRESHOLD"), 64); err == nil && v >= 0 {
+		cfg.maxCPU = v
+	}
+	if v, err := strconv.ParseFloat(telemetry.RuntimeValue("SHED_MEMORY_THRESHOLD"), 64); err == nil && v >= 0 {
+		cfg.maxMemory = v
+	}
+	shedSettings.Store(cfg)
+
+	logger.Info("Load shedding configured",
+		zap.Bool("enabled", cfg.enabled),
+		zap.Int64("max_in_flight", cfg.maxInFlight),
+		zap.Duration("latency_threshold", cfg.maxLatency),
+		zap.Float64("cpu_threshold", cfg.maxCPU),
+		zap.Float64("memory_threshold", cfg.maxMemory),
+	)
+}
+
+// sampleLoad takes a loadSample every second.
+func sampleLoad() {
+	prevUsage, prevAt := cgroupCPUUsage(), time.Now()
+	for range time.Tick(time.Second) {
+		sample := &loadSample{cpu: -1, memory: -1}
+
+		completed.Lock()
+		if completed.count > 0 {
+			sample.latency = completed.total / time.Duration(completed.count)
+		}
+		completed.count, completed.total = 0, 0
+		completed.Unlock()
+
+		usage, now := cgroupCPUUsage(), time.Now()
+		if cpus := cgroupCPULimit(); usage >= 0 && prevUsage >= 0 && cpus > 0 {
+			sample.cpu = (usage - prevUsage).Seconds() / (now.Sub(prevAt).Seconds() * cpus)
+		}
+		prevUsage, prevAt = usage, now
+		sample.memory = cgroupMemoryUse()
+
+		lastSample.Store(sample)
+	}
+}
+
+// saturation returns why the service is saturated, or "" when it isn't.
+func saturation(cfg *shedConfig) string {
+	sample := lastSample.Load()
+	switch {
+	case cfg.maxInFlight > 0 && inFlight.Load() > cfg.maxInFlight:
+		return "in_flight"
+	case cfg.maxLatency > 0 && sample.latency > cfg.maxLatency:
+		return "latency"
+	case cfg.maxCPU > 0 && sample.cpu > cfg.maxCPU:
+		return "cpu"
+	case cfg.maxMemory > 0 && sample.memory > cfg.maxMemory:
+		return "memory"
+	}
+	return ""
+}
+
+// isLowPriority reports whether a request may be shed.
+func isLowPriority(c *gin.Context) bool {
+	return lowPriorityRoutes[c.FullPath()] || isMirrored(c.Request.Context())
+}
+
+// loadSheddingMiddleware counts the requests in flight and their latency,
+// and sheds low-priority requests while the service is saturated. It must
+// run after mirroredRequestMiddleware, which marks mirrored requests.
+func loadSheddingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.FullPath()
+		if path == "/healthz" || strings.HasPrefix(path, "/internal/") {
+			c.Next()
+			return
+		}
+
+		cfg := shedSettings.Load()
+		lowPriority := isLowPriority(c)
+		if cfg.enabled && lowPriority {
+			if reason := saturation(cfg); reason != "" {
+				ctx := c.Request.Context()
+				requestsShed.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("route", path),
+					attribute.String("reason", reason),
+				), telemetry.ContextAttrs(ctx))
+				loggerFor(ctx).Warn("Request shed, service saturated",
+					zap.String("route", path),
+					zap.String("reason", reason),
+				)
+				c.Header("Retry-After", "1")
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Service overloaded, try again shortly"})
+				return
+			}
+		}
+
+		start := time.Now()
+		inFlight.Add(1)
+		defer func() {
+			inFlight.Add(-1)
+			if lowPriority {
+				return
+			}
+			completed.Lock()
+			completed.count++
+			completed.total += time.Since(start)
+			completed.Unlock()
+		}()
+		c.Next()
+	}
+}
+
+// cgroupCPUUsage returns the CPU time used by the container, or -1 when
+// it can't be read.
+func cgroupCPUUsage() time.Duration {
+	f, err := os.Open(cgroupRoot + "/cpu.stat")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "usage_usec "); ok {
+			if usec, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Duration(usec) * time.Microsecond
+			}
+		}
+	}
+	return -1
+}
+
+// cgroupCPULimit returns the CPUs the container may use: its quota when it
+// has one, else those of the machine.
+func cgroupCPULimit() float64 {
+	content, err := os.ReadFile(cgroupRoot + "/cpu.max")
+	if err == nil {
+		if fields := strings.Fields(string(content)); len(fields) == 2 {
+			quota, errQuota := strconv.ParseFloat(fields[0], 64)
+			period, errPeriod := strconv.ParseFloat(fields[1], 64)
+			if errQuota == nil && errPeriod == nil && period > 0 {
+				return quota / period
+			}
+		}
+	}
+	return float64(runtime.NumCPU())
+}
+
+// cgroupMemoryUse returns the container's memory use as a share of its
+// limit, or -1 without a limit.
+func cgroupMemoryUse() float64 {
+	limit, err := readCgroupInt("memory.max")
+	if err != nil || limit <= 0 {
+		return -1
+	}
+	current, err := readCgroupInt("memory.current")
+	if err != nil {
+		return -1
+	}
+	return float64(current) / float64(limit)
+}
+
+// readCgroupInt reads a cgroup file holding a single number; "max" fails
+// to parse, like a missing file.
+func readCgroupInt(name string) (int64, error) {
+	content, err := os.ReadFile(cgroupRoot + "/" + name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
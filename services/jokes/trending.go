@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// Trending jokes are ranked by the analytics service, which scores the
+// jokes served in the last hour by momentum against the hour before. The
+// ranking is cached per tenant for TRENDING_CACHE_TTL (default 30s), and
+// concurrent misses share one analytics call, so traffic to this endpoint
+// doesn't reach analytics. When analytics fails, the last ranking is served
+// for up to trendingStaleFor, flagged stale.
+
+// TrendingEntry is a joke in the analytics ranking.
+type TrendingEntry struct {
+	JokeID   string  `json:"joke_id"`
+	Served   int64   `json:"served"`
+	Previous int64   `json:"previous"`
+	Momentum float64 `json:"momentum"`
+}
+
+// trendingRanking is a cached analytics ranking.
+type trendingRanking struct {
+	entries   []TrendingEntry
+	fetchedAt time.Time
+}
+
+const (
+	// trendingFetchLimit is the ranking length fetched from analytics,
+	// more than served so retired and unsafe jokes can be left out
+	trendingFetchLimit   = 50
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 20
+
+	trendingStaleFor = 10 * time.Minute
+)
+
+var (
+	trendingCacheTTL = 30 * time.Second
+
+	// trendingCache holds the ranking of every tenant
+	trendingCache = map[string]trendingRanking{}
+	trendingMutex sync.Mutex
+	// trendingFetchMutex lets one request at a time refresh the cache
+	trendingFetchMutex sync.Mutex
+
+	trendingClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+func initTrending() {
+	if v, err := time.ParseDuration(os.Getenv("TRENDING_CACHE_TTL")); err == nil && v >= 0 {
+		trendingCacheTTL = v
+	}
+}
+
+// cachedTrending returns the tenant's cached ranking and whether it is
+// fresh.
+func cachedTrending(tenant string, now time.Time) (trendingRanking, bool, bool) {
+	trendingMutex.Lock()
+	defer trendingMutex.Unlock()
+
+	ranking, ok := trendingCache[tenant]
+	return ranking, ok, ok && now.Sub(ranking.fetchedAt) < trendingCacheTTL
+}
+
+// trending returns the tenant's ranking, from the cache while it is fresh.
+// stale is set when analytics failed and an older ranking is returned.
+func trending(ctx context.Context) (ranking trendingRanking, stale bool, err error) {
+	tenant := telemetry.TenantFromContext(ctx)
+	if ranking, _, fresh := cachedTrending(tenant, time.Now()); fresh {
+		return ranking, false, nil
+	}
+
+	trendingFetchMutex.Lock()
+	defer trendingFetchMutex.Unlock()
+
+	// Another request may have refreshed it while this one waited
+	cached, ok, fresh := cachedTrending(tenant, time.Now())
+	if fresh {
+		return cached, false, nil
+	}
+
+	entries, err := fetchTrending(ctx)
+	if err != nil {
+		if ok && time.Since(cached.fetchedAt) < trendingStaleFor {
+			loggerFor(ctx).Warn("Failed to fetch trending jokes, serving stale ranking", zap.Error(err))
+			return cached, true, nil
+		}
+		return trendingRanking{}, false, err
+	}
+
+	ranking = trendingRanking{entries: entries, fetchedAt: time.Now()}
+	trendingMutex.Lock()
+	trendingCache[tenant] = ranking
+	trendingMutex.Unlock()
+	return ranking, false, nil
+}
+
+// fetchTrending gets the last hour's ranking from analytics. The tenant
+// travels in the propagated baggage.
+func fetchTrending(ctx context.Context) ([]TrendingEntry, error) {
+	ctx, span := tracer.Start(ctx, "fetchTrending")
+	defer span.End()
+
+	url := fmt.Sprintf("http://%s/api/v1/stats/trending?window=1h&limit=%d", analyticsServiceAddr(), trendingFetchLimit)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := trendingClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("analytics returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Trending []TrendingEntry `json:"trending"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("trending.count", len(body.Trending)))
+	return body.Trending, nil
+}
+
+// trendingHandler serves GET /api/v1/jokes/trending?limit=10&safe=true:
+// the fastest-rising jokes of the last hour with their momentum. Jokes
+// unknown to this replica, retired or, in safe mode, filtered are left out.
+func trendingHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	limit := defaultTrendingLimit
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxTrendingLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be an integer between 1 and " + strconv.Itoa(maxTrendingLimit),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	safeMode := true
+	if v := c.Query("safe"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "safe must be true or false"})
+			return
+		}
+		safeMode = parsed
+	}
+
+	ranking, stale, err := trending(ctx)
+	if err != nil {
+		loggerFor(ctx).Error("Failed to fetch trending jokes", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Trending jokes are unavailable"})
+		return
+	}
+
+	servable := servableJokes(safeMode)
+	listed := make([]gin.H, 0, limit)
+	for _, entry := range ranking.entries {
+		if len(listed) == limit {
+			break
+		}
+		index, ok := jokeIndex(entry.JokeID)
+		if !ok || (servable != nil && !servable[index]) {
+			continue
+		}
+		joke := jokeResponse(index)
+		joke["rank"] = len(listed) + 1
+		joke["momentum"] = entry.Momentum
+		joke["served_last_hour"] = entry.Served
+		joke["served_previous_hour"] = entry.Previous
+		listed = append(listed, joke)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"trending":   listed,
+		"count":      len(listed),
+		"window":     "1h",
+		"updated_at": ranking.fetchedAt.Format(time.RFC3339),
+		"stale":      stale,
+		"service":    "jokes-service",
+	})
+}
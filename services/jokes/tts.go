@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/joke/audio speaks a joke for smart speakers: a random one
+// like GET /api/v1/joke, or the one named by ?id=. Speech comes from the
+// first speech provider that succeeds:
+//   - an OpenAI-compatible speech API (TTS_API_URL), returning MP3
+//   - espeak-ng run locally, which works offline; its WAV output is
+//     encoded to MP3 with lame when installed, and served as WAV otherwise
+//
+// The audio is streamed to the client as it is synthesized, so the
+// response has no Content-Length. Failures before the first byte fall
+// through to the next provider; later ones cut the response short.
+
+// speechProvider synthesizes speech.
+type speechProvider interface {
+	// Name labels the provider in metrics and logs
+	Name() string
+	// Synthesize returns the audio of text and its content type. The caller
+	// closes the audio, which ends the synthesis if it's still running.
+	Synthesize(ctx context.Context, text string) (io.ReadCloser, string, error)
+}
+
+var (
+	speechProviders []speechProvider
+	ttsTimeout      = 30 * time.Second
+
+	ttsRequests metric.Int64Counter
+)
+
+func initTTS() {
+	if v, err := time.ParseDuration(os.Getenv("TTS_TIMEOUT")); err == nil && v > 0 {
+		ttsTimeout = v
+	}
+
+	if url := os.Getenv("TTS_API_URL"); url != "" {
+		speechProviders = append(speechProviders, &apiSpeechProvider{
+			url:   url,
+			key:   os.Getenv("TTS_API_KEY"),
+			model: getEnv("TTS_MODEL", "tts-1"),
+			voice: getEnv("TTS_VOICE", "alloy"),
+		})
+	}
+
+	command := getEnv("TTS_ESPEAK_COMMAND", "espeak-ng")
+	if path, err := exec.LookPath(command); err == nil {
+		provider := &espeakSpeechProvider{command: path, voice: getEnv("TTS_ESPEAK_VOICE", "en")}
+		if encoder, err := exec.LookPath(getEnv("TTS_MP3_ENCODER", "lame")); err == nil {
+			provider.encoder = encoder
+		}
+		speechProviders = append(speechProviders, provider)
+	}
+
+	names := make([]string, 0, len(speechProviders))
+	for _, p := range speechProviders {
+		names = append(names, p.Name())
+	}
+	if len(names) == 0 {
+		logger.Warn("No speech provider available, /api/v1/joke/audio will return 503; set TTS_API_URL or install espeak-ng")
+	} else {
+		logger.Info("Speech providers configured", zap.Strings("providers", names))
+	}
+
+	var err error
+	ttsRequests, err = meter.Int64Counter(
+		"jokes.tts.requests",
+		metric.WithDescription("Number of speech syntheses, by provider and outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create TTS counter", zap.Error(err))
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// apiSpeechProvider calls an OpenAI-compatible /v1/audio/speech endpoint.
+type apiSpeechProvider struct {
+	url, key, model, voice string
+}
+
+func (p *apiSpeechProvider) Name() string { return "api" }
+
+func (p *apiSpeechProvider) Synthesize(ctx context.Context, text string) (io.ReadCloser, string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"model":           p.model,
+		"input":           text,
+		"voice":           p.voice,
+		"response_format": "mp3",
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.key != "" {
+		req.Header.Set("Authorization", "Bearer "+p.key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("speech API returned status %d", resp.StatusCode)
+	}
+	return resp.Body, "audio/mpeg", nil
+}
+
+// espeakSpeechProvider runs espeak-ng, piping its output through an MP3
+// encoder when one is installed.
+type espeakSpeechProvider struct {
+	command, voice string
+	// encoder is the path of lame, or empty
+	encoder string
+}
+
+func (p *espeakSpeechProvider) Name() string { return "espeak" }
+
+func (p *espeakSpeechProvider) Synthesize(ctx context.Context, text string) (io.ReadCloser, string, error) {
+	// The text goes in on stdin, so it can't be taken for options
+	speak := exec.CommandContext(ctx, p.command, "--stdout", "--stdin", "-v", p.voice)
+	speak.Stdin = strings.NewReader(text)
+	speech, err := speak.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := speak.Start(); err != nil {
+		return nil, "", err
+	}
+	if p.encoder == "" {
+		return &commandOutput{ReadCloser: speech, commands: []*exec.Cmd{speak}}, "audio/wav", nil
+	}
+
+	encode := exec.CommandContext(ctx, p.encoder, "--quiet", "-", "-")
+	encode.Stdin = speech
+	audio, err := encode.StdoutPipe()
+	if err != nil {
+		speak.Process.Kill()
+		speak.Wait()
+		return nil, "", err
+	}
+	if err := encode.Start(); err != nil {
+		speak.Process.Kill()
+		speak.Wait()
+		return nil, "", err
+	}
+	return &commandOutput{ReadCloser: audio, commands: []*exec.Cmd{speak, encode}}, "audio/mpeg", nil
+}
+
+// commandOutput is the output of a pipeline of commands, killed and
+// reaped on Close.
+type commandOutput struct {
+	io.ReadCloser
+	commands []*exec.Cmd
+}
+
+func (o *commandOutput) Close() error {
+	err := o.ReadCloser.Close()
+	for _, cmd := range o.commands {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	return err
+}
+
+// synthesize tries each provider in turn. The audio returned has at least
+// one byte buffered, so a provider that fails without producing any is
+// skipped.
+func synthesize(ctx context.Context, text string) (audio io.ReadCloser, contentType, provider string, err error) {
+	ctx, span := tracer.Start(ctx, "synthesizeSpeech")
+	defer span.End()
+
+	err = errors.New("no speech provider available")
+	for _, p := range speechProviders {
+		var raw io.ReadCloser
+		raw, contentType, err = p.Synthesize(ctx, text)
+		if err == nil {
+			buffered := bufio.NewReader(raw)
+			if _, err = buffered.Peek(1); err == nil {
+				span.SetAttributes(attribute.String("tts.provider", p.Name()))
+				ttsRequests.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("provider", p.Name()),
+					attribute.String("outcome", "ok"),
+				), telemetry.ContextAttrs(ctx))
+				return struct {
+					io.Reader
+					io.Closer
+				}{buffered, raw}, contentType, p.Name(), nil
+			}
+			raw.Close()
+		}
+
+		ttsRequests.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("provider", p.Name()),
+			attribute.String("outcome", "failed"),
+		), telemetry.ContextAttrs(ctx))
+		loggerFor(ctx).Warn("Speech synthesis failed",
+			zap.String("provider", p.Name()),
+			zap.Error(err),
+		)
+	}
+	span.SetStatus(codes.Error, err.Error())
+	return nil, "", "", err
+}
+
+// audioExtensions name the downloaded file by content type
+var audioExtensions = map[string]string{"audio/mpeg": "mp3", "audio/wav": "wav"}
+
+// jokeAudioHandler serves GET /api/v1/joke/audio?id=&safe=.
+func jokeAudioHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	start := time.Now()
+
+	if len(speechProviders) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Speech synthesis is not configured"})
+		return
+	}
+
+	var index int
+	var text string
+	if id := c.Query("id"); id != "" {
+		var ok bool
+		if index, ok = jokeIndex(id); !ok || isDraft(jokeID(index), time.Now()) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+			return
+		}
+		text = plainJokeText(jokeAt(index))
+	} else {
+		safeMode := true
+		if v := c.Query("safe"); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "safe must be true or false"})
+				return
+			}
+			safeMode = parsed
+		}
+		seed, ok := requestSeed(c)
+		if !ok {
+			return
+		}
+
+		client, userID := clientID(c), requestUserID(c)
+		var joke Joke
+		index, joke, ok = getRandomJoke(ctx, client, seed, safeMode, servableJokes(safeMode))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No jokes available"})
+			return
+		}
+		jokesServed.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+		recordServed(ctx, userID, []int{index}, false)
+		notifyAnalytics(ctx, joke, userID, latencySince(c, start))
+
+		// Clients under test hear their variant
+		response := jokeResponse(index)
+		applyExperiment(ctx, response, client, userID)
+		text = plainResponseText(response)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ttsTimeout)
+	defer cancel()
+	audio, contentType, provider, err := synthesize(ctx, text)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Speech synthesis failed"})
+		return
+	}
+	defer audio.Close()
+
+	id := jokeID(index)
+	loggerFor(ctx).Info("Joke audio streaming",
+		zap.String("joke_id", id),
+		zap.String("provider", provider),
+		zap.String("content_type", contentType),
+	)
+	c.DataFromReader(http.StatusOK, -1, contentType, audio, map[string]string{
+		"Cache-Control":       "no-store",
+		"Content-Disposition": fmt.Sprintf(`inline; filename="%s.%s"`, id, audioExtensions[contentType]),
+		"X-Joke-ID":           id,
+		"X-TTS-Provider":      provider,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// Favorites added and deleted and user merges are reported to the
+// analytics service, for its leaderboard, funnel and favorite counts, as
+// favorite_added, favorite_deleted and user_merged events in its versioned
+// event schema. Reports are best effort: a failed one is logged and not
+// retried, so analytics being down never slows down or fails a favorite.
+
+// Internal requests are signed with INTERNAL_AUTH_SECRET, as the
+// analytics service expects (see pkg/middleware).
+var (
+	analyticsService string
+	internalAuth     middleware.InternalAuth
+
+	// analyticsOverOTLP exports events as spans instead of posting them
+	// (see telemetry.AnalyticsOverOTLP)
+	analyticsOverOTLP bool
+)
+
+func initAnalytics() {
+	analyticsService = os.Getenv("ANALYTICS_SERVICE_URL")
+	if analyticsService == "" {
+		analyticsService = telemetry.ClusterServiceAddr("analytics-service")
+	}
+	internalAuth = middleware.InternalAuth{
+		Service: "user-service",
+		Secret:  []byte(os.Getenv("INTERNAL_AUTH_SECRET")),
+	}
+	if len(internalAuth.Secret) == 0 {
+		logger.Warn("INTERNAL_AUTH_SECRET not set, analytics events will be sent unsigned")
+	}
+}
+
+// analyticsSchemaVersion is the version of the events sent to analytics
+const analyticsSchemaVersion = 2
+
+// AnalyticsEvent is the envelope of an analytics event.
+type AnalyticsEvent struct {
+	EventType     string      `json:"event_type"`
+	SchemaVersion int         `json:"schema_version"`
+	Payload       interface{} `json:"payload"`
+}
+
+// FavoriteEvent is the payload reported to analytics for every favorite
+// added or deleted.
+type FavoriteEvent struct {
+	UserID string `json:"user_id"`
+	JokeID string `json:"joke_id,omitempty"`
+}
+
+// UserMergedEvent is the payload reported to analytics when a user is
+// merged into another.
+type UserMergedEvent struct {
+	FromUserID string `json:"from_user_id"`
+	ToUserID   string `json:"to_user_id"`
+}
+
+// notifyFavoriteAdded reports a new favorite to analytics.
+func notifyFavoriteAdded(ctx context.Context, fav Favorite) {
+	notifyAnalytics(ctx, "favorite_added", FavoriteEvent{UserID: fav.UserID, JokeID: fav.JokeID},
+		zap.String("favorite_id", fav.ID))
+}
+
+// notifyFavoriteDeleted reports a favorite moved to the trash to
+// analytics.
+func notifyFavoriteDeleted(ctx context.Context, fav Favorite) {
+	notifyAnalytics(ctx, "favorite_deleted", FavoriteEvent{UserID: fav.UserID, JokeID: fav.JokeID},
+		zap.String("favorite_id", fav.ID))
+}
+
+// notifyUsersMerged reports a merge to analytics, so it credits the
+// source user's activity to the target.
+func notifyUsersMerged(ctx context.Context, record MergeRecord) {
+	notifyAnalytics(ctx, "user_merged", UserMergedEvent{FromUserID: record.FromUserID, ToUserID: record.ToUserID},
+		zap.String("merge_id", record.ID))
+}
+
+// notifyAnalytics reports an event to analytics in the background, or
+// records it as a span event with ANALYTICS_TRANSPORT=otlp (see
+// pkg/telemetry). fields identify the event in the log if it fails.
+func notifyAnalytics(ctx context.Context, eventType string, payload interface{}, fields ...zap.Field) {
+	if analyticsOverOTLP {
+		telemetry.RecordAnalyticsEvent(ctx, tracer, eventType, payload)
+		return
+	}
+
+	body, err := json.Marshal(AnalyticsEvent{
+		EventType:     eventType,
+		SchemaVersion: analyticsSchemaVersion,
+		Payload:       payload,
+	})
+	if err != nil {
+		return
+	}
+
+	// Keep the trace and tenant baggage, but not the request's deadline
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := postToAnalytics(ctx, "/internal/events", body); err != nil {
+			loggerFor(ctx).Warn("Failed to report event to analytics",
+				append(fields, zap.String("event_type", eventType), zap.Error(err))...,
+			)
+		}
+	}()
+}
+
+// postToAnalytics sends a signed request to an analytics internal endpoint.
+func postToAnalytics(ctx context.Context, path string, body []byte) error {
+	ctx, span := tracer.Start(ctx, "postToAnalytics")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+analyticsService+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	internalAuth.Sign(req, body)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("analytics returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Users can sign in without a password: POST /api/v1/auth/magic-link
+// emails a one-time link, valid for MAGIC_LINK_TTL (default 15m), and
+// GET /api/v1/auth/verify exchanges the link's token for a session token
+// (see pkg/middleware/session.go) valid for AUTH_SESSION_TTL (default
+// 720h). Clients send it as "Authorization: Bearer ..."; the gateway
+// verifies it with the same AUTH_JWT_SECRET and acts for its user.
+//
+// A user's ID is derived from the tenant and the email address with
+// AUTH_JWT_SECRET, so it's the same on every sign-in and every replica and
+// no accounts are stored. The link token is signed too, with a key derived
+// from the secret so it can't pass for a session, and names the user in
+// the link's user_id, which the gateway routes on like the user's other
+// requests: the replica serving the user remembers the tokens used until
+// they expire, so each link works once.
+//
+// Links are rate limited per email address (MAGIC_LINK_RATE_LIMIT, default
+// 5) and per client IP (MAGIC_LINK_IP_RATE_LIMIT, default 20) per hour, on
+// each replica. Any address gets a link, so the response says nothing
+// about who has signed in before.
+
+var (
+	sessionTokens      middleware.SessionTokens
+	magicLinkTokens    middleware.SessionTokens
+	magicLinkTTL       = 15 * time.Minute
+	sessionTTL         = 720 * time.Hour
+	magicLinkBaseURL   = "http://localhost:8080/api/v1/auth/verify"
+	magicLinkRateLimit = 5
+	magicLinkIPLimit   = 20
+
+	// usedMagicLinks holds the IDs of the link tokens used, until they
+	// expire; guarded by authMutex
+	usedMagicLinks = map[string]time.Time{}
+	// magicLinkRequests counts link requests per rate limit key in the
+	// current window; guarded by authMutex
+	magicLinkRequests = map[string]*rateWindow{}
+	authMutex         sync.Mutex
+
+	magicLinkEvents metric.Int64Counter
+)
+
+// magicLinkWindow is the period the rate limits count over
+const magicLinkWindow = time.Hour
+
+// rateWindow counts requests since start.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// MagicLinkRequest asks for a sign-in link.
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// SessionResponse is returned for a verified link.
+type SessionResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var errMagicLinkInvalid = errors.New("invalid or expired sign-in link")
+
+func initAuth() {
+	secret := []byte(os.Getenv("AUTH_JWT_SECRET"))
+	if len(secret) == 0 {
+		logger.Warn("AUTH_JWT_SECRET not set, generating a random one; sessions and user IDs will not survive restarts or span replicas")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.Fatal("Failed to generate session secret", zap.Error(err))
+		}
+	}
+	sessionTokens = middleware.SessionTokens{Secret: secret}
+	linkKey := hmac.New(sha256.New, secret)
+	linkKey.Write([]byte("magic-link"))
+	magicLinkTokens = middleware.SessionTokens{Secret: linkKey.Sum(nil)}
+
+	if v, err := time.ParseDuration(os.Getenv("MAGIC_LINK_TTL")); err == nil && v > 0 {
+		magicLinkTTL = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AUTH_SESSION_TTL")); err == nil && v > 0 {
+		sessionTTL = v
+	}
+	if v := os.Getenv("MAGIC_LINK_BASE_URL"); v != "" {
+		magicLinkBaseURL = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAGIC_LINK_RATE_LIMIT")); err == nil && v > 0 {
+		magicLinkRateLimit = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAGIC_LINK_IP_RATE_LIMIT")); err == nil && v > 0 {
+		magicLinkIPLimit = v
+	}
+
+	var err error
+	magicLinkEvents, err = meter.Int64Counter(
+		"user.auth.magic_links",
+		metric.WithDescription("Number of sign-in links requested and verified, by outcome"),
+		metric.WithUnit("{link}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create magic links counter", zap.Error(err))
+	}
+}
+
+// accountUserID is the user ID of the email address within tenant.
+func accountUserID(tenant, email string) string {
+	mac := hmac.New(sha256.New, sessionTokens.Secret)
+	mac.Write([]byte(tenant + "/" + email))
+	return "usr_" + hex.EncodeToString(mac.Sum(nil))[:24]
+}
+
+// allowMagicLink counts a link request against the limits of email and ip,
+// returning how long to wait when either is used up.
+func allowMagicLink(tenant, email, ip string, now time.Time) (bool, time.Duration) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+
+	for key, w := range magicLinkRequests {
+		if now.Sub(w.start) >= magicLinkWindow {
+			delete(magicLinkRequests, key)
+		}
+	}
+
+	limits := map[string]int{
+		"email:" + tenant + "/" + email: magicLinkRateLimit,
+		"ip:" + ip:                      magicLinkIPLimit,
+	}
+	for key, limit := range limits {
+		if w, ok := magicLinkRequests[key]; ok && w.count >= limit {
+			return false, w.start.Add(magicLinkWindow).Sub(now)
+		}
+	}
+	for key := range limits {
+		w, ok := magicLinkRequests[key]
+		if !ok {
+			w = &rateWindow{start: now}
+			magicLinkRequests[key] = w
+		}
+		w.count++
+	}
+	return true, 0
+}
+
+// useMagicLink verifies a link token for userID within tenant and marks it
+// used.
+func useMagicLink(token, tenant, userID string, now time.Time) (middleware.SessionClaims, error) {
+	claims, err := magicLinkTokens.Verify(token)
+	if err != nil {
+		return middleware.SessionClaims{}, errMagicLinkInvalid
+	}
+	if claims.Tenant != tenant || claims.Subject != userID || claims.ID == "" {
+		return middleware.SessionClaims{}, errMagicLinkInvalid
+	}
+
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	for id, expiresAt := range usedMagicLinks {
+		if !now.Before(expiresAt) {
+			delete(usedMagicLinks, id)
+		}
+	}
+	if _, used := usedMagicLinks[claims.ID]; used {
+		return middleware.SessionClaims{}, errMagicLinkInvalid
+	}
+	usedMagicLinks[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	return claims, nil
+}
+
+// magicLinkURL is the link that signs userID in with token.
+func magicLinkURL(token, userID string) string {
+	query := url.Values{"token": {token}, "user_id": {userID}}
+	separator := "?"
+	if strings.Contains(magicLinkBaseURL, "?") {
+		separator = "&"
+	}
+	return magicLinkBaseURL + separator + query.Encode()
+}
+
+func deliverMagicLink(to, link string) error {
+	addr := os.Getenv("SMTP_ADDR")
+	from := os.Getenv("SMTP_FROM")
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: Your sign-in link\r\n\r\n", from, to)
+	fmt.Fprintf(&body, "Open this link to sign in:\r\n\r\n  %s\r\n\r\n", link)
+	fmt.Fprintf(&body, "It works once, within %s. If you didn't ask for it, ignore this email.\r\n", magicLinkTTL)
+
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(body.String()))
+}
+
+func recordMagicLink(ctx context.Context, outcome string) {
+	magicLinkEvents.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), telemetry.ContextAttrs(ctx))
+}
+
+// registerAuthRoutes installs the magic-link sign-in endpoints.
+func registerAuthRoutes(r *gin.Engine) {
+	r.POST("/api/v1/auth/magic-link", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req MagicLinkRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		address, err := mail.ParseAddress(req.Email)
+		if err != nil || address.Name != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email must be an email address"})
+			return
+		}
+		if !smtpConfigured() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "email delivery is not configured"})
+			return
+		}
+
+		tenant := telemetry.TenantFromContext(ctx)
+		email := strings.ToLower(address.Address)
+		now := time.Now()
+		if ok, retryAfter := allowMagicLink(tenant, email, c.ClientIP(), now); !ok {
+			recordMagicLink(ctx, "rate_limited")
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many sign-in links requested, try again later"})
+			return
+		}
+
+		userID := accountUserID(tenant, email)
+		token, err := magicLinkTokens.Issue(middleware.SessionClaims{
+			Subject:   userID,
+			Email:     email,
+			Tenant:    tenant,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(magicLinkTTL).Unix(),
+			ID:        randomHex(16),
+		})
+		if err != nil {
+			loggerFor(ctx).Error("Failed to issue sign-in link", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue sign-in link"})
+			return
+		}
+
+		if err := deliverMagicLink(email, magicLinkURL(token, userID)); err != nil {
+			recordMagicLink(ctx, "failed")
+			loggerFor(ctx).Warn("Failed to send sign-in link", zap.String("user_id", userID), zap.Error(err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send sign-in link"})
+			return
+		}
+
+		recordMagicLink(ctx, "sent")
+		loggerFor(ctx).Info("Sign-in link sent", zap.String("user_id", userID))
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":     "sent",
+			"expires_at": now.Add(magicLinkTTL).UTC().Format(time.RFC3339),
+		})
+	})
+
+	r.GET("/api/v1/auth/verify", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		token, userID := c.Query("token"), c.Query("user_id")
+		if token == "" || userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token and user_id are required"})
+			return
+		}
+
+		now := time.Now()
+		claims, err := useMagicLink(token, telemetry.TenantFromContext(ctx), userID, now)
+		if err != nil {
+			recordMagicLink(ctx, "invalid")
+			loggerFor(ctx).Info("Rejected sign-in link", zap.String("user_id", userID), zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired sign-in link"})
+			return
+		}
+
+		expiresAt := now.Add(sessionTTL)
+		session, err := sessionTokens.Issue(middleware.SessionClaims{
+			Subject:   claims.Subject,
+			Email:     claims.Email,
+			Tenant:    claims.Tenant,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		})
+		if err != nil {
+			loggerFor(ctx).Error("Failed to issue session", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+
+		recordMagicLink(ctx, "verified")
+		loggerFor(ctx).Info("User signed in with a magic link", zap.String("user_id", claims.Subject))
+		c.JSON(http.StatusOK, SessionResponse{
+			Token:     session,
+			TokenType: "Bearer",
+			UserID:    claims.Subject,
+			Email:     claims.Email,
+			ExpiresAt: time.Unix(expiresAt.Unix(), 0).UTC(),
+		})
+	})
+}
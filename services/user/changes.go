@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// FavoriteChange is one entry in the favorites change log. Cursors
+// increase monotonically across all tenants and users.
+type FavoriteChange struct {
+	Cursor   int64     `json:"cursor"`
+	Type     string    `json:"type"`
+	Favorite Favorite  `json:"favorite"`
+	At       time.Time `json:"at"`
+}
+
+const (
+	changeAdded   = "added"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+
+	maxChangesPerPage = 500
+)
+
+var (
+	// Change log, oldest first; guarded by favoritesMutex
+	favoriteChanges []FavoriteChange
+	lastCursor      int64
+
+	// changeLogSize bounds the change log; clients whose cursor has been
+	// trimmed away must resync from a full snapshot
+	changeLogSize = 10000
+
+	// changeSignal is closed, and replaced, whenever a change is recorded,
+	// waking the sync streams waiting for one (see sync.go); guarded by
+	// favoritesMutex
+	changeSignal = make(chan struct{})
+)
+
+func initChangeLog() {
+	if v, err := strconv.Atoi(os.Getenv("FAVORITES_CHANGELOG_SIZE")); err == nil && v > 0 {
+		changeLogSize = v
+	}
+}
+
+// recordChange bumps the favorite's version, appends to the change log and
+// queues the user's webhook events (see webhooks.go). Callers must hold
+// favoritesMutex.
+func recordChange(changeType string, fav *Favorite) {
+	now := time.Now()
+	fav.Version++
+	lastCursor++
+	favoriteChanges = append(favoriteChanges, FavoriteChange{
+		Cursor:   lastCursor,
+		Type:     changeType,
+		Favorite: *fav,
+		At:       now,
+	})
+	queueWebhookEvents(changeType, fav, now)
+	close(changeSignal)
+	changeSignal = make(chan struct{})
+	if len(favoriteChanges) > changeLogSize {
+		trimmed := make([]FavoriteChange, changeLogSize)
+		copy(trimmed, favoriteChanges[len(favoriteChanges)-changeLogSize:])
+		favoriteChanges = trimmed
+	}
+}
+
+// nextChange returns a channel that is closed when the next change is
+// recorded.
+func nextChange() <-chan struct{} {
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+	return changeSignal
+}
+
+// favoriteChangesSince returns the user's changes after since, at most
+// limit of them, and the cursor to resume from. ok is false if since is
+// older than the retained log or newer than any change.
+func favoriteChangesSince(ctx context.Context, userID string, since int64, limit int) (changes []FavoriteChange, cursor int64, hasMore, ok bool) {
+	_, span := tracer.Start(ctx, "getFavoriteChanges")
+	defer span.End()
+
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	// A cursor ahead of the log was issued before a restart
+	if since > lastCursor || (len(favoriteChanges) > 0 && since < favoriteChanges[0].Cursor-1) {
+		return nil, lastCursor, false, false
+	}
+
+	tenant := telemetry.TenantFromContext(ctx)
+	changes = []FavoriteChange{}
+	cursor = lastCursor
+	for _, change := range favoriteChanges {
+		if change.Cursor <= since || !change.Favorite.ownedBy(tenant, userID) {
+			continue
+		}
+		if len(changes) == limit {
+			hasMore = true
+			cursor = changes[len(changes)-1].Cursor
+			break
+		}
+		changes = append(changes, change)
+	}
+
+	span.SetAttributes(
+		attribute.Int64("changes.since", since),
+		attribute.Int64("changes.cursor", cursor),
+		attribute.Int("changes.count", len(changes)),
+	)
+	return changes, cursor, hasMore, true
+}
+
+// favoritesSnapshot returns the user's live favorites and the cursor they
+// are current as of, for a client's first sync or a resync.
+func favoritesSnapshot(ctx context.Context, userID string) ([]Favorite, int64) {
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	snapshot := []Favorite{}
+	for _, fav := range favorites {
+		if fav.DeletedAt == nil && fav.ownedBy(tenant, userID) {
+			snapshot = append(snapshot, *fav)
+		}
+	}
+	return snapshot, lastCursor
+}
+
+// changesHandler serves GET /api/v1/favorites/changes. Without since it
+// returns a full snapshot; with since it returns the adds, updates and
+// deletes after that cursor, or 410 if the cursor has expired.
+func changesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID := requestUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+
+	since := c.Query("since")
+	if since == "" {
+		snapshot, cursor := favoritesSnapshot(ctx, userID)
+		c.JSON(http.StatusOK, gin.H{
+			"snapshot":  true,
+			"favorites": snapshot,
+			"cursor":    strconv.FormatInt(cursor, 10),
+		})
+		return
+	}
+
+	sinceCursor, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || sinceCursor < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since cursor"})
+		return
+	}
+
+	limit := maxChangesPerPage
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v < limit {
+		limit = v
+	}
+
+	changes, cursor, hasMore, ok := favoriteChangesSince(ctx, userID, sinceCursor, limit)
+	if !ok {
+		loggerFor(ctx).Info("Expired sync cursor",
+			zap.String("user_id", userID),
+			zap.Int64("since", sinceCursor),
+		)
+		c.JSON(http.StatusGone, gin.H{"error": "cursor expired, resync without since"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"snapshot": false,
+		"changes":  changes,
+		"cursor":   strconv.FormatInt(cursor, 10),
+		"has_more": hasMore,
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Favorites can be deleted in bulk, for cleaning up test accounts without
+// a request per favorite:
+//
+//   - POST /api/v1/favorites:batchDelete with {"ids": [...]} moves up to
+//     maxBatchDelete favorites to the trash and reports a result per ID,
+//     with the status a DELETE of that favorite alone would have had. An
+//     "if_match" object maps IDs to the ETags they must still have; with
+//     FAVORITES_REQUIRE_IF_MATCH=true every ID needs one.
+//   - DELETE /api/v1/favorites?user_id=... moves all of a user's favorites
+//     to the trash. Without ?confirm= it deletes nothing and answers 428
+//     with the number of favorites and a confirmation token, valid for
+//     FAVORITES_CLEAR_CONFIRM_TTL (default 5m); repeating the request with
+//     ?confirm=<token> clears them. Tokens are bound to the tenant and
+//     user and signed with a key derived from AUTH_JWT_SECRET.
+//
+// Both behave like single deletes otherwise: the favorites can be restored
+// from the trash, and each is reported to analytics and webhooks.
+
+// maxBatchDelete bounds the IDs of one batch delete
+const maxBatchDelete = 500
+
+// BatchDeleteRequest is the body of POST /api/v1/favorites:batchDelete.
+type BatchDeleteRequest struct {
+	IDs []string `json:"ids"`
+	// IfMatch maps IDs to the ETag they must still have
+	IfMatch map[string]string `json:"if_match,omitempty"`
+	UserID  string            `json:"user_id,omitempty"`
+}
+
+// BatchDeleteResult is what happened to one favorite of a batch delete.
+type BatchDeleteResult struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Favorite is the favorite as deleted, or as it is now after a 412
+	Favorite *Favorite `json:"favorite,omitempty"`
+}
+
+var (
+	// clearConfirmKey signs clear-all confirmation tokens
+	clearConfirmKey []byte
+	clearConfirmTTL = 5 * time.Minute
+
+	errConfirmInvalid = errors.New("invalid or expired confirmation token")
+)
+
+// initFavoriteCleanup derives the confirmation key from the session
+// secret, so it must run after initAuth.
+func initFavoriteCleanup() {
+	mac := hmac.New(sha256.New, sessionTokens.Secret)
+	mac.Write([]byte("clear-favorites"))
+	clearConfirmKey = mac.Sum(nil)
+
+	if v, err := time.ParseDuration(os.Getenv("FAVORITES_CLEAR_CONFIRM_TTL")); err == nil && v > 0 {
+		clearConfirmTTL = v
+	}
+}
+
+// batchDeleteFavorites moves the listed favorites of userID to the trash,
+// each on its own, and reports them to analytics.
+func batchDeleteFavorites(ctx context.Context, userID string, req BatchDeleteRequest) ([]BatchDeleteResult, int) {
+	ctx, span := tracer.Start(ctx, "batchDeleteFavorites")
+	defer span.End()
+
+	results := make([]BatchDeleteResult, 0, len(req.IDs))
+	deleted := 0
+	seen := map[string]bool{}
+	for _, id := range req.IDs {
+		result := BatchDeleteResult{ID: id}
+		ifMatch, hasIfMatch := req.IfMatch[id]
+		switch {
+		case seen[id]:
+			result.Status, result.Error = http.StatusConflict, "duplicate id in batch"
+		case !hasIfMatch && requireIfMatch:
+			result.Status, result.Error = http.StatusPreconditionRequired, "If-Match is required to change a favorite"
+		default:
+			fav, err := deleteFavorite(ctx, userID, id, ifMatch)
+			switch {
+			case errors.Is(err, errPreconditionFailed):
+				result.Status, result.Error, result.Favorite = http.StatusPreconditionFailed, err.Error(), &fav
+			case err != nil:
+				result.Status, result.Error = http.StatusNotFound, err.Error()
+			default:
+				result.Status, result.Favorite = http.StatusOK, &fav
+				notifyFavoriteDeleted(ctx, fav)
+				deleted++
+			}
+		}
+		seen[id] = true
+		results = append(results, result)
+	}
+
+	span.SetAttributes(
+		attribute.String("favorite.user_id", userID),
+		attribute.Int("batch.size", len(req.IDs)),
+		attribute.Int("batch.deleted", deleted),
+	)
+	loggerFor(ctx).Info("Favorites batch deleted",
+		zap.String("user_id", userID),
+		zap.Int("requested", len(req.IDs)),
+		zap.Int("deleted", deleted),
+	)
+	return results, deleted
+}
+
+// countFavorites returns how many of userID's favorites are not in the
+// trash.
+func countFavorites(ctx context.Context, userID string) int {
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	count := 0
+	for _, fav := range favorites {
+		if fav.DeletedAt == nil && fav.ownedBy(tenant, userID) {
+			count++
+		}
+	}
+	return count
+}
+
+// clearFavorites moves all of userID's favorites to the trash and returns
+// how many it moved.
+func clearFavorites(ctx context.Context, userID string) int {
+	ctx, span := tracer.Start(ctx, "clearFavorites")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	tenant := telemetry.TenantFromContext(ctx)
+	now := time.Now()
+	var cleared []Favorite
+	for _, fav := range favorites {
+		if fav.DeletedAt != nil || !fav.ownedBy(tenant, userID) {
+			continue
+		}
+		fav.DeletedAt = &now
+		delete(favoritesByContent, favoriteContentKey(fav.Tenant, fav.UserID, fav.ContentHash))
+		recordChange(changeDeleted, fav)
+		cleared = append(cleared, *fav)
+	}
+	favoritesMutex.Unlock()
+
+	for _, fav := range cleared {
+		notifyFavoriteDeleted(ctx, fav)
+	}
+
+	span.SetAttributes(
+		attribute.String("favorite.user_id", userID),
+		attribute.Int("favorites.cleared", len(cleared)),
+	)
+	loggerFor(ctx).Info("Favorites cleared",
+		zap.String("user_id", userID),
+		zap.Int("count", len(cleared)),
+	)
+	return len(cleared)
+}
+
+// clearConfirmToken returns the token confirming a clear of userID's
+// favorites in tenant, valid until expires.
+func clearConfirmToken(tenant, userID string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, clearConfirmKey)
+	mac.Write([]byte(tenant + "\x00" + userID + "\x00" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkClearConfirmToken verifies a token from clearConfirmToken.
+func checkClearConfirmToken(token, tenant, userID string) error {
+	exp, _, ok := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || time.Now().Unix() >= unix {
+		return errConfirmInvalid
+	}
+	if !hmac.Equal([]byte(token), []byte(clearConfirmToken(tenant, userID, time.Unix(unix, 0)))) {
+		return errConfirmInvalid
+	}
+	return nil
+}
+
+// registerCleanupRoutes installs the batch delete and clear-all endpoints.
+func registerCleanupRoutes(r *gin.Engine) {
+	// gin has no literal colons in paths, so the custom method is a
+	// parameter holding ":batchDelete"
+	r.POST("/api/v1/favorites:method", func(c *gin.Context) {
+		if c.Param("method") != ":batchDelete" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+
+		var req BatchDeleteRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		userID := requestUserID(c)
+		if userID == "" {
+			userID = req.UserID
+		}
+		switch {
+		case userID == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		case len(req.IDs) == 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+			return
+		case len(req.IDs) > maxBatchDelete:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at most " + strconv.Itoa(maxBatchDelete) + " ids per batch"})
+			return
+		}
+
+		results, deleted := batchDeleteFavorites(c.Request.Context(), userID, req)
+		c.JSON(http.StatusOK, gin.H{
+			"results": results,
+			"deleted": deleted,
+			"failed":  len(results) - deleted,
+		})
+	})
+
+	r.DELETE("/api/v1/favorites", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		tenant := telemetry.TenantFromContext(ctx)
+
+		confirm := c.Query("confirm")
+		if confirm == "" {
+			expires := time.Now().Add(clearConfirmTTL)
+			c.JSON(http.StatusPreconditionRequired, gin.H{
+				"error":              "confirm with the confirmation token to delete all favorites",
+				"count":              countFavorites(ctx, userID),
+				"confirmation_token": clearConfirmToken(tenant, userID, expires),
+				"expires_at":         expires.UTC().Truncate(time.Second),
+			})
+			return
+		}
+		if err := checkClearConfirmToken(confirm, tenant, userID); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"deleted": clearFavorites(ctx, userID)})
+	})
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Users organize their favorites into named collections ("Work talks",
+// "Dad jokes"). A favorite can be in any number of collections; a
+// collection lists favorites by ID in the order they were added. Favorites
+// in the trash stay in their collections but aren't listed, so a restored
+// favorite is back where it was; purged favorites leave them. Collections
+// aren't in the change log and don't trigger webhooks.
+//
+// A collection can be shared: POST /api/v1/collections/:id/share gives it
+// a share token, and anyone with the link can read the collection's jokes,
+// without notes, at GET /api/v1/shared/collections/:token. Sharing again
+// replaces the token, DELETE revokes it. The link names the owner in
+// user_id, as the gateway routes each user to the replica holding their
+// favorites (see the gateway's balance.go).
+
+const (
+	maxCollectionsPerUser        = 100
+	maxCollectionNameLength      = 100
+	maxCollectionDescriptionSize = 500
+)
+
+var (
+	errCollectionNotFound = errors.New("collection not found")
+	errCollectionExists   = errors.New("a collection with this name already exists")
+	errTooManyCollections = fmt.Errorf("a user can have at most %d collections", maxCollectionsPerUser)
+)
+
+// Collection is a named set of a user's favorites.
+type Collection struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// FavoriteIDs are the favorites in the collection, oldest addition
+	// first, including those in the trash
+	FavoriteIDs []string  `json:"favorite_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// ShareToken is set while the collection is shared; ShareURL is the
+	// gateway path of its shared view
+	ShareToken string `json:"share_token,omitempty"`
+	ShareURL   string `json:"share_url,omitempty"`
+	Tenant     string `json:"-"`
+}
+
+// CollectionRequest creates a collection.
+type CollectionRequest struct {
+	UserID      string `json:"user_id"`
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+// SharedFavorite is a joke of a shared collection; notes stay private.
+type SharedFavorite struct {
+	JokeID string `json:"joke_id,omitempty"`
+	Joke   string `json:"joke"`
+}
+
+var (
+	// Collections keyed by ID, and their IDs by share token; guarded by
+	// favoritesMutex
+	collections       = map[string]*Collection{}
+	sharedCollections = map[string]string{}
+)
+
+// findCollection returns the collection with the given ID owned by userID
+// in the tenant carried by ctx. Callers must hold favoritesMutex.
+func findCollection(ctx context.Context, userID, id string) *Collection {
+	col, ok := collections[id]
+	if !ok || col.Tenant != telemetry.TenantFromContext(ctx) || col.UserID != userID {
+		return nil
+	}
+	return col
+}
+
+// collectionFavorites returns the live favorites of a collection, in
+// collection order. Callers must hold favoritesMutex.
+func collectionFavorites(col *Collection) []Favorite {
+	byID := map[string]*Favorite{}
+	for _, fav := range favorites {
+		if fav.ownedBy(col.Tenant, col.UserID) && fav.DeletedAt == nil {
+			byID[fav.ID] = fav
+		}
+	}
+	listed := []Favorite{}
+	for _, id := range col.FavoriteIDs {
+		if fav, ok := byID[id]; ok {
+			listed = append(listed, *fav)
+		}
+	}
+	return listed
+}
+
+// snapshot copies the collection for use without favoritesMutex.
+func (col *Collection) snapshot() Collection {
+	copied := *col
+	copied.FavoriteIDs = slices.Clone(col.FavoriteIDs)
+	return copied
+}
+
+// setShareURL sets the shared view's path for the collection's token.
+func (col *Collection) setShareURL() {
+	col.ShareURL = ""
+	if col.ShareToken != "" {
+		col.ShareURL = "/api/v1/shared/collections/" + col.ShareToken + "?user_id=" + url.QueryEscape(col.UserID)
+	}
+}
+
+// createCollection adds a collection for the user.
+func createCollection(ctx context.Context, req CollectionRequest) (Collection, error) {
+	ctx, span := tracer.Start(ctx, "createCollection")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	owned := 0
+	for _, col := range collections {
+		if col.Tenant != tenant || col.UserID != req.UserID {
+			continue
+		}
+		if strings.EqualFold(col.Name, req.Name) {
+			return col.snapshot(), errCollectionExists
+		}
+		owned++
+	}
+	if owned >= maxCollectionsPerUser {
+		return Collection{}, errTooManyCollections
+	}
+
+	now := time.Now()
+	col := &Collection{
+		ID:          "col_" + randomHex(8),
+		UserID:      req.UserID,
+		Name:        req.Name,
+		Description: req.Description,
+		FavoriteIDs: []string{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Tenant:      tenant,
+	}
+	collections[col.ID] = col
+
+	span.SetAttributes(attribute.String("collection.id", col.ID))
+	loggerFor(ctx).Info("Collection created",
+		zap.String("collection_id", col.ID),
+		zap.String("user_id", col.UserID),
+	)
+	return col.snapshot(), nil
+}
+
+// collectFavorite adds one of the user's favorites to a collection, or
+// with remove set takes it out. Adding a favorite already there, or
+// removing one that isn't, changes nothing.
+func collectFavorite(ctx context.Context, userID, id, favoriteID string, remove bool) (Collection, error) {
+	ctx, span := tracer.Start(ctx, "collectFavorite")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	col := findCollection(ctx, userID, id)
+	if col == nil {
+		return Collection{}, errCollectionNotFound
+	}
+	at := -1
+	for i, collected := range col.FavoriteIDs {
+		if collected == favoriteID {
+			at = i
+			break
+		}
+	}
+
+	switch {
+	case remove && at >= 0:
+		col.FavoriteIDs = append(col.FavoriteIDs[:at], col.FavoriteIDs[at+1:]...)
+		col.UpdatedAt = time.Now()
+	case !remove && at < 0:
+		if fav := findFavorite(ctx, userID, favoriteID); fav == nil || fav.DeletedAt != nil {
+			return col.snapshot(), errFavoriteNotFound
+		}
+		col.FavoriteIDs = append(col.FavoriteIDs, favoriteID)
+		col.UpdatedAt = time.Now()
+	}
+
+	span.SetAttributes(
+		attribute.String("collection.id", col.ID),
+		attribute.String("favorite.id", favoriteID),
+		attribute.Bool("collection.remove", remove),
+	)
+	loggerFor(ctx).Info("Collection updated",
+		zap.String("collection_id", col.ID),
+		zap.String("favorite_id", favoriteID),
+		zap.Bool("removed", remove),
+	)
+	return col.snapshot(), nil
+}
+
+// shareCollection gives a collection a new share token, replacing any
+// previous one, or with revoke set stops sharing it.
+func shareCollection(ctx context.Context, userID, id string, revoke bool) (Collection, error) {
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	col := findCollection(ctx, userID, id)
+	if col == nil {
+		return Collection{}, errCollectionNotFound
+	}
+	delete(sharedCollections, col.ShareToken)
+	col.ShareToken = ""
+	if !revoke {
+		col.ShareToken = randomHex(16)
+		sharedCollections[col.ShareToken] = col.ID
+	}
+	col.setShareURL()
+
+	loggerFor(ctx).Info("Collection sharing changed",
+		zap.String("collection_id", col.ID),
+		zap.Bool("shared", !revoke),
+	)
+	return col.snapshot(), nil
+}
+
+// deleteCollection removes a collection; its favorites are kept.
+func deleteCollection(ctx context.Context, userID, id string) error {
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	col := findCollection(ctx, userID, id)
+	if col == nil {
+		return errCollectionNotFound
+	}
+	delete(sharedCollections, col.ShareToken)
+	delete(collections, col.ID)
+
+	loggerFor(ctx).Info("Collection deleted",
+		zap.String("collection_id", col.ID),
+		zap.String("user_id", userID),
+	)
+	return nil
+}
+
+// dropUserCollections removes every collection of userID in tenant and
+// returns how many there were. Callers must hold favoritesMutex.
+func dropUserCollections(tenant, userID string) int {
+	dropped := 0
+	for id, col := range collections {
+		if col.Tenant == tenant && col.UserID == userID {
+			delete(sharedCollections, col.ShareToken)
+			delete(collections, id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// uncollectFavorite takes a purged favorite out of its owner's
+// collections. Callers must hold favoritesMutex.
+func uncollectFavorite(fav *Favorite) {
+	for _, col := range collections {
+		if col.Tenant != fav.Tenant || col.UserID != fav.UserID {
+			continue
+		}
+		for i, id := range col.FavoriteIDs {
+			if id == fav.ID {
+				col.FavoriteIDs = append(col.FavoriteIDs[:i], col.FavoriteIDs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// mergeCollections moves fromUserID's collections to toUserID, with the
+// favorite IDs the merge changed replaced by renamed. A collection named
+// like one of the target's is merged into it. It returns the number of
+// collections moved or merged. Callers must hold favoritesMutex.
+func mergeCollections(tenant, fromUserID, toUserID string, renamed map[string]string) int {
+	byName := map[string]*Collection{}
+	for _, col := range collections {
+		if col.Tenant == tenant && col.UserID == toUserID {
+			byName[strings.ToLower(col.Name)] = col
+		}
+	}
+
+	merged := 0
+	for id, col := range collections {
+		if col.Tenant != tenant || col.UserID != fromUserID {
+			continue
+		}
+		for i, favoriteID := range col.FavoriteIDs {
+			if newID, ok := renamed[favoriteID]; ok {
+				col.FavoriteIDs[i] = newID
+			}
+		}
+
+		target, ok := byName[strings.ToLower(col.Name)]
+		if !ok {
+			col.UserID = toUserID
+			col.setShareURL()
+			byName[strings.ToLower(col.Name)] = col
+			merged++
+			continue
+		}
+		for _, favoriteID := range col.FavoriteIDs {
+			if !slices.Contains(target.FavoriteIDs, favoriteID) {
+				target.FavoriteIDs = append(target.FavoriteIDs, favoriteID)
+			}
+		}
+		target.UpdatedAt = time.Now()
+		delete(sharedCollections, col.ShareToken)
+		delete(collections, id)
+		merged++
+	}
+	return merged
+}
+
+// userCollections lists the user's collections, oldest first. Callers must
+// hold favoritesMutex.
+func userCollections(tenant, userID string) []Collection {
+	listed := []Collection{}
+	for _, col := range collections {
+		if col.Tenant == tenant && col.UserID == userID {
+			listed = append(listed, col.snapshot())
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].CreatedAt.Before(listed[j].CreatedAt) })
+	return listed
+}
+
+// collectionError answers a failed collection change.
+func collectionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errCollectionExists), errors.Is(err, errTooManyCollections):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	}
+}
+
+// collectHandler serves adding a favorite to a collection, or with remove
+// set taking it out.
+func collectHandler(remove bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		col, err := collectFavorite(c.Request.Context(), userID, c.Param("id"), c.Param("favorite_id"), remove)
+		if err != nil {
+			collectionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, col)
+	}
+}
+
+// shareHandler serves sharing a collection, or with revoke set stopping.
+func shareHandler(revoke bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		col, err := shareCollection(c.Request.Context(), userID, c.Param("id"), revoke)
+		if err != nil {
+			collectionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, col)
+	}
+}
+
+// registerCollectionRoutes installs the collection endpoints and the
+// shared view.
+func registerCollectionRoutes(r *gin.Engine) {
+	r.POST("/api/v1/collections", func(c *gin.Context) {
+		var req CollectionRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+			req.UserID = authenticated
+		}
+		if req.UserID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		req.Description = strings.TrimSpace(req.Description)
+		switch {
+		case req.Name == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		case utf8.RuneCountInString(req.Name) > maxCollectionNameLength:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be at most %d characters", maxCollectionNameLength)})
+			return
+		case utf8.RuneCountInString(req.Description) > maxCollectionDescriptionSize:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("description must be at most %d characters", maxCollectionDescriptionSize)})
+			return
+		}
+
+		col, err := createCollection(c.Request.Context(), req)
+		if err != nil {
+			collectionError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, col)
+	})
+
+	r.GET("/api/v1/collections", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		favoritesMutex.RLock()
+		listed := userCollections(telemetry.TenantFromContext(c.Request.Context()), userID)
+		favoritesMutex.RUnlock()
+
+		c.JSON(http.StatusOK, gin.H{"collections": listed, "count": len(listed)})
+	})
+
+	r.GET("/api/v1/collections/:id", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		favoritesMutex.RLock()
+		col := findCollection(c.Request.Context(), userID, c.Param("id"))
+		var (
+			found  Collection
+			listed []Favorite
+		)
+		if col != nil {
+			found = col.snapshot()
+			listed = collectionFavorites(col)
+		}
+		favoritesMutex.RUnlock()
+
+		if col == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+			return
+		}
+		if c.Query("render") == "html" {
+			renderNotes(listed)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"collection": found,
+			"favorites":  listed,
+			"count":      len(listed),
+		})
+	})
+
+	r.DELETE("/api/v1/collections/:id", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		if err := deleteCollection(c.Request.Context(), userID, c.Param("id")); err != nil {
+			collectionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	})
+
+	r.PUT("/api/v1/collections/:id/favorites/:favorite_id", collectHandler(false))
+	r.DELETE("/api/v1/collections/:id/favorites/:favorite_id", collectHandler(true))
+	r.POST("/api/v1/collections/:id/share", shareHandler(false))
+	r.DELETE("/api/v1/collections/:id/share", shareHandler(true))
+
+	r.GET("/api/v1/shared/collections/:token", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		favoritesMutex.RLock()
+		col, ok := collections[sharedCollections[c.Param("token")]]
+		var (
+			name, description string
+			jokes             []SharedFavorite
+		)
+		if ok && col.Tenant == telemetry.TenantFromContext(ctx) {
+			name, description = col.Name, col.Description
+			for _, fav := range collectionFavorites(col) {
+				jokes = append(jokes, SharedFavorite{JokeID: fav.JokeID, Joke: fav.Joke})
+			}
+		} else {
+			ok = false
+		}
+		favoritesMutex.RUnlock()
+
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+			return
+		}
+		if jokes == nil {
+			jokes = []SharedFavorite{}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"name":        name,
+			"description": description,
+			"jokes":       jokes,
+			"count":       len(jokes),
+		})
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// Subscription is a user's opt-in to periodic joke digests.
+type Subscription struct {
+	UserID     string    `json:"user_id"`
+	Frequency  string    `json:"frequency"`
+	Channel    string    `json:"channel"`
+	Target     string    `json:"target"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSentAt time.Time `json:"last_sent_at"`
+	Tenant     string    `json:"-"`
+}
+
+// subscriptionKey identifies a user's subscription within their tenant.
+func subscriptionKey(tenant, userID string) string {
+	return tenant + "/" + userID
+}
+
+type SubscriptionRequest struct {
+	UserID    string `json:"user_id"`
+	Frequency string `json:"frequency" binding:"required,oneof=daily weekly"`
+	Channel   string `json:"channel" binding:"required,oneof=webhook email"`
+	// Target is the webhook URL or email address
+	Target string `json:"target" binding:"required"`
+}
+
+// Digest is the payload delivered to subscribers.
+type Digest struct {
+	UserID        string        `json:"user_id"`
+	Frequency     string        `json:"frequency"`
+	Since         time.Time     `json:"since"`
+	NewJokes      []string      `json:"new_jokes"`
+	TopFavorites  []TopFavorite `json:"top_favorites"`
+	YourFavorites int           `json:"your_favorites"`
+}
+
+// TopFavorite is a joke and how many users favorited it in the period.
+type TopFavorite struct {
+	JokeID string `json:"joke_id,omitempty"`
+	Joke   string `json:"joke"`
+	Count  int    `json:"count"`
+}
+
+var (
+	// Subscriptions keyed by subscriptionKey
+	subscriptions      map[string]*Subscription
+	subscriptionsMutex sync.Mutex
+
+	digestsSent metric.Int64Counter
+
+	digestJokeCount     = 3
+	digestTopFavorites  = 5
+	digestCheckInterval = 15 * time.Minute
+)
+
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+func initDigests() {
+	subscriptions = make(map[string]*Subscription)
+
+	if v, err := strconv.Atoi(os.Getenv("DIGEST_JOKE_COUNT")); err == nil && v >= 0 {
+		digestJokeCount = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("DIGEST_TOP_FAVORITES")); err == nil && v >= 0 {
+		digestTopFavorites = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("DIGEST_CHECK_INTERVAL")); err == nil && v > 0 {
+		digestCheckInterval = v
+	}
+
+	var err error
+	digestsSent, err = meter.Int64Counter(
+		"user.digests.sent",
+		metric.WithDescription("Number of digest deliveries attempted"),
+		metric.WithUnit("{digest}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create digests counter", zap.Error(err))
+	}
+}
+
+// smtpConfigured reports whether email delivery is available.
+func smtpConfigured() bool {
+	return os.Getenv("SMTP_ADDR") != "" && os.Getenv("SMTP_FROM") != ""
+}
+
+// runDigests periodically sends digests to subscribers whose period has
+// elapsed since their last delivery.
+func runDigests(ctx context.Context) {
+	logger.Info("Digest scheduler started", zap.Duration("interval", digestCheckInterval))
+
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sendDueDigests(ctx)
+		}
+	}
+}
+
+func sendDueDigests(ctx context.Context) {
+	now := time.Now()
+
+	subscriptionsMutex.Lock()
+	var due []Subscription
+	for _, sub := range subscriptions {
+		if now.Sub(sub.LastSentAt) >= digestPeriods[sub.Frequency] {
+			due = append(due, *sub)
+		}
+	}
+	subscriptionsMutex.Unlock()
+
+	for _, sub := range due {
+		if err := sendDigest(ctx, sub, now); err != nil {
+			// Retried on the next tick
+			continue
+		}
+
+		subscriptionsMutex.Lock()
+		if current, ok := subscriptions[subscriptionKey(sub.Tenant, sub.UserID)]; ok {
+			current.LastSentAt = now
+		}
+		subscriptionsMutex.Unlock()
+	}
+}
+
+func sendDigest(ctx context.Context, sub Subscription, now time.Time) error {
+	ctx, span := tracer.Start(telemetry.WithTenant(ctx, sub.Tenant), "sendDigest")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("digest.user_id", sub.UserID),
+		attribute.String("digest.frequency", sub.Frequency),
+		attribute.String("digest.channel", sub.Channel),
+	)
+
+	digest := buildDigest(ctx, sub, now)
+
+	var err error
+	switch sub.Channel {
+	case "webhook":
+		err = deliverWebhook(ctx, sub.Target, digest)
+	case "email":
+		err = deliverEmail(sub.Target, digest)
+	}
+
+	digestsSent.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("channel", sub.Channel),
+		attribute.Bool("success", err == nil),
+	), telemetry.ContextAttrs(ctx))
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		loggerFor(ctx).Warn("Digest delivery failed",
+			zap.String("user_id", sub.UserID),
+			zap.String("channel", sub.Channel),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	loggerFor(ctx).Info("Digest sent",
+		zap.String("user_id", sub.UserID),
+		zap.String("channel", sub.Channel),
+		zap.Int("new_jokes", len(digest.NewJokes)),
+		zap.Int("top_favorites", len(digest.TopFavorites)),
+	)
+	return nil
+}
+
+// buildDigest collects fresh jokes from the jokes service and the jokes
+// most favorited in the subscriber's tenant since their last digest.
+func buildDigest(ctx context.Context, sub Subscription, now time.Time) Digest {
+	digest := Digest{
+		UserID:       sub.UserID,
+		Frequency:    sub.Frequency,
+		Since:        sub.LastSentAt,
+		NewJokes:     []string{},
+		TopFavorites: []TopFavorite{},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < digestJokeCount; i++ {
+		joke, err := fetchJoke(ctx, sub.UserID)
+		if err != nil {
+			loggerFor(ctx).Warn("Failed to fetch digest joke", zap.Error(err))
+			break
+		}
+		if !seen[joke] {
+			seen[joke] = true
+			digest.NewJokes = append(digest.NewJokes, joke)
+		}
+	}
+
+	favoritesMutex.RLock()
+	counts := map[string]*TopFavorite{}
+	for _, fav := range favorites {
+		if fav.Tenant != sub.Tenant || fav.DeletedAt != nil {
+			continue
+		}
+		if fav.UserID == sub.UserID {
+			digest.YourFavorites++
+		}
+		if fav.CreatedAt.Before(sub.LastSentAt) || fav.CreatedAt.After(now) {
+			continue
+		}
+		if top, ok := counts[fav.ContentHash]; ok {
+			top.Count++
+			if top.JokeID == "" {
+				top.JokeID = fav.JokeID
+			}
+		} else {
+			counts[fav.ContentHash] = &TopFavorite{JokeID: fav.JokeID, Joke: fav.Joke, Count: 1}
+		}
+	}
+	favoritesMutex.RUnlock()
+
+	for _, top := range counts {
+		digest.TopFavorites = append(digest.TopFavorites, *top)
+	}
+	sort.Slice(digest.TopFavorites, func(i, j int) bool {
+		return digest.TopFavorites[i].Count > digest.TopFavorites[j].Count
+	})
+	if len(digest.TopFavorites) > digestTopFavorites {
+		digest.TopFavorites = digest.TopFavorites[:digestTopFavorites]
+	}
+
+	return digest
+}
+
+// fetchJoke gets a joke from the jokes service on behalf of the user, so
+// its repeat avoidance applies across the digest.
+func fetchJoke(ctx context.Context, userID string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+jokesServiceAddr()+"/api/v1/joke", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(userIDHeader, userID)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("jokes service returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Joke string `json:"joke"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Joke, nil
+}
+
+func deliverWebhook(ctx context.Context, target string, digest Digest) error {
+	payload, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The target is the user's, so it gets the webhook client's guards
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func deliverEmail(to string, digest Digest) error {
+	addr := os.Getenv("SMTP_ADDR")
+	from := os.Getenv("SMTP_FROM")
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: Your %s joke digest\r\n\r\n", from, to, digest.Frequency)
+	body.WriteString("New jokes:\r\n")
+	for _, joke := range digest.NewJokes {
+		fmt.Fprintf(&body, "  - %s\r\n", joke)
+	}
+	body.WriteString("\r\nMost favorited:\r\n")
+	for _, top := range digest.TopFavorites {
+		fmt.Fprintf(&body, "  - %s (%d)\r\n", top.Joke, top.Count)
+	}
+	fmt.Fprintf(&body, "\r\nYou have %d favorite jokes.\r\n", digest.YourFavorites)
+
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(body.String()))
+}
+
+// registerSubscriptionRoutes installs the digest subscription endpoints.
+func registerSubscriptionRoutes(r *gin.Engine) {
+	r.POST("/api/v1/subscriptions", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req SubscriptionRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+			req.UserID = authenticated
+		}
+		if req.UserID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		switch req.Channel {
+		case "webhook":
+			if err := checkWebhookURL(c.Request.Context(), req.Target); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		case "email":
+			if !smtpConfigured() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "email delivery is not configured"})
+				return
+			}
+			if !strings.Contains(req.Target, "@") {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "email target must be an email address"})
+				return
+			}
+		}
+
+		now := time.Now()
+		sub := &Subscription{
+			UserID:     req.UserID,
+			Frequency:  req.Frequency,
+			Channel:    req.Channel,
+			Target:     req.Target,
+			CreatedAt:  now,
+			LastSentAt: now,
+			Tenant:     telemetry.TenantFromContext(ctx),
+		}
+		key := subscriptionKey(sub.Tenant, sub.UserID)
+
+		subscriptionsMutex.Lock()
+		_, existed := subscriptions[key]
+		subscriptions[key] = sub
+		subscriptionsMutex.Unlock()
+
+		loggerFor(ctx).Info("Digest subscription saved",
+			zap.String("user_id", sub.UserID),
+			zap.String("frequency", sub.Frequency),
+			zap.String("channel", sub.Channel),
+		)
+
+		status := http.StatusCreated
+		if existed {
+			status = http.StatusOK
+		}
+		c.JSON(status, sub)
+	})
+
+	r.DELETE("/api/v1/subscriptions", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		key := subscriptionKey(telemetry.TenantFromContext(ctx), userID)
+
+		subscriptionsMutex.Lock()
+		_, existed := subscriptions[key]
+		delete(subscriptions, key)
+		subscriptionsMutex.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+			return
+		}
+
+		loggerFor(ctx).Info("Digest subscription removed", zap.String("user_id", userID))
+		c.JSON(http.StatusOK, gin.H{"status": "unsubscribed"})
+	})
+}
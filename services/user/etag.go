@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Favorites carry a version, starting at 1 and bumped by every change
+// recorded for them: a note set or removed, a delete, a restore or a
+// merge. Responses about a single favorite send it as the ETag, and the
+// favorites list has it in each favorite's version.
+//
+// Requests that change a favorite (deleting or restoring it, setting or
+// removing its note) may send If-Match with the ETag they last saw; when
+// the favorite has changed since, they fail with 412 and the current
+// favorite, instead of overwriting an edit made from another device. With
+// FAVORITES_REQUIRE_IF_MATCH=true, such requests without If-Match are
+// rejected with 428. Changes through the sync stream (see sync.go) are
+// applied in the order they arrive and don't check versions.
+
+var errPreconditionFailed = errors.New("favorite has been modified")
+
+// requireIfMatch rejects changes to favorites that don't send If-Match
+var requireIfMatch bool
+
+func initETags() {
+	requireIfMatch, _ = strconv.ParseBool(os.Getenv("FAVORITES_REQUIRE_IF_MATCH"))
+}
+
+// favoriteETag is the entity tag of a favorite's current version.
+func favoriteETag(fav Favorite) string {
+	return `"` + strconv.FormatInt(fav.Version, 10) + `"`
+}
+
+// etagMatches reports whether an If-Match header value matches the
+// favorite: empty and "*" match any version. Weak tags are compared by
+// their value, since versions change with every edit.
+func etagMatches(ifMatch string, fav *Favorite) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	current := favoriteETag(*fav)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIfMatch returns the request's If-Match header. It responds with
+// 428 and returns false when the header is required and missing.
+func requestIfMatch(c *gin.Context) (string, bool) {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" && requireIfMatch {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required to change a favorite"})
+		return "", false
+	}
+	return ifMatch, true
+}
+
+// respondFavorite sends fav with its ETag.
+func respondFavorite(c *gin.Context, status int, body interface{}, fav Favorite) {
+	c.Header("ETag", favoriteETag(fav))
+	c.JSON(status, body)
+}
+
+// respondPreconditionFailed sends 412 with the favorite as it is now, so
+// the client can reconcile the edits and retry with its ETag.
+func respondPreconditionFailed(c *gin.Context, fav Favorite) {
+	respondFavorite(c, http.StatusPreconditionFailed, gin.H{
+		"error":    errPreconditionFailed.Error(),
+		"favorite": fav,
+	}, fav)
+}
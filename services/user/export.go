@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/favorites/export downloads the user's favorites with their
+// notes, oldest first, as a file: JSON (the default), CSV for
+// spreadsheets, or markdown for pasting into slides and documents, where
+// each joke is a section followed by its note as written. With
+// ?render=html the JSON export also has each note rendered to HTML.
+
+// exportFormats are the export formats and their content types
+var exportFormats = map[string]string{
+	"json":     "application/json; charset=utf-8",
+	"csv":      "text/csv; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+}
+
+// exportExtensions are the file extensions of the export formats
+var exportExtensions = map[string]string{
+	"json":     "json",
+	"csv":      "csv",
+	"markdown": "md",
+}
+
+// favoritesCSV writes favorites as CSV with a header row.
+func favoritesCSV(favs []Favorite) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "joke_id", "joke", "created_at", "note", "note_updated_at"})
+	for _, fav := range favs {
+		noteUpdatedAt := ""
+		if fav.NoteUpdatedAt != nil {
+			noteUpdatedAt = fav.NoteUpdatedAt.UTC().Format(time.RFC3339)
+		}
+		w.Write([]string{
+			fav.ID,
+			fav.JokeID,
+			fav.Joke,
+			fav.CreatedAt.UTC().Format(time.RFC3339),
+			fav.Note,
+			noteUpdatedAt,
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// favoritesMarkdown writes favorites as a markdown document.
+func favoritesMarkdown(userID string, favs []Favorite, exportedAt time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Favorite jokes of %s\n\n", userID)
+	fmt.Fprintf(&b, "%d favorites, exported %s.\n", len(favs), exportedAt.UTC().Format(time.RFC3339))
+	for i, fav := range favs {
+		fmt.Fprintf(&b, "\n## %d. %s\n\n", i+1, strings.Join(strings.Fields(fav.Joke), " "))
+		fmt.Fprintf(&b, "Favorited %s", fav.CreatedAt.UTC().Format(time.DateOnly))
+		if fav.JokeID != "" {
+			fmt.Fprintf(&b, " (%s)", fav.JokeID)
+		}
+		b.WriteString("\n")
+		if fav.Note != "" {
+			b.WriteString("\n" + fav.Note + "\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// registerExportRoutes installs the favorites export endpoint.
+func registerExportRoutes(r *gin.Engine) {
+	r.GET("/api/v1/favorites/export", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		format := c.DefaultQuery("format", "json")
+		contentType, ok := exportFormats[format]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, csv or markdown"})
+			return
+		}
+
+		favs := getFavorites(ctx, userID)
+		if favs == nil {
+			favs = []Favorite{}
+		}
+		exportedAt := time.Now()
+
+		var body []byte
+		switch format {
+		case "csv":
+			body = favoritesCSV(favs)
+		case "markdown":
+			body = favoritesMarkdown(userID, favs, exportedAt)
+		default:
+			if c.Query("render") == "html" {
+				renderNotes(favs)
+			}
+			var err error
+			body, err = json.MarshalIndent(gin.H{
+				"user_id":     userID,
+				"exported_at": exportedAt.UTC().Format(time.RFC3339),
+				"favorites":   favs,
+				"count":       len(favs),
+			}, "", "  ")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode export"})
+				return
+			}
+		}
+
+		loggerFor(ctx).Info("Favorites exported",
+			zap.String("user_id", userID),
+			zap.String("format", format),
+			zap.Int("count", len(favs)),
+		)
+
+		filename := fmt.Sprintf("favorites-%s.%s", exportedAt.UTC().Format("20060102"), exportExtensions[format])
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Data(http.StatusOK, contentType, body)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var errJokeNotFound = errors.New("joke not found")
+
+// jokesServiceAddr is the host of the jokes service.
+func jokesServiceAddr() string {
+	if addr := os.Getenv("JOKES_SERVICE_URL"); addr != "" {
+		return addr
+	}
+	return telemetry.ClusterServiceAddr("jokes-service")
+}
+
+// lookupJoke returns the text of a joke by its stable ID.
+func lookupJoke(ctx context.Context, jokeID string) (string, error) {
+	ctx, span := tracer.Start(ctx, "lookupJoke")
+	defer span.End()
+	span.SetAttributes(attribute.String("joke.id", jokeID))
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+jokesServiceAddr()+"/api/v1/jokes/"+url.PathEscape(jokeID), nil)
+	if err != nil {
+		return "", err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errJokeNotFound
+	default:
+		err := fmt.Errorf("jokes service returned status %d", resp.StatusCode)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	var body struct {
+		Joke string `json:"joke"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Joke, nil
+}
@@ -1,23 +1,76 @@
 // User Service - Manages user preferences and favorites
 // Routes:
 //   GET /healthz              -> health check
-//   POST /api/v1/favorite     -> add a favorite joke
+//   POST /api/v1/favorites    -> add a favorite joke (POST /api/v1/favorite is
+//                                the deprecated path of the same endpoint)
 //   GET /api/v1/favorites     -> get all favorite jokes
+//   DELETE /api/v1/favorites/:id        -> move a favorite to the trash
+//   DELETE /api/v1/favorites            -> move all of a user's favorites to the trash,
+//                                          once confirmed (see cleanup.go)
+//   POST /api/v1/favorites:batchDelete  -> move up to 500 favorites to the trash, with a
+//                                          result per ID
+//   GET /api/v1/favorites/:id/note      -> a favorite's note, optionally rendered to HTML
+//   PUT /api/v1/favorites/:id/note      -> set a favorite's markdown note
+//   DELETE /api/v1/favorites/:id/note   -> remove a favorite's note
+//   GET /api/v1/favorites/export        -> download favorites and notes as JSON, CSV or markdown
+//   GET /api/v1/favorites/trash         -> list deleted favorites
+//   POST /api/v1/favorites/:id/restore  -> restore a favorite from the trash
+//   GET /api/v1/favorites/changes       -> incremental adds/updates/deletes since a cursor
+//   GET /api/v1/favorites/stats         -> favorite count, first/last and per-day histogram
+//   GET /api/v1/favorites/search        -> ranked full-text search of jokes and notes (see search.go)
+//   POST /api/v1/collections            -> create a named collection of favorites
+//   GET /api/v1/collections             -> list a user's collections
+//   GET /api/v1/collections/:id         -> a collection and its favorites
+//   DELETE /api/v1/collections/:id      -> remove a collection, keeping its favorites
+//   PUT/DELETE /api/v1/collections/:id/favorites/:favorite_id -> add or remove a favorite
+//   POST/DELETE /api/v1/collections/:id/share -> share a collection, or stop sharing it
+//   GET /api/v1/shared/collections/:token     -> a shared collection's jokes (see collections.go)
+//   POST /api/v1/subscriptions          -> subscribe to joke digests
+//   DELETE /api/v1/subscriptions        -> unsubscribe from joke digests
+//   POST /api/v1/users/merge/token      -> a token letting the user's data be merged into
+//                                          another user
+//   POST /api/v1/users/merge            -> move a user's favorites and subscription to another user,
+//                                          given the source's merge token (see merge.go)
+//   GET /api/v1/users/merges            -> merges into or out of a user (audit log)
+//   POST /api/v1/webhooks               -> register a webhook for favorite events
+//   GET /api/v1/webhooks                -> list a user's webhooks
+//   DELETE /api/v1/webhooks/:id         -> remove a webhook
+//   GET /api/v1/webhooks/dead-letters   -> webhook deliveries given up on
+//   GET /api/v1/users/:id/data          -> everything stored about a user
+//   DELETE /api/v1/users/:id/data       -> erase a user's data (see userdata.go)
+//   GET|PUT|DELETE /api/v1/users/:id/preferences -> joke delivery preferences (see preferences.go)
+//   POST /api/v1/auth/magic-link        -> email a one-time sign-in link
+//   GET /api/v1/auth/verify             -> exchange a sign-in link for a session token (see auth.go)
+//
+// Changes to a favorite honor If-Match against its version (see etag.go).
+//
+// gRPC (GRPC_PORT):
+//   FavoritesSync/SyncFavorites -> two-way favorites sync stream (see sync.go)
+//
+// Favorites and subscriptions are partitioned by the tenant in the request
+// baggage set by the gateway (see telemetry.TenantOf). Favorites added and
+// deleted and user merges are reported to the analytics service (see
+// analytics.go).
 
 package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"github.com/navyn13/microservice-joke/pkg/ids"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -25,7 +78,6 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -35,33 +87,84 @@ var (
 	favoritesCount  metric.Int64Counter
 	
 	// In-memory storage (in production, use a database)
-	favorites      []Favorite
+	favorites      []*Favorite
 	favoritesMutex sync.RWMutex
+
+	// Index of live (not deleted) favorites by tenant, user and joke content
+	// hash, for dedupe
+	favoritesByContent map[string]*Favorite
 )
 
+// Favorite is a joke a user saved. JokeID is the jokes service's stable
+// ID and Joke keeps the text for display; favorites added by text alone
+// have no JokeID.
 type Favorite struct {
-	ID        string    `json:"id"`
-	Joke      string    `json:"joke"`
-	UserID    string    `json:"user_id"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        string     `json:"id"`
+	JokeID    string     `json:"joke_id,omitempty"`
+	Joke      string     `json:"joke"`
+	UserID    string     `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version is bumped by every change to the favorite (see etag.go)
+	Version int64 `json:"version"`
+	// Note is the user's markdown annotation (see notes.go); NoteHTML is
+	// only set on responses that asked for it rendered
+	Note          string     `json:"note,omitempty"`
+	NoteUpdatedAt *time.Time `json:"note_updated_at,omitempty"`
+	NoteHTML      string     `json:"note_html,omitempty"`
+	ContentHash   string     `json:"-"`
+	// Tenant partitions favorites; users of different tenants never see
+	// each other's favorites
+	Tenant string `json:"-"`
+}
+
+// ownedBy reports whether the favorite belongs to userID within tenant.
+func (f *Favorite) ownedBy(tenant, userID string) bool {
+	return f.Tenant == tenant && f.UserID == userID
 }
 
+// FavoriteResponse is returned when adding a favorite; AlreadyFavorited is
+// set when the user had already favorited the same joke.
+type FavoriteResponse struct {
+	Favorite
+	AlreadyFavorited bool `json:"already_favorited"`
+}
+
+// FavoriteRequest needs joke_id or joke; given only the ID, the text is
+// looked up in the jokes service.
 type FavoriteRequest struct {
-	Joke   string `json:"joke" binding:"required"`
-	UserID string `json:"user_id" binding:"required"`
+	JokeID string `json:"joke_id"`
+	Joke   string `json:"joke"`
+	UserID string `json:"user_id"`
+}
+
+// userIDHeader carries the user ID the gateway authenticated; when present
+// it takes precedence over any user_id supplied by the client.
+const userIDHeader = "X-User-ID"
+
+// requestUserID returns the authenticated user ID, falling back to the
+// user_id query parameter.
+func requestUserID(c *gin.Context) string {
+	if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+		return authenticated
+	}
+	return c.Query("user_id")
 }
 
 func initLogger() {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	var err error
-	logger, err = config.Build()
+	logger, err = telemetry.NewLogger()
 	if err != nil {
 		panic(err)
 	}
 }
 
+// loggerFor returns the service logger bound to ctx (see
+// telemetry.LoggerFor).
+func loggerFor(ctx context.Context) *zap.Logger {
+	return telemetry.LoggerFor(ctx, logger)
+}
+
 func initTracer() func() {
 	ctx := context.Background()
 
@@ -70,13 +173,7 @@ func initTracer() func() {
 		signozEndpoint = "signoz-otel-collector.platform.svc.cluster.local:4317"
 	}
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(signozEndpoint),
-		otlptracegrpc.WithInsecure(),
-	)
-	if err != nil {
-		logger.Fatal("Failed to create trace exporter", zap.Error(err))
-	}
+	exporter := telemetry.NewSpanExporter(signozEndpoint)
 
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
@@ -84,6 +181,7 @@ func initTracer() func() {
 			semconv.ServiceVersion("1.0.0"),
 			attribute.String("environment", "production"),
 		),
+		resource.WithAttributes(telemetry.K8sResourceAttributes()...),
 	)
 	if err != nil {
 		logger.Fatal("Failed to create resource", zap.Error(err))
@@ -92,7 +190,8 @@ func initTracer() func() {
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(telemetry.ContextSpanProcessor{}),
+		sdktrace.WithSampler(telemetry.NewSampler(telemetry.IsAnalyticsSpan)),
 	)
 
 	otel.SetTracerProvider(tp)
@@ -103,10 +202,19 @@ func initTracer() func() {
 
 	tracer = tp.Tracer("user-service")
 
+	exported, lp, err := telemetry.ExportLogs(logger, "user-service", signozEndpoint, res)
+	if err != nil {
+		logger.Fatal("Failed to create log export core", zap.Error(err))
+	}
+	logger = exported
+
 	return func() {
 		if err := tp.Shutdown(ctx); err != nil {
 			logger.Error("Error shutting down tracer provider", zap.Error(err))
 		}
+		if err := lp.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down logger provider", zap.Error(err))
+		}
 	}
 }
 
@@ -124,22 +232,60 @@ func initMetrics() {
 	}
 }
 
-func addFavorite(ctx context.Context, req FavoriteRequest) Favorite {
-	_, span := tracer.Start(ctx, "addFavorite")
+// jokeContentHash hashes the joke text after normalizing case and whitespace,
+// so trivially different copies of the same joke are treated as equal.
+func jokeContentHash(joke string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(joke)), " ")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func favoriteContentKey(tenant, userID, hash string) string {
+	return tenant + "/" + userID + "/" + hash
+}
+
+// addFavorite stores a favorite, returning the existing record and false
+// if the user has already favorited the same joke.
+func addFavorite(ctx context.Context, req FavoriteRequest) (Favorite, bool) {
+	ctx, span := tracer.Start(ctx, "addFavorite")
 	defer span.End()
 
 	favoritesMutex.Lock()
 	defer favoritesMutex.Unlock()
 
-	fav := Favorite{
-		ID:        time.Now().Format("20060102150405"),
-		Joke:      req.Joke,
-		UserID:    req.UserID,
-		CreatedAt: time.Now(),
+	tenant := telemetry.TenantFromContext(ctx)
+	hash := jokeContentHash(req.Joke)
+	key := favoriteContentKey(tenant, req.UserID, hash)
+
+	if existing, ok := favoritesByContent[key]; ok {
+		span.SetAttributes(
+			attribute.String("favorite.id", existing.ID),
+			attribute.String("favorite.user_id", existing.UserID),
+			attribute.Bool("favorite.duplicate", true),
+		)
+
+		loggerFor(ctx).Info("Favorite already exists",
+			zap.String("favorite_id", existing.ID),
+			zap.String("user_id", existing.UserID),
+		)
+
+		return *existing, false
+	}
+
+	fav := &Favorite{
+		ID:          ids.New(),
+		JokeID:      req.JokeID,
+		Joke:        req.Joke,
+		UserID:      req.UserID,
+		CreatedAt:   time.Now(),
+		ContentHash: hash,
+		Tenant:      tenant,
 	}
 
 	favorites = append(favorites, fav)
-	favoritesCount.Add(ctx, 1)
+	favoritesByContent[key] = fav
+	recordChange(changeAdded, fav)
+	favoritesCount.Add(ctx, 1, telemetry.ContextAttrs(ctx))
 
 	span.SetAttributes(
 		attribute.String("favorite.id", fav.ID),
@@ -147,27 +293,30 @@ func addFavorite(ctx context.Context, req FavoriteRequest) Favorite {
 		attribute.Int("favorites.total", len(favorites)),
 	)
 
-	logger.Info("Favorite added",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	loggerFor(ctx).Info("Favorite added",
 		zap.String("favorite_id", fav.ID),
 		zap.String("user_id", fav.UserID),
 		zap.Int("total_favorites", len(favorites)),
 	)
 
-	return fav
+	return *fav, true
 }
 
 func getFavorites(ctx context.Context, userID string) []Favorite {
-	_, span := tracer.Start(ctx, "getFavorites")
+	ctx, span := tracer.Start(ctx, "getFavorites")
 	defer span.End()
 
 	favoritesMutex.RLock()
 	defer favoritesMutex.RUnlock()
 
+	tenant := telemetry.TenantFromContext(ctx)
 	var userFavorites []Favorite
 	for _, fav := range favorites {
+		if fav.Tenant != tenant || fav.DeletedAt != nil {
+			continue
+		}
 		if userID == "" || fav.UserID == userID {
-			userFavorites = append(userFavorites, fav)
+			userFavorites = append(userFavorites, *fav)
 		}
 	}
 
@@ -176,8 +325,7 @@ func getFavorites(ctx context.Context, userID string) []Favorite {
 		attribute.Int("results.count", len(userFavorites)),
 	)
 
-	logger.Info("Favorites retrieved",
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	loggerFor(ctx).Info("Favorites retrieved",
 		zap.String("user_id", userID),
 		zap.Int("count", len(userFavorites)),
 	)
@@ -188,60 +336,132 @@ func getFavorites(ctx context.Context, userID string) []Favorite {
 func main() {
 	initLogger()
 	defer logger.Sync()
+	telemetry.InitRuntimeConfig()
 
 	shutdown := initTracer()
 	defer shutdown()
 
 	initMetrics()
-
-	favorites = make([]Favorite, 0)
-
-	r := gin.Default()
-	r.Use(otelgin.Middleware("user-service"))
+	initDigests()
+	initChangeLog()
+	initAnalytics()
+	analyticsOverOTLP = telemetry.AnalyticsOverOTLP()
+	initWebhooks()
+	initNotes()
+	initSync()
+	initUserData()
+	initETags()
+	initAuth()
+	initFavoriteCleanup()
+	initMerges()
+
+	favorites = make([]*Favorite, 0)
+	favoritesByContent = make(map[string]*Favorite)
+
+	// Background jobs run until main returns
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go runTrashPurge(bgCtx)
+	go runDigests(bgCtx)
+
+	r := gin.New()
+	// Accept HTTP/2 without TLS from the gateway (BACKEND_HTTP2)
+	r.UseH2C = true
+	r.Use(middleware.Default("user-service",
+		middleware.WithLogger(loggerFor),
+		middleware.WithMetricAttributes(telemetry.ContextAttrs),
+	)...)
+	r.Use(telemetry.TenantMiddleware())
 
 	r.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"status": "healthy",
-			"service": "user-service",
+			"status":    "healthy",
+			"service":   "user-service",
 			"timestamp": time.Now().Format(time.RFC3339),
 		})
 	})
 
-	r.POST("/api/v1/favorite", func(c *gin.Context) {
+	addFavoriteHandler := func(c *gin.Context) {
 		ctx := c.Request.Context()
-		span := trace.SpanFromContext(ctx)
 
 		var req FavoriteRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			logger.Error("Invalid request",
-				zap.String("trace_id", span.SpanContext().TraceID().String()),
-				zap.Error(err),
-			)
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !middleware.BindJSON(c, &req) {
+			loggerFor(ctx).Warn("Invalid request")
+			return
+		}
+		if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+			req.UserID = authenticated
+		}
+		if req.UserID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		if req.JokeID == "" && req.Joke == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "joke_id or joke is required"})
 			return
 		}
 
-		logger.Info("Favorite request received",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		loggerFor(ctx).Info("Favorite request received",
 			zap.String("user_id", req.UserID),
+			zap.String("joke_id", req.JokeID),
 		)
 
-		favorite := addFavorite(ctx, req)
-		c.JSON(http.StatusCreated, favorite)
-	})
+		if req.Joke == "" {
+			joke, err := lookupJoke(ctx, req.JokeID)
+			if errors.Is(err, errJokeNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Joke not found"})
+				return
+			}
+			if err != nil {
+				loggerFor(ctx).Warn("Failed to look up joke",
+					zap.String("joke_id", req.JokeID),
+					zap.Error(err),
+				)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to look up joke"})
+				return
+			}
+			req.Joke = joke
+		}
+
+		favorite, created := addFavorite(ctx, req)
+		if !created {
+			respondFavorite(c, http.StatusOK, FavoriteResponse{Favorite: favorite, AlreadyFavorited: true}, favorite)
+			return
+		}
+		notifyFavoriteAdded(ctx, favorite)
+		respondFavorite(c, http.StatusCreated, FavoriteResponse{Favorite: favorite}, favorite)
+	}
+	r.POST("/api/v1/favorites", addFavoriteHandler)
+	r.POST("/api/v1/favorite", addFavoriteHandler)
+
+	registerTrashRoutes(r)
+	registerSubscriptionRoutes(r)
+	registerMergeRoutes(r)
+	registerWebhookRoutes(r)
+	registerNoteRoutes(r)
+	registerExportRoutes(r)
+	registerUserDataRoutes(r)
+	registerPreferencesRoutes(r)
+	registerCollectionRoutes(r)
+	registerAuthRoutes(r)
+	registerCleanupRoutes(r)
+	r.GET("/api/v1/favorites/changes", changesHandler)
+	r.GET("/api/v1/favorites/stats", statsHandler)
+	r.GET("/api/v1/favorites/search", searchHandler)
 
 	r.GET("/api/v1/favorites", func(c *gin.Context) {
 		ctx := c.Request.Context()
-		span := trace.SpanFromContext(ctx)
 
-		userID := c.Query("user_id")
+		userID := requestUserID(c)
 
-		logger.Info("Favorites list requested",
-			zap.String("trace_id", span.SpanContext().TraceID().String()),
+		loggerFor(ctx).Info("Favorites list requested",
 			zap.String("user_id", userID),
 		)
 
 		userFavorites := getFavorites(ctx, userID)
+		if c.Query("render") == "html" {
+			renderNotes(userFavorites)
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"favorites": userFavorites,
 			"count":     len(userFavorites),
@@ -253,9 +473,10 @@ func main() {
 		port = "8083"
 	}
 
+	go serveSync()
+
 	logger.Info("Starting User Service", zap.String("port", port))
 	if err := r.Run(":" + port); err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
 	}
 }
-
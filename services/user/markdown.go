@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Notes are rendered from a small markdown subset: paragraphs, headings,
+// bullet and numbered lists, block quotes, fenced code blocks, and inline
+// bold, italics, code and links. Rendering is safe by construction: every
+// character of the note is HTML-escaped, the only tags in the output are
+// the ones the renderer writes, and links are kept only for http, https
+// and mailto URLs. There is no raw HTML passthrough.
+
+var (
+	headingPattern     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletPattern      = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	numberedPattern    = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+	quotePattern       = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	linkPattern        = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	boldPattern        = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	italicPattern      = regexp.MustCompile(`\*([^*\n]+)\*|\b_([^_\n]+)_\b`)
+	placeholderPattern = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdown renders a note to sanitized HTML.
+func renderMarkdown(src string) string {
+	// NUL delimits the placeholders of rendered inline elements
+	src = strings.ReplaceAll(src, "\x00", "")
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+
+	var out strings.Builder
+	var paragraph []string
+	list := ""
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInlineLines(paragraph) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+
+		case headingPattern.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			m := headingPattern.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			out.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+
+		case bulletPattern.MatchString(line):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(bulletPattern.FindStringSubmatch(line)[1]) + "</li>\n")
+
+		case numberedPattern.MatchString(line):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(numberedPattern.FindStringSubmatch(line)[1]) + "</li>\n")
+
+		case quotePattern.MatchString(line):
+			flushParagraph()
+			closeList()
+			var quoted []string
+			for ; i < len(lines) && quotePattern.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quotePattern.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			out.WriteString("<blockquote><p>" + renderInlineLines(quoted) + "</p></blockquote>\n")
+
+		default:
+			closeList()
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	closeList()
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// renderInlineLines renders the lines of a paragraph, keeping the line
+// breaks.
+func renderInlineLines(lines []string) string {
+	rendered := make([]string, len(lines))
+	for i, line := range lines {
+		rendered[i] = renderInline(line)
+	}
+	return strings.Join(rendered, "<br>\n")
+}
+
+// renderInline renders inline markdown in one line of text. Code spans and
+// links are rendered first and set aside as placeholders, so emphasis
+// markers inside them are left alone.
+func renderInline(text string) string {
+	var rendered []string
+	hold := func(s string) string {
+		rendered = append(rendered, s)
+		return "\x00" + strconv.Itoa(len(rendered)-1) + "\x00"
+	}
+
+	// Code spans: text between pairs of backticks
+	var b strings.Builder
+	parts := strings.Split(text, "`")
+	for i, part := range parts {
+		switch {
+		case i%2 == 1 && i < len(parts)-1:
+			b.WriteString(hold("<code>" + html.EscapeString(part) + "</code>"))
+		case i%2 == 1:
+			// Unmatched backtick
+			b.WriteString("`" + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	text = b.String()
+
+	text = linkPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := linkPattern.FindStringSubmatch(m)
+		label, target := parts[1], parts[2]
+		if !safeLinkTarget(target) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(target) + `" rel="nofollow noopener noreferrer">` +
+			renderEmphasis(html.EscapeString(label)) + "</a>")
+	})
+
+	text = renderEmphasis(html.EscapeString(text))
+
+	return placeholderPattern.ReplaceAllStringFunc(text, func(m string) string {
+		index, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+		return rendered[index]
+	})
+}
+
+// renderEmphasis renders bold and italics in escaped text.
+func renderEmphasis(text string) string {
+	text = boldPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := boldPattern.FindStringSubmatch(m)
+		return "<strong>" + parts[1] + parts[2] + "</strong>"
+	})
+	return italicPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := italicPattern.FindStringSubmatch(m)
+		return "<em>" + parts[1] + parts[2] + "</em>"
+	})
+}
+
+// safeLinkTarget reports whether a link may point at target.
+func safeLinkTarget(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
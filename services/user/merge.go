@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/ids"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Merging moves everything a user owns to another user in the same tenant,
+// typically an anonymous user_id to the account they signed in with. The
+// merge is atomic: favoritesMutex, subscriptionsMutex and preferencesMutex
+// are held while it runs, so readers see either the old or the merged state.
+//
+// Only the source's owner can give its data away: the merge must carry a
+// merge token, which POST /api/v1/users/merge/token issues to whoever acts
+// as the source (the signed-in user, else the user_id of the request) and
+// which is bound to the tenant and the source, valid for MERGE_TOKEN_TTL.
+// Favorites are kept per replica, so the merge must reach the replica
+// holding the source; the gateway refuses merges whose source and target
+// live on different replicas, and a merge finding nothing of the source
+// fails with 404 rather than reporting an empty merge.
+
+// Subscription outcomes of a merge
+const (
+	mergeSubscriptionNone  = "none"
+	mergeSubscriptionMoved = "moved"
+	mergeSubscriptionKept  = "kept_target"
+)
+
+// maxMergeRecords bounds the merge audit log
+const maxMergeRecords = 1000
+
+// MergeRequest merges FromUserID into ToUserID. ToUserID defaults to the
+// authenticated user.
+type MergeRequest struct {
+	FromUserID string `json:"from_user_id" binding:"required"`
+	ToUserID   string `json:"to_user_id"`
+	// MergeToken proves the caller owns FromUserID
+	MergeToken string `json:"merge_token" binding:"required"`
+}
+
+// MergeRecord is the audit record of a merge.
+type MergeRecord struct {
+	ID         string    `json:"id"`
+	FromUserID string    `json:"from_user_id"`
+	ToUserID   string    `json:"to_user_id"`
+	MergedAt   time.Time `json:"merged_at"`
+	// Moved counts live favorites moved to the target, Trashed the deleted
+	// ones moved with them
+	Moved   int `json:"moved"`
+	Trashed int `json:"trashed"`
+	// Duplicates counts favorites the target already had, which were
+	// dropped; the older favorite time is kept, and the note if only the
+	// dropped favorite had one
+	Duplicates   int    `json:"duplicates"`
+	Subscription string `json:"subscription"`
+	// Preferences is the outcome for the delivery preferences, in the
+	// terms of Subscription
+	Preferences string `json:"preferences"`
+	// Collections counts the collections moved to the target or merged
+	// into its collection of the same name
+	Collections int `json:"collections"`
+	// RenamedIDs maps moved favorite IDs that clashed with the target's to
+	// their new IDs
+	RenamedIDs map[string]string `json:"renamed_ids,omitempty"`
+	Tenant     string            `json:"-"`
+}
+
+var (
+	// Merge audit log, oldest first; guarded by favoritesMutex
+	mergeRecords []MergeRecord
+
+	// mergeTokenKey signs merge tokens
+	mergeTokenKey []byte
+	mergeTokenTTL = 10 * time.Minute
+
+	userMerges metric.Int64Counter
+
+	errMergeSameUser     = errors.New("cannot merge a user into itself")
+	errMergeTokenInvalid = errors.New("invalid or expired merge token")
+	errMergeNothing      = errors.New("from_user_id has no data on this replica")
+)
+
+// initMerges derives the merge token key from the session secret, so it
+// must run after initAuth.
+func initMerges() {
+	mac := hmac.New(sha256.New, sessionTokens.Secret)
+	mac.Write([]byte("merge-users"))
+	mergeTokenKey = mac.Sum(nil)
+
+	if v, err := time.ParseDuration(os.Getenv("MERGE_TOKEN_TTL")); err == nil && v > 0 {
+		mergeTokenTTL = v
+	}
+
+	var err error
+	userMerges, err = meter.Int64Counter(
+		"user.merges",
+		metric.WithDescription("Number of user accounts merged"),
+		metric.WithUnit("{merge}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create merges counter", zap.Error(err))
+	}
+}
+
+// mergeUsers moves fromUserID's favorites, trash, collections and
+// subscription to toUserID and records the merge.
+func mergeUsers(ctx context.Context, fromUserID, toUserID string) (MergeRecord, error) {
+	ctx, span := tracer.Start(ctx, "mergeUsers")
+	defer span.End()
+
+	if fromUserID == toUserID {
+		return MergeRecord{}, errMergeSameUser
+	}
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	now := time.Now()
+	record := MergeRecord{
+		ID:           ids.NewAt(now),
+		FromUserID:   fromUserID,
+		ToUserID:     toUserID,
+		MergedAt:     now,
+		Subscription: mergeSubscriptionNone,
+		Tenant:       tenant,
+	}
+
+	// Favorite IDs collections must follow: renamed favorites and dropped
+	// duplicates
+	collected := map[string]string{}
+	targetIDs := map[string]bool{}
+	for _, fav := range favorites {
+		if fav.ownedBy(tenant, toUserID) {
+			targetIDs[fav.ID] = true
+		}
+	}
+
+	kept := favorites[:0]
+	for _, fav := range favorites {
+		if !fav.ownedBy(tenant, fromUserID) {
+			kept = append(kept, fav)
+			continue
+		}
+
+		if fav.DeletedAt == nil {
+			// The source's sync clients see the favorite go away
+			recordChange(changeDeleted, fav)
+			delete(favoritesByContent, favoriteContentKey(tenant, fromUserID, fav.ContentHash))
+
+			key := favoriteContentKey(tenant, toUserID, fav.ContentHash)
+			if existing, ok := favoritesByContent[key]; ok {
+				if fav.CreatedAt.Before(existing.CreatedAt) {
+					existing.CreatedAt = fav.CreatedAt
+				}
+				// The target's own note wins
+				if existing.Note == "" && fav.Note != "" {
+					existing.Note = fav.Note
+					existing.NoteUpdatedAt = fav.NoteUpdatedAt
+					recordChange(changeUpdated, existing)
+				}
+				collected[fav.ID] = existing.ID
+				record.Duplicates++
+				continue
+			}
+		}
+
+		fav.UserID = toUserID
+		if targetIDs[fav.ID] {
+			newID := fav.ID
+			for n := 1; targetIDs[newID]; n++ {
+				newID = fmt.Sprintf("%s-%d", fav.ID, n)
+			}
+			if record.RenamedIDs == nil {
+				record.RenamedIDs = map[string]string{}
+			}
+			record.RenamedIDs[fav.ID] = newID
+			collected[fav.ID] = newID
+			fav.ID = newID
+		}
+		targetIDs[fav.ID] = true
+
+		if fav.DeletedAt == nil {
+			favoritesByContent[favoriteContentKey(tenant, toUserID, fav.ContentHash)] = fav
+			recordChange(changeAdded, fav)
+			record.Moved++
+		} else {
+			record.Trashed++
+		}
+		kept = append(kept, fav)
+	}
+	for i := len(kept); i < len(favorites); i++ {
+		favorites[i] = nil
+	}
+	favorites = kept
+	record.Collections = mergeCollections(tenant, fromUserID, toUserID, collected)
+
+	// The target's own subscription wins
+	fromKey := subscriptionKey(tenant, fromUserID)
+	if sub, ok := subscriptions[fromKey]; ok {
+		delete(subscriptions, fromKey)
+		toKey := subscriptionKey(tenant, toUserID)
+		if _, exists := subscriptions[toKey]; exists {
+			record.Subscription = mergeSubscriptionKept
+		} else {
+			sub.UserID = toUserID
+			subscriptions[toKey] = sub
+			record.Subscription = mergeSubscriptionMoved
+		}
+	}
+	record.Preferences = mergePreferences(tenant, fromUserID, toUserID)
+	// Nothing was changed either, as the source owned nothing
+	if record.Moved+record.Trashed+record.Duplicates+record.Collections == 0 &&
+		record.Subscription == mergeSubscriptionNone && record.Preferences == mergeSubscriptionNone {
+		return MergeRecord{}, errMergeNothing
+	}
+
+	mergeRecords = append(mergeRecords, record)
+	if len(mergeRecords) > maxMergeRecords {
+		mergeRecords = mergeRecords[len(mergeRecords)-maxMergeRecords:]
+	}
+	userMerges.Add(ctx, 1, telemetry.ContextAttrs(ctx))
+
+	span.SetAttributes(
+		attribute.String("merge.id", record.ID),
+		attribute.String("merge.from_user_id", fromUserID),
+		attribute.String("merge.to_user_id", toUserID),
+		attribute.Int("merge.moved", record.Moved),
+		attribute.Int("merge.duplicates", record.Duplicates),
+	)
+	loggerFor(ctx).Info("Users merged",
+		zap.String("merge_id", record.ID),
+		zap.String("from_user_id", fromUserID),
+		zap.String("to_user_id", toUserID),
+		zap.Int("moved", record.Moved),
+		zap.Int("trashed", record.Trashed),
+		zap.Int("duplicates", record.Duplicates),
+		zap.Int("collections", record.Collections),
+		zap.String("subscription", record.Subscription),
+		zap.String("preferences", record.Preferences),
+	)
+
+	return record, nil
+}
+
+// mergeToken returns the token allowing fromUserID's data to be merged
+// into another user.
+func mergeToken(tenant, fromUserID string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, mergeTokenKey)
+	mac.Write([]byte(tenant + "\x00" + fromUserID + "\x00" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkMergeToken verifies a token from mergeToken.
+func checkMergeToken(token, tenant, fromUserID string) error {
+	exp, _, ok := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || time.Now().Unix() >= unix {
+		return errMergeTokenInvalid
+	}
+	if !hmac.Equal([]byte(token), []byte(mergeToken(tenant, fromUserID, time.Unix(unix, 0)))) {
+		return errMergeTokenInvalid
+	}
+	return nil
+}
+
+// userMergeRecords returns the merges into or out of userID, newest first.
+func userMergeRecords(ctx context.Context, userID string) []MergeRecord {
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	records := []MergeRecord{}
+	for i := len(mergeRecords) - 1; i >= 0; i-- {
+		r := mergeRecords[i]
+		if r.Tenant == tenant && (r.FromUserID == userID || r.ToUserID == userID) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// registerMergeRoutes installs the merge endpoints and the audit log.
+func registerMergeRoutes(r *gin.Engine) {
+	r.POST("/api/v1/users/merge/token", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		expires := time.Now().Add(mergeTokenTTL)
+		c.JSON(http.StatusOK, gin.H{
+			"merge_token":  mergeToken(telemetry.TenantFromContext(c.Request.Context()), userID, expires),
+			"from_user_id": userID,
+			"expires_at":   expires.UTC().Format(time.RFC3339),
+		})
+	})
+
+	r.POST("/api/v1/users/merge", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req MergeRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		// Only the authenticated user can be merged into
+		if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+			if req.ToUserID != "" && req.ToUserID != authenticated {
+				c.JSON(http.StatusForbidden, gin.H{"error": "can only merge into the authenticated user"})
+				return
+			}
+			req.ToUserID = authenticated
+		}
+		if req.ToUserID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to_user_id is required"})
+			return
+		}
+		if err := checkMergeToken(req.MergeToken, telemetry.TenantFromContext(ctx), req.FromUserID); err != nil {
+			loggerFor(ctx).Warn("Merge rejected",
+				zap.String("from_user_id", req.FromUserID),
+				zap.String("to_user_id", req.ToUserID),
+				zap.Error(err),
+			)
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		record, err := mergeUsers(ctx, req.FromUserID, req.ToUserID)
+		switch {
+		case errors.Is(err, errMergeNothing):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		notifyUsersMerged(ctx, record)
+		c.JSON(http.StatusOK, record)
+	})
+
+	r.GET("/api/v1/users/merges", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		records := userMergeRecords(c.Request.Context(), userID)
+		c.JSON(http.StatusOK, gin.H{
+			"merges": records,
+			"count":  len(records),
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Each favorite can carry a note, free text the user writes about the joke
+// (where they used it, how it landed). Notes are stored as written and are
+// treated as markdown: with ?render=html the note endpoint, the favorites
+// list and the export also return the note rendered to sanitized HTML in
+// note_html (see markdown.go). Setting or removing a note is an "updated"
+// entry in the change log, so sync clients pick it up; it doesn't trigger
+// webhooks. Notes of favorites in the trash are kept, so a restored
+// favorite has its note back.
+
+// noteMaxLength is the longest note accepted, in characters
+var noteMaxLength = 4000
+
+var errNoteTooLong = errors.New("note is too long")
+
+// NoteRequest sets a favorite's note; an empty note removes it.
+type NoteRequest struct {
+	Note string `json:"note"`
+}
+
+func initNotes() {
+	if v, err := strconv.Atoi(os.Getenv("NOTE_MAX_LENGTH")); err == nil && v > 0 {
+		noteMaxLength = v
+	}
+}
+
+// renderNotes sets NoteHTML on the favorites that have a note.
+func renderNotes(favs []Favorite) {
+	for i := range favs {
+		if favs[i].Note != "" {
+			favs[i].NoteHTML = renderMarkdown(favs[i].Note)
+		}
+	}
+}
+
+// setFavoriteNote sets, or with an empty note removes, the note of one of
+// the user's live favorites, if it matches ifMatch.
+func setFavoriteNote(ctx context.Context, userID, id, note, ifMatch string) (Favorite, error) {
+	ctx, span := tracer.Start(ctx, "setFavoriteNote")
+	defer span.End()
+
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > noteMaxLength {
+		return Favorite{}, errNoteTooLong
+	}
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	fav := findFavorite(ctx, userID, id)
+	if fav == nil || fav.DeletedAt != nil {
+		return Favorite{}, errFavoriteNotFound
+	}
+	if !etagMatches(ifMatch, fav) {
+		return *fav, errPreconditionFailed
+	}
+
+	if fav.Note != note {
+		fav.Note = note
+		fav.NoteUpdatedAt = nil
+		if note != "" {
+			now := time.Now()
+			fav.NoteUpdatedAt = &now
+		}
+		recordChange(changeUpdated, fav)
+	}
+
+	span.SetAttributes(
+		attribute.String("favorite.id", fav.ID),
+		attribute.Int("note.length", len(note)),
+	)
+	loggerFor(ctx).Info("Favorite note updated",
+		zap.String("favorite_id", fav.ID),
+		zap.String("user_id", fav.UserID),
+		zap.Int("note_length", len(note)),
+	)
+
+	return *fav, nil
+}
+
+// getFavoriteNote returns one of the user's favorites, for its note.
+func getFavoriteNote(ctx context.Context, userID, id string) (Favorite, error) {
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	fav := findFavorite(ctx, userID, id)
+	if fav == nil || fav.DeletedAt != nil {
+		return Favorite{}, errFavoriteNotFound
+	}
+	return *fav, nil
+}
+
+// noteResponse is the note part of a favorite.
+func noteResponse(fav Favorite) gin.H {
+	response := gin.H{
+		"favorite_id": fav.ID,
+		"note":        fav.Note,
+	}
+	if fav.NoteUpdatedAt != nil {
+		response["note_updated_at"] = fav.NoteUpdatedAt
+	}
+	if fav.NoteHTML != "" {
+		response["note_html"] = fav.NoteHTML
+	}
+	return response
+}
+
+// registerNoteRoutes installs the endpoints reading and editing favorite
+// notes.
+func registerNoteRoutes(r *gin.Engine) {
+	r.GET("/api/v1/favorites/:id/note", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		fav, err := getFavoriteNote(c.Request.Context(), userID, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("render") == "html" && fav.Note != "" {
+			fav.NoteHTML = renderMarkdown(fav.Note)
+		}
+		respondFavorite(c, http.StatusOK, noteResponse(fav), fav)
+	})
+
+	r.PUT("/api/v1/favorites/:id/note", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		ifMatch, ok := requestIfMatch(c)
+		if !ok {
+			return
+		}
+
+		var req NoteRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+
+		fav, err := setFavoriteNote(c.Request.Context(), userID, c.Param("id"), req.Note, ifMatch)
+		switch {
+		case errors.Is(err, errPreconditionFailed):
+			respondPreconditionFailed(c, fav)
+			return
+		case errors.Is(err, errNoteTooLong):
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("note must be at most %d characters", noteMaxLength)})
+			return
+		case err != nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("render") == "html" && fav.Note != "" {
+			fav.NoteHTML = renderMarkdown(fav.Note)
+		}
+		respondFavorite(c, http.StatusOK, fav, fav)
+	})
+
+	r.DELETE("/api/v1/favorites/:id/note", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		ifMatch, ok := requestIfMatch(c)
+		if !ok {
+			return
+		}
+
+		fav, err := setFavoriteNote(c.Request.Context(), userID, c.Param("id"), "", ifMatch)
+		switch {
+		case errors.Is(err, errPreconditionFailed):
+			respondPreconditionFailed(c, fav)
+		case err != nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			respondFavorite(c, http.StatusOK, fav, fav)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Users can set how jokes are delivered to them: whether safe mode is on,
+// the categories they prefer and their language. The jokes service reads
+// them from GET /api/v1/users/:id/preferences when it serves an identified
+// user, so GET /api/v1/joke is personalized without the client passing
+// anything. PUT replaces them and DELETE resets them to the defaults; like
+// the data endpoints, an authenticated caller can only reach their own.
+//
+// Preferences are part of a user's data export and erasure, and move with
+// a merge unless the target has their own.
+
+const (
+	maxPreferredCategories = 10
+	maxCategoryLength      = 50
+)
+
+// Preferences are a user's joke delivery preferences. A null SafeMode
+// leaves safe mode to the request, empty Categories allow every category
+// and an empty Language every language.
+type Preferences struct {
+	UserID     string     `json:"user_id"`
+	SafeMode   *bool      `json:"safe_mode"`
+	Categories []string   `json:"categories"`
+	Language   string     `json:"language"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	Tenant     string     `json:"-"`
+}
+
+// PreferencesRequest is the body of PUT /api/v1/users/:id/preferences.
+type PreferencesRequest struct {
+	SafeMode   *bool    `json:"safe_mode"`
+	Categories []string `json:"categories"`
+	Language   string   `json:"language"`
+}
+
+var (
+	// preferences maps subscriptionKey(tenant, user) to the user's
+	// preferences
+	preferences      = map[string]*Preferences{}
+	preferencesMutex sync.RWMutex
+
+	// languagePattern matches the language tags jokes are imported with
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// userPreferences returns the preferences of userID in tenant, the
+// defaults if they set none.
+func userPreferences(tenant, userID string) Preferences {
+	preferencesMutex.RLock()
+	defer preferencesMutex.RUnlock()
+
+	if prefs, ok := preferences[subscriptionKey(tenant, userID)]; ok {
+		copied := *prefs
+		copied.Categories = append([]string{}, prefs.Categories...)
+		return copied
+	}
+	return Preferences{UserID: userID, Categories: []string{}, Tenant: tenant}
+}
+
+// normalizePreferences lowercases and deduplicates the categories and the
+// language of req, and reports why it is rejected, if it is.
+func normalizePreferences(req *PreferencesRequest) string {
+	categories := []string{}
+	seen := map[string]bool{}
+	for _, category := range req.Categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		switch {
+		case category == "":
+			return "categories can't be empty"
+		case !utf8.ValidString(category) || utf8.RuneCountInString(category) > maxCategoryLength:
+			return "categories are at most " + strconv.Itoa(maxCategoryLength) + " characters"
+		case seen[category]:
+			continue
+		}
+		seen[category] = true
+		categories = append(categories, category)
+	}
+	if len(categories) > maxPreferredCategories {
+		return "at most " + strconv.Itoa(maxPreferredCategories) + " categories"
+	}
+	req.Categories = categories
+
+	req.Language = strings.ToLower(strings.TrimSpace(req.Language))
+	if req.Language != "" && !languagePattern.MatchString(req.Language) {
+		return "language must be a language tag such as en or pt-br"
+	}
+	return ""
+}
+
+// mergePreferences moves the preferences of fromUserID to toUserID unless
+// the target has their own, and reports the outcome in the terms of the
+// subscription's. The caller holds preferencesMutex.
+func mergePreferences(tenant, fromUserID, toUserID string) string {
+	fromKey := subscriptionKey(tenant, fromUserID)
+	prefs, ok := preferences[fromKey]
+	if !ok {
+		return mergeSubscriptionNone
+	}
+	delete(preferences, fromKey)
+	toKey := subscriptionKey(tenant, toUserID)
+	if _, exists := preferences[toKey]; exists {
+		return mergeSubscriptionKept
+	}
+	prefs.UserID = toUserID
+	preferences[toKey] = prefs
+	return mergeSubscriptionMoved
+}
+
+// registerPreferencesRoutes installs the delivery preferences endpoints.
+func registerPreferencesRoutes(r *gin.Engine) {
+	r.GET("/api/v1/users/:id/preferences", func(c *gin.Context) {
+		userID, _, ok := dataSubject(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, userPreferences(telemetry.TenantFromContext(c.Request.Context()), userID))
+	})
+
+	r.PUT("/api/v1/users/:id/preferences", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		ctx, span := tracer.Start(ctx, "setPreferences")
+		defer span.End()
+
+		userID, _, ok := dataSubject(c)
+		if !ok {
+			return
+		}
+		var req PreferencesRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		if msg := normalizePreferences(&req); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		tenant := telemetry.TenantFromContext(ctx)
+		now := time.Now().UTC()
+		prefs := &Preferences{
+			UserID:     userID,
+			SafeMode:   req.SafeMode,
+			Categories: req.Categories,
+			Language:   req.Language,
+			UpdatedAt:  &now,
+			Tenant:     tenant,
+		}
+		preferencesMutex.Lock()
+		preferences[subscriptionKey(tenant, userID)] = prefs
+		preferencesMutex.Unlock()
+
+		span.SetAttributes(
+			attribute.String("preferences.user_id", userID),
+			attribute.Int("preferences.categories", len(req.Categories)),
+			attribute.String("preferences.language", req.Language),
+		)
+		loggerFor(ctx).Info("Preferences updated",
+			zap.String("user_id", userID),
+			zap.Strings("categories", req.Categories),
+			zap.String("language", req.Language),
+		)
+		c.JSON(http.StatusOK, userPreferences(tenant, userID))
+	})
+
+	r.DELETE("/api/v1/users/:id/preferences", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userID, _, ok := dataSubject(c)
+		if !ok {
+			return
+		}
+
+		key := subscriptionKey(telemetry.TenantFromContext(ctx), userID)
+		preferencesMutex.Lock()
+		_, existed := preferences[key]
+		delete(preferences, key)
+		preferencesMutex.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "preferences not found"})
+			return
+		}
+
+		loggerFor(ctx).Info("Preferences reset", zap.String("user_id", userID))
+		c.JSON(http.StatusOK, gin.H{"status": "reset"})
+	})
+}
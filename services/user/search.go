@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// GET /api/v1/favorites/search?q= finds a user's live favorites by the
+// words of the joke and of its note. Text is split into lowercase words,
+// common English words are dropped and plurals and -ing/-ed forms are
+// reduced to their stem, so "dogs barking" finds "a dog barked". A
+// favorite matches when it has every word of the query; matches are
+// ranked with BM25 over the user's favorites, words in the joke counting
+// twice as much as words in the note, newest first on equal scores.
+//
+// Favorites are kept in memory, so the index is too: it holds the word
+// counts of each favorite, worked out when it is first searched and again
+// whenever its joke or note has changed since.
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchQuery     = 200
+
+	// jokeWeight is how much more a word in the joke counts than one in
+	// the note
+	jokeWeight = 2
+	// BM25 parameters
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// searchStopWords are left out of the index and of queries
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "no": true, "not": true, "of": true, "on": true, "or": true, "so": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// searchDocument is the indexed form of a favorite, for the joke and note
+// it was built from.
+type searchDocument struct {
+	joke, note string
+	// terms counts each stem, jokeWeight for each in the joke and 1 for
+	// each in the note
+	terms  map[string]int
+	length int
+}
+
+var (
+	// searchIndex holds the search document of the favorites searched so
+	// far; it is built under the favorites read lock, so it has its own
+	searchIndex      = map[*Favorite]*searchDocument{}
+	searchIndexMutex sync.Mutex
+)
+
+// FavoriteSearchResult is a favorite matching a search, with its score.
+type FavoriteSearchResult struct {
+	Favorite
+	Score float64 `json:"score"`
+}
+
+// searchTerms splits text into the stems it is indexed or searched by.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(strings.ReplaceAll(text, "'", "")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if searchStopWords[word] {
+			continue
+		}
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
+
+// stem strips the common English inflections, enough for the same word
+// to be found in another form ("jokes", "joked" and "joking" are all
+// "jok"); it is not a full stemmer.
+func stem(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		word = strings.TrimSuffix(word, "ies") + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		word = strings.TrimSuffix(word, "s")
+	}
+	for _, suffix := range []string{"ing", "ed"} {
+		base, ok := strings.CutSuffix(word, suffix)
+		if !ok || len(base) < 3 || (suffix == "ed" && strings.HasSuffix(base, "e")) {
+			continue
+		}
+		// "running" is "run", but "falling" is "fall"
+		if n := len(base); base[n-1] == base[n-2] && !strings.ContainsRune("lsz", rune(base[n-1])) {
+			base = base[:n-1]
+		}
+		word = base
+		break
+	}
+	if len(word) > 3 {
+		word = strings.TrimSuffix(word, "e")
+	}
+	return word
+}
+
+// searchDocumentFor returns fav's search document, rebuilding it if the
+// joke or note changed. The caller holds searchIndexMutex.
+func searchDocumentFor(fav *Favorite) *searchDocument {
+	if doc := searchIndex[fav]; doc != nil && doc.joke == fav.Joke && doc.note == fav.Note {
+		return doc
+	}
+	doc := &searchDocument{joke: fav.Joke, note: fav.Note, terms: map[string]int{}}
+	for _, term := range searchTerms(fav.Joke) {
+		doc.terms[term] += jokeWeight
+		doc.length += jokeWeight
+	}
+	for _, term := range searchTerms(fav.Note) {
+		doc.terms[term]++
+		doc.length++
+	}
+	searchIndex[fav] = doc
+	return doc
+}
+
+// pruneSearchIndex drops the documents of favorites no longer stored,
+// purged from the trash or erased, once they make up half the index. The
+// caller holds searchIndexMutex and the favorites lock.
+func pruneSearchIndex() {
+	if len(searchIndex) <= 2*len(favorites) {
+		return
+	}
+	stored := make(map[*Favorite]bool, len(favorites))
+	for _, fav := range favorites {
+		stored[fav] = true
+	}
+	for fav := range searchIndex {
+		if !stored[fav] {
+			delete(searchIndex, fav)
+		}
+	}
+}
+
+// searchFavorites returns the user's live favorites matching query, best
+// first, from offset on and at most limit of them, and how many matched.
+func searchFavorites(ctx context.Context, userID, query string, offset, limit int) ([]FavoriteSearchResult, int) {
+	ctx, span := tracer.Start(ctx, "searchFavorites")
+	defer span.End()
+
+	queryTerms := searchTerms(query)
+	if len(queryTerms) == 0 {
+		return []FavoriteSearchResult{}, 0
+	}
+
+	type candidate struct {
+		fav *Favorite
+		doc *searchDocument
+	}
+	var candidates []candidate
+	totalLength := 0
+	// df is the number of favorites having each query term
+	df := map[string]int{}
+
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+	searchIndexMutex.Lock()
+	pruneSearchIndex()
+	tenant := telemetry.TenantFromContext(ctx)
+	for _, fav := range favorites {
+		if fav.DeletedAt != nil || !fav.ownedBy(tenant, userID) {
+			continue
+		}
+		doc := searchDocumentFor(fav)
+		candidates = append(candidates, candidate{fav, doc})
+		totalLength += doc.length
+		for _, term := range queryTerms {
+			if doc.terms[term] > 0 {
+				df[term]++
+			}
+		}
+	}
+	searchIndexMutex.Unlock()
+
+	var matches []FavoriteSearchResult
+	if len(candidates) > 0 {
+		n := float64(len(candidates))
+		avgLength := math.Max(float64(totalLength)/n, 1)
+		for _, c := range candidates {
+			score := 0.0
+			for _, term := range queryTerms {
+				tf := float64(c.doc.terms[term])
+				if tf == 0 {
+					score = -1
+					break
+				}
+				idf := math.Log(1 + (n-float64(df[term])+0.5)/(float64(df[term])+0.5))
+				score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(c.doc.length)/avgLength))
+			}
+			if score >= 0 {
+				matches = append(matches, FavoriteSearchResult{Favorite: *c.fav, Score: math.Round(score*1000) / 1000})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].CreatedAt.After(matches[j].CreatedAt)
+	})
+
+	total := len(matches)
+	span.SetAttributes(
+		attribute.String("query.user_id", userID),
+		attribute.Int("query.terms", len(queryTerms)),
+		attribute.Int("results.count", total),
+	)
+
+	if offset >= total {
+		return []FavoriteSearchResult{}, total
+	}
+	return matches[offset:min(offset+limit, total)], total
+}
+
+// searchHandler serves GET /api/v1/favorites/search. limit (default 20,
+// at most 100) and offset page through the results; render=html renders
+// the notes as on the favorites list.
+func searchHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID := requestUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	if len([]rune(query)) > maxSearchQuery {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q must be at most " + strconv.Itoa(maxSearchQuery) + " characters"})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxSearchLimit)})
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	results, total := searchFavorites(ctx, userID, query, offset, limit)
+	if c.Query("render") == "html" {
+		for i := range results {
+			if results[i].Note != "" {
+				results[i].NoteHTML = renderMarkdown(results[i].Note)
+			}
+		}
+	}
+
+	loggerFor(ctx).Info("Favorites searched",
+		zap.String("user_id", userID),
+		zap.Int("matches", total),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":    query,
+		"results":  results,
+		"count":    len(results),
+		"total":    total,
+		"offset":   offset,
+		"has_more": offset+len(results) < total,
+	})
+}
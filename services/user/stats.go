@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+)
+
+// FavoriteStats summarizes a user's live favorites without listing them.
+type FavoriteStats struct {
+	UserID          string     `json:"user_id"`
+	Count           int        `json:"count"`
+	FirstFavoriteAt *time.Time `json:"first_favorite_at"`
+	LastFavoriteAt  *time.Time `json:"last_favorite_at"`
+	// PerDay counts favorites added on each of the last days (UTC), oldest
+	// first, including days without any
+	PerDay []DayCount `json:"per_day"`
+}
+
+// DayCount is the number of favorites added on one UTC day.
+type DayCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// favoriteStats computes counts for the user's live favorites and a
+// histogram over the last days, ending today.
+func favoriteStats(ctx context.Context, userID string, days int, now time.Time) FavoriteStats {
+	ctx, span := tracer.Start(ctx, "favoriteStats")
+	defer span.End()
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	oldest := today.AddDate(0, 0, -(days - 1))
+	perDay := make([]int, days)
+
+	stats := FavoriteStats{UserID: userID}
+
+	favoritesMutex.RLock()
+	tenant := telemetry.TenantFromContext(ctx)
+	for _, fav := range favorites {
+		if fav.DeletedAt != nil || !fav.ownedBy(tenant, userID) {
+			continue
+		}
+		stats.Count++
+
+		created := fav.CreatedAt
+		if stats.FirstFavoriteAt == nil || created.Before(*stats.FirstFavoriteAt) {
+			stats.FirstFavoriteAt = &created
+		}
+		if stats.LastFavoriteAt == nil || created.After(*stats.LastFavoriteAt) {
+			stats.LastFavoriteAt = &created
+		}
+
+		day := int(created.UTC().Sub(oldest) / (24 * time.Hour))
+		if !created.Before(oldest) && day < days {
+			perDay[day]++
+		}
+	}
+	favoritesMutex.RUnlock()
+
+	stats.PerDay = make([]DayCount, days)
+	for i, count := range perDay {
+		stats.PerDay[i] = DayCount{Date: oldest.AddDate(0, 0, i).Format("2006-01-02"), Count: count}
+	}
+
+	span.SetAttributes(
+		attribute.String("query.user_id", userID),
+		attribute.Int("results.count", stats.Count),
+	)
+	return stats
+}
+
+// statsHandler serves GET /api/v1/favorites/stats. The optional days
+// parameter sets the histogram length (default 30, at most 365).
+func statsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID := requestUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+
+	days := defaultStatsDays
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+
+	stats := favoriteStats(ctx, userID, days, time.Now())
+
+	loggerFor(ctx).Info("Favorite stats requested",
+		zap.String("user_id", userID),
+		zap.Int("count", stats.Count),
+	)
+
+	c.JSON(http.StatusOK, stats)
+}
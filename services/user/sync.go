@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"github.com/navyn13/microservice-joke/user/syncpb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Clients that stay connected, like the desktop app, sync favorites over
+// gRPC instead of polling GET /api/v1/favorites/changes. SyncFavorites
+// (see syncpb/sync.proto) is a bidirectional stream: the client sends its
+// local changes and gets an ack for each, and the server pushes every
+// change to the user's favorites as it is recorded, the client's own
+// included. Both read the same change log, so a cursor from one works
+// with the other. A stream whose cursor has fallen out of the log starts
+// with a snapshot instead.
+//
+// The gRPC server listens on GRPC_PORT (default 9083) next to the HTTP
+// API. Like the HTTP API it takes the user from the x-user-id metadata and
+// the tenant from the request baggage. Idle connections are kept alive
+// with pings every GRPC_KEEPALIVE_INTERVAL (default 1m), so proxies and
+// load balancers don't drop them.
+
+// syncUserMetadata carries the user ID, like userIDHeader over HTTP
+const syncUserMetadata = "x-user-id"
+
+// Outcomes of local changes
+const (
+	syncChangeApplied  = "applied"
+	syncChangeRejected = "rejected"
+)
+
+var (
+	grpcKeepaliveInterval = time.Minute
+
+	syncStreams      metric.Int64UpDownCounter
+	syncLocalChanges metric.Int64Counter
+
+	errEmptyChange = errors.New("change is empty")
+)
+
+func initSync() {
+	if v, err := time.ParseDuration(os.Getenv("GRPC_KEEPALIVE_INTERVAL")); err == nil && v > 0 {
+		grpcKeepaliveInterval = v
+	}
+
+	var err error
+	syncStreams, err = meter.Int64UpDownCounter(
+		"user.sync.streams",
+		metric.WithDescription("Number of favorites sync streams open"),
+		metric.WithUnit("{stream}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create sync streams counter", zap.Error(err))
+	}
+	syncLocalChanges, err = meter.Int64Counter(
+		"user.sync.local_changes",
+		metric.WithDescription("Number of local changes received on sync streams, by type and outcome"),
+		metric.WithUnit("{change}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create sync local changes counter", zap.Error(err))
+	}
+}
+
+// serveSync runs the gRPC server.
+func serveSync() {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		port = "9083"
+	}
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logger.Fatal("Failed to listen for gRPC", zap.Error(err))
+	}
+
+	server := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    grpcKeepaliveInterval,
+			Timeout: 20 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	syncpb.RegisterFavoritesSyncServer(server, favoritesSyncServer{})
+
+	logger.Info("Starting gRPC server", zap.String("port", port))
+	if err := server.Serve(lis); err != nil {
+		logger.Fatal("Failed to start gRPC server", zap.Error(err))
+	}
+}
+
+// favoritesSyncServer implements syncpb.FavoritesSyncServer.
+type favoritesSyncServer struct {
+	syncpb.UnimplementedFavoritesSyncServer
+}
+
+// syncStream is one open SyncFavorites stream.
+type syncStream struct {
+	userID string
+	stream syncpb.FavoritesSync_SyncFavoritesServer
+	// sendMutex serializes sends from the pushing and acking goroutines
+	sendMutex sync.Mutex
+}
+
+func (favoritesSyncServer) SyncFavorites(stream syncpb.FavoritesSync_SyncFavoritesServer) error {
+	ctx := stream.Context()
+
+	var userID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(syncUserMetadata); len(values) > 0 {
+			userID = values[0]
+		}
+	}
+	if userID == "" {
+		return status.Error(codes.InvalidArgument, "x-user-id metadata is required")
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := first.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be start")
+	}
+
+	attrs := telemetry.ContextAttrs(ctx)
+	syncStreams.Add(ctx, 1, attrs)
+	defer syncStreams.Add(ctx, -1, attrs)
+	opened := time.Now()
+	loggerFor(ctx).Info("Sync stream opened",
+		zap.String("user_id", userID),
+		zap.Bool("snapshot", start.Since == nil),
+	)
+	defer func() {
+		loggerFor(ctx).Info("Sync stream closed",
+			zap.String("user_id", userID),
+			zap.Duration("duration", time.Since(opened)),
+		)
+	}()
+
+	s := &syncStream{userID: userID, stream: stream}
+
+	// The stream must not be used once this returns, so wait for the push
+	ctx, cancel := context.WithCancel(ctx)
+	pushed := make(chan error, 1)
+	var pushing sync.WaitGroup
+	pushing.Add(1)
+	go func() {
+		defer pushing.Done()
+		pushed <- s.push(ctx, start.Since)
+	}()
+	defer pushing.Wait()
+	defer cancel()
+
+	received := make(chan *syncpb.SyncRequest)
+	receiveErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				receiveErr <- err
+				return
+			}
+			select {
+			case received <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case req := <-received:
+			change := req.GetChange()
+			if change == nil {
+				return status.Error(codes.InvalidArgument, "start may only be sent first")
+			}
+			if err := s.send(&syncpb.SyncResponse{
+				Response: &syncpb.SyncResponse_Ack{Ack: s.apply(ctx, change)},
+			}); err != nil {
+				return err
+			}
+		case err := <-receiveErr:
+			// The client is done sending
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case err := <-pushed:
+			return err
+		}
+	}
+}
+
+// send sends a response on the stream.
+func (s *syncStream) send(resp *syncpb.SyncResponse) error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	return s.stream.Send(resp)
+}
+
+// push sends a snapshot, if since is nil or has expired, or the changes
+// after since, and then every change as it is recorded, until ctx is
+// done.
+func (s *syncStream) push(ctx context.Context, since *int64) error {
+	snapshot := since == nil
+	var cursor int64
+	if since != nil {
+		cursor = *since
+	}
+
+	for {
+		// Taken before reading the log, so no change recorded meanwhile is
+		// missed
+		next := nextChange()
+
+		if snapshot {
+			favs, snapshotCursor := favoritesSnapshot(ctx, s.userID)
+			resp := &syncpb.Snapshot{Cursor: snapshotCursor}
+			for _, fav := range favs {
+				resp.Favorites = append(resp.Favorites, favoriteProto(fav))
+			}
+			if err := s.send(&syncpb.SyncResponse{
+				Response: &syncpb.SyncResponse_Snapshot{Snapshot: resp},
+			}); err != nil {
+				return err
+			}
+			cursor, snapshot = snapshotCursor, false
+		} else {
+			changes, changesCursor, hasMore, ok := favoriteChangesSince(ctx, s.userID, cursor, maxChangesPerPage)
+			if !ok {
+				loggerFor(ctx).Info("Expired sync cursor, sending a snapshot",
+					zap.String("user_id", s.userID),
+					zap.Int64("since", cursor),
+				)
+				snapshot = true
+				continue
+			}
+			for _, change := range changes {
+				if err := s.send(&syncpb.SyncResponse{
+					Response: &syncpb.SyncResponse_Change{Change: changeProto(change)},
+				}); err != nil {
+					return err
+				}
+			}
+			cursor = changesCursor
+			if hasMore {
+				continue
+			}
+		}
+
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// apply applies a local change and returns its ack.
+func (s *syncStream) apply(ctx context.Context, change *syncpb.LocalChange) *syncpb.ChangeAck {
+	ack := &syncpb.ChangeAck{ClientChangeId: change.GetClientChangeId()}
+
+	var (
+		fav        Favorite
+		err        error
+		changeType string
+	)
+	switch c := change.Change.(type) {
+	case *syncpb.LocalChange_Add:
+		changeType = "add"
+		fav, ack.AlreadyFavorited, err = s.add(ctx, c.Add)
+	case *syncpb.LocalChange_Delete:
+		changeType = "delete"
+		fav, err = deleteFavorite(ctx, s.userID, c.Delete.GetId(), "")
+		if err == nil {
+			notifyFavoriteDeleted(ctx, fav)
+		}
+	case *syncpb.LocalChange_SetNote:
+		changeType = "set_note"
+		fav, err = setFavoriteNote(ctx, s.userID, c.SetNote.GetId(), c.SetNote.GetNote(), "")
+	default:
+		changeType = "unknown"
+		err = errEmptyChange
+	}
+
+	outcome := syncChangeApplied
+	if err != nil {
+		outcome = syncChangeRejected
+		ack.Error = err.Error()
+		loggerFor(ctx).Info("Local change rejected",
+			zap.String("user_id", s.userID),
+			zap.String("client_change_id", ack.ClientChangeId),
+			zap.String("type", changeType),
+			zap.Error(err),
+		)
+	} else {
+		ack.Favorite = favoriteProto(fav)
+	}
+	syncLocalChanges.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("type", changeType),
+		attribute.String("outcome", outcome),
+	), telemetry.ContextAttrs(ctx))
+	return ack
+}
+
+// add adds a favorite like POST /api/v1/favorites, returning whether it was
+// already a favorite.
+func (s *syncStream) add(ctx context.Context, add *syncpb.AddFavorite) (Favorite, bool, error) {
+	req := FavoriteRequest{JokeID: add.GetJokeId(), Joke: add.GetJoke(), UserID: s.userID}
+	if req.JokeID == "" && req.Joke == "" {
+		return Favorite{}, false, errors.New("joke_id or joke is required")
+	}
+	if req.Joke == "" {
+		joke, err := lookupJoke(ctx, req.JokeID)
+		if errors.Is(err, errJokeNotFound) {
+			return Favorite{}, false, err
+		}
+		if err != nil {
+			loggerFor(ctx).Warn("Failed to look up joke",
+				zap.String("joke_id", req.JokeID),
+				zap.Error(err),
+			)
+			return Favorite{}, false, errors.New("failed to look up joke")
+		}
+		req.Joke = joke
+	}
+
+	fav, created := addFavorite(ctx, req)
+	if created {
+		notifyFavoriteAdded(ctx, fav)
+	}
+	return fav, !created, nil
+}
+
+// favoriteProto converts a favorite to its gRPC message.
+func favoriteProto(fav Favorite) *syncpb.Favorite {
+	msg := &syncpb.Favorite{
+		Id:        fav.ID,
+		JokeId:    fav.JokeID,
+		Joke:      fav.Joke,
+		UserId:    fav.UserID,
+		CreatedAt: timestamppb.New(fav.CreatedAt),
+		Note:      fav.Note,
+	}
+	if fav.NoteUpdatedAt != nil {
+		msg.NoteUpdatedAt = timestamppb.New(*fav.NoteUpdatedAt)
+	}
+	return msg
+}
+
+// changeProto converts a change log entry to its gRPC message.
+func changeProto(change FavoriteChange) *syncpb.FavoriteChange {
+	changeType := syncpb.ChangeType_CHANGE_TYPE_UNSPECIFIED
+	switch change.Type {
+	case changeAdded:
+		changeType = syncpb.ChangeType_CHANGE_TYPE_ADDED
+	case changeUpdated:
+		changeType = syncpb.ChangeType_CHANGE_TYPE_UPDATED
+	case changeDeleted:
+		changeType = syncpb.ChangeType_CHANGE_TYPE_DELETED
+	}
+	return &syncpb.FavoriteChange{
+		Cursor:   change.Cursor,
+		Type:     changeType,
+		Favorite: favoriteProto(change.Favorite),
+		At:       timestamppb.New(change.At),
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var (
+	errFavoriteNotFound   = errors.New("favorite not found")
+	errFavoriteConflict   = errors.New("an identical favorite already exists")
+	errFavoriteNotInTrash = errors.New("favorite is not in the trash")
+)
+
+// findFavorite returns the favorite with the given ID owned by userID in
+// the tenant carried by ctx. Callers must hold favoritesMutex.
+func findFavorite(ctx context.Context, userID, id string) *Favorite {
+	tenant := telemetry.TenantFromContext(ctx)
+	for _, fav := range favorites {
+		if fav.ID == id && fav.ownedBy(tenant, userID) {
+			return fav
+		}
+	}
+	return nil
+}
+
+// deleteFavorite moves a favorite to the trash, if it matches ifMatch.
+func deleteFavorite(ctx context.Context, userID, id, ifMatch string) (Favorite, error) {
+	ctx, span := tracer.Start(ctx, "deleteFavorite")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	fav := findFavorite(ctx, userID, id)
+	if fav == nil || fav.DeletedAt != nil {
+		return Favorite{}, errFavoriteNotFound
+	}
+	if !etagMatches(ifMatch, fav) {
+		return *fav, errPreconditionFailed
+	}
+
+	now := time.Now()
+	fav.DeletedAt = &now
+	delete(favoritesByContent, favoriteContentKey(fav.Tenant, fav.UserID, fav.ContentHash))
+	recordChange(changeDeleted, fav)
+
+	span.SetAttributes(
+		attribute.String("favorite.id", fav.ID),
+		attribute.String("favorite.user_id", fav.UserID),
+	)
+	loggerFor(ctx).Info("Favorite moved to trash",
+		zap.String("favorite_id", fav.ID),
+		zap.String("user_id", fav.UserID),
+	)
+
+	return *fav, nil
+}
+
+// restoreFavorite takes a favorite out of the trash, unless the user has
+// favorited the same joke again in the meantime or it doesn't match
+// ifMatch.
+func restoreFavorite(ctx context.Context, userID, id, ifMatch string) (Favorite, error) {
+	ctx, span := tracer.Start(ctx, "restoreFavorite")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	fav := findFavorite(ctx, userID, id)
+	if fav == nil {
+		return Favorite{}, errFavoriteNotFound
+	}
+	if fav.DeletedAt == nil {
+		return Favorite{}, errFavoriteNotInTrash
+	}
+	if !etagMatches(ifMatch, fav) {
+		return *fav, errPreconditionFailed
+	}
+
+	key := favoriteContentKey(fav.Tenant, fav.UserID, fav.ContentHash)
+	if _, exists := favoritesByContent[key]; exists {
+		return Favorite{}, errFavoriteConflict
+	}
+
+	fav.DeletedAt = nil
+	favoritesByContent[key] = fav
+	recordChange(changeAdded, fav)
+
+	span.SetAttributes(
+		attribute.String("favorite.id", fav.ID),
+		attribute.String("favorite.user_id", fav.UserID),
+	)
+	loggerFor(ctx).Info("Favorite restored",
+		zap.String("favorite_id", fav.ID),
+		zap.String("user_id", fav.UserID),
+	)
+
+	return *fav, nil
+}
+
+// getTrash lists the user's deleted favorites.
+func getTrash(ctx context.Context, userID string) []Favorite {
+	_, span := tracer.Start(ctx, "getTrash")
+	defer span.End()
+
+	favoritesMutex.RLock()
+	defer favoritesMutex.RUnlock()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	trash := []Favorite{}
+	for _, fav := range favorites {
+		if fav.DeletedAt != nil && fav.ownedBy(tenant, userID) {
+			trash = append(trash, *fav)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("results.count", len(trash)))
+	return trash
+}
+
+// purgeTrash permanently removes favorites deleted before the cutoff and
+// returns how many were removed.
+func purgeTrash(ctx context.Context, cutoff time.Time) int {
+	ctx, span := tracer.Start(ctx, "purgeTrash")
+	defer span.End()
+
+	favoritesMutex.Lock()
+	defer favoritesMutex.Unlock()
+
+	kept := favorites[:0]
+	purged := 0
+	for _, fav := range favorites {
+		if fav.DeletedAt != nil && fav.DeletedAt.Before(cutoff) {
+			uncollectFavorite(fav)
+			purged++
+			continue
+		}
+		kept = append(kept, fav)
+	}
+	for i := len(kept); i < len(favorites); i++ {
+		favorites[i] = nil
+	}
+	favorites = kept
+
+	span.SetAttributes(attribute.Int("favorites.purged", purged))
+	if purged > 0 {
+		loggerFor(ctx).Info("Trash purged",
+			zap.Int("purged", purged),
+			zap.Time("cutoff", cutoff),
+		)
+	}
+	return purged
+}
+
+// runTrashPurge periodically purges favorites that have been in the trash
+// longer than the retention period.
+func runTrashPurge(ctx context.Context) {
+	retention := 30 * 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("FAVORITES_TRASH_RETENTION")); err == nil {
+		retention = v
+	}
+	interval := time.Hour
+	if v, err := time.ParseDuration(os.Getenv("FAVORITES_PURGE_INTERVAL")); err == nil {
+		interval = v
+	}
+
+	logger.Info("Trash purge started",
+		zap.Duration("retention", retention),
+		zap.Duration("interval", interval),
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purgeTrash(ctx, time.Now().Add(-retention))
+		}
+	}
+}
+
+// registerTrashRoutes installs delete, trash listing and restore endpoints.
+func registerTrashRoutes(r *gin.Engine) {
+	r.DELETE("/api/v1/favorites/:id", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		ifMatch, ok := requestIfMatch(c)
+		if !ok {
+			return
+		}
+
+		fav, err := deleteFavorite(c.Request.Context(), userID, c.Param("id"), ifMatch)
+		switch {
+		case errors.Is(err, errPreconditionFailed):
+			respondPreconditionFailed(c, fav)
+		case err != nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			notifyFavoriteDeleted(c.Request.Context(), fav)
+			respondFavorite(c, http.StatusOK, fav, fav)
+		}
+	})
+
+	r.GET("/api/v1/favorites/trash", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		trash := getTrash(c.Request.Context(), userID)
+		c.JSON(http.StatusOK, gin.H{
+			"favorites": trash,
+			"count":     len(trash),
+		})
+	})
+
+	r.POST("/api/v1/favorites/:id/restore", func(c *gin.Context) {
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+
+		ifMatch, ok := requestIfMatch(c)
+		if !ok {
+			return
+		}
+
+		fav, err := restoreFavorite(c.Request.Context(), userID, c.Param("id"), ifMatch)
+		switch {
+		case errors.Is(err, errFavoriteNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errPreconditionFailed):
+			respondPreconditionFailed(c, fav)
+		case err != nil:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			respondFavorite(c, http.StatusOK, fav, fav)
+		}
+	})
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/ids"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Data-subject requests: GET /api/v1/users/:id/data returns everything
+// the service stores about a user in their tenant, and DELETE erases it:
+// favorites and trash with their notes, collections, the digest
+// subscription, the delivery preferences, webhooks and their dead
+// letters, and the user's entries in the change log. Merge records naming
+// the user keep the merge but have the ID replaced with erasedUserID. The
+// user's connected sync clients are sent a deletion for each live
+// favorite, carrying its ID only, so they converge.
+//
+// The erasure is reported to analytics as a user_deleted event, which
+// drops the user's leaderboard activity there. Every erasure is recorded
+// in an audit trail that keeps a hash of the user ID rather than the ID
+// itself; the export of an erased user lists the erasures of that ID.
+
+// erasedUserID replaces erased user IDs in merge records
+const erasedUserID = "[erased]"
+
+// maxErasureRecords bounds the erasure audit trail
+const maxErasureRecords = 1000
+
+// Analytics outcomes of an erasure
+const (
+	erasureAnalyticsNotified = "notified"
+	erasureAnalyticsExported = "exported"
+	erasureAnalyticsFailed   = "failed"
+)
+
+// UserData is a user's data export.
+type UserData struct {
+	UserID       string        `json:"user_id"`
+	ExportedAt   time.Time     `json:"exported_at"`
+	Favorites    []Favorite    `json:"favorites"`
+	Trash        []Favorite    `json:"trash"`
+	Collections  []Collection  `json:"collections"`
+	Subscription *Subscription `json:"subscription"`
+	Preferences  *Preferences  `json:"preferences"`
+	// Webhooks are listed without their secrets
+	Webhooks    []Webhook       `json:"webhooks"`
+	DeadLetters []DeadLetter    `json:"webhook_dead_letters"`
+	Merges      []MergeRecord   `json:"merges"`
+	Erasures    []ErasureRecord `json:"erasures"`
+}
+
+// ErasureRecord is the audit record of an erasure.
+type ErasureRecord struct {
+	ID string `json:"id"`
+	// UserHash is the SHA-256 of the erased user ID
+	UserHash string    `json:"user_hash"`
+	ErasedAt time.Time `json:"erased_at"`
+	// RequestedBy is "self" when the authenticated user erased their own
+	// data, "unauthenticated" otherwise
+	RequestedBy string `json:"requested_by"`
+	Favorites   int    `json:"favorites"`
+	Trashed     int    `json:"trashed"`
+	Collections int    `json:"collections"`
+	Webhooks    int    `json:"webhooks"`
+	DeadLetters int    `json:"dead_letters"`
+	Changes     int    `json:"changes"`
+	Merges      int    `json:"merges"`
+	// Subscription reports whether a digest subscription was removed
+	Subscription bool `json:"subscription"`
+	// Preferences reports whether delivery preferences were removed
+	Preferences bool `json:"preferences"`
+	// Analytics is whether the user_deleted event reached analytics
+	Analytics string `json:"analytics"`
+	Tenant    string `json:"-"`
+}
+
+var (
+	// Erasure audit trail, oldest first; guarded by favoritesMutex
+	erasureRecords []ErasureRecord
+
+	userErasures metric.Int64Counter
+)
+
+func initUserData() {
+	var err error
+	userErasures, err = meter.Int64Counter(
+		"user.erasures",
+		metric.WithDescription("Number of users whose data was erased, by analytics outcome"),
+		metric.WithUnit("{erasure}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create erasures counter", zap.Error(err))
+	}
+}
+
+// userHash identifies an erased user in the audit trail.
+func userHash(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(sum[:])
+}
+
+// exportUserData collects everything stored about userID.
+func exportUserData(ctx context.Context, userID string) UserData {
+	ctx, span := tracer.Start(ctx, "exportUserData")
+	defer span.End()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	data := UserData{
+		UserID:      userID,
+		ExportedAt:  time.Now().UTC(),
+		Favorites:   []Favorite{},
+		Trash:       []Favorite{},
+		Webhooks:    []Webhook{},
+		DeadLetters: []DeadLetter{},
+		Merges:      userMergeRecords(ctx, userID),
+		Erasures:    []ErasureRecord{},
+	}
+
+	favoritesMutex.RLock()
+	for _, fav := range favorites {
+		if !fav.ownedBy(tenant, userID) {
+			continue
+		}
+		if fav.DeletedAt == nil {
+			data.Favorites = append(data.Favorites, *fav)
+		} else {
+			data.Trash = append(data.Trash, *fav)
+		}
+	}
+	data.Collections = userCollections(tenant, userID)
+	hash := userHash(userID)
+	for _, record := range erasureRecords {
+		if record.Tenant == tenant && record.UserHash == hash {
+			data.Erasures = append(data.Erasures, record)
+		}
+	}
+	favoritesMutex.RUnlock()
+
+	subscriptionsMutex.Lock()
+	if sub, ok := subscriptions[subscriptionKey(tenant, userID)]; ok {
+		copied := *sub
+		data.Subscription = &copied
+	}
+	subscriptionsMutex.Unlock()
+
+	preferencesMutex.RLock()
+	if prefs, ok := preferences[subscriptionKey(tenant, userID)]; ok {
+		copied := *prefs
+		data.Preferences = &copied
+	}
+	preferencesMutex.RUnlock()
+
+	webhooksMutex.Lock()
+	for _, w := range webhooks {
+		if w.Tenant == tenant && w.UserID == userID {
+			data.Webhooks = append(data.Webhooks, *w)
+		}
+	}
+	for _, dl := range deadLetters {
+		if dl.Tenant == tenant && dl.UserID == userID {
+			data.DeadLetters = append(data.DeadLetters, dl)
+		}
+	}
+	webhooksMutex.Unlock()
+
+	span.SetAttributes(
+		attribute.Int("export.favorites", len(data.Favorites)),
+		attribute.Int("export.trash", len(data.Trash)),
+		attribute.Int("export.webhooks", len(data.Webhooks)),
+	)
+	return data
+}
+
+// eraseUserData removes everything stored about userID, reports the
+// erasure to analytics and records it in the audit trail.
+func eraseUserData(ctx context.Context, userID, requestedBy string) ErasureRecord {
+	ctx, span := tracer.Start(ctx, "eraseUserData")
+	defer span.End()
+
+	tenant := telemetry.TenantFromContext(ctx)
+	now := time.Now()
+	record := ErasureRecord{
+		UserHash:    userHash(userID),
+		ErasedAt:    now,
+		RequestedBy: requestedBy,
+		Tenant:      tenant,
+	}
+
+	// Webhooks go first, so the deletions below don't trigger deliveries
+	webhooksMutex.Lock()
+	for id, w := range webhooks {
+		if w.Tenant == tenant && w.UserID == userID {
+			delete(webhooks, id)
+			record.Webhooks++
+		}
+	}
+	keptLetters := deadLetters[:0]
+	for _, dl := range deadLetters {
+		if dl.Tenant == tenant && dl.UserID == userID {
+			record.DeadLetters++
+			continue
+		}
+		keptLetters = append(keptLetters, dl)
+	}
+	deadLetters = keptLetters
+	webhooksMutex.Unlock()
+
+	subscriptionsMutex.Lock()
+	key := subscriptionKey(tenant, userID)
+	if _, ok := subscriptions[key]; ok {
+		delete(subscriptions, key)
+		record.Subscription = true
+	}
+	subscriptionsMutex.Unlock()
+
+	preferencesMutex.Lock()
+	if _, ok := preferences[key]; ok {
+		delete(preferences, key)
+		record.Preferences = true
+	}
+	preferencesMutex.Unlock()
+
+	favoritesMutex.Lock()
+	keptChanges := favoriteChanges[:0]
+	for _, change := range favoriteChanges {
+		if change.Favorite.ownedBy(tenant, userID) {
+			record.Changes++
+			continue
+		}
+		keptChanges = append(keptChanges, change)
+	}
+	favoriteChanges = keptChanges
+
+	kept := favorites[:0]
+	for _, fav := range favorites {
+		if !fav.ownedBy(tenant, userID) {
+			kept = append(kept, fav)
+			continue
+		}
+		if fav.DeletedAt == nil {
+			delete(favoritesByContent, favoriteContentKey(tenant, userID, fav.ContentHash))
+			recordChange(changeDeleted, &Favorite{ID: fav.ID, UserID: userID, Tenant: tenant, DeletedAt: &now, Version: fav.Version})
+			record.Favorites++
+		} else {
+			record.Trashed++
+		}
+	}
+	for i := len(kept); i < len(favorites); i++ {
+		favorites[i] = nil
+	}
+	favorites = kept
+	record.Collections = dropUserCollections(tenant, userID)
+
+	for i := range mergeRecords {
+		m := &mergeRecords[i]
+		if m.Tenant != tenant || (m.FromUserID != userID && m.ToUserID != userID) {
+			continue
+		}
+		if m.FromUserID == userID {
+			m.FromUserID = erasedUserID
+		}
+		if m.ToUserID == userID {
+			m.ToUserID = erasedUserID
+		}
+		record.Merges++
+	}
+	favoritesMutex.Unlock()
+
+	record.Analytics = notifyUserErased(ctx, userID)
+
+	favoritesMutex.Lock()
+	record.ID = ids.NewAt(now)
+	erasureRecords = append(erasureRecords, record)
+	if len(erasureRecords) > maxErasureRecords {
+		erasureRecords = erasureRecords[len(erasureRecords)-maxErasureRecords:]
+	}
+	favoritesMutex.Unlock()
+
+	userErasures.Add(ctx, 1, metric.WithAttributes(attribute.String("analytics", record.Analytics)), telemetry.ContextAttrs(ctx))
+	span.SetAttributes(
+		attribute.String("erasure.id", record.ID),
+		attribute.Int("erasure.favorites", record.Favorites),
+		attribute.Int("erasure.trashed", record.Trashed),
+		attribute.String("erasure.analytics", record.Analytics),
+	)
+	loggerFor(ctx).Info("User data erased",
+		zap.String("erasure_id", record.ID),
+		zap.String("user_hash", record.UserHash),
+		zap.String("requested_by", record.RequestedBy),
+		zap.Int("favorites", record.Favorites),
+		zap.Int("trashed", record.Trashed),
+		zap.Int("collections", record.Collections),
+		zap.Int("webhooks", record.Webhooks),
+		zap.Int("dead_letters", record.DeadLetters),
+		zap.Int("changes", record.Changes),
+		zap.Int("merges", record.Merges),
+		zap.Bool("subscription", record.Subscription),
+		zap.Bool("preferences", record.Preferences),
+		zap.String("analytics", record.Analytics),
+	)
+	return record
+}
+
+// UserDeletedEvent is the payload reported to analytics when a user's
+// data is erased.
+type UserDeletedEvent struct {
+	UserID string `json:"user_id"`
+}
+
+// notifyUserErased reports an erasure to analytics and returns the
+// outcome. Unlike favorites it is sent before responding, so the audit
+// record says whether analytics was told.
+func notifyUserErased(ctx context.Context, userID string) string {
+	payload := UserDeletedEvent{UserID: userID}
+	if analyticsOverOTLP {
+		telemetry.RecordAnalyticsEvent(ctx, tracer, "user_deleted", payload)
+		return erasureAnalyticsExported
+	}
+
+	body, err := json.Marshal(AnalyticsEvent{
+		EventType:     "user_deleted",
+		SchemaVersion: analyticsSchemaVersion,
+		Payload:       payload,
+	})
+	if err == nil {
+		err = postToAnalytics(ctx, "/internal/events", body)
+	}
+	if err != nil {
+		loggerFor(ctx).Warn("Failed to report erasure to analytics", zap.Error(err))
+		return erasureAnalyticsFailed
+	}
+	return erasureAnalyticsNotified
+}
+
+// dataSubject returns the user a data request is for, or aborts: an
+// authenticated caller can only ask about themselves.
+func dataSubject(c *gin.Context) (userID, requestedBy string, ok bool) {
+	userID = c.Param("id")
+	requestedBy = "unauthenticated"
+	if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+		if authenticated != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "can only access the authenticated user's data"})
+			return "", "", false
+		}
+		requestedBy = "self"
+	}
+	return userID, requestedBy, true
+}
+
+// registerUserDataRoutes installs the data export and erasure endpoints.
+func registerUserDataRoutes(r *gin.Engine) {
+	r.GET("/api/v1/users/:id/data", func(c *gin.Context) {
+		userID, _, ok := dataSubject(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, exportUserData(c.Request.Context(), userID))
+	})
+
+	r.DELETE("/api/v1/users/:id/data", func(c *gin.Context) {
+		userID, requestedBy, ok := dataSubject(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, eraseUserData(c.Request.Context(), userID, requestedBy))
+	})
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/navyn13/microservice-joke/pkg/middleware"
+	"github.com/navyn13/microservice-joke/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// Webhooks let integrators follow a user's favorites without polling the
+// change log. Every change recorded in the change log (see changes.go) is
+// turned into a favorite.added or favorite.removed event for each of the
+// user's webhooks subscribed to it; restores and merges count as adds and
+// removes like they do there.
+//
+// Events are queued and POSTed by a pool of workers. Each delivery is
+// signed with the webhook's secret:
+//
+//	X-Webhook-Timestamp: unix seconds
+//	X-Webhook-Signature: sha256=HEX(HMAC-SHA256(secret, TIMESTAMP + "." + BODY))
+//
+// X-Webhook-Delivery identifies the event and stays the same across
+// retries, so receivers can drop duplicates. Failed deliveries are retried
+// with exponential backoff up to WEBHOOK_MAX_ATTEMPTS; deliveries that
+// still fail, are rejected with a 4xx other than 408 or 429, or don't fit
+// in the queue are dead-lettered: logged and kept in a bounded list the
+// user can inspect.
+//
+// Webhook URLs are chosen by users, so they must not reach into the
+// cluster: hosts must resolve to public addresses only, which is checked
+// when the webhook is registered and again on every connection, so a host
+// can't be re-pointed in between. Redirects are not followed. Digest
+// webhooks (see digest.go) are held to the same rules.
+
+// Webhook event types
+const (
+	webhookFavoriteAdded   = "favorite.added"
+	webhookFavoriteRemoved = "favorite.removed"
+)
+
+// webhookEventTypes maps change log entries to the events they trigger
+var webhookEventTypes = map[string]string{
+	changeAdded:   webhookFavoriteAdded,
+	changeDeleted: webhookFavoriteRemoved,
+}
+
+const (
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-ID"
+
+	maxWebhooksPerUser = 10
+	// webhookMaxBackoff caps the delay between delivery attempts
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+// Webhook is an integrator's endpoint for a user's favorite events.
+type Webhook struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+	Secret    string    `json:"-"`
+	Tenant    string    `json:"-"`
+}
+
+// subscribed reports whether the webhook wants events of eventType.
+func (w *Webhook) subscribed(eventType string) bool {
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookRequest struct {
+	UserID string `json:"user_id"`
+	URL    string `json:"url" binding:"required"`
+	// Events defaults to every event type
+	Events []string `json:"events"`
+	// Secret signs deliveries; one is generated when it is left out
+	Secret string `json:"secret"`
+}
+
+// RegisteredWebhook is returned once, on registration: the secret is
+// never shown again.
+type RegisteredWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// WebhookEvent is the body POSTed to webhooks.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Favorite  Favorite  `json:"favorite"`
+}
+
+// webhookDelivery is an event on its way to one webhook.
+type webhookDelivery struct {
+	webhook  *Webhook
+	event    WebhookEvent
+	body     []byte
+	attempts int
+}
+
+// DeadLetter is a delivery given up on.
+type DeadLetter struct {
+	WebhookID string       `json:"webhook_id"`
+	URL       string       `json:"url"`
+	Event     WebhookEvent `json:"event"`
+	Attempts  int          `json:"attempts"`
+	Reason    string       `json:"reason"`
+	FailedAt  time.Time    `json:"failed_at"`
+	UserID    string       `json:"-"`
+	Tenant    string       `json:"-"`
+}
+
+var (
+	// Webhooks keyed by ID
+	webhooks      map[string]*Webhook
+	webhooksMutex sync.Mutex
+
+	webhookQueue chan *webhookDelivery
+
+	// Dead letters, oldest first; guarded by webhooksMutex
+	deadLetters    []DeadLetter
+	deadLetterSize = 100
+
+	webhookClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: checkWebhookDial,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	webhookMaxAttempts  = 6
+	webhookRetryBackoff = 2 * time.Second
+
+	webhookDeliveries metric.Int64Counter
+
+	// webhookAllowPrivate lets webhooks reach private addresses, for local
+	// development only
+	webhookAllowPrivate bool
+	// webhookBlockedPrefixes are refused besides the non-public ranges,
+	// e.g. a cluster's service CIDR when it uses public addresses
+	webhookBlockedPrefixes []netip.Prefix
+
+	errWebhookAddress = errors.New("webhook URL must resolve to public addresses only")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), often
+// used for pod and service addresses
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func initWebhooks() {
+	webhooks = make(map[string]*Webhook)
+
+	queueSize := 1000
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_QUEUE_SIZE")); err == nil && v > 0 {
+		queueSize = v
+	}
+	workers := 4
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS")); err == nil && v > 0 {
+		workers = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && v > 0 {
+		webhookMaxAttempts = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("WEBHOOK_RETRY_BACKOFF")); err == nil && v > 0 {
+		webhookRetryBackoff = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT")); err == nil && v > 0 {
+		webhookClient.Timeout = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_DEAD_LETTER_SIZE")); err == nil && v > 0 {
+		deadLetterSize = v
+	}
+	webhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE_ADDRESSES") == "true"
+	if webhookAllowPrivate {
+		logger.Warn("WEBHOOK_ALLOW_PRIVATE_ADDRESSES set, webhooks may reach internal addresses")
+	}
+	for _, v := range strings.Split(os.Getenv("WEBHOOK_BLOCKED_CIDRS"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			logger.Fatal("Invalid CIDR in WEBHOOK_BLOCKED_CIDRS", zap.String("cidr", v), zap.Error(err))
+		}
+		webhookBlockedPrefixes = append(webhookBlockedPrefixes, prefix.Masked())
+	}
+
+	var err error
+	webhookDeliveries, err = meter.Int64Counter(
+		"user.webhooks.deliveries",
+		metric.WithDescription("Number of webhook delivery attempts, by outcome"),
+		metric.WithUnit("{delivery}"),
+	)
+	if err != nil {
+		logger.Fatal("Failed to create webhook deliveries counter", zap.Error(err))
+	}
+
+	webhookQueue = make(chan *webhookDelivery, queueSize)
+	for i := 0; i < workers; i++ {
+		go webhookWorker()
+	}
+}
+
+// webhookAddressAllowed reports whether webhooks may connect to ip.
+func webhookAddressAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range webhookBlockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if webhookAllowPrivate {
+		return true
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookDial refuses connections to addresses webhooks may not
+// reach; it sees the address actually dialed, after DNS resolution.
+func checkWebhookDial(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !webhookAddressAllowed(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// checkWebhookURL validates a webhook URL on registration: an http(s) URL
+// whose host is not a cluster name and resolves to allowed addresses only.
+func checkWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook URL must be an http(s) URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !webhookAddressAllowed(ip) {
+			return errWebhookAddress
+		}
+		return nil
+	}
+	// Single-label and cluster names resolve to services in the cluster
+	if !webhookAllowPrivate && (!strings.Contains(host, ".") || strings.HasSuffix(host, ".local") ||
+		strings.HasSuffix(host, ".internal") || strings.HasSuffix(host, ".svc")) {
+		return errWebhookAddress
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("webhook host %s does not resolve", host)
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// queueWebhookEvents queues the event of a change log entry for every
+// webhook of the favorite's user subscribed to it. It never blocks, as
+// callers hold favoritesMutex.
+func queueWebhookEvents(changeType string, fav *Favorite, at time.Time) {
+	eventType, ok := webhookEventTypes[changeType]
+	if !ok {
+		return
+	}
+
+	webhooksMutex.Lock()
+	var targets []*Webhook
+	for _, w := range webhooks {
+		if w.Tenant == fav.Tenant && w.UserID == fav.UserID && w.subscribed(eventType) {
+			targets = append(targets, w)
+		}
+	}
+	webhooksMutex.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	event := WebhookEvent{
+		ID:        randomHex(12),
+		Type:      eventType,
+		CreatedAt: at,
+		Favorite:  *fav,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, w := range targets {
+		enqueueDelivery(&webhookDelivery{webhook: w, event: event, body: body})
+	}
+}
+
+// enqueueDelivery queues d, dead-lettering it if the queue is full.
+func enqueueDelivery(d *webhookDelivery) {
+	select {
+	case webhookQueue <- d:
+	default:
+		deadLetter(d, "delivery queue full")
+	}
+}
+
+func webhookWorker() {
+	for d := range webhookQueue {
+		attemptDelivery(d)
+	}
+}
+
+// attemptDelivery makes one delivery attempt and schedules a retry or
+// dead-letters the delivery if it fails.
+func attemptDelivery(d *webhookDelivery) {
+	ctx, span := tracer.Start(context.Background(), "deliverFavoriteWebhook")
+	defer span.End()
+
+	// Deliveries to webhooks removed since are dropped
+	webhooksMutex.Lock()
+	_, registered := webhooks[d.webhook.ID]
+	webhooksMutex.Unlock()
+	if !registered {
+		return
+	}
+
+	d.attempts++
+	span.SetAttributes(
+		attribute.String("webhook.id", d.webhook.ID),
+		attribute.String("webhook.event", d.event.Type),
+		attribute.Int("webhook.attempt", d.attempts),
+	)
+
+	status, err := postWebhook(ctx, d)
+	if err == nil {
+		webhookDeliveries.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", "delivered")))
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	permanent := status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+	if permanent || errors.Is(err, errWebhookAddress) || d.attempts >= webhookMaxAttempts {
+		deadLetter(d, err.Error())
+		return
+	}
+
+	webhookDeliveries.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", "retried")))
+	backoff := min(webhookRetryBackoff<<(d.attempts-1), webhookMaxBackoff)
+	logger.Warn("Webhook delivery failed, retrying",
+		zap.String("webhook_id", d.webhook.ID),
+		zap.String("delivery_id", d.event.ID),
+		zap.Int("attempt", d.attempts),
+		zap.Duration("backoff", backoff),
+		zap.Error(err),
+	)
+	time.AfterFunc(backoff, func() { enqueueDelivery(d) })
+}
+
+// postWebhook sends a signed delivery. It returns the response status, if
+// there was a response.
+func postWebhook(ctx context.Context, d *webhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, d.webhook.ID)
+	req.Header.Set(webhookDeliveryHeader, d.event.ID)
+	req.Header.Set(webhookEventHeader, d.event.Type)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(d.webhook.Secret, timestamp, d.body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of "TIMESTAMP.BODY" under secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter gives up on a delivery.
+func deadLetter(d *webhookDelivery, reason string) {
+	webhookDeliveries.Add(context.Background(), 1, metric.WithAttributes(attribute.String("outcome", "dead_lettered")))
+	logger.Error("Webhook delivery dead-lettered",
+		zap.String("webhook_id", d.webhook.ID),
+		zap.String("delivery_id", d.event.ID),
+		zap.String("event", d.event.Type),
+		zap.String("url", d.webhook.URL),
+		zap.Int("attempts", d.attempts),
+		zap.String("reason", reason),
+	)
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	deadLetters = append(deadLetters, DeadLetter{
+		WebhookID: d.webhook.ID,
+		URL:       d.webhook.URL,
+		Event:     d.event,
+		Attempts:  d.attempts,
+		Reason:    reason,
+		FailedAt:  time.Now(),
+		UserID:    d.webhook.UserID,
+		Tenant:    d.webhook.Tenant,
+	})
+	if len(deadLetters) > deadLetterSize {
+		trimmed := make([]DeadLetter, deadLetterSize)
+		copy(trimmed, deadLetters[len(deadLetters)-deadLetterSize:])
+		deadLetters = trimmed
+	}
+}
+
+// registerWebhookRoutes installs the webhook endpoints.
+func registerWebhookRoutes(r *gin.Engine) {
+	r.POST("/api/v1/webhooks", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req WebhookRequest
+		if !middleware.BindJSON(c, &req) {
+			return
+		}
+		if authenticated := c.GetHeader(userIDHeader); authenticated != "" {
+			req.UserID = authenticated
+		}
+		if req.UserID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		if err := checkWebhookURL(ctx, req.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Events) == 0 {
+			req.Events = []string{webhookFavoriteAdded, webhookFavoriteRemoved}
+		}
+		for _, e := range req.Events {
+			if e != webhookFavoriteAdded && e != webhookFavoriteRemoved {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("unknown event %q, must be %s or %s", e, webhookFavoriteAdded, webhookFavoriteRemoved),
+				})
+				return
+			}
+		}
+		if req.Secret == "" {
+			req.Secret = randomHex(32)
+		}
+
+		w := &Webhook{
+			ID:        "wh_" + randomHex(8),
+			UserID:    req.UserID,
+			URL:       req.URL,
+			Events:    req.Events,
+			CreatedAt: time.Now(),
+			Secret:    req.Secret,
+			Tenant:    telemetry.TenantFromContext(ctx),
+		}
+
+		webhooksMutex.Lock()
+		count := 0
+		for _, existing := range webhooks {
+			if existing.Tenant == w.Tenant && existing.UserID == w.UserID {
+				count++
+			}
+		}
+		if count >= maxWebhooksPerUser {
+			webhooksMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("a user can register at most %d webhooks", maxWebhooksPerUser),
+			})
+			return
+		}
+		webhooks[w.ID] = w
+		webhooksMutex.Unlock()
+
+		loggerFor(ctx).Info("Webhook registered",
+			zap.String("webhook_id", w.ID),
+			zap.String("user_id", w.UserID),
+			zap.Strings("events", w.Events),
+		)
+		c.JSON(http.StatusCreated, RegisteredWebhook{Webhook: *w, Secret: w.Secret})
+	})
+
+	r.GET("/api/v1/webhooks", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		tenant := telemetry.TenantFromContext(ctx)
+
+		webhooksMutex.Lock()
+		listed := []Webhook{}
+		for _, w := range webhooks {
+			if w.Tenant == tenant && w.UserID == userID {
+				listed = append(listed, *w)
+			}
+		}
+		webhooksMutex.Unlock()
+
+		sort.Slice(listed, func(i, j int) bool { return listed[i].CreatedAt.Before(listed[j].CreatedAt) })
+		c.JSON(http.StatusOK, gin.H{"webhooks": listed, "count": len(listed)})
+	})
+
+	r.DELETE("/api/v1/webhooks/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		id := c.Param("id")
+
+		webhooksMutex.Lock()
+		w, ok := webhooks[id]
+		owned := ok && w.Tenant == telemetry.TenantFromContext(ctx) && w.UserID == userID
+		if owned {
+			delete(webhooks, id)
+		}
+		webhooksMutex.Unlock()
+
+		if !owned {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+			return
+		}
+
+		loggerFor(ctx).Info("Webhook removed",
+			zap.String("webhook_id", id),
+			zap.String("user_id", userID),
+		)
+		c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	})
+
+	r.GET("/api/v1/webhooks/dead-letters", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		userID := requestUserID(c)
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return
+		}
+		tenant := telemetry.TenantFromContext(ctx)
+
+		webhooksMutex.Lock()
+		listed := []DeadLetter{}
+		for _, dl := range deadLetters {
+			if dl.Tenant == tenant && dl.UserID == userID {
+				listed = append(listed, dl)
+			}
+		}
+		webhooksMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{"dead_letters": listed, "count": len(listed)})
+	})
+}